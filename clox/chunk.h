@@ -42,6 +42,10 @@ typedef enum {
   OP_INHERIT,
   OP_GET_SUPER,
   OP_SUPER_INVOKE,
+  // Added after the book's instructions so .loxc files written before them
+  // keep their numbering. `a >= b` can't be `!(a < b)`, which is true for NaN.
+  OP_GREATER_EQUAL,
+  OP_LESS_EQUAL,
 } OpCode;
 
 typedef struct {
@@ -1,6 +1,9 @@
 #include "common.h"
 #include "chunk.h"
 #include "vm.h"
+#include "compiler.h"
+#include "serialize.h"
+#include "memory.h"
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
@@ -17,6 +20,9 @@
 
 */
 
+// Set by --mem-stats, which prints the heap's numbers after a script runs
+static bool showMemStats = false;
+
 static void repl() {
   char line[1024];
   for (;;) {
@@ -62,21 +68,90 @@ static void runFile(const char* path) {
   char* source = readFile(path);
   InterpretResult result = interpret(source);
   free(source); 
+  if (showMemStats) printMemStats(stderr);
 
   if (result == INTERPRET_COMPILE_ERROR) exit(65);
   if (result == INTERPRET_RUNTIME_ERROR) exit(70);
 }
 
+static bool hasExtension(const char* path, const char* extension) {
+  size_t pathLength = strlen(path);
+  size_t extensionLength = strlen(extension);
+  return pathLength >= extensionLength &&
+         strcmp(path + pathLength - extensionLength, extension) == 0;
+}
+
+static void runChunkFile(const char* path) {
+  ObjFunction* script = readChunkFile(path);
+  if (script == NULL) exit(65);
+  InterpretResult result = interpretFunction(script);
+  if (showMemStats) printMemStats(stderr);
+  if (result == INTERPRET_RUNTIME_ERROR) exit(70);
+}
+
+// Without -o the output goes next to the script: foo.lox -> foo.loxc
+static void compileFile(const char* path, const char* output) {
+  char* source = readFile(path);
+  ObjFunction* script = compile(source);
+  free(source);
+  if (script == NULL) exit(65);
+
+  char* defaultOutput = NULL;
+  if (output == NULL) {
+    defaultOutput = (char*)malloc(strlen(path) + sizeof(".loxc"));
+    if (defaultOutput == NULL) {
+      fprintf(stderr, "Not enough memory to name the output file.\n");
+      exit(74);
+    }
+    strcpy(defaultOutput, path);
+    strcat(defaultOutput, hasExtension(path, ".lox") ? "c" : ".loxc");
+    output = defaultOutput;
+  }
+  bool written = writeChunkFile(script, output);
+  free(defaultOutput);
+  if (!written) exit(74);
+}
+
+static void usage() {
+  fprintf(stderr, "Usage: clox [--mem-stats] [path]\n");
+  fprintf(stderr, "       clox compile <script.lox> [-o <script.loxc>]\n");
+  fprintf(stderr, "       clox run <script.lox|script.loxc>\n");
+  exit(64);
+}
+
 int main(int argc, const char* argv[]) {
   initVM();
 
+  if (argc >= 2 && strcmp(argv[1], "--mem-stats") == 0) {
+    showMemStats = true;
+    argv++;
+    argc--;
+  }
+
   if (argc == 1) {
     repl();
+  } else if (argc >= 3 && strcmp(argv[1], "compile") == 0) {
+    if (argc == 3) {
+      compileFile(argv[2], NULL);
+    } else if (argc == 5 && strcmp(argv[3], "-o") == 0) {
+      compileFile(argv[2], argv[4]);
+    } else {
+      usage();
+    }
+  } else if (argc == 3 && strcmp(argv[1], "run") == 0) {
+    if (hasExtension(argv[2], ".loxc")) {
+      runChunkFile(argv[2]);
+    } else {
+      runFile(argv[2]);
+    }
   } else if (argc == 2) {
-    runFile(argv[1]);
+    if (hasExtension(argv[1], ".loxc")) {
+      runChunkFile(argv[1]);
+    } else {
+      runFile(argv[1]);
+    }
   } else {
-    fprintf(stderr, "Usage: clox [path]\n");
-    exit(64);
+    usage();
   }
 
   // Chunk chunk;
@@ -13,14 +13,16 @@
 
 void* reallocate(void* pointer, size_t oldSize, size_t newSize) {
   vm.bytesAllocated += newSize - oldSize;
+  // Only growing can start a collection: freeing happens during one, and
+  // starting another from inside its sweep frees objects twice
   if (newSize > oldSize) {
 #ifdef DEBUG_STRESS_GC
     collectGarbage();
 #endif
-  }
 
-  if (vm.bytesAllocated > vm.nextGC) {
-    collectGarbage();
+    if (vm.bytesAllocated > vm.nextGC) {
+      collectGarbage();
+    }
   }
 
   if (newSize == 0) {
@@ -231,8 +233,8 @@ static void sweep() {
 void collectGarbage() {
 #ifdef DEBUG_LOG_GC
   printf("-- gc begin\n");
-  size_t before = vm.bytesAllocated;
 #endif
+  size_t before = vm.bytesAllocated;
 
   markRoots();
   traceReferences();
@@ -240,6 +242,8 @@ void collectGarbage() {
   sweep();
 
   vm.nextGC = vm.bytesAllocated * GC_HEAP_GROW_FACTOR;
+  vm.collections++;
+  vm.bytesCollected += before - vm.bytesAllocated;
 
 #ifdef DEBUG_LOG_GC
   printf("-- gc end\n");
@@ -248,3 +252,44 @@ void collectGarbage() {
          vm.nextGC);
 #endif
 }
+
+MemStats memStats() {
+  MemStats stats = {0};
+  stats.bytesAllocated = vm.bytesAllocated;
+  stats.nextGC = vm.nextGC;
+  stats.collections = vm.collections;
+  stats.bytesCollected = vm.bytesCollected;
+  for (Obj* object = vm.objects; object != NULL; object = object->next) {
+    stats.counts[object->type]++;
+    stats.objects++;
+  }
+  return stats;
+}
+
+// The names memStats() gives the counts, which --mem-stats prints too
+const char* objTypeName(ObjType type) {
+  switch (type) {
+    case OBJ_STRING: return "strings";
+    case OBJ_FUNCTION: return "functions";
+    case OBJ_NATIVE: return "natives";
+    case OBJ_CLOSURE: return "closures";
+    case OBJ_UPVALUE: return "upvalues";
+    case OBJ_CLASS: return "classes";
+    case OBJ_INSTANCE: return "instances";
+    case OBJ_BOUND_METHOD: return "boundMethods";
+  }
+  return "unknown";
+}
+
+void printMemStats(FILE* file) {
+  MemStats stats = memStats();
+  fprintf(file, "-- memory --\n");
+  fprintf(file, "%-15s %zu\n", "heapBytes", stats.bytesAllocated);
+  fprintf(file, "%-15s %zu\n", "nextGC", stats.nextGC);
+  fprintf(file, "%-15s %d\n", "collections", stats.collections);
+  fprintf(file, "%-15s %zu\n", "bytesCollected", stats.bytesCollected);
+  fprintf(file, "%-15s %d\n", "objects", stats.objects);
+  for (int type = 0; type <= OBJ_BOUND_METHOD; type++) {
+    fprintf(file, "%-15s %d\n", objTypeName((ObjType)type), stats.counts[type]);
+  }
+}
@@ -1,6 +1,8 @@
 #ifndef clox_memory_h
 #define clox_memory_h
 
+#include <stdio.h>
+
 #include "common.h"
 #include "object.h"
 
@@ -25,4 +27,19 @@ void markValue(Value value);
 void markObject(Obj* object);
 void collectGarbage();
 
+// A snapshot of the heap for memStats() and --mem-stats
+typedef struct {
+  size_t bytesAllocated;
+  size_t nextGC;
+  int collections;
+  size_t bytesCollected;
+  int objects;
+  // Objects on the heap by ObjType, garbage included until it is collected
+  int counts[OBJ_BOUND_METHOD + 1];
+} MemStats;
+
+MemStats memStats();
+const char* objTypeName(ObjType type);
+void printMemStats(FILE* file);
+
 #endif
\ No newline at end of file
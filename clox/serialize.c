@@ -0,0 +1,391 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "serialize.h"
+#include "memory.h"
+#include "vm.h"
+
+typedef enum {
+  TAG_NIL_CONSTANT,
+  TAG_FALSE_CONSTANT,
+  TAG_TRUE_CONSTANT,
+  TAG_NUMBER_CONSTANT,
+  TAG_STRING_CONSTANT,
+  TAG_FUNCTION_CONSTANT,
+} ConstantTag;
+
+// Functions nested deeper than this are rejected rather than recursed into
+#define MAX_NESTING 256
+
+/// Writing
+
+static void writeByte(FILE* file, uint8_t byte) {
+  fputc(byte, file);
+}
+
+static void writeU16(FILE* file, uint16_t value) {
+  writeByte(file, value & 0xff);
+  writeByte(file, value >> 8);
+}
+
+static void writeU32(FILE* file, uint32_t value) {
+  for (int i = 0; i < 4; i++) {
+    writeByte(file, (value >> (8 * i)) & 0xff);
+  }
+}
+
+static void writeString(FILE* file, ObjString* string) {
+  writeU32(file, string->length);
+  fwrite(string->chars, sizeof(char), string->length, file);
+}
+
+static void writeFunction(FILE* file, ObjFunction* function);
+
+static void writeConstant(FILE* file, Value value) {
+  if (IS_NIL(value)) {
+    writeByte(file, TAG_NIL_CONSTANT);
+  } else if (IS_BOOL(value)) {
+    writeByte(file, AS_BOOL(value) ? TAG_TRUE_CONSTANT : TAG_FALSE_CONSTANT);
+  } else if (IS_NUMBER(value)) {
+    double number = AS_NUMBER(value);
+    uint64_t bits;
+    memcpy(&bits, &number, sizeof(bits));
+    writeByte(file, TAG_NUMBER_CONSTANT);
+    writeU32(file, (uint32_t)bits);
+    writeU32(file, (uint32_t)(bits >> 32));
+  } else if (IS_STRING(value)) {
+    writeByte(file, TAG_STRING_CONSTANT);
+    writeString(file, AS_STRING(value));
+  } else {
+    // The compiler only ever emits the constants above and functions
+    writeByte(file, TAG_FUNCTION_CONSTANT);
+    writeFunction(file, AS_FUNCTION(value));
+  }
+}
+
+static void writeFunction(FILE* file, ObjFunction* function) {
+  writeByte(file, function->arity);
+  writeU16(file, function->upvalueCount);
+  if (function->name == NULL) {
+    writeByte(file, 0);
+  } else {
+    writeByte(file, 1);
+    writeString(file, function->name);
+  }
+
+  Chunk* chunk = &function->chunk;
+  writeU32(file, chunk->count);
+  fwrite(chunk->code, sizeof(uint8_t), chunk->count, file);
+  for (int i = 0; i < chunk->count; i++) {
+    writeU32(file, chunk->lines[i]);
+  }
+  writeU32(file, chunk->constants.count);
+  for (int i = 0; i < chunk->constants.count; i++) {
+    writeConstant(file, chunk->constants.values[i]);
+  }
+}
+
+bool writeChunkFile(ObjFunction* script, const char* path) {
+  FILE* file = fopen(path, "wb");
+  if (file == NULL) {
+    fprintf(stderr, "Could not open file \"%s\" for writing.\n", path);
+    return false;
+  }
+
+  fwrite(LOXC_MAGIC, sizeof(char), 4, file);
+  writeU16(file, LOXC_VERSION);
+  writeFunction(file, script);
+
+  bool failed = ferror(file);
+  if (fclose(file) != 0 || failed) {
+    fprintf(stderr, "Could not write file \"%s\".\n", path);
+    return false;
+  }
+  return true;
+}
+
+/// Reading
+
+typedef struct {
+  const uint8_t* data;
+  size_t size;
+  size_t position;
+  // Set by the first problem found; later reads return zeros
+  const char* error;
+} Reader;
+
+static void fail(Reader* reader, const char* message) {
+  if (reader->error == NULL) reader->error = message;
+}
+
+static bool has(Reader* reader, size_t count) {
+  if (reader->error != NULL) return false;
+  if (reader->size - reader->position < count) {
+    fail(reader, "file is truncated");
+    return false;
+  }
+  return true;
+}
+
+static uint8_t readByte(Reader* reader) {
+  if (!has(reader, 1)) return 0;
+  return reader->data[reader->position++];
+}
+
+static uint16_t readU16(Reader* reader) {
+  uint16_t low = readByte(reader);
+  return low | (uint16_t)readByte(reader) << 8;
+}
+
+static uint32_t readU32(Reader* reader) {
+  uint32_t value = 0;
+  for (int i = 0; i < 4; i++) {
+    value |= (uint32_t)readByte(reader) << (8 * i);
+  }
+  return value;
+}
+
+static ObjString* readString(Reader* reader) {
+  uint32_t length = readU32(reader);
+  if (!has(reader, length)) return NULL;
+  ObjString* string = copyString(
+      (const char*)reader->data + reader->position, length);
+  reader->position += length;
+  return string;
+}
+
+static bool isStringConstant(Chunk* chunk, int index) {
+  return index < chunk->constants.count &&
+         IS_STRING(chunk->constants.values[index]);
+}
+
+// Walks the code the way the VM will, checking that jumps land inside the
+// chunk and that constant and upvalue operands index something that exists.
+// Local slots aren't checked: how many locals are live at an instruction
+// isn't in the file, so a damaged one can still read past a frame's locals.
+static const char* checkCode(ObjFunction* function) {
+  Chunk* chunk = &function->chunk;
+  int offset = 0;
+  while (offset < chunk->count) {
+    uint8_t instruction = chunk->code[offset];
+    int length = 1;
+    switch (instruction) {
+      case OP_NIL: case OP_TRUE: case OP_FALSE: case OP_EQUAL:
+      case OP_GREATER: case OP_LESS: case OP_RETURN: case OP_ADD:
+      case OP_SUBTRACT: case OP_MULTIPLY: case OP_DIVIDE: case OP_NOT:
+      case OP_NEGATE: case OP_PRINT: case OP_POP: case OP_CLOSE_UPVALUE:
+      case OP_INHERIT: case OP_GREATER_EQUAL: case OP_LESS_EQUAL:
+        break;
+      case OP_GET_LOCAL: case OP_SET_LOCAL: case OP_CALL:
+        length = 2;
+        break;
+      case OP_GET_UPVALUE: case OP_SET_UPVALUE:
+        length = 2;
+        if (offset + 1 < chunk->count &&
+            chunk->code[offset + 1] >= function->upvalueCount) {
+          return "upvalue index out of range";
+        }
+        break;
+      case OP_CONSTANT:
+        length = 2;
+        if (offset + 1 < chunk->count &&
+            chunk->code[offset + 1] >= chunk->constants.count) {
+          return "constant index out of range";
+        }
+        break;
+      case OP_DEFINE_GLOBAL: case OP_GET_GLOBAL: case OP_SET_GLOBAL:
+      case OP_CLASS: case OP_GET_PROPERTY: case OP_SET_PROPERTY:
+      case OP_METHOD: case OP_GET_SUPER:
+        length = 2;
+        if (offset + 1 < chunk->count &&
+            !isStringConstant(chunk, chunk->code[offset + 1])) {
+          return "name operand is not a string constant";
+        }
+        break;
+      case OP_INVOKE: case OP_SUPER_INVOKE:
+        length = 3;
+        if (offset + 1 < chunk->count &&
+            !isStringConstant(chunk, chunk->code[offset + 1])) {
+          return "name operand is not a string constant";
+        }
+        break;
+      case OP_JUMP: case OP_JUMP_IF_FALSE: case OP_LOOP: {
+        length = 3;
+        if (offset + 2 >= chunk->count) break;
+        int jump = (chunk->code[offset + 1] << 8) | chunk->code[offset + 2];
+        int target = instruction == OP_LOOP ? offset + 3 - jump
+                                            : offset + 3 + jump;
+        if (target < 0 || target > chunk->count) {
+          return "jump target out of range";
+        }
+        break;
+      }
+      case OP_CLOSURE: {
+        if (offset + 1 >= chunk->count) {
+          length = 2;
+          break;
+        }
+        uint8_t constant = chunk->code[offset + 1];
+        if (constant >= chunk->constants.count ||
+            !IS_FUNCTION(chunk->constants.values[constant])) {
+          return "closure operand is not a function constant";
+        }
+        length = 2 + 2 * AS_FUNCTION(chunk->constants.values[constant])
+                             ->upvalueCount;
+        // Each upvalue is an isLocal flag and an index; one that isn't local
+        // is taken from this function's own upvalues
+        for (int i = offset + 2; i + 1 < offset + length &&
+                                 i + 1 < chunk->count; i += 2) {
+          uint8_t isLocal = chunk->code[i];
+          if (isLocal > 1) return "bad upvalue flag";
+          if (!isLocal && chunk->code[i + 1] >= function->upvalueCount) {
+            return "upvalue index out of range";
+          }
+        }
+        break;
+      }
+      default:
+        return "unknown opcode";
+    }
+    if (offset + length > chunk->count) return "instruction is cut off";
+    offset += length;
+  }
+  return NULL;
+}
+
+// Leaves the function on the VM stack so the collector can see it while the
+// rest of the file is read; the caller pops it
+static ObjFunction* readFunction(Reader* reader, int depth) {
+  ObjFunction* function = newFunction();
+  push(OBJ_VAL(function));
+  if (depth > MAX_NESTING) {
+    fail(reader, "functions are nested too deeply");
+    return function;
+  }
+
+  function->arity = readByte(reader);
+  function->upvalueCount = readU16(reader);
+  if (function->upvalueCount > UINT8_COUNT) {
+    fail(reader, "too many upvalues");
+  }
+  uint8_t hasName = readByte(reader);
+  if (hasName == 1) {
+    function->name = readString(reader);
+  } else if (hasName != 0) {
+    fail(reader, "bad function name");
+  }
+
+  uint32_t codeCount = readU32(reader);
+  // Each byte of code comes with four bytes of line info
+  if (!has(reader, (size_t)codeCount * 5)) return function;
+  const uint8_t* code = reader->data + reader->position;
+  reader->position += codeCount;
+  for (uint32_t i = 0; i < codeCount; i++) {
+    writeChunk(&function->chunk, code[i], readU32(reader));
+  }
+
+  uint32_t constantCount = readU32(reader);
+  if (constantCount > UINT8_COUNT) {
+    fail(reader, "too many constants");
+  }
+  for (uint32_t i = 0; i < constantCount && reader->error == NULL; i++) {
+    switch (readByte(reader)) {
+      case TAG_NIL_CONSTANT:
+        addConstant(&function->chunk, NIL_VAL);
+        break;
+      case TAG_FALSE_CONSTANT:
+        addConstant(&function->chunk, BOOL_VAL(false));
+        break;
+      case TAG_TRUE_CONSTANT:
+        addConstant(&function->chunk, BOOL_VAL(true));
+        break;
+      case TAG_NUMBER_CONSTANT: {
+        uint64_t bits = readU32(reader);
+        bits |= (uint64_t)readU32(reader) << 32;
+        double number;
+        memcpy(&number, &bits, sizeof(number));
+        addConstant(&function->chunk, NUMBER_VAL(number));
+        break;
+      }
+      case TAG_STRING_CONSTANT: {
+        ObjString* string = readString(reader);
+        if (string != NULL) addConstant(&function->chunk, OBJ_VAL(string));
+        break;
+      }
+      case TAG_FUNCTION_CONSTANT: {
+        ObjFunction* nested = readFunction(reader, depth + 1);
+        addConstant(&function->chunk, OBJ_VAL(nested));
+        pop();
+        break;
+      }
+      default:
+        fail(reader, "unknown constant type");
+    }
+  }
+
+  if (reader->error == NULL) {
+    const char* problem = checkCode(function);
+    if (problem != NULL) fail(reader, problem);
+  }
+  return function;
+}
+
+static uint8_t* readBytes(const char* path, size_t* size) {
+  FILE* file = fopen(path, "rb");
+  if (file == NULL) {
+    fprintf(stderr, "Could not open file \"%s\".\n", path);
+    return NULL;
+  }
+
+  fseek(file, 0L, SEEK_END);
+  *size = ftell(file);
+  rewind(file);
+
+  uint8_t* buffer = (uint8_t*)malloc(*size + 1);
+  if (buffer == NULL) {
+    fprintf(stderr, "Not enough memory to read \"%s\".\n", path);
+    fclose(file);
+    return NULL;
+  }
+  if (fread(buffer, sizeof(uint8_t), *size, file) < *size) {
+    fprintf(stderr, "Could not read file \"%s\".\n", path);
+    free(buffer);
+    buffer = NULL;
+  }
+  fclose(file);
+  return buffer;
+}
+
+ObjFunction* readChunkFile(const char* path) {
+  size_t size;
+  uint8_t* data = readBytes(path, &size);
+  if (data == NULL) return NULL;
+
+  Reader reader = {data, size, 0, NULL};
+  ObjFunction* script = NULL;
+  if (size < 4 || memcmp(data, LOXC_MAGIC, 4) != 0) {
+    fail(&reader, "not a .loxc file");
+  } else {
+    reader.position = 4;
+    uint16_t version = readU16(&reader);
+    if (reader.error == NULL && version != LOXC_VERSION) {
+      fprintf(stderr, "\"%s\" is format version %d, expected %d.\n",
+              path, version, LOXC_VERSION);
+      free(data);
+      return NULL;
+    }
+    script = readFunction(&reader, 0);
+    pop();
+    if (reader.error == NULL && reader.position != reader.size) {
+      fail(&reader, "unexpected data after the script");
+    }
+  }
+  free(data);
+
+  if (reader.error != NULL) {
+    fprintf(stderr, "Invalid chunk file \"%s\": %s.\n", path, reader.error);
+    return NULL;
+  }
+  return script;
+}
@@ -0,0 +1,25 @@
+#ifndef clox_serialize_h
+#define clox_serialize_h
+
+#include "object.h"
+
+/* .loxc files hold a compiled script so it can run without recompiling.
+
+  header:    "LOXC" magic, u16 format version
+  function:  u8 arity, u16 upvalue count, name (u8 0 for the script,
+             or u8 1 then a string), u32 code length, the code bytes,
+             a u32 line for each code byte, u32 constant count, constants
+  constant:  u8 tag then the payload: nil, false and true have none, a
+             number is an 8 byte IEEE double, a string is a u32 length then
+             its bytes, and a function is a nested function as above
+
+  Every integer is little endian. */
+
+#define LOXC_MAGIC "LOXC"
+#define LOXC_VERSION 1
+
+bool writeChunkFile(ObjFunction* script, const char* path);
+// Returns NULL, after reporting why, if the file is missing or malformed
+ObjFunction* readChunkFile(const char* path);
+
+#endif
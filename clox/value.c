@@ -1,3 +1,4 @@
+#include <math.h>
 #include <stdio.h>
 #include <string.h>
 
@@ -28,6 +29,16 @@ void freeValueArray(ValueArray* array) {
   initValueArray(array);
 }
 
+// %g writes NaN as nan or -nan depending on its sign bit, which 0/0 sets on
+// x86. The tree-walker always prints NaN, so this does too.
+static void printNumber(double number) {
+  if (isnan(number)) {
+    printf("NaN");
+  } else {
+    printf("%g", number);
+  }
+}
+
 void printValue(Value value) {
 #ifdef NAN_BOXING
   if (IS_BOOL(value)) {
@@ -35,7 +46,7 @@ void printValue(Value value) {
   } else if (IS_NIL(value)) {
     printf("nil");
   } else if (IS_NUMBER(value)) {
-    printf("%g", AS_NUMBER(value));
+    printNumber(AS_NUMBER(value));
   } else if (IS_OBJ(value)) {
     printObject(value);
   }
@@ -45,17 +56,29 @@ void printValue(Value value) {
       printf(AS_BOOL(value) ? "true" : "false");
       break;
     case VAL_NIL: printf("nil"); break;
-    case VAL_NUMBER: printf("%g", AS_NUMBER(value)); break;
+    case VAL_NUMBER: printNumber(AS_NUMBER(value)); break;
     case VAL_OBJ: printObject(value); break;
   }
 #endif
 }
 
+// Each `obj.method` makes a new bound method, so two of them are equal when
+// they bind the same method to equal receivers, as in the tree-walker.
+static bool objectsEqual(Value a, Value b) {
+  if (AS_OBJ(a) == AS_OBJ(b)) return true;
+  if (!IS_BOUND_METHOD(a) || !IS_BOUND_METHOD(b)) return false;
+  ObjBoundMethod* left = AS_BOUND_METHOD(a);
+  ObjBoundMethod* right = AS_BOUND_METHOD(b);
+  return left->method == right->method &&
+         valuesEqual(left->receiver, right->receiver);
+}
+
 bool valuesEqual(Value a, Value b) {
 #ifdef NAN_BOXING
   if (IS_NUMBER(a) && IS_NUMBER(b)) {
     return AS_NUMBER(a) == AS_NUMBER(b);
   }
+  if (IS_OBJ(a) && IS_OBJ(b)) return objectsEqual(a, b);
   return a == b;
 #else
   if (a.type != b.type) return false;
@@ -63,7 +86,7 @@ bool valuesEqual(Value a, Value b) {
     case VAL_BOOL:   return AS_BOOL(a) == AS_BOOL(b);
     case VAL_NIL:    return true;
     case VAL_NUMBER: return AS_NUMBER(a) == AS_NUMBER(b);
-    case VAL_OBJ:    return AS_OBJ(a) == AS_OBJ(b);
+    case VAL_OBJ:    return objectsEqual(a, b);
     default:         return false; // Unreachable.
   }
 #endif
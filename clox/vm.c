@@ -1,3 +1,4 @@
+#include <math.h>
 #include <stdio.h>
 #include <string.h>
 #include <time.h>
@@ -16,6 +17,49 @@ static Value clockNative(int argCount, Value* args) {
   return NUMBER_VAL((double)clock() / CLOCKS_PER_SEC);
 }
 
+// Natives can't report errors, so anything but a single number is neither
+// NaN nor finite
+static Value isNaNNative(int argCount, Value* args) {
+  return BOOL_VAL(argCount == 1 && IS_NUMBER(args[0]) &&
+                  isnan(AS_NUMBER(args[0])));
+}
+
+static Value isFiniteNative(int argCount, Value* args) {
+  return BOOL_VAL(argCount == 1 && IS_NUMBER(args[0]) &&
+                  isfinite(AS_NUMBER(args[0])));
+}
+
+static Value peek(int distance);
+
+static void setField(ObjInstance* instance, const char* name, double value) {
+  push(OBJ_VAL(copyString(name, (int)strlen(name))));
+  tableSet(&instance->fields, AS_STRING(peek(0)), NUMBER_VAL(value));
+  pop();
+}
+
+// A MemStats instance with the numbers printMemStats() prints. The counts
+// are taken first, since building the instance allocates.
+static Value memStatsNative(int argCount, Value* args) {
+  MemStats stats = memStats();
+  push(OBJ_VAL(copyString("MemStats", 8)));
+  ObjClass* klass = newClass(AS_STRING(peek(0)));
+  push(OBJ_VAL(klass));
+  ObjInstance* instance = newInstance(klass);
+  push(OBJ_VAL(instance));
+  setField(instance, "heapBytes", (double)stats.bytesAllocated);
+  setField(instance, "nextGC", (double)stats.nextGC);
+  setField(instance, "collections", stats.collections);
+  setField(instance, "bytesCollected", (double)stats.bytesCollected);
+  setField(instance, "objects", stats.objects);
+  for (int type = 0; type <= OBJ_BOUND_METHOD; type++) {
+    setField(instance, objTypeName((ObjType)type), stats.counts[type]);
+  }
+  pop();
+  pop();
+  pop();
+  return OBJ_VAL(instance);
+}
+
 static void resetStack() {
   vm.stackTop = vm.stack;
   vm.frameCount = 0;
@@ -53,11 +97,21 @@ static void defineNative(const char* name, NativeFn function) {
   pop();
 }
 
+static void defineGlobal(const char* name, Value value) {
+  push(OBJ_VAL(copyString(name, (int)strlen(name))));
+  push(value);
+  tableSet(&vm.globals, AS_STRING(vm.stack[0]), vm.stack[1]);
+  pop();
+  pop();
+}
+
 void initVM() {
   resetStack();
   vm.objects = NULL;
   vm.bytesAllocated = 0;
   vm.nextGC = 1024 * 1024;
+  vm.collections = 0;
+  vm.bytesCollected = 0;
 
   vm.grayCount = 0;
   vm.grayCapacity = 0;
@@ -70,6 +124,11 @@ void initVM() {
   vm.initString = copyString("init", 4);
 
   defineNative("clock", clockNative);
+  defineNative("memStats", memStatsNative);
+  defineNative("isNaN", isNaNNative);
+  defineNative("isFinite", isFiniteNative);
+  defineGlobal("nan", NUMBER_VAL(NAN));
+  defineGlobal("inf", NUMBER_VAL(INFINITY));
 }
 
 void freeVM() {
@@ -320,6 +379,8 @@ static InterpretResult run() {
       }
       case OP_GREATER:  BINARY_OP(BOOL_VAL, >); break;
       case OP_LESS:     BINARY_OP(BOOL_VAL, <); break;
+      case OP_GREATER_EQUAL: BINARY_OP(BOOL_VAL, >=); break;
+      case OP_LESS_EQUAL:    BINARY_OP(BOOL_VAL, <=); break;
       case OP_ADD: {
         if (IS_STRING(peek(0)) && IS_STRING(peek(1))) {
           concatenate();
@@ -545,6 +606,10 @@ InterpretResult interpret(const char* source) {
   ObjFunction* function = compile(source);
   if (function == NULL) return INTERPRET_COMPILE_ERROR;
 
+  return interpretFunction(function);
+}
+
+InterpretResult interpretFunction(ObjFunction* function) {
   push(OBJ_VAL(function));
   ObjClosure* closure = newClosure(function);
   pop();
@@ -28,6 +28,8 @@ typedef struct {
   Obj** grayStack;
   size_t bytesAllocated;
   size_t nextGC;
+  int collections;
+  size_t bytesCollected; // freed by every collection so far
   ObjString* initString;
 } VM;
 
@@ -42,6 +44,8 @@ extern VM vm;
 void initVM();
 void freeVM();
 InterpretResult interpret(const char* source);
+// Runs an already compiled script, such as one loaded from a .loxc file
+InterpretResult interpretFunction(ObjFunction* function);
 void push(Value value);
 Value pop();
 
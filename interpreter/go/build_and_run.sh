@@ -1,3 +1,3 @@
 rm lox
-go build -o lox .
-./lox $1
\ No newline at end of file
+go build -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o lox .
+./lox $1
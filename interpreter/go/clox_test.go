@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// NaN and infinity in clox, which has to agree with the tree-walker's
+// program_files/nan.lox. clox has no exponent literals, sets or try, so
+// overflow comes from multiplying here. Its natives can't fail either, so
+// isNaN() of a string, an error in the tree-walker, is false.
+func TestCloxNaN(t *testing.T) {
+	binary := buildClox(t)
+	const big = "100000000000000000000000000000"
+	source := `print 0 / 0;
+print 1 / 0;
+print -1 / 0;
+print ` + big + strings.Repeat(" * "+big, 10) + `;
+print inf == 1 / 0;
+print -inf < -` + big + `;
+print inf - inf;
+print nan == nan;
+print nan != nan;
+print nan < 1 or nan >= 1;
+print isNaN(0 / 0);
+print isNaN(inf);
+print isNaN("NaN");
+print isFinite(` + big + `);
+print isFinite(-inf);
+print isFinite(nan);
+`
+	want := "NaN\ninf\n-inf\ninf\ntrue\ntrue\nNaN\nfalse\ntrue\nfalse\ntrue\nfalse\nfalse\ntrue\nfalse\nfalse\n"
+
+	path := filepath.Join(t.TempDir(), "nan.lox")
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, exitCode, failure := runLox([]string{binary}, path)
+	if failure != "" {
+		t.Fatal(failure)
+	}
+	if exitCode != exitOK {
+		t.Errorf("exit code %d, want %d (stderr %q)", exitCode, exitOK, stderr)
+	}
+	if stdout != want {
+		t.Errorf("output %q, want %q", stdout, want)
+	}
+}
+
+// LOX_CLOX names a clox binary; otherwise the one in clox/ is built with make
+func buildClox(t *testing.T) string {
+	if binary := os.Getenv("LOX_CLOX"); binary != "" {
+		return binary
+	}
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make isn't installed and LOX_CLOX isn't set")
+	}
+	dir, err := filepath.Abs(filepath.Join("..", "..", "clox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("make", "--quiet")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building clox: %v\n%s", err, out)
+	}
+	return filepath.Join(dir, "clox")
+}
@@ -0,0 +1,364 @@
+package main
+
+// Runs the test suite from the Crafting Interpreters repository against a Lox
+// binary. Every test script in the suite says what it expects in comments:
+// `// expect: <line>` for output, `// expect runtime error: <message>` for a
+// runtime error (exit code 70), and `// Error at ...` or `// [line N] Error
+// ...` for compile errors (exit code 65). `[java line N]` and `[c line N]`
+// expectations only apply to the tree-walker and the bytecode VM respectively.
+//
+// Tests are grouped by the chapter of the book that makes them pass. Tests
+// from chapters past LOX_CHAPTER are still run, but failing them is expected
+// and only reported; passing one is worth knowing too, since it means
+// LOX_CHAPTER can go up.
+//
+// The suite isn't vendored. `make test-craftinginterpreters` fetches it and
+// runs this test; without CRAFTING_INTERPRETERS set, it is skipped.
+//
+//	CRAFTING_INTERPRETERS  the suite's test directory
+//	LOX                    the binary to test, this lexer when unset, which
+//	                       is run with --debug-tokens so it prints its tokens
+//	LOX_CHAPTER            the last chapter it implements, 4 when unset
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTimeout = 10 * time.Second
+
+type chapter struct {
+	number int
+	name   string
+}
+
+// Chapters that test something other than running a program (the scanner's
+// tokens, or one expression's value) are only in the suite when they are the
+// latest chapter implemented.
+var modeChapters = map[string]bool{"scanning": true, "expressions": true}
+
+// Keyed by the test's directory, or file name for tests at the top level.
+// Tests missing from a table aren't run for that half of the book.
+var treeWalkerChapters = map[string]chapter{
+	"scanning":             {4, "Scanning"},
+	"expressions":          {7, "Evaluating Expressions"},
+	"assignment":           {8, "Statements and State"},
+	"block":                {8, "Statements and State"},
+	"bool":                 {8, "Statements and State"},
+	"comments":             {8, "Statements and State"},
+	"empty_file":           {8, "Statements and State"},
+	"nil":                  {8, "Statements and State"},
+	"number":               {8, "Statements and State"},
+	"operator":             {8, "Statements and State"},
+	"precedence":           {8, "Statements and State"},
+	"print":                {8, "Statements and State"},
+	"string":               {8, "Statements and State"},
+	"unexpected_character": {8, "Statements and State"},
+	"variable":             {8, "Statements and State"},
+	"if":                   {9, "Control Flow"},
+	"logical_operator":     {9, "Control Flow"},
+	"while":                {9, "Control Flow"},
+	"for":                  {9, "Control Flow"},
+	"call":                 {10, "Functions"},
+	"function":             {10, "Functions"},
+	"return":               {10, "Functions"},
+	"closure":              {11, "Resolving and Binding"},
+	"class":                {12, "Classes"},
+	"constructor":          {12, "Classes"},
+	"field":                {12, "Classes"},
+	"method":               {12, "Classes"},
+	"this":                 {12, "Classes"},
+	"inheritance":          {13, "Inheritance"},
+	"super":                {13, "Inheritance"},
+	"regression":           {13, "Inheritance"},
+}
+
+var vmChapters = map[string]chapter{
+	"expressions":          {17, "Compiling Expressions"},
+	"assignment":           {21, "Global Variables"},
+	"bool":                 {21, "Global Variables"},
+	"comments":             {21, "Global Variables"},
+	"empty_file":           {21, "Global Variables"},
+	"nil":                  {21, "Global Variables"},
+	"number":               {21, "Global Variables"},
+	"operator":             {21, "Global Variables"},
+	"precedence":           {21, "Global Variables"},
+	"print":                {21, "Global Variables"},
+	"string":               {21, "Global Variables"},
+	"unexpected_character": {21, "Global Variables"},
+	"variable":             {21, "Global Variables"},
+	"block":                {22, "Local Variables"},
+	"if":                   {23, "Jumping Back and Forth"},
+	"logical_operator":     {23, "Jumping Back and Forth"},
+	"while":                {23, "Jumping Back and Forth"},
+	"for":                  {23, "Jumping Back and Forth"},
+	"call":                 {24, "Calls and Functions"},
+	"function":             {24, "Calls and Functions"},
+	"return":               {24, "Calls and Functions"},
+	"limit":                {24, "Calls and Functions"},
+	"closure":              {25, "Closures"},
+	"class":                {27, "Classes and Instances"},
+	"field":                {27, "Classes and Instances"},
+	"constructor":          {28, "Methods and Initializers"},
+	"method":               {28, "Methods and Initializers"},
+	"this":                 {28, "Methods and Initializers"},
+	"inheritance":          {29, "Superclasses"},
+	"super":                {29, "Superclasses"},
+	"regression":           {29, "Superclasses"},
+}
+
+var (
+	expectedOutputPattern       = regexp.MustCompile(`// expect: ?(.*)`)
+	expectedErrorPattern        = regexp.MustCompile(`// (Error.*)`)
+	errorLinePattern            = regexp.MustCompile(`// \[((java|c) )?line (\d+)\] (Error.*)`)
+	expectedRuntimeErrorPattern = regexp.MustCompile(`// expect runtime error: (.+)`)
+	syntaxErrorPattern          = regexp.MustCompile(`\[.*line (\d+)\] (Error.+)`)
+	stackTracePattern           = regexp.MustCompile(`\[line (\d+)\]`)
+	nonTestPattern              = regexp.MustCompile(`// nontest`)
+)
+
+// What a test script expects from running it
+type expectation struct {
+	output       []string
+	errors       []string
+	runtimeError string
+	// The line the runtime error happens on
+	runtimeLine int
+	exitCode    int
+}
+
+func parseExpectation(source string, language string) (expectation, bool) {
+	expect := expectation{}
+	for i, line := range strings.Split(source, "\n") {
+		lineNumber := i + 1
+		if nonTestPattern.MatchString(line) {
+			return expect, false
+		}
+		if match := expectedOutputPattern.FindStringSubmatch(line); match != nil {
+			expect.output = append(expect.output, match[1])
+		} else if match := expectedErrorPattern.FindStringSubmatch(line); match != nil {
+			expect.errors = append(expect.errors, fmt.Sprintf("[%d] %s", lineNumber, match[1]))
+			expect.exitCode = 65
+		} else if match := errorLinePattern.FindStringSubmatch(line); match != nil {
+			if match[2] == "" || match[2] == language {
+				expect.errors = append(expect.errors, fmt.Sprintf("[%s] %s", match[3], match[4]))
+				expect.exitCode = 65
+			}
+		} else if match := expectedRuntimeErrorPattern.FindStringSubmatch(line); match != nil {
+			expect.runtimeError = match[1]
+			expect.runtimeLine = lineNumber
+			expect.exitCode = 70
+		}
+	}
+	return expect, true
+}
+
+// Returns why the run didn't meet the expectation, or nothing if it did
+func (expect expectation) check(stdout, stderr string, exitCode int) []string {
+	var problems []string
+	errorLines := splitLines(stderr)
+	if expect.runtimeError != "" {
+		switch {
+		case len(errorLines) == 0:
+			problems = append(problems, fmt.Sprintf("Expected runtime error %q and got none.", expect.runtimeError))
+		case errorLines[0] != expect.runtimeError:
+			problems = append(problems, fmt.Sprintf("Expected runtime error %q and got %q.", expect.runtimeError, errorLines[0]))
+		default:
+			traced := false
+			for _, line := range errorLines[1:] {
+				if match := stackTracePattern.FindStringSubmatch(line); match != nil {
+					traced = match[1] == strconv.Itoa(expect.runtimeLine)
+					break
+				}
+			}
+			if !traced {
+				problems = append(problems, fmt.Sprintf("Expected a stack trace starting at line %d.", expect.runtimeLine))
+			}
+		}
+	} else {
+		var reported []string
+		for _, line := range errorLines {
+			if match := syntaxErrorPattern.FindStringSubmatch(line); match != nil {
+				reported = append(reported, fmt.Sprintf("[%s] %s", match[1], match[2]))
+			} else if line != "" {
+				problems = append(problems, fmt.Sprintf("Unexpected output on stderr: %q", line))
+			}
+		}
+		if strings.Join(reported, "\n") != strings.Join(expect.errors, "\n") {
+			problems = append(problems, fmt.Sprintf("Expected errors %q and got %q.", expect.errors, reported))
+		}
+	}
+
+	if exitCode != expect.exitCode {
+		problems = append(problems, fmt.Sprintf("Expected exit code %d and got %d.", expect.exitCode, exitCode))
+	}
+
+	output := splitLines(stdout)
+	for i, line := range output {
+		if i >= len(expect.output) {
+			problems = append(problems, fmt.Sprintf("Got output %q when none was expected.", line))
+			break
+		}
+		if line != expect.output[i] {
+			problems = append(problems, fmt.Sprintf("Expected output %q on line %d and got %q.", expect.output[i], i+1, line))
+			break
+		}
+	}
+	if len(output) < len(expect.output) {
+		problems = append(problems, fmt.Sprintf("Missing expected output %q.", expect.output[len(output)]))
+	}
+	return problems
+}
+
+func splitLines(text string) []string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Returns stdout, stderr and the exit code, or why the binary didn't finish
+func runLox(binary []string, path string) (string, string, int, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary[0], append(binary[1:], path)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return "", "", 0, fmt.Sprintf("Timed out after %s.", testTimeout)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), stderr.String(), exitErr.ExitCode(), ""
+	}
+	if err != nil {
+		return "", "", 0, err.Error()
+	}
+	return stdout.String(), stderr.String(), 0, ""
+}
+
+// The command under test: LOX, or this lexer built fresh and asked for the
+// tokens, since scanning is all it does
+func loxBinary(t *testing.T) []string {
+	if binary := os.Getenv("LOX"); binary != "" {
+		return []string{binary}
+	}
+	return []string{buildLox(t), "--debug-tokens"}
+}
+
+// Builds this front end into a temporary directory, returning its path
+func buildLox(t *testing.T) string {
+	binary := filepath.Join(t.TempDir(), "lox")
+	if out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building lox: %v\n%s", err, out)
+	}
+	return binary
+}
+
+func TestCraftingInterpreters(t *testing.T) {
+	suite := os.Getenv("CRAFTING_INTERPRETERS")
+	if suite == "" {
+		t.Skip("CRAFTING_INTERPRETERS isn't set; run `make test-craftinginterpreters`")
+	}
+	implemented := 4
+	if value := os.Getenv("LOX_CHAPTER"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			t.Fatalf("LOX_CHAPTER should be a chapter number, not %q", value)
+		}
+		implemented = number
+	}
+	// Chapters 4 to 13 build the tree-walker, and 14 on the bytecode VM
+	chapters, language := treeWalkerChapters, "java"
+	if implemented >= 14 {
+		chapters, language = vmChapters, "c"
+	}
+	latest := 0
+	for _, chapter := range chapters {
+		if chapter.number <= implemented && chapter.number > latest {
+			latest = chapter.number
+		}
+	}
+	binary := loxBinary(t)
+
+	// Tests sit at the top level or one directory down
+	topLevel, _ := filepath.Glob(filepath.Join(suite, "*.lox"))
+	grouped, _ := filepath.Glob(filepath.Join(suite, "*", "*.lox"))
+	paths := append(topLevel, grouped...)
+	if len(paths) == 0 {
+		t.Fatalf("no tests in %s", suite)
+	}
+
+	type tally struct {
+		chapter        chapter
+		passed, failed int
+	}
+	tallies := map[int]*tally{}
+	for _, path := range paths {
+		relative, _ := filepath.Rel(suite, path)
+		group := strings.TrimSuffix(strings.Split(filepath.ToSlash(relative), "/")[0], ".lox")
+		chapter, ok := chapters[group]
+		if !ok || (modeChapters[group] && chapter.number != latest) {
+			continue
+		}
+		source, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		expect, ok := parseExpectation(string(source), language)
+		if !ok {
+			continue
+		}
+		if tallies[chapter.number] == nil {
+			tallies[chapter.number] = &tally{chapter: chapter}
+		}
+		counts := tallies[chapter.number]
+
+		t.Run(filepath.ToSlash(strings.TrimSuffix(relative, ".lox")), func(t *testing.T) {
+			stdout, stderr, exitCode, failure := runLox(binary, path)
+			var problems []string
+			if failure != "" {
+				problems = []string{failure}
+			} else {
+				problems = expect.check(stdout, stderr, exitCode)
+			}
+			if len(problems) == 0 {
+				counts.passed++
+				return
+			}
+			counts.failed++
+			if chapter.number > implemented {
+				t.Skipf("expected failure, chapter %d (%s) isn't implemented: %s", chapter.number, chapter.name, problems[0])
+			}
+			for _, problem := range problems {
+				t.Error(problem)
+			}
+		})
+	}
+
+	numbers := make([]int, 0, len(tallies))
+	for number := range tallies {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	for _, number := range numbers {
+		counts := tallies[number]
+		status := "implemented"
+		if number > implemented {
+			status = "not implemented, failures expected"
+		}
+		t.Logf("chapter %2d %-26s %3d passed, %3d failed (%s)", number, counts.chapter.name, counts.passed, counts.failed, status)
+	}
+}
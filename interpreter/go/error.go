@@ -1,13 +1,24 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"os"
+)
 
-const hadError = false
+// Set when an error is reported, so a script with errors exits with
+// exitStaticError. The prompt clears it after each line.
+var hadError = false
+
+// Where errors are reported. Tests and the prompt's line checks point it at
+// a buffer.
+var errorOutput io.Writer = os.Stdout
 
 func error(line int, message string) {
 	report(line, "", message)
 }
 
 func report(line int, where string, message string) {
-	fmt.Printf("[line %d] Error %s: %s\n", line, where, message)
+	hadError = true
+	fmt.Fprintf(errorOutput, "[line %d] Error %s: %s\n", line, where, message)
 }
\ No newline at end of file
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs the built binary through each way a run can end and checks the exit
+// code it ends with. A runtime error (exitRuntimeError) can't happen until
+// this front end runs programs; the Rust interpreter's tests/exit_codes.rs
+// covers it there.
+func TestExitCodes(t *testing.T) {
+	binary := buildLox(t)
+	dir := t.TempDir()
+	write := func(name, source string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	valid := write("valid.lox", "var greeting = \"hi\";\nprint greeting;\n")
+	invalid := write("invalid.lox", "print @;\n")
+	unterminated := write("unterminated.lox", "print \"hi;\n")
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"valid script", []string{valid}, exitOK},
+		{"unexpected character", []string{invalid}, exitStaticError},
+		{"unterminated string", []string{unterminated}, exitStaticError},
+		{"missing script", []string{filepath.Join(dir, "missing.lox")}, exitNoInput},
+		{"directory as script", []string{dir}, exitIOError},
+		{"too many arguments", []string{valid, valid}, exitUsage},
+		{"unknown flag", []string{"--verbose"}, exitUsage},
+		{"version", []string{"version"}, exitOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, stderr, exitCode, failure := runLox(append([]string{binary}, test.args[:len(test.args)-1]...), test.args[len(test.args)-1])
+			if failure != "" {
+				t.Fatal(failure)
+			}
+			if exitCode != test.want {
+				t.Errorf("exit code %d, want %d (stderr %q)", exitCode, test.want, stderr)
+			}
+		})
+	}
+}
+
+func TestPromptExitCode(t *testing.T) {
+	binary := buildLox(t)
+	// An error on one line doesn't carry over, so the session ends cleanly
+	cmd := exec.Command(binary)
+	cmd.Stdin = strings.NewReader("print @;\nprint 1;\n")
+	if err := cmd.Run(); err != nil {
+		t.Errorf("prompt exited with %v, want %d", err, exitOK)
+	}
+}
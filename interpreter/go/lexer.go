@@ -1,6 +1,14 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// How much of an unterminated string its error shows
+const unterminatedPreview = 20
 
 const (
 	// Single-character tokens.
@@ -120,6 +128,16 @@ type Token struct {
 	line int
 }
 
+// Literals are the value the token stands for: the text of a string without
+// its quotes, a number's float64, or true and false. Every other token has nil.
+func NewToken(token_type_ int, lexeme string, literal any, line int) Token {
+	return Token{token_type_, lexeme, literal, line}
+}
+
+func (t Token) Equals(other Token) bool {
+	return t.token_type_ == other.token_type_ && t.lexeme == other.lexeme && t.literal == other.literal && t.line == other.line
+}
+
 func (t Token) ToString() string {
 	return fmt.Sprintf("TOKEN_TYPE: %s, TOKEN: %s, LITERAL: %v", token_names[t.token_type_], t.lexeme, t.literal)
 }
@@ -141,7 +159,7 @@ func (l *Lexer) ScanTokens() []Token {
 		l.start = l.current
 		l.ScanToken()
 	}
-	l.tokens = append(l.tokens, Token{EOF, "", nil, l.line})
+	l.tokens = append(l.tokens, NewToken(EOF, "", nil, l.line))
 	return l.tokens
 }
 
@@ -216,10 +234,12 @@ func (l *Lexer) ScanToken() {
 				}
 				text := l.source[l.start:l.current]
 				token_type, is_keyword := keywords[text]
-				if is_keyword {
-					l.addToken(token_type)
+				if !is_keyword {
+					l.addToken(IDENTIFIER)
+				} else if token_type == TRUE || token_type == FALSE {
+					l.addTokenLiteral(token_type, token_type == TRUE)
 				} else {
-					l.addTokenLiteral(IDENTIFIER, text)
+					l.addToken(token_type)
 				}
 			} else {
 				error(l.line, "Unexpected character.")
@@ -240,13 +260,12 @@ func isAlphaNumeric(c byte) bool {
 }
 
 func (l *Lexer) addToken(token_type_ int) {
-	text := l.source[l.start:l.current]
-	l.tokens = append(l.tokens, Token{token_type_, text, nil, l.line})
+	l.addTokenLiteral(token_type_, nil)
 }
 
 func (l *Lexer) addTokenLiteral(token_type_ int, literal any) {
 	text := l.source[l.start:l.current]
-	l.tokens = append(l.tokens, Token{token_type_, text, literal, l.line})
+	l.tokens = append(l.tokens, NewToken(token_type_, text, literal, l.line))
 }
 
 func (l *Lexer) advance() byte {
@@ -255,6 +274,9 @@ func (l *Lexer) advance() byte {
 	return c
 }
 
+// match, peek and peekNext all check for the end of input before indexing, so
+// a token cut off by EOF ends early instead of reading past the source. peek
+// and peekNext return '\000' there, which no token continues with.
 func (l *Lexer) match(expected byte) bool {
 	if l.isAtEnd() {
 		return false
@@ -288,7 +310,7 @@ func (l *Lexer) string() {
 		l.advance()
 	}
 	if l.isAtEnd() {
-		error(l.line, "Unterminated string.")
+		l.unterminatedString()
 		return
 	}
 	l.advance()
@@ -296,6 +318,22 @@ func (l *Lexer) string() {
 	l.addTokenLiteral(STRING, value)
 }
 
+// Reported where the string starts, with how it starts: by the end of the
+// file, the rest of the file has become part of the string.
+func (l *Lexer) unterminatedString() {
+	line := 1 + strings.Count(l.source[:l.start], "\n")
+	column := l.start - strings.LastIndex(l.source[:l.start], "\n")
+	content := []rune(l.source[l.start+1:])
+	if newline := slices.Index(content, '\n'); newline >= 0 {
+		content = content[:newline]
+	}
+	preview := string(content)
+	if len(content) > unterminatedPreview {
+		preview = string(content[:unterminatedPreview]) + "..."
+	}
+	error(line, fmt.Sprintf("Unterminated string starting at column %d: \"%s", column, preview))
+}
+
 func (l *Lexer) number() {
 	for isDigit(l.peek()) {
 		l.advance()
@@ -306,7 +344,8 @@ func (l *Lexer) number() {
 			l.advance()
 		}
 	}
-	literal := l.source[l.start:l.current]
+	// Only digits and one inner dot get here, so parsing can't fail
+	literal, _ := strconv.ParseFloat(l.source[l.start:l.current], 64)
 	l.addTokenLiteral(NUMBER, literal)
 }
 
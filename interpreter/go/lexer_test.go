@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Scans source with errors going to a buffer, which is returned with the tokens
+func scan(source string) ([]Token, string) {
+	var errors bytes.Buffer
+	saved := errorOutput
+	errorOutput = &errors
+	defer func() { errorOutput = saved }()
+	return NewLexer(source).ScanTokens(), errors.String()
+}
+
+func TestScanTokenTypes(t *testing.T) {
+	tests := []struct {
+		source  string
+		want    int
+		literal any
+	}{
+		{"(", LEFT_PAREN, nil},
+		{")", RIGHT_PAREN, nil},
+		{"{", LEFT_BRACE, nil},
+		{"}", RIGHT_BRACE, nil},
+		{",", COMMA, nil},
+		{".", DOT, nil},
+		{"-", MINUS, nil},
+		{"+", PLUS, nil},
+		{";", SEMICOLON, nil},
+		{"/", SLASH, nil},
+		{"*", STAR, nil},
+		{"!", BANG, nil},
+		{"!=", BANG_EQUAL, nil},
+		{"=", EQUAL, nil},
+		{"==", EQUAL_EQUAL, nil},
+		{">", GREATER, nil},
+		{">=", GREATER_EQUAL, nil},
+		{"<", LESS, nil},
+		{"<=", LESS_EQUAL, nil},
+		{"name", IDENTIFIER, nil},
+		{"_under_score1", IDENTIFIER, nil},
+		{`"text"`, STRING, "text"},
+		{`""`, STRING, ""},
+		{"123", NUMBER, 123.0},
+		{"12.5", NUMBER, 12.5},
+		{"007", NUMBER, 7.0},
+		{"and", AND, nil},
+		{"class", CLASS, nil},
+		{"else", ELSE, nil},
+		{"false", FALSE, false},
+		{"fun", FUN, nil},
+		{"for", FOR, nil},
+		{"if", IF, nil},
+		{"nil", NIL, nil},
+		{"or", OR, nil},
+		{"print", PRINT, nil},
+		{"return", RETURN, nil},
+		{"super", SUPER, nil},
+		{"this", THIS, nil},
+		{"true", TRUE, true},
+		{"var", VAR, nil},
+		{"while", WHILE, nil},
+	}
+	for _, test := range tests {
+		tokens, errors := scan(test.source)
+		if errors != "" {
+			t.Errorf("%q: unexpected error %q", test.source, errors)
+		}
+		if len(tokens) != 2 {
+			t.Errorf("%q: got %d tokens, want the token and EOF", test.source, len(tokens))
+			continue
+		}
+		want := NewToken(test.want, test.source, test.literal, 1)
+		if !tokens[0].Equals(want) {
+			t.Errorf("%q: got %s, want %s", test.source, tokens[0].ToString(), want.ToString())
+		}
+		if eof := NewToken(EOF, "", nil, 1); !tokens[1].Equals(eof) {
+			t.Errorf("%q: last token is %s, want %s", test.source, tokens[1].ToString(), eof.ToString())
+		}
+	}
+}
+
+func TestTokenEquals(t *testing.T) {
+	token := NewToken(NUMBER, "1", 1.0, 3)
+	same := NewToken(NUMBER, "1", 1.0, 3)
+	if !token.Equals(same) {
+		t.Errorf("%s doesn't equal %s", token.ToString(), same.ToString())
+	}
+	for _, other := range []Token{
+		NewToken(IDENTIFIER, "1", 1.0, 3),
+		NewToken(NUMBER, "1.0", 1.0, 3),
+		NewToken(NUMBER, "1", 2.0, 3),
+		NewToken(NUMBER, "1", "1", 3),
+		NewToken(NUMBER, "1", 1.0, 4),
+	} {
+		if token.Equals(other) {
+			t.Errorf("%s equals %s", token.ToString(), other.ToString())
+		}
+	}
+}
+
+// Every token type has a name to print
+func TestTokenNames(t *testing.T) {
+	for tokenType := LEFT_PAREN; tokenType <= EOF; tokenType++ {
+		if token_names[tokenType] == "" {
+			t.Errorf("token type %d has no name", tokenType)
+		}
+	}
+}
+
+func TestScanSequences(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []int
+	}{
+		{"", nil},
+		{"   \t\r\n", nil},
+		{"// only a comment", nil},
+		{"// comment\nprint", []int{PRINT}},
+		{"print // trailing comment", []int{PRINT}},
+		{"a/b", []int{IDENTIFIER, SLASH, IDENTIFIER}},
+		{"!==", []int{BANG_EQUAL, EQUAL}},
+		{"===", []int{EQUAL_EQUAL, EQUAL}},
+		{"<==", []int{LESS_EQUAL, EQUAL}},
+		{">>=", []int{GREATER, GREATER_EQUAL}},
+		{"!!", []int{BANG, BANG}},
+		{"-1", []int{MINUS, NUMBER}},
+		{"1.", []int{NUMBER, DOT}},
+		{".5", []int{DOT, NUMBER}},
+		{"1.2.3", []int{NUMBER, DOT, NUMBER}},
+		{"123abc", []int{NUMBER, IDENTIFIER}},
+		{"orchid", []int{IDENTIFIER}},
+		{"or chid", []int{OR, IDENTIFIER}},
+		{"Nil", []int{IDENTIFIER}},
+		{"var x = 1;", []int{VAR, IDENTIFIER, EQUAL, NUMBER, SEMICOLON}},
+		{`print "a" + "b";`, []int{PRINT, STRING, PLUS, STRING, SEMICOLON}},
+		{"fun f(a, b) { return a.b; }", []int{FUN, IDENTIFIER, LEFT_PAREN, IDENTIFIER, COMMA, IDENTIFIER, RIGHT_PAREN,
+			LEFT_BRACE, RETURN, IDENTIFIER, DOT, IDENTIFIER, SEMICOLON, RIGHT_BRACE}},
+	}
+	for _, test := range tests {
+		tokens, errors := scan(test.source)
+		if errors != "" {
+			t.Errorf("%q: unexpected error %q", test.source, errors)
+		}
+		want := append(test.want, EOF)
+		if !sameTypes(tokens, want) {
+			t.Errorf("%q: got %v, want %v", test.source, typeNames(tokens), names(want))
+		}
+	}
+}
+
+func TestScanLines(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []int
+	}{
+		{"a\nb\n\nc", []int{1, 2, 4, 4}},
+		{"a // comment\nb", []int{1, 2, 2}},
+		{"\"one\ntwo\" a", []int{2, 2, 2}},
+		{"a\r\nb", []int{1, 2, 2}},
+		{"\n\n", []int{3}},
+	}
+	for _, test := range tests {
+		tokens, _ := scan(test.source)
+		var got []int
+		for _, token := range tokens {
+			got = append(got, token.line)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%q: got lines %v, want %v", test.source, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q: got lines %v, want %v", test.source, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		errors string
+		want   []int
+	}{
+		{"@", "[line 1] Error : Unexpected character.\n", nil},
+		{"a # b", "[line 1] Error : Unexpected character.\n", []int{IDENTIFIER, IDENTIFIER}},
+		{"\n\n$", "[line 3] Error : Unexpected character.\n", nil},
+		{"@@", "[line 1] Error : Unexpected character.\n[line 1] Error : Unexpected character.\n", nil},
+		{`"open`, "[line 1] Error : Unterminated string starting at column 1: \"open\n", nil},
+		{"a;\n  \"open\n\n", "[line 2] Error : Unterminated string starting at column 3: \"open\n", []int{IDENTIFIER, SEMICOLON}},
+		{`print "`, "[line 1] Error : Unterminated string starting at column 7: \"\n", []int{PRINT}},
+		{`"a string much longer than the preview`, "[line 1] Error : Unterminated string starting at column 1: \"a string much longer...\n", nil},
+		{`"exactly twenty chars`, "[line 1] Error : Unterminated string starting at column 1: \"exactly twenty chars\n", nil},
+		{`"héllo wörld, ünïcode ok`, "[line 1] Error : Unterminated string starting at column 1: \"héllo wörld, ünïcode...\n", nil},
+	}
+	for _, test := range tests {
+		tokens, errors := scan(test.source)
+		if errors != test.errors {
+			t.Errorf("%q: got errors %q, want %q", test.source, errors, test.errors)
+		}
+		want := append(test.want, EOF)
+		if !sameTypes(tokens, want) {
+			t.Errorf("%q: got %v, want %v", test.source, typeNames(tokens), names(want))
+		}
+	}
+}
+
+// Input that ends partway through a token
+func TestScanEndOfInput(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []int
+	}{
+		{"!", []int{BANG}},
+		{"=", []int{EQUAL}},
+		{"<", []int{LESS}},
+		{">", []int{GREATER}},
+		{"/", []int{SLASH}},
+		{"//", nil},
+		{"1", []int{NUMBER}},
+		{"1.", []int{NUMBER, DOT}},
+		{"x", []int{IDENTIFIER}},
+		{"a !", []int{IDENTIFIER, BANG}},
+		{"a =", []int{IDENTIFIER, EQUAL}},
+		{"a <", []int{IDENTIFIER, LESS}},
+		{"a >", []int{IDENTIFIER, GREATER}},
+		{"!=", []int{BANG_EQUAL}},
+		{"==", []int{EQUAL_EQUAL}},
+		{"<=", []int{LESS_EQUAL}},
+		{">=", []int{GREATER_EQUAL}},
+		{"!\n", []int{BANG}},
+		{"1.5", []int{NUMBER}},
+		{"1.5.", []int{NUMBER, DOT}},
+		{"1.a", []int{NUMBER, DOT, IDENTIFIER}},
+		{"1.\n", []int{NUMBER, DOT}},
+		{"a.", []int{IDENTIFIER, DOT}},
+		{"// comment with no newline", nil},
+	}
+	for _, test := range tests {
+		tokens, errors := scan(test.source)
+		if errors != "" {
+			t.Errorf("%q: unexpected error %q", test.source, errors)
+		}
+		want := append(test.want, EOF)
+		if !sameTypes(tokens, want) {
+			t.Errorf("%q: got %v, want %v", test.source, typeNames(tokens), names(want))
+		}
+	}
+}
+
+// Every prefix of a program, so each token gets cut off at every point. None
+// of them may panic, and each must end with EOF.
+func TestScanPrefixes(t *testing.T) {
+	program := "var a = 1.5;\nif (a >= 1 and !false) {\n  print \"x\" + \"y\"; // done\n} else a = a != nil;\nb <= c == d > e < f / g * h - i;"
+	for end := 0; end <= len(program); end++ {
+		source := program[:end]
+		tokens, _ := scan(source)
+		if len(tokens) == 0 || tokens[len(tokens)-1].token_type_ != EOF {
+			t.Errorf("%q: doesn't end with EOF", source)
+		}
+	}
+}
+
+func FuzzScanTokens(f *testing.F) {
+	for _, seed := range []string{"", "!", "=", "<", ">", "/", "1.", "\"", "!=<=>=", "1.5.a", "// c", "\"a\nb\"", "\xff\xfe"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, source string) {
+		tokens, _ := scan(source)
+		if len(tokens) == 0 || tokens[len(tokens)-1].token_type_ != EOF {
+			t.Errorf("%q: doesn't end with EOF", source)
+		}
+	})
+}
+
+func sameTypes(tokens []Token, want []int) bool {
+	if len(tokens) != len(want) {
+		return false
+	}
+	for i, token := range tokens {
+		if token.token_type_ != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func typeNames(tokens []Token) []string {
+	var types []int
+	for _, token := range tokens {
+		types = append(types, token.token_type_)
+	}
+	return names(types)
+}
+
+func names(types []int) []string {
+	var names []string
+	for _, tokenType := range types {
+		names = append(names, token_names[tokenType])
+	}
+	return names
+}
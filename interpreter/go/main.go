@@ -2,28 +2,60 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"strings"
 )
 
+// Exit codes, from BSD's sysexits.h like the book's. Nothing exits with
+// exitRuntimeError until this front end can run a program, but the code is
+// part of the contract every Lox binary here keeps.
+const (
+	exitOK           = 0
+	exitUsage        = 64 // EX_USAGE: bad arguments
+	exitStaticError  = 65 // EX_DATAERR: the script has a syntax error
+	exitNoInput      = 66 // EX_NOINPUT: the script doesn't exist
+	exitRuntimeError = 70 // EX_SOFTWARE: the script failed while running
+	exitIOError      = 74 // EX_IOERR: reading the script or input failed
+)
+
+// Set by --debug-tokens, which prints the scanned tokens one per line
+var debugTokens bool
+
 func main() {
-	args := os.Args
-	argCount := len(args) - 1
-	if argCount > 1 {
-		fmt.Println("Usage: lox [script]")
-		os.Exit(64)
-	} else if argCount == 1 {
-		runFile(args[1])
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "--debug-tokens" {
+		debugTokens = true
+		args = args[1:]
+	}
+	if len(args) == 1 && args[0] == "version" {
+		printVersion()
+		return
+	}
+	if len(args) > 1 || (len(args) == 1 && strings.HasPrefix(args[0], "--")) {
+		fmt.Println("Usage: lox [--debug-tokens] [script]")
+		fmt.Println("       lox version")
+		os.Exit(exitUsage)
+	} else if len(args) == 1 {
+		runFile(args[0])
 	} else {
 		fmt.Println("Starting Lox Prompt! :)")
 		runPrompt()
 	}
 }
 
+// Scans the input, reporting any errors. This front end doesn't parse or
+// execute yet, so the tokens are the only thing there is to show, and only
+// with --debug-tokens: they're for debugging the lexer, not for users.
 func run(input string) {
 	lexer := NewLexer(input)
 	tokens := lexer.ScanTokens()
+	if !debugTokens {
+		return
+	}
 	for _, token := range tokens {
 		fmt.Println(token.ToString())
 	}
@@ -32,22 +64,75 @@ func run(input string) {
 func runFile(path string) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println("Error reading file:", err)
-		fmt.Println("provided path: ", path)
-		return
+		fmt.Fprintln(os.Stderr, "Error reading file:", err)
+		fmt.Fprintln(os.Stderr, "provided path: ", path)
+		if errors.Is(err, fs.ErrNotExist) {
+			os.Exit(exitNoInput)
+		}
+		os.Exit(exitIOError)
 	}
 	content := string(data)
 	run(content)
+	if hadError {
+		os.Exit(exitStaticError)
+	}
 }
 
 func runPrompt() {
-	scanner := bufio.NewScanner(os.Stdin)
+	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print(">> ")
-		if !scanner.Scan() {
+		input, ok := readInput(reader, os.Stdout)
+		if !ok {
 			break
 		}
-		input := strings.TrimSpace(scanner.Text())
-		run(input)
+		run(strings.TrimSpace(input))
+		// A mistake on one line shouldn't end the session
+		hadError = false
+	}
+}
+
+// Reads one input for the prompt: a line, or as many lines as it takes to
+// close the blocks, parentheses and strings it opens, so a program pasted in
+// runs as a whole. Continuation lines are prompted for with ".. " on prompt.
+// Lines can be any length, which bufio.Scanner would cap at 64KB. Returns
+// false once the input has run out, and exits if it can't be read.
+func readInput(reader *bufio.Reader, prompt io.Writer) (string, bool) {
+	var input strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		input.WriteString(line)
+		if err == io.EOF {
+			return input.String(), input.Len() > 0
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading input:", err)
+			os.Exit(exitIOError)
+		}
+		if !incomplete(input.String()) {
+			return input.String(), true
+		}
+		fmt.Fprint(prompt, ".. ")
+	}
+}
+
+// Whether the input opens more braces or parentheses than it closes, or ends
+// inside a string. Scanning errors are left for run to report.
+func incomplete(input string) bool {
+	savedOutput, savedError := errorOutput, hadError
+	var errors strings.Builder
+	errorOutput = &errors
+	tokens := NewLexer(input).ScanTokens()
+	errorOutput, hadError = savedOutput, savedError
+
+	depth := 0
+	for _, token := range tokens {
+		switch token.token_type_ {
+		case LEFT_BRACE, LEFT_PAREN:
+			depth++
+		case RIGHT_BRACE, RIGHT_PAREN:
+			depth--
+		}
 	}
+	return depth > 0 || strings.Contains(errors.String(), "Unterminated string")
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Reads every input the prompt would run from text
+func readInputs(text string) []string {
+	reader := bufio.NewReader(strings.NewReader(text))
+	var inputs []string
+	for {
+		input, ok := readInput(reader, io.Discard)
+		if !ok {
+			return inputs
+		}
+		inputs = append(inputs, input)
+	}
+}
+
+func TestReadInputLongLine(t *testing.T) {
+	line := "print \"" + strings.Repeat("x", 200_000) + "\";"
+	inputs := readInputs(line + "\nprint 1;\n")
+	if len(inputs) != 2 || inputs[0] != line+"\n" {
+		t.Fatalf("got %d inputs, want the long line whole and then one more", len(inputs))
+	}
+}
+
+func TestReadInputPastedBlocks(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"single lines", "print 1;\nprint 2;\n", []string{"print 1;\n", "print 2;\n"}},
+		{"block", "fun f() {\n  print 1;\n}\nf();\n", []string{"fun f() {\n  print 1;\n}\n", "f();\n"}},
+		{"nested", "if (a) {\n  while (b) {\n  }\n}\n", []string{"if (a) {\n  while (b) {\n  }\n}\n"}},
+		{"open parenthesis", "print (1 +\n2);\n", []string{"print (1 +\n2);\n"}},
+		{"string", "print \"a\nb\";\n", []string{"print \"a\nb\";\n"}},
+		{"braces in a string", "print \"{\";\n", []string{"print \"{\";\n"}},
+		{"braces in a comment", "// {\nprint 1;\n", []string{"// {\n", "print 1;\n"}},
+		{"extra closing brace", "}\nprint 1;\n", []string{"}\n", "print 1;\n"}},
+		{"unfinished at the end", "{\nprint 1;", []string{"{\nprint 1;"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := readInputs(test.text)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("readInputs(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
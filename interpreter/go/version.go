@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build metadata, injected at build time with
+//
+//	go build -ldflags "-X main.version=0.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// which build_and_run.sh does. A plain `go build` inside the repository still
+// gets the commit from the VCS stamp Go embeds.
+var (
+	version   = "0.1.0-dev"
+	commit    = ""
+	buildDate = ""
+)
+
+func printVersion() {
+	revision, modified := commit, false
+	if info, ok := debug.ReadBuildInfo(); ok && revision == "" {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value[:min(len(setting.Value), 7)]
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	fmt.Printf("lox %s\n", version)
+	fmt.Printf("commit:   %s\n", orUnknown(revision))
+	fmt.Printf("built:    %s\n", orUnknown(buildDate))
+	fmt.Println("dialect:  book (no extensions)")
+	// The Go front end only scans so far: the tree-walker is in
+	// interpreter/rust and the VM in clox
+	fmt.Println("engines:  none (scanner only)")
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
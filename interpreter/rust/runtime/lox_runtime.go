@@ -0,0 +1,1537 @@
+// Runtime support for programs built with `lox build`. The code generated for
+// a script is appended to this file to make one standalone main package, so
+// the generated code only calls what is defined here and imports nothing.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type Value = any
+
+type List struct {
+	Elements []Value
+}
+
+type Function struct {
+	Name     string
+	Params   int
+	Required int
+	Variadic bool
+	// Where it was declared and what it takes, for arity errors
+	Declaration string
+	Body        func(args []Value) Value
+	// For a method looked up on an instance, the instance and the class the
+	// method was found on, which bound methods are compared by
+	Receiver *Instance
+	Owner    *Class
+}
+
+type Native struct {
+	Name  string
+	Arity int
+	Body  func(args []Value, line int) Value
+}
+
+// Methods are stored unbound; binding one to an instance gives a Function
+// whose body sees that instance as `this`.
+type Class struct {
+	Name    string
+	Super   *Class
+	Methods map[string]func(this *Instance) *Function
+}
+
+// Order holds the field names in the order they were first set, since
+// ranging over Fields would go in a different order every run
+type Instance struct {
+	Class  *Class
+	Fields map[string]Value
+	Order  []string
+}
+
+// An instance with the fields given as name, value pairs
+func newInstance(class *Class, fields ...Value) *Instance {
+	instance := &Instance{class, map[string]Value{}, nil}
+	for i := 0; i < len(fields); i += 2 {
+		instance.set(fields[i].(string), fields[i+1])
+	}
+	return instance
+}
+
+func (instance *Instance) set(name string, value Value) {
+	if _, ok := instance.Fields[name]; !ok {
+		instance.Order = append(instance.Order, name)
+	}
+	instance.Fields[name] = value
+}
+
+// Globals hold this until their declaration runs
+type undefinedValue struct{}
+
+var undefined Value = undefinedValue{}
+
+type RuntimeError struct {
+	Line    int
+	Message string
+}
+
+// Raised by `?.` on nil and caught by the enclosing optionalChain
+type shortCircuit struct{}
+
+const maxCallDepth = 1000
+
+var callDepth int
+
+var stdout = bufio.NewWriter(os.Stdout)
+
+// Set once a statement fails, so the program exits 70 as the interpreter does
+var hadRuntimeError bool
+
+func fail(line int, format string, args ...any) {
+	panic(&RuntimeError{line, fmt.Sprintf(format, args...)})
+}
+
+// Runs one top-level statement. Like the interpreter, a runtime error is
+// reported and the program carries on with the next statement.
+func statement(body func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			err, ok := r.(*RuntimeError)
+			if !ok {
+				panic(r)
+			}
+			stdout.Flush()
+			fmt.Fprintf(os.Stderr, "[line %d] Error: %s\n", err.Line, err.Message)
+			hadRuntimeError = true
+			callDepth = 0
+		}
+	}()
+	body()
+}
+
+// Deferred by main: flushes the output and exits 70 if a statement failed
+func finish() {
+	stdout.Flush()
+	if hadRuntimeError {
+		os.Exit(70)
+	}
+}
+
+// Several values print on one line, separated by spaces
+func printValue(values ...Value) {
+	for i, value := range values {
+		if i > 0 {
+			stdout.WriteByte(' ')
+		}
+		stdout.WriteString(stringify(value))
+	}
+	stdout.WriteByte('\n')
+}
+
+///////////// Values ///////////////
+
+// "book" or "empty" and "deep" or "identity", as the dialect the program
+// was built in says; see dialect.rs
+var (
+	truthinessMode = "book"
+	equalityMode   = "deep"
+)
+
+func truthy(value Value) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	if truthinessMode == "book" {
+		return true
+	}
+	switch v := value.(type) {
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case *List:
+		return len(v.Elements) > 0
+	}
+	return true
+}
+
+// formatNumber follows number_string in lexer.rs: the fewest digits that
+// read back as n, with an exponent from 1e21 up and below 1e-6.
+func formatNumber(n float64) string {
+	switch {
+	case math.IsNaN(n):
+		return "NaN"
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	}
+	if magnitude := math.Abs(n); magnitude == 0 || (magnitude >= 1e-6 && magnitude < 1e21) {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	mantissa, exponent, _ := strings.Cut(strconv.FormatFloat(n, 'e', -1, 64), "e")
+	power, _ := strconv.Atoi(exponent)
+	if power > 0 {
+		return fmt.Sprintf("%se+%d", mantissa, power)
+	}
+	return fmt.Sprintf("%se%d", mantissa, power)
+}
+
+func display(value Value) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	case *List:
+		elements := make([]string, len(v.Elements))
+		for i, element := range v.Elements {
+			elements[i] = display(element)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *Function:
+		return "<fn " + v.Name + ">"
+	case *Native:
+		return "<native fn " + v.Name + ">"
+	case *Class:
+		return v.Name
+	case *Instance:
+		return v.Class.Name + " instance"
+	}
+	return fmt.Sprint(value)
+}
+
+// The interpreter's debug form, used in operand errors
+func debug(value Value) string {
+	switch v := value.(type) {
+	case nil:
+		return "Nil"
+	case bool:
+		return fmt.Sprintf("Boolean(%t)", v)
+	case int64:
+		return fmt.Sprintf("Integer(%d)", v)
+	case float64:
+		return fmt.Sprintf("Number(%s)", formatNumber(v))
+	case string:
+		return fmt.Sprintf("String(%q)", v)
+	}
+	return display(value)
+}
+
+// Instances may define a zero-argument toString() method to control how they
+// are printed and concatenated. A toString field, like the natives bind to
+// what they return, comes before any method.
+func stringify(value Value) string {
+	if instance, ok := value.(*Instance); ok {
+		if field, ok := instance.Fields["toString"]; ok {
+			switch method := field.(type) {
+			case *Function:
+				if method.Required == 0 {
+					return display(method.Body(nil))
+				}
+			case *Native:
+				if method.Arity == 0 {
+					return display(method.Body(nil, 0))
+				}
+			}
+			return display(value)
+		}
+		if method := instance.Class.findMethod("toString"); method != nil {
+			if bound := method(instance); bound.Required == 0 {
+				return display(bound.Body(nil))
+			}
+		}
+	}
+	return display(value)
+}
+
+func interpolate(parts ...Value) Value {
+	var text strings.Builder
+	for _, part := range parts {
+		text.WriteString(stringify(part))
+	}
+	return text.String()
+}
+
+func newList(elements []Value) Value {
+	return &List{elements}
+}
+
+///////////// Operators ///////////////
+
+func toFloat(value Value) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// What integer arithmetic does when the result doesn't fit in an int64:
+// "float", "wrap" or "error", as the dialect the program was built in says
+var overflowMode = "float"
+
+// Integer operands stay integers unless the result overflows or, for '/',
+// isn't whole; otherwise both sides are promoted to floats. What overflow
+// does instead is up to overflowMode.
+func arithmetic(operator byte, left, right Value, line int) (Value, bool) {
+	if l, ok := left.(int64); ok {
+		if r, ok := right.(int64); ok {
+			if result, overflowed, ok := intArithmetic(operator, l, r); ok {
+				switch {
+				case !overflowed || overflowMode == "wrap":
+					return result, true
+				case overflowMode == "error":
+					fail(line, "Integer overflow in %d %c %d.", l, operator, r)
+				}
+			}
+		}
+	}
+	l, lok := toFloat(left)
+	r, rok := toFloat(right)
+	if !lok || !rok {
+		return nil, false
+	}
+	switch operator {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	}
+	return l / r, true
+}
+
+// The integer result of l operator r and whether it overflowed, or false
+// when it has to be done in floating point
+func intArithmetic(operator byte, l, r int64) (int64, bool, bool) {
+	switch operator {
+	case '+':
+		sum := l + r
+		return sum, (sum > l) != (r > 0), true
+	case '-':
+		difference := l - r
+		return difference, (difference < l) != (r > 0), true
+	case '*':
+		product := l * r
+		return product, l != 0 && (product/l != r || (l == -1 && r == math.MinInt64)), true
+	case '/':
+		// A quotient that isn't whole is a float whatever the mode
+		if r == 0 || (r != -1 && l%r != 0) {
+			return 0, false, false
+		}
+		return l / r, l == math.MinInt64 && r == -1, true
+	}
+	return 0, false, false
+}
+
+func add(left, right Value, line int) Value {
+	if result, ok := arithmetic('+', left, right, line); ok {
+		return result
+	}
+	l, lstring := left.(string)
+	r, rstring := right.(string)
+	switch {
+	case lstring && rstring:
+		return l + r
+	case lstring && concatenates(right):
+		return l + stringify(right)
+	case concatenates(left) && rstring:
+		return stringify(left) + r
+	}
+	fail(line, "+ %s %s must be numbers or strings.", debug(left), debug(right))
+	return nil
+}
+
+// concatenates reports whether + joins the value onto a string.
+func concatenates(value Value) bool {
+	switch value.(type) {
+	case int64, float64, *Instance:
+		return true
+	}
+	return false
+}
+
+func numeric(operator byte, left, right Value, line int) Value {
+	if result, ok := arithmetic(operator, left, right, line); ok {
+		return result
+	}
+	fail(line, "%c %s %s must be numbers.", operator, debug(left), debug(right))
+	return nil
+}
+
+func negate(value Value, line int) Value {
+	switch v := value.(type) {
+	case int64:
+		if v != math.MinInt64 || overflowMode == "wrap" {
+			return -v
+		}
+		if overflowMode == "error" {
+			fail(line, "Integer overflow in -(%d).", v)
+		}
+		return -float64(v)
+	case float64:
+		return -v
+	}
+	fail(line, "- %s must be a number.", debug(value))
+	return nil
+}
+
+func compare(operator string, left, right Value, line int) Value {
+	var ordering int
+	l, lint := left.(int64)
+	r, rint := right.(int64)
+	if lint && rint {
+		ordering = cmpInts(l, r)
+	} else {
+		lf, lok := toFloat(left)
+		rf, rok := toFloat(right)
+		if !lok || !rok {
+			fail(line, "%s %s %s must be numbers.", operator, debug(left), debug(right))
+		}
+		if math.IsNaN(lf) || math.IsNaN(rf) {
+			return false
+		}
+		ordering = cmpFloats(lf, rf)
+	}
+	switch operator {
+	case ">":
+		return ordering > 0
+	case ">=":
+		return ordering >= 0
+	case "<":
+		return ordering < 0
+	}
+	return ordering <= 0
+}
+
+func cmpInts(l, r int64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func cmpFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// `==` compares lists element by element and everything else that lives
+// behind a reference by identity
+func isEqual(left, right Value) bool {
+	switch l := left.(type) {
+	case nil:
+		return right == nil
+	case int64:
+		switch r := right.(type) {
+		case int64:
+			return l == r
+		case float64:
+			return float64(l) == r
+		}
+		return false
+	case float64:
+		switch r := right.(type) {
+		case int64:
+			return l == float64(r)
+		case float64:
+			return l == r
+		}
+		return false
+	case *List:
+		r, ok := right.(*List)
+		if !ok {
+			return false
+		}
+		if l == r {
+			return true
+		}
+		if equalityMode == "identity" || len(l.Elements) != len(r.Elements) {
+			return false
+		}
+		for i := range l.Elements {
+			if !isEqual(l.Elements[i], r.Elements[i]) {
+				return false
+			}
+		}
+		return true
+	case *Class:
+		r, ok := right.(*Class)
+		return ok && l.Name == r.Name
+	case *Function:
+		// obj.m == obj.m though each lookup binds a new function
+		r, ok := right.(*Function)
+		return ok && (l == r || l.Receiver != nil && l.Receiver == r.Receiver && l.Owner == r.Owner && l.Name == r.Name)
+	case string, bool, *Native, *Instance:
+		return left == right
+	}
+	return false
+}
+
+func isInstance(left, right Value, line int) Value {
+	class, ok := right.(*Class)
+	if !ok {
+		fail(line, "Right operand of 'is' must be a class but got %s.", display(right))
+	}
+	instance, ok := left.(*Instance)
+	return ok && instance.Class.isSubclassOf(class)
+}
+
+///////////// Variables ///////////////
+
+func global(value Value, name string, line int) Value {
+	if value == undefined {
+		fail(line, "Undefined variable '%s'.", name)
+	}
+	return value
+}
+
+func assignGlobal(variable *Value, value Value, name string, line int) Value {
+	if *variable == undefined {
+		fail(line, "Undefined variable '%s'.", name)
+	}
+	*variable = value
+	return value
+}
+
+func assign(variable *Value, value Value) Value {
+	*variable = value
+	return value
+}
+
+// Splits a list into one value per pattern name, plus a list of the remainder
+// when the pattern has a rest name
+func unpack(value Value, count int, rest bool, line int) []Value {
+	list, ok := value.(*List)
+	if !ok {
+		fail(line, "Can only destructure a list, not %s.", display(value))
+	}
+	if len(list.Elements) < count || (len(list.Elements) > count && !rest) {
+		fail(line, "Expected %d values to unpack but got %d.", count, len(list.Elements))
+	}
+	values := append([]Value{}, list.Elements[:count]...)
+	if rest {
+		values = append(values, newList(append([]Value{}, list.Elements[count:]...)))
+	}
+	return values
+}
+
+///////////// Calls ///////////////
+
+func checkArity(required, params int, variadic bool, declaration string, got int, line int) {
+	if got >= required && (got <= params || variadic) {
+		return
+	}
+	expected := strconv.Itoa(params)
+	if variadic {
+		expected = fmt.Sprintf("at least %d", required)
+	} else if required != params {
+		expected = fmt.Sprintf("%d to %d", required, params)
+	}
+	if declaration == "" {
+		fail(line, "Expected %s arguments but got %d.", expected, got)
+	}
+	fail(line, "Expected %s arguments but got %d. %s.", expected, got, declaration)
+}
+
+// An instance whose class defines call() is called through it
+func callTarget(callee Value) Value {
+	if instance, ok := callee.(*Instance); ok {
+		if method := instance.Class.bindMethod("call", instance); method != nil {
+			return method
+		}
+	}
+	return callee
+}
+
+func call(callee Value, args []Value, line int) Value {
+	if callDepth == maxCallDepth {
+		fail(line, "Stack overflow.")
+	}
+	callDepth++
+	var result Value
+	switch f := callTarget(callee).(type) {
+	case *Function:
+		checkArity(f.Required, f.Params, f.Variadic, f.Declaration, len(args), line)
+		result = f.Body(args)
+	case *Native:
+		checkArity(f.Arity, f.Arity, false, "", len(args), line)
+		result = f.Body(args, line)
+	case *Class:
+		instance := newInstance(f)
+		if init := f.findMethod("init"); init != nil {
+			bound := init(instance)
+			checkArity(bound.Required, bound.Params, bound.Variadic, bound.Declaration, len(args), line)
+			bound.Body(args)
+		} else {
+			checkArity(0, 0, false, f.Name+" has no initializer", len(args), line)
+		}
+		result = instance
+	default:
+		fail(line, "%s is not callable.", display(callee))
+	}
+	callDepth--
+	return result
+}
+
+// The arguments past the declared parameters, for a rest parameter
+func restArgs(args []Value, from int) Value {
+	if len(args) <= from {
+		return newList(nil)
+	}
+	return newList(append([]Value{}, args[from:]...))
+}
+
+// Joins argument or element lists around `...list` spreads
+func concat(parts ...[]Value) []Value {
+	var values []Value
+	for _, part := range parts {
+		values = append(values, part...)
+	}
+	return values
+}
+
+func spread(value Value, line int) []Value {
+	list, ok := value.(*List)
+	if !ok {
+		fail(line, "Can only spread a list, not %s.", display(value))
+	}
+	return list.Elements
+}
+
+// What `for (x in value)` walks over. Lists are copied up front, so changing
+// one inside the loop doesn't change what the loop visits.
+func iterate(value Value, line int) []Value {
+	switch v := value.(type) {
+	case *List:
+		return append([]Value{}, v.Elements...)
+	case string:
+		var characters []Value
+		for _, c := range v {
+			characters = append(characters, string(c))
+		}
+		return characters
+	}
+	fail(line, "%s is not iterable.", display(value))
+	return nil
+}
+
+///////////// Classes ///////////////
+
+// Looks the method up on this class, then up the superclass chain
+func (c *Class) findMethod(name string) func(*Instance) *Function {
+	for class := c; class != nil; class = class.Super {
+		if method, ok := class.Methods[name]; ok {
+			return method
+		}
+	}
+	return nil
+}
+
+// The method bound to the instance as a value of its own, or nil when there
+// isn't one
+func (c *Class) bindMethod(name string, this *Instance) *Function {
+	for class := c; class != nil; class = class.Super {
+		if method, ok := class.Methods[name]; ok {
+			bound := method(this)
+			bound.Receiver, bound.Owner = this, class
+			return bound
+		}
+	}
+	return nil
+}
+
+// Its methods' names and those it inherits
+func (c *Class) methodNames() []string {
+	var names []string
+	for class := c; class != nil; class = class.Super {
+		for name := range class.Methods {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (c *Class) isSubclassOf(other *Class) bool {
+	for class := c; class != nil; class = class.Super {
+		if class.Name == other.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func superclass(value Value, line int) *Class {
+	class, ok := value.(*Class)
+	if !ok {
+		fail(line, "Superclass must be a class.")
+	}
+	return class
+}
+
+func getProperty(object Value, name string, line int) Value {
+	if list, ok := object.(*List); ok {
+		return listMethod(list, name, line)
+	}
+	instance, ok := object.(*Instance)
+	if !ok {
+		fail(line, "%s is not an instance.", display(object))
+	}
+	if value, ok := instance.Fields[name]; ok {
+		return value
+	}
+	if method := instance.Class.bindMethod(name, instance); method != nil {
+		return method
+	}
+	fail(line, "%s", undefinedProperty(name, append(instance.Class.methodNames(), instance.Order...)))
+	return nil
+}
+
+// A list's methods are natives that take the list first, so
+// `list.get(i, default)` is get(list, i, default)
+func listMethod(list *List, name string, line int) Value {
+	if name == "get" {
+		return &Native{"get", 2, func(args []Value, line int) Value {
+			return getNative(append([]Value{list}, args...), line)
+		}}
+	}
+	fail(line, "List has no method '%s'.", name)
+	return nil
+}
+
+// The error for a missing property, naming the closest one there is, as
+// resolver::closest picks it
+func undefinedProperty(name string, names []string) string {
+	limit := min(2, utf8.RuneCountInString(name)-1)
+	best, bestDistance := "", limit+1
+	for _, candidate := range names {
+		d := editDistance(name, candidate)
+		if d < bestDistance || (d == bestDistance && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return fmt.Sprintf("Undefined property '%s'.", name)
+	}
+	return fmt.Sprintf("Undefined property '%s'. Did you mean '%s'?", name, best)
+}
+
+func editDistance(a, b string) int {
+	target := []rune(b)
+	row := make([]int, len(target)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i, ca := range []rune(a) {
+		previous := row[0]
+		row[0] = i + 1
+		for j, cb := range target {
+			substitution := previous
+			if ca != cb {
+				substitution++
+			}
+			previous = row[j+1]
+			row[j+1] = min(substitution, row[j]+1, previous+1)
+		}
+	}
+	return row[len(target)]
+}
+
+func setProperty(object Value, name string, value Value, line int) Value {
+	instance, ok := object.(*Instance)
+	if !ok {
+		fail(line, "%s is not an instance.", display(object))
+	}
+	instance.set(name, value)
+	return value
+}
+
+func superMethod(class *Class, name string, this *Instance, line int) Value {
+	method := class.bindMethod(name, this)
+	if method == nil {
+		fail(line, "%s", undefinedProperty(name, class.methodNames()))
+	}
+	return method
+}
+
+func optionalGet(object Value, name string, line int) Value {
+	if object == nil {
+		panic(shortCircuit{})
+	}
+	return getProperty(object, name, line)
+}
+
+// `object?[index]`, which ends the chain when the object is nil or the index
+// is out of range
+func optionalIndex(object, index Value, line int) Value {
+	if object == nil {
+		panic(shortCircuit{})
+	}
+	list, ok := object.(*List)
+	if !ok {
+		fail(line, "%s is not a list.", display(object))
+	}
+	i, found := listPosition(list, index, line)
+	if !found {
+		panic(shortCircuit{})
+	}
+	return list.Elements[i]
+}
+
+// Evaluates a chain containing `?.`, which is nil if any `?.` met nil
+func optionalChain(chain func() Value) (result Value) {
+	depth := callDepth
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(shortCircuit); !ok {
+				panic(r)
+			}
+			callDepth = depth
+			result = nil
+		}
+	}()
+	return chain()
+}
+
+///////////// Lists ///////////////
+
+func listIndex(list *List, index Value, line int) int {
+	i, found := listPosition(list, index, line)
+	if !found {
+		fail(line, "List index %s out of range.", display(index))
+	}
+	return i
+}
+
+// Where index is in the list, and false when it's out of range. Only an
+// index that isn't a number is an error.
+func listPosition(list *List, index Value, line int) (int, bool) {
+	switch n := index.(type) {
+	case int64:
+		return int(n), n >= 0 && n < int64(len(list.Elements))
+	case float64:
+		return int(n), n == math.Trunc(n) && n >= 0 && n < float64(len(list.Elements))
+	}
+	fail(line, "List index %s must be a number.", display(index))
+	return 0, false
+}
+
+func getIndex(object, index Value, line int) Value {
+	list, ok := object.(*List)
+	if !ok {
+		fail(line, "%s is not a list.", display(object))
+	}
+	return list.Elements[listIndex(list, index, line)]
+}
+
+func setIndex(object, index, value Value, line int) Value {
+	list, ok := object.(*List)
+	if !ok {
+		fail(line, "%s is not a list.", display(object))
+	}
+	list.Elements[listIndex(list, index, line)] = value
+	return value
+}
+
+///////////// Natives ///////////////
+
+var natives = map[string]Value{
+	"clock":        &Native{"clock", 0, clockNative},
+	"len":          &Native{"len", 1, lenNative},
+	"push":         &Native{"push", 2, pushNative},
+	"get":          &Native{"get", 3, getNative},
+	"hasField":     &Native{"hasField", 2, hasFieldNative},
+	"getField":     &Native{"getField", 2, getFieldNative},
+	"setField":     &Native{"setField", 3, setFieldNative},
+	"fields":       &Native{"fields", 1, fieldsNative},
+	"methods":      &Native{"methods", 1, methodsNative},
+	"classOf":      &Native{"classOf", 1, classOfNative},
+	"identical":    &Native{"identical", 2, identicalNative},
+	"zip":          &Native{"zip", 2, zipNative},
+	"range":        &Native{"range", 2, rangeNative},
+	"map":          &Native{"map", 2, mapNative},
+	"filter":       &Native{"filter", 2, filterNative},
+	"reduce":       &Native{"reduce", 3, reduceNative},
+	"sort":         &Native{"sort", 1, sortNative},
+	"sortBy":       &Native{"sortBy", 2, sortByNative},
+	"any":          &Native{"any", 2, anyNative},
+	"all":          &Native{"all", 2, allNative},
+	"regex":        &Native{"regex", 1, regexNative},
+	"DateTime":     dateTimeNamespace(),
+	"sha256":       &Native{"sha256", 1, sha256Native},
+	"md5":          &Native{"md5", 1, md5Native},
+	"hmac":         &Native{"hmac", 2, hmacNative},
+	"base64Encode": &Native{"base64Encode", 1, base64EncodeNative},
+	"base64Decode": &Native{"base64Decode", 1, base64DecodeNative},
+	"uuid":         &Native{"uuid", 0, uuidNative},
+	"toFixed":      &Native{"toFixed", 2, toFixedNative},
+	"str":          &Native{"str", 1, strNative},
+	"num":          &Native{"num", 1, numNative},
+	"nan":          math.NaN(),
+	"inf":          math.Inf(1),
+	"isNaN":        &Native{"isNaN", 1, isNaNNative},
+	"isFinite":     &Native{"isFinite", 1, isFiniteNative},
+}
+
+func clockNative(args []Value, line int) Value {
+	return float64(time.Now().UnixNano()) / 1e9
+}
+
+func lenNative(args []Value, line int) Value {
+	switch v := args[0].(type) {
+	case *List:
+		return int64(len(v.Elements))
+	case string:
+		return int64(len([]rune(v)))
+	}
+	fail(line, "len: %s has no length.", display(args[0]))
+	return nil
+}
+
+func getNative(args []Value, line int) Value {
+	switch v := args[0].(type) {
+	case *List:
+		if i, found := listPosition(v, args[1], line); found {
+			return v.Elements[i]
+		}
+		return args[2]
+	case *Instance:
+		if value, found := v.Fields[expectString("get", args[1], line)]; found {
+			return value
+		}
+		return args[2]
+	}
+	fail(line, "get: %s is not a list or an instance.", display(args[0]))
+	return nil
+}
+
+func expectString(native string, value Value, line int) string {
+	s, ok := value.(string)
+	if !ok {
+		fail(line, "%s: Field name must be a string.", native)
+	}
+	return s
+}
+
+func expectInstance(native string, value Value, line int) *Instance {
+	instance, ok := value.(*Instance)
+	if !ok {
+		fail(line, "%s: %s is not an instance.", native, display(value))
+	}
+	return instance
+}
+
+func expectList(native string, value Value, line int) []Value {
+	list, ok := value.(*List)
+	if !ok {
+		fail(line, "%s: %s is not a list.", native, display(value))
+	}
+	return append([]Value{}, list.Elements...)
+}
+
+func hasFieldNative(args []Value, line int) Value {
+	name := expectString("hasField", args[1], line)
+	if instance, ok := args[0].(*Instance); ok {
+		_, found := instance.Fields[name]
+		return found
+	}
+	return false
+}
+
+func getFieldNative(args []Value, line int) Value {
+	instance := expectInstance("getField", args[0], line)
+	name := expectString("getField", args[1], line)
+	value, ok := instance.Fields[name]
+	if !ok {
+		fail(line, "getField: Undefined field '%s'.", name)
+	}
+	return value
+}
+
+func setFieldNative(args []Value, line int) Value {
+	instance := expectInstance("setField", args[0], line)
+	instance.set(expectString("setField", args[1], line), args[2])
+	return args[2]
+}
+
+func sortedNames(names []string) Value {
+	sort.Strings(names)
+	values := make([]Value, len(names))
+	for i, name := range names {
+		values[i] = name
+	}
+	return newList(values)
+}
+
+func pushNative(args []Value, line int) Value {
+	list, ok := args[0].(*List)
+	if !ok {
+		fail(line, "push: %s is not a list.", display(args[0]))
+	}
+	list.Elements = append(list.Elements, args[1])
+	return nil
+}
+
+func fieldsNative(args []Value, line int) Value {
+	instance := expectInstance("fields", args[0], line)
+	names := make([]Value, len(instance.Order))
+	for i, name := range instance.Order {
+		names[i] = name
+	}
+	return newList(names)
+}
+
+func methodsNative(args []Value, line int) Value {
+	class, ok := args[0].(*Class)
+	if !ok {
+		fail(line, "methods: %s is not a class.", display(args[0]))
+	}
+	seen := map[string]bool{}
+	var names []string
+	for ; class != nil; class = class.Super {
+		for name := range class.Methods {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return sortedNames(names)
+}
+
+func classOfNative(args []Value, line int) Value {
+	if instance, ok := args[0].(*Instance); ok {
+		return instance.Class
+	}
+	return nil
+}
+
+// Strict equality: values must have the same type and lists are only
+// identical to themselves
+func identicalNative(args []Value, line int) Value {
+	switch l := args[0].(type) {
+	case int64, float64:
+		return args[0] == args[1]
+	case *List:
+		r, ok := args[1].(*List)
+		return ok && l == r
+	case *Function:
+		r, ok := args[1].(*Function)
+		return ok && l == r
+	}
+	switch args[1].(type) {
+	case int64, float64:
+		return false
+	}
+	return isEqual(args[0], args[1])
+}
+
+func zipNative(args []Value, line int) Value {
+	left, lok := args[0].(*List)
+	right, rok := args[1].(*List)
+	if !lok || !rok {
+		fail(line, "zip: arguments must be lists.")
+	}
+	var pairs []Value
+	for i := 0; i < len(left.Elements) && i < len(right.Elements); i++ {
+		pairs = append(pairs, newList([]Value{left.Elements[i], right.Elements[i]}))
+	}
+	return newList(pairs)
+}
+
+func rangeNative(args []Value, line int) Value {
+	start, sok := args[0].(int64)
+	end, eok := args[1].(int64)
+	if !sok || !eok {
+		fail(line, "range: bounds must be integers.")
+	}
+	var values []Value
+	for i := start; i < end; i++ {
+		values = append(values, i)
+	}
+	return newList(values)
+}
+
+// Calls a Lox value from a native with the same arity rules as a call
+func callValue(native string, callee Value, args []Value, line int) Value {
+	switch f := callTarget(callee).(type) {
+	case *Function:
+		if len(args) < f.Required || (len(args) > f.Params && !f.Variadic) {
+			fail(line, "%s: callback must accept %d arguments.", native, len(args))
+		}
+	case *Native:
+		if len(args) != f.Arity {
+			fail(line, "%s: callback must accept %d arguments.", native, len(args))
+		}
+	case *Class:
+	default:
+		fail(line, "%s: %s is not callable.", native, display(callee))
+	}
+	return call(callee, args, line)
+}
+
+func mapNative(args []Value, line int) Value {
+	var mapped []Value
+	for _, element := range expectList("map", args[0], line) {
+		mapped = append(mapped, callValue("map", args[1], []Value{element}, line))
+	}
+	return newList(mapped)
+}
+
+func filterNative(args []Value, line int) Value {
+	var kept []Value
+	for _, element := range expectList("filter", args[0], line) {
+		if truthy(callValue("filter", args[1], []Value{element}, line)) {
+			kept = append(kept, element)
+		}
+	}
+	return newList(kept)
+}
+
+func reduceNative(args []Value, line int) Value {
+	accumulator := args[2]
+	for _, element := range expectList("reduce", args[0], line) {
+		accumulator = callValue("reduce", args[1], []Value{accumulator, element}, line)
+	}
+	return accumulator
+}
+
+func anyNative(args []Value, line int) Value {
+	for _, element := range expectList("any", args[0], line) {
+		if truthy(callValue("any", args[1], []Value{element}, line)) {
+			return true
+		}
+	}
+	return false
+}
+
+func allNative(args []Value, line int) Value {
+	for _, element := range expectList("all", args[0], line) {
+		if !truthy(callValue("all", args[1], []Value{element}, line)) {
+			return false
+		}
+	}
+	return true
+}
+
+// A merge sort like the interpreter's, so equal elements keep their order and
+// a comparator that isn't consistent can't break it
+func sortNative(args []Value, line int) Value {
+	return newList(mergeSort(expectList("sort", args[0], line), func(left, right Value) bool {
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return l > r
+			}
+		}
+		if l, ok := left.(int64); ok {
+			if r, ok := right.(int64); ok {
+				return l > r
+			}
+		}
+		l, lok := toFloat(left)
+		r, rok := toFloat(right)
+		if !lok || !rok {
+			fail(line, "sort: Can't order %s and %s. Use sortBy() with a comparator for anything but numbers or strings.", display(left), display(right))
+		}
+		return l > r
+	}))
+}
+
+func sortByNative(args []Value, line int) Value {
+	return newList(mergeSort(expectList("sortBy", args[0], line), func(left, right Value) bool {
+		order := callValue("sortBy", args[1], []Value{left, right}, line)
+		n, ok := toFloat(order)
+		if !ok {
+			fail(line, "sortBy: comparator must return a number but got %s.", display(order))
+		}
+		return n > 0
+	}))
+}
+
+// rightFirst(left, right) says whether right belongs before left
+func mergeSort(elements []Value, rightFirst func(left, right Value) bool) []Value {
+	if len(elements) <= 1 {
+		return elements
+	}
+	middle := len(elements) / 2
+	left := mergeSort(append([]Value{}, elements[:middle]...), rightFirst)
+	right := mergeSort(append([]Value{}, elements[middle:]...), rightFirst)
+	merged := make([]Value, 0, len(elements))
+	for len(left) > 0 && len(right) > 0 {
+		if rightFirst(left[0], right[0]) {
+			merged, right = append(merged, right[0]), right[1:]
+		} else {
+			merged, left = append(merged, left[0]), left[1:]
+		}
+	}
+	return append(append(merged, left...), right...)
+}
+
+///////////// Regular expressions ///////////////
+
+var regexClass = &Class{Name: "Regex", Methods: map[string]func(this *Instance) *Function{}}
+
+// The interpreter's regex() follows this package's syntax, so a built
+// program matches the same way. The methods are fields bound to the pattern.
+func regexNative(args []Value, line int) Value {
+	pattern, ok := args[0].(string)
+	if !ok {
+		fail(line, "regex: Pattern must be a string.")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		message := err.Error()
+		if syntaxError, ok := err.(*syntax.Error); ok {
+			message = string(syntaxError.Code)
+		}
+		fail(line, "regex: Invalid regex `%s`: %s.", pattern, message)
+	}
+	text := func(native string, value Value, line int) string {
+		s, ok := value.(string)
+		if !ok {
+			fail(line, "%s: Text to search must be a string.", native)
+		}
+		return s
+	}
+	list := func(pieces []string) Value {
+		values := make([]Value, len(pieces))
+		for i, piece := range pieces {
+			values[i] = piece
+		}
+		return newList(values)
+	}
+	return newInstance(regexClass,
+		"pattern", pattern,
+		"match", &Native{"match", 1, func(args []Value, line int) Value {
+			return re.MatchString(text("match", args[0], line))
+		}},
+		"find", &Native{"find", 1, func(args []Value, line int) Value {
+			s := text("find", args[0], line)
+			if match := re.FindStringIndex(s); match != nil {
+				return s[match[0]:match[1]]
+			}
+			return nil
+		}},
+		"findAll", &Native{"findAll", 1, func(args []Value, line int) Value {
+			return list(re.FindAllString(text("findAll", args[0], line), -1))
+		}},
+		"replace", &Native{"replace", 2, func(args []Value, line int) Value {
+			replacement, ok := args[1].(string)
+			if !ok {
+				fail(line, "replace: Replacement must be a string.")
+			}
+			return re.ReplaceAllString(text("replace", args[0], line), replacement)
+		}},
+		"split", &Native{"split", 1, func(args []Value, line int) Value {
+			return list(re.Split(text("split", args[0], line), -1))
+		}},
+	)
+}
+
+///////////// Dates and times ///////////////
+
+// The interpreter's DateTime follows this package's layouts and zones, so a
+// built program reads and writes times the same way. As with regexes, the
+// methods are fields bound to the time.
+func dateTimeNamespace() Value {
+	parse := func(native string, args []Value, location *time.Location, line int) Value {
+		layout, ok := args[0].(string)
+		if !ok {
+			fail(line, "%s: Layout must be a string.", native)
+		}
+		text, ok := args[1].(string)
+		if !ok {
+			fail(line, "%s: Time must be a string.", native)
+		}
+		t, err := time.ParseInLocation(layout, text, location)
+		if native == "parse" {
+			t, err = time.Parse(layout, text)
+		}
+		if err != nil {
+			fail(line, "%s: Can't parse \"%s\" as \"%s\".", native, text, layout)
+		}
+		return dateTimeValue(t)
+	}
+	return newInstance(&Class{Name: "DateTime", Methods: map[string]func(this *Instance) *Function{}},
+		"now", &Native{"now", 0, func(args []Value, line int) Value {
+			return dateTimeValue(time.Now())
+		}},
+		"parse", &Native{"parse", 2, func(args []Value, line int) Value {
+			return parse("parse", args, time.UTC, line)
+		}},
+		"parseIn", &Native{"parseIn", 3, func(args []Value, line int) Value {
+			return parse("parseIn", args, loadZone("parseIn", args[2], line), line)
+		}},
+		"unix", &Native{"unix", 1, func(args []Value, line int) Value {
+			if n, ok := args[0].(int64); ok {
+				return dateTimeValue(time.Unix(n, 0))
+			}
+			return dateTimeValue(addSeconds("unix", time.Unix(0, 0), args[0], line))
+		}},
+		"RFC3339", time.RFC3339,
+		"DateOnly", time.DateOnly,
+		"TimeOnly", time.TimeOnly,
+	)
+}
+
+func loadZone(native string, value Value, line int) *time.Location {
+	name, ok := value.(string)
+	if !ok {
+		fail(line, "%s: Zone must be a string.", native)
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		fail(line, "%s: Unknown time zone '%s'.", native, name)
+	}
+	return location
+}
+
+// Whole seconds are added exactly and the fraction to the nanosecond,
+// rounding down, as the interpreter does
+func addSeconds(native string, t time.Time, value Value, line int) time.Time {
+	var seconds float64
+	switch n := value.(type) {
+	case int64:
+		seconds = float64(n)
+	case float64:
+		seconds = n
+	default:
+		fail(line, "%s: Seconds must be a number.", native)
+	}
+	whole := math.Floor(seconds)
+	if math.IsInf(whole, 0) || math.IsNaN(whole) || math.Abs(whole) >= 1<<62 {
+		fail(line, "%s: Time out of range.", native)
+	}
+	return time.Unix(t.Unix()+int64(whole), int64(t.Nanosecond())+int64((seconds-whole)*1e9)).In(t.Location())
+}
+
+func dateTimeValue(t time.Time) Value {
+	zone, offset := t.Zone()
+	count := func(native, what string, value Value, line int) int {
+		n, ok := value.(int64)
+		if !ok {
+			fail(line, "%s: %s must be an integer.", native, what)
+		}
+		return int(n)
+	}
+	return newInstance(&Class{Name: "DateTime", Methods: map[string]func(this *Instance) *Function{}},
+		"year", int64(t.Year()),
+		"month", int64(t.Month()),
+		"day", int64(t.Day()),
+		"hour", int64(t.Hour()),
+		"minute", int64(t.Minute()),
+		"second", int64(t.Second()),
+		"nanosecond", int64(t.Nanosecond()),
+		"yearDay", int64(t.YearDay()),
+		"offset", int64(offset),
+		"unix", t.Unix(),
+		"weekday", t.Weekday().String(),
+		"zone", zone,
+		"format", &Native{"format", 1, func(args []Value, line int) Value {
+			layout, ok := args[0].(string)
+			if !ok {
+				fail(line, "format: Layout must be a string.")
+			}
+			return t.Format(layout)
+		}},
+		"inZone", &Native{"inZone", 1, func(args []Value, line int) Value {
+			return dateTimeValue(t.In(loadZone("inZone", args[0], line)))
+		}},
+		"addSeconds", &Native{"addSeconds", 1, func(args []Value, line int) Value {
+			return dateTimeValue(addSeconds("addSeconds", t, args[0], line))
+		}},
+		"addDays", &Native{"addDays", 1, func(args []Value, line int) Value {
+			return dateTimeValue(t.AddDate(0, 0, count("addDays", "Days", args[0], line)))
+		}},
+		"addMonths", &Native{"addMonths", 1, func(args []Value, line int) Value {
+			return dateTimeValue(t.AddDate(0, count("addMonths", "Months", args[0], line), 0))
+		}},
+		"since", &Native{"since", 1, func(args []Value, line int) Value {
+			unix, nanosecond, ok := instant(args[0])
+			if !ok {
+				fail(line, "since: %s is not a DateTime.", display(args[0]))
+			}
+			return float64(t.Unix()-unix) + float64(int64(t.Nanosecond())-nanosecond)/1e9
+		}},
+		"toString", &Native{"toString", 0, func(args []Value, line int) Value {
+			return t.Format("2006-01-02 15:04:05.999999999 -0700 MST")
+		}},
+	)
+}
+
+// The instant a DateTime instance stands for
+func instant(value Value) (unix int64, nanosecond int64, ok bool) {
+	instance, ok := value.(*Instance)
+	if !ok || instance.Class.Name != "DateTime" {
+		return 0, 0, false
+	}
+	unix, ok = instance.Fields["unix"].(int64)
+	if !ok {
+		return 0, 0, false
+	}
+	nanosecond, ok = instance.Fields["nanosecond"].(int64)
+	return unix, nanosecond, ok
+}
+
+///////////// Hashing ///////////////
+
+func expectData(native string, what string, value Value, line int) []byte {
+	s, ok := value.(string)
+	if !ok {
+		fail(line, "%s: %s must be a string or bytes.", native, what)
+	}
+	return []byte(s)
+}
+
+func sha256Native(args []Value, line int) Value {
+	digest := sha256.Sum256(expectData("sha256", "Data", args[0], line))
+	return hex.EncodeToString(digest[:])
+}
+
+func md5Native(args []Value, line int) Value {
+	digest := md5.Sum(expectData("md5", "Data", args[0], line))
+	return hex.EncodeToString(digest[:])
+}
+
+func hmacNative(args []Value, line int) Value {
+	mac := hmac.New(sha256.New, expectData("hmac", "Key", args[0], line))
+	mac.Write(expectData("hmac", "Data", args[1], line))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func base64EncodeNative(args []Value, line int) Value {
+	return base64.StdEncoding.EncodeToString(expectData("base64Encode", "Data", args[0], line))
+}
+
+func base64DecodeNative(args []Value, line int) Value {
+	text, ok := args[0].(string)
+	if !ok {
+		fail(line, "base64Decode: Base64 must be a string.")
+	}
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		fail(line, "base64Decode: '%s' isn't valid base64.", text)
+	}
+	if !utf8.Valid(data) {
+		fail(line, "base64Decode: The decoded data isn't UTF-8 text; fromBase64() decodes it to bytes.")
+	}
+	return string(data)
+}
+
+func uuidNative(args []Value, line int) Value {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		fail(line, "uuid: Can't read random bytes: %s.", err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	digits := hex.EncodeToString(id[:])
+	return digits[:8] + "-" + digits[8:12] + "-" + digits[12:16] + "-" + digits[16:20] + "-" + digits[20:]
+}
+
+func expectNumber(native string, value Value, line int) float64 {
+	n, ok := toFloat(value)
+	if !ok {
+		fail(line, "%s: %s is not a number.", native, display(value))
+	}
+	return n
+}
+
+func isNaNNative(args []Value, line int) Value {
+	return math.IsNaN(expectNumber("isNaN", args[0], line))
+}
+
+func isFiniteNative(args []Value, line int) Value {
+	n := expectNumber("isFinite", args[0], line)
+	return !math.IsNaN(n) && !math.IsInf(n, 0)
+}
+
+func toFixedNative(args []Value, line int) Value {
+	n := expectNumber("toFixed", args[0], line)
+	digits, ok := args[1].(int64)
+	if !ok || digits < 0 || digits > 100 {
+		fail(line, "toFixed: Digits must be an integer from 0 to 100, not %s.", display(args[1]))
+	}
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return formatNumber(n)
+	}
+	return strconv.FormatFloat(n, 'f', int(digits), 64)
+}
+
+func strNative(args []Value, line int) Value {
+	return stringify(args[0])
+}
+
+// numberText is what num() accepts besides NaN, inf and -inf, as in
+// parse_number in lexer.rs
+var numberText = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+func numNative(args []Value, line int) Value {
+	switch v := args[0].(type) {
+	case int64, float64:
+		return v
+	case string:
+		switch v {
+		case "NaN":
+			return math.NaN()
+		case "inf":
+			return math.Inf(1)
+		case "-inf":
+			return math.Inf(-1)
+		}
+		match := numberText.FindStringSubmatch(v)
+		if match == nil {
+			fail(line, "num: Cannot convert '%s' to a number.", v)
+		}
+		// Out of range only rounds to inf or 0, as in Rust
+		n, _ := strconv.ParseFloat(v, 64)
+		if match[1] == "" && match[2] == "" && !(n == 0 && strings.HasPrefix(v, "-")) {
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return i
+			}
+		}
+		return n
+	}
+	fail(line, "num: Cannot convert %s to a number.", display(args[0]))
+	return nil
+}
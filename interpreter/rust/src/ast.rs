@@ -29,6 +29,32 @@ pub trait ExprVisitor<R> {
   fn visitSuperExpression(&mut self, expr: &SuperExpr) -> R;
   #[allow(non_snake_case)]
   fn visitThisExpression(&mut self, expr: &ThisExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitListExpr(&mut self, expr: &ListExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitSetLiteralExpr(&mut self, expr: &SetLiteralExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitMapLiteralExpr(&mut self, expr: &MapLiteralExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitIndexExpr(&mut self, expr: &IndexExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitIndexSetExpr(&mut self, expr: &IndexSetExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitSpreadExpr(&mut self, expr: &SpreadExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitDestructureAssignExpr(&mut self, expr: &DestructureAssignExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitInterpolationExpr(&mut self, expr: &InterpolationExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitOptionalGetExpr(&mut self, expr: &OptionalGetExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitOptionalIndexExpr(&mut self, expr: &OptionalIndexExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitOptionalChainExpr(&mut self, expr: &OptionalChainExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitMatchExpr(&mut self, expr: &MatchExpr) -> R;
+  #[allow(non_snake_case)]
+  fn visitComparisonExpr(&mut self, expr: &ComparisonExpr) -> R;
 }
 
 #[derive(Clone, Debug, Hash, PartialEq, Eq)]
@@ -45,7 +71,54 @@ pub enum Expr {
   Logical(LogicalExpr),
   Super(SuperExpr),
   This(ThisExpr),
+  List(ListExpr),
+  SetLiteral(SetLiteralExpr),
+  MapLiteral(MapLiteralExpr),
+  Index(IndexExpr),
+  IndexSet(IndexSetExpr),
+  Spread(SpreadExpr),
+  DestructureAssign(DestructureAssignExpr),
+  Interpolation(InterpolationExpr),
+  OptionalGet(OptionalGetExpr),
+  OptionalIndex(OptionalIndexExpr),
+  OptionalChain(OptionalChainExpr),
+  Match(MatchExpr),
+  Comparison(ComparisonExpr),
+}
+impl Expr {
+  // The leftmost token of the expression, which marks where it starts in the
+  // source. Only literals have none.
+  pub fn first_token(&self) -> Option<&Token> {
+    match self {
+      Expr::Assign(expr) => Some(&expr.name),
+      Expr::Binary(expr) => expr.left.first_token().or(Some(&expr.operator)),
+      Expr::Call(expr) => expr.callee.first_token().or(Some(&expr.paren)),
+      Expr::Get(expr) => expr.object.first_token().or(Some(&expr.name)),
+      Expr::Set(expr) => expr.object.first_token().or(Some(&expr.name)),
+      Expr::Grouping(expr) => expr.expression.first_token(),
+      Expr::Literal(_) => None,
+      Expr::Unary(expr) => Some(&expr.operator),
+      Expr::Variable(expr) => Some(&expr.name),
+      Expr::Logical(expr) => expr.left.first_token().or(Some(&expr.operator)),
+      Expr::Super(expr) => Some(&expr.keyword),
+      Expr::This(expr) => Some(&expr.keyword),
+      Expr::List(expr) => Some(&expr.bracket),
+      Expr::SetLiteral(expr) => Some(&expr.brace),
+      Expr::MapLiteral(expr) => Some(&expr.brace),
+      Expr::Index(expr) => expr.object.first_token().or(Some(&expr.bracket)),
+      Expr::IndexSet(expr) => expr.object.first_token().or(Some(&expr.bracket)),
+      Expr::Spread(expr) => Some(&expr.ellipsis),
+      Expr::DestructureAssign(expr) => Some(&expr.pattern.bracket),
+      Expr::Interpolation(expr) => Some(&expr.start),
+      Expr::OptionalGet(expr) => expr.object.first_token().or(Some(&expr.name)),
+      Expr::OptionalIndex(expr) => expr.object.first_token().or(Some(&expr.bracket)),
+      Expr::OptionalChain(expr) => expr.expression.first_token(),
+      Expr::Match(expr) => Some(&expr.keyword),
+      Expr::Comparison(expr) => expr.left.first_token().or(Some(&expr.comparisons[0].0)),
+    }
+  }
 }
+
 #[derive(Clone, Debug, Hash, PartialEq, Eq)]
 pub struct AssignExpr {
   pub name: Token,
@@ -71,16 +144,33 @@ impl BinaryExpr {
   }
 }
 
+// A chain of comparisons, `a < b <= c`, which is (a < b) and (b <= c) with b
+// evaluated once. A single comparison is a BinaryExpr.
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct ComparisonExpr {
+  pub left: Box<Expr>,
+  // Each operator with the operand to its right
+  pub comparisons: Vec<(Token, Expr)>,
+}
+
+impl ComparisonExpr {
+  pub fn new(left: Box<Expr>, comparisons: Vec<(Token, Expr)>) -> Self {
+    Self { left, comparisons }
+  }
+}
+
 #[derive(Clone, Debug, Hash, PartialEq, Eq)]
 pub struct CallExpr {
   pub callee: Box<Expr>,
   pub paren: Token,
   pub arguments: Vec<Expr>,
+  // `name: value` arguments, which always come after the positional ones
+  pub named_arguments: Vec<(Token, Expr)>,
 }
 
 impl CallExpr {
-  pub fn new(callee: Box<Expr>, paren: Token, arguments: Vec<Expr>) -> Self {
-    Self { callee, paren, arguments }
+  pub fn new(callee: Box<Expr>, paren: Token, arguments: Vec<Expr>, named_arguments: Vec<(Token, Expr)>) -> Self {
+    Self { callee, paren, arguments, named_arguments }
   }
 }
 
@@ -96,6 +186,48 @@ impl GetExpr {
   }
 }
 
+// `object?.name`. Only appears inside an OptionalChainExpr, which is where
+// evaluation ends up when the object is nil.
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct OptionalGetExpr {
+  pub object: Box<Expr>,
+  pub name: Token,
+}
+
+impl OptionalGetExpr {
+  pub fn new(object: Box<Expr>, name: Token) -> Self {
+    Self { object, name }
+  }
+}
+
+// `object?[index]`, which like `?.` ends its chain with nil when the object
+// is nil, and also when the index is out of range.
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct OptionalIndexExpr {
+  pub object: Box<Expr>,
+  pub bracket: Token,
+  pub index: Box<Expr>,
+}
+
+impl OptionalIndexExpr {
+  pub fn new(object: Box<Expr>, bracket: Token, index: Box<Expr>) -> Self {
+    Self { object, bracket, index }
+  }
+}
+
+// Wraps a whole call/property chain containing `?.` so that the rest of the
+// chain is skipped and the chain evaluates to nil.
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct OptionalChainExpr {
+  pub expression: Box<Expr>,
+}
+
+impl OptionalChainExpr {
+  pub fn new(expression: Box<Expr>) -> Self {
+    Self { expression }
+  }
+}
+
 #[derive(Clone, Debug, Hash, PartialEq, Eq)]
 pub struct SetExpr {
   pub object: Box<Expr>,
@@ -194,6 +326,241 @@ impl ThisExpr {
   }
 }
 
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct ListExpr {
+  pub bracket: Token,
+  pub elements: Vec<Expr>,
+}
+
+impl ListExpr {
+  pub fn new(bracket: Token, elements: Vec<Expr>) -> Self {
+    Self { bracket, elements }
+  }
+}
+
+// #{a, b}
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct SetLiteralExpr {
+  pub brace: Token,
+  pub elements: Vec<Expr>,
+}
+
+impl SetLiteralExpr {
+  pub fn new(brace: Token, elements: Vec<Expr>) -> Self {
+    Self { brace, elements }
+  }
+}
+
+// {key: value}, where a key written as a name is that name as a string
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct MapLiteralExpr {
+  pub brace: Token,
+  pub entries: Vec<(Expr, Expr)>,
+}
+
+impl MapLiteralExpr {
+  pub fn new(brace: Token, entries: Vec<(Expr, Expr)>) -> Self {
+    Self { brace, entries }
+  }
+}
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct IndexExpr {
+  pub object: Box<Expr>,
+  pub bracket: Token,
+  pub index: Box<Expr>,
+}
+
+impl IndexExpr {
+  pub fn new(object: Box<Expr>, bracket: Token, index: Box<Expr>) -> Self {
+    Self { object, bracket, index }
+  }
+}
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct IndexSetExpr {
+  pub object: Box<Expr>,
+  pub bracket: Token,
+  pub index: Box<Expr>,
+  pub value: Box<Expr>,
+}
+
+impl IndexSetExpr {
+  pub fn new(object: Box<Expr>, bracket: Token, index: Box<Expr>, value: Box<Expr>) -> Self {
+    Self { object, bracket, index, value }
+  }
+}
+
+// `...expr`, only parsed inside argument lists and list literals
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct SpreadExpr {
+  pub ellipsis: Token,
+  pub expression: Box<Expr>,
+}
+
+impl SpreadExpr {
+  pub fn new(ellipsis: Token, expression: Box<Expr>) -> Self {
+    Self { ellipsis, expression }
+  }
+}
+
+// The names a list is unpacked into, as in `[a, b, ...rest]` or
+// `(a, b)`, or a map, as in `{name, age: years, ...rest}`. A map pattern has
+// one key per target; the rest name takes the entries no key named.
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct DestructurePattern {
+  pub bracket: Token,
+  pub targets: Vec<VariableExpr>,
+  pub rest: Option<VariableExpr>,
+  pub keys: Option<Vec<Token>>,
+}
+
+impl DestructurePattern {
+  pub fn new(bracket: Token, targets: Vec<VariableExpr>, rest: Option<VariableExpr>) -> Self {
+    Self { bracket, targets, rest, keys: None }
+  }
+
+  pub fn keyed(brace: Token, keys: Vec<Token>, targets: Vec<VariableExpr>, rest: Option<VariableExpr>) -> Self {
+    Self { bracket: brace, targets, rest, keys: Some(keys) }
+  }
+
+  pub fn names(&self) -> Vec<&VariableExpr> {
+    self.targets.iter().chain(self.rest.iter()).collect()
+  }
+}
+
+// `[a, b] = value;`
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct DestructureAssignExpr {
+  pub pattern: DestructurePattern,
+  pub value: Box<Expr>,
+}
+
+impl DestructureAssignExpr {
+  pub fn new(pattern: DestructurePattern, value: Box<Expr>) -> Self {
+    Self { pattern, value }
+  }
+}
+
+// "a ${b} c": the string segments and embedded expressions, in order
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct InterpolationExpr {
+  pub start: Token,
+  pub parts: Vec<Expr>,
+}
+
+impl InterpolationExpr {
+  pub fn new(start: Token, parts: Vec<Expr>) -> Self {
+    Self { start, parts }
+  }
+}
+
+// match (value) { pattern if guard => body, ... }
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct MatchExpr {
+  pub keyword: Token,
+  pub subject: Box<Expr>,
+  pub arms: Vec<MatchArm>,
+}
+
+impl MatchExpr {
+  pub fn new(keyword: Token, subject: Box<Expr>, arms: Vec<MatchArm>) -> Self {
+    Self { keyword, subject, arms }
+  }
+}
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct MatchArm {
+  pub pattern: Pattern,
+  pub guard: Option<Expr>,
+  pub body: Expr,
+}
+
+impl MatchArm {
+  pub fn new(pattern: Pattern, guard: Option<Expr>, body: Expr) -> Self {
+    Self { pattern, guard, body }
+  }
+}
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub enum Pattern {
+  // `_`, which matches anything without binding it
+  Wildcard,
+  // A number, string, boolean or nil, compared with ==
+  Literal(LiteralExpr),
+  // A name, which matches anything and binds it for the guard and body
+  Binding(VariableExpr),
+  // `[first, 0, ...rest]`
+  List(ListPattern),
+  // `Point { x, y: 0 }`, matching instances of the class or a subclass
+  Class(ClassPattern),
+  // `{name, "age": 30, ...rest}`, matching maps that have every key
+  Map(MapPattern),
+}
+
+impl Pattern {
+  // Every name the pattern binds, in source order
+  pub fn bindings(&self) -> Vec<&VariableExpr> {
+    match self {
+      Pattern::Wildcard | Pattern::Literal(_) => Vec::new(),
+      Pattern::Binding(variable) => vec![variable],
+      Pattern::List(list) => list.elements.iter().flat_map(|p| p.bindings()).chain(list.rest.iter()).collect(),
+      Pattern::Class(class) => class.fields.iter().flat_map(|(_, p)| p.bindings()).collect(),
+      Pattern::Map(map) => map.entries.iter().flat_map(|(_, p)| p.bindings()).chain(map.rest.iter()).collect(),
+    }
+  }
+
+  // The class names referenced by class patterns, which are looked up in the
+  // scope surrounding the match
+  pub fn classes(&self) -> Vec<&VariableExpr> {
+    match self {
+      Pattern::Wildcard | Pattern::Literal(_) | Pattern::Binding(_) => Vec::new(),
+      Pattern::List(list) => list.elements.iter().flat_map(|p| p.classes()).collect(),
+      Pattern::Class(class) => std::iter::once(&class.class).chain(class.fields.iter().flat_map(|(_, p)| p.classes())).collect(),
+      Pattern::Map(map) => map.entries.iter().flat_map(|(_, p)| p.classes()).collect(),
+    }
+  }
+}
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct ListPattern {
+  pub bracket: Token,
+  pub elements: Vec<Pattern>,
+  pub rest: Option<VariableExpr>,
+}
+
+impl ListPattern {
+  pub fn new(bracket: Token, elements: Vec<Pattern>, rest: Option<VariableExpr>) -> Self {
+    Self { bracket, elements, rest }
+  }
+}
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct ClassPattern {
+  pub class: VariableExpr,
+  pub fields: Vec<(Token, Pattern)>,
+}
+
+impl ClassPattern {
+  pub fn new(class: VariableExpr, fields: Vec<(Token, Pattern)>) -> Self {
+    Self { class, fields }
+  }
+}
+
+// The keys are literals; a name in the source is a string key
+#[derive(Clone, Debug, Hash, PartialEq, Eq)]
+pub struct MapPattern {
+  pub brace: Token,
+  pub entries: Vec<(LiteralExpr, Pattern)>,
+  pub rest: Option<VariableExpr>,
+}
+
+impl MapPattern {
+  pub fn new(brace: Token, entries: Vec<(LiteralExpr, Pattern)>, rest: Option<VariableExpr>) -> Self {
+    Self { brace, entries, rest }
+  }
+}
+
 /////////////// Statements ///////////////
 /// 
 pub trait StmtVisitor<R> {
@@ -206,6 +573,8 @@ pub trait StmtVisitor<R> {
   #[allow(non_snake_case)]
   fn visitVarStmt(&mut self, stmt: &VarStmt) -> R;
   #[allow(non_snake_case)]
+  fn visitDestructureStmt(&mut self, stmt: &DestructureStmt) -> R;
+  #[allow(non_snake_case)]
   fn visitReturnStmt(&mut self, stmt: &RetStmt) -> R;
   #[allow(non_snake_case)]
   fn visitFunStmt(&mut self, stmt: &FunStmt) -> R;
@@ -217,6 +586,22 @@ pub trait StmtVisitor<R> {
   fn visitForStmt(&mut self, stmt: &ForStmt) -> R;
   #[allow(non_snake_case)]
   fn visitClassStmt(&mut self, stmt: &ClassStmt) -> R;
+  #[allow(non_snake_case)]
+  fn visitTraitStmt(&mut self, stmt: &TraitStmt) -> R;
+  #[allow(non_snake_case)]
+  fn visitYieldStmt(&mut self, stmt: &YieldStmt) -> R;
+  #[allow(non_snake_case)]
+  fn visitForInStmt(&mut self, stmt: &ForInStmt) -> R;
+  #[allow(non_snake_case)]
+  fn visitDoWhileStmt(&mut self, stmt: &WhileStmt) -> R;
+  #[allow(non_snake_case)]
+  fn visitBreakStmt(&mut self, stmt: &BreakStmt) -> R;
+  #[allow(non_snake_case)]
+  fn visitTryStmt(&mut self, stmt: &TryStmt) -> R;
+  #[allow(non_snake_case)]
+  fn visitThrowStmt(&mut self, stmt: &ThrowStmt) -> R;
+  #[allow(non_snake_case)]
+  fn visitUsingStmt(&mut self, stmt: &UsingStmt) -> R;
 }
 
 #[derive(Clone, Debug)]
@@ -226,11 +611,65 @@ pub enum Stmt {
   Print(PrintStmt),
   Return(RetStmt),
   Var(VarStmt),
+  Destructure(DestructureStmt),
   Fun(FunStmt),
   If(IfStmt),
   While(WhileStmt),
   For(ForStmt),
   Class(ClassStmt),
+  Trait(TraitStmt),
+  Yield(YieldStmt),
+  ForIn(ForInStmt),
+  // `do body while (condition);` runs the body before the first check
+  DoWhile(WhileStmt),
+  Break(BreakStmt),
+  Try(TryStmt),
+  Throw(ThrowStmt),
+  Using(UsingStmt),
+}
+
+impl Stmt {
+  // Whether running this statement can reach a yield of the function it is
+  // in; nested functions and classes have their own bodies
+  pub fn contains_yield(&self) -> bool {
+    match self {
+      Stmt::Yield(_) => true,
+      Stmt::Block(block) => block.statements.iter().any(|s| s.contains_yield()),
+      Stmt::If(stmt) => stmt.then_branch.contains_yield() || stmt.else_branch.as_ref().is_some_and(|s| s.contains_yield()),
+      Stmt::While(stmt) | Stmt::DoWhile(stmt) => stmt.body.contains_yield() || stmt.else_branch.as_ref().is_some_and(|s| s.contains_yield()),
+      Stmt::For(stmt) => stmt.body.contains_yield(),
+      Stmt::ForIn(stmt) => stmt.body.contains_yield() || stmt.else_branch.as_ref().is_some_and(|s| s.contains_yield()),
+      _ => false,
+    }
+  }
+
+  // The first token of the statement that has one, for mapping generated code
+  // back to the source
+  pub fn first_token(&self) -> Option<&Token> {
+    match self {
+      Stmt::Block(block) => block.statements.iter().find_map(|s| s.first_token()),
+      Stmt::Expression(stmt) => stmt.expression.first_token(),
+      Stmt::Print(stmt) => stmt.expressions[0].first_token(),
+      Stmt::Return(stmt) => Some(&stmt.keyword),
+      Stmt::Var(stmt) => Some(&stmt.name),
+      Stmt::Destructure(stmt) => Some(&stmt.pattern.bracket),
+      Stmt::Fun(stmt) => Some(&stmt.name),
+      Stmt::If(stmt) => stmt.condition.first_token(),
+      Stmt::While(stmt) => stmt.condition.first_token(),
+      Stmt::DoWhile(stmt) => stmt.body.first_token().or(stmt.condition.first_token()),
+      Stmt::For(stmt) => stmt.initializer.as_ref().and_then(|s| s.first_token())
+        .or(stmt.condition.as_ref().and_then(|c| c.first_token()))
+        .or(stmt.body.first_token()),
+      Stmt::Class(stmt) => Some(&stmt.name),
+      Stmt::Trait(stmt) => Some(&stmt.name),
+      Stmt::Yield(stmt) => Some(&stmt.keyword),
+      Stmt::ForIn(stmt) => Some(&stmt.name),
+      Stmt::Break(stmt) => Some(&stmt.keyword),
+      Stmt::Try(stmt) => Some(&stmt.keyword),
+      Stmt::Throw(stmt) => Some(&stmt.keyword),
+      Stmt::Using(stmt) => Some(&stmt.keyword),
+    }
+  }
 }
 
 #[derive(Clone, Debug)]
@@ -238,20 +677,37 @@ pub struct ExprStmt {
   pub expression: Box<Expr>,
 }
 
+// `print a, b;` prints its values on one line, separated by spaces
 #[derive(Clone, Debug)]
 pub struct PrintStmt {
-  pub expression: Box<Expr>,
+  pub expressions: Vec<Expr>,
 }
 
 #[derive(Clone, Debug)]
 pub struct VarStmt {
   pub name: Token,
+  pub type_annotation: Option<Token>,
   pub initializer: Option<Expr>,
+  pub constant: bool,
 }
 
 impl VarStmt {
-  pub fn new(name: Token, initializer: Option<Expr>) -> Self {
-    Self { name, initializer }
+  pub fn new(name: Token, type_annotation: Option<Token>, initializer: Option<Expr>, constant: bool) -> Self {
+    Self { name, type_annotation, initializer, constant }
+  }
+}
+
+// `var [a, b] = value;`, `var (a, b) = value;` or `var {a, b} = value;`
+#[derive(Clone, Debug)]
+pub struct DestructureStmt {
+  pub pattern: DestructurePattern,
+  pub initializer: Expr,
+  pub constant: bool,
+}
+
+impl DestructureStmt {
+  pub fn new(pattern: DestructurePattern, initializer: Expr, constant: bool) -> Self {
+    Self { pattern, initializer, constant }
   }
 }
 
@@ -271,13 +727,37 @@ impl RetStmt {
 pub struct FunStmt {
   pub name: Token,
   pub params: Vec<Token>,
+  // Optional annotations, only read by the type checker
+  pub param_types: Vec<Option<Token>>,
+  pub return_type: Option<Token>,
+  // Default value expressions; only trailing parameters may have one
+  pub defaults: Vec<Option<Expr>>,
+  // `...name` collects any extra arguments into a list
+  pub rest: Option<Token>,
   pub body: Rc<BlockStmt>,
+  // Calling a function that yields returns a generator instead of running it
+  pub is_generator: bool,
+  // The `///` or `/** */` comment right before the declaration
+  pub doc: Option<String>,
 }
 
 impl FunStmt {
-  pub fn new(name: Token, params: Vec<Token>, body: Rc<BlockStmt>) -> Self {
-    Self { name, params, body }
+  pub fn new(name: Token, params: ParameterList, return_type: Option<Token>, body: Rc<BlockStmt>) -> Self {
+    let is_generator = body.statements.iter().any(|s| s.contains_yield());
+    Self { name, params: params.names, param_types: params.types, return_type, defaults: params.defaults, rest: params.rest, body, is_generator, doc: None }
   }
+
+  pub fn required_params(&self) -> usize {
+    self.defaults.iter().take_while(|d| d.is_none()).count()
+  }
+}
+
+#[derive(Clone, Debug, Default)]
+pub struct ParameterList {
+  pub names: Vec<Token>,
+  pub types: Vec<Option<Token>>,
+  pub defaults: Vec<Option<Expr>>,
+  pub rest: Option<Token>,
 }
 
 #[derive(Clone, Debug)]
@@ -308,11 +788,13 @@ impl IfStmt{
 pub struct WhileStmt {
   pub condition: Box<Expr>,
   pub body: Box<Stmt>,
+  // Runs when the loop ends without a `break`
+  pub else_branch: Option<Box<Stmt>>,
 }
 
 impl WhileStmt {
-  pub fn new(condition: Box<Expr>, body: Box<Stmt>) -> Self {
-    Self { condition, body }
+  pub fn new(condition: Box<Expr>, body: Box<Stmt>, else_branch: Option<Box<Stmt>>) -> Self {
+    Self { condition, body, else_branch }
   }
 }
 
@@ -334,11 +816,138 @@ impl ForStmt {
 pub struct ClassStmt {
   pub name: Token,
   pub superclass: Option<Box<Expr>>,
+  pub traits: Vec<Token>,
   pub methods: Vec<FunStmt>,
+  pub doc: Option<String>,
 }
 
 impl ClassStmt {
-  pub fn new(name: Token, superclass: Option<Box<Expr>>,  methods: Vec<FunStmt>) -> Self {
-    Self { name, superclass, methods }
+  pub fn new(name: Token, superclass: Option<Box<Expr>>, traits: Vec<Token>, methods: Vec<FunStmt>) -> Self {
+    Self { name, superclass, traits, methods, doc: None }
+  }
+}
+
+// A method a trait requires, without a body
+#[derive(Clone, Debug)]
+pub struct MethodSignature {
+  pub name: Token,
+  pub params: Vec<Token>,
+  pub doc: Option<String>,
+}
+
+impl MethodSignature {
+  pub fn new(name: Token, params: Vec<Token>) -> Self {
+    Self { name, params, doc: None }
+  }
+}
+
+#[derive(Clone, Debug)]
+pub struct TraitStmt {
+  pub name: Token,
+  pub methods: Vec<MethodSignature>,
+  pub doc: Option<String>,
+}
+
+impl TraitStmt {
+  pub fn new(name: Token, methods: Vec<MethodSignature>) -> Self {
+    Self { name, methods, doc: None }
+  }
+}
+
+#[derive(Clone, Debug)]
+pub struct YieldStmt {
+  pub keyword: Token,
+  pub value: Option<Expr>,
+}
+
+impl YieldStmt {
+  pub fn new(keyword: Token, value: Option<Expr>) -> Self {
+    Self { keyword, value }
+  }
+}
+
+// `for (name in iterable) body`, over lists, strings and generators
+#[derive(Clone, Debug)]
+pub struct ForInStmt {
+  pub name: Token,
+  pub iterable: Expr,
+  pub body: Box<Stmt>,
+  pub else_branch: Option<Box<Stmt>>,
+}
+
+impl ForInStmt {
+  pub fn new(name: Token, iterable: Expr, body: Box<Stmt>, else_branch: Option<Box<Stmt>>) -> Self {
+    Self { name, iterable, body, else_branch }
+  }
+}
+
+#[derive(Clone, Debug)]
+pub struct BreakStmt {
+  pub keyword: Token,
+}
+
+impl BreakStmt {
+  pub fn new(keyword: Token) -> Self {
+    Self { keyword }
+  }
+}
+
+// `try { ... } catch (e) { ... } finally { ... }`. The catch clauses are
+// tried in order and the first that matches the error runs; the finally block
+// runs last however the rest ended.
+#[derive(Clone, Debug)]
+pub struct TryStmt {
+  pub keyword: Token,
+  pub body: BlockStmt,
+  pub catches: Vec<CatchClause>,
+  pub finally: Option<BlockStmt>,
+}
+
+impl TryStmt {
+  pub fn new(keyword: Token, body: BlockStmt, catches: Vec<CatchClause>, finally: Option<BlockStmt>) -> Self {
+    Self { keyword, body, catches, finally }
+  }
+}
+
+// `catch (name: Class) { ... }`, which only catches instances of the class.
+// Without one it catches everything.
+#[derive(Clone, Debug)]
+pub struct CatchClause {
+  pub name: Token,
+  pub class: Option<Expr>,
+  pub body: BlockStmt,
+}
+
+impl CatchClause {
+  pub fn new(name: Token, class: Option<Expr>, body: BlockStmt) -> Self {
+    Self { name, class, body }
+  }
+}
+
+#[derive(Clone, Debug)]
+pub struct ThrowStmt {
+  pub keyword: Token,
+  pub value: Expr,
+}
+
+impl ThrowStmt {
+  pub fn new(keyword: Token, value: Expr) -> Self {
+    Self { keyword, value }
+  }
+}
+
+// `using (var name = initializer) { ... }` calls the value's close() method
+// once the body is done, however it ends.
+#[derive(Clone, Debug)]
+pub struct UsingStmt {
+  pub keyword: Token,
+  pub name: Token,
+  pub initializer: Expr,
+  pub body: BlockStmt,
+}
+
+impl UsingStmt {
+  pub fn new(keyword: Token, name: Token, initializer: Expr, body: BlockStmt) -> Self {
+    Self { keyword, name, initializer, body }
   }
 }
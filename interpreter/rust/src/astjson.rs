@@ -0,0 +1,1065 @@
+/*
+`lox ast`: the syntax tree as JSON, and back.
+
+The document is `{"version": 1, "dialect": "...", "statements": [...]}`,
+where the dialect is a spec as --dialect takes it. Every node is an
+object whose "type" names the AST node (Binary, Var, ListPattern, ...) and
+whose other fields are its children: nodes, arrays of nodes, or null when an
+optional child is missing. Names, operators and annotations are plain
+strings. Nodes that come from a token also have a "span" giving the token's
+line and byte offset in the source; a hand-written tree can leave spans out.
+
+Literals carry a "kind" of number, integer, bigint, string, boolean or nil
+and a "value". Integers and floats are JSON numbers, and bigints are strings
+of decimal digits so they keep their precision.
+
+Loading a tree gives back the statements the parser would have produced, so
+it can be resolved and run like any other script, and switches to the
+dialect it was parsed in when the document says. The resolver tells two
+uses of a name apart by where they are, so names without a span get an
+offset past the end of any real source.
+*/
+
+use crate::ast::*;
+use crate::bignum::BigInt;
+use crate::dialect::{self, Dialect};
+use crate::lexer::*;
+use std::rc::Rc;
+
+const VERSION: i64 = 1;
+
+// Operators by their source text, for rebuilding operator tokens
+const OPERATORS: &[(&str, TokenType)] = &[
+  ("+", TokenType::Plus),
+  ("-", TokenType::Minus),
+  ("*", TokenType::Star),
+  ("/", TokenType::Slash),
+  ("!", TokenType::Bang),
+  ("!=", TokenType::BangEqual),
+  ("==", TokenType::EqualEqual),
+  (">", TokenType::Greater),
+  (">=", TokenType::GreaterEqual),
+  ("<", TokenType::Less),
+  ("<=", TokenType::LessEqual),
+  ("is", TokenType::Is),
+  ("and", TokenType::And),
+  ("or", TokenType::Or),
+  ("??", TokenType::QuestionQuestion),
+];
+
+// Shared with snapshot.rs, which embeds the tree in its own document
+#[derive(Clone, Debug, PartialEq)]
+pub(crate) enum Json {
+  Null,
+  Bool(bool),
+  // Kept as written so integers don't pass through a float
+  Number(String),
+  String(String),
+  Array(Vec<Json>),
+  Object(Vec<(String, Json)>),
+}
+
+///////////// Export ///////////////
+
+pub fn to_json(statements: &[Stmt]) -> String {
+  write_document(&Json::Object(vec![
+    ("version".to_string(), Json::Number(VERSION.to_string())),
+    ("dialect".to_string(), Json::String(dialect::current().spec())),
+    ("statements".to_string(), statements_json(statements)),
+  ]))
+}
+
+pub(crate) fn statements_json(statements: &[Stmt]) -> Json {
+  Json::Array(statements.iter().map(stmt_json).collect())
+}
+
+pub(crate) fn write_document(document: &Json) -> String {
+  let mut out = String::new();
+  write_json(document, 0, &mut out);
+  out.push('\n');
+  out
+}
+
+fn node(kind: &str, span: Option<&Token>, fields: Vec<(&str, Json)>) -> Json {
+  let mut entries = vec![("type".to_string(), Json::String(kind.to_string()))];
+  if let Some(token) = span {
+    entries.push(("span".to_string(), Json::Object(vec![
+      ("line".to_string(), Json::Number(token.line.to_string())),
+      ("offset".to_string(), Json::Number(token.offset.to_string())),
+    ])));
+  }
+  entries.extend(fields.into_iter().map(|(key, value)| (key.to_string(), value)));
+  Json::Object(entries)
+}
+
+fn text(value: &str) -> Json {
+  Json::String(value.to_string())
+}
+
+fn optional<T>(value: Option<T>, to_json: impl Fn(T) -> Json) -> Json {
+  value.map(to_json).unwrap_or(Json::Null)
+}
+
+fn exprs_json(exprs: &[Expr]) -> Json {
+  Json::Array(exprs.iter().map(expr_json).collect())
+}
+
+fn variable_json(variable: &VariableExpr) -> Json {
+  node("Variable", Some(&variable.name), vec![("name", text(&variable.name.token))])
+}
+
+fn destructure_json(pattern: &DestructurePattern) -> Json {
+  node("DestructurePattern", Some(&pattern.bracket), vec![
+    ("targets", Json::Array(pattern.targets.iter().map(variable_json).collect())),
+    ("rest", optional(pattern.rest.as_ref(), variable_json)),
+    ("keys", optional(pattern.keys.as_ref(), |keys| Json::Array(keys.iter().map(|key| text(&key.token)).collect()))),
+  ])
+}
+
+fn literal_fields(value: &LoxValue) -> Vec<(&'static str, Json)> {
+  match value {
+    LoxValue::Number(n) if n.is_infinite() => vec![("kind", text("number")), ("value", Json::Number("1e999".to_string()))],
+    LoxValue::Number(n) => vec![("kind", text("number")), ("value", Json::Number(format!("{:?}", n)))],
+    LoxValue::Integer(n) => vec![("kind", text("integer")), ("value", Json::Number(n.to_string()))],
+    LoxValue::BigInt(n) => vec![("kind", text("bigint")), ("value", Json::String(n.to_string()))],
+    LoxValue::String(s) => vec![("kind", text("string")), ("value", text(s))],
+    LoxValue::Boolean(b) => vec![("kind", text("boolean")), ("value", Json::Bool(*b))],
+    _ => vec![("kind", text("nil")), ("value", Json::Null)],
+  }
+}
+
+fn expr_json(expr: &Expr) -> Json {
+  match expr {
+    Expr::Assign(e) => node("Assign", Some(&e.name), vec![("name", text(&e.name.token)), ("value", expr_json(&e.value))]),
+    Expr::Binary(e) => node("Binary", Some(&e.operator), vec![
+      ("operator", text(&e.operator.token)),
+      ("left", expr_json(&e.left)),
+      ("right", expr_json(&e.right)),
+    ]),
+    Expr::Comparison(e) => node("Comparison", Some(&e.comparisons[0].0), vec![
+      ("left", expr_json(&e.left)),
+      ("comparisons", Json::Array(e.comparisons.iter().map(|(operator, right)| {
+        node("Compare", Some(operator), vec![("operator", text(&operator.token)), ("right", expr_json(right))])
+      }).collect())),
+    ]),
+    Expr::Logical(e) => node("Logical", Some(&e.operator), vec![
+      ("operator", text(&e.operator.token)),
+      ("left", expr_json(&e.left)),
+      ("right", expr_json(&e.right)),
+    ]),
+    Expr::Unary(e) => node("Unary", Some(&e.operator), vec![("operator", text(&e.operator.token)), ("right", expr_json(&e.right))]),
+    Expr::Call(e) => node("Call", Some(&e.paren), vec![
+      ("callee", expr_json(&e.callee)),
+      ("arguments", exprs_json(&e.arguments)),
+      ("named_arguments", Json::Array(e.named_arguments.iter().map(|(name, value)| {
+        node("NamedArgument", Some(name), vec![("name", text(&name.token)), ("value", expr_json(value))])
+      }).collect())),
+    ]),
+    Expr::Get(e) => node("Get", Some(&e.name), vec![("object", expr_json(&e.object)), ("name", text(&e.name.token))]),
+    Expr::OptionalGet(e) => node("OptionalGet", Some(&e.name), vec![("object", expr_json(&e.object)), ("name", text(&e.name.token))]),
+    Expr::OptionalIndex(e) => node("OptionalIndex", Some(&e.bracket), vec![("object", expr_json(&e.object)), ("index", expr_json(&e.index))]),
+    Expr::OptionalChain(e) => node("OptionalChain", None, vec![("expression", expr_json(&e.expression))]),
+    Expr::Set(e) => node("Set", Some(&e.name), vec![
+      ("object", expr_json(&e.object)),
+      ("name", text(&e.name.token)),
+      ("value", expr_json(&e.value)),
+    ]),
+    Expr::Grouping(e) => node("Grouping", None, vec![("expression", expr_json(&e.expression))]),
+    Expr::Literal(e) => node("Literal", None, literal_fields(&e.literal)),
+    Expr::Variable(e) => variable_json(e),
+    Expr::Super(e) => node("Super", Some(&e.keyword), vec![("method", text(&e.method.token))]),
+    Expr::This(e) => node("This", Some(&e.keyword), vec![]),
+    Expr::List(e) => node("List", Some(&e.bracket), vec![("elements", exprs_json(&e.elements))]),
+    Expr::SetLiteral(e) => node("SetLiteral", Some(&e.brace), vec![("elements", exprs_json(&e.elements))]),
+    Expr::MapLiteral(e) => node("MapLiteral", Some(&e.brace), vec![("entries", Json::Array(e.entries.iter().map(|(key, value)| {
+      node("Entry", None, vec![("key", expr_json(key)), ("value", expr_json(value))])
+    }).collect()))]),
+    Expr::Index(e) => node("Index", Some(&e.bracket), vec![("object", expr_json(&e.object)), ("index", expr_json(&e.index))]),
+    Expr::IndexSet(e) => node("IndexSet", Some(&e.bracket), vec![
+      ("object", expr_json(&e.object)),
+      ("index", expr_json(&e.index)),
+      ("value", expr_json(&e.value)),
+    ]),
+    Expr::Spread(e) => node("Spread", Some(&e.ellipsis), vec![("expression", expr_json(&e.expression))]),
+    Expr::DestructureAssign(e) => node("DestructureAssign", None, vec![
+      ("pattern", destructure_json(&e.pattern)),
+      ("value", expr_json(&e.value)),
+    ]),
+    Expr::Interpolation(e) => node("Interpolation", Some(&e.start), vec![("parts", exprs_json(&e.parts))]),
+    Expr::Match(e) => node("Match", Some(&e.keyword), vec![
+      ("subject", expr_json(&e.subject)),
+      ("arms", Json::Array(e.arms.iter().map(|arm| node("MatchArm", None, vec![
+        ("pattern", pattern_json(&arm.pattern)),
+        ("guard", optional(arm.guard.as_ref(), expr_json)),
+        ("body", expr_json(&arm.body)),
+      ])).collect())),
+    ]),
+  }
+}
+
+fn pattern_json(pattern: &Pattern) -> Json {
+  match pattern {
+    Pattern::Wildcard => node("WildcardPattern", None, vec![]),
+    Pattern::Literal(literal) => node("LiteralPattern", None, literal_fields(&literal.literal)),
+    Pattern::Binding(variable) => node("BindingPattern", Some(&variable.name), vec![("name", text(&variable.name.token))]),
+    Pattern::List(list) => node("ListPattern", Some(&list.bracket), vec![
+      ("elements", Json::Array(list.elements.iter().map(pattern_json).collect())),
+      ("rest", optional(list.rest.as_ref(), variable_json)),
+    ]),
+    Pattern::Class(class) => node("ClassPattern", None, vec![
+      ("class", variable_json(&class.class)),
+      ("fields", Json::Array(class.fields.iter().map(|(name, pattern)| {
+        node("FieldPattern", Some(name), vec![("name", text(&name.token)), ("pattern", pattern_json(pattern))])
+      }).collect())),
+    ]),
+    Pattern::Map(map) => node("MapPattern", Some(&map.brace), vec![
+      ("entries", Json::Array(map.entries.iter().map(|(key, pattern)| {
+        node("EntryPattern", None, vec![("key", node("Literal", None, literal_fields(&key.literal))), ("pattern", pattern_json(pattern))])
+      }).collect())),
+      ("rest", optional(map.rest.as_ref(), variable_json)),
+    ]),
+  }
+}
+
+fn stmts_json(statements: &[Stmt]) -> Json {
+  Json::Array(statements.iter().map(stmt_json).collect())
+}
+
+fn type_json(annotation: &Option<Token>) -> Json {
+  optional(annotation.as_ref(), |token| text(&token.token))
+}
+
+fn function_json(stmt: &FunStmt) -> Json {
+  let params = stmt.params.iter().zip(&stmt.param_types).zip(&stmt.defaults).map(|((name, annotation), default)| {
+    node("Parameter", Some(name), vec![
+      ("name", text(&name.token)),
+      ("annotation", type_json(annotation)),
+      ("default", optional(default.as_ref(), expr_json)),
+    ])
+  });
+  node("Fun", Some(&stmt.name), vec![
+    ("name", text(&stmt.name.token)),
+    ("params", Json::Array(params.collect())),
+    ("rest", optional(stmt.rest.as_ref(), |rest| node("Parameter", Some(rest), vec![("name", text(&rest.token))]))),
+    ("return_annotation", type_json(&stmt.return_type)),
+    ("body", stmts_json(&stmt.body.statements)),
+    ("doc", optional(stmt.doc.as_ref(), |doc| text(doc))),
+  ])
+}
+
+fn stmt_json(stmt: &Stmt) -> Json {
+  match stmt {
+    Stmt::Block(s) => node("Block", None, vec![("statements", stmts_json(&s.statements))]),
+    Stmt::Expression(s) => node("Expression", None, vec![("expression", expr_json(&s.expression))]),
+    Stmt::Print(s) => node("Print", None, vec![("expressions", exprs_json(&s.expressions))]),
+    Stmt::Return(s) => node("Return", Some(&s.keyword), vec![("value", optional(s.value.as_deref(), expr_json))]),
+    Stmt::Var(s) => node("Var", Some(&s.name), vec![
+      ("name", text(&s.name.token)),
+      ("constant", Json::Bool(s.constant)),
+      ("annotation", type_json(&s.type_annotation)),
+      ("initializer", optional(s.initializer.as_ref(), expr_json)),
+    ]),
+    Stmt::Destructure(s) => node("Destructure", None, vec![
+      ("pattern", destructure_json(&s.pattern)),
+      ("constant", Json::Bool(s.constant)),
+      ("initializer", expr_json(&s.initializer)),
+    ]),
+    Stmt::Fun(s) => function_json(s),
+    Stmt::If(s) => node("If", None, vec![
+      ("condition", expr_json(&s.condition)),
+      ("then", stmt_json(&s.then_branch)),
+      ("else", optional(s.else_branch.as_deref(), stmt_json)),
+    ]),
+    Stmt::While(s) => node("While", None, vec![
+      ("condition", expr_json(&s.condition)),
+      ("body", stmt_json(&s.body)),
+      ("else", optional(s.else_branch.as_deref(), stmt_json)),
+    ]),
+    Stmt::DoWhile(s) => node("DoWhile", None, vec![("body", stmt_json(&s.body)), ("condition", expr_json(&s.condition))]),
+    Stmt::For(s) => node("For", None, vec![
+      ("initializer", optional(s.initializer.as_deref(), stmt_json)),
+      ("condition", optional(s.condition.as_deref(), expr_json)),
+      ("increment", optional(s.increment.as_deref(), expr_json)),
+      ("body", stmt_json(&s.body)),
+    ]),
+    Stmt::ForIn(s) => node("ForIn", Some(&s.name), vec![
+      ("name", text(&s.name.token)),
+      ("iterable", expr_json(&s.iterable)),
+      ("body", stmt_json(&s.body)),
+      ("else", optional(s.else_branch.as_deref(), stmt_json)),
+    ]),
+    Stmt::Class(s) => node("Class", Some(&s.name), vec![
+      ("name", text(&s.name.token)),
+      ("superclass", optional(s.superclass.as_deref(), expr_json)),
+      ("traits", Json::Array(s.traits.iter().map(|t| text(&t.token)).collect())),
+      ("methods", Json::Array(s.methods.iter().map(function_json).collect())),
+      ("doc", optional(s.doc.as_ref(), |doc| text(doc))),
+    ]),
+    Stmt::Trait(s) => node("Trait", Some(&s.name), vec![
+      ("name", text(&s.name.token)),
+      ("methods", Json::Array(s.methods.iter().map(|m| node("MethodSignature", Some(&m.name), vec![
+        ("name", text(&m.name.token)),
+        ("params", Json::Array(m.params.iter().map(|p| text(&p.token)).collect())),
+        ("doc", optional(m.doc.as_ref(), |doc| text(doc))),
+      ])).collect())),
+      ("doc", optional(s.doc.as_ref(), |doc| text(doc))),
+    ]),
+    Stmt::Yield(s) => node("Yield", Some(&s.keyword), vec![("value", optional(s.value.as_ref(), expr_json))]),
+    Stmt::Break(s) => node("Break", Some(&s.keyword), vec![]),
+    Stmt::Try(s) => node("Try", Some(&s.keyword), vec![
+      ("body", stmts_json(&s.body.statements)),
+      ("catches", Json::Array(s.catches.iter().map(|clause| {
+        node("Catch", Some(&clause.name), vec![
+          ("name", text(&clause.name.token)),
+          ("class", optional(clause.class.as_ref(), expr_json)),
+          ("body", stmts_json(&clause.body.statements)),
+        ])
+      }).collect())),
+      ("finally", optional(s.finally.as_ref(), |finally| stmts_json(&finally.statements))),
+    ]),
+    Stmt::Throw(s) => node("Throw", Some(&s.keyword), vec![("value", expr_json(&s.value))]),
+    Stmt::Using(s) => node("Using", Some(&s.keyword), vec![
+      ("name", text(&s.name.token)),
+      ("initializer", expr_json(&s.initializer)),
+      ("body", stmts_json(&s.body.statements)),
+    ]),
+  }
+}
+
+// Objects and non-empty arrays get one entry per line
+fn write_json(value: &Json, depth: usize, out: &mut String) {
+  let indent = "  ".repeat(depth + 1);
+  match value {
+    Json::Null => out.push_str("null"),
+    Json::Bool(b) => out.push_str(&b.to_string()),
+    Json::Number(n) => out.push_str(n),
+    Json::String(s) => out.push_str(&json_string(s)),
+    Json::Array(items) if items.is_empty() => out.push_str("[]"),
+    Json::Array(items) => {
+      out.push_str("[\n");
+      for (i, item) in items.iter().enumerate() {
+        out.push_str(&indent);
+        write_json(item, depth + 1, out);
+        out.push_str(if i + 1 < items.len() { ",\n" } else { "\n" });
+      }
+      out.push_str(&"  ".repeat(depth));
+      out.push(']');
+    }
+    Json::Object(entries) => {
+      out.push_str("{\n");
+      for (i, (key, item)) in entries.iter().enumerate() {
+        out.push_str(&format!("{}{}: ", indent, json_string(key)));
+        write_json(item, depth + 1, out);
+        out.push_str(if i + 1 < entries.len() { ",\n" } else { "\n" });
+      }
+      out.push_str(&"  ".repeat(depth));
+      out.push('}');
+    }
+  }
+}
+
+fn json_string(text: &str) -> String {
+  let mut out = String::from("\"");
+  for c in text.chars() {
+    match c {
+      '"' => out.push_str("\\\""),
+      '\\' => out.push_str("\\\\"),
+      '\n' => out.push_str("\\n"),
+      '\r' => out.push_str("\\r"),
+      '\t' => out.push_str("\\t"),
+      c if (c as u32) < 0x20 => out.push_str(&format!("\\u{:04x}", c as u32)),
+      c => out.push(c),
+    }
+  }
+  out.push('"');
+  out
+}
+
+///////////// Import ///////////////
+
+pub fn from_json(source: &str) -> Result<Vec<Stmt>, String> {
+  let document = parse_json(source)?;
+  match document.get("version") {
+    Some(Json::Number(n)) if n == &VERSION.to_string() => (),
+    Some(Json::Number(n)) => return Err(format!("Unsupported AST version {}.", n)),
+    _ => return Err("Expected a 'version' field.".to_string()),
+  }
+  match document.get("dialect") {
+    Some(Json::String(spec)) => dialect::switch(Dialect::parse(spec)?),
+    Some(_) => return Err("Expected 'dialect' to be a string.".to_string()),
+    None => (),
+  }
+  load_statements(document.array("statements")?)
+}
+
+pub(crate) fn parse_json(source: &str) -> Result<Json, String> {
+  JsonParser { chars: source.chars().collect(), current: 0 }.parse()
+}
+
+pub(crate) fn load_statements(nodes: &[Json]) -> Result<Vec<Stmt>, String> {
+  Loader { next_offset: usize::MAX / 2 }.stmts(nodes)
+}
+
+impl Json {
+  pub(crate) fn get(&self, key: &str) -> Option<&Json> {
+    match self {
+      Json::Object(entries) => entries.iter().find(|(k, _)| k == key).map(|(_, v)| v),
+      _ => None,
+    }
+  }
+
+  fn kind(&self) -> &str {
+    match self.get("type") {
+      Some(Json::String(kind)) => kind,
+      _ => "",
+    }
+  }
+
+  fn field(&self, key: &str) -> Result<&Json, String> {
+    match self.get(key) {
+      Some(value) => Ok(value),
+      None => Err(format!("Expected a '{}' field in {} node.", key, self.describe())),
+    }
+  }
+
+  // A missing field reads the same as null
+  fn optional(&self, key: &str) -> Option<&Json> {
+    match self.get(key) {
+      None | Some(Json::Null) => None,
+      Some(value) => Some(value),
+    }
+  }
+
+  pub(crate) fn string(&self, key: &str) -> Result<&str, String> {
+    match self.field(key)? {
+      Json::String(s) => Ok(s),
+      _ => Err(format!("Expected '{}' to be a string in {} node.", key, self.describe())),
+    }
+  }
+
+  pub(crate) fn array(&self, key: &str) -> Result<&[Json], String> {
+    match self.field(key)? {
+      Json::Array(items) => Ok(items),
+      _ => Err(format!("Expected '{}' to be an array in {} node.", key, self.describe())),
+    }
+  }
+
+  fn describe(&self) -> String {
+    match self.kind() {
+      "" => "the".to_string(),
+      kind => format!("a {}", kind),
+    }
+  }
+}
+
+struct Loader {
+  // Offset given to the next token without a span
+  next_offset: usize,
+}
+
+impl Loader {
+  // A token for one of the node's names, placed at the node's span
+  fn token(&mut self, node: &Json, token_type: TokenType, text: &str) -> Token {
+    let position = |key: &str| match node.get("span").and_then(|span| span.get(key)) {
+      Some(Json::Number(n)) => n.parse::<usize>().ok(),
+      _ => None,
+    };
+    let line = position("line").unwrap_or(0);
+    let offset = position("offset").unwrap_or_else(|| {
+      self.next_offset += 1;
+      self.next_offset
+    });
+    Token::new(token_type, text.to_string(), LoxValue::Nil, line, offset)
+  }
+
+  fn name(&mut self, node: &Json) -> Result<Token, String> {
+    let name = node.string("name")?.to_string();
+    Ok(self.token(node, TokenType::Identifier, &name))
+  }
+
+  fn operator(&mut self, node: &Json) -> Result<Token, String> {
+    let text = node.string("operator")?;
+    match OPERATORS.iter().find(|(op, _)| *op == text) {
+      Some((_, token_type)) => Ok(self.token(node, token_type.clone(), text)),
+      None => Err(format!("Unknown operator '{}' in {} node.", text, node.describe())),
+    }
+  }
+
+  fn annotation(&mut self, node: &Json, key: &str) -> Result<Option<Token>, String> {
+    match node.optional(key) {
+      Some(Json::String(name)) => Ok(Some(self.token(node, TokenType::Identifier, name))),
+      Some(_) => Err(format!("Expected '{}' to be a string in {} node.", key, node.describe())),
+      None => Ok(None),
+    }
+  }
+
+  fn doc(&self, node: &Json) -> Result<Option<String>, String> {
+    match node.optional("doc") {
+      Some(Json::String(doc)) => Ok(Some(doc.clone())),
+      Some(_) => Err(format!("Expected 'doc' to be a string in {} node.", node.describe())),
+      None => Ok(None),
+    }
+  }
+
+  fn boxed(&mut self, node: &Json, key: &str) -> Result<Box<Expr>, String> {
+    Ok(Box::new(self.expr(node.field(key)?)?))
+  }
+
+  fn exprs(&mut self, node: &Json, key: &str) -> Result<Vec<Expr>, String> {
+    node.array(key)?.iter().map(|e| self.expr(e)).collect()
+  }
+
+  fn variable(&mut self, node: &Json) -> Result<VariableExpr, String> {
+    Ok(VariableExpr { name: self.name(node)? })
+  }
+
+  fn optional_variable(&mut self, node: &Json, key: &str) -> Result<Option<VariableExpr>, String> {
+    node.optional(key).map(|v| self.variable(v)).transpose()
+  }
+
+  fn destructure(&mut self, node: &Json) -> Result<DestructurePattern, String> {
+    let bracket = self.token(node, TokenType::LeftBracket, "[");
+    let targets = node.array("targets")?.iter().map(|t| self.variable(t)).collect::<Result<_, _>>()?;
+    let rest = self.optional_variable(node, "rest")?;
+    match node.optional("keys") {
+      Some(_) => {
+        let mut keys = Vec::new();
+        for key in node.array("keys")? {
+          match key {
+            Json::String(key) => keys.push(self.token(node, TokenType::Identifier, key)),
+            _ => return Err(format!("Expected 'keys' to hold strings in {} node.", node.describe())),
+          }
+        }
+        Ok(DestructurePattern::keyed(bracket, keys, targets, rest))
+      }
+      None => Ok(DestructurePattern::new(bracket, targets, rest)),
+    }
+  }
+
+  fn literal(&mut self, node: &Json) -> Result<LiteralExpr, String> {
+    let value = node.get("value").unwrap_or(&Json::Null);
+    let bad_value = || format!("Invalid value for a {} literal.", node.string("kind").unwrap_or("?"));
+    let literal = match (node.string("kind")?, value) {
+      ("number", Json::Number(n)) => LiteralExpr::new(TokenType::Number, LoxValue::Number(n.parse().map_err(|_| bad_value())?)),
+      ("integer", Json::Number(n)) => LiteralExpr::new(TokenType::Number, LoxValue::Integer(n.parse().map_err(|_| bad_value())?)),
+      ("bigint", Json::String(digits)) => {
+        let (negative, digits) = match digits.strip_prefix('-') {
+          Some(digits) => (true, digits),
+          None => (false, digits.as_str()),
+        };
+        let mut value = BigInt::parse(digits, 10).filter(|_| !digits.is_empty()).ok_or_else(bad_value)?;
+        if negative {
+          value = value.neg();
+        }
+        LiteralExpr::new(TokenType::Number, LoxValue::BigInt(value))
+      }
+      ("string", Json::String(s)) => LiteralExpr::new(TokenType::String, LoxValue::String(s.clone())),
+      ("boolean", Json::Bool(true)) => LiteralExpr::new(TokenType::True, LoxValue::Boolean(true)),
+      ("boolean", Json::Bool(false)) => LiteralExpr::new(TokenType::False, LoxValue::Boolean(false)),
+      ("nil", Json::Null) => LiteralExpr::new(TokenType::Nil, LoxValue::Nil),
+      (kind @ ("number" | "integer" | "bigint" | "string" | "boolean" | "nil"), _) => {
+        return Err(format!("Invalid value for a {} literal.", kind));
+      }
+      (kind, _) => return Err(format!("Unknown literal kind '{}'.", kind)),
+    };
+    Ok(literal)
+  }
+
+  fn expr(&mut self, node: &Json) -> Result<Expr, String> {
+    let expr = match node.kind() {
+      "Assign" => Expr::Assign(AssignExpr::new(self.name(node)?, self.boxed(node, "value")?)),
+      "Binary" => {
+        let left = self.boxed(node, "left")?;
+        let operator = self.operator(node)?;
+        Expr::Binary(BinaryExpr::new(left, operator, self.boxed(node, "right")?))
+      }
+      "Comparison" => {
+        let left = self.boxed(node, "left")?;
+        let mut comparisons = Vec::new();
+        for comparison in node.array("comparisons")? {
+          let operator = self.operator(comparison)?;
+          comparisons.push((operator, self.expr(comparison.field("right")?)?));
+        }
+        if comparisons.is_empty() {
+          return Err(format!("Expected at least one comparison in {} node.", node.describe()));
+        }
+        Expr::Comparison(ComparisonExpr::new(left, comparisons))
+      }
+      "Logical" => {
+        let left = self.boxed(node, "left")?;
+        let operator = self.operator(node)?;
+        Expr::Logical(LogicalExpr::new(left, operator, self.boxed(node, "right")?))
+      }
+      "Unary" => {
+        let operator = self.operator(node)?;
+        Expr::Unary(UnaryExpr::new(operator, self.boxed(node, "right")?))
+      }
+      "Call" => {
+        let callee = self.boxed(node, "callee")?;
+        let paren = self.token(node, TokenType::RightParen, ")");
+        let arguments = self.exprs(node, "arguments")?;
+        let mut named_arguments = Vec::new();
+        if node.optional("named_arguments").is_some() {
+          for argument in node.array("named_arguments")? {
+            named_arguments.push((self.name(argument)?, self.expr(argument.field("value")?)?));
+          }
+        }
+        Expr::Call(CallExpr::new(callee, paren, arguments, named_arguments))
+      }
+      "Get" => {
+        let object = self.boxed(node, "object")?;
+        Expr::Get(GetExpr::new(object, self.name(node)?))
+      }
+      "OptionalGet" => {
+        let object = self.boxed(node, "object")?;
+        Expr::OptionalGet(OptionalGetExpr::new(object, self.name(node)?))
+      }
+      "OptionalIndex" => {
+        let object = self.boxed(node, "object")?;
+        let bracket = self.token(node, TokenType::RightBracket, "]");
+        Expr::OptionalIndex(OptionalIndexExpr::new(object, bracket, self.boxed(node, "index")?))
+      }
+      "OptionalChain" => Expr::OptionalChain(OptionalChainExpr::new(self.boxed(node, "expression")?)),
+      "Set" => {
+        let object = self.boxed(node, "object")?;
+        let name = self.name(node)?;
+        Expr::Set(SetExpr::new(object, name, self.boxed(node, "value")?))
+      }
+      "Grouping" => Expr::Grouping(GroupingExpr::new(self.boxed(node, "expression")?)),
+      "Literal" => Expr::Literal(self.literal(node)?),
+      "Variable" => Expr::Variable(self.variable(node)?),
+      "Super" => {
+        let keyword = self.token(node, TokenType::Super, "super");
+        let method = node.string("method")?.to_string();
+        let method = self.token(node, TokenType::Identifier, &method);
+        Expr::Super(SuperExpr::new(keyword, method))
+      }
+      "This" => Expr::This(ThisExpr::new(self.token(node, TokenType::This, "this"))),
+      "List" => {
+        let bracket = self.token(node, TokenType::LeftBracket, "[");
+        Expr::List(ListExpr::new(bracket, self.exprs(node, "elements")?))
+      }
+      "SetLiteral" => {
+        let brace = self.token(node, TokenType::HashBrace, "#{");
+        Expr::SetLiteral(SetLiteralExpr::new(brace, self.exprs(node, "elements")?))
+      }
+      "MapLiteral" => {
+        let brace = self.token(node, TokenType::LeftBrace, "{");
+        let mut entries = Vec::new();
+        for entry in node.array("entries")? {
+          entries.push((self.expr(entry.field("key")?)?, self.expr(entry.field("value")?)?));
+        }
+        Expr::MapLiteral(MapLiteralExpr::new(brace, entries))
+      }
+      "Index" => {
+        let object = self.boxed(node, "object")?;
+        let bracket = self.token(node, TokenType::RightBracket, "]");
+        Expr::Index(IndexExpr::new(object, bracket, self.boxed(node, "index")?))
+      }
+      "IndexSet" => {
+        let object = self.boxed(node, "object")?;
+        let bracket = self.token(node, TokenType::RightBracket, "]");
+        let index = self.boxed(node, "index")?;
+        Expr::IndexSet(IndexSetExpr::new(object, bracket, index, self.boxed(node, "value")?))
+      }
+      "Spread" => {
+        let ellipsis = self.token(node, TokenType::Ellipsis, "...");
+        Expr::Spread(SpreadExpr::new(ellipsis, self.boxed(node, "expression")?))
+      }
+      "DestructureAssign" => {
+        let pattern = self.destructure(node.field("pattern")?)?;
+        Expr::DestructureAssign(DestructureAssignExpr::new(pattern, self.boxed(node, "value")?))
+      }
+      "Interpolation" => {
+        let start = self.token(node, TokenType::Interpolation, "\"");
+        Expr::Interpolation(InterpolationExpr::new(start, self.exprs(node, "parts")?))
+      }
+      "Match" => {
+        let keyword = self.token(node, TokenType::Match, "match");
+        let subject = self.boxed(node, "subject")?;
+        let mut arms = Vec::new();
+        for arm in node.array("arms")? {
+          let pattern = self.pattern(arm.field("pattern")?)?;
+          let guard = arm.optional("guard").map(|g| self.expr(g)).transpose()?;
+          arms.push(MatchArm::new(pattern, guard, self.expr(arm.field("body")?)?));
+        }
+        Expr::Match(MatchExpr::new(keyword, subject, arms))
+      }
+      _ => return Err(format!("Unknown expression node {}.", node_name(node))),
+    };
+    Ok(expr)
+  }
+
+  fn pattern(&mut self, node: &Json) -> Result<Pattern, String> {
+    let pattern = match node.kind() {
+      "WildcardPattern" => Pattern::Wildcard,
+      "LiteralPattern" => Pattern::Literal(self.literal(node)?),
+      "BindingPattern" => Pattern::Binding(self.variable(node)?),
+      "ListPattern" => {
+        let bracket = self.token(node, TokenType::LeftBracket, "[");
+        let elements = node.array("elements")?.iter().map(|p| self.pattern(p)).collect::<Result<_, _>>()?;
+        let rest = self.optional_variable(node, "rest")?;
+        Pattern::List(ListPattern::new(bracket, elements, rest))
+      }
+      "ClassPattern" => {
+        let class = self.variable(node.field("class")?)?;
+        let mut fields = Vec::new();
+        for field in node.array("fields")? {
+          fields.push((self.name(field)?, self.pattern(field.field("pattern")?)?));
+        }
+        Pattern::Class(ClassPattern::new(class, fields))
+      }
+      "MapPattern" => {
+        let brace = self.token(node, TokenType::LeftBrace, "{");
+        let mut entries = Vec::new();
+        for entry in node.array("entries")? {
+          entries.push((self.literal(entry.field("key")?)?, self.pattern(entry.field("pattern")?)?));
+        }
+        let rest = self.optional_variable(node, "rest")?;
+        Pattern::Map(MapPattern::new(brace, entries, rest))
+      }
+      _ => return Err(format!("Unknown pattern node {}.", node_name(node))),
+    };
+    Ok(pattern)
+  }
+
+  fn stmts(&mut self, nodes: &[Json]) -> Result<Vec<Stmt>, String> {
+    nodes.iter().map(|s| self.stmt(s)).collect()
+  }
+
+  fn boxed_stmt(&mut self, node: &Json, key: &str) -> Result<Box<Stmt>, String> {
+    Ok(Box::new(self.stmt(node.field(key)?)?))
+  }
+
+  fn optional_stmt(&mut self, node: &Json, key: &str) -> Result<Option<Box<Stmt>>, String> {
+    node.optional(key).map(|s| self.stmt(s).map(Box::new)).transpose()
+  }
+
+  fn constant(&self, node: &Json) -> Result<bool, String> {
+    match node.get("constant") {
+      None | Some(Json::Null) => Ok(false),
+      Some(Json::Bool(constant)) => Ok(*constant),
+      Some(_) => Err(format!("Expected 'constant' to be a boolean in {} node.", node.describe())),
+    }
+  }
+
+  fn function(&mut self, node: &Json) -> Result<FunStmt, String> {
+    let name = self.name(node)?;
+    let mut params = ParameterList::default();
+    for param in node.array("params")? {
+      params.names.push(self.name(param)?);
+      params.types.push(self.annotation(param, "annotation")?);
+      params.defaults.push(param.optional("default").map(|d| self.expr(d)).transpose()?);
+    }
+    params.rest = node.optional("rest").map(|r| self.name(r)).transpose()?;
+    let return_type = self.annotation(node, "return_annotation")?;
+    let body = self.stmts(node.array("body")?)?;
+    let mut function = FunStmt::new(name, params, return_type, Rc::new(BlockStmt::new(body)));
+    function.doc = self.doc(node)?;
+    Ok(function)
+  }
+
+  fn stmt(&mut self, node: &Json) -> Result<Stmt, String> {
+    let stmt = match node.kind() {
+      "Block" => Stmt::Block(BlockStmt::new(self.stmts(node.array("statements")?)?)),
+      "Expression" => Stmt::Expression(ExprStmt { expression: self.boxed(node, "expression")? }),
+      // Trees from before print took several values have just the one
+      "Print" => match node.optional("expression") {
+        Some(expression) => Stmt::Print(PrintStmt { expressions: vec![self.expr(expression)?] }),
+        None => Stmt::Print(PrintStmt { expressions: self.exprs(node, "expressions")? }),
+      },
+      "Return" => {
+        let keyword = self.token(node, TokenType::Return, "return");
+        let value = node.optional("value").map(|v| self.expr(v).map(Box::new)).transpose()?;
+        Stmt::Return(RetStmt::new(keyword, value))
+      }
+      "Var" => {
+        let name = self.name(node)?;
+        let annotation = self.annotation(node, "annotation")?;
+        let initializer = node.optional("initializer").map(|i| self.expr(i)).transpose()?;
+        Stmt::Var(VarStmt::new(name, annotation, initializer, self.constant(node)?))
+      }
+      "Destructure" => {
+        let pattern = self.destructure(node.field("pattern")?)?;
+        let initializer = self.expr(node.field("initializer")?)?;
+        Stmt::Destructure(DestructureStmt::new(pattern, initializer, self.constant(node)?))
+      }
+      "Fun" => Stmt::Fun(self.function(node)?),
+      "If" => {
+        let condition = self.boxed(node, "condition")?;
+        let then_branch = self.boxed_stmt(node, "then")?;
+        Stmt::If(IfStmt::new(condition, then_branch, self.optional_stmt(node, "else")?))
+      }
+      "While" => {
+        let condition = self.boxed(node, "condition")?;
+        let body = self.boxed_stmt(node, "body")?;
+        Stmt::While(WhileStmt::new(condition, body, self.optional_stmt(node, "else")?))
+      }
+      "DoWhile" => {
+        let body = self.boxed_stmt(node, "body")?;
+        Stmt::DoWhile(WhileStmt::new(self.boxed(node, "condition")?, body, None))
+      }
+      "For" => {
+        let initializer = self.optional_stmt(node, "initializer")?;
+        let condition = node.optional("condition").map(|c| self.expr(c).map(Box::new)).transpose()?;
+        let increment = node.optional("increment").map(|i| self.expr(i).map(Box::new)).transpose()?;
+        Stmt::For(ForStmt::new(initializer, condition, increment, self.boxed_stmt(node, "body")?))
+      }
+      "ForIn" => {
+        let name = self.name(node)?;
+        let iterable = self.expr(node.field("iterable")?)?;
+        let body = self.boxed_stmt(node, "body")?;
+        Stmt::ForIn(ForInStmt::new(name, iterable, body, self.optional_stmt(node, "else")?))
+      }
+      "Class" => {
+        let name = self.name(node)?;
+        let superclass = match node.optional("superclass") {
+          Some(superclass) if superclass.kind() == "Variable" => Some(Box::new(Expr::Variable(self.variable(superclass)?))),
+          Some(_) => return Err("A superclass must be a Variable node.".to_string()),
+          None => None,
+        };
+        let mut traits = Vec::new();
+        for name in node.array("traits")? {
+          match name {
+            Json::String(name) => traits.push(self.token(node, TokenType::Identifier, name)),
+            _ => return Err("Expected trait names to be strings.".to_string()),
+          }
+        }
+        let methods = node.array("methods")?.iter().map(|m| self.function(m)).collect::<Result<_, _>>()?;
+        let mut class = ClassStmt::new(name, superclass, traits, methods);
+        class.doc = self.doc(node)?;
+        Stmt::Class(class)
+      }
+      "Trait" => {
+        let name = self.name(node)?;
+        let mut methods = Vec::new();
+        for method in node.array("methods")? {
+          let method_name = self.name(method)?;
+          let mut params = Vec::new();
+          for param in method.array("params")? {
+            match param {
+              Json::String(param) => params.push(self.token(method, TokenType::Identifier, param)),
+              _ => return Err("Expected parameter names to be strings.".to_string()),
+            }
+          }
+          let mut signature = MethodSignature::new(method_name, params);
+          signature.doc = self.doc(method)?;
+          methods.push(signature);
+        }
+        let mut trait_stmt = TraitStmt::new(name, methods);
+        trait_stmt.doc = self.doc(node)?;
+        Stmt::Trait(trait_stmt)
+      }
+      "Yield" => {
+        let keyword = self.token(node, TokenType::Yield, "yield");
+        Stmt::Yield(YieldStmt::new(keyword, node.optional("value").map(|v| self.expr(v)).transpose()?))
+      }
+      "Break" => Stmt::Break(BreakStmt::new(self.token(node, TokenType::Break, "break"))),
+      "Try" => {
+        let keyword = self.token(node, TokenType::Try, "try");
+        let body = BlockStmt::new(self.stmts(node.array("body")?)?);
+        let mut catches = Vec::new();
+        for clause in node.array("catches")? {
+          let name = self.name(clause)?;
+          let class = clause.optional("class").map(|c| self.expr(c)).transpose()?;
+          catches.push(CatchClause::new(name, class, BlockStmt::new(self.stmts(clause.array("body")?)?)));
+        }
+        let finally = match node.optional("finally") {
+          Some(_) => Some(BlockStmt::new(self.stmts(node.array("finally")?)?)),
+          None => None,
+        };
+        Stmt::Try(TryStmt::new(keyword, body, catches, finally))
+      }
+      "Throw" => {
+        let keyword = self.token(node, TokenType::Throw, "throw");
+        Stmt::Throw(ThrowStmt::new(keyword, self.expr(node.field("value")?)?))
+      }
+      "Using" => {
+        let keyword = self.token(node, TokenType::Using, "using");
+        let name = self.name(node)?;
+        let initializer = self.expr(node.field("initializer")?)?;
+        Stmt::Using(UsingStmt::new(keyword, name, initializer, BlockStmt::new(self.stmts(node.array("body")?)?)))
+      }
+      _ => return Err(format!("Unknown statement node {}.", node_name(node))),
+    };
+    Ok(stmt)
+  }
+}
+
+fn node_name(node: &Json) -> String {
+  match node.kind() {
+    "" => "without a type".to_string(),
+    kind => format!("'{}'", kind),
+  }
+}
+
+struct JsonParser {
+  chars: Vec<char>,
+  current: usize,
+}
+
+impl JsonParser {
+  fn parse(&mut self) -> Result<Json, String> {
+    let value = self.value()?;
+    self.skip_whitespace();
+    if self.current < self.chars.len() {
+      return Err(self.error("Unexpected text after the JSON value."));
+    }
+    Ok(value)
+  }
+
+  fn error(&self, message: &str) -> String {
+    let line = self.chars[..self.current.min(self.chars.len())].iter().filter(|c| **c == '\n').count() + 1;
+    format!("Invalid JSON on line {}: {}", line, message)
+  }
+
+  fn skip_whitespace(&mut self) {
+    while self.current < self.chars.len() && self.chars[self.current].is_whitespace() {
+      self.current += 1;
+    }
+  }
+
+  fn peek(&self) -> char {
+    self.chars.get(self.current).copied().unwrap_or('\0')
+  }
+
+  fn expect(&mut self, c: char) -> Result<(), String> {
+    self.skip_whitespace();
+    if self.peek() != c {
+      return Err(self.error(&format!("Expected '{}'.", c)));
+    }
+    self.current += 1;
+    Ok(())
+  }
+
+  fn keyword(&mut self, word: &str, value: Json) -> Result<Json, String> {
+    let end = self.current + word.len();
+    if end <= self.chars.len() && self.chars[self.current..end].iter().collect::<String>() == word {
+      self.current = end;
+      return Ok(value);
+    }
+    Err(self.error("Unexpected character."))
+  }
+
+  fn value(&mut self) -> Result<Json, String> {
+    self.skip_whitespace();
+    match self.peek() {
+      '{' => {
+        self.current += 1;
+        let mut entries = Vec::new();
+        self.skip_whitespace();
+        if self.peek() == '}' {
+          self.current += 1;
+          return Ok(Json::Object(entries));
+        }
+        loop {
+          self.skip_whitespace();
+          if self.peek() != '"' {
+            return Err(self.error("Expected a string key."));
+          }
+          let key = self.string()?;
+          self.expect(':')?;
+          entries.push((key, self.value()?));
+          self.skip_whitespace();
+          match self.peek() {
+            ',' => self.current += 1,
+            '}' => {
+              self.current += 1;
+              return Ok(Json::Object(entries));
+            }
+            _ => return Err(self.error("Expected ',' or '}'.")),
+          }
+        }
+      }
+      '[' => {
+        self.current += 1;
+        let mut items = Vec::new();
+        self.skip_whitespace();
+        if self.peek() == ']' {
+          self.current += 1;
+          return Ok(Json::Array(items));
+        }
+        loop {
+          items.push(self.value()?);
+          self.skip_whitespace();
+          match self.peek() {
+            ',' => self.current += 1,
+            ']' => {
+              self.current += 1;
+              return Ok(Json::Array(items));
+            }
+            _ => return Err(self.error("Expected ',' or ']'.")),
+          }
+        }
+      }
+      '"' => Ok(Json::String(self.string()?)),
+      't' => self.keyword("true", Json::Bool(true)),
+      'f' => self.keyword("false", Json::Bool(false)),
+      'n' => self.keyword("null", Json::Null),
+      c if c == '-' || c.is_ascii_digit() => {
+        let start = self.current;
+        while self.current < self.chars.len() && matches!(self.peek(), '0'..='9' | '-' | '+' | '.' | 'e' | 'E') {
+          self.current += 1;
+        }
+        let number: String = self.chars[start..self.current].iter().collect();
+        if number.parse::<f64>().is_err() {
+          return Err(self.error(&format!("Invalid number '{}'.", number)));
+        }
+        Ok(Json::Number(number))
+      }
+      _ => Err(self.error("Expected a value.")),
+    }
+  }
+
+  // Starts at the opening quote
+  fn string(&mut self) -> Result<String, String> {
+    self.current += 1;
+    let mut out = String::new();
+    loop {
+      let c = match self.chars.get(self.current) {
+        Some(c) => *c,
+        None => return Err(self.error("Unterminated string.")),
+      };
+      self.current += 1;
+      match c {
+        '"' => return Ok(out),
+        '\\' => {
+          let escape = self.peek();
+          self.current += 1;
+          match escape {
+            '"' => out.push('"'),
+            '\\' => out.push('\\'),
+            '/' => out.push('/'),
+            'b' => out.push('\u{8}'),
+            'f' => out.push('\u{c}'),
+            'n' => out.push('\n'),
+            'r' => out.push('\r'),
+            't' => out.push('\t'),
+            'u' => {
+              let mut code = self.hex4()?;
+              // A surrogate pair spells one character outside the BMP
+              if (0xd800..0xdc00).contains(&code) && self.peek() == '\\' && self.chars.get(self.current + 1) == Some(&'u') {
+                self.current += 2;
+                let low = self.hex4()?;
+                code = 0x10000 + ((code - 0xd800) << 10) + (low.wrapping_sub(0xdc00) & 0x3ff);
+              }
+              out.push(char::from_u32(code).ok_or_else(|| self.error("Invalid \\u escape."))?);
+            }
+            _ => return Err(self.error("Invalid escape.")),
+          }
+        }
+        c => out.push(c),
+      }
+    }
+  }
+
+  fn hex4(&mut self) -> Result<u32, String> {
+    let end = self.current + 4;
+    if end > self.chars.len() {
+      return Err(self.error("Invalid \\u escape."));
+    }
+    let digits: String = self.chars[self.current..end].iter().collect();
+    self.current = end;
+    u32::from_str_radix(&digits, 16).map_err(|_| self.error("Invalid \\u escape."))
+  }
+}
@@ -0,0 +1,216 @@
+use std::cmp::Ordering;
+use std::fmt;
+
+// Arbitrary-precision integer used for `123n` literals. The magnitude is
+// stored as base 2^32 limbs, least significant first, with no trailing zeros
+// so that zero is always the empty vector.
+#[derive(Debug, Clone, PartialEq)]
+pub struct BigInt {
+  negative: bool,
+  limbs: Vec<u32>,
+}
+
+impl BigInt {
+  pub fn from_i64(value: i64) -> Self {
+    let mut magnitude = value.unsigned_abs();
+    let mut limbs = Vec::new();
+    while magnitude > 0 {
+      limbs.push(magnitude as u32);
+      magnitude >>= 32;
+    }
+    BigInt { negative: value < 0, limbs }
+  }
+
+  // `digits` must only contain digits valid in `radix`
+  pub fn parse(digits: &str, radix: u32) -> Option<Self> {
+    let mut limbs = Vec::new();
+    for c in digits.chars() {
+      let digit = c.to_digit(radix)?;
+      limbs = mul_small(&limbs, radix, digit);
+    }
+    Some(BigInt { negative: false, limbs })
+  }
+
+  pub fn is_zero(&self) -> bool {
+    self.limbs.is_empty()
+  }
+
+  pub fn to_i64(&self) -> Option<i64> {
+    if self.limbs.len() > 2 {
+      return None;
+    }
+    let mut magnitude: u64 = 0;
+    for limb in self.limbs.iter().rev() {
+      magnitude = (magnitude << 32) | *limb as u64;
+    }
+    if self.negative {
+      0i64.checked_sub_unsigned(magnitude)
+    } else {
+      i64::try_from(magnitude).ok()
+    }
+  }
+
+  pub fn to_f64(&self) -> f64 {
+    let magnitude = self.limbs.iter().rev().fold(0.0, |acc, limb| acc * 4294967296.0 + *limb as f64);
+    if self.negative { -magnitude } else { magnitude }
+  }
+
+  pub fn neg(&self) -> Self {
+    BigInt::signed(!self.negative, self.limbs.clone())
+  }
+
+  pub fn add(&self, other: &BigInt) -> Self {
+    if self.negative == other.negative {
+      return BigInt::signed(self.negative, add_magnitudes(&self.limbs, &other.limbs));
+    }
+    match compare_magnitudes(&self.limbs, &other.limbs) {
+      Ordering::Less => BigInt::signed(other.negative, sub_magnitudes(&other.limbs, &self.limbs)),
+      _ => BigInt::signed(self.negative, sub_magnitudes(&self.limbs, &other.limbs)),
+    }
+  }
+
+  pub fn sub(&self, other: &BigInt) -> Self {
+    self.add(&other.neg())
+  }
+
+  pub fn mul(&self, other: &BigInt) -> Self {
+    let mut limbs = vec![0u32; self.limbs.len() + other.limbs.len()];
+    for (i, a) in self.limbs.iter().enumerate() {
+      let mut carry: u64 = 0;
+      for (j, b) in other.limbs.iter().enumerate() {
+        let total = limbs[i + j] as u64 + (*a as u64) * (*b as u64) + carry;
+        limbs[i + j] = total as u32;
+        carry = total >> 32;
+      }
+      limbs[i + other.limbs.len()] = carry as u32;
+    }
+    BigInt::signed(self.negative != other.negative, limbs)
+  }
+
+  // Truncating division, returning the quotient and remainder. None when
+  // dividing by zero.
+  pub fn div_rem(&self, other: &BigInt) -> Option<(BigInt, BigInt)> {
+    if other.is_zero() {
+      return None;
+    }
+    let mut quotient = vec![0u32; self.limbs.len()];
+    let mut remainder: Vec<u32> = Vec::new();
+    for bit in (0..self.limbs.len() * 32).rev() {
+      remainder = mul_small(&remainder, 2, (self.limbs[bit / 32] >> (bit % 32)) & 1);
+      if compare_magnitudes(&remainder, &other.limbs) != Ordering::Less {
+        remainder = sub_magnitudes(&remainder, &other.limbs);
+        quotient[bit / 32] |= 1 << (bit % 32);
+      }
+    }
+    Some((
+      BigInt::signed(self.negative != other.negative, quotient),
+      BigInt::signed(self.negative, remainder),
+    ))
+  }
+
+  fn signed(negative: bool, mut limbs: Vec<u32>) -> Self {
+    while limbs.last() == Some(&0) {
+      limbs.pop();
+    }
+    let negative = negative && !limbs.is_empty();
+    BigInt { negative, limbs }
+  }
+}
+
+impl PartialOrd for BigInt {
+  fn partial_cmp(&self, other: &BigInt) -> Option<Ordering> {
+    let ordering = match (self.negative, other.negative) {
+      (false, true) => Ordering::Greater,
+      (true, false) => Ordering::Less,
+      (false, false) => compare_magnitudes(&self.limbs, &other.limbs),
+      (true, true) => compare_magnitudes(&other.limbs, &self.limbs),
+    };
+    Some(ordering)
+  }
+}
+
+impl fmt::Display for BigInt {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    if self.is_zero() {
+      return write!(f, "0");
+    }
+    // Peel off nine decimal digits at a time
+    let mut chunks = Vec::new();
+    let mut limbs = self.limbs.clone();
+    while !limbs.is_empty() {
+      let mut remainder: u64 = 0;
+      for limb in limbs.iter_mut().rev() {
+        let current = (remainder << 32) | *limb as u64;
+        *limb = (current / 1_000_000_000) as u32;
+        remainder = current % 1_000_000_000;
+      }
+      while limbs.last() == Some(&0) {
+        limbs.pop();
+      }
+      chunks.push(remainder);
+    }
+    if self.negative {
+      write!(f, "-")?;
+    }
+    write!(f, "{}", chunks.pop().unwrap())?;
+    for chunk in chunks.iter().rev() {
+      write!(f, "{:09}", chunk)?;
+    }
+    Ok(())
+  }
+}
+
+fn compare_magnitudes(a: &[u32], b: &[u32]) -> Ordering {
+  if a.len() != b.len() {
+    return a.len().cmp(&b.len());
+  }
+  a.iter().rev().cmp(b.iter().rev())
+}
+
+fn add_magnitudes(a: &[u32], b: &[u32]) -> Vec<u32> {
+  let mut limbs = Vec::with_capacity(a.len().max(b.len()) + 1);
+  let mut carry: u64 = 0;
+  for i in 0..a.len().max(b.len()) {
+    let total = *a.get(i).unwrap_or(&0) as u64 + *b.get(i).unwrap_or(&0) as u64 + carry;
+    limbs.push(total as u32);
+    carry = total >> 32;
+  }
+  if carry > 0 {
+    limbs.push(carry as u32);
+  }
+  limbs
+}
+
+// Assumes a >= b
+fn sub_magnitudes(a: &[u32], b: &[u32]) -> Vec<u32> {
+  let mut limbs = Vec::with_capacity(a.len());
+  let mut borrow: i64 = 0;
+  for i in 0..a.len() {
+    let mut total = a[i] as i64 - *b.get(i).unwrap_or(&0) as i64 - borrow;
+    borrow = 0;
+    if total < 0 {
+      total += 1 << 32;
+      borrow = 1;
+    }
+    limbs.push(total as u32);
+  }
+  while limbs.last() == Some(&0) {
+    limbs.pop();
+  }
+  limbs
+}
+
+// Computes a * factor + addend
+fn mul_small(a: &[u32], factor: u32, addend: u32) -> Vec<u32> {
+  let mut limbs = Vec::with_capacity(a.len() + 1);
+  let mut carry = addend as u64;
+  for limb in a {
+    let total = *limb as u64 * factor as u64 + carry;
+    limbs.push(total as u32);
+    carry = total >> 32;
+  }
+  if carry > 0 {
+    limbs.push(carry as u32);
+  }
+  limbs
+}
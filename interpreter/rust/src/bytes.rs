@@ -0,0 +1,92 @@
+/*
+Byte buffers, built with Bytes(...) or read from a file with readBytes(), for
+scripts that work with data that isn't text.
+
+A buffer holds bytes 0-255 and indexes, slices, iterates and compares like a
+list of integers, but prints as hex so it's readable at a glance. It can be
+changed in place until freeze() is called on it, after which it's hashable by
+content like a frozen list. Text goes in and out as UTF-8; hex and base64
+(the standard alphabet, with padding) are the encodings for carrying binary
+data around as strings.
+*/
+
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct LoxBytes {
+  pub data: Vec<u8>,
+  // Set by freeze(), after which no byte can be changed or added
+  pub frozen: bool,
+}
+
+impl LoxBytes {
+  pub fn new(data: Vec<u8>) -> Self {
+    LoxBytes { data, frozen: false }
+  }
+}
+
+const HEX_DIGITS: &[u8; 16] = b"0123456789abcdef";
+const BASE64_ALPHABET: &[u8; 64] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+// Two lowercase digits a byte
+pub fn to_hex(data: &[u8]) -> String {
+  let mut hex = String::with_capacity(data.len() * 2);
+  for byte in data {
+    hex.push(HEX_DIGITS[(byte >> 4) as usize] as char);
+    hex.push(HEX_DIGITS[(byte & 0xf) as usize] as char);
+  }
+  hex
+}
+
+// Digits in either case, two a byte
+pub fn from_hex(hex: &str) -> Result<Vec<u8>, String> {
+  let digits = hex.as_bytes();
+  if digits.len() % 2 != 0 {
+    return Err(format!("'{}' has an odd number of hex digits.", hex));
+  }
+  let digit = |c: u8| (c as char).to_digit(16).ok_or_else(|| format!("'{}' isn't a hex digit.", c as char));
+  let mut data = Vec::with_capacity(digits.len() / 2);
+  for pair in digits.chunks(2) {
+    data.push((digit(pair[0])? * 16 + digit(pair[1])?) as u8);
+  }
+  Ok(data)
+}
+
+pub fn to_base64(data: &[u8]) -> String {
+  let mut encoded = String::with_capacity(data.len().div_ceil(3) * 4);
+  for chunk in data.chunks(3) {
+    let group = (chunk[0] as u32) << 16 | (*chunk.get(1).unwrap_or(&0) as u32) << 8 | *chunk.get(2).unwrap_or(&0) as u32;
+    for i in 0..4 {
+      if i <= chunk.len() {
+        encoded.push(BASE64_ALPHABET[(group >> (18 - 6 * i) & 0x3f) as usize] as char);
+      } else {
+        encoded.push('=');
+      }
+    }
+  }
+  encoded
+}
+
+// Padding is required, so the length is always a multiple of four
+pub fn from_base64(encoded: &str) -> Result<Vec<u8>, String> {
+  let invalid = || format!("'{}' isn't valid base64.", encoded);
+  let chars = encoded.as_bytes();
+  if chars.len() % 4 != 0 {
+    return Err(invalid());
+  }
+  let mut data = Vec::with_capacity(chars.len() / 4 * 3);
+  for (n, chunk) in chars.chunks(4).enumerate() {
+    let last = n == chars.len() / 4 - 1;
+    let padding = chunk.iter().rev().take_while(|c| **c == b'=').count();
+    if padding > 2 || (padding > 0 && !last) {
+      return Err(invalid());
+    }
+    let mut group = 0u32;
+    for c in &chunk[..4 - padding] {
+      let value = BASE64_ALPHABET.iter().position(|a| a == c).ok_or_else(invalid)?;
+      group = group << 6 | value as u32;
+    }
+    group <<= 6 * padding;
+    let decoded = [(group >> 16) as u8, (group >> 8) as u8, group as u8];
+    data.extend_from_slice(&decoded[..3 - padding]);
+  }
+  Ok(data)
+}
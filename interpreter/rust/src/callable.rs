@@ -1,10 +1,57 @@
 use crate::lexer::*;
 use crate::interpreter::*;
+use crate::environment::Environment;
+use crate::ast::FunStmt;
+use crate::oop::LoxInstance;
+use std::cell::RefCell;
+use std::rc::Rc;
 
 pub trait LoxCallable: std::fmt::Debug {
-  fn call(&mut self, interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Box<LoxValue>;
+  fn call(&self, interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError>;
   fn arity(&self) -> usize;
+  // Fewest arguments accepted; less than arity() when trailing parameters have defaults
+  fn min_arity(&self) -> usize {
+    self.arity()
+  }
+  // Variadic callables accept any number of arguments past arity()
+  fn is_variadic(&self) -> bool {
+    false
+  }
   fn box_clone(&self) -> Box<dyn LoxCallable>;
+  // Called instead of call() when the call site passes `name: value` arguments
+  fn call_named(&self, _interpreter: &mut Interpreter, _arguments: Vec<LoxValue>, _named: Vec<(String, LoxValue)>) -> Result<Box<LoxValue>, InterpreterError> {
+    Err(InterpreterError::call_error("", format!("{:?} does not accept named arguments.", self)))
+  }
+  // The scope a Lox function closes over, which natives don't have
+  fn closure(&self) -> Option<Rc<RefCell<Environment>>> {
+    None
+  }
+  // For a method looked up on an instance, the method and the instance it's
+  // bound to. Two lookups of the same one are equal without being identical.
+  fn bound_method(&self) -> Option<(Rc<FunStmt>, Rc<RefCell<LoxInstance>>)> {
+    None
+  }
+  // Where a Lox function was declared and what it takes, for arity errors.
+  // Natives weren't declared anywhere.
+  fn declaration(&self) -> Option<String> {
+    None
+  }
+  // The id weak.rs tracks the native handle a method works on by
+  fn handle(&self) -> Option<i64> {
+    None
+  }
+}
+
+// How many arguments a callable takes, as arity errors say it: "2", "1 to 3",
+// or "at least 1" when it's variadic
+pub fn expected_arguments(min_arity: usize, arity: usize, variadic: bool) -> String {
+  if variadic {
+    format!("at least {}", min_arity)
+  } else if min_arity == arity {
+    format!("{}", arity)
+  } else {
+    format!("{} to {}", min_arity, arity)
+  }
 }
 
 impl Clone for Box<dyn LoxCallable> {
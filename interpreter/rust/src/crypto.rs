@@ -0,0 +1,158 @@
+/*
+Hashes and random identifiers for sha256(), md5(), hmac() and uuid().
+
+SHA-256 is from FIPS 180-4 and MD5 from RFC 1321; HMAC (RFC 2104) is built
+on SHA-256. MD5 is only here to check data against published digests, since
+it's long broken for anything adversarial. uuid() makes version 4 UUIDs from
+the system's random source, which goes through replay.rs so recorded runs
+get the same ones back.
+*/
+
+use crate::replay;
+use std::fs::File;
+use std::io::Read;
+
+const SHA256_INITIAL: [u32; 8] = [
+  0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+];
+
+// The first 32 bits of the fractional parts of the cube roots of the first 64 primes
+const SHA256_ROUNDS: [u32; 64] = [
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+];
+
+// The per-step left rotations of MD5's four rounds
+const MD5_SHIFTS: [u32; 64] = [
+  7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22,
+  5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20,
+  4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23,
+  6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21,
+];
+
+const SHA256_BLOCK: usize = 64;
+
+// Both hashes pad the message with a 1 bit, zeros, and its length in bits to
+// a whole number of 64-byte blocks; only the length's byte order differs
+fn pad(data: &[u8], big_endian: bool) -> Vec<u8> {
+  let bits = (data.len() as u64).wrapping_mul(8);
+  let mut message = data.to_vec();
+  message.push(0x80);
+  while message.len() % 64 != 56 {
+    message.push(0);
+  }
+  message.extend_from_slice(&if big_endian { bits.to_be_bytes() } else { bits.to_le_bytes() });
+  message
+}
+
+pub fn sha256(data: &[u8]) -> [u8; 32] {
+  let mut state = SHA256_INITIAL;
+  for block in pad(data, true).chunks(64) {
+    let mut w = [0u32; 64];
+    for (i, word) in block.chunks(4).enumerate() {
+      w[i] = u32::from_be_bytes(word.try_into().unwrap());
+    }
+    for i in 16..64 {
+      let s0 = w[i - 15].rotate_right(7) ^ w[i - 15].rotate_right(18) ^ (w[i - 15] >> 3);
+      let s1 = w[i - 2].rotate_right(17) ^ w[i - 2].rotate_right(19) ^ (w[i - 2] >> 10);
+      w[i] = w[i - 16].wrapping_add(s0).wrapping_add(w[i - 7]).wrapping_add(s1);
+    }
+    let [mut a, mut b, mut c, mut d, mut e, mut f, mut g, mut h] = state;
+    for i in 0..64 {
+      let s1 = e.rotate_right(6) ^ e.rotate_right(11) ^ e.rotate_right(25);
+      let choose = (e & f) ^ (!e & g);
+      let t1 = h.wrapping_add(s1).wrapping_add(choose).wrapping_add(SHA256_ROUNDS[i]).wrapping_add(w[i]);
+      let s0 = a.rotate_right(2) ^ a.rotate_right(13) ^ a.rotate_right(22);
+      let majority = (a & b) ^ (a & c) ^ (b & c);
+      let t2 = s0.wrapping_add(majority);
+      h = g;
+      g = f;
+      f = e;
+      e = d.wrapping_add(t1);
+      d = c;
+      c = b;
+      b = a;
+      a = t1.wrapping_add(t2);
+    }
+    for (word, value) in state.iter_mut().zip([a, b, c, d, e, f, g, h]) {
+      *word = word.wrapping_add(value);
+    }
+  }
+  let mut digest = [0u8; 32];
+  for (i, word) in state.iter().enumerate() {
+    digest[i * 4..i * 4 + 4].copy_from_slice(&word.to_be_bytes());
+  }
+  digest
+}
+
+pub fn md5(data: &[u8]) -> [u8; 16] {
+  let mut state: [u32; 4] = [0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476];
+  for block in pad(data, false).chunks(64) {
+    let mut m = [0u32; 16];
+    for (i, word) in block.chunks(4).enumerate() {
+      m[i] = u32::from_le_bytes(word.try_into().unwrap());
+    }
+    let [mut a, mut b, mut c, mut d] = state;
+    for i in 0..64 {
+      let (f, g) = match i / 16 {
+        0 => ((b & c) | (!b & d), i),
+        1 => ((d & b) | (!d & c), (5 * i + 1) % 16),
+        2 => (b ^ c ^ d, (3 * i + 5) % 16),
+        _ => (c ^ (b | !d), (7 * i) % 16),
+      };
+      // The integer part of 2^32 times abs(sin(i + 1))
+      let k = ((i as f64 + 1.0).sin().abs() * 4294967296.0) as u32;
+      let rotated = a.wrapping_add(f).wrapping_add(k).wrapping_add(m[g]).rotate_left(MD5_SHIFTS[i]);
+      a = d;
+      d = c;
+      c = b;
+      b = b.wrapping_add(rotated);
+    }
+    for (word, value) in state.iter_mut().zip([a, b, c, d]) {
+      *word = word.wrapping_add(value);
+    }
+  }
+  let mut digest = [0u8; 16];
+  for (i, word) in state.iter().enumerate() {
+    digest[i * 4..i * 4 + 4].copy_from_slice(&word.to_le_bytes());
+  }
+  digest
+}
+
+pub fn hmac_sha256(key: &[u8], message: &[u8]) -> [u8; 32] {
+  let mut block = [0u8; SHA256_BLOCK];
+  if key.len() > SHA256_BLOCK {
+    block[..32].copy_from_slice(&sha256(key));
+  } else {
+    block[..key.len()].copy_from_slice(key);
+  }
+  let mut inner: Vec<u8> = block.iter().map(|b| b ^ 0x36).collect();
+  inner.extend_from_slice(message);
+  let mut outer: Vec<u8> = block.iter().map(|b| b ^ 0x5c).collect();
+  outer.extend_from_slice(&sha256(&inner));
+  sha256(&outer)
+}
+
+// A random version 4 UUID, like "0b4f2c4e-8f5a-4c1e-9d3b-2a7e6f1c0d95"
+pub fn uuid() -> Result<String, String> {
+  let random = replay::random(16, || {
+    let mut bytes = vec![0; 16];
+    File::open("/dev/urandom")
+      .and_then(|mut source| source.read_exact(&mut bytes))
+      .map_err(|err| format!("Can't read random bytes: {}.", err))?;
+    Ok(bytes)
+  })?;
+  let mut bytes = [0u8; 16];
+  bytes.copy_from_slice(&random);
+  // The version in the high nibble of byte 6, and the RFC 4122 variant
+  bytes[6] = (bytes[6] & 0x0f) | 0x40;
+  bytes[8] = (bytes[8] & 0x3f) | 0x80;
+  let hex = crate::bytes::to_hex(&bytes);
+  Ok(format!("{}-{}-{}-{}-{}", &hex[..8], &hex[8..12], &hex[12..16], &hex[16..20], &hex[20..]))
+}
@@ -0,0 +1,102 @@
+/*
+CSV for csvParse(), csvRead() and csvWrite(), following RFC 4180 the way Go's
+encoding/csv reads it.
+
+Fields are separated by commas and records by newlines, with "\r\n" read as
+"\n". A field that starts with a quote runs to the matching closing quote and
+can hold commas, newlines and doubled quotes ("") standing for one; a quote
+anywhere else in a field is an error. Empty lines are skipped, and every
+record has to have as many fields as the first.
+
+Writing quotes just the fields that need it: ones with a comma, quote or
+line break in them, or that start with a space. A record of one empty field
+is written as "" so it isn't read back as an empty line.
+*/
+
+pub fn parse(text: &str) -> Result<Vec<Vec<String>>, String> {
+  let text = text.replace("\r\n", "\n");
+  let mut chars = text.chars().peekable();
+  let mut records: Vec<Vec<String>> = Vec::new();
+  let mut line = 1;
+  while chars.peek().is_some() {
+    if chars.peek() == Some(&'\n') {
+      chars.next();
+      line += 1;
+      continue;
+    }
+    let start_line = line;
+    let mut record = Vec::new();
+    loop {
+      let mut field = String::new();
+      if chars.peek() == Some(&'"') {
+        chars.next();
+        loop {
+          match chars.next() {
+            Some('"') if chars.peek() == Some(&'"') => {
+              chars.next();
+              field.push('"');
+            }
+            Some('"') => break,
+            Some(c) => {
+              if c == '\n' {
+                line += 1;
+              }
+              field.push(c);
+            }
+            None => return Err(format!("Line {}: a quoted field isn't closed.", start_line)),
+          }
+        }
+        if !matches!(chars.peek(), Some(',') | Some('\n') | None) {
+          return Err(format!("Line {}: a quoted field has text after its closing quote.", line));
+        }
+      } else {
+        while let Some(&c) = chars.peek() {
+          if c == ',' || c == '\n' {
+            break;
+          }
+          if c == '"' {
+            return Err(format!("Line {}: a field that isn't quoted has a quote in it.", line));
+          }
+          field.push(c);
+          chars.next();
+        }
+      }
+      record.push(field);
+      match chars.next() {
+        Some(',') => continue,
+        Some(_) => line += 1,
+        None => (),
+      }
+      break;
+    }
+    if let Some(first) = records.first() {
+      if record.len() != first.len() {
+        return Err(format!("Line {} has {} fields where the first record has {}.", start_line, record.len(), first.len()));
+      }
+    }
+    records.push(record);
+  }
+  Ok(records)
+}
+
+pub fn format(records: &[Vec<String>]) -> String {
+  let mut text = String::new();
+  for record in records {
+    if record.len() == 1 && record[0].is_empty() {
+      text.push_str("\"\"\n");
+      continue;
+    }
+    let fields: Vec<String> = record.iter().map(|field| quote(field)).collect();
+    text.push_str(&fields.join(","));
+    text.push('\n');
+  }
+  text
+}
+
+fn quote(field: &str) -> String {
+  if field.contains([',', '"', '\r', '\n']) || field.starts_with(' ') {
+    format!("\"{}\"", field.replace('"', "\"\""))
+  } else {
+    field.to_string()
+  }
+}
@@ -0,0 +1,1110 @@
+/*
+Dates and times for the DateTime native, with the layouts and time zone
+rules of Go's time package, which is what `lox build` hands them to.
+
+A layout is the reference time, Mon Jan 2 15:04:05 MST 2006, written the
+way the dates it describes should look: "2006-01-02 15:04" formats as
+"2024-03-09 17:30", and parses it back. The pieces understood are
+
+    year      2006 06                 month   January Jan 01 1
+    day       02 2 _2                 weekday Monday Mon
+    day of year  002 __2              hour    15 03 3
+    minute    04 4                    second  05 5
+    fraction  .000 .999 (or with a comma), trailing 9s trimmed
+    AM/PM     PM pm                   zone    MST
+    offset    -07:00 -0700 -07 -07:00:00 -070000, or Z07:00 and the like
+              to write UTC as Z
+
+and anything else is copied or matched as written.
+
+A time is an instant, whole seconds and nanoseconds since the Unix epoch,
+seen in a zone. Zones are "UTC", "Local" or an IANA name like
+"America/New_York", read from the system's tzdata (or $ZONEINFO) in TZif
+form, with the POSIX rule at the end of the file carrying daylight saving
+past the last transition listed. "Local" follows $TZ, or /etc/localtime
+without it, and falls back to UTC. Times parsed with a numeric offset
+that isn't the local zone's get a fixed zone with that offset.
+*/
+
+use std::rc::Rc;
+
+const SECONDS_PER_DAY: i64 = 86400;
+
+// The start and end of time, for zone periods with no transition on a side
+const ALPHA: i64 = i64::MIN;
+const OMEGA: i64 = i64::MAX;
+
+const LONG_MONTHS: [&str; 12] = [
+  "January", "February", "March", "April", "May", "June",
+  "July", "August", "September", "October", "November", "December",
+];
+const LONG_DAYS: [&str; 7] = ["Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"];
+
+// Where IANA zones are looked for, after $ZONEINFO, as Go does
+const ZONE_SOURCES: &[&str] = &["/usr/share/zoneinfo/", "/usr/share/lib/zoneinfo/", "/usr/lib/locale/TZ/", "/etc/zoneinfo/"];
+
+///////////// Zones ///////////////
+
+#[derive(Debug, Clone, PartialEq)]
+struct ZoneType {
+  abbreviation: String,
+  offset: i64,
+  dst: bool,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct Zone {
+  pub name: String,
+  types: Vec<ZoneType>,
+  // When each period starts and the type in force during it, in order
+  transitions: Vec<(i64, usize)>,
+  // The POSIX TZ rule for times after the last transition, if any
+  extend: String,
+}
+
+// The zone's abbreviation and offset at some instant, with the span of
+// seconds around it that they hold for
+struct Period {
+  abbreviation: String,
+  offset: i64,
+  start: i64,
+  end: i64,
+}
+
+impl Zone {
+  pub fn utc() -> Zone {
+    Zone::fixed("UTC", 0)
+  }
+
+  pub fn fixed(name: &str, offset: i64) -> Zone {
+    Zone {
+      name: name.to_string(),
+      types: vec![ZoneType { abbreviation: name.to_string(), offset, dst: false }],
+      transitions: vec![(ALPHA, 0)],
+      extend: String::new(),
+    }
+  }
+
+  fn lookup(&self, sec: i64) -> Period {
+    let period = |index: usize, start: i64, end: i64| {
+      let kind = &self.types[index];
+      Period { abbreviation: kind.abbreviation.clone(), offset: kind.offset, start, end }
+    };
+    if self.transitions.first().map_or(true, |(first, _)| sec < *first) {
+      let end = self.transitions.first().map_or(OMEGA, |(when, _)| *when);
+      return period(self.first_type(), ALPHA, end);
+    }
+    let last = self.transitions.partition_point(|(when, _)| *when <= sec) - 1;
+    let (start, index) = self.transitions[last];
+    let end = self.transitions.get(last + 1).map_or(OMEGA, |(when, _)| *when);
+    if last == self.transitions.len() - 1 && !self.extend.is_empty() {
+      if let Some(period) = tzset(&self.extend, start, sec) {
+        return period;
+      }
+    }
+    period(index, start, end)
+  }
+
+  // The type in force before the first transition: the first type, unless a
+  // transition uses it, and then the first standard time type
+  fn first_type(&self) -> usize {
+    if !self.transitions.iter().any(|(_, index)| *index == 0) {
+      return 0;
+    }
+    if let Some(&(_, index)) = self.transitions.first() {
+      if self.types[index].dst {
+        if let Some(standard) = (0..index).rev().find(|i| !self.types[*i].dst) {
+          return standard;
+        }
+      }
+    }
+    self.types.iter().position(|kind| !kind.dst).unwrap_or(0)
+  }
+
+  // The offset a zone abbreviation stands for around the time, preferring a
+  // type with that name that's actually in force then
+  fn lookup_name(&self, name: &str, unix: i64) -> Option<i64> {
+    for kind in &self.types {
+      if kind.abbreviation == name && self.lookup(unix - kind.offset).abbreviation == name {
+        return Some(kind.offset);
+      }
+    }
+    self.types.iter().find(|kind| kind.abbreviation == name).map(|kind| kind.offset)
+  }
+}
+
+pub fn load_zone(name: &str) -> Result<Rc<Zone>, String> {
+  let unknown = || format!("Unknown time zone '{}'.", name);
+  match name {
+    "" | "UTC" => return Ok(Rc::new(Zone::utc())),
+    "Local" => return Ok(local_zone()),
+    _ => (),
+  }
+  if name.contains("..") || name.starts_with('/') || name.starts_with('\\') {
+    return Err(unknown());
+  }
+  let mut sources: Vec<String> = std::env::var("ZONEINFO").into_iter().map(|dir| format!("{}/", dir)).collect();
+  sources.extend(ZONE_SOURCES.iter().map(|dir| dir.to_string()));
+  for dir in sources {
+    if let Ok(data) = std::fs::read(format!("{}{}", dir, name)) {
+      return parse_tzif(name, &data).map(Rc::new).ok_or_else(unknown);
+    }
+  }
+  Err(unknown())
+}
+
+// The zone $TZ names, or /etc/localtime's without it, or UTC when neither
+// can be read
+pub fn local_zone() -> Rc<Zone> {
+  let zone = match std::env::var("TZ") {
+    Err(_) => std::fs::read("/etc/localtime").ok().and_then(|data| parse_tzif("Local", &data)),
+    Ok(tz) => {
+      let tz = tz.strip_prefix(':').unwrap_or(&tz);
+      if tz.starts_with('/') {
+        let name = if tz == "/etc/localtime" { "Local" } else { tz };
+        std::fs::read(tz).ok().and_then(|data| parse_tzif(name, &data))
+      } else if !tz.is_empty() && tz != "UTC" {
+        load_zone(tz).ok().map(|zone| (*zone).clone())
+      } else {
+        None
+      }
+    }
+  };
+  Rc::new(zone.unwrap_or_else(Zone::utc))
+}
+
+// Reads a TZif file: a header of counts, then the transitions, the types
+// they switch to and their abbreviations. Version 2 and later files repeat
+// it all with 64-bit times, then give the POSIX rule between newlines.
+fn parse_tzif(name: &str, data: &[u8]) -> Option<Zone> {
+  let mut reader = Reader { data, pos: 0 };
+  let mut header = reader.header()?;
+  let wide = header.version >= b'2';
+  if wide {
+    reader.skip(header.timecnt * 5 + header.typecnt * 6 + header.charcnt + header.leapcnt * 8 + header.isstdcnt + header.isutcnt)?;
+    header = reader.header()?;
+  }
+  let times = (0..header.timecnt)
+    .map(|_| if wide { reader.bytes(8).map(|b| i64::from_be_bytes(b.try_into().unwrap())) } else { reader.u32().map(|n| n as i32 as i64) })
+    .collect::<Option<Vec<i64>>>()?;
+  let indices = reader.bytes(header.timecnt)?.to_vec();
+  let mut raw_types = Vec::new();
+  for _ in 0..header.typecnt {
+    let offset = reader.u32()? as i32 as i64;
+    let dst = reader.bytes(1)?[0] != 0;
+    let abbreviation = reader.bytes(1)?[0] as usize;
+    raw_types.push((offset, dst, abbreviation));
+  }
+  let chars = reader.bytes(header.charcnt)?;
+  reader.skip(header.leapcnt * (if wide { 12 } else { 8 }) + header.isstdcnt + header.isutcnt)?;
+  let extend = if wide { reader.footer() } else { String::new() };
+
+  let types: Vec<ZoneType> = raw_types
+    .into_iter()
+    .map(|(offset, dst, start)| {
+      let text = chars.get(start..)?;
+      let end = text.iter().position(|b| *b == 0).unwrap_or(text.len());
+      Some(ZoneType { abbreviation: String::from_utf8_lossy(&text[..end]).into_owned(), offset, dst })
+    })
+    .collect::<Option<_>>()?;
+  if types.is_empty() || indices.iter().any(|index| *index as usize >= types.len()) {
+    return None;
+  }
+  let mut transitions: Vec<(i64, usize)> = times.into_iter().zip(indices.into_iter().map(|index| index as usize)).collect();
+  if transitions.is_empty() {
+    transitions.push((ALPHA, 0));
+  }
+  Some(Zone { name: name.to_string(), types, transitions, extend })
+}
+
+struct Reader<'a> {
+  data: &'a [u8],
+  pos: usize,
+}
+
+struct Header {
+  version: u8,
+  isutcnt: usize,
+  isstdcnt: usize,
+  leapcnt: usize,
+  timecnt: usize,
+  typecnt: usize,
+  charcnt: usize,
+}
+
+impl<'a> Reader<'a> {
+  fn bytes(&mut self, n: usize) -> Option<&'a [u8]> {
+    let bytes = self.data.get(self.pos..self.pos.checked_add(n)?)?;
+    self.pos += n;
+    Some(bytes)
+  }
+
+  fn skip(&mut self, n: usize) -> Option<()> {
+    self.bytes(n).map(|_| ())
+  }
+
+  fn u32(&mut self) -> Option<u32> {
+    self.bytes(4).map(|b| u32::from_be_bytes(b.try_into().unwrap()))
+  }
+
+  fn header(&mut self) -> Option<Header> {
+    if self.bytes(4)? != b"TZif" {
+      return None;
+    }
+    let version = self.bytes(1)?[0];
+    self.skip(15)?;
+    let mut count = || self.u32().map(|n| n as usize);
+    Some(Header { version, isutcnt: count()?, isstdcnt: count()?, leapcnt: count()?, timecnt: count()?, typecnt: count()?, charcnt: count()? })
+  }
+
+  fn footer(&mut self) -> String {
+    let rest = &self.data[self.pos..];
+    match rest.strip_prefix(b"\n").and_then(|rest| rest.iter().position(|b| *b == b'\n').map(|end| &rest[..end])) {
+      Some(rule) => String::from_utf8_lossy(rule).into_owned(),
+      None => String::new(),
+    }
+  }
+}
+
+///////////// POSIX TZ rules ///////////////
+/// A rule like "EST5EDT,M3.2.0,M11.1.0" names standard time and its offset
+/// west of UTC, then optionally daylight time (an hour ahead unless an offset
+/// is given) and the days it starts and ends: Jn for day n of 365 ignoring
+/// leap days, n for day n counting from 0, or Mm.w.d for weekday d of week w
+/// of month m, week 5 being the last. Each can end in /time, 2:00 otherwise.
+
+#[derive(Clone, Copy)]
+enum Rule {
+  Julian(i64),
+  DayOfYear(i64),
+  MonthWeekDay { month: i64, week: i64, day: i64 },
+}
+
+// The period the rule puts the time in. Its start and end are only exact
+// near a transition, and otherwise the start or end of the year.
+fn tzset(s: &str, last_transition: i64, sec: i64) -> Option<Period> {
+  let (std_name, s) = tzset_name(s)?;
+  let (std_offset, s) = tzset_offset(s)?;
+  // The rule's offsets are added to local time to get UTC, ours the reverse
+  let mut std_offset = -std_offset;
+  let mut std_name = std_name.to_string();
+  if s.is_empty() || s.starts_with(',') {
+    return Some(Period { abbreviation: std_name, offset: std_offset, start: last_transition, end: OMEGA });
+  }
+  let (dst_name, mut s) = tzset_name(s)?;
+  let mut dst_name = dst_name.to_string();
+  let mut dst_offset = std_offset + 3600;
+  if !s.is_empty() && !s.starts_with(',') {
+    let (offset, rest) = tzset_offset(s)?;
+    dst_offset = -offset;
+    s = rest;
+  }
+  // The US rules are the default, as in tzcode
+  let s = if s.is_empty() { ",M3.2.0,M11.1.0" } else { s };
+  let s = s.strip_prefix(',').or_else(|| s.strip_prefix(';'))?;
+  let (start_rule, s) = tzset_rule(s)?;
+  let (end_rule, s) = tzset_rule(s.strip_prefix(',')?)?;
+  if !s.is_empty() {
+    return None;
+  }
+
+  let year = civil_from_days(sec.div_euclid(SECONDS_PER_DAY)).0;
+  let year_start = days_from_civil(year, 1, 1) * SECONDS_PER_DAY;
+  let year_sec = sec - year_start;
+  let mut start = rule_time(year, start_rule, std_offset);
+  let mut end = rule_time(year, end_rule, dst_offset);
+  // In the southern hemisphere daylight time spans the new year, so the
+  // part of the year between the rules is standard time
+  if end < start {
+    std::mem::swap(&mut start, &mut end);
+    std::mem::swap(&mut std_name, &mut dst_name);
+    std::mem::swap(&mut std_offset, &mut dst_offset);
+  }
+  Some(if year_sec < start {
+    Period { abbreviation: std_name, offset: std_offset, start: year_start, end: year_start + start }
+  } else if year_sec >= end {
+    Period { abbreviation: std_name, offset: std_offset, start: year_start + end, end: year_start + 365 * SECONDS_PER_DAY }
+  } else {
+    Period { abbreviation: dst_name, offset: dst_offset, start: year_start + start, end: year_start + end }
+  })
+}
+
+// A name is three or more letters, or anything between angle brackets
+fn tzset_name(s: &str) -> Option<(&str, &str)> {
+  if let Some(quoted) = s.strip_prefix('<') {
+    let end = quoted.find('>')?;
+    return Some((&quoted[..end], &quoted[end + 1..]));
+  }
+  let end = s.find(|c: char| c.is_ascii_digit() || c == ',' || c == '-' || c == '+').unwrap_or(s.len());
+  if end < 3 {
+    return None;
+  }
+  Some((&s[..end], &s[end..]))
+}
+
+// [+-]hh[:mm[:ss]], in seconds
+fn tzset_offset(s: &str) -> Option<(i64, &str)> {
+  let (negative, s) = match s.as_bytes().first()? {
+    b'+' => (false, &s[1..]),
+    b'-' => (true, &s[1..]),
+    _ => (false, s),
+  };
+  let (hours, mut s) = tzset_num(s, 0, 24 * 7)?;
+  let mut offset = hours * 3600;
+  for scale in [60, 1] {
+    let Some(rest) = s.strip_prefix(':') else { break };
+    let (n, rest) = tzset_num(rest, 0, 59)?;
+    offset += n * scale;
+    s = rest;
+  }
+  Some((if negative { -offset } else { offset }, s))
+}
+
+fn tzset_rule(s: &str) -> Option<(TimedRule, &str)> {
+  let (rule, s) = if let Some(rest) = s.strip_prefix('J') {
+    let (day, rest) = tzset_num(rest, 1, 365)?;
+    (Rule::Julian(day), rest)
+  } else if let Some(rest) = s.strip_prefix('M') {
+    let (month, rest) = tzset_num(rest, 1, 12)?;
+    let (week, rest) = tzset_num(rest.strip_prefix('.')?, 1, 5)?;
+    let (day, rest) = tzset_num(rest.strip_prefix('.')?, 0, 6)?;
+    (Rule::MonthWeekDay { month, week, day }, rest)
+  } else {
+    let (day, rest) = tzset_num(s, 0, 365)?;
+    (Rule::DayOfYear(day), rest)
+  };
+  match s.strip_prefix('/') {
+    Some(rest) => tzset_offset(rest).map(|(time, rest)| (TimedRule { rule, time }, rest)),
+    None => Some((TimedRule { rule, time: 2 * 3600 }, s)),
+  }
+}
+
+fn tzset_num(s: &str, min: i64, max: i64) -> Option<(i64, &str)> {
+  let end = s.find(|c: char| !c.is_ascii_digit()).unwrap_or(s.len());
+  if end == 0 {
+    return None;
+  }
+  let mut n = 0;
+  for digit in s[..end].bytes() {
+    n = n * 10 + (digit - b'0') as i64;
+    if n > max {
+      return None;
+    }
+  }
+  if n < min {
+    return None;
+  }
+  Some((n, &s[end..]))
+}
+
+// A rule with the time of day it takes effect
+#[derive(Clone, Copy)]
+struct TimedRule {
+  rule: Rule,
+  time: i64,
+}
+
+// Seconds from the start of the year, in UTC, at which the rule takes effect
+fn rule_time(year: i64, rule: TimedRule, offset: i64) -> i64 {
+  let day = match rule.rule {
+    Rule::Julian(day) => day - 1 + if is_leap(year) && day >= 60 { 1 } else { 0 },
+    Rule::DayOfYear(day) => day,
+    Rule::MonthWeekDay { month, week, day } => {
+      let first = days_from_civil(year, month, 1);
+      // The first such weekday of the month, then a week on at a time
+      let mut d = (day - weekday(first)).rem_euclid(7);
+      for _ in 1..week {
+        if d + 7 >= days_in_month(year, month) {
+          break;
+        }
+        d += 7;
+      }
+      first - days_from_civil(year, 1, 1) + d
+    }
+  };
+  day * SECONDS_PER_DAY + rule.time - offset
+}
+
+///////////// Calendar ///////////////
+
+pub fn is_leap(year: i64) -> bool {
+  year % 4 == 0 && (year % 100 != 0 || year % 400 == 0)
+}
+
+fn days_in_month(year: i64, month: i64) -> i64 {
+  match month {
+    2 if is_leap(year) => 29,
+    2 => 28,
+    4 | 6 | 9 | 11 => 30,
+    _ => 31,
+  }
+}
+
+// Days since 1970-01-01 of a date in the proleptic Gregorian calendar
+fn days_from_civil(year: i64, month: i64, day: i64) -> i64 {
+  let year = if month <= 2 { year - 1 } else { year };
+  let era = year.div_euclid(400);
+  let year_of_era = year - era * 400;
+  let day_of_year = (153 * (month + if month > 2 { -3 } else { 9 }) + 2) / 5 + day - 1;
+  let day_of_era = year_of_era * 365 + year_of_era / 4 - year_of_era / 100 + day_of_year;
+  era * 146097 + day_of_era - 719468
+}
+
+fn civil_from_days(days: i64) -> (i64, i64, i64) {
+  let days = days + 719468;
+  let era = days.div_euclid(146097);
+  let day_of_era = days - era * 146097;
+  let year_of_era = (day_of_era - day_of_era / 1460 + day_of_era / 36524 - day_of_era / 146096) / 365;
+  let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+  let shifted_month = (5 * day_of_year + 2) / 153;
+  let day = day_of_year - (153 * shifted_month + 2) / 5 + 1;
+  let month = if shifted_month < 10 { shifted_month + 3 } else { shifted_month - 9 };
+  (year_of_era + era * 400 + if month <= 2 { 1 } else { 0 }, month, day)
+}
+
+// 0 for Sunday
+fn weekday(days: i64) -> i64 {
+  (days + 4).rem_euclid(7)
+}
+
+///////////// Times ///////////////
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct DateTime {
+  pub unix: i64,
+  // Always in 0..1e9
+  pub nanosecond: i64,
+  pub zone: Rc<Zone>,
+}
+
+// A time as it reads on a clock in its zone
+pub struct Civil {
+  pub year: i64,
+  pub month: i64,
+  pub day: i64,
+  pub hour: i64,
+  pub minute: i64,
+  pub second: i64,
+  pub weekday: i64,
+  // From 1
+  pub year_day: i64,
+  pub abbreviation: String,
+  pub offset: i64,
+}
+
+impl DateTime {
+  pub fn from_unix(unix: i64, nanosecond: i64, zone: Rc<Zone>) -> DateTime {
+    DateTime { unix: unix + nanosecond.div_euclid(1_000_000_000), nanosecond: nanosecond.rem_euclid(1_000_000_000), zone }
+  }
+
+  // The time a clock in the zone shows the date and time at, normalizing
+  // out-of-range fields, so that the 32nd of January is the 1st of February.
+  // Wall times that happen twice or not at all when clocks change get the
+  // offset in force before the change.
+  pub fn from_civil(year: i64, month: i64, day: i64, hour: i64, minute: i64, second: i64, nanosecond: i64, zone: Rc<Zone>) -> Result<DateTime, String> {
+    let out_of_range = || "Time out of range.".to_string();
+    let month = month.checked_sub(1).ok_or_else(out_of_range)?;
+    let year = year.checked_add(month.div_euclid(12)).filter(|year| year.abs() < 1 << 40).ok_or_else(out_of_range)?;
+    let month = month.rem_euclid(12) + 1;
+    let wall = (days_from_civil(year, month, 1) as i128 + day as i128 - 1) * SECONDS_PER_DAY as i128
+      + hour as i128 * 3600
+      + minute as i128 * 60
+      + second as i128
+      + nanosecond.div_euclid(1_000_000_000) as i128;
+    let mut unix = i64::try_from(wall).ok().filter(|unix| unix.abs() < 1 << 62).ok_or_else(out_of_range)?;
+    let period = zone.lookup(unix);
+    if period.offset != 0 {
+      let mut offset = period.offset;
+      let utc = unix - offset;
+      if utc < period.start || utc >= period.end {
+        offset = zone.lookup(utc).offset;
+      }
+      unix -= offset;
+    }
+    Ok(DateTime::from_unix(unix, nanosecond.rem_euclid(1_000_000_000), zone))
+  }
+
+  pub fn civil(&self) -> Civil {
+    let period = self.zone.lookup(self.unix);
+    let local = self.unix + period.offset;
+    let days = local.div_euclid(SECONDS_PER_DAY);
+    let seconds = local.rem_euclid(SECONDS_PER_DAY);
+    let (year, month, day) = civil_from_days(days);
+    Civil {
+      year,
+      month,
+      day,
+      hour: seconds / 3600,
+      minute: seconds % 3600 / 60,
+      second: seconds % 60,
+      weekday: weekday(days),
+      year_day: days - days_from_civil(year, 1, 1) + 1,
+      abbreviation: period.abbreviation,
+      offset: period.offset,
+    }
+  }
+
+  pub fn in_zone(&self, zone: Rc<Zone>) -> DateTime {
+    DateTime { zone, ..self.clone() }
+  }
+
+  // Fractions of a second are kept to the nanosecond, rounding down
+  pub fn add_seconds(&self, seconds: f64) -> Result<DateTime, String> {
+    let whole = seconds.floor();
+    if !whole.is_finite() || whole.abs() >= (1u64 << 62) as f64 {
+      return Err("Time out of range.".to_string());
+    }
+    let unix = self.unix.checked_add(whole as i64).filter(|unix| unix.abs() < 1 << 62).ok_or("Time out of range.")?;
+    Ok(DateTime::from_unix(unix, self.nanosecond + ((seconds - whole) * 1e9) as i64, self.zone.clone()))
+  }
+
+  // Moves the date on by calendar months and days, keeping the time of day
+  // in the zone. Like from_civil, an overflowing day carries into the next
+  // month, so a month after the 31st of January is the 2nd or 3rd of March.
+  pub fn add_date(&self, months: i64, days: i64) -> Result<DateTime, String> {
+    let civil = self.civil();
+    let month = civil.month.checked_add(months).ok_or("Time out of range.")?;
+    let day = civil.day.checked_add(days).filter(|day| day.abs() < 1 << 40).ok_or("Time out of range.")?;
+    DateTime::from_civil(civil.year, month, day, civil.hour, civil.minute, civil.second, self.nanosecond, self.zone.clone())
+  }
+
+  // Seconds from the other time to this one
+  pub fn since(&self, other: &DateTime) -> f64 {
+    (self.unix - other.unix) as f64 + (self.nanosecond - other.nanosecond) as f64 / 1e9
+  }
+}
+
+///////////// Layouts ///////////////
+
+#[derive(Clone, Copy, PartialEq)]
+enum OffsetStyle {
+  // -07
+  Hours,
+  // -0700
+  Minutes,
+  // -07:00
+  ColonMinutes,
+  // -070000
+  Seconds,
+  // -07:00:00
+  ColonSeconds,
+}
+
+#[derive(Clone, Copy, PartialEq)]
+enum Std {
+  LongMonth,
+  Month,
+  NumMonth,
+  ZeroMonth,
+  LongWeekDay,
+  WeekDay,
+  Day,
+  UnderDay,
+  ZeroDay,
+  UnderYearDay,
+  ZeroYearDay,
+  Hour,
+  Hour12,
+  ZeroHour12,
+  Minute,
+  ZeroMinute,
+  Second,
+  ZeroSecond,
+  LongYear,
+  Year,
+  // Upper case or not
+  PM(bool),
+  TZ,
+  // With Z standing for UTC or not
+  Offset(OffsetStyle, bool),
+  // The separator, how many digits and whether trailing zeros are trimmed
+  Fraction(u8, usize, bool),
+}
+
+// Splits the layout around its first piece, returning the text before it,
+// the piece and what follows
+fn next_std(layout: &[u8]) -> (&[u8], Option<Std>, &[u8]) {
+  let at = |i: usize, text: &str| layout[i..].starts_with(text.as_bytes());
+  let lower_at = |i: usize| layout.get(i).is_some_and(|c| c.is_ascii_lowercase());
+  for i in 0..layout.len() {
+    let found = |std: Std, len: usize| (&layout[..i], Some(std), &layout[i + len..]);
+    match layout[i] {
+      b'J' if at(i, "January") => return found(Std::LongMonth, 7),
+      b'J' if at(i, "Jan") && !lower_at(i + 3) => return found(Std::Month, 3),
+      b'M' if at(i, "Monday") => return found(Std::LongWeekDay, 6),
+      b'M' if at(i, "Mon") && !lower_at(i + 3) => return found(Std::WeekDay, 3),
+      b'M' if at(i, "MST") => return found(Std::TZ, 3),
+      b'0' if layout.get(i + 1).is_some_and(|c| (b'1'..=b'6').contains(c)) => {
+        let std = [Std::ZeroMonth, Std::ZeroDay, Std::ZeroHour12, Std::ZeroMinute, Std::ZeroSecond, Std::Year][(layout[i + 1] - b'1') as usize];
+        return found(std, 2);
+      }
+      b'0' if at(i, "002") => return found(Std::ZeroYearDay, 3),
+      b'1' if at(i, "15") => return found(Std::Hour, 2),
+      b'1' => return found(Std::NumMonth, 1),
+      b'2' if at(i, "2006") => return found(Std::LongYear, 4),
+      b'2' => return found(Std::Day, 1),
+      // _2006 is an underscore followed by the year
+      b'_' if at(i, "_2006") => return (&layout[..i + 1], Some(Std::LongYear), &layout[i + 5..]),
+      b'_' if at(i, "_2") => return found(Std::UnderDay, 2),
+      b'_' if at(i, "__2") => return found(Std::UnderYearDay, 3),
+      b'3' => return found(Std::Hour12, 1),
+      b'4' => return found(Std::Minute, 1),
+      b'5' => return found(Std::Second, 1),
+      b'P' if at(i, "PM") => return found(Std::PM(true), 2),
+      b'p' if at(i, "pm") => return found(Std::PM(false), 2),
+      sign @ (b'-' | b'Z') => {
+        let z = sign == b'Z';
+        let styles = [
+          ("070000", OffsetStyle::Seconds),
+          ("07:00:00", OffsetStyle::ColonSeconds),
+          ("0700", OffsetStyle::Minutes),
+          ("07:00", OffsetStyle::ColonMinutes),
+          ("07", OffsetStyle::Hours),
+        ];
+        if let Some((text, style)) = styles.iter().find(|(text, _)| at(i + 1, text)) {
+          return found(Std::Offset(*style, z), text.len() + 1);
+        }
+      }
+      separator @ (b'.' | b',') if matches!(layout.get(i + 1), Some(b'0' | b'9')) => {
+        let digit = layout[i + 1];
+        let end = (i + 1..layout.len()).find(|j| layout[*j] != digit).unwrap_or(layout.len());
+        // Only a run of the same digit that isn't followed by another
+        if !layout.get(end).is_some_and(|c| c.is_ascii_digit()) {
+          return found(Std::Fraction(separator, end - i - 1, digit == b'9'), end - i);
+        }
+      }
+      _ => (),
+    }
+  }
+  (layout, None, &[])
+}
+
+fn append_int(out: &mut String, n: i64, width: usize) {
+  if n < 0 {
+    out.push('-');
+  }
+  out.push_str(&format!("{:0width$}", n.unsigned_abs(), width = width));
+}
+
+impl DateTime {
+  pub fn format(&self, layout: &str) -> String {
+    let civil = self.civil();
+    let mut out = String::new();
+    let mut layout = layout.as_bytes();
+    loop {
+      let (prefix, std, suffix) = next_std(layout);
+      out.push_str(&String::from_utf8_lossy(prefix));
+      let Some(std) = std else { break };
+      layout = suffix;
+      match std {
+        Std::Year => append_int(&mut out, civil.year.abs() % 100, 2),
+        Std::LongYear => append_int(&mut out, civil.year, 4),
+        Std::Month => out.push_str(&LONG_MONTHS[civil.month as usize - 1][..3]),
+        Std::LongMonth => out.push_str(LONG_MONTHS[civil.month as usize - 1]),
+        Std::NumMonth => append_int(&mut out, civil.month, 0),
+        Std::ZeroMonth => append_int(&mut out, civil.month, 2),
+        Std::WeekDay => out.push_str(&LONG_DAYS[civil.weekday as usize][..3]),
+        Std::LongWeekDay => out.push_str(LONG_DAYS[civil.weekday as usize]),
+        Std::Day => append_int(&mut out, civil.day, 0),
+        Std::UnderDay => out.push_str(&format!("{:>2}", civil.day)),
+        Std::ZeroDay => append_int(&mut out, civil.day, 2),
+        Std::UnderYearDay => out.push_str(&format!("{:>3}", civil.year_day)),
+        Std::ZeroYearDay => append_int(&mut out, civil.year_day, 3),
+        Std::Hour => append_int(&mut out, civil.hour, 2),
+        Std::Hour12 => append_int(&mut out, (civil.hour + 11) % 12 + 1, 0),
+        Std::ZeroHour12 => append_int(&mut out, (civil.hour + 11) % 12 + 1, 2),
+        Std::Minute => append_int(&mut out, civil.minute, 0),
+        Std::ZeroMinute => append_int(&mut out, civil.minute, 2),
+        Std::Second => append_int(&mut out, civil.second, 0),
+        Std::ZeroSecond => append_int(&mut out, civil.second, 2),
+        Std::PM(upper) => {
+          let text = if civil.hour >= 12 { "PM" } else { "AM" };
+          out.push_str(&if upper { text.to_string() } else { text.to_lowercase() });
+        }
+        Std::Offset(_, true) if civil.offset == 0 => out.push('Z'),
+        Std::Offset(style, _) => {
+          // The sign goes by whole minutes, as in Go
+          let minutes = civil.offset / 60;
+          out.push(if minutes < 0 { '-' } else { '+' });
+          append_int(&mut out, minutes.abs() / 60, 2);
+          if matches!(style, OffsetStyle::ColonMinutes | OffsetStyle::ColonSeconds) {
+            out.push(':');
+          }
+          if style != OffsetStyle::Hours {
+            append_int(&mut out, minutes.abs() % 60, 2);
+          }
+          if matches!(style, OffsetStyle::Seconds | OffsetStyle::ColonSeconds) {
+            if style == OffsetStyle::ColonSeconds {
+              out.push(':');
+            }
+            append_int(&mut out, civil.offset.abs() % 60, 2);
+          }
+        }
+        Std::TZ if !civil.abbreviation.is_empty() => out.push_str(&civil.abbreviation),
+        // A zone without an abbreviation is written as its offset
+        Std::TZ => {
+          let minutes = civil.offset / 60;
+          out.push(if minutes < 0 { '-' } else { '+' });
+          append_int(&mut out, minutes.abs() / 60, 2);
+          append_int(&mut out, minutes.abs() % 60, 2);
+        }
+        Std::Fraction(separator, digits, trim) => {
+          if trim && (digits == 0 || self.nanosecond == 0) {
+            continue;
+          }
+          let mut fraction = format!("{:09}", self.nanosecond);
+          fraction.truncate(digits.min(9));
+          if trim {
+            fraction.truncate(fraction.trim_end_matches('0').len());
+            if fraction.is_empty() {
+              continue;
+            }
+          }
+          out.push(separator as char);
+          out.push_str(&fraction);
+        }
+      }
+    }
+    out
+  }
+
+  // Reads a time written in the layout. Without a zone in it the time is
+  // taken to be in `default`; an offset or abbreviation that `local` has in
+  // force at that time gets that zone, and any other a fixed zone.
+  pub fn parse(layout: &str, value: &str, default: Rc<Zone>, local: Rc<Zone>) -> Result<DateTime, String> {
+    parse(layout.as_bytes(), value.as_bytes(), default, local).ok_or_else(|| format!("Can't parse \"{}\" as \"{}\".", value, layout))
+  }
+}
+
+fn parse(mut layout: &[u8], mut value: &[u8], default: Rc<Zone>, local: Rc<Zone>) -> Option<DateTime> {
+  let (mut year, mut month, mut day, mut year_day) = (0, -1, -1, -1);
+  let (mut hour, mut minute, mut second, mut nanosecond) = (0, 0, 0, 0);
+  let (mut pm, mut am) = (false, false);
+  let mut utc = false;
+  let mut zone_offset: Option<i64> = None;
+  let mut zone_name = String::new();
+  loop {
+    let (prefix, std, suffix) = next_std(layout);
+    value = skip(value, prefix)?;
+    let Some(std) = std else {
+      if !value.is_empty() {
+        return None;
+      }
+      break;
+    };
+    layout = suffix;
+    match std {
+      Std::Year => {
+        year = atoi(value.get(..2)?)?;
+        year += if year >= 69 { 1900 } else { 2000 };
+        value = &value[2..];
+      }
+      Std::LongYear => {
+        if !value.first()?.is_ascii_digit() {
+          return None;
+        }
+        year = atoi(value.get(..4)?)?;
+        value = &value[4..];
+      }
+      Std::Month | Std::LongMonth => {
+        let long = std == Std::LongMonth;
+        let (i, rest) = lookup(value, LONG_MONTHS.iter().map(|name| if long { name } else { &name[..3] }))?;
+        month = i as i64 + 1;
+        value = rest;
+      }
+      Std::NumMonth | Std::ZeroMonth => {
+        (month, value) = getnum(value, std == Std::ZeroMonth)?;
+        if !(1..=12).contains(&month) {
+          return None;
+        }
+      }
+      Std::WeekDay | Std::LongWeekDay => {
+        let long = std == Std::LongWeekDay;
+        value = lookup(value, LONG_DAYS.iter().map(|name| if long { name } else { &name[..3] }))?.1;
+      }
+      Std::Day | Std::UnderDay | Std::ZeroDay => {
+        if std == Std::UnderDay && value.first() == Some(&b' ') {
+          value = &value[1..];
+        }
+        (day, value) = getnum(value, std == Std::ZeroDay)?;
+      }
+      Std::UnderYearDay | Std::ZeroYearDay => {
+        for _ in 0..2 {
+          if std == Std::UnderYearDay && value.first() == Some(&b' ') {
+            value = &value[1..];
+          }
+        }
+        let digits = value.iter().take(3).take_while(|c| c.is_ascii_digit()).count();
+        if digits == 0 || (std == Std::ZeroYearDay && digits != 3) {
+          return None;
+        }
+        year_day = atoi(&value[..digits])?;
+        value = &value[digits..];
+        if !(1..=366).contains(&year_day) {
+          return None;
+        }
+      }
+      Std::Hour => {
+        (hour, value) = getnum(value, false)?;
+        if hour >= 24 {
+          return None;
+        }
+      }
+      Std::Hour12 | Std::ZeroHour12 => {
+        (hour, value) = getnum(value, std == Std::ZeroHour12)?;
+        if hour > 12 {
+          return None;
+        }
+      }
+      Std::Minute | Std::ZeroMinute => {
+        (minute, value) = getnum(value, std == Std::ZeroMinute)?;
+        if minute >= 60 {
+          return None;
+        }
+      }
+      Std::Second | Std::ZeroSecond => {
+        (second, value) = getnum(value, std == Std::ZeroSecond)?;
+        if second >= 60 {
+          return None;
+        }
+        // A fraction the layout doesn't have a place for is read anyway
+        if value.len() >= 2 && matches!(value[0], b'.' | b',') && value[1].is_ascii_digit() && !matches!(next_std(layout).1, Some(Std::Fraction(..))) {
+          let end = (2..value.len()).find(|i| !value[*i].is_ascii_digit()).unwrap_or(value.len());
+          nanosecond = parse_nanoseconds(value, end)?;
+          value = &value[end..];
+        }
+      }
+      Std::PM(upper) => {
+        let text = value.get(..2)?;
+        let (pm_text, am_text) = if upper { (b"PM", b"AM") } else { (b"pm", b"am") };
+        if text == pm_text {
+          pm = true;
+        } else if text == am_text {
+          am = true;
+        } else {
+          return None;
+        }
+        value = &value[2..];
+      }
+      Std::Offset(_, true) if value.first() == Some(&b'Z') => {
+        value = &value[1..];
+        utc = true;
+      }
+      Std::Offset(style, _) => {
+        let colon = |i: usize| value.get(i) == Some(&b':');
+        let (hours, minutes, seconds, len): (&[u8], &[u8], &[u8], usize) = match style {
+          OffsetStyle::ColonMinutes if value.len() >= 6 && colon(3) => (&value[1..3], &value[4..6], b"00", 6),
+          OffsetStyle::Hours if value.len() >= 3 => (&value[1..3], b"00", b"00", 3),
+          OffsetStyle::ColonSeconds if value.len() >= 9 && colon(3) && colon(6) => (&value[1..3], &value[4..6], &value[7..9], 9),
+          OffsetStyle::Seconds if value.len() >= 7 => (&value[1..3], &value[3..5], &value[5..7], 7),
+          OffsetStyle::Minutes if value.len() >= 5 => (&value[1..3], &value[3..5], b"00", 5),
+          _ => return None,
+        };
+        let (hours, minutes, seconds) = (getnum(hours, true)?.0, getnum(minutes, true)?.0, getnum(seconds, true)?.0);
+        // Offsets of 24 hours or 60 minutes do get written
+        if hours > 24 || minutes > 60 || seconds > 60 {
+          return None;
+        }
+        let offset = (hours * 60 + minutes) * 60 + seconds;
+        zone_offset = Some(match value[0] {
+          b'+' => offset,
+          b'-' => -offset,
+          _ => return None,
+        });
+        value = &value[len..];
+      }
+      Std::TZ => {
+        if value.starts_with(b"UTC") {
+          utc = true;
+          value = &value[3..];
+          continue;
+        }
+        let len = zone_name_length(value)?;
+        zone_name = String::from_utf8_lossy(&value[..len]).into_owned();
+        value = &value[len..];
+      }
+      Std::Fraction(_, digits, false) => {
+        if value.len() < digits + 1 {
+          return None;
+        }
+        nanosecond = parse_nanoseconds(value, digits + 1)?;
+        value = &value[digits + 1..];
+      }
+      Std::Fraction(_, _, true) => {
+        // Trimmed fractions can be left out altogether
+        if value.len() < 2 || !matches!(value[0], b'.' | b',') || !value[1].is_ascii_digit() {
+          continue;
+        }
+        let end = (1..value.len()).find(|i| !value[*i].is_ascii_digit()).unwrap_or(value.len());
+        nanosecond = parse_nanoseconds(value, end)?;
+        value = &value[end..];
+      }
+    }
+  }
+  if pm && hour < 12 {
+    hour += 12;
+  } else if am && hour == 12 {
+    hour = 0;
+  }
+
+  if year_day >= 0 {
+    let days = days_from_civil(year, 1, 1) + year_day - 1;
+    let (in_year, m, d) = civil_from_days(days);
+    if in_year != year || (month >= 0 && month != m) || (day >= 0 && day != d) {
+      return None;
+    }
+    (month, day) = (m, d);
+  } else {
+    if month < 0 {
+      month = 1;
+    }
+    if day < 0 {
+      day = 1;
+    }
+  }
+  if day < 1 || day > days_in_month(year, month) {
+    return None;
+  }
+
+  let civil = |zone: Rc<Zone>| DateTime::from_civil(year, month, day, hour, minute, second, nanosecond, zone).ok();
+  if utc {
+    return civil(Rc::new(Zone::utc()));
+  }
+  if let Some(offset) = zone_offset {
+    let mut time = civil(Rc::new(Zone::utc()))?;
+    time.unix -= offset;
+    let period = local.lookup(time.unix);
+    if period.offset == offset && (zone_name.is_empty() || period.abbreviation == zone_name) {
+      return Some(time.in_zone(local));
+    }
+    return Some(time.in_zone(Rc::new(Zone::fixed(&zone_name, offset))));
+  }
+  if !zone_name.is_empty() {
+    let mut time = civil(Rc::new(Zone::utc()))?;
+    if let Some(offset) = local.lookup_name(&zone_name, time.unix) {
+      time.unix -= offset;
+      return Some(time.in_zone(local));
+    }
+    // An abbreviation the local zone doesn't know stands for no offset,
+    // except that GMT+n is n hours ahead
+    let offset = match zone_name.strip_prefix("GMT") {
+      Some(hours) if !hours.is_empty() => atoi(hours.as_bytes())? * 3600,
+      _ => 0,
+    };
+    return Some(time.in_zone(Rc::new(Zone::fixed(&zone_name, offset))));
+  }
+  civil(default)
+}
+
+// Matches the literal text before a piece, where a run of spaces in the
+// layout matches any run of spaces
+fn skip<'a>(mut value: &'a [u8], mut prefix: &[u8]) -> Option<&'a [u8]> {
+  while let Some(&c) = prefix.first() {
+    if c == b' ' {
+      if value.first().is_some_and(|c| *c != b' ') {
+        return None;
+      }
+      prefix = trim_spaces(prefix);
+      value = trim_spaces(value);
+      continue;
+    }
+    if value.first() != Some(&c) {
+      return None;
+    }
+    prefix = &prefix[1..];
+    value = &value[1..];
+  }
+  Some(value)
+}
+
+fn trim_spaces(text: &[u8]) -> &[u8] {
+  let start = text.iter().position(|c| *c != b' ').unwrap_or(text.len());
+  &text[start..]
+}
+
+// One or two digits, or exactly two when fixed
+fn getnum(value: &[u8], fixed: bool) -> Option<(i64, &[u8])> {
+  let digit = |i: usize| value.get(i).filter(|c| c.is_ascii_digit()).map(|c| (c - b'0') as i64);
+  let first = digit(0)?;
+  match digit(1) {
+    Some(second) => Some((first * 10 + second, &value[2..])),
+    None if fixed => None,
+    None => Some((first, &value[1..])),
+  }
+}
+
+// A whole number, maybe signed, as in Go's time package
+fn atoi(text: &[u8]) -> Option<i64> {
+  let (negative, digits) = match text.first() {
+    Some(b'-') => (true, &text[1..]),
+    Some(b'+') => (false, &text[1..]),
+    _ => (false, text),
+  };
+  let mut n: i64 = 0;
+  for c in digits {
+    if !c.is_ascii_digit() {
+      return None;
+    }
+    n = n.checked_mul(10)?.checked_add((c - b'0') as i64)?;
+  }
+  Some(if negative { -n } else { n })
+}
+
+// The separator and digits in value[..len], scaled to nanoseconds
+fn parse_nanoseconds(value: &[u8], len: usize) -> Option<i64> {
+  if !matches!(value.first(), Some(b'.' | b',')) {
+    return None;
+  }
+  let len = len.min(10);
+  let n = atoi(&value[1..len])?;
+  if n < 0 {
+    return None;
+  }
+  Some(n * 10i64.pow((10 - len) as u32))
+}
+
+// Month and weekday names match whatever their case
+fn lookup<'a, 'b>(value: &'a [u8], names: impl Iterator<Item = &'b str>) -> Option<(usize, &'a [u8])> {
+  for (i, name) in names.enumerate() {
+    if value.len() >= name.len() && value[..name.len()].eq_ignore_ascii_case(name.as_bytes()) {
+      return Some((i, &value[name.len()..]));
+    }
+  }
+  None
+}
+
+// How much of the value is a zone abbreviation: three to five capitals
+// ending in T (or WITA), ChST or MeST, GMT with an optional hour offset,
+// or a bare signed hour offset
+fn zone_name_length(value: &[u8]) -> Option<usize> {
+  if value.len() < 3 {
+    return None;
+  }
+  if value.starts_with(b"ChST") || value.starts_with(b"MeST") {
+    return Some(4);
+  }
+  if value.starts_with(b"GMT") {
+    return Some(3 + signed_offset_length(&value[3..]));
+  }
+  if matches!(value[0], b'+' | b'-') {
+    return Some(signed_offset_length(value)).filter(|len| *len > 0);
+  }
+  let capitals = value.iter().take(6).take_while(|c| c.is_ascii_uppercase()).count();
+  match capitals {
+    5 if value[4] == b'T' => Some(5),
+    4 if value[3] == b'T' || value.starts_with(b"WITA") => Some(4),
+    3 => Some(3),
+    _ => None,
+  }
+}
+
+fn signed_offset_length(value: &[u8]) -> usize {
+  if !matches!(value.first(), Some(b'+' | b'-')) {
+    return 0;
+  }
+  let digits = value[1..].iter().take_while(|c| c.is_ascii_digit()).count();
+  match atoi(&value[1..1 + digits]) {
+    Some(hours) if digits > 0 && hours <= 23 => 1 + digits,
+    _ => 0,
+  }
+}
@@ -0,0 +1,366 @@
+/*
+Dialects: which of this interpreter's extensions to the book's Lox are on.
+
+`--dialect <spec>` sets the dialect for a run, and a `// lox-dialect: <spec>`
+line among the comments at the top of a script adjusts it for that script. A
+spec is a comma-separated list read left to right: `book` turns every
+extension off, `extended` turns them all on (the default), a feature name
+turns that one on, and a feature name after '-' turns it off. So
+`book,lists` is the book's language plus lists, and `-match` is everything
+but match expressions.
+
+With an extension off, its keywords are plain identifiers again and its
+syntax is a parse error, so programs written for the book, and its test
+suite, run as written.
+
+A spec can also choose what integer arithmetic does when its result doesn't
+fit in 64 bits: `overflow=float` carries on in floating point (the default),
+`overflow=wrap` wraps around as two's complement, and `overflow=error` is a
+runtime error. Two more settings change what values mean:
+`truthiness=empty` makes 0, "" and empty lists, sets, maps and bytes false
+in conditions as well as nil and false (`truthiness=book`, the default, is
+just nil and false), and `equality=identity` makes `==` compare lists, sets,
+maps and bytes by identity instead of by what they hold (`equality=deep`,
+the default). `book` and `extended` leave the settings as they were.
+*/
+
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Feature {
+  Lists,
+  Destructuring,
+  Interpolation,
+  RawStrings,
+  Match,
+  Traits,
+  Generators,
+  Const,
+  DoWhile,
+  ForIn,
+  Break,
+  LoopElse,
+  Defaults,
+  Spread,
+  NamedArguments,
+  OptionalChaining,
+  Coalesce,
+  Is,
+  Types,
+  MultipleReturns,
+  Sets,
+  Pipeline,
+  Exceptions,
+  Using,
+  PrintList,
+  ChainedComparisons,
+  OptionalSemicolons,
+  TrailingCommas,
+  Discard,
+  Maps,
+}
+
+const FEATURES: &[(Feature, &str)] = &[
+  (Feature::Lists, "lists"),
+  (Feature::Destructuring, "destructuring"),
+  (Feature::Interpolation, "interpolation"),
+  (Feature::RawStrings, "raw-strings"),
+  (Feature::Match, "match"),
+  (Feature::Traits, "traits"),
+  (Feature::Generators, "generators"),
+  (Feature::Const, "const"),
+  (Feature::DoWhile, "do-while"),
+  (Feature::ForIn, "for-in"),
+  (Feature::Break, "break"),
+  (Feature::LoopElse, "loop-else"),
+  (Feature::Defaults, "defaults"),
+  (Feature::Spread, "spread"),
+  (Feature::NamedArguments, "named-arguments"),
+  (Feature::OptionalChaining, "optional-chaining"),
+  (Feature::Coalesce, "coalesce"),
+  (Feature::Is, "is"),
+  (Feature::Types, "types"),
+  (Feature::MultipleReturns, "multiple-returns"),
+  (Feature::Sets, "sets"),
+  (Feature::Pipeline, "pipeline"),
+  (Feature::Exceptions, "exceptions"),
+  (Feature::Using, "using"),
+  (Feature::PrintList, "print-list"),
+  (Feature::ChainedComparisons, "chained-comparisons"),
+  (Feature::OptionalSemicolons, "optional-semicolons"),
+  (Feature::TrailingCommas, "trailing-commas"),
+  (Feature::Discard, "discard"),
+  (Feature::Maps, "maps"),
+];
+
+// What integer arithmetic does when the result doesn't fit in an i64
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Overflow {
+  Float,
+  Wrap,
+  Error,
+}
+
+const OVERFLOWS: &[(Overflow, &str)] = &[(Overflow::Float, "float"), (Overflow::Wrap, "wrap"), (Overflow::Error, "error")];
+
+// What counts as false in a condition
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Truthiness {
+  Book,
+  Empty,
+}
+
+const TRUTHINESSES: &[(Truthiness, &str)] = &[(Truthiness::Book, "book"), (Truthiness::Empty, "empty")];
+
+// How `==` compares lists, sets, maps and bytes
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Equality {
+  Deep,
+  Identity,
+}
+
+const EQUALITIES: &[(Equality, &str)] = &[(Equality::Deep, "deep"), (Equality::Identity, "identity")];
+
+// The settings sit in the top four bits, above the features' bits: overflow
+// in two, then truthiness and equality in one each. Zero is each default.
+const OVERFLOW_SHIFT: u32 = 62;
+const OVERFLOW_MASK: u64 = 0b11 << OVERFLOW_SHIFT;
+const TRUTHINESS_SHIFT: u32 = 61;
+const EQUALITY_SHIFT: u32 = 60;
+const SETTINGS_MASK: u64 = 0b1111 << EQUALITY_SHIFT;
+
+// Each setting's name, where it sits and its modes' names, in the order
+// they're numbered in its bits
+const SETTINGS: &[(&str, u32, u64, fn() -> Vec<&'static str>)] = &[
+  ("overflow", OVERFLOW_SHIFT, 0b11, || OVERFLOWS.iter().map(|(_, name)| *name).collect()),
+  ("truthiness", TRUTHINESS_SHIFT, 0b1, || TRUTHINESSES.iter().map(|(_, name)| *name).collect()),
+  ("equality", EQUALITY_SHIFT, 0b1, || EQUALITIES.iter().map(|(_, name)| *name).collect()),
+];
+
+// The keywords extensions add, which are identifiers while they're off
+const KEYWORDS: &[(&str, Feature)] = &[
+  ("break", Feature::Break),
+  ("catch", Feature::Exceptions),
+  ("const", Feature::Const),
+  ("do", Feature::DoWhile),
+  ("finally", Feature::Exceptions),
+  ("in", Feature::ForIn),
+  ("is", Feature::Is),
+  ("match", Feature::Match),
+  ("throw", Feature::Exceptions),
+  ("trait", Feature::Traits),
+  ("implements", Feature::Traits),
+  ("try", Feature::Exceptions),
+  ("using", Feature::Using),
+  ("yield", Feature::Generators),
+];
+
+// One bit per feature, set when it's off. The base is what --dialect asked
+// for, and the current dialect adds the running script's pragma to it.
+static BASE: AtomicU64 = AtomicU64::new(0);
+static CURRENT: AtomicU64 = AtomicU64::new(0);
+// Whether --dialect was given, which wins over a project's manifest
+static CHOSEN: AtomicBool = AtomicBool::new(false);
+
+const PRAGMA: &str = "lox-dialect:";
+
+impl Feature {
+  pub fn name(self) -> &'static str {
+    FEATURES.iter().find(|(feature, _)| *feature == self).map(|(_, name)| *name).unwrap()
+  }
+
+  fn bit(self) -> u64 {
+    1 << (self as u64)
+  }
+}
+
+pub fn enabled(feature: Feature) -> bool {
+  current().enables(feature)
+}
+
+pub fn overflow() -> Overflow {
+  current().overflow()
+}
+
+pub fn truthiness() -> Truthiness {
+  current().truthiness()
+}
+
+pub fn equality() -> Equality {
+  current().equality()
+}
+
+impl Overflow {
+  pub fn name(self) -> &'static str {
+    OVERFLOWS.iter().find(|(overflow, _)| *overflow == self).map(|(_, name)| *name).unwrap()
+  }
+}
+
+impl Truthiness {
+  pub fn name(self) -> &'static str {
+    TRUTHINESSES.iter().find(|(truthiness, _)| *truthiness == self).map(|(_, name)| *name).unwrap()
+  }
+}
+
+impl Equality {
+  pub fn name(self) -> &'static str {
+    EQUALITIES.iter().find(|(equality, _)| *equality == self).map(|(_, name)| *name).unwrap()
+  }
+}
+
+pub fn keyword_feature(word: &str) -> Option<Feature> {
+  KEYWORDS.iter().find(|(keyword, _)| *keyword == word).map(|(_, feature)| *feature)
+}
+
+// A dialect as a value, for tools like `lox fix` that read a script in one
+// dialect and write it for another
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct Dialect(u64);
+
+impl Dialect {
+  pub fn parse(spec: &str) -> Result<Dialect, String> {
+    apply(spec, 0).map(Dialect)
+  }
+
+  pub fn enables(self, feature: Feature) -> bool {
+    self.0 & feature.bit() == 0
+  }
+
+  // The extensions this dialect has that `other` doesn't
+  pub fn added_since(self, other: Dialect) -> Vec<Feature> {
+    FEATURES.iter().map(|(feature, _)| *feature).filter(|feature| self.enables(*feature) && !other.enables(*feature)).collect()
+  }
+
+  pub fn features(self) -> Vec<Feature> {
+    FEATURES.iter().map(|(feature, _)| *feature).filter(|feature| self.enables(*feature)).collect()
+  }
+
+  pub fn keywords(self) -> Vec<&'static str> {
+    KEYWORDS.iter().filter(|(_, feature)| self.enables(*feature)).map(|(keyword, _)| *keyword).collect()
+  }
+  pub fn overflow(self) -> Overflow {
+    OVERFLOWS[((self.0 & OVERFLOW_MASK) >> OVERFLOW_SHIFT) as usize].0
+  }
+
+  pub fn truthiness(self) -> Truthiness {
+    TRUTHINESSES[((self.0 >> TRUTHINESS_SHIFT) & 0b1) as usize].0
+  }
+
+  pub fn equality(self) -> Equality {
+    EQUALITIES[((self.0 >> EQUALITY_SHIFT) & 0b1) as usize].0
+  }
+
+  // A spec that gives this dialect whatever it's applied on top of: book or
+  // extended, whichever needs fewer features named after it
+  pub fn spec(self) -> String {
+    let (on, off): (Vec<_>, Vec<_>) = FEATURES.iter().partition(|(feature, _)| self.enables(*feature));
+    let mut items = if off.len() > on.len() {
+      let mut items = vec!["book".to_string()];
+      items.extend(on.iter().map(|(_, name)| name.to_string()));
+      items
+    } else {
+      let mut items = vec!["extended".to_string()];
+      items.extend(off.iter().map(|(_, name)| format!("-{}", name)));
+      items
+    };
+    for (name, shift, bits, modes) in SETTINGS {
+      items.push(format!("{}={}", name, modes()[((self.0 >> shift) & bits) as usize]));
+    }
+    items.join(",")
+  }
+
+  // The pragma line that puts a script in this dialect, or None for the
+  // default, which needs none
+  pub fn pragma(self) -> Option<String> {
+    if self.0 == 0 {
+      return None;
+    }
+    Some(format!("// {} {}", PRAGMA, self.spec()))
+  }
+}
+
+pub fn current() -> Dialect {
+  Dialect(CURRENT.load(Ordering::Relaxed))
+}
+
+// Lexes and parses in the given dialect from here on
+pub fn switch(dialect: Dialect) {
+  CURRENT.store(dialect.0, Ordering::Relaxed);
+}
+
+// Applies a spec on top of the given disabled bits
+fn apply(spec: &str, mut disabled: u64) -> Result<u64, String> {
+  for item in spec.split(',').map(str::trim).filter(|item| !item.is_empty()) {
+    let (name, on) = match item.strip_prefix('-') {
+      Some(name) => (name, false),
+      None => (item.strip_prefix('+').unwrap_or(item), true),
+    };
+    if let Some((setting, mode)) = name.split_once('=') {
+      let Some((_, shift, bits, modes)) = SETTINGS.iter().find(|(name, _, _, _)| *name == setting) else {
+        let names: Vec<&str> = SETTINGS.iter().map(|(name, _, _, _)| *name).collect();
+        return Err(format!("Unknown dialect setting '{}'. Expected one of {}.", setting, names.join(", ")));
+      };
+      let modes = modes();
+      let index = modes.iter().position(|name| *name == mode).ok_or_else(|| {
+        let (last, others) = modes.split_last().unwrap();
+        format!("Unknown {} mode '{}'. Expected {} or {}.", setting, mode, others.join(", "), last)
+      })?;
+      disabled = (disabled & !(bits << shift)) | ((index as u64) << shift);
+      continue;
+    }
+    match name {
+      "book" if on => disabled = !SETTINGS_MASK | (disabled & SETTINGS_MASK),
+      "extended" if on => disabled &= SETTINGS_MASK,
+      _ => {
+        let feature = FEATURES.iter().find(|(_, feature)| *feature == name).map(|(feature, _)| *feature).ok_or_else(|| {
+          let names: Vec<&str> = FEATURES.iter().map(|(_, name)| *name).collect();
+          format!("Unknown dialect feature '{}'. Expected book, extended or one of {}.", name, names.join(", "))
+        })?;
+        if on {
+          disabled &= !feature.bit();
+        } else {
+          disabled |= feature.bit();
+        }
+      }
+    }
+  }
+  Ok(disabled)
+}
+
+// Sets the dialect from --dialect
+pub fn set(spec: &str) -> Result<(), String> {
+  let disabled = apply(spec, 0)?;
+  BASE.store(disabled, Ordering::Relaxed);
+  CURRENT.store(disabled, Ordering::Relaxed);
+  CHOSEN.store(true, Ordering::Relaxed);
+  Ok(())
+}
+
+// Sets the dialect from a project's manifest, unless --dialect set it
+pub fn set_default(spec: &str) -> Result<(), String> {
+  let disabled = apply(spec, 0)?;
+  if !CHOSEN.load(Ordering::Relaxed) {
+    BASE.store(disabled, Ordering::Relaxed);
+    CURRENT.store(disabled, Ordering::Relaxed);
+  }
+  Ok(())
+}
+
+// Sets the dialect for a script: --dialect's, adjusted by the script's
+// pragma if it has one. Returns the line of a bad pragma with what's wrong.
+pub fn for_script(source: &str) -> Result<(), (usize, String)> {
+  let mut disabled = BASE.load(Ordering::Relaxed);
+  for (i, line) in source.lines().enumerate() {
+    let line = line.trim();
+    let comment = match line.strip_prefix("//") {
+      Some(comment) => comment.trim(),
+      None if line.is_empty() => continue,
+      None => break,
+    };
+    if let Some(spec) = comment.strip_prefix(PRAGMA) {
+      disabled = apply(spec, disabled).map_err(|message| (i + 1, message))?;
+    }
+  }
+  CURRENT.store(disabled, Ordering::Relaxed);
+  Ok(())
+}
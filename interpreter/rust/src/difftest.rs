@@ -0,0 +1,602 @@
+/*
+`lox difftest`: differential testing of this interpreter against the clox
+bytecode VM.
+
+Random programs are generated from a seed, and scripts given on the command
+line are mutated (a number, operator or boolean swapped for another), and
+each program is run by both engines. Their printed output has to agree line
+for line. Numbers are compared by value, since clox prints with %g and so
+shows fewer digits.
+
+The generator sticks to the language both engines share and keeps its
+programs well typed, so they finish without runtime errors: the engines
+report errors differently, and this interpreter carries on with the next
+statement where clox stops. Variables, blocks, if, while and for loops,
+functions, closures, classes, inheritance and super calls all turn up. For
+mutated scripts, a run where both engines report an error, or where clox
+can't compile the script at all, is skipped rather than compared.
+
+Programs that diverge are saved to difftest-<seed>.lox (or
+difftest-<script>-<n>.lox for mutants) in the current directory so they can
+be run again by hand, and the exit code is 70 if there were any.
+*/
+
+use crate::interpreter::*;
+use crate::lexer::*;
+use crate::logging::*;
+use crate::parser::*;
+use crate::resolver::*;
+use std::cell::RefCell;
+use std::fs::{self, File};
+use std::panic::{self, AssertUnwindSafe};
+use std::path::Path;
+use std::process::{Command, Stdio};
+use std::rc::Rc;
+use std::thread;
+use std::time::{Duration, Instant};
+
+const TIME_LIMIT: Duration = Duration::from_secs(5);
+const MUTANTS_PER_SCRIPT: usize = 10;
+
+pub struct Options {
+  pub vm: String,
+  pub seed: u64,
+  pub count: usize,
+  pub corpus: Vec<String>,
+}
+
+#[derive(Default)]
+struct Tally {
+  matched: usize,
+  skipped: usize,
+  diverged: usize,
+}
+
+// Returns whether both engines agreed on every program, or why the VM
+// couldn't be run
+pub fn run(options: &Options) -> Result<bool, String> {
+  let mut tally = Tally::default();
+  for i in 0..options.count {
+    let seed = options.seed.wrapping_add(i as u64);
+    let program = Generator::new(seed).program();
+    check(options, &program, &format!("difftest-{}.lox", seed), false, &mut tally)?;
+  }
+  for path in &options.corpus {
+    let source = match fs::read_to_string(path) {
+      Ok(source) => source,
+      Err(err) => {
+        eprintln!("Error reading file: {}", err);
+        eprintln!("Provided path: {}", path);
+        continue;
+      }
+    };
+    let stem = Path::new(path).file_stem().map(|stem| stem.to_string_lossy().into_owned()).unwrap_or("script".to_string());
+    check(options, &source, &format!("difftest-{}-0.lox", stem), true, &mut tally)?;
+    let mut rng = Rng::new(options.seed);
+    for n in 1..=MUTANTS_PER_SCRIPT {
+      let mutant = mutate(&source, &mut rng);
+      check(options, &mutant, &format!("difftest-{}-{}.lox", stem, n), true, &mut tally)?;
+    }
+  }
+  println!(
+    "{} programs: {} matched, {} skipped, {} diverged.",
+    tally.matched + tally.skipped + tally.diverged, tally.matched, tally.skipped, tally.diverged
+  );
+  Ok(tally.diverged == 0)
+}
+
+// What one engine printed, and whether it reported an error
+struct Outcome {
+  output: Vec<String>,
+  errored: bool,
+  // clox couldn't compile the program
+  rejected: bool,
+}
+
+fn check(options: &Options, program: &str, name: &str, mutated: bool, tally: &mut Tally) -> Result<(), String> {
+  let walker = run_tree_walker(program);
+  let vm = run_vm(&options.vm, program)?;
+  let problem = if mutated && (vm.rejected || (walker.errored && vm.errored)) {
+    None
+  } else if walker.errored != vm.errored || vm.rejected {
+    let which = |errored| if errored { "reported an error" } else { "ran cleanly" };
+    Some(format!("the tree-walker {} but the VM {}", which(walker.errored), which(vm.errored || vm.rejected)))
+  } else if walker.errored {
+    None
+  } else {
+    first_difference(&walker.output, &vm.output)
+  };
+  let compared = !(walker.errored || vm.errored || vm.rejected);
+  match problem {
+    Some(problem) => {
+      tally.diverged += 1;
+      match fs::write(name, program) {
+        Ok(()) => println!("Diverged, saved to {}: {}", name, problem),
+        Err(err) => println!("Diverged, and saving to {} failed ({}): {}", name, err, problem),
+      }
+    }
+    None if compared => tally.matched += 1,
+    None => tally.skipped += 1,
+  }
+  Ok(())
+}
+
+fn first_difference(walker: &[String], vm: &[String]) -> Option<String> {
+  for (i, (a, b)) in walker.iter().zip(vm).enumerate() {
+    if !same_line(a, b) {
+      return Some(format!("line {} of output is {:?} from the tree-walker but {:?} from the VM", i + 1, a, b));
+    }
+  }
+  if walker.len() != vm.len() {
+    return Some(format!("the tree-walker printed {} lines but the VM printed {}", walker.len(), vm.len()));
+  }
+  None
+}
+
+fn same_line(a: &str, b: &str) -> bool {
+  if a == b {
+    return true;
+  }
+  match (a.parse::<f64>(), b.parse::<f64>()) {
+    (Ok(x), Ok(y)) => x == y || (x - y).abs() <= 1e-5 * x.abs().max(y.abs()),
+    _ => false,
+  }
+}
+
+///////////// Engines ///////////////
+
+fn run_tree_walker(program: &str) -> Outcome {
+  start_capture();
+  let finished = panic::catch_unwind(AssertUnwindSafe(|| {
+    let mut lexer = Lexer::new(program.to_string());
+    let tokens = lexer.scan_tokens();
+    let mut parser = Parser::new(tokens.clone());
+    let stmts = match parser.parse() {
+      Ok(stmts) => stmts,
+      Err(_) => return false,
+    };
+    let interpreter = Rc::new(RefCell::new(Interpreter::new()));
+    let mut resolver = Resolver::new(Box::new(interpreter.clone()));
+    resolver.resolve(&stmts);
+    if resolver.had_error {
+      return false;
+    }
+    interpreter.borrow_mut().limits = Some(Limits { deadline: Instant::now() + TIME_LIMIT, output_left: usize::MAX });
+    interpreter.borrow_mut().interpret(&stmts);
+    true
+  }));
+  let captured = finish_capture();
+  Outcome {
+    output: captured.output.lines().map(str::to_string).collect(),
+    errored: !matches!(finished, Ok(true)) || !captured.errors.is_empty(),
+    rejected: false,
+  }
+}
+
+// Output goes to a file rather than a pipe, so a chatty program can't block
+// on a full pipe while it is being timed
+fn run_vm(vm: &str, program: &str) -> Result<Outcome, String> {
+  let dir = std::env::temp_dir();
+  let script = dir.join(format!("lox-difftest-{}.lox", std::process::id()));
+  let output = dir.join(format!("lox-difftest-{}.out", std::process::id()));
+  fs::write(&script, program).map_err(|err| format!("Error writing file: {}", err))?;
+  let stdout = File::create(&output).map_err(|err| format!("Error writing file: {}", err))?;
+  let mut child = Command::new(vm)
+    .arg(&script)
+    .stdout(stdout)
+    .stderr(Stdio::null())
+    .spawn()
+    .map_err(|err| format!("Couldn't start the VM '{}': {}", vm, err))?;
+  let deadline = Instant::now() + TIME_LIMIT;
+  let status = loop {
+    match child.try_wait() {
+      Ok(Some(status)) => break Some(status),
+      Ok(None) if Instant::now() < deadline => thread::sleep(Duration::from_millis(5)),
+      _ => {
+        let _ = child.kill();
+        let _ = child.wait();
+        break None;
+      }
+    }
+  };
+  let printed = fs::read_to_string(&output).unwrap_or_default();
+  let _ = fs::remove_file(&script);
+  let _ = fs::remove_file(&output);
+  let code = status.and_then(|status| status.code());
+  Ok(Outcome {
+    output: printed.lines().map(str::to_string).collect(),
+    errored: code != Some(0),
+    rejected: code == Some(65),
+  })
+}
+
+///////////// Programs ///////////////
+
+// xorshift64*, so a seed always gives the same programs
+struct Rng(u64);
+
+impl Rng {
+  fn new(seed: u64) -> Self {
+    Rng(seed.wrapping_mul(0x9E3779B97F4A7C15) | 1)
+  }
+
+  fn next(&mut self) -> u64 {
+    self.0 ^= self.0 >> 12;
+    self.0 ^= self.0 << 25;
+    self.0 ^= self.0 >> 27;
+    self.0.wrapping_mul(0x2545F4914F6CDD1D)
+  }
+
+  fn below(&mut self, n: usize) -> usize {
+    (self.next() % n as u64) as usize
+  }
+
+  fn chance(&mut self, percent: usize) -> bool {
+    self.below(100) < percent
+  }
+
+  fn pick<'a, T>(&mut self, items: &'a [T]) -> &'a T {
+    &items[self.below(items.len())]
+  }
+}
+
+const WORDS: &[&str] = &["lox", "tree", "vm", "byte", "code", "walk", "a", ""];
+
+#[derive(Clone, Copy, PartialEq)]
+enum Ty {
+  Num,
+  Str,
+  Bool,
+}
+
+struct Variable {
+  name: String,
+  ty: Ty,
+  // Loop counters are read but never assigned, so loops always end
+  assignable: bool,
+}
+
+// A numeric method or function-like thing an expression can call
+struct Callee {
+  // The call up to its arguments, like `f2(` or `o1.get(`
+  call: String,
+  arity: usize,
+}
+
+struct Generator {
+  rng: Rng,
+  out: String,
+  indent: usize,
+  scopes: Vec<Vec<Variable>>,
+  callees: Vec<Callee>,
+  // Instances, by variable name
+  objects: Vec<String>,
+  classes: Vec<(String, bool)>,
+  next_name: usize,
+}
+
+impl Generator {
+  fn new(seed: u64) -> Self {
+    Self {
+      rng: Rng::new(seed),
+      out: String::new(),
+      indent: 0,
+      scopes: vec![Vec::new()],
+      callees: Vec::new(),
+      objects: Vec::new(),
+      classes: Vec::new(),
+      next_name: 0,
+    }
+  }
+
+  fn program(mut self) -> String {
+    for _ in 0..2 + self.rng.below(3) {
+      let ty = *self.rng.pick(&[Ty::Num, Ty::Str, Ty::Bool]);
+      self.var_declaration(ty);
+    }
+    for _ in 0..6 + self.rng.below(10) {
+      match self.rng.below(10) {
+        0 | 1 => self.function(),
+        2 => self.class(),
+        3 => self.counter(),
+        4 if !self.classes.is_empty() => self.instance(),
+        _ => self.statement(2),
+      }
+    }
+    self.out
+  }
+
+  fn name(&mut self, prefix: &str) -> String {
+    self.next_name += 1;
+    format!("{}{}", prefix, self.next_name)
+  }
+
+  fn line(&mut self, text: &str) {
+    self.out.push_str(&"  ".repeat(self.indent));
+    self.out.push_str(text);
+    self.out.push('\n');
+  }
+
+  fn declare(&mut self, name: &str, ty: Ty, assignable: bool) {
+    self.scopes.last_mut().unwrap().push(Variable { name: name.to_string(), ty, assignable });
+  }
+
+  fn variables(&self, ty: Ty, assignable: bool) -> Vec<String> {
+    self.scopes.iter().flatten()
+      .filter(|v| v.ty == ty && (v.assignable || !assignable))
+      .map(|v| v.name.clone())
+      .collect()
+  }
+
+  ///////////// Declarations ///////////////
+
+  fn var_declaration(&mut self, ty: Ty) {
+    let value = self.expression(ty, 2);
+    let name = self.name("v");
+    self.line(&format!("var {} = {};", name, value));
+    self.declare(&name, ty, true);
+  }
+
+  // Functions only call what was declared before them, so nothing recurses
+  fn function(&mut self) {
+    let name = self.name("f");
+    let arity = self.rng.below(3);
+    let params: Vec<String> = (0..arity).map(|_| self.name("p")).collect();
+    self.line(&format!("fun {}({}) {{", name, params.join(", ")));
+    self.indent += 1;
+    self.scopes.push(Vec::new());
+    for param in &params {
+      self.declare(param, Ty::Num, true);
+    }
+    for _ in 0..self.rng.below(3) {
+      self.statement(1);
+    }
+    let result = self.expression(Ty::Num, 3);
+    self.line(&format!("return {};", result));
+    self.scopes.pop();
+    self.indent -= 1;
+    self.line("}");
+    self.callees.push(Callee { call: format!("{}(", name), arity });
+  }
+
+  fn class(&mut self) {
+    let name = self.name("C");
+    let superclass = match self.classes.is_empty() || self.rng.chance(50) {
+      true => None,
+      false => Some(self.rng.pick(&self.classes).0.clone()),
+    };
+    let offset = self.rng.below(10);
+    match &superclass {
+      // Inherits init and bump, and wraps get
+      Some(superclass) => {
+        self.line(&format!("class {} < {} {{", name, superclass));
+        self.line(&format!("  get() {{ return super.get() * 2 + {}; }}", offset));
+      }
+      None => {
+        self.line(&format!("class {} {{", name));
+        self.line("  init(value) { this.value = value; }");
+        self.line(&format!("  get() {{ return this.value + {}; }}", offset));
+        self.line("  bump(by) { this.value = this.value + by; return this.value; }");
+      }
+    }
+    self.line("}");
+    self.classes.push((name, superclass.is_some()));
+  }
+
+  fn instance(&mut self) {
+    let class = self.rng.pick(&self.classes).0.clone();
+    let value = self.expression(Ty::Num, 1);
+    let name = self.name("o");
+    self.line(&format!("var {} = {}({});", name, class, value));
+    self.callees.push(Callee { call: format!("{}.get(", name), arity: 0 });
+    self.callees.push(Callee { call: format!("{}.bump(", name), arity: 1 });
+    self.objects.push(name);
+  }
+
+  // A closure over a local that outlives the call that made it
+  fn counter(&mut self) {
+    let maker = self.name("make");
+    let counter = self.name("k");
+    let (start, step) = (self.rng.below(10), 1 + self.rng.below(5));
+    self.line(&format!("fun {}() {{", maker));
+    self.line(&format!("  var count = {};", start));
+    self.line(&format!("  fun step() {{ count = count + {}; return count; }}", step));
+    self.line("  return step;");
+    self.line("}");
+    self.line(&format!("var {} = {}();", counter, maker));
+    self.callees.push(Callee { call: format!("{}(", counter), arity: 0 });
+  }
+
+  ///////////// Statements ///////////////
+
+  fn statement(&mut self, depth: usize) {
+    let choice = if depth == 0 { self.rng.below(4) } else { self.rng.below(9) };
+    match choice {
+      0 | 1 => {
+        let ty = *self.rng.pick(&[Ty::Num, Ty::Num, Ty::Str, Ty::Bool]);
+        let value = self.expression(ty, 3);
+        self.line(&format!("print {};", value));
+      }
+      2 => self.assignment(),
+      3 => {
+        let ty = *self.rng.pick(&[Ty::Num, Ty::Str, Ty::Bool]);
+        self.var_declaration(ty);
+      }
+      4 => {
+        self.line("{");
+        self.block(depth - 1);
+        self.line("}");
+      }
+      5 => {
+        let condition = self.expression(Ty::Bool, 2);
+        self.line(&format!("if ({}) {{", condition));
+        self.block(depth - 1);
+        if self.rng.chance(50) {
+          self.line("} else {");
+          self.block(depth - 1);
+        }
+        self.line("}");
+      }
+      6 => {
+        let counter = self.name("i");
+        let limit = 1 + self.rng.below(4);
+        self.line(&format!("for (var {0} = 0; {0} < {1}; {0} = {0} + 1) {{", counter, limit));
+        self.scopes.push(Vec::new());
+        self.declare(&counter, Ty::Num, false);
+        self.block(depth - 1);
+        self.scopes.pop();
+        self.line("}");
+      }
+      7 => {
+        let counter = self.name("w");
+        let limit = 1 + self.rng.below(4);
+        self.line("{");
+        self.indent += 1;
+        self.line(&format!("var {} = 0;", counter));
+        self.line(&format!("while ({} < {}) {{", counter, limit));
+        self.scopes.push(Vec::new());
+        self.declare(&counter, Ty::Num, false);
+        self.block(depth - 1);
+        self.scopes.pop();
+        self.line(&format!("  {0} = {0} + 1;", counter));
+        self.line("}");
+        self.indent -= 1;
+        self.line("}");
+      }
+      _ if !self.objects.is_empty() => {
+        let object = self.rng.pick(&self.objects).clone();
+        let value = self.expression(Ty::Num, 2);
+        self.line(&format!("{}.value = {};", object, value));
+      }
+      _ => self.assignment(),
+    }
+  }
+
+  fn block(&mut self, depth: usize) {
+    self.indent += 1;
+    self.scopes.push(Vec::new());
+    for _ in 0..1 + self.rng.below(3) {
+      self.statement(depth);
+    }
+    self.scopes.pop();
+    self.indent -= 1;
+  }
+
+  fn assignment(&mut self) {
+    let ty = *self.rng.pick(&[Ty::Num, Ty::Str, Ty::Bool]);
+    let targets = self.variables(ty, true);
+    if targets.is_empty() {
+      return self.var_declaration(ty);
+    }
+    let target = self.rng.pick(&targets).clone();
+    let value = self.expression(ty, 2);
+    self.line(&format!("{} = {};", target, value));
+  }
+
+  ///////////// Expressions ///////////////
+
+  fn expression(&mut self, ty: Ty, depth: usize) -> String {
+    match ty {
+      Ty::Num => self.number(depth),
+      Ty::Str => self.string(depth),
+      Ty::Bool => self.boolean(depth),
+    }
+  }
+
+  fn number(&mut self, depth: usize) -> String {
+    if depth == 0 || self.rng.chance(30) {
+      let variables = self.variables(Ty::Num, false);
+      return match self.rng.below(4) {
+        0 if !variables.is_empty() => self.rng.pick(&variables).clone(),
+        1 if !self.callees.is_empty() => self.call(depth),
+        2 if !self.objects.is_empty() => format!("{}.value", self.rng.pick(&self.objects)),
+        _ => self.rng.below(20).to_string(),
+      };
+    }
+    match self.rng.below(6) {
+      0 => format!("{} + {}", self.number(depth - 1), self.number(depth - 1)),
+      1 => format!("{} - {}", self.number(depth - 1), self.number(depth - 1)),
+      2 => format!("{} * ({})", 1 + self.rng.below(5), self.number(depth - 1)),
+      3 => format!("-({})", self.number(depth - 1)),
+      4 if !self.callees.is_empty() => self.call(depth),
+      _ => format!("({})", self.number(depth - 1)),
+    }
+  }
+
+  fn call(&mut self, depth: usize) -> String {
+    let index = self.rng.below(self.callees.len());
+    let (call, arity) = (self.callees[index].call.clone(), self.callees[index].arity);
+    let arguments: Vec<String> = (0..arity).map(|_| self.number(depth.saturating_sub(1).min(1))).collect();
+    format!("{}{})", call, arguments.join(", "))
+  }
+
+  fn string(&mut self, depth: usize) -> String {
+    let variables = self.variables(Ty::Str, false);
+    if depth == 0 || self.rng.chance(40) {
+      return match variables.is_empty() || self.rng.chance(50) {
+        true => format!("\"{}\"", self.rng.pick(WORDS)),
+        false => self.rng.pick(&variables).clone(),
+      };
+    }
+    format!("{} + {}", self.string(depth - 1), self.string(depth - 1))
+  }
+
+  fn boolean(&mut self, depth: usize) -> String {
+    if depth == 0 || self.rng.chance(20) {
+      let variables = self.variables(Ty::Bool, false);
+      return match variables.is_empty() || self.rng.chance(50) {
+        true => self.rng.pick(&["true", "false"]).to_string(),
+        false => self.rng.pick(&variables).clone(),
+      };
+    }
+    match self.rng.below(7) {
+      0 => format!("{} < {}", self.number(depth - 1), self.number(depth - 1)),
+      1 => format!("{} >= {}", self.number(depth - 1), self.number(depth - 1)),
+      2 => format!("{} == {}", self.number(depth - 1), self.number(depth - 1)),
+      3 => format!("{} != {}", self.string(depth - 1), self.string(depth - 1)),
+      4 => format!("!({})", self.boolean(depth - 1)),
+      5 => format!("({}) and ({})", self.boolean(depth - 1), self.boolean(depth - 1)),
+      _ => format!("({}) or ({})", self.boolean(depth - 1), self.boolean(depth - 1)),
+    }
+  }
+}
+
+///////////// Mutation ///////////////
+
+const ARITHMETIC: &[&str] = &["+", "-", "*"];
+const COMPARISONS: &[&str] = &["<", "<=", ">", ">=", "==", "!="];
+
+// Swaps one to three tokens for others of the same kind
+fn mutate(source: &str, rng: &mut Rng) -> String {
+  let mut lexer = Lexer::new(source.to_string());
+  let tokens: Vec<Token> = lexer.scan_tokens().iter()
+    .filter(|token| {
+      matches!(token.token_type, TokenType::Number | TokenType::True | TokenType::False)
+        || ARITHMETIC.contains(&token.token.as_str())
+        || COMPARISONS.contains(&token.token.as_str())
+    })
+    .cloned()
+    .collect();
+  if tokens.is_empty() {
+    return source.to_string();
+  }
+  let mut chosen: Vec<&Token> = (0..1 + rng.below(3)).map(|_| rng.pick(&tokens)).collect();
+  chosen.sort_by_key(|token| std::cmp::Reverse(token.offset));
+  chosen.dedup_by_key(|token| token.offset);
+  // Offsets count chars, and replacing from the end keeps the earlier ones valid
+  let mut chars: Vec<char> = source.chars().collect();
+  for token in chosen {
+    let replacement = match token.token_type {
+      TokenType::Number => rng.below(20).to_string(),
+      TokenType::True => "false".to_string(),
+      TokenType::False => "true".to_string(),
+      _ if ARITHMETIC.contains(&token.token.as_str()) => rng.pick(ARITHMETIC).to_string(),
+      _ => rng.pick(COMPARISONS).to_string(),
+    };
+    let end = token.offset + token.token.chars().count();
+    if end <= chars.len() {
+      chars.splice(token.offset..end, replacement.chars());
+    }
+  }
+  chars.into_iter().collect()
+}
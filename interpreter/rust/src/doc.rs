@@ -0,0 +1,174 @@
+/*
+`lox doc`: reference documentation for a script's top-level functions,
+classes and traits.
+
+Each one is listed in source order with its signature and the `///` or
+`/** */` comment written right before it, and classes and traits list their
+methods the same way. Undocumented declarations are listed too, with just
+their signature. Comment text is passed through as is, so it can use
+Markdown; the HTML output shows it as plain paragraphs.
+*/
+
+use crate::ast::*;
+use crate::minify;
+
+struct Section {
+  title: &'static str,
+  entries: Vec<Entry>,
+}
+
+struct Entry {
+  name: String,
+  signature: String,
+  doc: Option<String>,
+  members: Vec<Entry>,
+}
+
+pub fn markdown(statements: &[Stmt], title: &str) -> String {
+  let mut out = format!("# {}\n", title);
+  for section in sections(statements) {
+    out.push_str(&format!("\n## {}\n", section.title));
+    for entry in &section.entries {
+      markdown_entry(&mut out, entry, "###", None);
+    }
+  }
+  out
+}
+
+fn markdown_entry(out: &mut String, entry: &Entry, level: &str, owner: Option<&str>) {
+  let name = match owner {
+    Some(owner) => format!("{}.{}", owner, entry.name),
+    None => entry.name.clone(),
+  };
+  out.push_str(&format!("\n{} {}\n\n`{}`\n", level, name, entry.signature));
+  if let Some(doc) = &entry.doc {
+    out.push_str(&format!("\n{}\n", doc));
+  }
+  for member in &entry.members {
+    markdown_entry(out, member, &format!("{}#", level), Some(&entry.name));
+  }
+}
+
+pub fn html(statements: &[Stmt], title: &str) -> String {
+  let mut out = format!(
+    "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>{0}</title>\n{1}</head>\n<body>\n<h1>{0}</h1>\n",
+    escape(title),
+    STYLE
+  );
+  for section in sections(statements) {
+    out.push_str(&format!("<h2>{}</h2>\n", section.title));
+    for entry in &section.entries {
+      html_entry(&mut out, entry, 3, None);
+    }
+  }
+  out.push_str("</body>\n</html>\n");
+  out
+}
+
+const STYLE: &str = "<style>
+  body { font-family: sans-serif; margin: 2em; max-width: 50em; }
+  code { background: #f4f4f4; padding: 0.2em 0.4em; }
+  .members { margin-left: 2em; }
+</style>
+";
+
+fn html_entry(out: &mut String, entry: &Entry, level: usize, owner: Option<&str>) {
+  let name = match owner {
+    Some(owner) => format!("{}.{}", owner, entry.name),
+    None => entry.name.clone(),
+  };
+  out.push_str(&format!("<h{0} id=\"{1}\">{1}</h{0}>\n", level, escape(&name)));
+  out.push_str(&format!("<p><code>{}</code></p>\n", escape(&entry.signature)));
+  if let Some(doc) = &entry.doc {
+    for paragraph in doc.split("\n\n").filter(|p| !p.trim().is_empty()) {
+      out.push_str(&format!("<p>{}</p>\n", escape(paragraph.trim())));
+    }
+  }
+  if !entry.members.is_empty() {
+    out.push_str("<div class=\"members\">\n");
+    for member in &entry.members {
+      html_entry(out, member, level + 1, Some(&entry.name));
+    }
+    out.push_str("</div>\n");
+  }
+}
+
+fn escape(text: &str) -> String {
+  text.replace('&', "&amp;").replace('<', "&lt;").replace('>', "&gt;").replace('"', "&quot;")
+}
+
+fn sections(statements: &[Stmt]) -> Vec<Section> {
+  let mut functions = Vec::new();
+  let mut classes = Vec::new();
+  let mut traits = Vec::new();
+  for statement in statements {
+    match statement {
+      Stmt::Fun(function) => functions.push(function_entry("fun ", function)),
+      Stmt::Class(class) => classes.push(Entry {
+        name: class.name.token.clone(),
+        signature: class_signature(class),
+        doc: class.doc.clone(),
+        members: class.methods.iter().map(|method| function_entry("", method)).collect(),
+      }),
+      Stmt::Trait(trait_stmt) => traits.push(Entry {
+        name: trait_stmt.name.token.clone(),
+        signature: format!("trait {}", trait_stmt.name.token),
+        doc: trait_stmt.doc.clone(),
+        members: trait_stmt.methods.iter().map(|method| {
+          let params: Vec<&str> = method.params.iter().map(|p| p.token.as_str()).collect();
+          Entry {
+            name: method.name.token.clone(),
+            signature: format!("{}({})", method.name.token, params.join(", ")),
+            doc: method.doc.clone(),
+            members: Vec::new(),
+          }
+        }).collect(),
+      }),
+      _ => (),
+    }
+  }
+  [("Functions", functions), ("Classes", classes), ("Traits", traits)]
+    .into_iter()
+    .filter(|(_, entries)| !entries.is_empty())
+    .map(|(title, entries)| Section { title, entries })
+    .collect()
+}
+
+fn function_entry(keyword: &str, function: &FunStmt) -> Entry {
+  let mut signature = format!("{}{}({})", keyword, function.name.token, parameter_list(function));
+  if let Some(return_type) = &function.return_type {
+    signature.push_str(&format!(": {}", return_type.token));
+  }
+  Entry { name: function.name.token.clone(), signature, doc: function.doc.clone(), members: Vec::new() }
+}
+
+// The parameters as they were written, annotations and defaults included
+pub fn parameter_list(function: &FunStmt) -> String {
+  let mut params = Vec::new();
+  for ((name, annotation), default) in function.params.iter().zip(&function.param_types).zip(&function.defaults) {
+    let mut param = name.token.clone();
+    if let Some(annotation) = annotation {
+      param.push_str(&format!(": {}", annotation.token));
+    }
+    if let Some(default) = default {
+      param.push_str(&format!(" = {}", minify::source(default)));
+    }
+    params.push(param);
+  }
+  if let Some(rest) = &function.rest {
+    params.push(format!("...{}", rest.token));
+  }
+  params.join(", ")
+}
+
+fn class_signature(class: &ClassStmt) -> String {
+  let mut signature = format!("class {}", class.name.token);
+  if let Some(Expr::Variable(superclass)) = class.superclass.as_deref() {
+    signature.push_str(&format!(" < {}", superclass.name.token));
+  }
+  if !class.traits.is_empty() {
+    let traits: Vec<&str> = class.traits.iter().map(|t| t.token.as_str()).collect();
+    signature.push_str(&format!(" implements {}", traits.join(", ")));
+  }
+  signature
+}
@@ -1,11 +1,13 @@
 use crate::lexer::*;
-use std::collections::HashMap;
+use crate::symbol::Symbol;
+use std::collections::{HashMap, HashSet};
 use std::rc::Rc;
 use std::cell::RefCell;
 
 #[derive(Default, Debug, Clone)]
 pub struct Environment {
-    pub values: HashMap<String, LoxValue>,
+    pub values: HashMap<Symbol, LoxValue>,
+    pub constants: HashSet<Symbol>,
     pub enclosing: Option<Rc<RefCell<Environment>>>,
 }
 
@@ -13,6 +15,7 @@ impl Environment {
     pub fn new() -> Self {
         Self {
             values: HashMap::new(),
+            constants: HashSet::new(),
             enclosing: None,
         }
     }
@@ -20,17 +23,41 @@ impl Environment {
     pub fn new_enclosed(enclosing: Rc<RefCell<Environment>>) -> Self {
         Self {
             values: HashMap::new(),
+            constants: HashSet::new(),
             enclosing: Some(enclosing),
         }
     }
 
-    pub fn define(&mut self, name: String, value: LoxValue) {
+    pub fn define(&mut self, name: impl Into<Symbol>, value: LoxValue) {
+        let name = name.into();
+        self.constants.remove(&name);
         self.values.insert(name, value);
     }
 
-    pub fn get(&self, name: &str) -> Result<LoxValue, String> {
-        if self.values.contains_key(name) {
-            return Ok(self.values[name].clone());
+    pub fn define_constant(&mut self, name: impl Into<Symbol>, value: LoxValue) {
+        let name = name.into();
+        self.values.insert(name, value);
+        self.constants.insert(name);
+    }
+
+    // Every name visible from here, innermost first, for suggesting one when
+    // a lookup fails
+    pub fn visible_names(&self) -> Vec<String> {
+        let mut names: Vec<String> = self.values.keys().map(|name| name.to_string()).collect();
+        if let Some(enclosing) = &self.enclosing {
+            names.extend(enclosing.borrow().visible_names());
+        }
+        names
+    }
+
+    fn constant_error(name: Symbol) -> String {
+        format!("Cannot assign to constant '{}'.", name)
+    }
+
+    pub fn get(&self, name: impl Into<Symbol>) -> Result<LoxValue, String> {
+        let name = name.into();
+        if let Some(value) = self.values.get(&name) {
+            return Ok(value.clone());
         }
 
         if let Some(enclosing) = &self.enclosing {
@@ -41,11 +68,17 @@ impl Environment {
         return Err(format!("Undefined variable '{}'.", name));
     }
 
-    pub fn get_at(&self, distance: usize, name: &str) -> Result<LoxValue, String> {
+    pub fn get_at(&self, distance: usize, name: impl Into<Symbol>) -> Result<LoxValue, String> {
+        let name = name.into();
+        if distance == 0 {
+            return match self.values.get(&name) {
+                Some(value) => Ok(value.clone()),
+                None => Err(format!("Undefined variable '{}'.", name)),
+            };
+        }
         if let Some(enclosing) = self.ancestor(distance) {
-            let borrowed_env = enclosing.borrow();
-            if borrowed_env.values.contains_key(name) {
-                return Ok(borrowed_env.values[name].clone());
+            if let Some(value) = enclosing.borrow().values.get(&name) {
+                return Ok(value.clone());
             }
         }
         Err(format!("Undefined variable '{}'.", name))
@@ -54,11 +87,18 @@ impl Environment {
     pub fn assign_at(
         &mut self,
         distance: usize,
-        name: String,
+        name: impl Into<Symbol>,
         value: LoxValue,
     ) -> Result<(), String> {
+        let name = name.into();
+        if distance == 0 {
+            return self.assign_here(name, value);
+        }
         if let Some(enclosing) = self.ancestor(distance) {
             let mut borrowed_env = enclosing.borrow_mut();
+            if borrowed_env.constants.contains(&name) {
+                return Err(Environment::constant_error(name));
+            }
             if borrowed_env.values.contains_key(&name) {
                 borrowed_env.values.insert(name, value);
                 return Ok(());
@@ -67,28 +107,37 @@ impl Environment {
         Err(format!("Undefined variable '{}'.", name))
     }
 
+    // Walks the shared chain rather than copying it, so writes through the
+    // returned environment are visible to everyone holding it. Distance 0 is
+    // self, which callers handle directly.
     fn ancestor(&self, distance: usize) -> Option<Rc<RefCell<Environment>>> {
-        let mut env = self.clone();
-        for _ in 0..distance {
-            if let Some(enclosing) = env.enclosing.clone() {
-                env = enclosing.borrow().clone();
-            } else {
-                return None;
-            }
+        let mut env = self.enclosing.clone()?;
+        for _ in 1..distance {
+            let next = env.borrow().enclosing.clone()?;
+            env = next;
         }
-        Some(Rc::new(RefCell::new(env)))
+        Some(env)
     }
 
-    pub fn assign(&mut self, name: String, value: LoxValue) -> Result<(), String> {
+    fn assign_here(&mut self, name: Symbol, value: LoxValue) -> Result<(), String> {
+        if self.constants.contains(&name) {
+            return Err(Environment::constant_error(name));
+        }
         if self.values.contains_key(&name) {
             self.values.insert(name, value);
             return Ok(());
         }
+        Err(format!("Undefined variable '{}'.", name))
+    }
+
+    pub fn assign(&mut self, name: impl Into<Symbol>, value: LoxValue) -> Result<(), String> {
+        let name = name.into();
+        if self.values.contains_key(&name) {
+            return self.assign_here(name, value);
+        }
 
         if let Some(enclosing) = &mut self.enclosing {
-            if let Ok(_) = enclosing.borrow_mut().assign(name.clone(), value) {
-                return Ok(());
-            }
+            return enclosing.borrow_mut().assign(name, value);
         }
 
         Err(format!("Undefined variable '{}'.", name))
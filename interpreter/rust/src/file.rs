@@ -0,0 +1,120 @@
+/*
+Open files for open() and create(), modelled on Go's os.Open and os.Create:
+open() reads a file that's already there and create() writes a new one,
+emptying it first if it exists.
+
+Files are read as UTF-8 text a line at a time or all at once; readBytes() and
+writeBytes() are the way to work with binary data. A file closes when close()
+is called, which `using` does on the way out of its block, or once nothing in
+the script can reach it (see weak.rs).
+
+What's read goes through replay.rs, so a replayed run gets what the recorded
+one read; a file opened for a replay is only a placeholder for that.
+*/
+
+use crate::replay;
+use crate::weak::Handle;
+use std::fs::File;
+use std::io::{BufRead, BufReader, Read, Write};
+
+pub enum LoxFile {
+  Reader(BufReader<File>),
+  Writer(File),
+  // Open for reading in a replay, which reads from the trace instead
+  Replayed,
+  Closed,
+}
+
+pub fn open(path: &str) -> Result<LoxFile, String> {
+  let mut file = None;
+  replay::input("opened a file", || {
+    file = Some(File::open(path).map_err(|err| format!("Can't open '{}': {}.", path, err))?);
+    Ok(Vec::new())
+  })?;
+  Ok(file.map_or(LoxFile::Replayed, |file| LoxFile::Reader(BufReader::new(file))))
+}
+
+pub fn create(path: &str) -> Result<LoxFile, String> {
+  let file = File::create(path).map_err(|err| format!("Can't create '{}': {}.", path, err))?;
+  Ok(LoxFile::Writer(file))
+}
+
+fn describe(err: std::io::Error) -> String {
+  format!("{}.", err)
+}
+
+fn text(data: Vec<u8>) -> Result<String, String> {
+  String::from_utf8(data).map_err(|err| format!("Invalid UTF-8 at byte {}.", err.utf8_error().valid_up_to()))
+}
+
+impl LoxFile {
+  // Everything that hasn't been read yet
+  pub fn read(&mut self) -> Result<String, String> {
+    let reader = self.reader()?;
+    text(replay::input("read a file", || {
+      let mut data = Vec::new();
+      if let Some(reader) = reader {
+        reader.read_to_end(&mut data).map_err(describe)?;
+      }
+      Ok(data)
+    })?)
+  }
+
+  // Up to the next "\n", which is dropped along with a "\r" before it, or
+  // None at the end of the file
+  pub fn read_line(&mut self) -> Result<Option<String>, String> {
+    let reader = self.reader()?;
+    let mut line = replay::input("read a file", || {
+      let mut line = Vec::new();
+      if let Some(reader) = reader {
+        reader.read_until(b'\n', &mut line).map_err(describe)?;
+      }
+      Ok(line)
+    })?;
+    if line.is_empty() {
+      return Ok(None);
+    }
+    if line.last() == Some(&b'\n') {
+      line.pop();
+      if line.last() == Some(&b'\r') {
+        line.pop();
+      }
+    }
+    text(line).map(Some)
+  }
+
+  pub fn write(&mut self, data: &[u8]) -> Result<(), String> {
+    match self {
+      LoxFile::Writer(file) => file.write_all(data).map_err(describe),
+      _ => Err(self.not_open_for("writing")),
+    }
+  }
+
+  // Dropping the file closes it. Closing twice is fine, so a file closed by
+  // hand inside `using` doesn't fail on the way out.
+  pub fn close(&mut self) {
+    *self = LoxFile::Closed;
+  }
+
+  // The file to read from, which a replayed one doesn't have
+  fn reader(&mut self) -> Result<Option<&mut BufReader<File>>, String> {
+    match self {
+      LoxFile::Reader(reader) => Ok(Some(reader)),
+      LoxFile::Replayed => Ok(None),
+      other => Err(other.not_open_for("reading")),
+    }
+  }
+
+  fn not_open_for(&self, purpose: &str) -> String {
+    match self {
+      LoxFile::Closed => "The file is closed.".to_string(),
+      _ => format!("The file isn't open for {}.", purpose),
+    }
+  }
+}
+
+impl Handle for LoxFile {
+  fn close(&mut self) {
+    LoxFile::close(self);
+  }
+}
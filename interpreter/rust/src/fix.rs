@@ -0,0 +1,156 @@
+/*
+`lox fix`: rewrites a script written for one dialect so that it means the
+same thing in another, and shows the change as a diff.
+
+The script is lexed and parsed in the dialect it was written for, and every
+extension the new dialect turns on that the old one didn't is checked for
+code whose meaning it would change:
+
+- keywords the extension adds, used as names, are renamed by appending '_'
+  until the name is unused in the script
+- a plain string containing `${` is split there, so it isn't read as
+  interpolation: "cost: ${n}" becomes ("cost: $" + "{n}")
+- a variable named `_` is renamed, since with discards on it can't be read
+
+Edits are made to the source text rather than printed from the tree, so
+comments and layout are kept. None of them adds or removes a line, which
+keeps the diff line for line. Going the other way, to a dialect with fewer
+extensions, can't be fixed automatically: code using a dropped extension has
+to be rewritten by hand, and the parser will point it out.
+*/
+
+use crate::dialect::{self, Dialect, Feature};
+use crate::lexer::*;
+use crate::parser::*;
+use std::collections::HashSet;
+
+// Replaces the source's characters from start up to end
+struct Edit {
+  start: usize,
+  end: usize,
+  text: String,
+}
+
+pub struct Fixed {
+  pub source: String,
+  // What was changed, one line per kind of fix
+  pub notes: Vec<String>,
+}
+
+// Parses the source as `from` and returns it rewritten for `to`, or None if
+// it doesn't parse, after the parser has reported why
+pub fn fix(source: &str, from: Dialect, to: Dialect) -> Option<Fixed> {
+  let saved = dialect::current();
+  dialect::switch(from);
+  let mut lexer = Lexer::new(source.to_string());
+  let tokens = lexer.scan_tokens().clone();
+  let parsed = Parser::new(tokens.clone()).parse();
+  dialect::switch(saved);
+  parsed.ok()?;
+
+  let added = to.added_since(from);
+  let mut edits = Vec::new();
+  let mut notes = Vec::new();
+  rename_keywords(&tokens, from, to, &mut edits, &mut notes);
+  if added.contains(&Feature::Interpolation) {
+    split_interpolations(&tokens, &mut edits, &mut notes);
+  }
+  if added.contains(&Feature::Discard) {
+    rename_discards(&tokens, &mut edits, &mut notes);
+  }
+
+  let mut chars: Vec<char> = source.chars().collect();
+  edits.sort_by_key(|edit| edit.start);
+  for edit in edits.iter().rev() {
+    chars.splice(edit.start..edit.end, edit.text.chars());
+  }
+  Some(Fixed { source: chars.into_iter().collect(), notes })
+}
+
+// Names that are keywords in `to` but weren't in `from`
+fn rename_keywords(tokens: &[Token], from: Dialect, to: Dialect, edits: &mut Vec<Edit>, notes: &mut Vec<String>) {
+  let mut taken: HashSet<String> = tokens.iter().filter(|t| t.token_type == TokenType::Identifier).map(|t| t.token.clone()).collect();
+  for word in to.keywords() {
+    if from.keywords().contains(&word) || !taken.contains(word) {
+      continue;
+    }
+    let mut name = format!("{}_", word);
+    while taken.contains(&name) {
+      name.push('_');
+    }
+    for token in tokens.iter().filter(|t| t.token_type == TokenType::Identifier && t.token == word) {
+      edits.push(Edit { start: token.offset, end: token.offset + word.chars().count(), text: name.clone() });
+    }
+    notes.push(format!("Renamed '{}' to '{}', which is a keyword now.", word, name));
+    taken.insert(name);
+  }
+}
+
+// `_` can't be read once discards are on, so a script that reads it gets
+// another name for it
+fn rename_discards(tokens: &[Token], edits: &mut Vec<Edit>, notes: &mut Vec<String>) {
+  let discards: Vec<&Token> = tokens.iter().filter(|t| t.token_type == TokenType::Identifier && t.token == "_").collect();
+  if discards.is_empty() {
+    return;
+  }
+  let taken: HashSet<&str> = tokens.iter().filter(|t| t.token_type == TokenType::Identifier).map(|t| t.token.as_str()).collect();
+  let mut name = "__".to_string();
+  while taken.contains(name.as_str()) {
+    name.push('_');
+  }
+  for token in discards {
+    edits.push(Edit { start: token.offset, end: token.offset + 1, text: name.clone() });
+  }
+  notes.push(format!("Renamed '_' to '{}', since '_' can't be read now.", name));
+}
+
+fn split_interpolations(tokens: &[Token], edits: &mut Vec<Edit>, notes: &mut Vec<String>) {
+  let mut count = 0;
+  for token in tokens.iter().filter(|t| t.token_type == TokenType::String) {
+    // Raw strings never interpolate
+    if !token.token.starts_with('"') || token.token.starts_with("\"\"\"") || !token.token.contains("${") {
+      continue;
+    }
+    let text = &token.token[1..token.token.len() - 1];
+    let parts: Vec<String> = text.split("${").map(str::to_string).collect();
+    let mut pieces = Vec::new();
+    for (i, part) in parts.iter().enumerate() {
+      let open = if i == 0 { "" } else { "{" };
+      let close = if i + 1 < parts.len() { "$" } else { "" };
+      pieces.push(format!("\"{}{}{}\"", open, part, close));
+    }
+    let end = token.offset + token.token.chars().count();
+    edits.push(Edit { start: token.offset, end, text: format!("({})", pieces.join(" + ")) });
+    count += 1;
+  }
+  if count > 0 {
+    notes.push(format!("Split {} string(s) at '${{' so they aren't interpolated.", count));
+  }
+}
+
+// The lines that differ, as hunks of a unified diff. Fixing never adds or
+// removes lines, so line n of one is line n of the other.
+pub fn diff(path: &str, before: &str, after: &str) -> String {
+  let old: Vec<&str> = before.lines().collect();
+  let new: Vec<&str> = after.lines().collect();
+  let mut out = format!("--- {}\n+++ {}\n", path, path);
+  let mut line = 0;
+  while line < old.len().min(new.len()) {
+    if old[line] == new[line] {
+      line += 1;
+      continue;
+    }
+    let start = line;
+    while line < old.len().min(new.len()) && old[line] != new[line] {
+      line += 1;
+    }
+    out.push_str(&format!("@@ -{},{} +{},{} @@\n", start + 1, line - start, start + 1, line - start));
+    for removed in &old[start..line] {
+      out.push_str(&format!("-{}\n", removed));
+    }
+    for added in &new[start..line] {
+      out.push_str(&format!("+{}\n", added));
+    }
+  }
+  out
+}
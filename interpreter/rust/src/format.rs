@@ -0,0 +1,95 @@
+/*
+Format strings for format(), in the style of Rust's and Python's: each `{}`
+in the template is replaced by the next argument, converted as print would.
+
+A placeholder can name the argument it wants by position, `{1}`, counting
+from 0, and a number can be given a precision, the digits after the decimal
+point, after a colon: `{:.2}` or `{0:.2}`. Positional placeholders don't move
+the count the plain ones go by, so "{} {0} {}" uses arguments 0, 0 and 1.
+`{{` and `}}` stand for a literal brace.
+
+Every argument has to be used, and a precision on something that isn't a
+number is an error, the same as a placeholder with no argument: each means
+the template and the arguments don't agree.
+*/
+
+use crate::interpreter::Interpreter;
+use crate::lexer::LoxValue;
+
+struct Placeholder {
+  position: Option<usize>,
+  precision: Option<usize>,
+}
+
+// `spec` is the text between the braces
+fn placeholder(spec: &str) -> Result<Placeholder, String> {
+  let invalid = || format!("Invalid placeholder '{{{}}}'.", spec);
+  let (position, precision) = match spec.split_once(':') {
+    Some((position, precision)) => (position, Some(precision)),
+    None => (spec, None),
+  };
+  let position = match position {
+    "" => None,
+    digits => Some(digits.parse::<usize>().map_err(|_| invalid())?),
+  };
+  let precision = match precision {
+    None => None,
+    Some(precision) => match precision.strip_prefix('.') {
+      Some(digits) => Some(digits.parse::<usize>().map_err(|_| invalid())?),
+      None => return Err(invalid()),
+    },
+  };
+  Ok(Placeholder { position, precision })
+}
+
+// Fills in the template, with `stringify` converting values the way print
+// does
+pub fn format(template: &str, arguments: &[LoxValue], stringify: &mut dyn FnMut(&LoxValue) -> Result<String, String>) -> Result<String, String> {
+  let mut out = String::new();
+  let mut chars = template.chars().peekable();
+  let mut next = 0;
+  let mut used = vec![false; arguments.len()];
+  while let Some(c) = chars.next() {
+    match c {
+      '{' if chars.peek() == Some(&'{') => {
+        chars.next();
+        out.push('{');
+      }
+      '}' if chars.peek() == Some(&'}') => {
+        chars.next();
+        out.push('}');
+      }
+      '}' => return Err("Unmatched '}' in the template; write '}}' for a literal one.".to_string()),
+      '{' => {
+        let mut spec = String::new();
+        loop {
+          match chars.next() {
+            Some('}') => break,
+            Some(c) => spec.push(c),
+            None => return Err("A '{' in the template isn't closed.".to_string()),
+          }
+        }
+        let placeholder = placeholder(&spec)?;
+        let position = placeholder.position.unwrap_or_else(|| {
+          next += 1;
+          next - 1
+        });
+        let Some(value) = arguments.get(position) else {
+          return Err(format!("There's no argument {} for the template, which was given {}.", position, arguments.len()));
+        };
+        used[position] = true;
+        let text = match (placeholder.precision, Interpreter::as_float(value)) {
+          (Some(precision), Some(n)) => format!("{:.*}", precision, n),
+          (Some(_), None) => return Err(format!("Placeholder '{{{}}}' gives a precision, which needs a number, not {}.", spec, value)),
+          (None, _) => stringify(value)?,
+        };
+        out.push_str(&text);
+      }
+      c => out.push(c),
+    }
+  }
+  if let Some(position) = used.iter().position(|used| !used) {
+    return Err(format!("Argument {} isn't used by the template, which was given {}.", position, arguments.len()));
+  }
+  Ok(out)
+}
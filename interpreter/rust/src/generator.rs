@@ -0,0 +1,226 @@
+use crate::ast::*;
+use crate::environment::Environment;
+use crate::interpreter::*;
+use crate::lexer::*;
+use std::cell::RefCell;
+use std::fmt;
+use std::rc::Rc;
+
+// Calling a function whose body contains `yield` returns one of these instead
+// of running the body. The body is then run on demand by an explicit stack of
+// continuation frames: statements that can't yield are handed to the
+// interpreter whole, while blocks, ifs and loops that contain a yield are
+// unfolded into frames so execution can stop at the yield and pick up again
+// on the next resume. Environments are created exactly where the interpreter
+// would create them, so the resolver's distances still hold.
+pub struct LoxGenerator {
+  pub name: String,
+  frames: Vec<Frame>,
+}
+
+enum Frame {
+  Block { statements: Vec<Stmt>, index: usize, env: Rc<RefCell<Environment>> },
+  // `checked` is false until a do-while has run its body once
+  While { stmt: WhileStmt, env: Rc<RefCell<Environment>>, checked: bool },
+  ForIn { stmt: ForInStmt, iterator: LoxIterator, env: Rc<RefCell<Environment>> },
+}
+
+impl fmt::Debug for LoxGenerator {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    write!(f, "<generator {}>", self.name)
+  }
+}
+
+impl fmt::Display for LoxGenerator {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    write!(f, "<generator {}>", self.name)
+  }
+}
+
+// Generators are only ever equal to themselves
+impl PartialEq for LoxGenerator {
+  fn eq(&self, other: &Self) -> bool {
+    std::ptr::eq(self, other)
+  }
+}
+
+impl LoxGenerator {
+  // `env` holds the bound parameters; the body gets its own scope inside it
+  // just like a normal call
+  pub fn new(name: String, body: &BlockStmt, env: Rc<RefCell<Environment>>) -> Self {
+    let body_env = Rc::new(RefCell::new(Environment::new_enclosed(env)));
+    Self {
+      name,
+      frames: vec![Frame::Block { statements: body.statements.clone(), index: 0, env: body_env }],
+    }
+  }
+
+  // The scopes and values a suspended generator holds on to, for memory.rs
+  pub fn references(&self) -> (Vec<Rc<RefCell<Environment>>>, Vec<LoxValue>) {
+    let mut environments = Vec::new();
+    let mut values = Vec::new();
+    for frame in &self.frames {
+      match frame {
+        Frame::Block { env, .. } | Frame::While { env, .. } => environments.push(env.clone()),
+        Frame::ForIn { iterator, env, .. } => {
+          environments.push(env.clone());
+          match iterator {
+            LoxIterator::List(elements, index) => values.extend(elements.iter().skip(*index).cloned()),
+            LoxIterator::Generator(generator) => values.push(LoxValue::Generator(generator.clone())),
+          }
+        }
+      }
+    }
+    (environments, values)
+  }
+
+  // Returns the next yielded value, or None once the body has finished
+  pub fn next(generator: &Rc<RefCell<LoxGenerator>>, interpreter: &mut Interpreter) -> Result<Option<LoxValue>, InterpreterError> {
+    match generator.try_borrow_mut() {
+      Ok(mut generator) => generator.resume(interpreter),
+      Err(_) => Err(InterpreterError::call_error("generator", "Generator is already running.".to_string())),
+    }
+  }
+
+  fn resume(&mut self, interpreter: &mut Interpreter) -> Result<Option<LoxValue>, InterpreterError> {
+    let result = self.run(interpreter);
+    // A generator that failed or finished stays finished
+    if !matches!(result, Ok(Some(_))) {
+      self.frames.clear();
+    }
+    result
+  }
+
+  fn run(&mut self, interpreter: &mut Interpreter) -> Result<Option<LoxValue>, InterpreterError> {
+    while let Some(frame) = self.frames.last_mut() {
+      // The next statement to run, or the frame is done, along with the
+      // loop's else branch if it finished without a break
+      let next = match frame {
+        Frame::Block { statements, index, env } => {
+          *index += 1;
+          statements.get(*index - 1).map(|stmt| (stmt.clone(), env.clone())).ok_or(None)
+        }
+        Frame::While { stmt, env, checked } => {
+          let run = !*checked || Interpreter::is_truthy(interpreter.evaluate_in(&stmt.condition, env.clone())?);
+          *checked = true;
+          if run {
+            Ok(((*stmt.body).clone(), env.clone()))
+          } else {
+            Err(stmt.else_branch.clone().map(|branch| (*branch, env.clone())))
+          }
+        }
+        Frame::ForIn { stmt, iterator, env } => match iterator.next(interpreter)? {
+          Some(value) => {
+            let loop_env = Rc::new(RefCell::new(Environment::new_enclosed(env.clone())));
+            loop_env.borrow_mut().define(stmt.name.symbol, value);
+            Ok(((*stmt.body).clone(), loop_env))
+          }
+          None => Err(stmt.else_branch.clone().map(|branch| (*branch, env.clone()))),
+        },
+      };
+      match next {
+        Ok((stmt, env)) => {
+          if let Some(value) = self.step(interpreter, stmt, env)? {
+            return Ok(Some(value));
+          }
+        }
+        Err(else_branch) => {
+          self.frames.pop();
+          if let Some((branch, env)) = else_branch {
+            self.frames.push(Frame::Block { statements: vec![branch], index: 0, env });
+          }
+        }
+      }
+    }
+    Ok(None)
+  }
+
+  fn step(&mut self, interpreter: &mut Interpreter, stmt: Stmt, env: Rc<RefCell<Environment>>) -> Result<Option<LoxValue>, InterpreterError> {
+    if !stmt.contains_yield() {
+      return match interpreter.execute_in(&stmt, env) {
+        // `return` ends the generator; any value is dropped
+        Err(InterpreterError { error_type: InterpreterErrorType::ReturnValue(_), .. }) => {
+          self.frames.clear();
+          Ok(None)
+        }
+        // Unwind to the innermost loop frame, skipping its else branch
+        Err(InterpreterError { error_type: InterpreterErrorType::Break, .. }) => {
+          while let Some(frame) = self.frames.pop() {
+            if !matches!(frame, Frame::Block { .. }) {
+              break;
+            }
+          }
+          Ok(None)
+        }
+        Err(err) => Err(err),
+        Ok(()) => Ok(None),
+      };
+    }
+    match stmt {
+      Stmt::Yield(stmt) => {
+        let value = match &stmt.value {
+          Some(value) => interpreter.evaluate_in(value, env)?,
+          None => LoxValue::Nil,
+        };
+        return Ok(Some(value));
+      }
+      Stmt::Block(block) => {
+        let block_env = Rc::new(RefCell::new(Environment::new_enclosed(env)));
+        self.frames.push(Frame::Block { statements: block.statements, index: 0, env: block_env });
+      }
+      Stmt::If(stmt) => {
+        let branch = if Interpreter::is_truthy(interpreter.evaluate_in(&stmt.condition, env.clone())?) {
+          Some(stmt.then_branch)
+        } else {
+          stmt.else_branch
+        };
+        if let Some(branch) = branch {
+          self.frames.push(Frame::Block { statements: vec![*branch], index: 0, env });
+        }
+      }
+      Stmt::While(stmt) => self.frames.push(Frame::While { stmt, env, checked: true }),
+      Stmt::DoWhile(stmt) => self.frames.push(Frame::While { stmt, env, checked: false }),
+      Stmt::ForIn(stmt) => {
+        let iterable = interpreter.evaluate_in(&stmt.iterable, env.clone())?;
+        let iterator = LoxIterator::new(&iterable, &stmt.name)?;
+        self.frames.push(Frame::ForIn { stmt, iterator, env });
+      }
+      // Anything else reaches visitYieldStmt, which reports the yield
+      other => interpreter.execute_in(&other, env)?,
+    }
+    Ok(None)
+  }
+}
+
+// What `for (x in value)` walks over
+pub enum LoxIterator {
+  List(Vec<LoxValue>, usize),
+  Generator(Rc<RefCell<LoxGenerator>>),
+}
+
+impl LoxIterator {
+  // Lists, sets, maps and bytes are copied up front, so changing one inside the loop
+  // doesn't change what the loop visits
+  pub fn new(iterable: &LoxValue, token: &Token) -> Result<Self, InterpreterError> {
+    match iterable {
+      LoxValue::List(list) => Ok(LoxIterator::List(list.borrow().clone(), 0)),
+      LoxValue::Set(set) => Ok(LoxIterator::List(set.borrow().values(), 0)),
+      // A map's keys, in the order they were added
+      LoxValue::Map(map) => Ok(LoxIterator::List(map.borrow().keys(), 0)),
+      LoxValue::Bytes(bytes) => Ok(LoxIterator::List(bytes.borrow().data.iter().map(|b| LoxValue::Integer(*b as i64)).collect(), 0)),
+      LoxValue::String(s) => Ok(LoxIterator::List(s.chars().map(|c| LoxValue::String(c.to_string())).collect(), 0)),
+      LoxValue::Generator(generator) => Ok(LoxIterator::Generator(generator.clone())),
+      other => Err(InterpreterError::new(token.clone(), format!("{} is not iterable.", other))),
+    }
+  }
+
+  pub fn next(&mut self, interpreter: &mut Interpreter) -> Result<Option<LoxValue>, InterpreterError> {
+    match self {
+      LoxIterator::List(elements, index) => {
+        *index += 1;
+        Ok(elements.get(*index - 1).cloned())
+      }
+      LoxIterator::Generator(generator) => LoxGenerator::next(generator, interpreter),
+    }
+  }
+}
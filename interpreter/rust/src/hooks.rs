@@ -0,0 +1,37 @@
+/*
+Hooks into a running interpreter, for tools that watch a script run without
+changing it: tracers, profilers, debuggers and coverage all want the same
+few events, so they subscribe to these instead of each patching the
+interpreter.
+
+A tool implements the methods it cares about and leaves the rest as they
+are, then hands itself to Interpreter::add_hooks(). Every subscriber sees
+every event, in the order they were added. With none added, each event costs
+the interpreter one check.
+*/
+
+use crate::ast::Stmt;
+use crate::interpreter::InterpreterError;
+use crate::lexer::LoxValue;
+
+pub trait Hooks {
+  // Before each statement runs, blocks and the statements in them included.
+  // first_token() gives its line.
+  fn on_statement(&mut self, _stmt: &Stmt) {}
+
+  // Before a call, once its arguments are evaluated
+  fn on_call(&mut self, _callee: &LoxValue, _arguments: &[LoxValue], _line: usize) {}
+
+  // After the call on_call announced, with what it returned or the error it
+  // raised. Every on_call gets one, so tools can keep their own call stack.
+  fn on_return(&mut self, _callee: &LoxValue, _result: Result<&LoxValue, &InterpreterError>) {}
+
+  // A runtime error reaching the top of the script, where it's reported
+  fn on_error(&mut self, _error: &InterpreterError) {}
+
+  // After a garbage collection, with how many objects it freed. The
+  // tree-walker frees values by reference counting the moment they become
+  // unreachable, so it has no collections and never calls this; it's part of
+  // the API so a tool can be written once for every engine.
+  fn on_gc(&mut self, _freed: usize) {}
+}
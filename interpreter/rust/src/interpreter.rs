@@ -1,24 +1,81 @@
 use crate::ast::*;
 use crate::lexer::*;
+use crate::symbol;
 use crate::environment::*;
 use crate::oop::*;
 use crate::stl::*;
-use std::collections::HashMap;
-use std::rc::Rc;
+use crate::callable::{expected_arguments, LoxCallable};
+use std::collections::{HashMap, HashSet};
+use std::rc::{Rc, Weak};
 use std::cell::RefCell;
-use std::any::Any;
+use std::cmp::Ordering;
+use std::time::Instant;
+use crate::bignum::BigInt;
+use crate::generator::LoxIterator;
+use crate::set::LoxSet;
+use crate::map::LoxMap;
+use crate::interrupt;
+use crate::minify;
+use crate::hooks::Hooks;
+use crate::memory::{self, MemStats};
+use crate::weak;
+use crate::resolver;
+use crate::dialect::{self, Equality, Overflow, Truthiness};
+use crate::stdlib;
+use crate::logging::{diagnostic, log, log_enabled, paint, warn_mixed_equality, warnings_as_errors, write_error, write_output, Level, Severity, RED};
 
 pub struct Interpreter {
   pub globals: Rc<RefCell<Environment>>,
   environment: Rc<RefCell<Environment>>,
   locals: HashMap<Expr, usize>,
+  // Lox calls currently on the stack
+  call_depth: usize,
+  // Set for untrusted code, such as runs from the playground
+  pub limits: Option<Limits>,
+  // The modules loaded into globals as namespaces, with the names each one
+  // exports, so the resolver can check qualified names
+  pub namespaces: HashMap<String, Vec<String>>,
+  // Instances whose toString is running, innermost last
+  printing: Vec<*const RefCell<LoxInstance>>,
+  // Lists passed to freeze(). A list has no room for a flag of its own, and
+  // holding a weak reference keeps its address from being reused.
+  frozen_lists: Vec<Weak<RefCell<Vec<LoxValue>>>>,
+  // Whether interpret() has reported a runtime error, which makes the run
+  // exit with 70
+  pub had_runtime_error: bool,
+  // Subscribers to the events in hooks.rs
+  hooks: Vec<Box<dyn Hooks>>,
+  // The offsets of the == and != operators -Wmixed-equality has warned
+  // about, so one in a loop is reported once
+  mixed_equality_warned: HashSet<usize>,
 }
 
+pub struct Limits {
+  pub deadline: Instant,
+  // Bytes `print` may still write
+  pub output_left: usize,
+}
+
+// Deeper recursion than this is reported instead of overflowing the native stack
+const MAX_CALL_DEPTH: usize = 1000;
+
 // This is the error type for "RunTime" errors in our itnerpreter
 #[derive(Debug)]
 pub enum InterpreterErrorType {
   FatalError,
+  // Raised by callables themselves (natives, argument binding), which don't
+  // know their call site. visitCallExpr re-attaches it to the call's paren.
+  CallError,
   ReturnValue(Box<LoxValue>),
+  // Raised by `?.` on nil and caught by the enclosing OptionalChainExpr
+  ShortCircuit,
+  // Unwinds to the innermost loop
+  Break,
+  // Ctrl-C was pressed. Holds each call it unwound through, innermost first.
+  Interrupted(Vec<String>),
+  // A value from `throw`, unwinding to the nearest catch clause that takes
+  // it, with the calls it has unwound through so far
+  Thrown(Box<LoxValue>, Vec<String>),
 }
 
 #[derive(Debug)]
@@ -37,8 +94,44 @@ impl InterpreterError {
     Self { final_token, message, error_type }
   }
 
+  pub fn call_error(callee: &str, message: String) -> Self {
+    Self::new_with_type(
+      Token::new(TokenType::Identifier, callee.to_string(), LoxValue::Nil, 0, 0),
+      message,
+      InterpreterErrorType::CallError,
+    )
+  }
+
+  // Raised when a sandboxed run goes over one of its Limits
+  pub fn limit_error(message: &str) -> Self {
+    Self::new(Token::new(TokenType::Eof, String::new(), LoxValue::Nil, 0, 0), message.to_string())
+  }
+
+  // Stops the run at the statement about to be executed
+  pub fn interrupted(stmt: &Stmt) -> Self {
+    let token = stmt.first_token().cloned().unwrap_or(Token::new(TokenType::Eof, String::new(), LoxValue::Nil, 0, 0));
+    Self::new_with_type(token, "Interrupted.".to_string(), InterpreterErrorType::Interrupted(Vec::new()))
+  }
+
   pub fn print(&self) {
-    eprintln!("Error at token: {}. INFO: {} ", &self.final_token, &self.message);
+    if let InterpreterErrorType::Interrupted(trace) = &self.error_type {
+      // An empty block has no token to give a line
+      let message = match self.final_token.line {
+        0 => "Interrupted.".to_string(),
+        line => format!("Interrupted at line {}.", line),
+      };
+      write_error(&paint(&message, RED));
+      for frame in trace {
+        write_error(&paint(&format!("  in {}", frame), RED));
+      }
+      return;
+    }
+    write_error(&paint(&format!("Error at token: {}. INFO: {} ", &self.final_token, &self.message), RED));
+    if let InterpreterErrorType::Thrown(_, trace) = &self.error_type {
+      for frame in trace {
+        write_error(&paint(&format!("  in {}", frame), RED));
+      }
+    }
   }
 }
 
@@ -49,20 +142,85 @@ impl Interpreter {
       "clock".to_string(),
       LoxValue::Callable(Rc::new(RefCell::new(Box::new(ClockCallable::new())))),
     );
+    define_natives(&mut globals);
     let globals_ref = Rc::new(RefCell::new(globals));
-    Self { globals: globals_ref.clone(), environment: globals_ref.clone(), locals: HashMap::new() }
+    let interpreter = Self { globals: globals_ref.clone(), environment: globals_ref.clone(), locals: HashMap::new(), call_depth: 0, limits: None, namespaces: HashMap::new(), printing: Vec::new(), frozen_lists: Vec::new(), had_runtime_error: false, hooks: Vec::new(), mixed_equality_warned: HashSet::new() };
+    stdlib::load(interpreter)
   }
 
-  pub fn interpret(&mut self, stmts: &Vec<Stmt>) {
-    for stmt in stmts {
-      let result = self.execute(stmt);
-      match result {
-        Ok(_) => {},
-        Err(err) => {
-          err.print();
-        }
+  pub fn interpret(&mut self, stmts: &[Stmt]) {
+    let start = Instant::now();
+    log(Level::Info, "run", &[("statements", stmts.len().into())]);
+    interrupt::arm();
+    // Hoisted functions and classes are declared first (see
+    // resolver::hoisted), and skipped where they appear
+    let hoisted = resolver::hoisted(stmts);
+    let first = stmts.iter().zip(&hoisted).filter(|(_, hoisted)| **hoisted);
+    let rest = stmts.iter().zip(&hoisted).filter(|(_, hoisted)| !**hoisted);
+    for (stmt, _) in first.chain(rest) {
+      if !self.run_top_level(stmt) {
+        break;
       }
     }
+    interrupt::disarm();
+    log(Level::Info, "finished", &[("elapsed_us", (start.elapsed().as_micros() as usize).into())]);
+  }
+
+  // Runs a statement of the script, reporting its error if it has one.
+  // Returns false when the rest of the run is abandoned.
+  fn run_top_level(&mut self, stmt: &Stmt) -> bool {
+    let result = self.execute(stmt);
+    self.finalize_handles();
+    if let Err(err) = result {
+      log(Level::Error, "runtime error", &[("line", err.final_token.line.into()), ("error", err.message.as_str().into())]);
+      err.print();
+      self.had_runtime_error = true;
+      for hooks in &mut self.hooks {
+        hooks.on_error(&err);
+      }
+      // The rest of the run is abandoned, not just this statement
+      if let InterpreterErrorType::Interrupted(_) = err.error_type {
+        self.reset();
+        return false;
+      }
+    }
+    true
+  }
+
+  // What the heap holds, and what's reachable from the scope running now
+  pub fn mem_stats(&self) -> MemStats {
+    memory::stats(&[self.globals.clone(), self.environment.clone()])
+  }
+
+  // Closes the files and sockets nothing can reach any more (see weak.rs).
+  // Only safe between top-level statements, when everything live is
+  // reachable from the scopes.
+  fn finalize_handles(&self) {
+    if weak::any_open() {
+      weak::close_unreachable(&memory::reachable_handles(&[self.globals.clone(), self.environment.clone()]));
+    }
+  }
+
+  // Sends the events in hooks.rs to `hooks` from now on
+  pub fn add_hooks(&mut self, hooks: Box<dyn Hooks>) {
+    self.hooks.push(hooks);
+  }
+
+  pub fn freeze_list(&mut self, list: &Rc<RefCell<Vec<LoxValue>>>) {
+    if !self.is_frozen(list) {
+      self.frozen_lists.retain(|frozen| frozen.strong_count() > 0);
+      self.frozen_lists.push(Rc::downgrade(list));
+    }
+  }
+
+  pub fn is_frozen(&self, list: &Rc<RefCell<Vec<LoxValue>>>) -> bool {
+    self.frozen_lists.iter().any(|frozen| std::ptr::eq(frozen.as_ptr(), Rc::as_ptr(list)))
+  }
+
+  // Drops back to the global scope after a run was abandoned partway through
+  pub fn reset(&mut self) {
+    self.environment = self.globals.clone();
+    self.call_depth = 0;
   }
 
   pub fn resolve(&mut self, expr: Expr, depth: usize) {
@@ -70,23 +228,69 @@ impl Interpreter {
   }
 
   pub fn execute(&mut self, stmt: &Stmt) -> Result<(), InterpreterError> {
+    if let Some(limits) = &self.limits {
+      if Instant::now() > limits.deadline {
+        return Err(InterpreterError::limit_error("Time limit exceeded."));
+      }
+    }
+    if interrupt::interrupted() {
+      return Err(InterpreterError::interrupted(stmt));
+    }
+    for hooks in &mut self.hooks {
+      hooks.on_statement(stmt);
+    }
     match stmt {
       Stmt::Block(stmt) => self.visitBlockStmt(stmt),
       Stmt::Expression(expr) => self.visitExpressionStmt(expr),
       Stmt::Print(expr) => self.visitPrintStmt(expr),
       Stmt::Return(expr) => self.visitReturnStmt(expr),
       Stmt::Var(expr) => self.visitVarStmt(expr),
+      Stmt::Destructure(expr) => self.visitDestructureStmt(expr),
       Stmt::Fun(expr) => self.visitFunStmt(expr),
       Stmt::If(expr) => self.visitIfStmt(expr),
       Stmt::While(expr) => self.visitWhileStmt(expr),
       Stmt::For(expr) => self.visitForStmt(expr),
       Stmt::Class(expr) => self.visitClassStmt(expr),
+      Stmt::Trait(expr) => self.visitTraitStmt(expr),
+      Stmt::Yield(expr) => self.visitYieldStmt(expr),
+      Stmt::ForIn(expr) => self.visitForInStmt(expr),
+      Stmt::DoWhile(expr) => self.visitDoWhileStmt(expr),
+      Stmt::Break(expr) => self.visitBreakStmt(expr),
+      Stmt::Try(expr) => self.visitTryStmt(expr),
+      Stmt::Throw(expr) => self.visitThrowStmt(expr),
+      Stmt::Using(expr) => self.visitUsingStmt(expr),
+    }
+  }
+
+  // Runs a module's statements in a scope of their own, resolved with
+  // Resolver::resolve_module, and defines a global by the module's name
+  // holding what they declared, so they're reached as `name.symbol`. Names
+  // starting with an underscore are private to the module and left out.
+  pub fn define_module(&mut self, name: &str, stmts: &[Stmt]) -> Result<(), InterpreterError> {
+    let env = Rc::new(RefCell::new(Environment::new_enclosed(self.globals.clone())));
+    let prev = std::mem::replace(&mut self.environment, env.clone());
+    let result = stmts.iter().try_for_each(|stmt| self.execute(stmt));
+    self.environment = prev;
+    result?;
+    let mut namespace = LoxInstance::new(LoxClass::new(name.to_string(), None, HashMap::new()));
+    let mut exports = Vec::new();
+    for (symbol, value) in env.borrow().values.iter() {
+      let name = symbol.to_string();
+      if !name.starts_with('_') {
+        namespace.set(name.clone(), value.clone());
+        exports.push(name);
+      }
     }
+    exports.sort();
+    self.namespaces.insert(name.to_string(), exports);
+    self.globals.borrow_mut().define(name.to_string(), LoxValue::Instance(Rc::new(RefCell::new(namespace))));
+    Ok(())
   }
 
   pub fn execute_block(&mut self, block: &BlockStmt, env: Rc<RefCell<Environment>>) -> Result<(), InterpreterError> {
     // Take current environment (replacing it with a dummy one temporarily)
     let prev = self.environment.clone();
+    log(Level::Debug, "scope", &[("statements", block.statements.len().into()), ("depth", self.call_depth.into())]);
     let enclosed_env = Environment::new_enclosed(Rc::clone(&env));
     self.environment = Rc::new(RefCell::new(enclosed_env));
     for statement in &*block.statements {
@@ -103,6 +307,132 @@ impl Interpreter {
     Ok(())
   }
 
+  // Calls an already evaluated callee with its arguments
+  fn call(&mut self, expr: &CallExpr, mut callee: LoxValue, arguments: Vec<LoxValue>, named: Vec<(String, LoxValue)>) -> Result<LoxValue, InterpreterError> {
+    let callable = callee.as_callable();
+    match callable {
+      Some(callable) if !named.is_empty() => {
+        let res = callable.borrow().call_named(self, arguments, named);
+        match res {
+          Ok(value) => Ok(*value),
+          Err(err) => match err.error_type {
+            InterpreterErrorType::CallError => Err(InterpreterError::new(expr.paren.clone(), err.message)),
+            _ => Err(err),
+          },
+        }
+      }
+      Some(callable) => {
+        if log_enabled(Level::Debug) {
+          log(Level::Debug, "call", &[
+            ("callee", callee.to_string().into()),
+            ("args", arguments.len().into()),
+            ("depth", self.call_depth.into()),
+            ("line", expr.paren.line.into()),
+          ]);
+        }
+        let (min_arity, arity) = (callable.borrow().min_arity(), callable.borrow().arity());
+        let variadic = callable.borrow().is_variadic();
+        if arguments.len() < min_arity || (arguments.len() > arity && !variadic) {
+          let expected = expected_arguments(min_arity, arity, variadic);
+          let mut message = format!("Expected {} arguments but got {}.", expected, arguments.len());
+          if let Some(declaration) = callable.borrow().declaration() {
+            message.push_str(&format!(" {}.", declaration));
+          }
+          return Err(InterpreterError::new(expr.paren.clone(), message));
+        }
+        let res = callable.borrow().call(self, arguments.clone());
+        match res {
+          Ok(value) => Ok(*value),
+          Err(err) => match err.error_type {
+            InterpreterErrorType::CallError => Err(InterpreterError::new(expr.paren.clone(), err.message)),
+            _ => Err(err),
+          },
+        }
+      }
+      _ => Err(InterpreterError::new(
+        expr.paren.clone(),
+        format!("{} is not callable.", callee),
+      )),
+    }
+  }
+
+  // A runtime error as an instance of the standard library's Error class, so
+  // a catch clause can handle it like a thrown one
+  fn error_instance(&mut self, message: &str) -> Result<LoxValue, InterpreterError> {
+    let std = self.globals.borrow().get("std").ok();
+    let error_class = match std {
+      Some(LoxValue::Instance(std)) => std.borrow().properties.get("Error").cloned(),
+      _ => None,
+    };
+    let Some(LoxValue::Class(class)) = error_class else {
+      return Ok(LoxValue::String(message.to_string()));
+    };
+    let mut instance = LoxInstance::new(class);
+    instance.set("message".to_string(), LoxValue::String(message.to_string()));
+    instance.set("stack".to_string(), LoxValue::List(Rc::new(RefCell::new(Vec::new()))));
+    Ok(LoxValue::Instance(Rc::new(RefCell::new(instance))))
+  }
+
+  // The body and its catch clauses. Runtime errors are caught too, as
+  // instances of Error; anything else unwinding through, like a return, a
+  // break or Ctrl-C, passes on by.
+  fn try_catch(&mut self, stmt: &TryStmt) -> Result<(), InterpreterError> {
+    let err = match self.execute_block(&stmt.body, self.environment.clone()) {
+      Ok(()) => return Ok(()),
+      Err(err) => err,
+    };
+    let (value, trace) = match &err.error_type {
+      InterpreterErrorType::Thrown(value, trace) => ((**value).clone(), trace.clone()),
+      InterpreterErrorType::FatalError | InterpreterErrorType::CallError => (self.error_instance(&err.message)?, Vec::new()),
+      _ => return Err(err),
+    };
+    for clause in &stmt.catches {
+      if let Some(class) = &clause.class {
+        let LoxValue::Class(class) = self.evaluate(class)? else {
+          return Err(InterpreterError::new(clause.name.clone(), format!("Can't catch by {}, which is not a class.", minify::source(class))));
+        };
+        match &value {
+          LoxValue::Instance(instance) if instance.borrow().class.is_subclass_of(&class) => (),
+          _ => continue,
+        }
+      }
+      // An Error learns where it was thrown from once something catches it
+      if let LoxValue::Instance(instance) = &value {
+        if instance.borrow().properties.contains_key("stack") {
+          let stack = trace.iter().cloned().map(LoxValue::String).collect();
+          instance.borrow_mut().set("stack".to_string(), LoxValue::List(Rc::new(RefCell::new(stack))));
+        }
+      }
+      let env = Rc::new(RefCell::new(Environment::new_enclosed(self.environment.clone())));
+      env.borrow_mut().define(clause.name.symbol, value);
+      return self.execute_block(&clause.body, env);
+    }
+    Err(err)
+  }
+
+  // Whether a loop body's result was a `break`; other errors pass through
+  pub fn broke_out(result: Result<(), InterpreterError>) -> Result<bool, InterpreterError> {
+    match result {
+      Ok(()) => Ok(false),
+      Err(InterpreterError { error_type: InterpreterErrorType::Break, .. }) => Ok(true),
+      Err(err) => Err(err),
+    }
+  }
+
+  pub fn execute_in(&mut self, stmt: &Stmt, env: Rc<RefCell<Environment>>) -> Result<(), InterpreterError> {
+    let prev = std::mem::replace(&mut self.environment, env);
+    let result = self.execute(stmt);
+    self.environment = prev;
+    result
+  }
+
+  pub fn evaluate_in(&mut self, expr: &Expr, env: Rc<RefCell<Environment>>) -> Result<LoxValue, InterpreterError> {
+    let prev = std::mem::replace(&mut self.environment, env);
+    let result = self.evaluate(expr);
+    self.environment = prev;
+    result
+  }
+
   // Okay so visitor pattern doesn't really need to be implemented here...
   pub fn evaluate(&mut self, expr: &Expr) -> Result<LoxValue, InterpreterError> {
     match expr {
@@ -110,6 +440,11 @@ impl Interpreter {
       Expr::Binary(expr) => self.visitBinaryExpr(expr),
       Expr::Call(expr) => self.visitCallExpr(expr),
       Expr::Get(expr) => self.visitGetExpr(expr),
+      Expr::OptionalGet(expr) => self.visitOptionalGetExpr(expr),
+      Expr::OptionalIndex(expr) => self.visitOptionalIndexExpr(expr),
+      Expr::OptionalChain(expr) => self.visitOptionalChainExpr(expr),
+      Expr::Match(expr) => self.visitMatchExpr(expr),
+      Expr::Comparison(expr) => self.visitComparisonExpr(expr),
       Expr::Set(expr) => self.visitSetExpr(expr),
       Expr::Grouping(expr) => self.visitGroupingExpr(expr),
       Expr::Literal(expr) => self.visitLiteralExpr(expr),
@@ -118,27 +453,268 @@ impl Interpreter {
       Expr::Logical(expr) => self.visitLogicalExpression(expr),
       Expr::Super(expr) => self.visitSuperExpression(expr),
       Expr::This(expr) => self.visitThisExpression(expr),
+      Expr::List(expr) => self.visitListExpr(expr),
+      Expr::SetLiteral(expr) => self.visitSetLiteralExpr(expr),
+      Expr::MapLiteral(expr) => self.visitMapLiteralExpr(expr),
+      Expr::Index(expr) => self.visitIndexExpr(expr),
+      Expr::IndexSet(expr) => self.visitIndexSetExpr(expr),
+      Expr::Spread(expr) => self.visitSpreadExpr(expr),
+      Expr::DestructureAssign(expr) => self.visitDestructureAssignExpr(expr),
+      Expr::Interpolation(expr) => self.visitInterpolationExpr(expr),
     }
   }
 
+  // nil and false are false, and with truthiness=empty so are zero, the
+  // empty string and empty lists, sets, maps and bytes
   pub fn is_truthy(value: LoxValue) -> bool {
     match value {
       LoxValue::Nil => false,
       LoxValue::Boolean(b) => b,
+      _ if dialect::truthiness() == Truthiness::Book => true,
+      LoxValue::Integer(n) => n != 0,
+      LoxValue::Number(n) => n != 0.0,
+      LoxValue::BigInt(n) => !n.is_zero(),
+      LoxValue::String(s) => !s.is_empty(),
+      LoxValue::List(list) => !list.borrow().is_empty(),
+      LoxValue::Set(set) => set.borrow().len() > 0,
+      LoxValue::Map(map) => map.borrow().len() > 0,
+      LoxValue::Bytes(bytes) => !bytes.borrow().data.is_empty(),
       _ => true,
     }
   }
 
+  // `==` compares lists element by element, sets and maps by their entries
+  // in any order, and everything else that lives behind a reference
+  // (instances, functions) by identity. With equality=identity, lists, sets,
+  // maps and bytes are only equal to themselves too. See identical() for the
+  // strict version.
+  // With -Wmixed-equality, warns about == or != between values that can
+  // never be equal because their types differ, like 1 == "1". Comparing with
+  // nil is how a missing value is checked for, so that's left alone. Under
+  // -Werror it's a runtime error instead.
+  fn check_mixed_equality(&mut self, operator: &Token, left: &LoxValue, right: &LoxValue) -> Result<(), InterpreterError> {
+    if !warn_mixed_equality() {
+      return Ok(());
+    }
+    let (Some(l), Some(r)) = (Interpreter::equality_kind(left), Interpreter::equality_kind(right)) else {
+      return Ok(());
+    };
+    if l == r || !self.mixed_equality_warned.insert(operator.offset) {
+      return Ok(());
+    }
+    let always = if operator.token_type == TokenType::EqualEqual { "false" } else { "true" };
+    let message = format!("Comparing {} with {} using '{}' is always {}.", left.type_name(), right.type_name(), operator.token, always);
+    if warnings_as_errors() {
+      return Err(InterpreterError::new(operator.clone(), message));
+    }
+    diagnostic(Severity::Warning, operator, &message);
+    Ok(())
+  }
+
+  // Values of the same kind can be equal; numbers are one kind however
+  // they're stored
+  fn equality_kind(value: &LoxValue) -> Option<&'static str> {
+    Some(match value {
+      LoxValue::Nil => return None,
+      LoxValue::Number(_) | LoxValue::Integer(_) | LoxValue::BigInt(_) => "number",
+      LoxValue::String(_) => "string",
+      LoxValue::Boolean(_) => "bool",
+      LoxValue::Callable(_) => "function",
+      LoxValue::Class(_) => "class",
+      LoxValue::Instance(_) => "instance",
+      LoxValue::List(_) => "list",
+      LoxValue::Set(_) => "set",
+      LoxValue::Map(_) => "map",
+      LoxValue::Bytes(_) => "bytes",
+      LoxValue::Generator(_) => "generator",
+    })
+  }
+
   pub fn is_equal(left: &LoxValue, right: &LoxValue) -> bool {
+    if dialect::equality() == Equality::Identity {
+      match (left, right) {
+        (LoxValue::List(l), LoxValue::List(r)) => return Rc::ptr_eq(l, r),
+        (LoxValue::Set(l), LoxValue::Set(r)) => return Rc::ptr_eq(l, r),
+        (LoxValue::Map(l), LoxValue::Map(r)) => return Rc::ptr_eq(l, r),
+        (LoxValue::Bytes(l), LoxValue::Bytes(r)) => return Rc::ptr_eq(l, r),
+        _ => {}
+      }
+    }
     match (left, right) {
       (LoxValue::Nil, LoxValue::Nil) => true,
       (LoxValue::Number(l), LoxValue::Number(r)) => l == r,
+      (LoxValue::Integer(l), LoxValue::Integer(r)) => l == r,
+      (LoxValue::BigInt(_), _) | (_, LoxValue::BigInt(_)) => match Interpreter::as_bigints(left, right) {
+        Some((l, r)) => l == r,
+        None => false,
+      },
+      (LoxValue::Integer(l), LoxValue::Number(r)) | (LoxValue::Number(r), LoxValue::Integer(l)) => *l as f64 == *r,
       (LoxValue::String(l), LoxValue::String(r)) => l == r,
       (LoxValue::Boolean(l), LoxValue::Boolean(r)) => l == r,
+      (LoxValue::List(l), LoxValue::List(r)) => {
+        if Rc::ptr_eq(l, r) {
+          return true;
+        }
+        let (l, r) = (l.borrow(), r.borrow());
+        l.len() == r.len() && l.iter().zip(r.iter()).all(|(a, b)| Interpreter::is_equal(a, b))
+      }
+      (LoxValue::Set(l), LoxValue::Set(r)) => Rc::ptr_eq(l, r) || l.borrow().same_elements(&r.borrow()),
+      (LoxValue::Bytes(l), LoxValue::Bytes(r)) => Rc::ptr_eq(l, r) || l.borrow().data == r.borrow().data,
+      (LoxValue::Map(l), LoxValue::Map(r)) => Rc::ptr_eq(l, r) || l.borrow().same_entries(&r.borrow()),
+      (LoxValue::Instance(l), LoxValue::Instance(r)) => Rc::ptr_eq(l, r),
+      (LoxValue::Callable(l), LoxValue::Callable(r)) => Rc::ptr_eq(l, r) || Interpreter::same_method(l, r),
+      (LoxValue::Class(l), LoxValue::Class(r)) => l == r,
+      _ => false,
+    }
+  }
+
+  // `obj.m == obj.m` though each lookup binds a new function: bound methods
+  // are equal when they're the same method of the same instance
+  fn same_method(left: &Rc<RefCell<Box<dyn LoxCallable>>>, right: &Rc<RefCell<Box<dyn LoxCallable>>>) -> bool {
+    match (left.borrow().bound_method(), right.borrow().bound_method()) {
+      (Some((l, this_l)), Some((r, this_r))) => Rc::ptr_eq(&l, &r) && Rc::ptr_eq(&this_l, &this_r),
       _ => false,
     }
   }
 
+  pub fn get_property(object: LoxValue, name: &Token) -> Result<LoxValue, InterpreterError> {
+    if let LoxValue::Instance(instance) = object {
+      return LoxInstance::get(instance, &name.token).map_err(|msg| InterpreterError::new(name.clone(), msg));
+    }
+    if let Some(method) = value_method(&object, &name.token) {
+      return Ok(method);
+    }
+    if let LoxValue::List(_) | LoxValue::Map(_) | LoxValue::Bytes(_) = object {
+      return Err(InterpreterError::new(name.clone(), format!("{} has no method '{}'.", object.type_name(), name.token)));
+    }
+    Err(InterpreterError::new(
+      name.clone(),
+      format!("{} is not an instance.", object),
+    ))
+  }
+
+  pub fn as_float(value: &LoxValue) -> Option<f64> {
+    match value {
+      LoxValue::Number(n) => Some(*n),
+      LoxValue::Integer(n) => Some(*n as f64),
+      LoxValue::BigInt(n) => Some(n.to_f64()),
+      _ => None,
+    }
+  }
+
+  // Some when at least one side is a bigint and the other is a bigint or an
+  // integer; floats never promote to bigints.
+  pub fn as_bigints(left: &LoxValue, right: &LoxValue) -> Option<(BigInt, BigInt)> {
+    match (left, right) {
+      (LoxValue::BigInt(l), LoxValue::BigInt(r)) => Some((l.clone(), r.clone())),
+      (LoxValue::BigInt(l), LoxValue::Integer(r)) => Some((l.clone(), BigInt::from_i64(*r))),
+      (LoxValue::Integer(l), LoxValue::BigInt(r)) => Some((BigInt::from_i64(*l), r.clone())),
+      _ => None,
+    }
+  }
+
+  // Integer operands stay integers unless the result overflows or, for '/',
+  // isn't whole; otherwise both sides are promoted to floats. What overflow
+  // does instead is up to the dialect. Returns None when either operand isn't
+  // a number.
+  pub fn arithmetic(operator: &TokenType, left: &LoxValue, right: &LoxValue) -> Result<Option<LoxValue>, String> {
+    Ok(match Interpreter::integer_arithmetic(operator, left, right)? {
+      Some(result) => Some(result),
+      None => Interpreter::float_arithmetic(operator, left, right),
+    })
+  }
+
+  // The result of arithmetic on integers or bigints, or None when it's done
+  // in floating point
+  fn integer_arithmetic(operator: &TokenType, left: &LoxValue, right: &LoxValue) -> Result<Option<LoxValue>, String> {
+    if let Some((l, r)) = Interpreter::as_bigints(left, right) {
+      let result = match operator {
+        TokenType::Plus => Some(l.add(&r)),
+        TokenType::Minus => Some(l.sub(&r)),
+        TokenType::Star => Some(l.mul(&r)),
+        TokenType::Slash => match l.div_rem(&r) {
+          Some((quotient, remainder)) if remainder.is_zero() => Some(quotient),
+          _ => None,
+        },
+        _ => None,
+      };
+      if let Some(n) = result {
+        return Ok(Some(LoxValue::BigInt(n)));
+      }
+    }
+    let (LoxValue::Integer(l), LoxValue::Integer(r)) = (left, right) else {
+      return Ok(None);
+    };
+    let (n, overflowed) = match operator {
+      TokenType::Plus => l.overflowing_add(*r),
+      TokenType::Minus => l.overflowing_sub(*r),
+      TokenType::Star => l.overflowing_mul(*r),
+      // A quotient that isn't whole is a float whatever the mode
+      TokenType::Slash if *r != 0 && l.wrapping_rem(*r) == 0 => l.overflowing_div(*r),
+      _ => return Ok(None),
+    };
+    if !overflowed {
+      return Ok(Some(LoxValue::Integer(n)));
+    }
+    match dialect::overflow() {
+      Overflow::Float => Ok(None),
+      Overflow::Wrap => Ok(Some(LoxValue::Integer(n))),
+      Overflow::Error => {
+        let symbol = match operator {
+          TokenType::Plus => "+",
+          TokenType::Minus => "-",
+          TokenType::Star => "*",
+          _ => "/",
+        };
+        Err(Interpreter::overflow_error(&format!("{} {} {}", l, symbol, r)))
+      }
+    }
+  }
+
+  fn overflow_error(operation: &str) -> String {
+    format!("Integer overflow in {}.", operation)
+  }
+
+  fn float_arithmetic(operator: &TokenType, left: &LoxValue, right: &LoxValue) -> Option<LoxValue> {
+    let (l, r) = (Interpreter::as_float(left)?, Interpreter::as_float(right)?);
+    match operator {
+      TokenType::Plus => Some(LoxValue::Number(l + r)),
+      TokenType::Minus => Some(LoxValue::Number(l - r)),
+      TokenType::Star => Some(LoxValue::Number(l * r)),
+      TokenType::Slash => Some(LoxValue::Number(l / r)),
+      _ => None,
+    }
+  }
+
+  fn arithmetic_at(&self, operator: &Token, left: &LoxValue, right: &LoxValue) -> Result<Option<LoxValue>, InterpreterError> {
+    Interpreter::arithmetic(&operator.token_type, left, right).map_err(|message| InterpreterError::new(operator.clone(), message))
+  }
+
+  pub fn compare(operator: &Token, left: &LoxValue, right: &LoxValue) -> Result<LoxValue, InterpreterError> {
+    let ordering = match (left, right) {
+      (LoxValue::Integer(l), LoxValue::Integer(r)) => l.partial_cmp(r),
+      _ if Interpreter::as_bigints(left, right).is_some() => {
+        let (l, r) = Interpreter::as_bigints(left, right).unwrap();
+        l.partial_cmp(&r)
+      }
+      _ => match (Interpreter::as_float(left), Interpreter::as_float(right)) {
+        (Some(l), Some(r)) => l.partial_cmp(&r),
+        _ => return Err(Interpreter::not_numbers_error(operator, left, right)),
+      },
+    };
+    let result = match ordering {
+      Some(ordering) => match operator.token_type {
+        TokenType::Greater => ordering == Ordering::Greater,
+        TokenType::GreaterEqual => ordering != Ordering::Less,
+        TokenType::Less => ordering == Ordering::Less,
+        TokenType::LessEqual => ordering != Ordering::Greater,
+        _ => false,
+      },
+      None => false,
+    };
+    Ok(LoxValue::Boolean(result))
+  }
+
   pub fn not_a_number_error(expr: &Token, val: &LoxValue) -> InterpreterError {
     InterpreterError::new(
       expr.clone(),
@@ -168,9 +744,284 @@ impl Interpreter {
     )
   }
 
+  // The values other than strings that + joins onto a string
+  fn concatenates(value: &LoxValue) -> bool {
+    matches!(value, LoxValue::Number(_) | LoxValue::Integer(_) | LoxValue::BigInt(_) | LoxValue::Instance(_))
+  }
+
+  // Instances may define a zero-argument toString() method to control how they
+  // are printed and concatenated, in a list, set or map as much as on their
+  // own. Everything else falls back to Display.
+  pub fn stringify(&mut self, value: &LoxValue) -> Result<String, InterpreterError> {
+    self.stringify_in(value, &mut Vec::new())
+  }
+
+  // `path` holds the lists, sets and maps being printed, which print as
+  // [...] where they come round again, as in Display
+  fn stringify_in(&mut self, value: &LoxValue, path: &mut Vec<*const ()>) -> Result<String, InterpreterError> {
+    let (address, open, close) = match value {
+      LoxValue::Instance(instance) => return match self.custom_string(instance)? {
+        Some(text) => Ok(text),
+        None => Ok(format!("{}", value)),
+      },
+      LoxValue::List(list) => (Rc::as_ptr(list) as *const (), "[", "]"),
+      LoxValue::Set(set) => (Rc::as_ptr(set) as *const (), "#{", "}"),
+      LoxValue::Map(map) => (Rc::as_ptr(map) as *const (), "{", "}"),
+      _ => return Ok(format!("{}", value)),
+    };
+    if path.contains(&address) {
+      return Ok(format!("{}...{}", open, close));
+    }
+    path.push(address);
+    let mut elements = Vec::new();
+    match value {
+      LoxValue::List(list) => {
+        for element in list.borrow().clone() {
+          elements.push(self.stringify_in(&element, path)?);
+        }
+      }
+      LoxValue::Set(set) => {
+        for element in set.borrow().values() {
+          elements.push(self.stringify_in(&element, path)?);
+        }
+      }
+      LoxValue::Map(map) => {
+        let entries: Vec<(LoxValue, LoxValue)> = map.borrow().entries().map(|(k, v)| (k.clone(), v.clone())).collect();
+        for (key, value) in entries {
+          elements.push(format!("{}: {}", self.stringify_in(&key, path)?, self.stringify_in(&value, path)?));
+        }
+      }
+      _ => unreachable!(),
+    }
+    path.pop();
+    Ok(format!("{}{}{}", open, elements.join(", "), close))
+  }
+
+  // What the instance's own toString() makes of it, or None when it has none.
+  // An instance whose toString ends up printing the instance again gets
+  // `Name {...}` there instead of recursing until the stack runs out.
+  pub fn custom_string(&mut self, instance: &Rc<RefCell<LoxInstance>>) -> Result<Option<String>, InterpreterError> {
+    let id = Rc::as_ptr(instance);
+    if self.printing.contains(&id) {
+      return Ok(Some(format!("{} {{...}}", instance.borrow().class.name)));
+    }
+    if let Ok(LoxValue::Callable(method)) = LoxInstance::get(instance.clone(), "toString") {
+      if method.borrow().min_arity() == 0 {
+        self.printing.push(id);
+        let result = method.borrow().call(self, Vec::new());
+        self.printing.pop();
+        return Ok(Some(format!("{}", result?)));
+      }
+    }
+    Ok(None)
+  }
+
+  // Evaluates argument or element expressions, flattening `...list` spreads
+  fn evaluate_spreadable(&mut self, exprs: &Vec<Expr>) -> Result<Vec<LoxValue>, InterpreterError> {
+    let mut values = Vec::new();
+    for expr in exprs {
+      if let Expr::Spread(spread) = expr {
+        match self.evaluate(&spread.expression)? {
+          LoxValue::List(list) => values.extend(list.borrow().iter().cloned()),
+          LoxValue::Set(set) => values.extend(set.borrow().values()),
+          LoxValue::Bytes(bytes) => values.extend(bytes.borrow().data.iter().map(|b| LoxValue::Integer(*b as i64))),
+          other => return Err(InterpreterError::new(
+            spread.ellipsis.clone(),
+            format!("Can only spread a list, set or bytes, not {}.", other),
+          )),
+        }
+      } else {
+        values.push(self.evaluate(expr)?);
+      }
+    }
+    Ok(values)
+  }
+
+  // Checks `index` against a list or bytes of length `len`, `kind` saying which
+  pub fn list_index(bracket: &Token, kind: &str, len: usize, index: &LoxValue) -> Result<usize, InterpreterError> {
+    match Interpreter::list_position(kind, len, index) {
+      Ok(Some(i)) => Ok(i),
+      Ok(None) => Err(InterpreterError::new(bracket.clone(), format!("{} index {} out of range.", kind, index))),
+      Err(message) => Err(InterpreterError::new(bracket.clone(), message)),
+    }
+  }
+
+  // Where `index` is in a list of `len` elements, or None when it's out of
+  // range. Only an index that isn't a number is an error.
+  pub fn list_position(kind: &str, len: usize, index: &LoxValue) -> Result<Option<usize>, String> {
+    match index {
+      LoxValue::Integer(n) if *n >= 0 && (*n as usize) < len => Ok(Some(*n as usize)),
+      LoxValue::Number(n) if n.fract() == 0.0 && *n >= 0.0 && (*n as usize) < len => Ok(Some(*n as usize)),
+      LoxValue::Integer(_) | LoxValue::Number(_) => Ok(None),
+      _ => Err(format!("{} index {} must be a number.", kind, index)),
+    }
+  }
+
+  // Checks `value` against `pattern`, collecting the names it binds
+  fn match_pattern(&mut self, pattern: &Pattern, value: &LoxValue, bindings: &mut Vec<(String, LoxValue)>) -> Result<bool, InterpreterError> {
+    match pattern {
+      Pattern::Wildcard => Ok(true),
+      Pattern::Literal(literal) => Ok(Interpreter::is_equal(&literal.literal, value)),
+      Pattern::Binding(variable) => {
+        bindings.push((variable.name.token.clone(), value.clone()));
+        Ok(true)
+      }
+      Pattern::List(list) => {
+        let elements = match value {
+          LoxValue::List(elements) => elements.borrow().clone(),
+          _ => return Ok(false),
+        };
+        let count = list.elements.len();
+        if elements.len() < count || (list.rest.is_none() && elements.len() != count) {
+          return Ok(false);
+        }
+        for (pattern, element) in list.elements.iter().zip(elements.iter()) {
+          if !self.match_pattern(pattern, element, bindings)? {
+            return Ok(false);
+          }
+        }
+        if let Some(rest) = &list.rest {
+          let rest_list = LoxValue::List(Rc::new(RefCell::new(elements[count..].to_vec())));
+          bindings.push((rest.name.token.clone(), rest_list));
+        }
+        Ok(true)
+      }
+      Pattern::Class(pattern) => {
+        let class = match self.evaluate(&Expr::Variable(pattern.class.clone()))? {
+          LoxValue::Class(class) => class,
+          other => return Err(InterpreterError::new(
+            pattern.class.name.clone(),
+            format!("{} is not a class.", other),
+          )),
+        };
+        let instance = match value {
+          LoxValue::Instance(instance) if instance.borrow().class.is_subclass_of(&class) => instance.clone(),
+          _ => return Ok(false),
+        };
+        for (field, pattern) in &pattern.fields {
+          let field_value = instance.borrow().properties.get(&field.token).cloned();
+          match field_value {
+            Some(field_value) if self.match_pattern(pattern, &field_value, bindings)? => {}
+            _ => return Ok(false),
+          }
+        }
+        Ok(true)
+      }
+      // Keys the pattern doesn't name are allowed, and go to the rest name if
+      // there is one
+      Pattern::Map(pattern) => {
+        let map = match value {
+          LoxValue::Map(map) => map.borrow().clone(),
+          _ => return Ok(false),
+        };
+        let error = |message| InterpreterError::new(pattern.brace.clone(), message);
+        let mut rest = map.thawed();
+        for (key, entry_pattern) in &pattern.entries {
+          match map.get(&key.literal, self).map_err(error)? {
+            Some(entry) if self.match_pattern(entry_pattern, &entry, bindings)? => {}
+            _ => return Ok(false),
+          }
+          rest.remove(&key.literal, self).map_err(error)?;
+        }
+        if let Some(name) = &pattern.rest {
+          bindings.push((name.name.token.clone(), LoxValue::Map(Rc::new(RefCell::new(rest)))));
+        }
+        Ok(true)
+      }
+    }
+  }
+
+  // `key` is the expression the resolver recorded the distance for
+  fn assign_variable(&mut self, name: &Token, key: &Expr, value: LoxValue) -> Result<(), InterpreterError> {
+    let res = match self.locals.get(key) {
+      Some(distance) => self.environment.borrow_mut().assign_at(*distance, name.symbol, value),
+      None => {
+        let assigned = self.globals.borrow_mut().assign(name.symbol, value);
+        assigned.map_err(|msg| self.suggest_name(msg, name))
+      }
+    };
+    match res {
+      Ok(()) => Ok(()),
+      Err(msg) => Err(InterpreterError::new(name.clone(), msg)),
+    }
+  }
+
+  // An error for a global that isn't defined, naming the closest variable
+  // that is, local or global
+  fn suggest_name(&self, message: String, name: &Token) -> String {
+    if self.globals.borrow().values.contains_key(&name.symbol) {
+      return message;
+    }
+    match resolver::closest(&name.token, &self.environment.borrow().visible_names()) {
+      Some(suggestion) => format!("{} Did you mean '{}'?", message, suggestion),
+      None => message,
+    }
+  }
+
+  // Splits a list into one value per pattern name, the rest name taking a list of the remainder.
+  // A map pattern takes the value of each key instead, the rest name a map of the others.
+  fn unpack(&self, pattern: &DestructurePattern, value: &LoxValue) -> Result<Vec<LoxValue>, InterpreterError> {
+    if let Some(keys) = &pattern.keys {
+      return self.unpack_map(pattern, keys, value);
+    }
+    let list = match value {
+      LoxValue::List(list) => list.borrow().clone(),
+      other => return Err(InterpreterError::new(
+        pattern.bracket.clone(),
+        format!("Can only destructure a list, not {}.", other),
+      )),
+    };
+    let count = pattern.targets.len();
+    if list.len() < count || (list.len() > count && pattern.rest.is_none()) {
+      return Err(InterpreterError::new(
+        pattern.bracket.clone(),
+        format!("Expected {} values to unpack but got {}.", count, list.len()),
+      ));
+    }
+    let mut values: Vec<LoxValue> = list[..count].to_vec();
+    if pattern.rest.is_some() {
+      values.push(LoxValue::List(Rc::new(RefCell::new(list[count..].to_vec()))));
+    }
+    Ok(values)
+  }
+
+  fn unpack_map(&self, pattern: &DestructurePattern, keys: &[Token], value: &LoxValue) -> Result<Vec<LoxValue>, InterpreterError> {
+    let map = match value {
+      LoxValue::Map(map) => map.borrow().clone(),
+      other => return Err(InterpreterError::new(
+        pattern.bracket.clone(),
+        format!("Can only destructure a map, not {}.", other),
+      )),
+    };
+    let mut rest = map.thawed();
+    let mut values = Vec::new();
+    for key in keys {
+      let name = LoxValue::String(key.token.clone());
+      match map.get(&name, self).map_err(|message| InterpreterError::new(key.clone(), message))? {
+        Some(value) => values.push(value),
+        None => return Err(InterpreterError::new(key.clone(), format!("Map has no key {} to unpack.", key.token))),
+      }
+      rest.remove(&name, self).map_err(|message| InterpreterError::new(key.clone(), message))?;
+    }
+    if pattern.rest.is_some() {
+      values.push(LoxValue::Map(Rc::new(RefCell::new(rest))));
+    }
+    Ok(values)
+  }
+
   pub fn look_up_variable(&self, name: &Token, expr: &Expr) -> Result<LoxValue, InterpreterError> {
-    if let Some(distance) = self.locals.get(expr) {
-      let value = self.environment.borrow().get_at(*distance, &name.token);
+    // The resolver's table is the lookup cache: a hit goes straight to the
+    // right environment, a miss falls back to the globals
+    let distance = self.locals.get(expr);
+    if log_enabled(Level::Debug) {
+      log(Level::Debug, "lookup", &[
+        ("name", name.token.as_str().into()),
+        ("line", name.line.into()),
+        ("hit", distance.is_some().into()),
+      ]);
+    }
+    if let Some(distance) = distance {
+      let value = self.environment.borrow().get_at(*distance, name.symbol);
       match value {
         Ok(v) => {
           return Ok(v);
@@ -181,12 +1032,12 @@ impl Interpreter {
         )),
       }
     }
-    let value = self.globals.borrow().get(&name.token.clone());
+    let value = self.globals.borrow().get(name.symbol);
     match value {
       Ok(v) => Ok(v),
       Err(msg) => Err(InterpreterError::new(
         name.clone(),
-        msg,
+        self.suggest_name(msg, name),
       )),
     }
   }
@@ -197,11 +1048,18 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
     match &expr.literal {
       LoxValue::Nil => Ok(LoxValue::Nil),
       LoxValue::Number(n) => Ok(LoxValue::Number(n.clone())),
+      LoxValue::Integer(n) => Ok(LoxValue::Integer(n.clone())),
+      LoxValue::BigInt(n) => Ok(LoxValue::BigInt(n.clone())),
       LoxValue::String(s) => Ok(LoxValue::String(s.clone())),
       LoxValue::Callable(c) => Ok(LoxValue::Callable(c.clone())),
       LoxValue::Boolean(b) => Ok(LoxValue::Boolean(b.clone())),
       LoxValue::Class(c) => Ok(LoxValue::Class(c.clone())),
       LoxValue::Instance(c) => Ok(LoxValue::Instance(c.clone())),
+      LoxValue::List(l) => Ok(LoxValue::List(l.clone())),
+      LoxValue::Set(s) => Ok(LoxValue::Set(s.clone())),
+      LoxValue::Map(m) => Ok(LoxValue::Map(m.clone())),
+      LoxValue::Bytes(b) => Ok(LoxValue::Bytes(b.clone())),
+      LoxValue::Generator(g) => Ok(LoxValue::Generator(g.clone())),
     }
   }
 
@@ -213,7 +1071,18 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
     let right = self.evaluate(&expr.right)?;
     match expr.operator.token_type {
       TokenType::Minus => {
-        if let LoxValue::Number(n) = right {
+        if let LoxValue::Integer(n) = right {
+          return Ok(match (n.checked_neg(), dialect::overflow()) {
+            (Some(n), _) => LoxValue::Integer(n),
+            (None, Overflow::Float) => LoxValue::Number(-(n as f64)),
+            (None, Overflow::Wrap) => LoxValue::Integer(n.wrapping_neg()),
+            (None, Overflow::Error) => {
+              return Err(InterpreterError::new(expr.operator.clone(), Interpreter::overflow_error(&format!("-({})", n))));
+            }
+          });
+        } else if let LoxValue::BigInt(n) = right {
+          return Ok(LoxValue::BigInt(n.neg()));
+        } else if let LoxValue::Number(n) = right {
           return Ok(LoxValue::Number(-n));
         } else {
           return Err(Interpreter::not_a_number_error(&expr.operator, &right));
@@ -233,12 +1102,19 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
 
     match expr.operator.token_type {
       TokenType::Plus => {
-        if let (LoxValue::Number(l), LoxValue::Number(r)) = (&left, &right) {
-          return Ok(LoxValue::Number(l + r));
+        if let Some(result) = self.arithmetic_at(&expr.operator, &left, &right)? {
+          return Ok(result);
         }
         if let (LoxValue::String(l), LoxValue::String(r)) = (&left, &right) {
           return Ok(LoxValue::String(format!("{}{}", l, r)));
         }
+        // A string joins with a number or an instance the way print shows it
+        if let (LoxValue::String(l), true) = (&left, Interpreter::concatenates(&right)) {
+          return Ok(LoxValue::String(format!("{}{}", l, self.stringify(&right)?)));
+        }
+        if let (true, LoxValue::String(r)) = (Interpreter::concatenates(&left), &right) {
+          return Ok(LoxValue::String(format!("{}{}", self.stringify(&left)?, r)));
+        }
         return Err(Interpreter::not_numbers_or_strings_error(
           &expr.operator,
           &left,
@@ -246,8 +1122,8 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
         ));
       }
       TokenType::Minus => {
-        if let (LoxValue::Number(l), LoxValue::Number(r)) = (&left, &right) {
-          return Ok(LoxValue::Number(l - r));
+        if let Some(result) = self.arithmetic_at(&expr.operator, &left, &right)? {
+          return Ok(result);
         } else {
           return Err(Interpreter::not_numbers_error(
             &expr.operator,
@@ -257,8 +1133,8 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
         }
       }
       TokenType::Star => {
-        if let (LoxValue::Number(l), LoxValue::Number(r)) = (&left, &right) {
-          return Ok(LoxValue::Number(l * r));
+        if let Some(result) = self.arithmetic_at(&expr.operator, &left, &right)? {
+          return Ok(result);
         } else {
           return Err(Interpreter::not_numbers_error(
             &expr.operator,
@@ -268,8 +1144,8 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
         }
       }
       TokenType::Slash => {
-        if let (LoxValue::Number(l), LoxValue::Number(r)) = (&left, &right) {
-          return Ok(LoxValue::Number(l / r));
+        if let Some(result) = self.arithmetic_at(&expr.operator, &left, &right)? {
+          return Ok(result);
         } else {
           return Err(Interpreter::not_numbers_error(
             &expr.operator,
@@ -278,55 +1154,28 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
           ));
         }
       }
+      TokenType::Is => {
+        if let LoxValue::Class(class) = &right {
+          return Ok(LoxValue::Boolean(match &left {
+            LoxValue::Instance(instance) => instance.borrow().class.is_subclass_of(class),
+            _ => false,
+          }));
+        }
+        return Err(InterpreterError::new(
+          expr.operator.clone(),
+          format!("Right operand of 'is' must be a class but got {}.", right),
+        ));
+      }
       TokenType::BangEqual => {
+        self.check_mixed_equality(&expr.operator, &left, &right)?;
         return Ok(LoxValue::Boolean(!Interpreter::is_equal(&left, &right)));
       }
       TokenType::EqualEqual => {
+        self.check_mixed_equality(&expr.operator, &left, &right)?;
         return Ok(LoxValue::Boolean(Interpreter::is_equal(&left, &right)));
       }
-      TokenType::Greater => {
-        if let (LoxValue::Number(l), LoxValue::Number(r)) = (&left, &right) {
-          return Ok(LoxValue::Boolean(l > r));
-        } else {
-          return Err(Interpreter::not_numbers_error(
-            &expr.operator,
-            &left,
-            &right,
-          ));
-        }
-      }
-      TokenType::GreaterEqual => {
-        if let (LoxValue::Number(l), LoxValue::Number(r)) = (&left, &right) {
-          return Ok(LoxValue::Boolean(l >= r));
-        } else {
-          return Err(Interpreter::not_numbers_error(
-            &expr.operator,
-            &left,
-            &right,
-          ));
-        }
-      }
-      TokenType::Less => {
-        if let (LoxValue::Number(l), LoxValue::Number(r)) = (&left, &right) {
-          return Ok(LoxValue::Boolean(l < r));
-        } else {
-          return Err(Interpreter::not_numbers_error(
-            &expr.operator,
-            &left,
-            &right,
-          ));
-        }
-      }
-      TokenType::LessEqual => {
-        if let (LoxValue::Number(l), LoxValue::Number(r)) = (&left, &right) {
-          return Ok(LoxValue::Boolean(l <= r));
-        } else {
-          return Err(Interpreter::not_numbers_error(
-            &expr.operator,
-            &left,
-            &right,
-          ));
-        }
+      TokenType::Greater | TokenType::GreaterEqual | TokenType::Less | TokenType::LessEqual => {
+        return Interpreter::compare(&expr.operator, &left, &right);
       }
       _ => {}
     }
@@ -335,56 +1184,131 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
   }
 
   fn visitCallExpr(&mut self, expr: &CallExpr) -> Result<LoxValue, InterpreterError> {
-    let mut callee = self.evaluate(&expr.callee)?;
-    let mut arguments = Vec::new();
-    for arg in &expr.arguments {
-      arguments.push(self.evaluate(arg)?);
+    let callee = self.evaluate(&expr.callee)?;
+    let arguments = self.evaluate_spreadable(&expr.arguments)?;
+    let mut named = Vec::new();
+    for (name, arg) in &expr.named_arguments {
+      named.push((name.token.clone(), self.evaluate(arg)?));
     }
-    let callable = callee.as_callable();
-    match callable {
-      Some(callable) => {
-        // println!("Callable: {:?}", callable);
-        if arguments.len() != callable.borrow().arity() {
-          return Err(InterpreterError::new(
-            expr.paren.clone(),
-            format!(
-              "Expected {} arguments but got {}.",
-              callable.borrow().arity(),
-              arguments.len()
-            ),
-          ));
-        }
-        let res = callable.borrow_mut().call(self, arguments.clone());
-        Ok(*res)
+    if self.call_depth == MAX_CALL_DEPTH {
+      return Err(InterpreterError::new(expr.paren.clone(), "Stack overflow.".to_string()));
+    }
+    self.call_depth += 1;
+    // The callee only needs keeping for on_return when someone's listening
+    let hooked = if self.hooks.is_empty() { None } else { Some(callee.clone()) };
+    if let Some(callee) = &hooked {
+      for hooks in &mut self.hooks {
+        hooks.on_call(callee, &arguments, expr.paren.line);
       }
-      _ => Err(InterpreterError::new(
-        expr.paren.clone(),
-        format!("{} is not callable.", callee),
-      )),
     }
+    let mut result = self.call(expr, callee, arguments, named);
+    if let Some(callee) = &hooked {
+      for hooks in &mut self.hooks {
+        hooks.on_return(callee, result.as_ref());
+      }
+    }
+    self.call_depth -= 1;
+    if let Err(InterpreterError { error_type: InterpreterErrorType::Interrupted(trace) | InterpreterErrorType::Thrown(_, trace), .. }) = &mut result {
+      trace.push(format!("{} (line {})", minify::source(&expr.callee), expr.paren.line));
+    }
+    result
   }
 
   fn visitGetExpr(&mut self, expr: &GetExpr) -> Result<LoxValue, InterpreterError> {
     let object = self.evaluate(&expr.object)?;
-    if let LoxValue::Instance(instance) = object {
-      match LoxInstance::get(instance, &expr.name.token) {
-        Ok(value) => return Ok(value),
-        Err(msg) => return Err(InterpreterError::new(
-          expr.name.clone(),
-          msg,
-        )),
+    Interpreter::get_property(object, &expr.name)
+  }
+
+  fn visitOptionalGetExpr(&mut self, expr: &OptionalGetExpr) -> Result<LoxValue, InterpreterError> {
+    let object = self.evaluate(&expr.object)?;
+    if object == LoxValue::Nil {
+      return Err(InterpreterError::new_with_type(
+        expr.name.clone(),
+        String::new(),
+        InterpreterErrorType::ShortCircuit,
+      ));
+    }
+    Interpreter::get_property(object, &expr.name)
+  }
+
+  fn visitOptionalIndexExpr(&mut self, expr: &OptionalIndexExpr) -> Result<LoxValue, InterpreterError> {
+    let object = self.evaluate(&expr.object)?;
+    let index = self.evaluate(&expr.index)?;
+    let element = match &object {
+      LoxValue::Nil => None,
+      LoxValue::List(list) => {
+        let list = list.borrow();
+        Interpreter::list_position("List", list.len(), &index)
+          .map_err(|message| InterpreterError::new(expr.bracket.clone(), message))?
+          .map(|i| list[i].clone())
+      }
+      LoxValue::Bytes(bytes) => {
+        let bytes = bytes.borrow();
+        Interpreter::list_position("Bytes", bytes.data.len(), &index)
+          .map_err(|message| InterpreterError::new(expr.bracket.clone(), message))?
+          .map(|i| LoxValue::Integer(bytes.data[i] as i64))
       }
+      LoxValue::Map(map) => map.borrow().get(&index, self).map_err(|message| InterpreterError::new(expr.bracket.clone(), message))?,
+      _ => return Err(InterpreterError::new(expr.bracket.clone(), format!("{} is not a list or a map.", object))),
+    };
+    element.ok_or_else(|| InterpreterError::new_with_type(expr.bracket.clone(), String::new(), InterpreterErrorType::ShortCircuit))
+  }
+
+  fn visitOptionalChainExpr(&mut self, expr: &OptionalChainExpr) -> Result<LoxValue, InterpreterError> {
+    match self.evaluate(&expr.expression) {
+      Err(InterpreterError { error_type: InterpreterErrorType::ShortCircuit, .. }) => Ok(LoxValue::Nil),
+      result => result,
+    }
+  }
+
+  fn visitMatchExpr(&mut self, expr: &MatchExpr) -> Result<LoxValue, InterpreterError> {
+    let subject = self.evaluate(&expr.subject)?;
+    for arm in &expr.arms {
+      let mut bindings = Vec::new();
+      if !self.match_pattern(&arm.pattern, &subject, &mut bindings)? {
+        continue;
+      }
+      let env = Rc::new(RefCell::new(Environment::new_enclosed(self.environment.clone())));
+      for (name, value) in bindings {
+        env.borrow_mut().define(name, value);
+      }
+      if let Some(guard) = &arm.guard {
+        if !Interpreter::is_truthy(self.evaluate_in(guard, env.clone())?) {
+          continue;
+        }
+      }
+      return self.evaluate_in(&arm.body, env);
     }
     Err(InterpreterError::new(
-      expr.name.clone(),
-      format!("{} is not an instance.", object),
+      expr.keyword.clone(),
+      format!("No match arm matched {}.", subject),
     ))
   }
 
+  // Stops at the first comparison that's false, leaving the operands after it
+  // unevaluated, as `and` would
+  fn visitComparisonExpr(&mut self, expr: &ComparisonExpr) -> Result<LoxValue, InterpreterError> {
+    let mut left = self.evaluate(&expr.left)?;
+    for (operator, right) in &expr.comparisons {
+      let right = self.evaluate(right)?;
+      if !Interpreter::is_truthy(Interpreter::compare(operator, &left, &right)?) {
+        return Ok(LoxValue::Boolean(false));
+      }
+      left = right;
+    }
+    Ok(LoxValue::Boolean(true))
+  }
+
   fn visitSetExpr(&mut self, expr: &SetExpr) -> Result<LoxValue, InterpreterError> {
     let object = self.evaluate(&expr.object)?;
-    if let LoxValue::Instance(mut instance) = object {
+    if let LoxValue::Instance(instance) = object {
       let value = self.evaluate(&expr.value)?;
+      if instance.borrow().frozen {
+        return Err(InterpreterError::new(
+          expr.name.clone(),
+          format!("Can't set '{}' on a frozen {}.", expr.name.token, instance.borrow()),
+        ));
+      }
       instance.borrow_mut().set(expr.name.token.clone(), value.clone());
       return Ok(value);
     }
@@ -400,30 +1324,35 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
 
   fn visitAssignExpression(&mut self, expr: &AssignExpr) -> Result<LoxValue, InterpreterError> {
     let value = self.evaluate(&expr.value)?;
-    let distance = self.locals.get(&Expr::Assign(expr.clone()));
-    if let Some(distance) = distance {
-      let res = self.environment.borrow_mut().assign_at(*distance, expr.name.token.clone(), value.clone());
-      if let Err(msg) = res {
-        return Err(InterpreterError::new(
-          expr.name.clone(),
-          msg,
-        ));
-      }
-    } else {
-      let res = self.globals.borrow_mut().assign(expr.name.token.clone(), value.clone());
-      if let Err(msg) = res {
-        return Err(InterpreterError::new(
-          expr.name.clone(),
-          msg,
-        ));
-      }
+    self.assign_variable(&expr.name, &Expr::Assign(expr.clone()), value.clone())?;
+    Ok(value)
+  }
+
+  fn visitInterpolationExpr(&mut self, expr: &InterpolationExpr) -> Result<LoxValue, InterpreterError> {
+    let mut result = String::new();
+    for part in &expr.parts {
+      let value = self.evaluate(part)?;
+      result.push_str(&self.stringify(&value)?);
+    }
+    Ok(LoxValue::String(result))
+  }
+
+  fn visitDestructureAssignExpr(&mut self, expr: &DestructureAssignExpr) -> Result<LoxValue, InterpreterError> {
+    let value = self.evaluate(&expr.value)?;
+    let values = self.unpack(&expr.pattern, &value)?;
+    for (target, element) in expr.pattern.names().into_iter().zip(values) {
+      self.assign_variable(&target.name, &Expr::Variable(target.clone()), element)?;
     }
     Ok(value)
   }
 
   fn visitLogicalExpression(&mut self, expr: &LogicalExpr) -> Result<LoxValue, InterpreterError> {
     let left = self.evaluate(&expr.left)?;
-    if expr.operator.token_type == TokenType::Or {
+    if expr.operator.token_type == TokenType::QuestionQuestion {
+      if left != LoxValue::Nil {
+        return Ok(left);
+      }
+    } else if expr.operator.token_type == TokenType::Or {
       if Interpreter::is_truthy(left.clone()) {
         return Ok(left);
       }
@@ -438,24 +1367,24 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
   fn visitSuperExpression(&mut self, expr: &SuperExpr) -> Result<LoxValue, InterpreterError> {
       let distance = self.locals.get(&Expr::Super(expr.clone()));
       if let Some(distance) = distance {
-        let superclass = self.environment.borrow().get_at(*distance, "super");
+        let superclass = self.environment.borrow().get_at(*distance, symbol::SUPER);
         match superclass {
           Ok(superclass) => {
             if let LoxValue::Class(sc) = superclass {
-              let instance = self.environment.borrow().get_at(*distance - 1, "this");
+              let instance = self.environment.borrow().get_at(*distance - 1, symbol::THIS);
               match instance {
                 Ok(instance) => {
                   if let LoxValue::Instance(instance) = instance {
                     let object = instance;
-                    let method = sc.methods.get(&expr.method.token);
+                    let method = sc.find_method(&expr.method.token);
                     match method {
                       Some(method) => {
-                        return Ok(LoxValue::Callable(Rc::new(RefCell::new(Box::new(method.clone().bind(object.clone()))))))
+                        return Ok(LoxValue::Callable(Rc::new(RefCell::new(Box::new(method.bind(object.clone()))))))
                       }
                       None => {
                         return Err(InterpreterError::new(
                           expr.method.clone(),
-                          format!("Undefined property '{}'.", expr.method.token),
+                          sc.undefined_method(&expr.method.token),
                         ));
                       }
                     }
@@ -489,6 +1418,97 @@ impl ExprVisitor<Result<LoxValue, InterpreterError>> for Interpreter {
     let value = self.look_up_variable(&expr.keyword, &Expr::This(expr.clone()))?;
     Ok(value)
   }
+
+  fn visitListExpr(&mut self, expr: &ListExpr) -> Result<LoxValue, InterpreterError> {
+    let elements = self.evaluate_spreadable(&expr.elements)?;
+    Ok(LoxValue::List(Rc::new(RefCell::new(elements))))
+  }
+
+  fn visitSetLiteralExpr(&mut self, expr: &SetLiteralExpr) -> Result<LoxValue, InterpreterError> {
+    let elements = self.evaluate_spreadable(&expr.elements)?;
+    let set = LoxSet::from_values(elements, self).map_err(|message| InterpreterError::new(expr.brace.clone(), message))?;
+    Ok(LoxValue::Set(Rc::new(RefCell::new(set))))
+  }
+
+  fn visitMapLiteralExpr(&mut self, expr: &MapLiteralExpr) -> Result<LoxValue, InterpreterError> {
+    let mut map = LoxMap::new();
+    for (key, value) in &expr.entries {
+      let key = self.evaluate(key)?;
+      let value = self.evaluate(value)?;
+      map.insert(key, value, self).map_err(|message| InterpreterError::new(expr.brace.clone(), message))?;
+    }
+    Ok(LoxValue::Map(Rc::new(RefCell::new(map))))
+  }
+
+  // The parser only produces spreads where evaluate_spreadable handles them
+  fn visitSpreadExpr(&mut self, expr: &SpreadExpr) -> Result<LoxValue, InterpreterError> {
+    Err(InterpreterError::new(
+      expr.ellipsis.clone(),
+      "Spread is only allowed in argument lists and list literals.".to_string(),
+    ))
+  }
+
+  fn visitIndexExpr(&mut self, expr: &IndexExpr) -> Result<LoxValue, InterpreterError> {
+    let object = self.evaluate(&expr.object)?;
+    let index = self.evaluate(&expr.index)?;
+    if let LoxValue::List(list) = object {
+      let list = list.borrow();
+      let i = Interpreter::list_index(&expr.bracket, "List", list.len(), &index)?;
+      return Ok(list[i].clone());
+    }
+    if let LoxValue::Bytes(bytes) = object {
+      let bytes = bytes.borrow();
+      let i = Interpreter::list_index(&expr.bracket, "Bytes", bytes.data.len(), &index)?;
+      return Ok(LoxValue::Integer(bytes.data[i] as i64));
+    }
+    if let LoxValue::Map(map) = object {
+      let value = map.borrow().get(&index, self).map_err(|message| InterpreterError::new(expr.bracket.clone(), message))?;
+      return value.ok_or_else(|| InterpreterError::new(expr.bracket.clone(), format!("Map has no key {}.", index)));
+    }
+    Err(InterpreterError::new(
+      expr.bracket.clone(),
+      format!("{} is not a list or a map.", object),
+    ))
+  }
+
+  fn visitIndexSetExpr(&mut self, expr: &IndexSetExpr) -> Result<LoxValue, InterpreterError> {
+    let object = self.evaluate(&expr.object)?;
+    let index = self.evaluate(&expr.index)?;
+    let value = self.evaluate(&expr.value)?;
+    if let LoxValue::List(list) = object {
+      if self.is_frozen(&list) {
+        return Err(InterpreterError::new(expr.bracket.clone(), "Can't change a frozen list.".to_string()));
+      }
+      let mut list = list.borrow_mut();
+      let i = Interpreter::list_index(&expr.bracket, "List", list.len(), &index)?;
+      list[i] = value.clone();
+      return Ok(value);
+    }
+    if let LoxValue::Bytes(bytes) = object {
+      if bytes.borrow().frozen {
+        return Err(InterpreterError::new(expr.bracket.clone(), "Can't change frozen bytes.".to_string()));
+      }
+      let byte = match value {
+        LoxValue::Integer(n) if (0..=255).contains(&n) => n as u8,
+        _ => return Err(InterpreterError::new(expr.bracket.clone(), format!("A byte must be an integer from 0 to 255, not {}.", value))),
+      };
+      let mut bytes = bytes.borrow_mut();
+      let i = Interpreter::list_index(&expr.bracket, "Bytes", bytes.data.len(), &index)?;
+      bytes.data[i] = byte;
+      return Ok(value);
+    }
+    if let LoxValue::Map(map) = object {
+      if map.borrow().frozen {
+        return Err(InterpreterError::new(expr.bracket.clone(), "Can't change a frozen map.".to_string()));
+      }
+      map.borrow_mut().insert(index, value.clone(), self).map_err(|message| InterpreterError::new(expr.bracket.clone(), message))?;
+      return Ok(value);
+    }
+    Err(InterpreterError::new(
+      expr.bracket.clone(),
+      format!("{} is not a list or a map.", object),
+    ))
+  }
 }
 
 impl StmtVisitor<Result<(), InterpreterError>> for Interpreter {
@@ -508,13 +1528,110 @@ impl StmtVisitor<Result<(), InterpreterError>> for Interpreter {
     Ok(())
   }
 
+  // Generators run their own yields, so reaching this means the yield sits
+  // somewhere they can't suspend, such as a desugared-away construct
+  fn visitYieldStmt(&mut self, stmt: &YieldStmt) -> Result<(), InterpreterError> {
+    Err(InterpreterError::new(stmt.keyword.clone(), "Can't yield here.".to_string()))
+  }
+
+  fn visitForInStmt(&mut self, stmt: &ForInStmt) -> Result<(), InterpreterError> {
+    let iterable = self.evaluate(&stmt.iterable)?;
+    let mut iterator = LoxIterator::new(&iterable, &stmt.name)?;
+    while let Some(value) = iterator.next(self)? {
+      let env = Rc::new(RefCell::new(Environment::new_enclosed(self.environment.clone())));
+      env.borrow_mut().define(stmt.name.symbol, value);
+      if Interpreter::broke_out(self.execute_in(&stmt.body, env))? {
+        return Ok(());
+      }
+    }
+    if let Some(else_branch) = &stmt.else_branch {
+      self.execute(else_branch)?;
+    }
+    Ok(())
+  }
+
   fn visitWhileStmt(&mut self, stmt: &WhileStmt) -> Result<(), InterpreterError> {
     while Interpreter::is_truthy(self.evaluate(&stmt.condition)?) {
-      self.execute(&stmt.body)?;
+      if Interpreter::broke_out(self.execute(&stmt.body))? {
+        return Ok(());
+      }
+    }
+    if let Some(else_branch) = &stmt.else_branch {
+      self.execute(else_branch)?;
     }
     Ok(())
   }
 
+  fn visitDoWhileStmt(&mut self, stmt: &WhileStmt) -> Result<(), InterpreterError> {
+    loop {
+      if Interpreter::broke_out(self.execute(&stmt.body))? {
+        return Ok(());
+      }
+      if !Interpreter::is_truthy(self.evaluate(&stmt.condition)?) {
+        return Ok(());
+      }
+    }
+  }
+
+  fn visitBreakStmt(&mut self, stmt: &BreakStmt) -> Result<(), InterpreterError> {
+    Err(InterpreterError::new_with_type(stmt.keyword.clone(), String::new(), InterpreterErrorType::Break))
+  }
+
+  // The finally block runs after the body and any catch clause however they
+  // ended, a return or break included. If it finishes normally whatever was
+  // unwinding carries on; a return, break or throw of its own takes over
+  // instead. Ctrl-C skips it, since the whole run is being abandoned.
+  fn visitTryStmt(&mut self, stmt: &TryStmt) -> Result<(), InterpreterError> {
+    let result = self.try_catch(stmt);
+    let Some(finally) = &stmt.finally else {
+      return result;
+    };
+    if let Err(InterpreterError { error_type: InterpreterErrorType::Interrupted(_), .. }) = &result {
+      return result;
+    }
+    self.execute_block(finally, self.environment.clone())?;
+    result
+  }
+
+  fn visitThrowStmt(&mut self, stmt: &ThrowStmt) -> Result<(), InterpreterError> {
+    let value = self.evaluate(&stmt.value)?;
+    // What's reported if nothing catches it
+    let message = match &value {
+      LoxValue::Instance(instance) => match instance.borrow().properties.get("message") {
+        Some(message) => message.to_string(),
+        None => value.to_string(),
+      },
+      _ => value.to_string(),
+    };
+    Err(InterpreterError::new_with_type(stmt.keyword.clone(), message, InterpreterErrorType::Thrown(Box::new(value), Vec::new())))
+  }
+
+  // close() is looked up before the body runs, so a value that can't be
+  // closed is an error up front rather than a leak. It's called however the
+  // body ends, except for Ctrl-C; an error from the body wins over one from
+  // close().
+  fn visitUsingStmt(&mut self, stmt: &UsingStmt) -> Result<(), InterpreterError> {
+    let value = self.evaluate(&stmt.initializer)?;
+    let name = Token::new(TokenType::Identifier, "close".to_string(), LoxValue::Nil, stmt.keyword.line, stmt.keyword.offset);
+    let close = match Interpreter::get_property(value.clone(), &name).ok().and_then(|mut close| close.as_callable()) {
+      Some(close) if close.borrow().min_arity() == 0 => close,
+      _ => return Err(InterpreterError::new(stmt.name.clone(), format!("{} has no close() method.", value))),
+    };
+    let env = Rc::new(RefCell::new(Environment::new_enclosed(self.environment.clone())));
+    env.borrow_mut().define(stmt.name.symbol, value);
+    let result = self.execute_block(&stmt.body, env);
+    if let Err(InterpreterError { error_type: InterpreterErrorType::Interrupted(_), .. }) = &result {
+      return result;
+    }
+    let closed = close.borrow().call(self, Vec::new());
+    result?;
+    match closed {
+      Ok(_) => Ok(()),
+      Err(err) if matches!(err.error_type, InterpreterErrorType::CallError) => Err(InterpreterError::new(stmt.keyword.clone(), err.message)),
+      Err(err) => Err(err),
+    }
+  }
+
   fn visitIfStmt(&mut self, stmt: &IfStmt) -> Result<(), InterpreterError> {
     let condition = self.evaluate(&stmt.condition)?;
     if Interpreter::is_truthy(condition) {
@@ -537,8 +1654,19 @@ impl StmtVisitor<Result<(), InterpreterError>> for Interpreter {
   }
 
   fn visitPrintStmt(&mut self, stmt: &PrintStmt) -> Result<(), InterpreterError> {
-    let value = self.evaluate(&stmt.expression)?;
-    println!("{}", value);
+    let mut texts = Vec::new();
+    for expression in &stmt.expressions {
+      let value = self.evaluate(expression)?;
+      texts.push(self.stringify(&value)?);
+    }
+    let text = texts.join(" ");
+    if let Some(limits) = &mut self.limits {
+      if text.len() + 1 > limits.output_left {
+        return Err(InterpreterError::limit_error("Output limit exceeded."));
+      }
+      limits.output_left -= text.len() + 1;
+    }
+    write_output(&text);
     Ok(())
   }
 
@@ -560,13 +1688,35 @@ impl StmtVisitor<Result<(), InterpreterError>> for Interpreter {
     } else {
       LoxValue::Nil
     };
-    self.environment.borrow_mut().define(stmt.name.token.clone(), value);
+    if stmt.constant {
+      self.environment.borrow_mut().define_constant(stmt.name.symbol, value);
+    } else {
+      self.environment.borrow_mut().define(stmt.name.symbol, value);
+    }
+    Ok(())
+  }
+
+  fn visitDestructureStmt(&mut self, stmt: &DestructureStmt) -> Result<(), InterpreterError> {
+    let value = self.evaluate(&stmt.initializer)?;
+    let values = self.unpack(&stmt.pattern, &value)?;
+    for (target, element) in stmt.pattern.names().into_iter().zip(values) {
+      if stmt.constant {
+        self.environment.borrow_mut().define_constant(target.name.symbol, element);
+      } else {
+        self.environment.borrow_mut().define(target.name.symbol, element);
+      }
+    }
     Ok(())
   }
 
   fn visitFunStmt(&mut self, stmt: &FunStmt) -> Result<(), InterpreterError> {
     let function = LoxFunction::new(Rc::new(stmt.clone()), self.environment.clone(), false);
-    self.environment.borrow_mut().define(stmt.name.token.clone(), LoxValue::Callable(Rc::new(RefCell::new(Box::new(function)))));
+    self.environment.borrow_mut().define(stmt.name.symbol, LoxValue::Callable(Rc::new(RefCell::new(Box::new(function)))));
+    Ok(())
+  }
+
+  // Traits are only checked by the resolver; there is nothing to do at runtime.
+  fn visitTraitStmt(&mut self, _stmt: &TraitStmt) -> Result<(), InterpreterError> {
     Ok(())
   }
 
@@ -585,11 +1735,11 @@ impl StmtVisitor<Result<(), InterpreterError>> for Interpreter {
       None
     };
     let has_superclass = superclass.is_some();
-    self.environment.borrow_mut().define(stmt.name.token.clone(), LoxValue::Nil);
+    self.environment.borrow_mut().define(stmt.name.symbol, LoxValue::Nil);
 
     if let Some(sc) = &superclass {
       self.environment = Rc::new(RefCell::new(Environment::new_enclosed(Rc::clone(&self.environment))));
-      self.environment.borrow_mut().define("super".to_string(), LoxValue::Class(sc.borrow_mut().clone()));
+      self.environment.borrow_mut().define(symbol::SUPER, LoxValue::Class(sc.borrow_mut().clone()));
     }
     let mut methods = HashMap::new();
     for method in &stmt.methods {
@@ -603,7 +1753,7 @@ impl StmtVisitor<Result<(), InterpreterError>> for Interpreter {
         self.environment =  enclosing.clone();
       }
     }
-    match self.environment.borrow_mut().assign(stmt.name.token.clone(), klass) {
+    match self.environment.borrow_mut().assign(stmt.name.symbol, klass) {
       Ok(_) => {}
       Err(msg) => return Err(InterpreterError::new(
         stmt.name.clone(),
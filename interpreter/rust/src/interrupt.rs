@@ -0,0 +1,53 @@
+/*
+Ctrl-C handling.
+
+While a script or REPL input is running, SIGINT only sets a flag. The
+interpreter checks it before each statement and unwinds with an
+"Interrupted" error, which collects a stack trace on the way out, so the
+script stops between statements instead of partway through a write. Outside
+of a run, or on a second Ctrl-C before the first was noticed (say the script
+is stuck inside a native), the process exits with 130 as it would by default.
+*/
+
+use std::sync::Once;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+const SIGINT: i32 = 2;
+
+static INSTALL: Once = Once::new();
+// Whether a run is in progress that Ctrl-C should stop
+static ARMED: AtomicBool = AtomicBool::new(false);
+static INTERRUPTED: AtomicBool = AtomicBool::new(false);
+
+unsafe extern "C" {
+  fn signal(signum: i32, handler: extern "C" fn(i32)) -> usize;
+  fn _exit(status: i32) -> !;
+}
+
+// Only async-signal-safe work belongs here
+extern "C" fn on_sigint(_: i32) {
+  if !ARMED.load(Ordering::SeqCst) || INTERRUPTED.swap(true, Ordering::SeqCst) {
+    unsafe { _exit(130) };
+  }
+}
+
+pub fn install() {
+  INSTALL.call_once(|| unsafe {
+    signal(SIGINT, on_sigint);
+  });
+}
+
+// Ctrl-C interrupts the run from here until disarm()
+pub fn arm() {
+  INTERRUPTED.store(false, Ordering::SeqCst);
+  ARMED.store(true, Ordering::SeqCst);
+}
+
+pub fn disarm() {
+  ARMED.store(false, Ordering::SeqCst);
+}
+
+// Whether Ctrl-C was pressed since the last arm()
+pub fn interrupted() -> bool {
+  INTERRUPTED.load(Ordering::SeqCst)
+}
@@ -2,26 +2,66 @@ use std::fmt;
 use crate::logging::*;
 use crate::callable::*;
 use crate::oop::*;
-use std::hash::{Hash, Hasher};
+use std::hash::Hash;
+use std::collections::HashMap;
 use std::rc::Rc;
 use std::cell::RefCell;
+use crate::bignum::BigInt;
+use crate::generator::LoxGenerator;
+use crate::set::LoxSet;
+use crate::map::LoxMap;
+use crate::bytes::LoxBytes;
+use crate::dialect::{self, Feature};
+use crate::symbol::{self, Symbol};
 
 #[derive(Debug, Clone, PartialEq)]
 pub enum LoxValue {
   Number(f64),
+  Integer(i64),
+  BigInt(BigInt),
   String(String),
   Boolean(bool),
   Callable(Rc<RefCell<Box<dyn LoxCallable>>>),
   Class(LoxClass),
   Instance(Rc<RefCell<LoxInstance>>),
+  List(Rc<RefCell<Vec<LoxValue>>>),
+  Set(Rc<RefCell<LoxSet>>),
+  Map(Rc<RefCell<LoxMap>>),
+  Bytes(Rc<RefCell<LoxBytes>>),
+  Generator(Rc<RefCell<LoxGenerator>>),
   Nil,
 }
 
 impl LoxValue {
+  // Instances report their class name
+  pub fn type_name(&self) -> String {
+    match self {
+      LoxValue::Number(_) => "Number".to_string(),
+      LoxValue::Integer(_) => "Integer".to_string(),
+      LoxValue::BigInt(_) => "BigInt".to_string(),
+      LoxValue::String(_) => "String".to_string(),
+      LoxValue::Boolean(_) => "Bool".to_string(),
+      LoxValue::Callable(_) => "Function".to_string(),
+      LoxValue::Class(_) => "Class".to_string(),
+      LoxValue::Instance(instance) => instance.borrow().class.name.clone(),
+      LoxValue::List(_) => "List".to_string(),
+      LoxValue::Set(_) => "Set".to_string(),
+      LoxValue::Map(_) => "Map".to_string(),
+      LoxValue::Bytes(_) => "Bytes".to_string(),
+      LoxValue::Generator(_) => "Generator".to_string(),
+      LoxValue::Nil => "Nil".to_string(),
+    }
+  }
+
   pub fn as_callable(&mut self) -> Option<Rc<RefCell<Box<dyn LoxCallable>>>> {
     match self {
       LoxValue::Callable(c) => Some(c.clone()),
       LoxValue::Class(c) => Some(Rc::new(RefCell::new(Box::new(c.clone())))),
+      // An instance whose class defines call() is called through it
+      LoxValue::Instance(instance) => {
+        let method = instance.borrow().class.find_method("call")?;
+        Some(Rc::new(RefCell::new(Box::new(method.bind(instance.clone())))))
+      }
       _ => None,
     }
   }
@@ -31,17 +71,97 @@ impl LoxValue {
 impl fmt::Display for LoxValue {
   fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
       match self {
-          LoxValue::Number(n) => write!(f, "{}", n),
+          LoxValue::Number(n) => write!(f, "{}", number_string(*n)),
+          LoxValue::Integer(n) => write!(f, "{}", n),
+          LoxValue::BigInt(n) => write!(f, "{}", n),
           LoxValue::String(s) => write!(f, "{}", s),
           LoxValue::Boolean(b) => write!(f, "{}", b),
-          LoxValue::Callable(c) => write!(f, "{:?}", c),
+          LoxValue::Callable(c) => write!(f, "{:?}", c.borrow()),
           LoxValue::Class(c) => write!(f, "{}", c),
           LoxValue::Instance(c) => write!(f, "{}", c.borrow_mut()),
+          LoxValue::List(_) | LoxValue::Set(_) | LoxValue::Map(_) => write!(f, "{}", compound_string(self, &mut Vec::new())),
+          LoxValue::Bytes(bytes) => write!(f, "<bytes {}>", crate::bytes::to_hex(&bytes.borrow().data)),
+          LoxValue::Generator(g) => write!(f, "{}", g.borrow()),
           LoxValue::Nil => write!(f, "nil"),
       }
   }
 }
 
+// How a number reads wherever it becomes text: print, string concatenation,
+// interpolation and the REPL. A whole number has no fractional part, so 3.0
+// prints as 3, and otherwise it gets the fewest digits that read back as the
+// same number. As in JavaScript, one of 1e21 or more, or smaller than 1e-6,
+// is written with an exponent instead of a long run of zeros.
+pub fn number_string(n: f64) -> String {
+  let magnitude = n.abs();
+  if !n.is_finite() || magnitude == 0.0 || (1e-6..1e21).contains(&magnitude) {
+    return format!("{}", n);
+  }
+  let scientific = format!("{:e}", n);
+  let (mantissa, exponent) = scientific.split_once('e').unwrap();
+  let sign = if exponent.starts_with('-') { "" } else { "+" };
+  format!("{}e{}{}", mantissa, sign, exponent)
+}
+
+// Reads a number the way number_string writes one, for num(): decimal
+// digits with an optional '-', fraction and exponent, or NaN, inf and -inf.
+// Like a literal it's an integer when it has no fraction or exponent, except
+// for -0, which only a float can hold. Parsing is correctly rounded, so
+// whatever number_string gives back reads as the same number.
+pub fn parse_number(text: &str) -> Option<LoxValue> {
+  match text {
+    "NaN" => return Some(LoxValue::Number(f64::NAN)),
+    "inf" => return Some(LoxValue::Number(f64::INFINITY)),
+    "-inf" => return Some(LoxValue::Number(f64::NEG_INFINITY)),
+    _ => {}
+  }
+  let digits = |s: &str| !s.is_empty() && s.bytes().all(|b| b.is_ascii_digit());
+  let unsigned = text.strip_prefix('-').unwrap_or(text);
+  let (mantissa, exponent) = match unsigned.split_once(['e', 'E']) {
+    Some((mantissa, exponent)) => (mantissa, Some(exponent.strip_prefix(['+', '-']).unwrap_or(exponent))),
+    None => (unsigned, None),
+  };
+  let (whole, fraction) = match mantissa.split_once('.') {
+    Some((whole, fraction)) => (whole, Some(fraction)),
+    None => (mantissa, None),
+  };
+  if !digits(whole) || !fraction.map_or(true, digits) || !exponent.map_or(true, digits) {
+    return None;
+  }
+  let value = text.parse::<f64>().ok()?;
+  let integer = fraction.is_none() && exponent.is_none() && !(value == 0.0 && text.starts_with('-'));
+  let exact = if integer { text.parse::<i64>().ok() } else { None };
+  Some(integer_or_float(value, exact))
+}
+
+// Lists, sets and maps print their elements in brackets, a map's as
+// `key: value`. A list that contains itself, directly or through other
+// lists, prints as [...] where it comes round again. `path` holds the lists,
+// sets and maps being printed.
+fn compound_string(value: &LoxValue, path: &mut Vec<*const ()>) -> String {
+  let (address, open, close) = match value {
+    LoxValue::List(list) => (Rc::as_ptr(list) as *const (), "[", "]"),
+    LoxValue::Set(set) => (Rc::as_ptr(set) as *const (), "#{", "}"),
+    LoxValue::Map(map) => (Rc::as_ptr(map) as *const (), "{", "}"),
+    other => return other.to_string(),
+  };
+  if path.contains(&address) {
+    return format!("{}...{}", open, close);
+  }
+  path.push(address);
+  let elements: Vec<String> = match value {
+    LoxValue::List(list) => list.borrow().clone().iter().map(|element| compound_string(element, path)).collect(),
+    LoxValue::Set(set) => set.borrow().values().iter().map(|element| compound_string(element, path)).collect(),
+    LoxValue::Map(map) => {
+      let entries: Vec<(LoxValue, LoxValue)> = map.borrow().entries().map(|(k, v)| (k.clone(), v.clone())).collect();
+      entries.iter().map(|(key, value)| format!("{}: {}", compound_string(key, path), compound_string(value, path))).collect()
+    }
+    _ => unreachable!(),
+  };
+  path.pop();
+  format!("{}{}{}", open, elements.join(", "), close)
+}
+
 #[derive(Debug, Clone, Hash, PartialEq)]
 pub enum TokenType {
   // Single-character tokens
@@ -49,8 +169,12 @@ pub enum TokenType {
   RightParen,
   LeftBrace,
   RightBrace,
+  LeftBracket,
+  RightBracket,
   Comma,
+  Colon,
   Dot,
+  Ellipsis,
   Minus,
   Plus,
   Semicolon,
@@ -62,34 +186,60 @@ pub enum TokenType {
   BangEqual,
   Equal,
   EqualEqual,
+  FatArrow,
   Greater,
   GreaterEqual,
   Less,
   LessEqual,
+  QuestionDot,
+  // `?[`, which indexes without failing on a missing element
+  QuestionBracket,
+  QuestionQuestion,
+  // `|>`, which passes a value to a function as its first argument
+  Pipe,
+  // `#{`, which opens a set
+  HashBrace,
 
   // Literals
   Identifier,
   String,
+  // A string segment ending in "${"; the tokens of the embedded expression
+  // follow, then another Interpolation or the closing String segment.
+  Interpolation,
   Number, // The number literal is always in text format from the lexer
                   // Some string -> int or string -> float conversion will take place eventually
 
   // Keywords
   And,
+  Break,
+  Catch,
   Class,
+  Const,
+  Do,
   Else,
   False,
+  Finally,
   Fun,
   For,
   If,
+  In,
+  Is,
+  Match,
   Nil,
   Or,
   Print,
   Return,
   Super,
   This,
+  Throw,
+  Trait,
+  Implements,
   True,
+  Try,
+  Using,
   Var,
   While,
+  Yield,
 
   Eof,
 }
@@ -100,11 +250,21 @@ pub struct Token {
   pub token: String,
   pub literal: LoxValue,
   pub line: usize,
+  // Where the token starts in the source. Two uses of the same name on one
+  // line are different tokens, and the resolver's table relies on that.
+  pub offset: usize,
+  // The interned name, which the environments and the resolver key on.
+  // Literals have none.
+  pub symbol: Symbol,
 }
 
 impl Token {
-  pub fn new(token_type: TokenType, token: String, literal: LoxValue, line: usize) -> Self {
-    Self { token_type, token, literal, line }
+  pub fn new(token_type: TokenType, token: String, literal: LoxValue, line: usize, offset: usize) -> Self {
+    let symbol = match token_type {
+      TokenType::String | TokenType::Number => symbol::NONE,
+      _ => symbol::intern(&token),
+    };
+    Self { token_type, token, literal, line, offset, symbol }
   }
 }
 
@@ -113,6 +273,7 @@ impl Hash for Token {
     self.token.hash(state);
     self.token_type.hash(state);
     self.line.hash(state);
+    self.offset.hash(state);
   }
 }
 
@@ -124,12 +285,26 @@ impl fmt::Display for Token {
   }
 }
 
+// Integer literals that don't fit in an i64 fall back to floats
+fn integer_or_float(value: f64, exact: Option<i64>) -> LoxValue {
+  match exact {
+    Some(n) => LoxValue::Integer(n),
+    None => LoxValue::Number(value),
+  }
+}
+
 pub struct Lexer {
   source: String,
   tokens: Vec<Token>,
   start: u32,
   current: u32,
   line: usize,
+  // One brace count per "${" we are inside, so the matching '}' resumes the string
+  interpolations: Vec<usize>,
+  // Doc comment text by the offset of the token it documents
+  pub docs: HashMap<usize, String>,
+  // Doc comment lines seen since the last token
+  pending_doc: Vec<String>,
 }
 
 impl Lexer {
@@ -140,6 +315,9 @@ impl Lexer {
           start: 0,
           current: 0,
           line: 1,
+          interpolations: Vec::new(),
+          docs: HashMap::new(),
+          pending_doc: Vec::new(),
       }
   }
 
@@ -150,7 +328,7 @@ impl Lexer {
           self.scan_token();
       }
 
-      self.tokens.push(Token::new(TokenType::Eof, String::from(""), LoxValue::Nil, self.line as usize));
+      self.tokens.push(Token::new(TokenType::Eof, String::from(""), LoxValue::Nil, self.line as usize, self.current as usize));
       &self.tokens
   }
 
@@ -160,10 +338,42 @@ impl Lexer {
       match c {
           '(' => self.add_token(TokenType::LeftParen),
           ')' => self.add_token(TokenType::RightParen),
-          '{' => self.add_token(TokenType::LeftBrace),
-          '}' => self.add_token(TokenType::RightBrace),
+          '{' => {
+              if let Some(depth) = self.interpolations.last_mut() {
+                  *depth += 1;
+              }
+              self.add_token(TokenType::LeftBrace);
+          },
+          '}' => match self.interpolations.last_mut() {
+              Some(0) => {
+                  self.interpolations.pop();
+                  self.string();
+              },
+              Some(depth) => {
+                  *depth -= 1;
+                  self.add_token(TokenType::RightBrace);
+              },
+              None => self.add_token(TokenType::RightBrace),
+          },
+          '#' if self.peek() == '{' => {
+              self.advance();
+              if let Some(depth) = self.interpolations.last_mut() {
+                  *depth += 1;
+              }
+              self.add_token(TokenType::HashBrace);
+          },
+          '[' => self.add_token(TokenType::LeftBracket),
+          ']' => self.add_token(TokenType::RightBracket),
           ',' => self.add_token(TokenType::Comma),
-          '.' => self.add_token(TokenType::Dot),
+          ':' => self.add_token(TokenType::Colon),
+          '.' =>
+            if self.peek() == '.' && self.peek_next() == '.' {
+              self.advance();
+              self.advance();
+              self.add_token(TokenType::Ellipsis);
+            } else {
+              self.add_token(TokenType::Dot);
+            },
           '-' => self.add_token(TokenType::Minus),
           '+' => self.add_token(TokenType::Plus),
           ';' => self.add_token(TokenType::Semicolon),
@@ -177,6 +387,8 @@ impl Lexer {
           '=' => 
             if self.match_char('=') {
               self.add_token(TokenType::EqualEqual);
+            } else if self.match_char('>') {
+              self.add_token(TokenType::FatArrow);
             } else {
               self.add_token(TokenType::Equal);
             },
@@ -192,22 +404,56 @@ impl Lexer {
             } else {
               self.add_token(TokenType::Greater);
             },
+          '?' =>
+            if self.match_char('.') {
+              self.add_token(TokenType::QuestionDot);
+            } else if self.match_char('[') {
+              self.add_token(TokenType::QuestionBracket);
+            } else if self.match_char('?') {
+              self.add_token(TokenType::QuestionQuestion);
+            } else {
+              error_at_line(self.line, "Unexpected character.");
+            },
+          '|' =>
+            if self.match_char('>') {
+              self.add_token(TokenType::Pipe);
+            } else {
+              error_at_line(self.line, "Unexpected character.");
+            },
           '/' => {
               if self.match_char('/') {
+                  // `///` starts a doc comment, but a line of slashes doesn't
+                  let doc = self.peek() == '/' && self.peek_next() != '/';
                   while self.peek() != '\n' && !self.is_at_end() {
                       self.advance();
                   }
+                  if doc {
+                      let text = &self.source[self.start as usize + 3..self.current as usize];
+                      self.pending_doc.push(text.strip_prefix(' ').unwrap_or(text).to_string());
+                  }
+              } else if self.match_char('*') {
+                  self.block_comment();
               } else {
                   self.add_token(TokenType::Slash);
               }
           },
           ' ' | '\r' | '\t' => (),
           '\n' => self.line += 1,
-          '"' => self.string(),
+          '"' =>
+            if self.peek() == '"' && self.peek_next() == '"' && dialect::enabled(Feature::RawStrings) {
+              self.advance();
+              self.advance();
+              self.triple_quoted_string();
+            } else {
+              self.string();
+            },
           _ => {
-              if c.is_digit(10) {
+              if c == 'r' && self.peek() == '"' && dialect::enabled(Feature::RawStrings) {
+                  self.advance();
+                  self.raw_string();
+              } else if c.is_digit(10) {
                   self.number();
-              } else if c.is_alphabetic() {
+              } else if c.is_alphabetic() || c == '_' {
                   self.identifier();
               } else {
                 error_at_line(self.line, "Unexpected character.");
@@ -217,13 +463,58 @@ impl Lexer {
   }
 
   fn add_token(&mut self, token_type: TokenType) {
+      self.attach_doc();
       let text = self.source[self.start as usize..self.current as usize].to_string();
-      self.tokens.push(Token::new(token_type, text, LoxValue::Nil, self.line as usize));
+      self.tokens.push(Token::new(token_type, text, LoxValue::Nil, self.line as usize, self.start as usize));
   }
 
   fn add_token_literal(&mut self, token_type: TokenType, literal: LoxValue) {
+    self.attach_doc();
     let text = self.source[self.start as usize..self.current as usize].to_string();
-    self.tokens.push(Token::new(token_type, text, literal, self.line as usize));
+    self.tokens.push(Token::new(token_type, text, literal, self.line as usize, self.start as usize));
+  }
+
+  // Doc comments belong to the token that follows them
+  fn attach_doc(&mut self) {
+      if !self.pending_doc.is_empty() {
+          let doc = self.pending_doc.join("\n");
+          self.docs.insert(self.start as usize, doc);
+          self.pending_doc.clear();
+      }
+  }
+
+  // Skips a /* */ comment, which doesn't nest. One that starts with /** is a
+  // doc comment; its lines may be lined up with a leading '*'.
+  fn block_comment(&mut self) {
+      let doc = self.peek() == '*' && self.peek_next() != '/';
+      while !self.is_at_end() && !(self.peek() == '*' && self.peek_next() == '/') {
+          if self.peek() == '\n' {
+              self.line += 1;
+          }
+          self.advance();
+      }
+
+      if self.is_at_end() {
+          error_at_line(self.line, "Unterminated block comment.");
+          return;
+      }
+
+      self.advance();
+      self.advance();
+
+      if doc {
+          let text = &self.source[self.start as usize + 3..self.current as usize - 2];
+          let lines: Vec<String> = text.split('\n')
+              .map(|line| {
+                  let line = line.trim();
+                  let line = line.strip_prefix('*').unwrap_or(line);
+                  line.strip_prefix(' ').unwrap_or(line).to_string()
+              })
+              .collect();
+          let first = lines.iter().position(|line| !line.is_empty()).unwrap_or(lines.len());
+          let last = lines.iter().rposition(|line| !line.is_empty()).map_or(first, |i| i + 1);
+          self.pending_doc = lines[first..last].to_vec();
+      }
   }
 
   fn match_char(&mut self, expected: char) -> bool {
@@ -251,8 +542,18 @@ impl Lexer {
       self.source.chars().nth(self.current as usize).unwrap()
   }
 
+  // Scans a string segment, starting after either the opening quote or the
+  // '}' closing an interpolated expression.
   fn string(&mut self) {
       while self.peek() != '"' && !self.is_at_end() {
+          if self.peek() == '$' && self.peek_next() == '{' && dialect::enabled(Feature::Interpolation) {
+              let value = self.source[self.start as usize + 1..self.current as usize].to_string();
+              self.advance();
+              self.advance();
+              self.add_token_literal(TokenType::Interpolation, LoxValue::String(value));
+              self.interpolations.push(0);
+              return;
+          }
           if self.peek() == '\n' {
               self.line += 1;
           }
@@ -260,7 +561,7 @@ impl Lexer {
       }
 
       if self.is_at_end() {
-          eprintln!("Unterminated string.");
+          error_at_line(self.line as usize, "Unterminated string.");
           return;
       }
 
@@ -270,21 +571,180 @@ impl Lexer {
       self.add_token_literal(TokenType::String, LoxValue::String(value));
   }
 
+  // r"..." is taken verbatim: no interpolation
+  fn raw_string(&mut self) {
+      while self.peek() != '"' && !self.is_at_end() {
+          if self.peek() == '\n' {
+              self.line += 1;
+          }
+          self.advance();
+      }
+
+      if self.is_at_end() {
+          error_at_line(self.line as usize, "Unterminated string.");
+          return;
+      }
+
+      self.advance();
+
+      let value = self.source[self.start as usize + 2..self.current as usize - 1].to_string();
+      self.add_token_literal(TokenType::String, LoxValue::String(value));
+  }
+
+  // """...""" is verbatim like a raw string but may contain quotes. A newline
+  // right after the opening quotes and a blank line before the closing ones
+  // are dropped, as is the indentation shared by every line, so the literal
+  // can be indented along with the code around it.
+  fn triple_quoted_string(&mut self) {
+      while !self.is_at_end() && !(self.peek() == '"' && self.peek_next() == '"' && self.peek_at(2) == '"') {
+          if self.peek() == '\n' {
+              self.line += 1;
+          }
+          self.advance();
+      }
+
+      if self.is_at_end() {
+          error_at_line(self.line as usize, "Unterminated string.");
+          return;
+      }
+
+      self.advance();
+      self.advance();
+      self.advance();
+
+      let raw = &self.source[self.start as usize + 3..self.current as usize - 3];
+      let value = Lexer::dedent(raw);
+      self.add_token_literal(TokenType::String, LoxValue::String(value));
+  }
+
+  fn dedent(raw: &str) -> String {
+      let text = raw.strip_prefix('\n').unwrap_or(raw);
+      let mut lines: Vec<&str> = text.split('\n').collect();
+      if lines.len() > 1 && lines.last().unwrap().trim().is_empty() {
+          lines.pop();
+      }
+      let indent = lines.iter()
+          .filter(|line| !line.trim().is_empty())
+          .map(|line| line.len() - line.trim_start().len())
+          .min()
+          .unwrap_or(0);
+      lines.iter()
+          .map(|line| if line.len() >= indent { &line[indent..] } else { line.trim_start() })
+          .collect::<Vec<&str>>()
+          .join("\n")
+  }
+
+  // Decimal literals may have a fraction and an exponent (1.5e-3); 0x, 0b and
+  // 0o prefixes give integer literals in other bases. Any of them can use '_'
+  // between digits as a separator.
   fn number(&mut self) {
-      while self.peek().is_digit(10) {
+      let first = self.source.chars().nth(self.start as usize).unwrap();
+      let radix = match (first, self.peek()) {
+          ('0', 'x') | ('0', 'X') => 16,
+          ('0', 'b') | ('0', 'B') => 2,
+          ('0', 'o') | ('0', 'O') => 8,
+          _ => 10,
+      };
+
+      if radix != 10 {
           self.advance();
+          let digits_start = self.current;
+          self.digits(radix);
+          let digits = self.source[digits_start as usize..self.current as usize].replace('_', "");
+          if digits.is_empty() {
+              let prefix = self.source[self.start as usize..digits_start as usize].to_string();
+              // digits() has already reported a lone '_'
+              if !self.source[digits_start as usize..self.current as usize].contains('_') {
+                  self.number_error(&format!("Expect digits after '{}'.", prefix));
+              }
+              self.add_token_literal(TokenType::Number, LoxValue::Integer(0));
+              return;
+          }
+          if self.bigint_suffix() {
+              let value = BigInt::parse(&digits, radix).unwrap();
+              self.add_token_literal(TokenType::Number, LoxValue::BigInt(value));
+              return;
+          }
+          match u64::from_str_radix(&digits, radix) {
+              Ok(value) => self.add_token_literal(TokenType::Number, integer_or_float(value as f64, i64::try_from(value).ok())),
+              Err(_) => error_at_line(self.line, "Invalid number literal."),
+          }
+          return;
+      }
+
+      self.digits(10);
+      if self.bigint_suffix() {
+          let digits = self.source[self.start as usize..self.current as usize - 1].replace('_', "");
+          self.add_token_literal(TokenType::Number, LoxValue::BigInt(BigInt::parse(&digits, 10).unwrap()));
+          return;
       }
+      let mut integer = true;
 
       if self.peek() == '.' && self.peek_next().is_digit(10) {
+          integer = false;
+          self.advance();
+          self.digits(10);
+      }
+
+      let mut end = self.current;
+      if self.peek() == 'e' || self.peek() == 'E' {
+          let signed = self.peek_next() == '+' || self.peek_next() == '-';
+          self.advance();
+          if signed {
+              self.advance();
+          }
+          if self.peek().is_digit(10) {
+              integer = false;
+              self.digits(10);
+              end = self.current;
+          } else {
+              // The literal keeps its value without the exponent, so the
+              // parser doesn't report the same mistake again
+              self.number_error("Exponent has no digits.");
+          }
+      }
+
+      let text = self.source[self.start as usize..end as usize].replace('_', "");
+      let value = text.parse::<f64>().expect("Failed to parse number");
+      let exact = if integer { text.parse::<i64>().ok() } else { None };
+      self.add_token_literal(TokenType::Number, integer_or_float(value, exact));
+  }
+
+  // A trailing 'n' marks an integer literal as arbitrary precision (123n)
+  fn bigint_suffix(&mut self) -> bool {
+      if self.peek() == 'n' && !self.peek_next().is_alphanumeric() && self.peek_next() != '_' {
           self.advance();
+          return true;
+      }
+      false
+  }
 
-          while self.peek().is_digit(10) {
+  // Consumes digits of the given radix, allowing '_' only between two digits
+  fn digits(&mut self, radix: u32) {
+      loop {
+          if self.peek().is_digit(radix) {
               self.advance();
+          } else if self.peek() == '_' && self.peek_next().is_digit(radix) {
+              self.advance();
+          } else if self.peek() == '_' {
+              while self.peek() == '_' {
+                  self.advance();
+              }
+              if !self.peek().is_digit(radix) {
+                  self.number_error("Trailing '_' in number literal.");
+                  break;
+              }
+              self.number_error("Only one '_' can separate digits in a number literal.");
+          } else {
+              break;
           }
       }
+  }
 
-      let value = self.source[self.start as usize..self.current as usize].parse::<f64>().expect("Failed to parse number");
-      self.add_token_literal(TokenType::Number, LoxValue::Number(value));
+  // Reports a malformed number at the literal scanned so far
+  fn number_error(&self, message: &str) {
+      let text = &self.source[self.start as usize..self.current as usize];
+      report(self.line, &format!(" at '{}'", text), message);
   }
 
   fn peek_next(&self) -> char {
@@ -295,31 +755,57 @@ impl Lexer {
       self.source.chars().nth((self.current + 1) as usize).unwrap()
   }
 
+  fn peek_at(&self, offset: u32) -> char {
+      if self.current + offset >= self.source.len() as u32 {
+          return '\0';
+      }
+
+      self.source.chars().nth((self.current + offset) as usize).unwrap()
+  }
+
   fn identifier(&mut self) {
-      while self.peek().is_alphanumeric() {
+      while self.peek().is_alphanumeric() || self.peek() == '_' {
           self.advance();
       }
 
       let text = self.source[self.start as usize..self.current as usize].to_string();
-      let token_type = match text.as_str() {
+      let mut token_type = match text.as_str() {
           "and" => TokenType::And,
+          "break" => TokenType::Break,
+          "catch" => TokenType::Catch,
           "class" => TokenType::Class,
+          "const" => TokenType::Const,
+          "do" => TokenType::Do,
           "else" => TokenType::Else,
           "false" => TokenType::False,
+          "finally" => TokenType::Finally,
           "for" => TokenType::For,
           "fun" => TokenType::Fun,
           "if" => TokenType::If,
+          "in" => TokenType::In,
+          "is" => TokenType::Is,
+          "match" => TokenType::Match,
           "nil" => TokenType::Nil,
           "or" => TokenType::Or,
           "print" => TokenType::Print,
           "return" => TokenType::Return,
           "super" => TokenType::Super,
           "this" => TokenType::This,
+          "throw" => TokenType::Throw,
+          "trait" => TokenType::Trait,
+          "implements" => TokenType::Implements,
           "true" => TokenType::True,
+          "try" => TokenType::Try,
+          "using" => TokenType::Using,
           "var" => TokenType::Var,
           "while" => TokenType::While,
+          "yield" => TokenType::Yield,
           _ => TokenType::Identifier,
       };
+      // The book's Lox doesn't reserve the extensions' keywords
+      if dialect::keyword_feature(&text).is_some_and(|feature| !dialect::enabled(feature)) {
+          token_type = TokenType::Identifier;
+      }
 
       self.add_token(token_type);
   }
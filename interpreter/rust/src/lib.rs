@@ -0,0 +1,53 @@
+// The interpreter as a library, so tools can parse scripts and work with the
+// syntax tree; see walk.rs for traversing and rewriting it. The `lox` binary
+// is built on top of this.
+
+pub mod lexer;
+pub mod symbol;
+pub mod ast;
+pub mod walk;
+pub mod parser;
+pub mod logging;
+pub mod interrupt;
+pub mod interpreter;
+pub mod hooks;
+pub mod memory;
+pub mod timings;
+pub mod environment;
+pub mod callable;
+pub mod stl;
+pub mod stdlib;
+pub mod resolver;
+pub mod oop;
+pub mod typechecker;
+pub mod bignum;
+pub mod generator;
+pub mod set;
+pub mod map;
+pub mod bytes;
+pub mod regex;
+pub mod datetime;
+pub mod net;
+pub mod file;
+pub mod weak;
+pub mod csv;
+pub mod format;
+pub mod crypto;
+pub mod repl;
+pub mod pretty;
+pub mod serve;
+pub mod transpile;
+pub mod minify;
+pub mod astjson;
+pub mod doc;
+pub mod snapshot;
+pub mod dialect;
+pub mod fix;
+pub mod project;
+pub mod packages;
+pub mod replay;
+pub mod difftest;
+
+// Each Lox call takes several native frames, so run everything on a thread
+// with enough stack for the interpreter's own recursion limit
+pub const STACK_SIZE: usize = 256 * 1024 * 1024;
@@ -1,4 +1,43 @@
 use crate::lexer::*;
+use std::cell::RefCell;
+use std::sync::atomic::{AtomicBool, AtomicU8, Ordering};
+
+// Off unless the REPL finds it's talking to a terminal
+static COLOR: AtomicBool = AtomicBool::new(false);
+
+pub fn set_color(enabled: bool) {
+    COLOR.store(enabled, Ordering::Relaxed);
+}
+
+// Wraps text in an ANSI color code when color is on
+pub fn paint(text: &str, code: &str) -> String {
+    if COLOR.load(Ordering::Relaxed) {
+        format!("\x1b[{}m{}\x1b[0m", code, text)
+    } else {
+        text.to_string()
+    }
+}
+
+pub const RED: &str = "31";
+pub const GREEN: &str = "32";
+pub const YELLOW: &str = "33";
+pub const BLUE: &str = "1;34";
+pub const MAGENTA: &str = "35";
+pub const CYAN: &str = "36";
+
+// Set once an error's been reported, so a script that lexed with errors the
+// parser recovered from still exits with 65
+static HAD_ERROR: AtomicBool = AtomicBool::new(false);
+
+pub fn had_error() -> bool {
+    HAD_ERROR.load(Ordering::Relaxed)
+}
+
+// Forgets earlier errors, so a script run again (by --watch, say) is judged
+// on its own
+pub fn reset_error() {
+    HAD_ERROR.store(false, Ordering::Relaxed);
+}
 
 pub fn error_at_line(line: usize, message: &str) {
     report(line, "", message);
@@ -13,5 +52,273 @@ pub fn error_at_token(token: &Token, message: &str) {
 }
 
 pub fn report(line: usize, location: &str, message: &str) {
-    eprintln!("[line {}] Error {}: {}", line, location, message);
+    HAD_ERROR.store(true, Ordering::Relaxed);
+    write_error(&paint(&format!("[line {}] Error {}: {}", line, location, message), RED));
+}
+
+///////////// Diagnostics ///////////////
+
+// Errors stop a script from running. Warnings and info point out likely
+// mistakes (an unused variable, say) without stopping it, unless -Werror
+// makes warnings errors.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Severity {
+    Error,
+    Warning,
+    Info,
+}
+
+static WARNINGS_AS_ERRORS: AtomicBool = AtomicBool::new(false);
+
+pub fn set_warnings_as_errors(enabled: bool) {
+    WARNINGS_AS_ERRORS.store(enabled, Ordering::Relaxed);
+}
+
+pub fn warnings_as_errors() -> bool {
+    WARNINGS_AS_ERRORS.load(Ordering::Relaxed)
+}
+
+// Set by -Wmixed-equality: == and != between values of different types are
+// warned about as the script runs, since only then are the types known
+static MIXED_EQUALITY: AtomicBool = AtomicBool::new(false);
+
+pub fn set_warn_mixed_equality(enabled: bool) {
+    MIXED_EQUALITY.store(enabled, Ordering::Relaxed);
+}
+
+pub fn warn_mixed_equality() -> bool {
+    MIXED_EQUALITY.load(Ordering::Relaxed)
+}
+
+// Reports a diagnostic at a token and returns whether it counts as an error
+pub fn diagnostic(severity: Severity, token: &Token, message: &str) -> bool {
+    let severity = match severity {
+        Severity::Warning if WARNINGS_AS_ERRORS.load(Ordering::Relaxed) => Severity::Error,
+        severity => severity,
+    };
+    if severity == Severity::Error {
+        error_at_token(token, message);
+        return true;
+    }
+    let (label, color) = match severity {
+        Severity::Warning => ("Warning", YELLOW),
+        _ => ("Info", CYAN),
+    };
+    write_warning(&paint(&format!("[line {}] {} at '{}': {}", token.line, label, token.token, message), color));
+    false
+}
+
+// What a captured run printed, for callers that aren't writing to a terminal
+#[derive(Debug, Default)]
+pub struct Captured {
+    pub output: String,
+    pub errors: Vec<String>,
+    pub warnings: Vec<String>,
+}
+
+thread_local! {
+    static CAPTURE: RefCell<Option<Captured>> = RefCell::new(None);
+}
+
+// Until finish_capture, output and errors on this thread are collected
+// instead of going to stdout and stderr
+pub fn start_capture() {
+    CAPTURE.with(|capture| *capture.borrow_mut() = Some(Captured::default()));
+}
+
+pub fn finish_capture() -> Captured {
+    CAPTURE.with(|capture| capture.borrow_mut().take()).unwrap_or_default()
+}
+
+pub fn write_output(text: &str) {
+    CAPTURE.with(|capture| match capture.borrow_mut().as_mut() {
+        Some(captured) => {
+            captured.output.push_str(text);
+            captured.output.push('\n');
+        }
+        None => println!("{}", text),
+    });
+}
+
+pub fn write_error(text: &str) {
+    CAPTURE.with(|capture| match capture.borrow_mut().as_mut() {
+        Some(captured) => captured.errors.push(text.to_string()),
+        None => eprintln!("{}", text),
+    });
+}
+
+pub fn write_warning(text: &str) {
+    CAPTURE.with(|capture| match capture.borrow_mut().as_mut() {
+        Some(captured) => captured.warnings.push(text.to_string()),
+        None => eprintln!("{}", text),
+    });
+}
+
+///////////// Sources ///////////////
+
+thread_local! {
+    // The file each run of token offsets came from, by where the run starts.
+    // A script starts at 0, a project's files follow one another and the
+    // standard library sits far past them.
+    static SOURCES: RefCell<Vec<(usize, String)>> = RefCell::new(Vec::new());
+}
+
+pub fn add_source(offset: usize, name: &str) {
+    SOURCES.with(|sources| {
+        let mut sources = sources.borrow_mut();
+        match sources.binary_search_by_key(&offset, |(start, _)| *start) {
+            Ok(at) => sources[at].1 = name.to_string(),
+            Err(at) => sources.insert(at, (offset, name.to_string())),
+        }
+    });
+}
+
+// "file:line" for a token from a known file, or just its line for one typed
+// at the prompt
+pub fn location(token: &Token) -> String {
+    SOURCES.with(|sources| {
+        let sources = sources.borrow();
+        match sources.iter().rev().find(|(start, _)| *start <= token.offset) {
+            Some((_, name)) => format!("{}:{}", name, token.line),
+            None => format!("line {}", token.line),
+        }
+    })
+}
+
+///////////// Debug log ///////////////
+
+// Structured records of what the interpreter is doing, written to stderr
+// as `key=value` lines or, with --log-json, one JSON object per line. Off
+// unless --log-level is given.
+#[derive(Clone, Copy, Debug, PartialEq, PartialOrd)]
+pub enum Level {
+    Debug,
+    Info,
+    Warn,
+    Error,
+}
+
+impl Level {
+    pub fn parse(name: &str) -> Option<Level> {
+        match name.to_ascii_lowercase().as_str() {
+            "debug" => Some(Level::Debug),
+            "info" => Some(Level::Info),
+            "warn" => Some(Level::Warn),
+            "error" => Some(Level::Error),
+            _ => None,
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            Level::Debug => "DEBUG",
+            Level::Info => "INFO",
+            Level::Warn => "WARN",
+            Level::Error => "ERROR",
+        }
+    }
+}
+
+// The lowest level written, as Level's discriminant; past Error means off
+static LOG_LEVEL: AtomicU8 = AtomicU8::new(u8::MAX);
+static LOG_JSON: AtomicBool = AtomicBool::new(false);
+
+pub fn set_log_level(level: Level) {
+    LOG_LEVEL.store(level as u8, Ordering::Relaxed);
+}
+
+pub fn set_log_json(enabled: bool) {
+    LOG_JSON.store(enabled, Ordering::Relaxed);
+}
+
+// Callers check this first so records that won't be written cost nothing
+pub fn log_enabled(level: Level) -> bool {
+    level as u8 >= LOG_LEVEL.load(Ordering::Relaxed)
+}
+
+pub enum Attr {
+    Int(usize),
+    Bool(bool),
+    Text(String),
+}
+
+impl From<usize> for Attr {
+    fn from(value: usize) -> Self {
+        Attr::Int(value)
+    }
+}
+
+impl From<bool> for Attr {
+    fn from(value: bool) -> Self {
+        Attr::Bool(value)
+    }
+}
+
+impl From<&str> for Attr {
+    fn from(value: &str) -> Self {
+        Attr::Text(value.to_string())
+    }
+}
+
+impl From<String> for Attr {
+    fn from(value: String) -> Self {
+        Attr::Text(value)
+    }
+}
+
+pub fn log(level: Level, message: &str, attrs: &[(&str, Attr)]) {
+    if !log_enabled(level) {
+        return;
+    }
+    let record = if LOG_JSON.load(Ordering::Relaxed) {
+        let mut fields = vec![
+            format!("\"level\":{}", json_string(level.name())),
+            format!("\"msg\":{}", json_string(message)),
+        ];
+        for (key, value) in attrs {
+            let value = match value {
+                Attr::Int(n) => n.to_string(),
+                Attr::Bool(b) => b.to_string(),
+                Attr::Text(text) => json_string(text),
+            };
+            fields.push(format!("{}:{}", json_string(key), value));
+        }
+        format!("{{{}}}", fields.join(","))
+    } else {
+        let mut fields = vec![format!("level={}", level.name()), format!("msg={}", text_value(message))];
+        for (key, value) in attrs {
+            let value = match value {
+                Attr::Int(n) => n.to_string(),
+                Attr::Bool(b) => b.to_string(),
+                Attr::Text(text) => text_value(text),
+            };
+            fields.push(format!("{}={}", key, value));
+        }
+        fields.join(" ")
+    };
+    eprintln!("{}", record);
+}
+
+// Quoted only when it wouldn't read back as one value
+fn text_value(text: &str) -> String {
+    if !text.is_empty() && !text.chars().any(|c| c.is_whitespace() || c == '"' || c == '=') {
+        return text.to_string();
+    }
+    format!("{:?}", text)
+}
+
+fn json_string(text: &str) -> String {
+    let mut out = String::from("\"");
+    for c in text.chars() {
+        match c {
+            '"' => out.push_str("\\\""),
+            '\\' => out.push_str("\\\\"),
+            '\n' => out.push_str("\\n"),
+            '\t' => out.push_str("\\t"),
+            c if (c as u32) < 0x20 => out.push_str(&format!("\\u{:04x}", c as u32)),
+            c => out.push(c),
+        }
+    }
+    out.push('"');
+    out
 }
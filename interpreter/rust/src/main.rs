@@ -1,85 +1,1025 @@
 use std::env;
 use std::process;
+use std::thread;
 use std::fs;
-use std::io::{self, Write};
+use std::io;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::time::Duration;
 use std::rc::Rc;
 use std::cell::RefCell;
 
-mod lexer;
+use lox::STACK_SIZE;
+use lox::memory::CountingAllocator;
+use lox::ast::Stmt;
+use lox::{astjson, dialect, difftest, doc, fix, interpreter, interrupt, lexer, logging, memory, minify, packages, parser, project, repl, replay, resolver, serve, timings, transpile, typechecker};
 use lexer::*;
-mod ast;
-mod parser;
 use parser::*;
-mod logging;
-mod interpreter;
-mod environment;
-mod callable;
-mod stl;
-mod resolver;
-mod oop;
+
+// Counts what's allocated, for memStats() and --mem-stats
+#[global_allocator]
+static ALLOCATOR: CountingAllocator = CountingAllocator;
 
 fn main() {
-    let args: Vec<String> = env::args().collect();
+    let child = thread::Builder::new()
+        .stack_size(STACK_SIZE)
+        .spawn(start)
+        .expect("Failed to start the interpreter thread");
+    if child.join().is_err() {
+        process::exit(70);
+    }
+}
+
+fn start() {
+    let mut args: Vec<String> = env::args().collect();
+    take_global_options(&mut args);
     let arg_count = args.len() - 1;
-    if arg_count > 1 {
-        println!("Usage: lox/lox.exe [script]");
+    if arg_count >= 1 && args[1] == "init" {
+        run_init(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "get" {
+        run_get(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "run" {
+        run_run(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "repl" {
+        run_repl(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "check" {
+        run_check(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "serve" {
+        run_serve(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "build" {
+        run_build(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "ast" {
+        run_ast(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "doc" {
+        run_doc(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "min" {
+        run_min(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "fix" {
+        run_fix(&args[2..]);
+    } else if arg_count >= 1 && args[1] == "difftest" {
+        run_difftest(&args[2..]);
+    } else if arg_count == 1 && args[1] == "version" {
+        run_version();
+    } else if arg_count > 1 {
+        println!("Usage: lox/lox.exe [--log-level <level>] [--log-json] [-Werror] [-Wmixed-equality] [--dialect <spec>] [--mem-stats] [--timings] [script]");
+        println!("       lox/lox.exe init");
+        println!("       lox/lox.exe get [module[@ref]...]");
+        println!("       lox/lox.exe run [--watch] <script>");
+        println!("       lox/lox.exe run [--watch]");
+        println!("       lox/lox.exe run --restore <session> [script]");
+        println!("       lox/lox.exe run --record <trace> <script>");
+        println!("       lox/lox.exe run --replay <trace>");
+        println!("       lox/lox.exe repl [--script <session>]");
+        println!("       lox/lox.exe check [--types] <script>");
+        println!("       lox/lox.exe serve [--port <port>]");
+        println!("       lox/lox.exe build [--emit-go] [-o <output>] <script>");
+        println!("       lox/lox.exe ast --json <script>");
+        println!("       lox/lox.exe ast --load <file.json>");
+        println!("       lox/lox.exe min <script>");
+        println!("       lox/lox.exe doc [--html] <script>");
+        println!("       lox/lox.exe fix [--from <spec>] [--write] <script>");
+        println!("       lox/lox.exe difftest [--vm <clox>] [--seed <n>] [--count <n>] [script...]");
+        println!("       lox/lox.exe version");
         process::exit(64);
     } else if arg_count == 1 {
         let temp_arg = args[1].clone();
         run_file(temp_arg);
     } else {
-        run_prompt();
+        repl::Repl::new().run();
+    }
+}
+
+// Removes the leading `--log-level <debug|info|warn|error>` and `--log-json`
+// options, which turn on the interpreter's debug log, `-Werror`, which makes
+// warnings errors, `-Wmixed-equality`, which warns about == and != between
+// different types as the script runs, `--dialect <spec>`, `--mem-stats`,
+// which prints a summary of memory use after a script runs, and `--timings`,
+// which prints how long each phase took. `--log-json` alone logs at info.
+fn take_global_options(args: &mut Vec<String>) {
+    let mut level = None;
+    let mut json = false;
+    while args.len() > 1 && (args[1].starts_with("--log-") || args[1] == "-Werror" || args[1] == "-Wmixed-equality" || args[1] == "--dialect" || args[1] == "--mem-stats" || args[1] == "--timings") {
+        match (args[1].as_str(), args.get(2)) {
+            ("--dialect", Some(spec)) => match dialect::set(spec) {
+                Ok(()) => {
+                    args.drain(1..3);
+                }
+                Err(message) => {
+                    println!("{}", message);
+                    process::exit(64);
+                }
+            },
+            ("--mem-stats", _) => {
+                memory::set_report(true);
+                args.remove(1);
+            }
+            ("--timings", _) => {
+                timings::set_report(true);
+                args.remove(1);
+            }
+            ("-Werror", _) => {
+                logging::set_warnings_as_errors(true);
+                args.remove(1);
+            }
+            ("-Wmixed-equality", _) => {
+                logging::set_warn_mixed_equality(true);
+                args.remove(1);
+            }
+            ("--log-json", _) => {
+                json = true;
+                args.remove(1);
+            }
+            ("--log-level", Some(name)) => match logging::Level::parse(name) {
+                Some(parsed) => {
+                    level = Some(parsed);
+                    args.drain(1..3);
+                }
+                None => {
+                    println!("Unknown log level '{}'. Expected debug, info, warn or error.", name);
+                    process::exit(64);
+                }
+            },
+            _ => {
+                println!("Usage: lox/lox.exe [--log-level <level>] [--log-json] [-Werror] [-Wmixed-equality] [--dialect <spec>] [--mem-stats] [--timings] [script]");
+                process::exit(64);
+            }
+        }
+    }
+    if let Some(level) = level.or(if json { Some(logging::Level::Info) } else { None }) {
+        logging::set_log_level(level);
     }
+    logging::set_log_json(json);
 }
 
+// Exits with run()'s code, or read_error_code()'s if the script can't be
+// read. Usage mistakes exit with 64.
 fn run_file(file_path: String) {
-    let copy = file_path.clone();
-    match fs::read_to_string(file_path) {
-        Ok(content) => run(content),
+    logging::add_source(0, &file_path);
+    match fs::read_to_string(&file_path) {
+        Ok(content) => process::exit(run(content)),
         Err(err) => {
             eprintln!("Error reading file: {}", err);
-            eprintln!("Provided path: {}", copy);
+            eprintln!("Provided path: {}", file_path);
+            process::exit(read_error_code(&err));
         }
     }
 }
 
-fn run_prompt() {
-    println!("Starting Lox Prompt! :)");
-    let stdin = io::stdin();
-    let mut input = String::new();
+// 66 when the file isn't there, 74 when it is but can't be read
+fn read_error_code(err: &io::Error) -> i32 {
+    if err.kind() == io::ErrorKind::NotFound { 66 } else { 74 }
+}
 
-    loop {
-        print!(">> ");
-        io::stdout().flush().unwrap(); // Ensure the prompt is displayed
+const RUN_USAGE: &str = "Usage: lox/lox.exe run [--watch] <script>
+       lox/lox.exe run [--watch]
+       lox/lox.exe run --restore <session> [script]
+       lox/lox.exe run --record <trace> <script>
+       lox/lox.exe run --replay <trace>";
+
+fn run_run(options: &[String]) {
+    match options {
+        [] => run_project(),
+        [flag] if flag == "--watch" => watch_project(),
+        [path] => run_file(path.clone()),
+        [flag, path] if flag == "--watch" => watch(path),
+        [flag, session] if flag == "--restore" => restore(session).run(),
+        [flag, session, path] if flag == "--restore" => restore(session).load(path.clone()),
+        [flag, trace, path] if flag == "--record" => record(trace, path),
+        [flag, trace] if flag == "--replay" => replay(trace),
+        _ => {
+            println!("{}", RUN_USAGE);
+            process::exit(64);
+        }
+    }
+}
+
+// The prompt, or with --script a session of lines typed at it, played back
+// and written out as a transcript
+fn run_repl(options: &[String]) {
+    match options {
+        [] => repl::Repl::new().run(),
+        [flag, path] if flag == "--script" => match fs::read_to_string(path) {
+            Ok(content) => repl::Repl::new().run_script(&content),
+            Err(err) => {
+                eprintln!("Error reading file: {}", err);
+                eprintln!("Provided path: {}", path);
+                process::exit(read_error_code(&err));
+            }
+        },
+        _ => {
+            println!("Usage: lox/lox.exe repl [--script <session>]");
+            process::exit(64);
+        }
+    }
+}
+
+// Starts a project in the current directory
+fn run_init(options: &[String]) {
+    if !options.is_empty() {
+        println!("Usage: lox/lox.exe init");
+        process::exit(64);
+    }
+    match project::init(Path::new(".")) {
+        Ok(written) => {
+            for path in written {
+                println!("Created {}", path.display());
+            }
+        }
+        Err(message) => {
+            eprintln!("{}", message);
+            process::exit(74);
+        }
+    }
+}
+
+// Fetches modules into the project and pins them in its lockfile, or with
+// none named, fetches everything it depends on
+fn run_get(modules: &[String]) {
+    if modules.iter().any(|module| module.starts_with('-')) {
+        println!("Usage: lox/lox.exe get [module[@ref]...]");
+        process::exit(64);
+    }
+    for module in modules {
+        if let Err(message) = packages::check_path(module) {
+            println!("{}", message);
+            process::exit(64);
+        }
+    }
+    let manifest = match env::current_dir().ok().and_then(|dir| project::find(&dir)) {
+        Some(path) => path,
+        None => {
+            eprintln!("No {} here or in any directory above. Run `lox init` to start a project.", project::MANIFEST);
+            process::exit(64);
+        }
+    };
+    match packages::get(&manifest, modules) {
+        Ok(fetched) => {
+            for line in fetched {
+                println!("Fetched {}", line);
+            }
+        }
+        Err(message) => {
+            eprintln!("{}", message);
+            process::exit(74);
+        }
+    }
+}
+
+// Runs the entry point of the project the current directory is in, after the
+// rest of its sources, all in one global scope
+fn run_project() {
+    let code = run_manifest(&find_manifest(), &mut Vec::new());
+    if code != 0 {
+        process::exit(code);
+    }
+}
+
+// The manifest of the project the current directory is in, or the usage when
+// there isn't one
+fn find_manifest() -> PathBuf {
+    match env::current_dir().ok().and_then(|dir| project::find(&dir)) {
+        Some(path) => path,
+        None => {
+            eprintln!("No {} here or in any directory above. Run `lox init` to start a project.", project::MANIFEST);
+            println!("{}", RUN_USAGE);
+            process::exit(64);
+        }
+    }
+}
+
+// Runs the project and returns the exit code it ends with. `watched` gets
+// every file and directory the run read, modules included, for --watch to
+// poll: the directories so a file added to one is noticed too.
+fn run_manifest(path: &Path, watched: &mut Vec<PathBuf>) -> i32 {
+    logging::reset_error();
+    watched.push(path.to_path_buf());
+    let manifest = match project::load(path) {
+        Ok(manifest) => manifest,
+        Err(message) => {
+            eprintln!("{}", message);
+            return 65;
+        }
+    };
+    if let Some(spec) = &manifest.dialect {
+        if let Err(message) = dialect::set_default(spec) {
+            eprintln!("{}: {}", project::MANIFEST, message);
+            return 65;
+        }
+    }
+    watched.extend(manifest.sources.iter().cloned());
+    watched.extend(manifest.dependencies.iter().map(|(module, _)| manifest.root.join(project::MODULES).join(module)));
+    let files = match manifest.files() {
+        Ok(files) => files,
+        Err(message) => {
+            eprintln!("{}", message);
+            return 66;
+        }
+    };
+    let modules = match manifest.modules() {
+        Ok(modules) => modules,
+        Err(message) => {
+            eprintln!("{}", message);
+            return 66;
+        }
+    };
+    watched.extend(files.iter().cloned());
+    watched.extend(modules.iter().flat_map(|(_, files)| files.iter().cloned()));
+
+    // Each file's tokens start past the last file's, since the resolver tells
+    // names apart by their offset
+    let mut offset = 0;
+    let shared_interpreter = Box::new(Rc::new(RefCell::new(interpreter::Interpreter::new())));
+    let mut resolver = resolver::Resolver::new(shared_interpreter.clone());
+    for (name, files) in &modules {
+        let stmts = match parse_project_files(files, &mut offset) {
+            Ok(stmts) => stmts,
+            Err(code) => return code,
+        };
+        resolver.resolve_module(&stmts);
+        if resolver.had_error {
+            return 65;
+        }
+        if let Err(err) = shared_interpreter.borrow_mut().define_module(name, &stmts) {
+            err.print();
+            return 70;
+        }
+    }
+    let stmts = match parse_project_files(&files, &mut offset) {
+        Ok(stmts) => stmts,
+        Err(code) => return code,
+    };
+    resolver.resolve(&stmts);
+    if resolver.had_error {
+        return 65;
+    }
+    interrupt::install();
+    shared_interpreter.borrow_mut().interpret(&stmts);
+    if memory::report_enabled() {
+        eprint!("{}", shared_interpreter.borrow().mem_stats().summary());
+    }
+    if interrupt::interrupted() {
+        return 130;
+    }
+    if shared_interpreter.borrow().had_runtime_error {
+        return 70;
+    }
+    0
+}
+
+fn parse_project_files(files: &[PathBuf], offset: &mut usize) -> Result<Vec<Stmt>, i32> {
+    let mut stmts = Vec::new();
+    for file in files {
+        stmts.extend(parse_project_file(file, offset)?);
+    }
+    Ok(stmts)
+}
+
+// Parses one of a project's files in its dialect, with its tokens placed at
+// the offset, which moves past them. Fails with the exit code to end with.
+fn parse_project_file(file: &Path, offset: &mut usize) -> Result<Vec<Stmt>, i32> {
+    let source = match fs::read_to_string(file) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", file.display());
+            return Err(read_error_code(&err));
+        }
+    };
+    let length = source.chars().count();
+    if let Err((line, message)) = dialect::for_script(&source) {
+        logging::error_at_line(line, &message);
+        eprintln!("In {}.", file.display());
+        return Err(65);
+    }
+    logging::add_source(*offset, &file.display().to_string());
+    let mut tokens = Lexer::new(source).scan_tokens().clone();
+    for token in tokens.iter_mut() {
+        token.offset += *offset;
+    }
+    *offset += length + 1;
+    match Parser::new(tokens).parse() {
+        Ok(stmts) => Ok(stmts),
+        Err(_) => {
+            eprintln!("In {}.", file.display());
+            Err(65)
+        }
+    }
+}
 
-        input.clear(); // Clear the input buffer
-        if stdin.read_line(&mut input).is_err() {
-            break;
+fn record(trace: &str, path: &str) {
+    let source = match fs::read_to_string(path) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", path);
+            process::exit(read_error_code(&err));
+        }
+    };
+    replay::start_recording(&source);
+    logging::add_source(0, path);
+    let code = run(source);
+    if let Err(err) = fs::write(trace, replay::finish_recording()) {
+        eprintln!("Error writing file: {}", err);
+        process::exit(74);
+    }
+    process::exit(code);
+}
+
+fn replay(trace: &str) {
+    let bytes = match fs::read(trace) {
+        Ok(bytes) => bytes,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", trace);
+            process::exit(read_error_code(&err));
+        }
+    };
+    let source = match replay::start_replay(&bytes) {
+        Ok(source) => source,
+        Err(message) => {
+            eprintln!("{}", message);
+            process::exit(65);
+        }
+    };
+    let code = run(source);
+    if let Err(message) = replay::finish_replay() {
+        eprintln!("{}", message);
+        process::exit(65);
+    }
+    process::exit(code);
+}
+
+// A REPL session picking up where `:save` left off
+fn restore(session: &str) -> repl::Repl {
+    let content = match fs::read_to_string(session) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", session);
+            process::exit(read_error_code(&err));
+        }
+    };
+    let mut repl = repl::Repl::new();
+    if let Err(message) = repl.restore(&content) {
+        eprintln!("Error restoring {}: {}", session, message);
+        process::exit(65);
+    }
+    repl
+}
+
+// Runs the script again whenever it is saved, on a cleared screen. Polls the
+// modification time, so it works the same everywhere without a file watcher.
+fn watch(path: &str) {
+    if let Err(err) = fs::metadata(path) {
+        eprintln!("Error reading file: {}", err);
+        eprintln!("Provided path: {}", path);
+        process::exit(read_error_code(&err));
+    }
+    logging::add_source(0, path);
+    watch_files(path, PathBuf::from(path), |watched| {
+        watched.push(PathBuf::from(path));
+        match fs::read_to_string(path) {
+            Ok(content) => {
+                run(content);
+            }
+            Err(err) => eprintln!("Error reading file: {}", err),
         }
+    });
+}
 
-        let trimmed: &str = input.trim();
-        if trimmed.is_empty() {
+// The same for the project the current directory is in, which is run again
+// when its manifest, any of its sources or any module it uses changes
+fn watch_project() {
+    let manifest = find_manifest();
+    watch_files(&manifest.display().to_string(), manifest.clone(), |watched| {
+        run_manifest(&manifest, watched);
+    });
+}
+
+// Calls `run` at the start and again whenever one of the paths it read last
+// time changes. `main` is the file that has to exist for a run to start:
+// editors that save by replacing a file leave it missing for a moment.
+fn watch_files(name: &str, main: PathBuf, mut run: impl FnMut(&mut Vec<PathBuf>)) {
+    let modified = |path: &Path| fs::metadata(path).and_then(|metadata| metadata.modified()).ok();
+    let mut watched = vec![main.clone()];
+    let mut last_run = None;
+    loop {
+        let current: Vec<_> = watched.iter().map(|path| modified(path)).collect();
+        if modified(&main).is_none() || last_run.as_ref() == Some(&current) {
+            thread::sleep(Duration::from_millis(200));
             continue;
         }
+        print!("\x1b[2J\x1b[H");
+        println!("[watching {}, Ctrl-C to stop]\n", name);
+        // What the run reads is what's watched from now on. When that's what
+        // was watched already, the stamps from before the run are kept, so a
+        // save during it is caught next time round.
+        let mut read = Vec::new();
+        run(&mut read);
+        read.sort();
+        read.dedup();
+        let stamps: Vec<_> = read.iter().map(|path| modified(path)).collect();
+        last_run = Some(if read == watched { current } else { stamps });
+        watched = read;
+        println!("\n[finished, waiting for changes]");
+    }
+}
+
+// Runs the static passes without executing the script. Exits 65 if any report errors.
+fn run_check(options: &[String]) {
+    let mut check_types = false;
+    let mut path = None;
+    for option in options {
+        match option.as_str() {
+            "--types" => check_types = true,
+            _ if path.is_none() => path = Some(option.clone()),
+            _ => {
+                println!("Usage: lox/lox.exe check [--types] <script>");
+                process::exit(64);
+            }
+        }
+    }
+    let path = match path {
+        Some(path) => path,
+        None => {
+            println!("Usage: lox/lox.exe check [--types] <script>");
+            process::exit(64);
+        }
+    };
+    let source = match fs::read_to_string(&path) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", path);
+            process::exit(read_error_code(&err));
+        }
+    };
+
+    script_dialect(&source);
+    let mut lexer = Lexer::new(source);
+    let tokens = lexer.scan_tokens();
+    let mut parser = Parser::new(tokens.clone());
+    let stmts = match parser.parse() {
+        Ok(stmts) => stmts,
+        Err(_) => process::exit(65),
+    };
+    let shared_interpreter = Box::new(Rc::new(RefCell::new(interpreter::Interpreter::new())));
+    let mut resolver = resolver::Resolver::new(shared_interpreter);
+    resolver.resolve(&stmts);
+    let mut had_error = resolver.had_error;
+    if check_types {
+        let mut checker = typechecker::TypeChecker::new();
+        checker.check(&stmts);
+        had_error = had_error || checker.had_error;
+    }
+    if had_error {
+        process::exit(65);
+    }
+}
+
+fn run_serve(options: &[String]) {
+    let port = match options {
+        [] => 8080,
+        [flag, port] if flag == "--port" => match port.parse() {
+            Ok(port) => port,
+            Err(_) => {
+                println!("Invalid port '{}'.", port);
+                process::exit(64);
+            }
+        },
+        _ => {
+            println!("Usage: lox/lox.exe serve [--port <port>]");
+            process::exit(64);
+        }
+    };
+    serve::serve(port);
+}
+
+const BUILD_USAGE: &str = "Usage: lox/lox.exe build [--emit-go] [-o <output>] <script>";
+
+// Translates the script to Go and compiles it with the Go toolchain into an
+// executable named after the script. --emit-go writes the Go source instead.
+fn run_build(options: &[String]) {
+    let mut emit_go = false;
+    let mut output = None;
+    let mut path = None;
+    let mut options = options.iter();
+    while let Some(option) = options.next() {
+        match option.as_str() {
+            "--emit-go" => emit_go = true,
+            "-o" => match options.next() {
+                Some(value) => output = Some(value.clone()),
+                None => {
+                    println!("{}", BUILD_USAGE);
+                    process::exit(64);
+                }
+            },
+            _ if path.is_none() => path = Some(option.clone()),
+            _ => {
+                println!("{}", BUILD_USAGE);
+                process::exit(64);
+            }
+        }
+    }
+    let path = match path {
+        Some(path) => path,
+        None => {
+            println!("{}", BUILD_USAGE);
+            process::exit(64);
+        }
+    };
+    let source = match fs::read_to_string(&path) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", path);
+            process::exit(read_error_code(&err));
+        }
+    };
+
+    script_dialect(&source);
+    let mut timings = timings::Timings::start();
+    let mut lexer = Lexer::new(source.clone());
+    let tokens = lexer.scan_tokens();
+    timings.finish("lexing");
+    let mut parser = Parser::new(tokens.clone());
+    let stmts = match parser.parse() {
+        Ok(stmts) => stmts,
+        Err(_) => process::exit(65),
+    };
+    timings.finish("parsing");
+    let shared_interpreter = Box::new(Rc::new(RefCell::new(interpreter::Interpreter::new())));
+    timings.finish("setup");
+    let mut resolver = resolver::Resolver::new(shared_interpreter);
+    resolver.resolve(&stmts);
+    if resolver.had_error {
+        process::exit(65);
+    }
+    timings.finish("resolving");
+    let script = Path::new(&path);
+    let name = script.file_name().map(|name| name.to_string_lossy().into_owned()).unwrap_or(path.clone());
+    // `//line` directives need a path that still resolves from the build directory
+    let absolute = fs::canonicalize(script).map(|p| p.to_string_lossy().into_owned()).unwrap_or(path.clone());
+    let mut transpiler = transpile::GoTranspiler::with_source_map(&absolute, &source);
+    let program = transpiler.transpile(&stmts, &name);
+    if transpiler.had_error {
+        process::exit(65);
+    }
+    timings.finish("translating");
+
+    let stem = script.file_stem().map(|stem| stem.to_string_lossy().into_owned()).unwrap_or("main".to_string());
+    if emit_go {
+        let output = output.unwrap_or(format!("{}.go", stem));
+        if let Err(err) = fs::write(&output, program) {
+            eprintln!("Could not write {}: {}", output, err);
+            process::exit(74);
+        }
+        timings.report();
+        return;
+    }
+    let output = output.unwrap_or(if cfg!(windows) { format!("{}.exe", stem) } else { stem });
+    if let Err(message) = go_build(&program, Path::new(&output)) {
+        eprintln!("{}", message);
+        process::exit(70);
+    }
+    timings.finish("compiling");
+    timings.report();
+}
+
+// Builds the program in a scratch module, since `go build` wants one
+fn go_build(program: &str, output: &Path) -> Result<(), String> {
+    let output = std::path::absolute(output).map_err(|err| format!("Invalid output path: {}", err))?;
+    let dir = env::temp_dir().join(format!("lox-build-{}", process::id()));
+    let result = (|| {
+        fs::create_dir_all(&dir).map_err(|err| format!("Could not create {}: {}", dir.display(), err))?;
+        fs::write(dir.join("go.mod"), "module loxprogram\n\ngo 1.21\n").map_err(|err| err.to_string())?;
+        fs::write(dir.join("main.go"), program).map_err(|err| err.to_string())?;
+        let status = Command::new("go")
+            .arg("build")
+            .arg("-o")
+            .arg(&output)
+            .arg(".")
+            .current_dir(&dir)
+            .status()
+            .map_err(|err| format!("Could not run the Go toolchain ({}); is `go` on your PATH? --emit-go writes the Go source instead.", err))?;
+        if !status.success() {
+            return Err("go build failed.".to_string());
+        }
+        Ok(())
+    })();
+    let _ = fs::remove_dir_all(&dir);
+    result
+}
+
+const AST_USAGE: &str = "Usage: lox/lox.exe ast --json <script>\n       lox/lox.exe ast --load <file.json>";
+
+// --json prints the script's syntax tree as JSON; --load runs a tree in that
+// format, checking it with the resolver first just like a script
+fn run_ast(options: &[String]) {
+    let (load, path) = match options {
+        [flag, path] if flag == "--json" => (false, path),
+        [flag, path] if flag == "--load" => (true, path),
+        _ => {
+            println!("{}", AST_USAGE);
+            process::exit(64);
+        }
+    };
+    let source = match fs::read_to_string(path) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", path);
+            process::exit(read_error_code(&err));
+        }
+    };
+
+    if !load {
+        script_dialect(&source);
+        let mut lexer = Lexer::new(source);
+        let tokens = lexer.scan_tokens();
+        let mut parser = Parser::new(tokens.clone());
+        match parser.parse() {
+            Ok(stmts) => print!("{}", astjson::to_json(&stmts)),
+            Err(_) => process::exit(65),
+        }
+        return;
+    }
+    let stmts = match astjson::from_json(&source) {
+        Ok(stmts) => stmts,
+        Err(message) => {
+            eprintln!("{}", message);
+            process::exit(65);
+        }
+    };
+    let shared_interpreter = Box::new(Rc::new(RefCell::new(interpreter::Interpreter::new())));
+    let mut resolver = resolver::Resolver::new(shared_interpreter.clone());
+    resolver.resolve(&stmts);
+    if resolver.had_error {
+        process::exit(65);
+    }
+    shared_interpreter.borrow_mut().interpret(&stmts);
+}
 
-        run(trimmed.to_string());
+// Prints Markdown (or with --html, a web page) documenting the script's
+// functions, classes and traits from their doc comments
+fn run_doc(options: &[String]) {
+    let (html, path) = match options {
+        [path] => (false, path),
+        [flag, path] if flag == "--html" => (true, path),
+        _ => {
+            println!("Usage: lox/lox.exe doc [--html] <script>");
+            process::exit(64);
+        }
+    };
+    let source = match fs::read_to_string(path) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", path);
+            process::exit(read_error_code(&err));
+        }
+    };
+
+    script_dialect(&source);
+    let mut lexer = Lexer::new(source);
+    let tokens = lexer.scan_tokens().clone();
+    let mut parser = Parser::with_docs(tokens, lexer.docs.clone());
+    let stmts = match parser.parse() {
+        Ok(stmts) => stmts,
+        Err(_) => process::exit(65),
+    };
+    let title = Path::new(path).file_name().map(|name| name.to_string_lossy().into_owned()).unwrap_or(path.clone());
+    if html {
+        print!("{}", doc::html(&stmts, &title));
+    } else {
+        print!("{}", doc::markdown(&stmts, &title));
+    }
+}
+
+// Prints the script with comments and whitespace stripped and locals renamed
+fn run_min(options: &[String]) {
+    let path = match options {
+        [path] => path,
+        _ => {
+            println!("Usage: lox/lox.exe min <script>");
+            process::exit(64);
+        }
+    };
+    let source = match fs::read_to_string(path) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", path);
+            process::exit(read_error_code(&err));
+        }
+    };
+
+    script_dialect(&source);
+    let mut lexer = Lexer::new(source);
+    let tokens = lexer.scan_tokens();
+    let mut parser = Parser::new(tokens.clone());
+    let stmts = match parser.parse() {
+        Ok(stmts) => stmts,
+        Err(_) => process::exit(65),
+    };
+    let shared_interpreter = Box::new(Rc::new(RefCell::new(interpreter::Interpreter::new())));
+    let mut resolver = resolver::Resolver::new(shared_interpreter);
+    resolver.resolve(&stmts);
+    if resolver.had_error {
+        process::exit(65);
+    }
+    print!("{}", minify::Minifier::new(tokens).minify(&stmts));
+}
+
+// Set when building, as in
+//   LOX_COMMIT=$(git rev-parse --short HEAD) LOX_BUILD_DATE=$(date -u +%FT%TZ) cargo build --release
+// the way the Go front end takes them through -ldflags
+const COMMIT: Option<&str> = option_env!("LOX_COMMIT");
+const BUILD_DATE: Option<&str> = option_env!("LOX_BUILD_DATE");
+
+// Prints the version, where it was built from, the extensions the current
+// dialect has on, and the engines this binary can run scripts with
+fn run_version() {
+    let features: Vec<&str> = dialect::current().features().into_iter().map(|feature| feature.name()).collect();
+    println!("lox {}", env!("CARGO_PKG_VERSION"));
+    println!("commit:   {}", COMMIT.unwrap_or("unknown"));
+    println!("built:    {}", BUILD_DATE.unwrap_or("unknown"));
+    if features.is_empty() {
+        println!("dialect:  book (no extensions)");
+    } else {
+        println!("dialect:  {}", features.join(", "));
+    }
+    // The VM is clox, a separate binary that difftest drives with --vm
+    println!("engines:  tree-walker, go (lox build)");
+}
+
+const FIX_USAGE: &str = "Usage: lox/lox.exe fix [--from <spec>] [--write] <script>";
+
+// Prints the changes that make a script written for the --from dialect (the
+// book's by default) mean the same in the current one, and with --write
+// makes them
+fn run_fix(options: &[String]) {
+    let mut from = "book".to_string();
+    let mut write = false;
+    let mut path = None;
+    let mut options = options.iter();
+    while let Some(option) = options.next() {
+        match (option.as_str(), path.is_none()) {
+            ("--from", _) => match options.next() {
+                Some(spec) => from = spec.clone(),
+                None => {
+                    println!("{}", FIX_USAGE);
+                    process::exit(64);
+                }
+            },
+            ("--write", _) => write = true,
+            (_, true) if !option.starts_with("--") => path = Some(option.clone()),
+            _ => {
+                println!("{}", FIX_USAGE);
+                process::exit(64);
+            }
+        }
     }
+    let Some(path) = path else {
+        println!("{}", FIX_USAGE);
+        process::exit(64);
+    };
+    let from = match dialect::Dialect::parse(&from) {
+        Ok(from) => from,
+        Err(message) => {
+            println!("{}", message);
+            process::exit(64);
+        }
+    };
+    let source = match fs::read_to_string(&path) {
+        Ok(content) => content,
+        Err(err) => {
+            eprintln!("Error reading file: {}", err);
+            eprintln!("Provided path: {}", path);
+            process::exit(read_error_code(&err));
+        }
+    };
+
+    script_dialect(&source);
+    let fixed = match fix::fix(&source, from, dialect::current()) {
+        Some(fixed) => fixed,
+        None => process::exit(65),
+    };
+    if fixed.source == source {
+        println!("Nothing to fix in {}.", path);
+        return;
+    }
+    print!("{}", fix::diff(&path, &source, &fixed.source));
+    for note in &fixed.notes {
+        println!("{}", note);
+    }
+    if write {
+        if let Err(err) = fs::write(&path, &fixed.source) {
+            eprintln!("Error writing file: {}", err);
+            process::exit(74);
+        }
+    }
+}
+
+const DIFFTEST_USAGE: &str = "Usage: lox/lox.exe difftest [--vm <clox>] [--seed <n>] [--count <n>] [script...]";
+
+// Runs generated programs, and mutants of the given scripts, through both this
+// interpreter and the clox VM and reports any difference in their output
+fn run_difftest(options: &[String]) {
+    let seed = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .map(|elapsed| elapsed.as_secs())
+        .unwrap_or(0);
+    let mut settings = difftest::Options { vm: "clox".to_string(), seed, count: 100, corpus: Vec::new() };
+    let mut options = options.iter();
+    while let Some(option) = options.next() {
+        let value = match option.as_str() {
+            "--vm" | "--seed" | "--count" => options.next(),
+            _ => None,
+        };
+        match (option.as_str(), value) {
+            ("--vm", Some(vm)) => settings.vm = vm.clone(),
+            ("--seed", Some(n)) if n.parse::<u64>().is_ok() => settings.seed = n.parse().unwrap(),
+            ("--count", Some(n)) if n.parse::<usize>().is_ok() => settings.count = n.parse().unwrap(),
+            (path, None) if !path.starts_with("--") => settings.corpus.push(path.to_string()),
+            _ => {
+                println!("{}", DIFFTEST_USAGE);
+                process::exit(64);
+            }
+        }
+    }
+    println!("Seed {}.", settings.seed);
+    match difftest::run(&settings) {
+        Ok(true) => (),
+        Ok(false) => process::exit(70),
+        Err(message) => {
+            eprintln!("{}", message);
+            process::exit(74);
+        }
+    }
+}
+
+// Applies the script's dialect pragma, or exits if it's malformed
+fn script_dialect(source: &str) {
+    if let Err((line, message)) = dialect::for_script(source) {
+        logging::error_at_line(line, &message);
+        process::exit(65);
+    }
+}
+
+// Runs a script, returning the exit code for how it went: 0, 65 for an
+// error found before it ran, 70 for a runtime error, or 130 if Ctrl-C
+// stopped it
+fn run(source: String) -> i32 {
+    let mut timings = timings::Timings::start();
+    let code = run_phases(source, &mut timings);
+    timings.report();
+    code
 }
 
-fn run(source: String) {
+fn run_phases(source: String, timings: &mut timings::Timings) -> i32 {
+    logging::reset_error();
+    if let Err((line, message)) = dialect::for_script(&source) {
+        logging::error_at_line(line, &message);
+        return 65;
+    }
 	let mut lexer : lexer::Lexer = Lexer::new(source);
 	let tokens :&Vec<lexer::Token> = lexer.scan_tokens();
+    timings.finish("lexing");
 	let mut parser : parser::Parser = Parser::new(tokens.clone());
     let statements = parser.parse();
+    timings.finish("parsing");
     match statements {
         Ok(stmts) => {
+            if logging::had_error() {
+                return 65;
+            }
             let shared_interpreter = Box::new(Rc::new(RefCell::new(interpreter::Interpreter::new())));
+            // Defining the natives, which isn't resolving
+            timings.finish("setup");
             let mut resolver = Box::new(resolver::Resolver::new(shared_interpreter.clone()));
             resolver.resolve(&stmts);
+            timings.finish("resolving");
+            if resolver.had_error {
+                return 65;
+            }
+            interrupt::install();
             shared_interpreter.borrow_mut().interpret(&stmts);
+            timings.finish("executing");
+            if memory::report_enabled() {
+                eprint!("{}", shared_interpreter.borrow().mem_stats().summary());
+            }
+            if interrupt::interrupted() {
+                return 130;
+            }
+            if shared_interpreter.borrow().had_runtime_error {
+                return 70;
+            }
+            0
         },
         Err(_) => {
             eprintln!("parser error!");
+            65
         }
     }
-} 
+}
@@ -0,0 +1,114 @@
+/*
+Maps, written {name: "Ann", 1: "one"}, from keys to values.
+
+Keys follow the set rules in set.rs: anything hashable can be one, so
+numbers, strings, instances and frozen lists can, and unfrozen lists can't.
+An identifier before the ':' in a literal is a string key, as in JavaScript;
+any other expression is evaluated, so `(k): v` uses the value of k.
+
+Entries stay in the order their keys were first added. Printing, for-in,
+keys() and values() all go in that order, so a script that builds a map the
+same way sees it the same way every run.
+*/
+
+use crate::interpreter::*;
+use crate::lexer::*;
+use crate::set::hash;
+use std::collections::HashMap;
+
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct LoxMap {
+  // Key hash, key and value, in the order the keys were first added
+  entries: Vec<(u64, LoxValue, LoxValue)>,
+  // The positions in `entries` of the keys with each hash
+  buckets: HashMap<u64, Vec<usize>>,
+  // Set by freeze(), after which no entry can be added, changed or removed
+  pub frozen: bool,
+}
+
+impl LoxMap {
+  pub fn new() -> Self {
+    Self::default()
+  }
+
+  pub fn len(&self) -> usize {
+    self.entries.len()
+  }
+
+  pub fn keys(&self) -> Vec<LoxValue> {
+    self.entries.iter().map(|(_, key, _)| key.clone()).collect()
+  }
+
+  pub fn values(&self) -> Vec<LoxValue> {
+    self.entries.iter().map(|(_, _, value)| value.clone()).collect()
+  }
+
+  pub fn values_mut(&mut self) -> impl Iterator<Item = &mut LoxValue> {
+    self.entries.iter_mut().map(|(_, _, value)| value)
+  }
+
+  pub fn entries(&self) -> impl Iterator<Item = (&LoxValue, &LoxValue)> {
+    self.entries.iter().map(|(_, key, value)| (key, value))
+  }
+
+  pub fn get(&self, key: &LoxValue, interpreter: &Interpreter) -> Result<Option<LoxValue>, String> {
+    let position = self.position(hash(key, interpreter)?, key);
+    Ok(position.map(|i| self.entries[i].2.clone()))
+  }
+
+  pub fn has(&self, key: &LoxValue, interpreter: &Interpreter) -> Result<bool, String> {
+    Ok(self.position(hash(key, interpreter)?, key).is_some())
+  }
+
+  // A key that's already there keeps its place and takes the new value
+  pub fn insert(&mut self, key: LoxValue, value: LoxValue, interpreter: &Interpreter) -> Result<(), String> {
+    let hash = hash(&key, interpreter)?;
+    match self.position(hash, &key) {
+      Some(i) => self.entries[i].2 = value,
+      None => {
+        self.buckets.entry(hash).or_default().push(self.entries.len());
+        self.entries.push((hash, key, value));
+      }
+    }
+    Ok(())
+  }
+
+  // Returns whether the key was there. The entries after it move down a
+  // place, so the buckets are rebuilt.
+  pub fn remove(&mut self, key: &LoxValue, interpreter: &Interpreter) -> Result<bool, String> {
+    let Some(i) = self.position(hash(key, interpreter)?, key) else {
+      return Ok(false);
+    };
+    self.entries.remove(i);
+    self.buckets.clear();
+    for (i, (hash, _, _)) in self.entries.iter().enumerate() {
+      self.buckets.entry(*hash).or_default().push(i);
+    }
+    Ok(true)
+  }
+
+  // A copy that isn't frozen
+  pub fn thawed(&self) -> LoxMap {
+    LoxMap { frozen: false, ..self.clone() }
+  }
+
+  // Maps are equal when they have equal values for the same keys, in any order
+  pub fn same_entries(&self, other: &LoxMap) -> bool {
+    self.len() == other.len()
+      && self.entries.iter().all(|(hash, key, value)| other.lookup(*hash, key).is_some_and(|other| Interpreter::is_equal(value, other)))
+  }
+
+  // The value for a key whose hash is already known
+  pub fn lookup(&self, hash: u64, key: &LoxValue) -> Option<&LoxValue> {
+    self.position(hash, key).map(|i| &self.entries[i].2)
+  }
+
+  pub fn hashed_entries(&self) -> impl Iterator<Item = &(u64, LoxValue, LoxValue)> {
+    self.entries.iter()
+  }
+
+  fn position(&self, hash: u64, key: &LoxValue) -> Option<usize> {
+    let bucket = self.buckets.get(&hash)?;
+    bucket.iter().copied().find(|i| Interpreter::is_equal(&self.entries[*i].1, key))
+  }
+}
@@ -0,0 +1,272 @@
+/*
+Memory use, for memStats() and the --mem-stats summary.
+
+Two views of the heap. The allocator's: the `lox` binary installs
+CountingAllocator, which keeps a running total of the bytes and blocks that
+are live and the most bytes ever live at once. An embedder that doesn't
+install it gets zeros. And the program's: a census of the Lox objects it can
+still reach, from the globals and the current scope, through lists, sets,
+maps, instances, classes and closures. The tree-walker frees a value as soon as
+nothing refers to it, so what the census finds is what's alive, except for
+cycles, which reference counting never frees.
+*/
+
+use crate::environment::Environment;
+use crate::lexer::LoxValue;
+use crate::oop::LoxClass;
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::cell::RefCell;
+use std::collections::HashSet;
+use std::rc::Rc;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+
+static LIVE_BYTES: AtomicUsize = AtomicUsize::new(0);
+static LIVE_BLOCKS: AtomicUsize = AtomicUsize::new(0);
+static PEAK_BYTES: AtomicUsize = AtomicUsize::new(0);
+// Set by --mem-stats
+static REPORT: AtomicBool = AtomicBool::new(false);
+
+// The system allocator, counting as it goes
+pub struct CountingAllocator;
+
+unsafe impl GlobalAlloc for CountingAllocator {
+  unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+    // SAFETY: the caller upholds alloc's contract for `layout`, which is
+    // passed on to the system allocator unchanged
+    let pointer = unsafe { System.alloc(layout) };
+    if !pointer.is_null() {
+      allocated(layout.size());
+    }
+    pointer
+  }
+
+  unsafe fn dealloc(&self, pointer: *mut u8, layout: Layout) {
+    // SAFETY: `pointer` came from this allocator with `layout`, and so from
+    // System, since every allocation here is passed through to it
+    unsafe { System.dealloc(pointer, layout) };
+    freed(layout.size());
+  }
+
+  unsafe fn realloc(&self, pointer: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+    // SAFETY: as for dealloc, `pointer` and `layout` are System's, and the
+    // caller guarantees `new_size` is valid for `layout`'s alignment
+    let moved = unsafe { System.realloc(pointer, layout, new_size) };
+    if !moved.is_null() {
+      freed(layout.size());
+      allocated(new_size);
+    }
+    moved
+  }
+}
+
+fn allocated(size: usize) {
+  let live = LIVE_BYTES.fetch_add(size, Ordering::Relaxed) + size;
+  LIVE_BLOCKS.fetch_add(1, Ordering::Relaxed);
+  PEAK_BYTES.fetch_max(live, Ordering::Relaxed);
+}
+
+fn freed(size: usize) {
+  LIVE_BYTES.fetch_sub(size, Ordering::Relaxed);
+  LIVE_BLOCKS.fetch_sub(1, Ordering::Relaxed);
+}
+
+pub fn set_report(enabled: bool) {
+  REPORT.store(enabled, Ordering::Relaxed);
+}
+
+pub fn report_enabled() -> bool {
+  REPORT.load(Ordering::Relaxed)
+}
+
+#[derive(Debug, Default)]
+pub struct MemStats {
+  pub heap_bytes: usize,
+  pub peak_bytes: usize,
+  pub allocations: usize,
+  pub environments: usize,
+  pub functions: usize,
+  pub classes: usize,
+  pub instances: usize,
+  pub lists: usize,
+  pub sets: usize,
+  pub maps: usize,
+  pub bytes: usize,
+  pub generators: usize,
+}
+
+impl MemStats {
+  pub fn objects(&self) -> usize {
+    self.environments + self.functions + self.classes + self.instances + self.lists + self.sets + self.maps + self.bytes + self.generators
+  }
+
+  // The fields as memStats() names them, in the order the summary lists them
+  pub fn fields(&self) -> Vec<(&'static str, usize)> {
+    vec![
+      ("heapBytes", self.heap_bytes),
+      ("peakBytes", self.peak_bytes),
+      ("allocations", self.allocations),
+      ("objects", self.objects()),
+      ("environments", self.environments),
+      ("functions", self.functions),
+      ("classes", self.classes),
+      ("instances", self.instances),
+      ("lists", self.lists),
+      ("sets", self.sets),
+      ("maps", self.maps),
+      ("bytes", self.bytes),
+      ("generators", self.generators),
+    ]
+  }
+
+  pub fn summary(&self) -> String {
+    let mut summary = String::from("-- memory --\n");
+    for (name, value) in self.fields() {
+      summary.push_str(&format!("{:<13} {}\n", name, value));
+    }
+    summary
+  }
+}
+
+// Counts what's reachable from `roots`, the global scope and whatever scopes
+// are open, along with the allocator's totals
+pub fn stats(roots: &[Rc<RefCell<Environment>>]) -> MemStats {
+  let mut stats = Census::take(roots).stats;
+  stats.heap_bytes = LIVE_BYTES.load(Ordering::Relaxed);
+  stats.peak_bytes = PEAK_BYTES.load(Ordering::Relaxed);
+  stats.allocations = LIVE_BLOCKS.load(Ordering::Relaxed);
+  stats
+}
+
+// The ids of the native handles reachable from `roots`, for weak.rs
+pub fn reachable_handles(roots: &[Rc<RefCell<Environment>>]) -> HashSet<i64> {
+  Census::take(roots).handles
+}
+
+struct Census {
+  stats: MemStats,
+  // The addresses of the objects counted so far, so shared ones count once
+  seen: HashSet<usize>,
+  // Classes are held by value, so they're told apart by their methods'
+  // declarations, or by name when they have none
+  classes: HashSet<String>,
+  // The native handles whose methods were reached, by the ids weak.rs gives
+  handles: HashSet<i64>,
+}
+
+impl Census {
+  fn take(roots: &[Rc<RefCell<Environment>>]) -> Census {
+    let mut census = Census { stats: MemStats::default(), seen: HashSet::new(), classes: HashSet::new(), handles: HashSet::new() };
+    for root in roots {
+      census.environment(root);
+    }
+    census
+  }
+
+  fn first_visit<T: ?Sized>(&mut self, object: &Rc<T>) -> bool {
+    self.seen.insert(Rc::as_ptr(object) as *const u8 as usize)
+  }
+
+  fn environment(&mut self, environment: &Rc<RefCell<Environment>>) {
+    if !self.first_visit(environment) {
+      return;
+    }
+    self.stats.environments += 1;
+    let environment = environment.borrow();
+    for value in environment.values.values() {
+      self.value(value);
+    }
+    if let Some(enclosing) = &environment.enclosing {
+      self.environment(enclosing);
+    }
+  }
+
+  fn class(&mut self, class: &LoxClass) {
+    let key = match class.methods.values().next() {
+      Some(method) => format!("{:p}", Rc::as_ptr(&method.declaration)),
+      None => class.name.clone(),
+    };
+    if !self.classes.insert(key) {
+      return;
+    }
+    self.stats.classes += 1;
+    for method in class.methods.values() {
+      self.environment(&method.closure);
+    }
+    if let Some(superclass) = &class.superclass {
+      self.class(&superclass.borrow());
+    }
+  }
+
+  fn value(&mut self, value: &LoxValue) {
+    match value {
+      LoxValue::Callable(callable) => {
+        if self.first_visit(callable) {
+          self.stats.functions += 1;
+          let callable = callable.borrow();
+          if let Some(closure) = callable.closure() {
+            self.environment(&closure);
+          }
+          self.handles.extend(callable.handle());
+        }
+      }
+      LoxValue::Class(class) => self.class(class),
+      LoxValue::Instance(instance) => {
+        if self.first_visit(instance) {
+          self.stats.instances += 1;
+          let instance = instance.borrow();
+          self.class(&instance.class);
+          for field in instance.properties.values() {
+            self.value(field);
+          }
+        }
+      }
+      LoxValue::List(list) => {
+        if self.first_visit(list) {
+          self.stats.lists += 1;
+          for element in list.borrow().iter() {
+            self.value(element);
+          }
+        }
+      }
+      LoxValue::Set(set) => {
+        if self.first_visit(set) {
+          self.stats.sets += 1;
+          for element in set.borrow().values() {
+            self.value(&element);
+          }
+        }
+      }
+      LoxValue::Map(map) => {
+        if self.first_visit(map) {
+          self.stats.maps += 1;
+          for (key, value) in map.borrow().entries() {
+            self.value(key);
+            self.value(value);
+          }
+        }
+      }
+      LoxValue::Bytes(bytes) => {
+        if self.first_visit(bytes) {
+          self.stats.bytes += 1;
+        }
+      }
+      LoxValue::Generator(generator) => {
+        if self.first_visit(generator) {
+          self.stats.generators += 1;
+          // A running generator is only found from inside itself, and what it
+          // holds is reachable from the scopes running it
+          if let Ok(generator) = generator.try_borrow() {
+            let (environments, values) = generator.references();
+            for environment in &environments {
+              self.environment(environment);
+            }
+            for value in &values {
+              self.value(value);
+            }
+          }
+        }
+      }
+      _ => (),
+    }
+  }
+}
@@ -0,0 +1,717 @@
+/*
+`lox min`: prints a script back out as the smallest equivalent source.
+
+The script is parsed and resolved as usual and the tree is printed on one
+line, with a space only where two tokens would otherwise run together.
+Comments, type annotations and layout don't survive parsing, and `for` loops
+come back out in the while form the parser desugars them to. A script read in
+anything but the default dialect gets a `// lox-dialect:` line first, since
+its pragma was a comment too.
+
+Locals and parameters are renamed to the shortest names that are free. A
+new local is named after the number of renamed locals already in scope, so it
+can never shadow one it might refer to, while sibling scopes reuse the same
+short names. Names are never taken from any identifier that appears in the
+script, so globals and natives keep resolving to the same thing. Globals,
+properties and methods keep their names since they can be reached by name at
+runtime, and so do functions and classes, whose names show up when they are
+printed. Parameters that share a name with a `name:` anywhere in the script
+are kept too, as a named argument may refer to them.
+*/
+
+use crate::ast::*;
+use crate::dialect;
+use crate::lexer::*;
+use std::collections::{HashMap, HashSet};
+
+const KEYWORDS: &[&str] = &[
+  "and", "break", "catch", "class", "const", "do", "else", "false", "finally", "for", "fun", "if", "implements", "in",
+  "is", "match", "nil", "or", "print", "return", "super", "this", "throw", "trait", "true", "try", "using", "var", "while",
+  "yield",
+];
+
+const NAME_CHARS: &str = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ";
+
+// A string literal that can't be written with plain or raw quotes is built up
+// from pieces around this one, which is a lone quote
+const QUOTE: &str = "\"\"\"\n\"\n\"\"\"";
+
+struct Scope {
+  // Lox name -> printed name
+  names: HashMap<String, String>,
+  renamed: usize,
+}
+
+pub struct Minifier {
+  out: String,
+  scopes: Vec<Scope>,
+  // Identifiers used anywhere in the script, which short names must avoid
+  taken: HashSet<String>,
+  // Identifiers followed by ':', which may be named arguments
+  labels: HashSet<String>,
+  short_names: Vec<String>,
+  candidates: usize,
+}
+
+impl Minifier {
+  pub fn new(tokens: &[Token]) -> Self {
+    let mut taken: HashSet<String> = KEYWORDS.iter().map(|k| k.to_string()).collect();
+    let mut labels = HashSet::new();
+    for (i, token) in tokens.iter().enumerate() {
+      if token.token_type != TokenType::Identifier {
+        continue;
+      }
+      taken.insert(token.token.clone());
+      if tokens.get(i + 1).is_some_and(|next| next.token_type == TokenType::Colon) {
+        labels.insert(token.token.clone());
+      }
+    }
+    Self { out: String::new(), scopes: Vec::new(), taken, labels, short_names: Vec::new(), candidates: 0 }
+  }
+
+  pub fn minify(&mut self, statements: &[Stmt]) -> String {
+    if let Some(pragma) = dialect::current().pragma() {
+      self.out.push_str(&pragma);
+      self.out.push('\n');
+    }
+    for statement in statements {
+      self.statement(statement);
+    }
+    self.out.push('\n');
+    std::mem::take(&mut self.out)
+  }
+
+  // Appends a token, separated from the previous one only if they would
+  // otherwise lex as a single word
+  fn emit(&mut self, text: &str) {
+    let is_word = |c: char| c.is_alphanumeric() || c == '_';
+    if self.out.ends_with(is_word) && text.starts_with(is_word) {
+      self.out.push(' ');
+    }
+    self.out.push_str(text);
+  }
+
+  ///////////// Names ///////////////
+
+  fn begin_scope(&mut self) {
+    self.scopes.push(Scope { names: HashMap::new(), renamed: 0 });
+  }
+
+  fn end_scope(&mut self) {
+    self.scopes.pop();
+  }
+
+  // The index-th of the names a..Z, aa..ZZ, ... that aren't used in the script
+  fn short_name(&mut self, index: usize) -> String {
+    while self.short_names.len() <= index {
+      let name = nth_name(self.candidates);
+      self.candidates += 1;
+      if !self.taken.contains(&name) {
+        self.short_names.push(name);
+      }
+    }
+    self.short_names[index].clone()
+  }
+
+  // Declares a name in the current scope and emits what it is printed as. At
+  // the top level, and for names that must be kept, that is the name itself.
+  fn declare(&mut self, name: &Token, rename: bool) {
+    if self.scopes.is_empty() {
+      self.emit(&name.token);
+      return;
+    }
+    let printed = if rename {
+      let index = self.scopes.iter().map(|s| s.renamed).sum();
+      self.scopes.last_mut().unwrap().renamed += 1;
+      self.short_name(index)
+    } else {
+      name.token.clone()
+    };
+    self.scopes.last_mut().unwrap().names.insert(name.token.clone(), printed.clone());
+    self.emit(&printed);
+  }
+
+  fn parameter(&mut self, name: &Token) {
+    let rename = !self.labels.contains(&name.token);
+    self.declare(name, rename);
+  }
+
+  fn variable(&mut self, name: &Token) {
+    let printed = self.scopes.iter().rev()
+      .find_map(|scope| scope.names.get(&name.token))
+      .cloned()
+      .unwrap_or(name.token.clone());
+    self.emit(&printed);
+  }
+
+  ///////////// Statements ///////////////
+
+  fn statement(&mut self, statement: &Stmt) {
+    match statement {
+      Stmt::Block(block) => self.block(&block.statements),
+      Stmt::Expression(stmt) => {
+        self.expression(&stmt.expression);
+        self.emit(";");
+      }
+      Stmt::Print(stmt) => {
+        self.emit("print");
+        for (i, expression) in stmt.expressions.iter().enumerate() {
+          if i > 0 {
+            self.emit(",");
+          }
+          self.expression(expression);
+        }
+        self.emit(";");
+      }
+      Stmt::Return(stmt) => {
+        self.emit("return");
+        if let Some(value) = &stmt.value {
+          self.expression(value);
+        }
+        self.emit(";");
+      }
+      Stmt::Yield(stmt) => {
+        self.emit("yield");
+        if let Some(value) = &stmt.value {
+          self.expression(value);
+        }
+        self.emit(";");
+      }
+      Stmt::Break(_) => self.emit("break;"),
+      Stmt::Try(stmt) => {
+        self.emit("try");
+        self.block(&stmt.body.statements);
+        for clause in &stmt.catches {
+          self.emit("catch(");
+          self.begin_scope();
+          self.declare(&clause.name, true);
+          if let Some(class) = &clause.class {
+            self.emit(":");
+            self.expression(class);
+          }
+          self.emit(")");
+          self.block(&clause.body.statements);
+          self.end_scope();
+        }
+        if let Some(finally) = &stmt.finally {
+          self.emit("finally");
+          self.block(&finally.statements);
+        }
+      }
+      Stmt::Throw(stmt) => {
+        self.emit("throw");
+        self.expression(&stmt.value);
+        self.emit(";");
+      }
+      Stmt::Using(stmt) => {
+        self.emit("using(var");
+        let start = self.out.len();
+        self.emit("=");
+        self.expression(&stmt.initializer);
+        let initializer = self.out.split_off(start);
+        self.begin_scope();
+        self.declare(&stmt.name, true);
+        self.emit(&initializer);
+        self.emit(")");
+        self.block(&stmt.body.statements);
+        self.end_scope();
+      }
+      Stmt::Var(stmt) => {
+        self.emit(if stmt.constant { "const" } else { "var" });
+        // The initializer can't see the name being declared
+        let mut initializer = String::new();
+        if let Some(value) = &stmt.initializer {
+          let start = self.out.len();
+          self.emit("=");
+          self.expression(value);
+          initializer = self.out.split_off(start);
+        }
+        self.declare(&stmt.name, true);
+        self.emit(&initializer);
+        self.emit(";");
+      }
+      Stmt::Destructure(stmt) => {
+        self.emit(if stmt.constant { "const" } else { "var" });
+        let start = self.out.len();
+        self.emit("=");
+        self.expression(&stmt.initializer);
+        let initializer = self.out.split_off(start);
+        self.destructure(&stmt.pattern, true);
+        self.emit(&initializer);
+        self.emit(";");
+      }
+      Stmt::Fun(stmt) => {
+        self.emit("fun");
+        self.declare(&stmt.name, false);
+        self.function(stmt);
+      }
+      Stmt::If(stmt) => {
+        self.emit("if(");
+        self.expression(&stmt.condition);
+        self.emit(")");
+        self.statement(&stmt.then_branch);
+        if let Some(else_branch) = &stmt.else_branch {
+          self.emit("else");
+          self.statement(else_branch);
+        }
+      }
+      Stmt::While(stmt) => {
+        self.emit("while(");
+        self.expression(&stmt.condition);
+        self.emit(")");
+        self.statement(&stmt.body);
+        self.loop_else(&stmt.else_branch);
+      }
+      Stmt::DoWhile(stmt) => {
+        self.emit("do");
+        self.statement(&stmt.body);
+        self.emit("while(");
+        self.expression(&stmt.condition);
+        self.emit(");");
+      }
+      Stmt::For(stmt) => {
+        // The parser desugars for loops, but print one faithfully if it's there
+        self.begin_scope();
+        self.emit("for(");
+        match &stmt.initializer {
+          Some(initializer) => self.statement(initializer),
+          None => self.emit(";"),
+        }
+        if let Some(condition) = &stmt.condition {
+          self.expression(condition);
+        }
+        self.emit(";");
+        if let Some(increment) = &stmt.increment {
+          self.expression(increment);
+        }
+        self.emit(")");
+        self.statement(&stmt.body);
+        self.end_scope();
+      }
+      Stmt::ForIn(stmt) => {
+        self.emit("for(");
+        let start = self.out.len();
+        self.emit("in");
+        self.expression(&stmt.iterable);
+        self.emit(")");
+        let iterable = self.out.split_off(start);
+        self.begin_scope();
+        self.declare(&stmt.name, true);
+        self.emit(&iterable);
+        self.statement(&stmt.body);
+        self.end_scope();
+        self.loop_else(&stmt.else_branch);
+      }
+      Stmt::Class(stmt) => self.class(stmt),
+      Stmt::Trait(stmt) => {
+        self.emit("trait");
+        self.emit(&stmt.name.token);
+        self.emit("{");
+        for method in &stmt.methods {
+          self.emit(&method.name.token);
+          self.emit("(");
+          let params: Vec<&str> = method.params.iter().map(|p| p.token.as_str()).collect();
+          self.emit(&params.join(","));
+          self.emit(");");
+        }
+        self.emit("}");
+      }
+    }
+  }
+
+  fn block(&mut self, statements: &[Stmt]) {
+    self.begin_scope();
+    self.emit("{");
+    for statement in statements {
+      self.statement(statement);
+    }
+    self.emit("}");
+    self.end_scope();
+  }
+
+  fn loop_else(&mut self, else_branch: &Option<Box<Stmt>>) {
+    if let Some(else_branch) = else_branch {
+      self.emit("else");
+      self.statement(else_branch);
+    }
+  }
+
+  // The parameter list and body; the caller has printed the name
+  fn function(&mut self, stmt: &FunStmt) {
+    self.begin_scope();
+    self.emit("(");
+    for (i, (param, default)) in stmt.params.iter().zip(&stmt.defaults).enumerate() {
+      if i > 0 {
+        self.emit(",");
+      }
+      // Defaults see the parameters before them, but not their own
+      let mut value = String::new();
+      if let Some(default) = default {
+        let start = self.out.len();
+        self.emit("=");
+        self.expression(default);
+        value = self.out.split_off(start);
+      }
+      self.parameter(param);
+      self.emit(&value);
+    }
+    if let Some(rest) = &stmt.rest {
+      if !stmt.params.is_empty() {
+        self.emit(",");
+      }
+      self.emit("...");
+      self.parameter(rest);
+    }
+    self.emit(")");
+    self.block(&stmt.body.statements);
+    self.end_scope();
+  }
+
+  fn class(&mut self, stmt: &ClassStmt) {
+    self.emit("class");
+    self.declare(&stmt.name, false);
+    if let Some(Expr::Variable(superclass)) = stmt.superclass.as_deref() {
+      self.emit("<");
+      self.variable(&superclass.name);
+    }
+    if !stmt.traits.is_empty() {
+      self.emit("implements");
+      let traits: Vec<&str> = stmt.traits.iter().map(|t| t.token.as_str()).collect();
+      self.emit(&traits.join(","));
+    }
+    self.emit("{");
+    for method in &stmt.methods {
+      self.emit(&method.name.token);
+      self.function(method);
+    }
+    self.emit("}");
+  }
+
+  ///////////// Expressions ///////////////
+
+  fn expression(&mut self, expr: &Expr) {
+    match expr {
+      Expr::Literal(literal) => {
+        let text = literal_source(&literal.literal);
+        self.emit(&text);
+      }
+      Expr::Grouping(grouping) => {
+        self.emit("(");
+        self.expression(&grouping.expression);
+        self.emit(")");
+      }
+      Expr::Unary(unary) => {
+        self.emit(&unary.operator.token);
+        self.expression(&unary.right);
+      }
+      Expr::Binary(binary) => {
+        self.expression(&binary.left);
+        self.emit(&binary.operator.token);
+        self.expression(&binary.right);
+      }
+      Expr::Logical(logical) => {
+        self.expression(&logical.left);
+        self.emit(&logical.operator.token);
+        self.expression(&logical.right);
+      }
+      Expr::Comparison(comparison) => {
+        self.expression(&comparison.left);
+        for (operator, right) in &comparison.comparisons {
+          self.emit(&operator.token);
+          self.expression(right);
+        }
+      }
+      Expr::Variable(variable) => self.variable(&variable.name),
+      Expr::Assign(assign) => {
+        self.variable(&assign.name);
+        self.emit("=");
+        self.expression(&assign.value);
+      }
+      Expr::Call(call) => {
+        self.expression(&call.callee);
+        self.emit("(");
+        self.list(&call.arguments);
+        for (i, (name, value)) in call.named_arguments.iter().enumerate() {
+          if i > 0 || !call.arguments.is_empty() {
+            self.emit(",");
+          }
+          self.emit(&name.token);
+          self.emit(":");
+          self.expression(value);
+        }
+        self.emit(")");
+      }
+      Expr::Get(get) => {
+        self.expression(&get.object);
+        self.emit(".");
+        self.emit(&get.name.token);
+      }
+      Expr::OptionalGet(get) => {
+        self.expression(&get.object);
+        self.emit("?.");
+        self.emit(&get.name.token);
+      }
+      Expr::OptionalIndex(index) => {
+        self.expression(&index.object);
+        self.emit("?[");
+        self.expression(&index.index);
+        self.emit("]");
+      }
+      Expr::OptionalChain(chain) => self.expression(&chain.expression),
+      Expr::Set(set) => {
+        self.expression(&set.object);
+        self.emit(".");
+        self.emit(&set.name.token);
+        self.emit("=");
+        self.expression(&set.value);
+      }
+      Expr::Super(expr) => {
+        self.emit("super.");
+        self.emit(&expr.method.token);
+      }
+      Expr::This(_) => self.emit("this"),
+      Expr::List(list) => {
+        self.emit("[");
+        self.list(&list.elements);
+        self.emit("]");
+      }
+      Expr::SetLiteral(set) => {
+        self.emit("#{");
+        self.list(&set.elements);
+        self.emit("}");
+      }
+      Expr::MapLiteral(map) => {
+        self.emit("{");
+        for (i, (key, value)) in map.entries.iter().enumerate() {
+          if i > 0 {
+            self.emit(",");
+          }
+          self.expression(key);
+          self.emit(":");
+          self.expression(value);
+        }
+        self.emit("}");
+      }
+      Expr::Index(index) => {
+        self.expression(&index.object);
+        self.emit("[");
+        self.expression(&index.index);
+        self.emit("]");
+      }
+      Expr::IndexSet(index) => {
+        self.expression(&index.object);
+        self.emit("[");
+        self.expression(&index.index);
+        self.emit("]=");
+        self.expression(&index.value);
+      }
+      Expr::Spread(spread) => {
+        self.emit("...");
+        self.expression(&spread.expression);
+      }
+      Expr::DestructureAssign(assign) => {
+        self.destructure(&assign.pattern, false);
+        self.emit("=");
+        self.expression(&assign.value);
+      }
+      Expr::Interpolation(interpolation) => {
+        // The string segments alternate with the expressions, starting and
+        // ending with a segment, and are already free of quotes and "${"
+        for (i, part) in interpolation.parts.iter().enumerate() {
+          match part {
+            Expr::Literal(LiteralExpr { literal: LoxValue::String(segment), .. }) if i % 2 == 0 => {
+              let open = if i == 0 { "\"" } else { "}" };
+              let close = if i == interpolation.parts.len() - 1 { "\"" } else { "${" };
+              self.emit(&format!("{}{}{}", open, segment, close));
+            }
+            _ => self.expression(part),
+          }
+        }
+      }
+      Expr::Match(expr) => {
+        self.emit("match(");
+        self.expression(&expr.subject);
+        self.emit("){");
+        for (i, arm) in expr.arms.iter().enumerate() {
+          if i > 0 {
+            self.emit(",");
+          }
+          self.begin_scope();
+          self.pattern(&arm.pattern);
+          if let Some(guard) = &arm.guard {
+            self.emit("if");
+            self.expression(guard);
+          }
+          self.emit("=>");
+          self.expression(&arm.body);
+          self.end_scope();
+        }
+        self.emit("}");
+      }
+    }
+  }
+
+  // Comma-separated arguments or list elements
+  // A list pattern as `[a,b]` and a map pattern as `{key:a}`, since the
+  // variables may be renamed away from the keys. `declare` is for `var`.
+  fn destructure(&mut self, pattern: &DestructurePattern, declare: bool) {
+    self.emit(if pattern.keys.is_some() { "{" } else { "[" });
+    for (i, target) in pattern.targets.iter().enumerate() {
+      if i > 0 {
+        self.emit(",");
+      }
+      if let Some(keys) = &pattern.keys {
+        self.emit(&keys[i].token);
+        self.emit(":");
+      }
+      if declare {
+        self.declare(&target.name, true);
+      } else {
+        self.variable(&target.name);
+      }
+    }
+    if let Some(rest) = &pattern.rest {
+      if !pattern.targets.is_empty() {
+        self.emit(",");
+      }
+      self.emit("...");
+      if declare {
+        self.declare(&rest.name, true);
+      } else {
+        self.variable(&rest.name);
+      }
+    }
+    self.emit(if pattern.keys.is_some() { "}" } else { "]" });
+  }
+
+  fn list(&mut self, exprs: &[Expr]) {
+    for (i, expr) in exprs.iter().enumerate() {
+      if i > 0 {
+        self.emit(",");
+      }
+      self.expression(expr);
+    }
+  }
+
+  // Class names in a pattern are looked up outside the arm, before any of its
+  // bindings are declared
+  fn pattern(&mut self, pattern: &Pattern) {
+    match pattern {
+      Pattern::Wildcard => self.emit("_"),
+      Pattern::Literal(literal) => {
+        let text = literal_source(&literal.literal);
+        self.emit(&text);
+      }
+      Pattern::Binding(variable) => self.declare(&variable.name, true),
+      Pattern::List(list) => {
+        self.emit("[");
+        for (i, element) in list.elements.iter().enumerate() {
+          if i > 0 {
+            self.emit(",");
+          }
+          self.pattern(element);
+        }
+        if let Some(rest) = &list.rest {
+          if !list.elements.is_empty() {
+            self.emit(",");
+          }
+          self.emit("...");
+          self.declare(&rest.name, true);
+        }
+        self.emit("]");
+      }
+      Pattern::Class(class) => {
+        let scope = self.scopes.pop().unwrap();
+        self.variable(&class.class.name);
+        self.scopes.push(scope);
+        self.emit("{");
+        for (i, (field, pattern)) in class.fields.iter().enumerate() {
+          if i > 0 {
+            self.emit(",");
+          }
+          self.emit(&field.token);
+          let start = self.out.len();
+          self.emit(":");
+          self.pattern(pattern);
+          // `{x: x}` can go back to the shorthand `{x}`
+          if self.out[start..] == format!(":{}", field.token) {
+            self.out.truncate(start);
+          }
+        }
+        self.emit("}");
+      }
+      Pattern::Map(map) => {
+        self.emit("{");
+        for (i, (key, pattern)) in map.entries.iter().enumerate() {
+          if i > 0 {
+            self.emit(",");
+          }
+          let key = literal_source(&key.literal);
+          self.emit(&key);
+          self.emit(":");
+          self.pattern(pattern);
+        }
+        if let Some(rest) = &map.rest {
+          if !map.entries.is_empty() {
+            self.emit(",");
+          }
+          self.emit("...");
+          self.declare(&rest.name, true);
+        }
+        self.emit("}");
+      }
+    }
+  }
+}
+
+// Compact source for a single expression, with every name as written
+pub fn source(expr: &Expr) -> String {
+  let mut minifier = Minifier::new(&[]);
+  minifier.expression(expr);
+  minifier.out
+}
+
+// Bijective base 52, so every string of letters comes up exactly once
+fn nth_name(mut n: usize) -> String {
+  let chars: Vec<char> = NAME_CHARS.chars().collect();
+  let mut name = String::new();
+  loop {
+    name.insert(0, chars[n % chars.len()]);
+    if n < chars.len() {
+      return name;
+    }
+    n = n / chars.len() - 1;
+  }
+}
+
+// Source text that lexes back to the same value
+fn literal_source(value: &LoxValue) -> String {
+  match value {
+    LoxValue::Number(n) if n.is_infinite() => "1e999".to_string(),
+    LoxValue::Number(n) => format!("{:?}", n),
+    LoxValue::BigInt(n) => format!("{}n", n),
+    LoxValue::String(s) => string_source(s),
+    other => other.to_string(),
+  }
+}
+
+// Strings have no escapes, so a string with a quote in it has to be raw
+// triple-quoted, and one that doesn't survive the dedenting of those is
+// joined together from pieces instead
+fn string_source(text: &str) -> String {
+  if !text.contains('"') {
+    if text.contains("${") {
+      return format!("r\"{}\"", text);
+    }
+    return format!("\"{}\"", text);
+  }
+  let lines: Vec<&str> = text.split('\n').collect();
+  let trailing_blank = lines.len() > 1 && lines.last().unwrap().trim().is_empty();
+  let indented = lines.iter().filter(|line| !line.trim().is_empty()).all(|line| line.starts_with(char::is_whitespace));
+  if !text.contains("\"\"\"") && !text.ends_with('"') && !trailing_blank && !indented {
+    // The newline after the opening quotes is dropped
+    return format!("\"\"\"\n{}\"\"\"", text);
+  }
+  let pieces: Vec<String> = text.split('"').map(string_source).collect();
+  format!("({})", pieces.join(&format!("+{}+", QUOTE)))
+}
@@ -0,0 +1,232 @@
+/*
+TCP sockets for listen(), connect() and ready(), modelled on Go's net
+package: addresses are "host:port" strings, and ":port" listens on every
+interface.
+
+Reads and accepts block, so a script that talks to several peers at once
+runs each conversation as a generator and asks ready() which sockets can go
+on without blocking, resuming only those generators. The standard library
+has no poll(), so ready() checks each socket without blocking and sleeps
+briefly between rounds. A listener's check accepts the connection it finds
+and keeps it for the next accept(); a connection's check peeks at its data.
+
+Sockets are found again from their Lox instances by the id weak.rs tracks
+them by. The registry only holds them weakly, so a socket closes once nothing
+in the script refers to its instance.
+*/
+
+use crate::weak::{self, Handle};
+use std::cell::RefCell;
+use std::collections::{HashMap, VecDeque};
+use std::io::{self, ErrorKind, Read, Write};
+use std::net::{SocketAddr, TcpListener, TcpStream};
+use std::rc::{Rc, Weak};
+use std::thread;
+use std::time::{Duration, Instant};
+
+// The most read() hands back at once
+const READ_SIZE: usize = 4096;
+// How long ready() sleeps when nothing is ready yet
+const POLL_INTERVAL: Duration = Duration::from_millis(5);
+
+pub enum Socket {
+  Listener { listener: TcpListener, pending: VecDeque<TcpStream> },
+  // `buffer` holds what's been read but not handed out yet, which readLine()
+  // leaves behind after the newline
+  Connection { stream: TcpStream, buffer: Vec<u8>, eof: bool },
+  Closed,
+}
+
+thread_local! {
+  static SOCKETS: RefCell<HashMap<i64, Weak<RefCell<Socket>>>> = RefCell::new(HashMap::new());
+}
+
+// Records the socket and returns the id to find it by
+pub fn register(socket: &Rc<RefCell<Socket>>) -> i64 {
+  let id = weak::track(socket.clone());
+  SOCKETS.with(|sockets| {
+    let mut sockets = sockets.borrow_mut();
+    sockets.retain(|_, socket| socket.strong_count() > 0);
+    sockets.insert(id, Rc::downgrade(socket));
+  });
+  id
+}
+
+pub fn lookup(id: i64) -> Option<Rc<RefCell<Socket>>> {
+  SOCKETS.with(|sockets| sockets.borrow().get(&id).and_then(Weak::upgrade))
+}
+
+// Go's ":8080" means every interface, which Rust spells out
+fn socket_address(address: &str) -> String {
+  match address.strip_prefix(':') {
+    Some(port) => format!("0.0.0.0:{}", port),
+    None => address.to_string(),
+  }
+}
+
+fn describe(err: io::Error) -> String {
+  format!("{}.", err)
+}
+
+pub fn listen(address: &str) -> Result<Socket, String> {
+  let listener = TcpListener::bind(socket_address(address)).map_err(|err| format!("Can't listen on '{}': {}", address, describe(err)))?;
+  Ok(Socket::Listener { listener, pending: VecDeque::new() })
+}
+
+pub fn connect(address: &str) -> Result<Socket, String> {
+  let stream = TcpStream::connect(address).map_err(|err| format!("Can't connect to '{}': {}", address, describe(err)))?;
+  Ok(Socket::connection(stream))
+}
+
+impl Socket {
+  fn connection(stream: TcpStream) -> Self {
+    Socket::Connection { stream, buffer: Vec::new(), eof: false }
+  }
+
+  // The local address, and for a connection the remote one
+  pub fn addresses(&self) -> (String, String) {
+    let address = |address: io::Result<SocketAddr>| address.map_or(String::new(), |address| address.to_string());
+    match self {
+      Socket::Listener { listener, .. } => (address(listener.local_addr()), String::new()),
+      Socket::Connection { stream, .. } => (address(stream.local_addr()), address(stream.peer_addr())),
+      Socket::Closed => (String::new(), String::new()),
+    }
+  }
+
+  pub fn accept(&mut self) -> Result<Socket, String> {
+    match self {
+      Socket::Listener { listener, pending } => {
+        let stream = match pending.pop_front() {
+          Some(stream) => stream,
+          None => listener.accept().map_err(describe)?.0,
+        };
+        Ok(Socket::connection(stream))
+      }
+      _ => Err(self.not_a("listener")),
+    }
+  }
+
+  // Whatever has arrived, waiting for something if nothing has, or None once
+  // the peer has closed its end
+  pub fn read(&mut self) -> Result<Option<Vec<u8>>, String> {
+    let Socket::Connection { buffer, .. } = self else {
+      return Err(self.not_a("connection"));
+    };
+    if buffer.is_empty() && !self.fill()? {
+      return Ok(None);
+    }
+    let Socket::Connection { buffer, .. } = self else { unreachable!() };
+    Ok(Some(std::mem::take(buffer)))
+  }
+
+  // Up to the next "\n", which is dropped along with a "\r" before it. The
+  // last line doesn't need one.
+  pub fn read_line(&mut self) -> Result<Option<Vec<u8>>, String> {
+    loop {
+      let Socket::Connection { buffer, eof, .. } = self else {
+        return Err(self.not_a("connection"));
+      };
+      if let Some(end) = buffer.iter().position(|b| *b == b'\n') {
+        let mut line: Vec<u8> = buffer.drain(..=end).collect();
+        line.pop();
+        if line.last() == Some(&b'\r') {
+          line.pop();
+        }
+        return Ok(Some(line));
+      }
+      if *eof {
+        return Ok(if buffer.is_empty() { None } else { Some(std::mem::take(buffer)) });
+      }
+      self.fill()?;
+    }
+  }
+
+  // Reads more into the buffer, returning false at the end of the stream
+  fn fill(&mut self) -> Result<bool, String> {
+    let Socket::Connection { stream, buffer, eof } = self else {
+      return Err(self.not_a("connection"));
+    };
+    let mut chunk = [0; READ_SIZE];
+    let n = stream.read(&mut chunk).map_err(describe)?;
+    buffer.extend_from_slice(&chunk[..n]);
+    *eof = n == 0;
+    Ok(n > 0)
+  }
+
+  pub fn write(&mut self, data: &[u8]) -> Result<(), String> {
+    match self {
+      Socket::Connection { stream, .. } => stream.write_all(data).map_err(describe),
+      _ => Err(self.not_a("connection")),
+    }
+  }
+
+  // Dropping the listener or stream closes it
+  pub fn close(&mut self) {
+    *self = Socket::Closed;
+  }
+
+  // Whether accept() or read() would go ahead without waiting. Errors count
+  // as ready, so the call that's waiting for them reports them.
+  fn is_ready(&mut self) -> Result<bool, String> {
+    match self {
+      Socket::Listener { listener, pending } => {
+        if !pending.is_empty() {
+          return Ok(true);
+        }
+        listener.set_nonblocking(true).map_err(describe)?;
+        let accepted = listener.accept();
+        listener.set_nonblocking(false).map_err(describe)?;
+        match accepted {
+          Ok((stream, _)) => {
+            stream.set_nonblocking(false).map_err(describe)?;
+            pending.push_back(stream);
+            Ok(true)
+          }
+          Err(err) => Ok(err.kind() != ErrorKind::WouldBlock),
+        }
+      }
+      Socket::Connection { stream, buffer, eof } => {
+        if !buffer.is_empty() || *eof {
+          return Ok(true);
+        }
+        stream.set_nonblocking(true).map_err(describe)?;
+        let peeked = stream.peek(&mut [0]);
+        stream.set_nonblocking(false).map_err(describe)?;
+        Ok(!matches!(peeked, Err(err) if err.kind() == ErrorKind::WouldBlock))
+      }
+      Socket::Closed => Err("The socket is closed.".to_string()),
+    }
+  }
+
+  fn not_a(&self, kind: &str) -> String {
+    match self {
+      Socket::Closed => "The socket is closed.".to_string(),
+      _ => format!("The socket is not a {}.", kind),
+    }
+  }
+}
+
+impl Handle for Socket {
+  fn close(&mut self) {
+    Socket::close(self);
+  }
+}
+
+// The positions in `sockets` of the ones that are ready, waiting until at
+// least one is or `timeout` runs out. With no timeout it waits for as long
+// as it takes.
+pub fn ready(sockets: &[Rc<RefCell<Socket>>], timeout: Option<Duration>) -> Result<Vec<usize>, String> {
+  let deadline = timeout.map(|timeout| Instant::now() + timeout);
+  loop {
+    let mut ready = Vec::new();
+    for (i, socket) in sockets.iter().enumerate() {
+      if socket.borrow_mut().is_ready()? {
+        ready.push(i);
+      }
+    }
+    if !ready.is_empty() || deadline.is_some_and(|deadline| Instant::now() >= deadline) {
+      return Ok(ready);
+    }
+    thread::sleep(POLL_INTERVAL);
+  }
+}
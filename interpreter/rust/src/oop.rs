@@ -1,6 +1,7 @@
 use crate::callable::*;
 use crate::interpreter::*;
 use crate::lexer::*;
+use crate::resolver::closest;
 use crate::stl::LoxFunction;
 use std::collections::HashMap;
 use std::fmt;
@@ -30,12 +31,132 @@ impl LoxClass {
   pub fn new(name: String, superclass: Option<Rc<RefCell<LoxClass>>>, methods: HashMap<String, LoxFunction> ) -> Self {
     Self { name, superclass, methods }
   }
+
+  // Looks the method up on this class, then up the superclass chain
+  pub fn find_method(&self, name: &str) -> Option<LoxFunction> {
+    if let Some(method) = self.methods.get(name) {
+      return Some(method.clone());
+    }
+    match &self.superclass {
+      Some(superclass) => superclass.borrow().find_method(name),
+      None => None,
+    }
+  }
+
+  // The class, this one or one it inherits from, that has `method` as one
+  // of its own methods
+  pub fn declaring_class(&self, method: &LoxFunction) -> Option<String> {
+    if self.methods.values().any(|own| Rc::ptr_eq(&own.declaration, &method.declaration)) {
+      return Some(self.name.clone());
+    }
+    self.superclass.as_ref().and_then(|superclass| superclass.borrow().declaring_class(method))
+  }
+
+  // Its methods' names and those it inherits
+  pub fn method_names(&self) -> Vec<String> {
+    let mut names: Vec<String> = self.methods.keys().cloned().collect();
+    if let Some(superclass) = &self.superclass {
+      names.extend(superclass.borrow().method_names());
+    }
+    names
+  }
+
+  // The error for a method it doesn't have, naming the closest one it does
+  pub fn undefined_method(&self, name: &str) -> String {
+    undefined_property(name, &self.method_names())
+  }
+
+  // True when this class is `other` or inherits from it
+  pub fn is_subclass_of(&self, other: &LoxClass) -> bool {
+    if self == other {
+      return true;
+    }
+    match &self.superclass {
+      Some(superclass) => superclass.borrow().is_subclass_of(other),
+      None => false,
+    }
+  }
+}
+
+// An instance's fields, which go in the order they were first set when
+// iterated, so fields(), printing and snapshots list them the same way every
+// run. Equal when they hold the same fields, whatever the order.
+#[derive(Clone, Default)]
+pub struct Fields {
+  names: Vec<String>,
+  values: HashMap<String, LoxValue>,
+}
+
+impl Fields {
+  pub fn new() -> Self {
+    Self::default()
+  }
+
+  pub fn get(&self, name: &str) -> Option<&LoxValue> {
+    self.values.get(name)
+  }
+
+  pub fn contains_key(&self, name: &str) -> bool {
+    self.values.contains_key(name)
+  }
+
+  pub fn insert(&mut self, name: String, value: LoxValue) {
+    if !self.values.contains_key(&name) {
+      self.names.push(name.clone());
+    }
+    self.values.insert(name, value);
+  }
+
+  pub fn len(&self) -> usize {
+    self.names.len()
+  }
+
+  pub fn keys(&self) -> impl Iterator<Item = &String> {
+    self.names.iter()
+  }
+
+  pub fn values(&self) -> impl Iterator<Item = &LoxValue> {
+    self.names.iter().map(|name| &self.values[name])
+  }
+
+  pub fn iter(&self) -> impl Iterator<Item = (&String, &LoxValue)> {
+    self.names.iter().map(|name| (name, &self.values[name]))
+  }
+}
+
+impl std::ops::Index<&str> for Fields {
+  type Output = LoxValue;
+
+  fn index(&self, name: &str) -> &LoxValue {
+    &self.values[name]
+  }
+}
+
+impl PartialEq for Fields {
+  fn eq(&self, other: &Self) -> bool {
+    self.values == other.values
+  }
+}
+
+impl IntoIterator for Fields {
+  type Item = (String, LoxValue);
+  type IntoIter = std::vec::IntoIter<(String, LoxValue)>;
+
+  fn into_iter(mut self) -> Self::IntoIter {
+    let names = std::mem::take(&mut self.names);
+    names.into_iter().map(|name| {
+      let value = self.values.remove(&name).unwrap();
+      (name, value)
+    }).collect::<Vec<_>>().into_iter()
+  }
 }
 
 #[derive(Clone, PartialEq)]
 pub struct LoxInstance {
   pub class: LoxClass,
-  pub properties: std::collections::HashMap<String, LoxValue>,
+  pub properties: Fields,
+  // Set by freeze(), after which its fields can't be set
+  pub frozen: bool,
 }
 
 impl fmt::Debug for LoxInstance {
@@ -54,7 +175,8 @@ impl LoxInstance {
   pub fn new(class: LoxClass) -> Self {
     Self {
       class: class.clone(),
-      properties: std::collections::HashMap::new(),
+      properties: Fields::new(),
+      frozen: false,
     }
   }
 
@@ -64,17 +186,15 @@ impl LoxInstance {
       return Ok(value.clone());
     }
 
-    if let Some(method) = this.borrow().class.methods.get(name) {
-      return Ok(LoxValue::Callable(Rc::new(RefCell::new(Box::new(method.clone().bind(this.clone()))))));
+    let method = this.borrow().class.find_method(name);
+    if let Some(method) = method {
+      return Ok(LoxValue::Callable(Rc::new(RefCell::new(Box::new(method.bind(this.clone()))))));
     }
 
-    if let Some(superclass) = &this.borrow().class.superclass {
-      if let Some(method) = superclass.borrow().methods.get(name) {
-        return Ok(LoxValue::Callable(Rc::new(RefCell::new(Box::new(method.clone().bind(this.clone()))))));
-      }
-    }
-
-    Err(format!("Undefined property '{}'.", name))
+    let instance = this.borrow();
+    let mut names: Vec<String> = instance.properties.keys().cloned().collect();
+    names.extend(instance.class.method_names());
+    Err(undefined_property(name, &names))
   }
 
   pub fn set(&mut self, name: String, value: LoxValue) {
@@ -83,22 +203,64 @@ impl LoxInstance {
 }
 
 impl LoxCallable for LoxClass {
-  fn call(&mut self, _interpreter: &mut Interpreter, _arguments: Vec<LoxValue>) -> Box<LoxValue> {
+  fn call(&self, _interpreter: &mut Interpreter, _arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
     let instance = Rc::new(RefCell::new(LoxInstance::new(self.clone())));
-    if let Some(method) = self.methods.get("init") {
-      method.bind(instance.clone()).call(_interpreter, _arguments);
+    if let Some(method) = self.find_method("init") {
+      method.bind(instance.clone()).call(_interpreter, _arguments)?;
     }
-    Box::new(LoxValue::Instance(instance))
+    Ok(Box::new(LoxValue::Instance(instance)))
+  }
+
+  fn call_named(&self, interpreter: &mut Interpreter, arguments: Vec<LoxValue>, named: Vec<(String, LoxValue)>) -> Result<Box<LoxValue>, InterpreterError> {
+    let instance = Rc::new(RefCell::new(LoxInstance::new(self.clone())));
+    match self.find_method("init") {
+      Some(method) => {
+        method.bind(instance.clone()).call_named(interpreter, arguments, named)?;
+      }
+      None => return Err(InterpreterError::call_error(&self.name, format!("{} has no initializer to take named arguments.", self.name))),
+    }
+    Ok(Box::new(LoxValue::Instance(instance)))
   }
 
   fn arity(&self) -> usize {
-    if let Some(method) = self.methods.get("init") {
+    if let Some(method) = self.find_method("init") {
       return method.arity();
     }
     0
   }
 
+  fn min_arity(&self) -> usize {
+    if let Some(method) = self.find_method("init") {
+      return method.min_arity();
+    }
+    0
+  }
+
+  fn is_variadic(&self) -> bool {
+    if let Some(method) = self.find_method("init") {
+      return method.is_variadic();
+    }
+    false
+  }
+
+  fn declaration(&self) -> Option<String> {
+    match self.find_method("init") {
+      Some(method) => {
+        let class = self.declaring_class(&method).unwrap_or_else(|| self.name.clone());
+        method.declaration().map(|init| format!("{}.{}", class, init))
+      }
+      None => Some(format!("{} has no initializer", self.name)),
+    }
+  }
+
   fn box_clone(&self) -> Box<dyn LoxCallable> {
     Box::new(self.clone())
   }
 }
+
+fn undefined_property(name: &str, names: &[String]) -> String {
+  match closest(name, names) {
+    Some(suggestion) => format!("Undefined property '{}'. Did you mean '{}'?", name, suggestion),
+    None => format!("Undefined property '{}'.", name),
+  }
+}
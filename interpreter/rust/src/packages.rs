@@ -0,0 +1,245 @@
+/*
+`lox get`: fetches third-party modules into a project.
+
+A module is a git repository named by its path without the scheme, like
+`github.com/user/loxlib`, and fetched over https. `lox get <module>[@<ref>]`
+clones it, checks out the tag, branch or commit asked for (the default
+branch without one), and copies the checkout without its history into
+lox_modules/<module>. The module and ref go in the manifest's
+`dependencies`, and `lox run` loads the module as a namespace named after
+its last path part before running the project (see project.rs).
+
+What was fetched is pinned in lox.lock next to the manifest:
+
+    {
+      "version": 1,
+      "modules": [
+        {"path": "github.com/user/loxlib", "ref": "v1.0", "commit": "...", "tree": "..."}
+      ]
+    }
+
+`commit` is the commit checked out and `tree` is git's hash of its
+contents. `lox get` with no modules fetches every dependency again: the ones
+in the lockfile at their pinned commit, which has to hash to the same tree,
+so a rewritten tag or history can't change what the project runs without
+anyone noticing. Getting a module by name always fetches its ref afresh and
+re-pins it.
+
+Modules don't have dependencies of their own yet.
+*/
+
+use crate::astjson::{self, Json};
+use crate::project::{self, Manifest};
+use std::fs;
+use std::path::Path;
+use std::process::Command;
+
+pub const LOCKFILE: &str = "lox.lock";
+
+const VERSION: i64 = 1;
+
+// The ref a module is fetched at when none is given
+const DEFAULT_REF: &str = "HEAD";
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Locked {
+  pub path: String,
+  pub reference: String,
+  pub commit: String,
+  pub tree: String,
+}
+
+// Fetches the modules, given as `path[@ref]`, and adds them to the manifest
+// and lockfile, or with none, fetches everything the manifest depends on.
+// Returns a line for each module fetched.
+pub fn get(manifest_path: &Path, modules: &[String]) -> Result<Vec<String>, String> {
+  let manifest = project::load(manifest_path)?;
+  let lockfile = manifest.root.join(LOCKFILE);
+  let mut locked = read_lockfile(&lockfile)?;
+  let mut fetched = Vec::new();
+
+  let mut wanted: Vec<(String, String, bool)> = Vec::new();
+  if modules.is_empty() {
+    for (path, reference) in &manifest.dependencies {
+      wanted.push((path.clone(), reference.clone(), false));
+    }
+  }
+  for module in modules {
+    let (path, reference) = module.split_once('@').unwrap_or((module, DEFAULT_REF));
+    wanted.push((path.to_string(), reference.to_string(), true));
+  }
+
+  for (path, reference, update) in wanted {
+    let pinned = locked.iter().position(|entry| entry.path == path && entry.reference == reference);
+    let entry = match pinned {
+      Some(i) if !update => {
+        let pin = &locked[i];
+        let fetched = fetch(&manifest, &path, &pin.commit)?;
+        if fetched.tree != pin.tree {
+          return Err(format!(
+            "{} at {} has tree {}, but {} pinned {}. Run `lox get {}@{}` to accept the change.",
+            path, pin.commit, fetched.tree, LOCKFILE, pin.tree, path, reference
+          ));
+        }
+        Locked { reference: reference.clone(), ..fetched }
+      }
+      _ => Locked { reference: reference.clone(), ..fetch(&manifest, &path, &reference)? },
+    };
+    locked.retain(|other| other.path != entry.path);
+    locked.push(entry.clone());
+    fetched.push(entry);
+  }
+
+  locked.sort_by(|a, b| a.path.cmp(&b.path));
+  write_lockfile(&lockfile, &locked)?;
+  if !modules.is_empty() {
+    add_dependencies(manifest_path, &fetched)?;
+  }
+  Ok(fetched.iter().map(|entry| format!("{}@{} {}", entry.path, entry.reference, &entry.commit[..entry.commit.len().min(12)])).collect())
+}
+
+// Whether `path[@ref]` names a module at a usable ref. A module path is a host and a
+// repository, and becomes a directory under lox_modules, so it can't climb
+// out of it.
+pub fn check_path(module: &str) -> Result<(), String> {
+  let (path, reference) = module.split_once('@').unwrap_or((module, DEFAULT_REF));
+  check_reference(reference)?;
+  let parts: Vec<&str> = path.split('/').collect();
+  let valid = parts.len() >= 2
+    && !path.contains("://")
+    && parts.iter().all(|part| !part.is_empty() && *part != "." && *part != ".." && !part.starts_with('-'));
+  if valid {
+    Ok(())
+  } else {
+    Err(format!("'{}' isn't a module path. Expected something like github.com/user/loxlib.", path))
+  }
+}
+
+// Whether a ref can go to git as one: a branch, tag or commit name that
+// can't be read as an option
+fn check_reference(reference: &str) -> Result<(), String> {
+  let valid = !reference.is_empty()
+    && !reference.starts_with('-')
+    && reference.chars().all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '_' | '/' | '-'));
+  if valid {
+    Ok(())
+  } else {
+    Err(format!("'{}' isn't a ref. A ref is a branch, tag or commit made of letters, digits, '.', '_', '/' and '-'.", reference))
+  }
+}
+
+// Clones the module at the ref into lox_modules, replacing what was there.
+// The ref comes from the command line, lox.json or the lockfile, and is
+// checked before git sees it.
+fn fetch(manifest: &Manifest, path: &str, reference: &str) -> Result<Locked, String> {
+  check_reference(reference)?;
+  let modules = manifest.root.join(project::MODULES);
+  let target = modules.join(path);
+  let staging = modules.join(".staging");
+  let _ = fs::remove_dir_all(&staging);
+  fs::create_dir_all(&modules).map_err(|err| format!("Error creating {}: {}", modules.display(), err))?;
+
+  let url = format!("https://{}", path);
+  git(&modules, &["clone", "--quiet", &url, ".staging"]).map_err(|message| format!("Couldn't fetch {}: {}", path, message))?;
+  let result = (|| {
+    git(&staging, &["checkout", "--quiet", "--detach", reference, "--"]).map_err(|message| format!("{} has no ref '{}': {}", path, reference, message))?;
+    let commit = git(&staging, &["rev-parse", "HEAD"])?;
+    let tree = git(&staging, &["rev-parse", "HEAD^{tree}"])?;
+    fs::remove_dir_all(staging.join(".git")).map_err(|err| format!("Error removing {}: {}", staging.join(".git").display(), err))?;
+    if target.exists() {
+      fs::remove_dir_all(&target).map_err(|err| format!("Error removing {}: {}", target.display(), err))?;
+    }
+    if let Some(parent) = target.parent() {
+      fs::create_dir_all(parent).map_err(|err| format!("Error creating {}: {}", parent.display(), err))?;
+    }
+    fs::rename(&staging, &target).map_err(|err| format!("Error moving {} into place: {}", path, err))?;
+    Ok(Locked { path: path.to_string(), reference: reference.to_string(), commit, tree })
+  })();
+  let _ = fs::remove_dir_all(&staging);
+  result
+}
+
+// Runs git in the directory and returns what it printed, trimmed
+fn git(dir: &Path, args: &[&str]) -> Result<String, String> {
+  let output = Command::new("git")
+    .args(args)
+    .current_dir(dir)
+    .env("GIT_TERMINAL_PROMPT", "0")
+    .output()
+    .map_err(|err| format!("Could not run git ({}); is `git` on your PATH?", err))?;
+  if !output.status.success() {
+    return Err(String::from_utf8_lossy(&output.stderr).trim().to_string());
+  }
+  Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+///////////// Lockfile ///////////////
+
+pub fn read_lockfile(path: &Path) -> Result<Vec<Locked>, String> {
+  let content = match fs::read_to_string(path) {
+    Ok(content) => content,
+    Err(_) if !path.exists() => return Ok(Vec::new()),
+    Err(err) => return Err(format!("Error reading {}: {}", path.display(), err)),
+  };
+  let invalid = |message: &str| format!("{}: {}", path.display(), message);
+  let document = astjson::parse_json(&content).map_err(|message| invalid(&message))?;
+  match document.get("version") {
+    Some(Json::Number(n)) if n == &VERSION.to_string() => (),
+    Some(Json::Number(n)) => return Err(invalid(&format!("Unsupported lockfile version {}.", n))),
+    _ => return Err(invalid("Expected a 'version' field.")),
+  }
+  let entries = document.array("modules").map_err(|message| invalid(&message))?;
+  entries
+    .iter()
+    .map(|entry| {
+      Ok(Locked {
+        path: entry.string("path")?.to_string(),
+        reference: entry.string("ref")?.to_string(),
+        commit: entry.string("commit")?.to_string(),
+        tree: entry.string("tree")?.to_string(),
+      })
+    })
+    .collect::<Result<_, String>>()
+    .map_err(|message| invalid(&message))
+}
+
+fn write_lockfile(path: &Path, locked: &[Locked]) -> Result<(), String> {
+  let modules = locked
+    .iter()
+    .map(|entry| {
+      Json::Object(vec![
+        ("path".to_string(), Json::String(entry.path.clone())),
+        ("ref".to_string(), Json::String(entry.reference.clone())),
+        ("commit".to_string(), Json::String(entry.commit.clone())),
+        ("tree".to_string(), Json::String(entry.tree.clone())),
+      ])
+    })
+    .collect();
+  let document = Json::Object(vec![
+    ("version".to_string(), Json::Number(VERSION.to_string())),
+    ("modules".to_string(), Json::Array(modules)),
+  ]);
+  fs::write(path, astjson::write_document(&document)).map_err(|err| format!("Error writing {}: {}", path.display(), err))
+}
+
+// Records the modules in the manifest's dependencies, keeping its other fields
+fn add_dependencies(manifest_path: &Path, locked: &[Locked]) -> Result<(), String> {
+  let content = fs::read_to_string(manifest_path).map_err(|err| format!("Error reading {}: {}", manifest_path.display(), err))?;
+  let Json::Object(mut fields) = astjson::parse_json(&content)? else {
+    return Err(format!("{}: Expected an object.", manifest_path.display()));
+  };
+  let mut dependencies = match fields.iter().find(|(key, _)| key == "dependencies") {
+    Some((_, Json::Object(entries))) => entries.clone(),
+    _ => Vec::new(),
+  };
+  for entry in locked {
+    match dependencies.iter_mut().find(|(path, _)| *path == entry.path) {
+      Some((_, version)) => *version = Json::String(entry.reference.clone()),
+      None => dependencies.push((entry.path.clone(), Json::String(entry.reference.clone()))),
+    }
+  }
+  fields.retain(|(key, _)| key != "dependencies");
+  fields.push(("dependencies".to_string(), Json::Object(dependencies)));
+  fs::write(manifest_path, astjson::write_document(&Json::Object(fields)))
+    .map_err(|err| format!("Error writing {}: {}", manifest_path.display(), err))
+}
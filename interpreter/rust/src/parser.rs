@@ -2,40 +2,153 @@
 Overview:
 
 Our parsing / precedence is based on:
-expression     → equality ;
+expression     → pipeline ;
+pipeline       → equality ( "|>" call )* ;
 equality       → comparison ( ( "!=" | "==" ) comparison )* ;
-comparison     → term ( ( ">" | ">=" | "<" | "<=" ) term )* ;
+comparison     → term ( ( ">" | ">=" | "<" | "<=" | "is" ) term )* ;
 term           → factor ( ( "-" | "+" ) factor )* ;
 factor         → unary ( ( "/" | "*" ) unary )* ;
 unary          → ( "!" | "-" ) unary
-               | primary ;
+               | call ;
+call           → primary ( "(" arguments? ")" | ( "." | "?." ) IDENTIFIER | ( "[" | "?[" ) expression "]" )* ;
 primary        → NUMBER | STRING | "true" | "false" | "nil"
-               | "(" expression ")" ;
+               | "(" expression ")" | "[" ( expression ( "," expression )* )? "]"
+               | "match" "(" expression ")" "{" ( arm ( "," arm )* )? "}" ;
+arm            → pattern ( "if" expression )? "=>" expression ;
 
 This grammar allows for a recursive descent parser to be implemented.
 note that left recursion is intentionally avoided in the grammar.
+
+Statements are parsed by recursive descent. Expressions from '??' down are
+parsed Pratt-style instead: the levels above are rows in the precedence table
+(prefix_rule and infix_rule) rather than a function each, so an operator is
+added by giving it a precedence and a parselet.
+
+Where an extension can't be told apart by looking a fixed number of tokens
+ahead (a destructuring target looks like a list until its '='), the parser
+tries the rule speculatively: errors aren't reported, and if the rule fails
+the parser goes back to where it started and tries the next alternative.
+Each speculative rule remembers its outcome at every position it was tried
+(packrat parsing), so no rule is parsed twice at the same token and the
+worst case stays linear.
 */
 
 use crate::lexer::*;
 use crate::ast::*;
 use crate::logging::*;
+use crate::dialect::{self, Feature};
 use std::rc::Rc;
+use std::collections::HashMap;
 
 pub struct Parser {
     tokens: Vec<Token>,
     current: usize,
+    // Doc comments from the lexer, by the offset of the token they precede
+    docs: HashMap<usize, String>,
+    // How many speculative rules are being tried, which keeps errors quiet
+    speculating: usize,
+    // The outcome of each speculative rule by the token it was tried at
+    destructure_targets: Memo<DestructurePattern>,
+    // Set by errors reported without abandoning the statement they're in
+    had_error: bool,
+    // Whether an if's then branch is being parsed outside any block. An else
+    // there is the if's, even right after a loop.
+    in_then_branch: bool,
 }
 
 pub struct ParserError {}
 
+// The most parameters a function can declare and the most arguments a call
+// can pass, as in the book. clox has the same limit, since it keeps the count
+// in a byte; the tree-walker keeps it so a script runs in both.
+const MAX_ARGUMENTS: usize = 255;
+
+// How tightly an operator binds, from loosest to tightest. Assignment is
+// parsed on its own above these, since its left side is a target rather than
+// an operand.
+#[derive(Clone, Copy, PartialEq, PartialOrd)]
+enum Precedence {
+    Pipe,
+    Coalesce,
+    Or,
+    And,
+    Equality,
+    Comparison,
+    Term,
+    Factor,
+    Unary,
+    Call,
+}
+
+impl Precedence {
+    fn next(self) -> Precedence {
+        match self {
+            Precedence::Pipe => Precedence::Coalesce,
+            Precedence::Coalesce => Precedence::Or,
+            Precedence::Or => Precedence::And,
+            Precedence::And => Precedence::Equality,
+            Precedence::Equality => Precedence::Comparison,
+            Precedence::Comparison => Precedence::Term,
+            Precedence::Term => Precedence::Factor,
+            Precedence::Factor => Precedence::Unary,
+            Precedence::Unary | Precedence::Call => Precedence::Call,
+        }
+    }
+}
+
+// Parses the rest of an expression from the operator token that starts it
+type PrefixParselet = fn(&mut Parser, Token) -> Result<Expr, ParserError>;
+// Parses the rest of an expression from its left operand and the operator
+// token after it
+type InfixParselet = fn(&mut Parser, Expr, Token) -> Result<Expr, ParserError>;
+
+// The prefix operators. Tokens without an entry start a primary expression.
+fn prefix_rule(token_type: &TokenType) -> Option<PrefixParselet> {
+    match token_type {
+        TokenType::Bang | TokenType::Minus => Some(Parser::unary),
+        _ => None,
+    }
+}
+
+// The infix and postfix operators, with how tightly each binds. A new
+// operator is an entry here and a parselet that builds its node.
+fn infix_rule(token_type: &TokenType) -> Option<(Precedence, InfixParselet)> {
+    let rule: (Precedence, InfixParselet) = match token_type {
+        TokenType::Pipe => (Precedence::Pipe, Parser::pipe),
+        TokenType::QuestionQuestion => (Precedence::Coalesce, Parser::coalesce),
+        TokenType::Or => (Precedence::Or, Parser::logical),
+        TokenType::And => (Precedence::And, Parser::logical),
+        TokenType::BangEqual | TokenType::EqualEqual => (Precedence::Equality, Parser::binary),
+        TokenType::Greater | TokenType::GreaterEqual | TokenType::Less | TokenType::LessEqual => (Precedence::Comparison, Parser::comparison),
+        TokenType::Is => (Precedence::Comparison, Parser::binary),
+        TokenType::Minus | TokenType::Plus => (Precedence::Term, Parser::binary),
+        TokenType::Slash | TokenType::Star => (Precedence::Factor, Parser::binary),
+        TokenType::LeftParen => (Precedence::Call, Parser::finish_call),
+        TokenType::Dot => (Precedence::Call, Parser::get),
+        TokenType::QuestionDot => (Precedence::Call, Parser::optional_get),
+        TokenType::LeftBracket => (Precedence::Call, Parser::index),
+        TokenType::QuestionBracket => (Precedence::Call, Parser::optional_index),
+        _ => return None,
+    };
+    Some(rule)
+}
+
+// What a speculative rule parsed and the token it stopped before, or None if
+// it didn't parse
+type Memo<T> = HashMap<usize, Option<(T, usize)>>;
+
 impl Parser {
     pub fn new(tokens: Vec<Token>) -> Self {
-        Self { tokens, current: 0 }
+        Self::with_docs(tokens, HashMap::new())
+    }
+
+    // Attaches doc comments to the functions, classes and traits they precede
+    pub fn with_docs(tokens: Vec<Token>, docs: HashMap<usize, String>) -> Self {
+        Self { tokens, current: 0, docs, speculating: 0, destructure_targets: HashMap::new(), had_error: false, in_then_branch: false }
     }
 
     pub fn parse(&mut self) -> Result<Vec<Stmt>, ParserError> {
         let mut statements = Vec::new();
-        let mut had_error = false;
         while !self.is_at_end() {
             match self.declaration() {
                 Ok(stmt) => {
@@ -43,23 +156,54 @@ impl Parser {
                 }
                 Err(_) => {
                   self.synchronize();
-                  had_error = true;
+                  self.had_error = true;
                 }
             }
         }
-        if had_error {
+        if self.had_error {
             return Err(ParserError {});
         }
         return Ok(statements);
     }
 
+    // Parses the whole input as a single expression, for the REPL's
+    // meta-commands
+    pub fn parse_expression(&mut self) -> Result<Expr, ParserError> {
+        let expr = self.expression()?;
+        if !self.is_at_end() {
+            let token = self.peek();
+            return Err(self.error(token, "Expect end of expression."));
+        }
+        if self.had_error {
+            return Err(ParserError {});
+        }
+        Ok(expr)
+    }
+
     fn declaration(&mut self) -> Result<Stmt, ParserError> {
+        let doc = self.doc();
         if self.match_tokens(vec![TokenType::Class]) {
-            return self.class_declaration();
+            let mut stmt = self.class_declaration()?;
+            if let Stmt::Class(class) = &mut stmt {
+                class.doc = doc;
+            }
+            return Ok(stmt);
+        } else if self.match_tokens(vec![TokenType::Trait]) {
+            let mut stmt = self.trait_declaration()?;
+            if let Stmt::Trait(trait_stmt) = &mut stmt {
+                trait_stmt.doc = doc;
+            }
+            return Ok(stmt);
         } else if self.match_tokens(vec![TokenType::Fun]) {
-            return self.function("function");
+            let mut stmt = self.function("function")?;
+            if let Stmt::Fun(function) = &mut stmt {
+                function.doc = doc;
+            }
+            return Ok(stmt);
         } else if self.match_tokens(vec![TokenType::Var]) {
-            return self.var_declaration();
+            return self.var_declaration(false);
+        } else if self.match_tokens(vec![TokenType::Const]) {
+            return self.var_declaration(true);
         }
         self.statement()
     }
@@ -72,10 +216,22 @@ impl Parser {
         } else {
             None
         };
+        let mut traits = Vec::new();
+        if self.match_tokens(vec![TokenType::Implements]) {
+            self.require(Feature::Traits)?;
+            loop {
+                traits.push(self.consume(TokenType::Identifier, "Expect trait name.")?);
+                if !self.match_tokens(vec![TokenType::Comma]) {
+                    break;
+                }
+            }
+        }
         self.consume(TokenType::LeftBrace, "Expect '{' before class body.")?;
         let mut methods = Vec::new();
         while !self.check(TokenType::RightBrace) && !self.is_at_end() {
-            if let Stmt::Fun(fun_stmt) = self.function("method")? {
+            let doc = self.doc();
+            if let Stmt::Fun(mut fun_stmt) = self.function("method")? {
+                fun_stmt.doc = doc;
                 methods.push(fun_stmt);
             } else {
                 self.synchronize();
@@ -83,40 +239,114 @@ impl Parser {
             }
         }
         self.consume(TokenType::RightBrace, "Expect '}' after class body.")?;
-        Ok(Stmt::Class(ClassStmt::new(name, superclass, methods)))
+        Ok(Stmt::Class(ClassStmt::new(name, superclass, traits, methods)))
     }
 
-    fn function(&mut self, kind: &str) -> Result<Stmt, ParserError> {
-        let name = self.consume(TokenType::Identifier, &format!("Expect {} name.", kind))?;
-        self.consume(TokenType::LeftParen, &format!("Expect '(' after {} name.", kind))?;
-        let mut parameters = Vec::new();
+    fn trait_declaration(&mut self) -> Result<Stmt, ParserError> {
+        let name = self.consume(TokenType::Identifier, "Expect trait name.")?;
+        self.consume(TokenType::LeftBrace, "Expect '{' before trait body.")?;
+        let mut methods = Vec::new();
+        while !self.check(TokenType::RightBrace) && !self.is_at_end() {
+            let doc = self.doc();
+            let method = self.consume(TokenType::Identifier, "Expect method name.")?;
+            self.consume(TokenType::LeftParen, "Expect '(' after method name.")?;
+            let parameters = self.parameters()?;
+            self.type_annotation()?;
+            self.terminate("Expect ';' after method signature.")?;
+            let mut signature = MethodSignature::new(method, parameters.names);
+            signature.doc = doc;
+            methods.push(signature);
+        }
+        self.consume(TokenType::RightBrace, "Expect '}' after trait body.")?;
+        Ok(Stmt::Trait(TraitStmt::new(name, methods)))
+    }
+
+    // Parses a parameter list up to and including the closing ')'
+    fn parameters(&mut self) -> Result<ParameterList, ParserError> {
+        let mut parameters = ParameterList::default();
         if !self.check(TokenType::RightParen) {
             loop {
-                if parameters.len() >= 255 {
+                if parameters.names.len() == MAX_ARGUMENTS {
                     let token = self.peek();
-                    return Err(self.error(token, "Cannot have more than 255 parameters."));
+                    self.report(token, &format!("Can't have more than {} parameters.", MAX_ARGUMENTS));
                 }
-                parameters.push(self.consume(TokenType::Identifier, "Expect parameter name.")?);
-                if !self.match_tokens(vec![TokenType::Comma]) {
+                if self.match_tokens(vec![TokenType::Ellipsis]) {
+                    self.require(Feature::Spread)?;
+                    parameters.rest = Some(self.consume(TokenType::Identifier, "Expect rest parameter name after '...'.")?);
+                    if !self.check(TokenType::RightParen) {
+                        let token = self.peek();
+                        return Err(self.error(token, "Rest parameter must be last."));
+                    }
+                    break;
+                }
+                let name = self.consume(TokenType::Identifier, "Expect parameter name.")?;
+                parameters.types.push(self.type_annotation()?);
+                if self.match_tokens(vec![TokenType::Equal]) {
+                    self.require(Feature::Defaults)?;
+                    parameters.defaults.push(Some(self.expression()?));
+                } else if parameters.defaults.iter().any(|d| d.is_some()) {
+                    return Err(self.error(name, "Parameter without a default cannot follow one with a default."));
+                } else {
+                    parameters.defaults.push(None);
+                }
+                parameters.names.push(name);
+                if !self.match_tokens(vec![TokenType::Comma]) || self.trailing_comma(TokenType::RightParen)? {
                     break;
                 }
             }
         }
         self.consume(TokenType::RightParen, "Expect ')' after parameters.")?;
+        Ok(parameters)
+    }
+
+    // An optional ": Type" suffix
+    fn type_annotation(&mut self) -> Result<Option<Token>, ParserError> {
+        if self.match_tokens(vec![TokenType::Colon]) {
+            self.require(Feature::Types)?;
+            return Ok(Some(self.consume(TokenType::Identifier, "Expect type name after ':'.")?));
+        }
+        Ok(None)
+    }
+
+    fn function(&mut self, kind: &str) -> Result<Stmt, ParserError> {
+        let name = self.consume(TokenType::Identifier, &format!("Expect {} name.", kind))?;
+        self.consume(TokenType::LeftParen, &format!("Expect '(' after {} name.", kind))?;
+        let parameters = self.parameters()?;
+        let return_type = self.type_annotation()?;
         self.consume(TokenType::LeftBrace, &format!("Expect '{{' before {} body.", kind))?;
         let body = self.block()?;
-        Ok(Stmt::Fun(FunStmt::new(name, parameters, Rc::new(BlockStmt::new(body)))))
+        Ok(Stmt::Fun(FunStmt::new(name, parameters, return_type, Rc::new(BlockStmt::new(body)))))
     }
 
-    fn var_declaration(&mut self) -> Result<Stmt, ParserError> {
+    fn var_declaration(&mut self, constant: bool) -> Result<Stmt, ParserError> {
+        if self.check(TokenType::LeftBracket) || self.check(TokenType::LeftParen) || self.check(TokenType::LeftBrace) {
+            let open = self.advance();
+            self.require(Feature::Destructuring)?;
+            let pattern = match open.token_type {
+                TokenType::LeftBracket => {
+                    let elements = self.list_elements()?;
+                    let bracket = self.previous();
+                    self.destructure_pattern(bracket, elements)?
+                }
+                _ => self.destructure_names(open.token_type)?,
+            };
+            self.consume(TokenType::Equal, "Expect '=' after destructuring pattern.")?;
+            let initializer = self.expression()?;
+            self.terminate("Expect ';' after variable declaration.")?;
+            return Ok(Stmt::Destructure(DestructureStmt::new(pattern, initializer, constant)));
+        }
         let name = self.consume(TokenType::Identifier, "Expect variable name.")?;
+        let type_annotation = self.type_annotation()?;
         let initializer = if self.match_tokens(vec![TokenType::Equal]) {
             Some(self.expression()?)
+        } else if constant {
+            let token = self.peek();
+            return Err(self.error(token, "Expect '=' after constant name."));
         } else {
             None
         };
-        self.consume(TokenType::Semicolon, "Expect ';' after variable declaration.")?;
-        Ok(Stmt::Var(VarStmt::new(name, initializer)))
+        self.terminate("Expect ';' after variable declaration.")?;
+        Ok(Stmt::Var(VarStmt::new(name, type_annotation, initializer, constant)))
     }
 
     fn statement(&mut self) -> Result<Stmt, ParserError> {
@@ -132,21 +362,95 @@ impl Parser {
         if self.match_tokens(vec![TokenType::Return]) {
             return self.return_statement();
         }
+        if self.match_tokens(vec![TokenType::Yield]) {
+            return self.yield_statement();
+        }
         if self.match_tokens(vec![TokenType::While]) {
             return self.while_statement();
         }
+        if self.match_tokens(vec![TokenType::Do]) {
+            return self.do_while_statement();
+        }
+        if self.match_tokens(vec![TokenType::Break]) {
+            let keyword = self.previous();
+            self.terminate("Expect ';' after 'break'.")?;
+            return Ok(Stmt::Break(BreakStmt::new(keyword)));
+        }
+        if self.match_tokens(vec![TokenType::Try]) {
+            return self.try_statement();
+        }
+        if self.match_tokens(vec![TokenType::Throw]) {
+            let keyword = self.previous();
+            let value = self.expression()?;
+            self.terminate("Expect ';' after thrown value.")?;
+            return Ok(Stmt::Throw(ThrowStmt::new(keyword, value)));
+        }
+        if self.match_tokens(vec![TokenType::Using]) {
+            return self.using_statement();
+        }
         if self.match_tokens(vec![TokenType::LeftBrace]) {
             return Ok(Stmt::Block(BlockStmt::new(self.block()?)));
         }
         self.expression_statement()
     }
 
+    fn using_statement(&mut self) -> Result<Stmt, ParserError> {
+        let keyword = self.previous();
+        self.consume(TokenType::LeftParen, "Expect '(' after 'using'.")?;
+        self.consume(TokenType::Var, "Expect 'var' after '('.")?;
+        let name = self.consume(TokenType::Identifier, "Expect variable name.")?;
+        self.consume(TokenType::Equal, "Expect '=' after variable name.")?;
+        let initializer = self.expression()?;
+        self.consume(TokenType::RightParen, "Expect ')' after using clause.")?;
+        self.consume(TokenType::LeftBrace, "Expect '{' before using body.")?;
+        Ok(Stmt::Using(UsingStmt::new(keyword, name, initializer, BlockStmt::new(self.block()?))))
+    }
+
+    fn try_statement(&mut self) -> Result<Stmt, ParserError> {
+        let keyword = self.previous();
+        self.consume(TokenType::LeftBrace, "Expect '{' after 'try'.")?;
+        let body = BlockStmt::new(self.block()?);
+        let mut catches = Vec::new();
+        while self.match_tokens(vec![TokenType::Catch]) {
+            self.consume(TokenType::LeftParen, "Expect '(' after 'catch'.")?;
+            let name = self.consume(TokenType::Identifier, "Expect error name.")?;
+            let class = if self.match_tokens(vec![TokenType::Colon]) {
+                let class = self.consume(TokenType::Identifier, "Expect class name after ':'.")?;
+                Some(Expr::Variable(VariableExpr{name: class}))
+            } else {
+                None
+            };
+            self.consume(TokenType::RightParen, "Expect ')' after catch clause.")?;
+            self.consume(TokenType::LeftBrace, "Expect '{' before catch body.")?;
+            catches.push(CatchClause::new(name, class, BlockStmt::new(self.block()?)));
+        }
+        let finally = if self.match_tokens(vec![TokenType::Finally]) {
+            self.consume(TokenType::LeftBrace, "Expect '{' after 'finally'.")?;
+            Some(BlockStmt::new(self.block()?))
+        } else {
+            None
+        };
+        if catches.is_empty() && finally.is_none() {
+            let token = self.peek();
+            return Err(self.error(token, "Expect 'catch' or 'finally' after try block."));
+        }
+        Ok(Stmt::Try(TryStmt::new(keyword, body, catches, finally)))
+    }
+
     fn for_statement(&mut self) -> Result<Stmt, ParserError> {
         self.consume(TokenType::LeftParen, "Expect '(' after 'for'.")?;
+        // `for (x in ...)` and `for (var x in ...)` both declare x for the body
+        let declares_loop_var = self.check(TokenType::Var);
+        if declares_loop_var {
+            self.advance();
+        }
+        if self.check_sequence(&[TokenType::Identifier, TokenType::In]) {
+            return self.for_in_statement();
+        }
         let initializer: Option<Box<Stmt>> = if self.match_tokens(vec![TokenType::Semicolon]) {
             None
-        } else if self.match_tokens(vec![TokenType::Var]) {
-            Some(Box::new(self.var_declaration()?))
+        } else if declares_loop_var {
+            Some(Box::new(self.var_declaration(false)?))
         } else {
             Some(Box::new(self.expression_statement()?))
         };
@@ -163,11 +467,12 @@ impl Parser {
         };
         self.consume(TokenType::RightParen, "Expect ')' after for clauses.")?;
         let mut body = Box::new(self.statement()?);
+        let else_branch = self.loop_else()?;
         if let Some(increment) = increment {
             body = Box::new(Stmt::Block(BlockStmt::new(vec![*body, Stmt::Expression(ExprStmt { expression: Box::new(increment) })])));
         }
-        let condition = condition.unwrap_or_else(|| Expr::Literal(LiteralExpr::new(TokenType::Nil, LoxValue::Nil)));
-        body = Box::new(Stmt::While(WhileStmt::new(Box::new(condition), body)));
+        let condition = condition.unwrap_or_else(|| Expr::Literal(LiteralExpr::new(TokenType::True, LoxValue::Boolean(true))));
+        body = Box::new(Stmt::While(WhileStmt::new(Box::new(condition), body, else_branch)));
         if initializer.is_none() {
             return Ok(*body);
         }
@@ -180,19 +485,65 @@ impl Parser {
         }
     }
 
+    fn for_in_statement(&mut self) -> Result<Stmt, ParserError> {
+        let name = self.advance();
+        self.advance();
+        let iterable = self.expression()?;
+        self.consume(TokenType::RightParen, "Expect ')' after for-in clause.")?;
+        let body = Box::new(self.statement()?);
+        let else_branch = self.loop_else()?;
+        Ok(Stmt::ForIn(ForInStmt::new(name, iterable, body, else_branch)))
+    }
+
+    fn yield_statement(&mut self) -> Result<Stmt, ParserError> {
+        let keyword = self.previous();
+        let value = if !self.at_statement_end() {
+            Some(self.expression()?)
+        } else {
+            None
+        };
+        self.terminate("Expect ';' after yield value.")?;
+        Ok(Stmt::Yield(YieldStmt::new(keyword, value)))
+    }
+
     fn while_statement(&mut self) -> Result<Stmt, ParserError> {
         self.consume(TokenType::LeftParen, "Expect '(' after 'while'.")?;
         let condition = self.expression()?;
         self.consume(TokenType::RightParen, "Expect ')' after condition.")?;
         let body = Box::new(self.statement()?);
-        Ok(Stmt::While(WhileStmt::new(Box::new(condition), body)))
+        let else_branch = self.loop_else()?;
+        Ok(Stmt::While(WhileStmt::new(Box::new(condition), body, else_branch)))
+    }
+
+    fn do_while_statement(&mut self) -> Result<Stmt, ParserError> {
+        let body = Box::new(self.statement()?);
+        self.consume(TokenType::While, "Expect 'while' after do body.")?;
+        self.consume(TokenType::LeftParen, "Expect '(' after 'while'.")?;
+        let condition = self.expression()?;
+        self.consume(TokenType::RightParen, "Expect ')' after condition.")?;
+        self.terminate("Expect ';' after do-while condition.")?;
+        Ok(Stmt::DoWhile(WhileStmt::new(Box::new(condition), body, None)))
+    }
+
+    // An `else` right after a loop body belongs to the loop, the same way a
+    // dangling else belongs to the nearest if. In `if (a) while (b) x; else y;`
+    // it's still the if's, as in the book, so the loop isn't braced to have one.
+    fn loop_else(&mut self) -> Result<Option<Box<Stmt>>, ParserError> {
+        // Without loop-else, the else is left for an enclosing if as in the book
+        if dialect::enabled(Feature::LoopElse) && !self.in_then_branch && self.match_tokens(vec![TokenType::Else]) {
+            return Ok(Some(Box::new(self.statement()?)));
+        }
+        Ok(None)
     }
 
     fn if_statement(&mut self) -> Result<Stmt, ParserError> {
         self.consume(TokenType::LeftParen, "Expect '(' after 'if'.")?;
         let condition = self.expression()?;
         self.consume(TokenType::RightParen, "Expect ')' after condition.")?;
-        let then_branch = Box::new(self.statement()?);
+        let enclosing = std::mem::replace(&mut self.in_then_branch, true);
+        let then_branch = self.statement();
+        self.in_then_branch = enclosing;
+        let then_branch = Box::new(then_branch?);
         let else_branch = if self.match_tokens(vec![TokenType::Else]) {
             Some(Box::new(self.statement()?))
         } else {
@@ -203,38 +554,57 @@ impl Parser {
 
     fn block(&mut self) -> Result<Vec<Stmt>, ParserError> {
         let mut statements = Vec::new();
+        let enclosing = std::mem::replace(&mut self.in_then_branch, false);
         while !self.is_at_end() && !self.check(TokenType::RightBrace) {
             match self.declaration() {
                 Ok(stmt) => statements.push(stmt),
                 Err(_) => {
+                  self.in_then_branch = enclosing;
                   return Err(ParserError{});
                 }
             }
         }
+        self.in_then_branch = enclosing;
         self.consume(TokenType::RightBrace, "Expect '}' after block.")?;
         Ok(statements)
     }
 
     fn print_statement(&mut self) -> Result<Stmt, ParserError> {
-        let value = self.expression()?;
-        self.consume(TokenType::Semicolon, "Expect ';' after value.")?;
-        Ok(Stmt::Print(PrintStmt{expression : Box::new(value)}))
+        let mut expressions = vec![self.expression()?];
+        while self.match_tokens(vec![TokenType::Comma]) {
+            self.require(Feature::PrintList)?;
+            expressions.push(self.expression()?);
+        }
+        self.terminate("Expect ';' after value.")?;
+        Ok(Stmt::Print(PrintStmt{expressions}))
     }
 
     fn return_statement(&mut self) -> Result<Stmt, ParserError> {
         let keyword = self.previous();
-        let value = if !self.check(TokenType::Semicolon) {
-            Some(Box::new(self.expression()?))
+        let value = if !self.at_statement_end() {
+            let first = self.expression()?;
+            if self.check(TokenType::Comma) {
+                self.advance();
+                self.require(Feature::MultipleReturns)?;
+                // `return a, b;` returns the values as a list
+                let mut values = vec![first, self.expression()?];
+                while self.match_tokens(vec![TokenType::Comma]) {
+                    values.push(self.expression()?);
+                }
+                Some(Box::new(Expr::List(ListExpr::new(keyword.clone(), values))))
+            } else {
+                Some(Box::new(first))
+            }
         } else {
             None
         };
-        self.consume(TokenType::Semicolon, "Expect ';' after return value.")?;
+        self.terminate("Expect ';' after return value.")?;
         Ok(Stmt::Return(RetStmt::new(keyword, value)))
     }
 
     fn expression_statement(&mut self) -> Result<Stmt, ParserError> {
         let expr = self.expression()?;
-        self.consume(TokenType::Semicolon, "Expect ';' after expression.")?;
+        self.terminate("Expect ';' after expression.")?;
         Ok(Stmt::Expression(ExprStmt{ expression : Box::new(expr)}))
     }
 
@@ -243,7 +613,15 @@ impl Parser {
     }
 
     fn assignment(&mut self) -> Result<Expr, ParserError> {
-        let expr = self.or()?;
+        if self.check(TokenType::LeftBracket) || self.check(TokenType::LeftParen) || self.check(TokenType::LeftBrace) {
+            if let Some(pattern) = self.speculate(Self::destructure_target, |parser| &mut parser.destructure_targets) {
+                let equals = self.previous();
+                self.require_at(Feature::Destructuring, equals)?;
+                let value = self.assignment()?;
+                return Ok(Expr::DestructureAssign(DestructureAssignExpr::new(pattern, Box::new(value))));
+            }
+        }
+        let expr = self.parse_precedence(Precedence::Pipe)?;
         if self.match_tokens(vec![TokenType::Equal]) {
             let equals = self.previous();
             let value = self.assignment()?;
@@ -251,112 +629,462 @@ impl Parser {
                 return Ok(Expr::Assign(AssignExpr::new(var.name, Box::new(value))));
             } else if let Expr::Get(get) = expr {
                 return Ok(Expr::Set(SetExpr::new(get.object, get.name, Box::new(value))));
+            } else if let Expr::Index(index) = expr {
+                return Ok(Expr::IndexSet(IndexSetExpr::new(index.object, index.bracket, index.index, Box::new(value))));
+            } else if let Expr::List(list) = expr {
+                self.require_at(Feature::Destructuring, equals)?;
+                let pattern = self.destructure_pattern(list.bracket, list.elements)?;
+                return Ok(Expr::DestructureAssign(DestructureAssignExpr::new(pattern, Box::new(value))));
             }
             self.error(equals, "Invalid assignment target.");
         }
         Ok(expr)
     }
 
-    fn or(&mut self) -> Result<Expr, ParserError> {
-        let mut expr = self.and()?;
-        while self.match_tokens(vec![TokenType::Or]) {
-            let operator = self.previous();
-            let right = self.and()?;
-            expr = Expr::Logical(LogicalExpr::new(Box::new(expr), operator, Box::new(right)));
+    // Parses operators that bind at least as tightly as `precedence`: a
+    // prefix operator or primary, then whatever infix and postfix operators
+    // follow it in the table. Each of those parses its own right operand,
+    // one level tighter for left-associative ones.
+    fn parse_precedence(&mut self, precedence: Precedence) -> Result<Expr, ParserError> {
+        let mut expr = match prefix_rule(&self.peek_at(0).token_type) {
+            Some(prefix) => {
+                let operator = self.advance();
+                prefix(self, operator)?
+            }
+            None => self.primary()?,
+        };
+        // Set once a '?.' or '?[' is in the chain of calls, properties and indexes
+        // after the operand, which is wrapped up when the chain ends so a
+        // nil anywhere in it short-circuits the rest
+        let mut optional = false;
+        while let Some((rule, infix)) = infix_rule(&self.peek_at(0).token_type) {
+            if rule < precedence {
+                break;
+            }
+            if optional && rule < Precedence::Call {
+                expr = Expr::OptionalChain(OptionalChainExpr::new(Box::new(expr)));
+                optional = false;
+            }
+            let operator = self.advance();
+            optional |= matches!(operator.token_type, TokenType::QuestionDot | TokenType::QuestionBracket);
+            expr = infix(self, expr, operator)?;
+        }
+        if optional {
+            expr = Expr::OptionalChain(OptionalChainExpr::new(Box::new(expr)));
         }
         Ok(expr)
     }
 
-    fn and(&mut self) -> Result<Expr, ParserError> {
-        let mut expr = self.equality()?;
-        while self.match_tokens(vec![TokenType::And]) {
-            let operator = self.previous();
-            let right = self.equality()?;
-            expr = Expr::Logical(LogicalExpr::new(Box::new(expr), operator, Box::new(right)));
+    // The right operand of a left-associative operator, which binds one level
+    // tighter than the operator so `a - b - c` groups as `(a - b) - c`
+    fn right_operand(&mut self, operator: &Token) -> Result<Expr, ParserError> {
+        let (precedence, _) = infix_rule(&operator.token_type).unwrap();
+        self.parse_precedence(precedence.next())
+    }
+
+    fn unary(&mut self, operator: Token) -> Result<Expr, ParserError> {
+        let right = self.parse_precedence(Precedence::Unary)?;
+        Ok(Expr::Unary(UnaryExpr::new(operator, Box::new(right))))
+    }
+
+    fn binary(&mut self, left: Expr, operator: Token) -> Result<Expr, ParserError> {
+        let right = self.right_operand(&operator)?;
+        Ok(Expr::Binary(BinaryExpr::new(Box::new(left), operator, Box::new(right))))
+    }
+
+    // With chained comparisons on, `a < b < c` is one ComparisonExpr rather
+    // than (a < b) < c, which could only fail: booleans aren't ordered
+    fn comparison(&mut self, left: Expr, operator: Token) -> Result<Expr, ParserError> {
+        let right = self.right_operand(&operator)?;
+        if !dialect::enabled(Feature::ChainedComparisons) || !self.check_comparison() {
+            return Ok(Expr::Binary(BinaryExpr::new(Box::new(left), operator, Box::new(right))));
         }
-        Ok(expr)
+        let mut comparisons = vec![(operator, right)];
+        while self.check_comparison() {
+            let operator = self.advance();
+            let right = self.right_operand(&operator)?;
+            comparisons.push((operator, right));
+        }
+        Ok(Expr::Comparison(ComparisonExpr::new(Box::new(left), comparisons)))
     }
 
-    fn equality(&mut self) -> Result<Expr, ParserError> {
-        let mut expr = self.comparison()?;
-        while self.match_tokens(vec![TokenType::BangEqual, TokenType::EqualEqual]) {
-            let operator = self.previous();
-            let right = self.comparison()?;
-            expr = Expr::Binary(BinaryExpr::new(Box::new(expr), operator, Box::new(right)));
+    fn check_comparison(&self) -> bool {
+        matches!(self.peek_at(0).token_type, TokenType::Greater | TokenType::GreaterEqual | TokenType::Less | TokenType::LessEqual)
+    }
+
+    fn logical(&mut self, left: Expr, operator: Token) -> Result<Expr, ParserError> {
+        let right = self.right_operand(&operator)?;
+        Ok(Expr::Logical(LogicalExpr::new(Box::new(left), operator, Box::new(right))))
+    }
+
+    fn coalesce(&mut self, left: Expr, operator: Token) -> Result<Expr, ParserError> {
+        self.require(Feature::Coalesce)?;
+        self.logical(left, operator)
+    }
+
+    // `value |> f` is f(value), and `value |> f(a, b)` is f(value, a, b). The
+    // right side is a function or a call, so the rest of a longer expression
+    // after it applies to the call's result.
+    fn pipe(&mut self, value: Expr, operator: Token) -> Result<Expr, ParserError> {
+        self.require(Feature::Pipeline)?;
+        let function = self.parse_precedence(Precedence::Call)?;
+        match function {
+            Expr::Call(mut call) => {
+                call.arguments.insert(0, value);
+                Ok(Expr::Call(call))
+            }
+            function => Ok(Expr::Call(CallExpr::new(Box::new(function), operator, vec![value], Vec::new()))),
         }
-        Ok(expr)
     }
 
-    fn comparison(&mut self) -> Result<Expr, ParserError> {
-        let mut expr = self.term()?;
-        while self.match_tokens(vec![TokenType::Greater, TokenType::GreaterEqual, TokenType::Less, TokenType::LessEqual]) {
-            let operator = self.previous();
-            let right = self.term()?;
-            expr = Expr::Binary(BinaryExpr::new(Box::new(expr), operator, Box::new(right)));
+    fn get(&mut self, object: Expr, _dot: Token) -> Result<Expr, ParserError> {
+        let name = self.property_name("Expect property name after '.'")?;
+        Ok(Expr::Get(GetExpr::new(Box::new(object), name)))
+    }
+
+    fn optional_get(&mut self, object: Expr, _dot: Token) -> Result<Expr, ParserError> {
+        self.require(Feature::OptionalChaining)?;
+        let name = self.property_name("Expect property name after '?.'")?;
+        Ok(Expr::OptionalGet(OptionalGetExpr::new(Box::new(object), name)))
+    }
+
+    fn index(&mut self, object: Expr, _bracket: Token) -> Result<Expr, ParserError> {
+        self.require(Feature::Lists)?;
+        let index = self.expression()?;
+        let bracket = self.consume(TokenType::RightBracket, "Expect ']' after index.")?;
+        Ok(Expr::Index(IndexExpr::new(Box::new(object), bracket, Box::new(index))))
+    }
+
+    fn optional_index(&mut self, object: Expr, _bracket: Token) -> Result<Expr, ParserError> {
+        self.require(Feature::OptionalChaining)?;
+        let index = self.expression()?;
+        let bracket = self.consume(TokenType::RightBracket, "Expect ']' after index.")?;
+        Ok(Expr::OptionalIndex(OptionalIndexExpr::new(Box::new(object), bracket, Box::new(index))))
+    }
+
+    fn finish_call(&mut self, callee: Expr, _paren: Token) -> Result<Expr, ParserError> {
+        let mut arguments = Vec::new();
+        let mut named_arguments: Vec<(Token, Expr)> = Vec::new();
+        if !self.check(TokenType::RightParen) {
+            loop {
+                if arguments.len() + named_arguments.len() == MAX_ARGUMENTS {
+                    let token = self.peek();
+                    self.report(token, &format!("Can't have more than {} arguments.", MAX_ARGUMENTS));
+                }
+                if self.check_sequence(&[TokenType::Identifier, TokenType::Colon]) {
+                    let name = self.advance();
+                    self.advance();
+                    self.require(Feature::NamedArguments)?;
+                    if named_arguments.iter().any(|(n, _)| n.token == name.token) {
+                        return Err(self.error(name, "Duplicate named argument."));
+                    }
+                    named_arguments.push((name, self.expression()?));
+                } else if !named_arguments.is_empty() {
+                    let token = self.peek();
+                    return Err(self.error(token, "Positional argument cannot follow named arguments."));
+                } else {
+                    arguments.push(self.spreadable()?);
+                }
+                if !self.match_tokens(vec![TokenType::Comma]) || self.trailing_comma(TokenType::RightParen)? {
+                    break;
+                }
+            }
         }
-        Ok(expr)
+        let paren = self.consume(TokenType::RightParen, "Expect ')' after arguments.")?;
+        Ok(Expr::Call(CallExpr::new(Box::new(callee), paren, arguments, named_arguments)))
     }
 
-    fn term(&mut self) -> Result<Expr, ParserError> {
-        let mut expr = self.factor()?;
-        while self.match_tokens(vec![TokenType::Minus, TokenType::Plus]) {
-            let operator = self.previous();
-            let right = self.factor()?;
-            expr = Expr::Binary(BinaryExpr::new(Box::new(expr), operator, Box::new(right)));
+    // After a ',' in a list of parameters, arguments or elements: whether the
+    // list ends there, which it can with trailing commas on so that each line
+    // of one written out a line per item looks the same
+    fn trailing_comma(&mut self, close: TokenType) -> Result<bool, ParserError> {
+        if !self.check(close) {
+            return Ok(false);
         }
-        Ok(expr)
+        self.require(Feature::TrailingCommas)?;
+        Ok(true)
     }
 
-    fn factor(&mut self) -> Result<Expr, ParserError> {
-        let mut expr = self.unary()?;
-        while self.match_tokens(vec![TokenType::Slash, TokenType::Star]) {
-            let operator = self.previous();
-            let right = self.unary()?;
-            expr = Expr::Binary(BinaryExpr::new(Box::new(expr), operator, Box::new(right)));
+    // Elements after a '[' up to and including the closing ']'
+    fn list_elements(&mut self) -> Result<Vec<Expr>, ParserError> {
+        let mut elements = Vec::new();
+        if !self.check(TokenType::RightBracket) {
+            loop {
+                elements.push(self.spreadable()?);
+                if !self.match_tokens(vec![TokenType::Comma]) || self.trailing_comma(TokenType::RightBracket)? {
+                    break;
+                }
+            }
         }
-        Ok(expr)
+        self.consume(TokenType::RightBracket, "Expect ']' after list elements.")?;
+        Ok(elements)
+    }
+
+    // `[a, b, ...rest] =`, `(a, b) =` or `{a, b: c} =`, tried speculatively
+    // since up to the '=' it could be a list, a grouping or a map. Anything
+    // that isn't a plain name is left to parse as one of those, which reports
+    // what's wrong with it if an '=' does follow.
+    fn destructure_target(&mut self) -> Result<DestructurePattern, ParserError> {
+        let open = self.advance();
+        let pattern = match open.token_type {
+            TokenType::LeftBracket => {
+                let mut targets = Vec::new();
+                let mut rest = None;
+                if !self.check(TokenType::RightBracket) {
+                    loop {
+                        if self.match_tokens(vec![TokenType::Ellipsis]) {
+                            let name = self.consume(TokenType::Identifier, "Expect rest name.")?;
+                            rest = Some(VariableExpr{name});
+                            break;
+                        }
+                        let name = self.consume(TokenType::Identifier, "Expect name.")?;
+                        targets.push(VariableExpr{name});
+                        if !self.match_tokens(vec![TokenType::Comma]) || self.trailing_comma(TokenType::RightBracket)? {
+                            break;
+                        }
+                    }
+                }
+                let bracket = self.consume(TokenType::RightBracket, "Expect ']'.")?;
+                DestructurePattern::new(bracket, targets, rest)
+            }
+            open => self.destructure_names(open)?,
+        };
+        self.consume(TokenType::Equal, "Expect '='.")?;
+        Ok(pattern)
+    }
+
+    // The names of a `(a, b, ...rest)` or `{a, b: c, ...rest}` pattern after
+    // its opening token, up to and including the closing one. In braces a
+    // name is a key and the variable it goes into, unless `key: name` gives
+    // the variable a different name.
+    fn destructure_names(&mut self, open: TokenType) -> Result<DestructurePattern, ParserError> {
+        let keyed = open == TokenType::LeftBrace;
+        let close = if keyed { TokenType::RightBrace } else { TokenType::RightParen };
+        let mut keys = Vec::new();
+        let mut targets = Vec::new();
+        let mut rest = None;
+        if !self.check(close.clone()) {
+            loop {
+                if self.match_tokens(vec![TokenType::Ellipsis]) {
+                    let name = self.consume(TokenType::Identifier, "Expect rest name.")?;
+                    rest = Some(VariableExpr{name});
+                    break;
+                }
+                let name = self.consume(TokenType::Identifier, "Expect name in destructuring pattern.")?;
+                if keyed {
+                    keys.push(name.clone());
+                    if self.match_tokens(vec![TokenType::Colon]) {
+                        let name = self.consume(TokenType::Identifier, "Expect name after ':' in destructuring pattern.")?;
+                        targets.push(VariableExpr{name});
+                    } else {
+                        targets.push(VariableExpr{name});
+                    }
+                } else {
+                    targets.push(VariableExpr{name});
+                }
+                if !self.match_tokens(vec![TokenType::Comma]) || self.trailing_comma(close.clone())? {
+                    break;
+                }
+            }
+        }
+        if keyed {
+            let brace = self.consume(close, "Expect '}' after destructuring pattern.")?;
+            return Ok(DestructurePattern::keyed(brace, keys, targets, rest));
+        }
+        let paren = self.consume(close, "Expect ')' after destructuring pattern.")?;
+        Ok(DestructurePattern::new(paren, targets, rest))
     }
 
-    fn unary(&mut self) -> Result<Expr, ParserError> {
-        if self.match_tokens(vec![TokenType::Bang, TokenType::Minus]) {
-            let operator = self.previous();
-            let right = self.unary()?;
-            return Ok(Expr::Unary(UnaryExpr::new(operator, Box::new(right))));
+    // Reinterprets parsed list elements as the names of a destructuring pattern
+    fn destructure_pattern(&mut self, bracket: Token, elements: Vec<Expr>) -> Result<DestructurePattern, ParserError> {
+        let mut targets = Vec::new();
+        let mut rest = None;
+        let count = elements.len();
+        for (i, element) in elements.into_iter().enumerate() {
+            match element {
+                Expr::Variable(variable) => targets.push(variable),
+                Expr::Spread(SpreadExpr { ellipsis, expression }) => match *expression {
+                    Expr::Variable(variable) if i == count - 1 => rest = Some(variable),
+                    _ => return Err(self.error(ellipsis, "Only the last name in a pattern can be a rest name.")),
+                },
+                _ => return Err(self.error(bracket, "Invalid destructuring target.")),
+            }
         }
-        return self.call();
+        Ok(DestructurePattern::new(bracket, targets, rest))
     }
 
-    fn call(&mut self) -> Result<Expr, ParserError> {
-        let mut expr = self.primary()?;
-        loop {
-            if self.match_tokens(vec![TokenType::LeftParen]) {
-                expr = self.finish_call(expr)?;
-            } else if self.match_tokens(vec![TokenType::Dot]) {
-                let name = self.consume(TokenType::Identifier, "Expect property name after '.'")?;
-                expr = Expr::Get(GetExpr::new(Box::new(expr), name));
+    fn match_expression(&mut self) -> Result<Expr, ParserError> {
+        let keyword = self.previous();
+        self.consume(TokenType::LeftParen, "Expect '(' after 'match'.")?;
+        let subject = self.expression()?;
+        self.consume(TokenType::RightParen, "Expect ')' after match value.")?;
+        self.consume(TokenType::LeftBrace, "Expect '{' before match arms.")?;
+        let mut arms = Vec::new();
+        while !self.check(TokenType::RightBrace) && !self.is_at_end() {
+            let pattern = self.pattern()?;
+            let guard = if self.match_tokens(vec![TokenType::If]) {
+                Some(self.expression()?)
             } else {
+                None
+            };
+            self.consume(TokenType::FatArrow, "Expect '=>' after match pattern.")?;
+            let body = self.expression()?;
+            arms.push(MatchArm::new(pattern, guard, body));
+            if !self.match_tokens(vec![TokenType::Comma]) {
                 break;
             }
         }
-        Ok(expr)
+        self.consume(TokenType::RightBrace, "Expect '}' after match arms.")?;
+        Ok(Expr::Match(MatchExpr::new(keyword, Box::new(subject), arms)))
     }
 
-    fn finish_call(&mut self, callee: Expr) -> Result<Expr, ParserError> {
-        let mut arguments = Vec::new();
-        if !self.check(TokenType::RightParen) {
-            loop {
-                if arguments.len() >= 255 {
-                    let token = self.peek();
-                    return Err(self.error(token, "Cannot have more than 255 arguments."));
+    fn pattern(&mut self) -> Result<Pattern, ParserError> {
+        let token = self.peek();
+        if self.match_tokens(vec![TokenType::False]) {
+            return Ok(Pattern::Literal(LiteralExpr::new(TokenType::False, LoxValue::Boolean(false))));
+        }
+        if self.match_tokens(vec![TokenType::True]) {
+            return Ok(Pattern::Literal(LiteralExpr::new(TokenType::True, LoxValue::Boolean(true))));
+        }
+        if self.match_tokens(vec![TokenType::Nil]) {
+            return Ok(Pattern::Literal(LiteralExpr::new(TokenType::Nil, LoxValue::Nil)));
+        }
+        if self.match_tokens(vec![TokenType::Number, TokenType::String]) {
+            return Ok(Pattern::Literal(LiteralExpr::new(token.token_type, token.literal)));
+        }
+        if self.match_tokens(vec![TokenType::Minus]) {
+            let number = self.consume(TokenType::Number, "Expect number after '-' in pattern.")?;
+            let negated = match number.literal {
+                LoxValue::Integer(n) => LoxValue::Integer(-n),
+                LoxValue::BigInt(n) => LoxValue::BigInt(n.neg()),
+                LoxValue::Number(n) => LoxValue::Number(-n),
+                other => other,
+            };
+            return Ok(Pattern::Literal(LiteralExpr::new(TokenType::Number, negated)));
+        }
+        if self.match_tokens(vec![TokenType::LeftBracket]) {
+            let mut elements = Vec::new();
+            let mut rest = None;
+            while !self.check(TokenType::RightBracket) {
+                if self.match_tokens(vec![TokenType::Ellipsis]) {
+                    let name = self.consume(TokenType::Identifier, "Expect name after '...'.")?;
+                    rest = Some(VariableExpr { name });
+                    if !self.check(TokenType::RightBracket) {
+                        let token = self.peek();
+                        return Err(self.error(token, "Only the last element of a list pattern can be a rest name."));
+                    }
+                    break;
                 }
-                arguments.push(self.expression()?);
+                elements.push(self.pattern()?);
                 if !self.match_tokens(vec![TokenType::Comma]) {
                     break;
                 }
             }
+            self.consume(TokenType::RightBracket, "Expect ']' after list pattern.")?;
+            return Ok(Pattern::List(ListPattern::new(token, elements, rest)));
         }
-        let paren = self.consume(TokenType::RightParen, "Expect ')' after arguments.")?;
-        Ok(Expr::Call(CallExpr::new(Box::new(callee), paren, arguments)))
+        if self.match_tokens(vec![TokenType::LeftBrace]) {
+            self.require(Feature::Maps)?;
+            return self.map_pattern(token);
+        }
+        if self.match_tokens(vec![TokenType::Identifier]) {
+            if self.match_tokens(vec![TokenType::LeftBrace]) {
+                let mut fields = Vec::new();
+                while !self.check(TokenType::RightBrace) {
+                    let field = self.consume(TokenType::Identifier, "Expect field name in class pattern.")?;
+                    let pattern = if self.match_tokens(vec![TokenType::Colon]) {
+                        self.pattern()?
+                    } else {
+                        Pattern::Binding(VariableExpr { name: field.clone() })
+                    };
+                    fields.push((field, pattern));
+                    if !self.match_tokens(vec![TokenType::Comma]) {
+                        break;
+                    }
+                }
+                self.consume(TokenType::RightBrace, "Expect '}' after class pattern.")?;
+                return Ok(Pattern::Class(ClassPattern::new(VariableExpr { name: token }, fields)));
+            }
+            if token.token == "_" {
+                return Ok(Pattern::Wildcard);
+            }
+            return Ok(Pattern::Binding(VariableExpr { name: token }));
+        }
+        Err(self.error(token, "Expect pattern."))
+    }
+
+    // Entries after a '{' in a pattern up to and including the closing '}'.
+    // A name alone binds the value under that name as a string key.
+    fn map_pattern(&mut self, brace: Token) -> Result<Pattern, ParserError> {
+        let mut entries = Vec::new();
+        let mut rest = None;
+        while !self.check(TokenType::RightBrace) {
+            if self.match_tokens(vec![TokenType::Ellipsis]) {
+                let name = self.consume(TokenType::Identifier, "Expect name after '...'.")?;
+                rest = Some(VariableExpr { name });
+                if !self.check(TokenType::RightBrace) {
+                    let token = self.peek();
+                    return Err(self.error(token, "Only the last entry of a map pattern can be a rest name."));
+                }
+                break;
+            }
+            let key = self.peek();
+            if self.match_tokens(vec![TokenType::Identifier]) {
+                let literal = LiteralExpr::new(TokenType::String, LoxValue::String(key.token.clone()));
+                let pattern = if self.match_tokens(vec![TokenType::Colon]) {
+                    self.pattern()?
+                } else {
+                    Pattern::Binding(VariableExpr { name: key })
+                };
+                entries.push((literal, pattern));
+            } else if self.match_tokens(vec![TokenType::String, TokenType::Number]) {
+                self.consume(TokenType::Colon, "Expect ':' after map pattern key.")?;
+                entries.push((LiteralExpr::new(key.token_type, key.literal), self.pattern()?));
+            } else {
+                return Err(self.error(key, "Expect name, string or number as map pattern key."));
+            }
+            if !self.match_tokens(vec![TokenType::Comma]) {
+                break;
+            }
+        }
+        self.consume(TokenType::RightBrace, "Expect '}' after map pattern.")?;
+        Ok(Pattern::Map(MapPattern::new(brace, entries, rest)))
+    }
+
+    // Entries after a '{' in an expression up to and including the closing
+    // '}'. A name before the ':' is the key as a string; anything else is an
+    // expression whose value is the key.
+    fn map_literal(&mut self) -> Result<Expr, ParserError> {
+        let brace = self.previous();
+        let mut entries = Vec::new();
+        if !self.check(TokenType::RightBrace) {
+            loop {
+                let key = if self.check_sequence(&[TokenType::Identifier, TokenType::Colon]) {
+                    let name = self.advance();
+                    Expr::Literal(LiteralExpr::new(TokenType::String, LoxValue::String(name.token)))
+                } else {
+                    self.expression()?
+                };
+                self.consume(TokenType::Colon, "Expect ':' after map key.")?;
+                entries.push((key, self.expression()?));
+                if !self.match_tokens(vec![TokenType::Comma]) || self.trailing_comma(TokenType::RightBrace)? {
+                    break;
+                }
+            }
+        }
+        self.consume(TokenType::RightBrace, "Expect '}' after map entries.")?;
+        Ok(Expr::MapLiteral(MapLiteralExpr::new(brace, entries)))
+    }
+
+    // An argument or list element, optionally prefixed with '...'
+    fn spreadable(&mut self) -> Result<Expr, ParserError> {
+        if self.match_tokens(vec![TokenType::Ellipsis]) {
+            self.require(Feature::Spread)?;
+            let ellipsis = self.previous();
+            let expr = self.expression()?;
+            return Ok(Expr::Spread(SpreadExpr::new(ellipsis, Box::new(expr))));
+        }
+        self.expression()
     }
 
     fn primary(&mut self) -> Result<Expr, ParserError> {
@@ -376,6 +1104,20 @@ impl Parser {
         if self.match_tokens(vec![TokenType::String]) {
             return Ok(Expr::Literal(LiteralExpr::new(TokenType::String, token.literal.clone())));
         }
+        if self.match_tokens(vec![TokenType::Interpolation]) {
+            let mut parts = vec![Expr::Literal(LiteralExpr::new(TokenType::String, token.literal.clone()))];
+            loop {
+                parts.push(self.expression()?);
+                if self.match_tokens(vec![TokenType::Interpolation]) {
+                    parts.push(Expr::Literal(LiteralExpr::new(TokenType::String, self.previous().literal)));
+                    continue;
+                }
+                let end = self.consume(TokenType::String, "Expect '}' after interpolated expression.")?;
+                parts.push(Expr::Literal(LiteralExpr::new(TokenType::String, end.literal)));
+                break;
+            }
+            return Ok(Expr::Interpolation(InterpolationExpr::new(token, parts)));
+        }
         if self.match_tokens(vec![TokenType::Super]) {
             let keyword = self.previous();
             self.consume(TokenType::Dot, "Expect '.' after 'super'.")?;
@@ -388,15 +1130,48 @@ impl Parser {
         if self.match_tokens(vec![TokenType::Identifier]) {
             return Ok(Expr::Variable(VariableExpr{name : token.clone()}));
         }
+        if self.match_tokens(vec![TokenType::LeftBracket]) {
+            self.require(Feature::Lists)?;
+            let elements = self.list_elements()?;
+            return Ok(Expr::List(ListExpr::new(self.previous(), elements)));
+        }
+        if self.match_tokens(vec![TokenType::HashBrace]) {
+            self.require(Feature::Sets)?;
+            let brace = self.previous();
+            let mut elements = Vec::new();
+            if !self.check(TokenType::RightBrace) {
+                loop {
+                    elements.push(self.spreadable()?);
+                    if !self.match_tokens(vec![TokenType::Comma]) || self.trailing_comma(TokenType::RightBrace)? {
+                        break;
+                    }
+                }
+            }
+            self.consume(TokenType::RightBrace, "Expect '}' after set elements.")?;
+            return Ok(Expr::SetLiteral(SetLiteralExpr::new(brace, elements)));
+        }
+        if self.match_tokens(vec![TokenType::LeftBrace]) {
+            self.require(Feature::Maps)?;
+            return self.map_literal();
+        }
         if self.match_tokens(vec![TokenType::LeftParen]) {
             let expr = self.expression()?;
             let _noop = self.consume(TokenType::RightParen, "Expect ')' after expression.")?;
             return Ok(Expr::Grouping(GroupingExpr::new(Box::new(expr))));
         }
+        if self.match_tokens(vec![TokenType::Match]) {
+            return self.match_expression();
+        }
         let token = self.peek();
         Err(self.error(token, "Expect expression."))
     }
 
+    // The doc comment before the next token, if any
+    fn doc(&mut self) -> Option<String> {
+        let offset = self.peek().offset;
+        self.docs.get(&offset).cloned()
+    }
+
     fn match_tokens(&mut self, types: Vec<TokenType>) -> bool {
         for token_type in types {
             if self.check(token_type) {
@@ -411,7 +1186,14 @@ impl Parser {
         if self.is_at_end() {
             return false;
         }
-        self.peek().token_type == token_type
+        self.peek_at(0).token_type == token_type
+    }
+
+    // Whether the tokens coming up are these, in this order, without
+    // consuming any. This is how a construct that starts like another one is
+    // told apart from it, instead of parsing one and backtracking.
+    fn check_sequence(&self, token_types: &[TokenType]) -> bool {
+        token_types.iter().enumerate().all(|(k, token_type)| self.peek_at(k).token_type == *token_type)
     }
 
     fn advance(&mut self) -> Token {
@@ -422,17 +1204,54 @@ impl Parser {
     }
 
     fn is_at_end(&mut self) -> bool {
-      self.peek().token_type == TokenType::Eof
+      self.peek_at(0).token_type == TokenType::Eof
     }
 
     fn peek(&mut self) -> Token {
-        self.tokens[self.current].clone()
+        self.peek_at(0).clone()
+    }
+
+    // The token k past the current one, borrowed rather than copied, or the
+    // final Eof for anything past the end
+    fn peek_at(&self, k: usize) -> &Token {
+        let last = self.tokens.len() - 1;
+        &self.tokens[(self.current + k).min(last)]
     }
 
     fn previous(&mut self) -> Token {
         self.tokens[self.current - 1].clone()
     }
 
+    // Ends a statement at its ';'. With optional semicolons on, a line break
+    // ends it too, and so does a '}' or the end of the script after it, but
+    // only where a ';' was expected: a line that continues the expression, say
+    // by starting with an operator, '(' or '[', is still part of it.
+    fn terminate(&mut self, message: &str) -> Result<(), ParserError> {
+        if self.match_tokens(vec![TokenType::Semicolon]) || self.implicit_semicolon() {
+            return Ok(());
+        }
+        let token = self.peek();
+        Err(self.error(token, message))
+    }
+
+    fn implicit_semicolon(&mut self) -> bool {
+        if !dialect::enabled(Feature::OptionalSemicolons) {
+            return false;
+        }
+        let line = self.previous().line;
+        self.check(TokenType::RightBrace) || self.is_at_end() || self.peek().line > line
+    }
+
+    // Whether a `return` or `yield` has no value: only when the statement ends
+    // right after the keyword with a ';', '}' or the end of the script, since
+    // a value on the next line is still the one returned
+    fn at_statement_end(&mut self) -> bool {
+        if self.check(TokenType::Semicolon) {
+            return true;
+        }
+        dialect::enabled(Feature::OptionalSemicolons) && (self.check(TokenType::RightBrace) || self.is_at_end())
+    }
+
     fn consume(&mut self, token_type: TokenType, message: &str) -> Result<Token, ParserError> {
         if self.check(token_type) {
             return Ok(self.advance());
@@ -441,11 +1260,74 @@ impl Parser {
         Err(self.error(token, message))
     }
 
+    // Fails at the token just matched if the dialect has the feature off
+    // A name after '.' can be a keyword an extension added, as in `r.match(s)`,
+    // since it can't be mistaken for one there
+    fn property_name(&mut self, message: &str) -> Result<Token, ParserError> {
+        let token = self.peek();
+        if token.token_type != TokenType::Identifier && dialect::keyword_feature(&token.token).is_some() {
+            self.advance();
+            return Ok(Token { token_type: TokenType::Identifier, ..token });
+        }
+        self.consume(TokenType::Identifier, message)
+    }
+
+    fn require(&mut self, feature: Feature) -> Result<(), ParserError> {
+        let token = self.previous();
+        self.require_at(feature, token)
+    }
+
+    fn require_at(&mut self, feature: Feature, token: Token) -> Result<(), ParserError> {
+        if dialect::enabled(feature) {
+            return Ok(());
+        }
+        Err(self.error(token, &format!("The '{}' extension is off in this dialect.", feature.name())))
+    }
+
+    // Tries a rule at the current token without reporting its errors. If it
+    // fails, the parser is put back where it was. Either way the outcome goes
+    // in the rule's memo table, so trying it here again costs nothing.
+    fn speculate<T: Clone>(&mut self, rule: fn(&mut Self) -> Result<T, ParserError>, memo: fn(&mut Self) -> &mut Memo<T>) -> Option<T> {
+        let start = self.current;
+        let outcome = match memo(self).get(&start).cloned() {
+            Some(outcome) => outcome,
+            None => {
+                self.speculating += 1;
+                let parsed = rule(self).ok().map(|parsed| (parsed, self.current));
+                self.speculating -= 1;
+                memo(self).insert(start, parsed.clone());
+                parsed
+            }
+        };
+        match outcome {
+            Some((parsed, end)) => {
+                self.current = end;
+                Some(parsed)
+            }
+            None => {
+                self.current = start;
+                None
+            }
+        }
+    }
+
     fn error(&mut self, token: Token, message: &str) -> ParserError {
-        error_at_token(&token, message);
+        if self.speculating == 0 {
+            error_at_token(&token, message);
+        }
         ParserError {}
     }
 
+    // Reports an error that leaves the code around it parseable, so parsing
+    // carries on from where it is instead of skipping to the next statement
+    // and reporting whatever that trips over too
+    fn report(&mut self, token: Token, message: &str) {
+        if self.speculating == 0 {
+            self.had_error = true;
+        }
+        self.error(token, message);
+    }
+
     fn synchronize(&mut self) {
         self.advance();
         while !self.is_at_end() {
@@ -453,7 +1335,7 @@ impl Parser {
                 return;
             }
             match self.peek().token_type {
-                TokenType::Class | TokenType::Fun | TokenType::Var | TokenType::For | TokenType::If | TokenType::While | TokenType::Print | TokenType::Return => return,
+                TokenType::Class | TokenType::Trait | TokenType::Fun | TokenType::Var | TokenType::Const | TokenType::For | TokenType::If | TokenType::While | TokenType::Print | TokenType::Return | TokenType::Yield | TokenType::Do | TokenType::Break | TokenType::Try | TokenType::Throw | TokenType::Using => return,
                 _ => (),
             }
             self.advance();
@@ -0,0 +1,120 @@
+use crate::interpreter::{Interpreter, InterpreterError};
+use crate::lexer::*;
+use crate::logging::*;
+
+// Lists and instances whose contents fit on one line this long are kept inline
+const INLINE_WIDTH: usize = 60;
+
+// Formats values for the REPL: strings are quoted, nested lists and instances
+// are spread over indented lines, and a list or instance that contains itself
+// prints `[...]` or `{...}` where it recurs instead of recursing forever.
+// An instance with a toString() is shown as that returns, the same as print
+// would show it, so the error is toString's when it fails.
+pub fn pretty(value: &LoxValue, interpreter: &mut Interpreter) -> Result<String, InterpreterError> {
+  let mut printer = PrettyPrinter { interpreter, path: Vec::new() };
+  printer.format(value, 0)
+}
+
+struct PrettyPrinter<'a> {
+  interpreter: &'a mut Interpreter,
+  // The containers currently being printed, outermost first
+  path: Vec<*const ()>,
+}
+
+impl PrettyPrinter<'_> {
+  fn format(&mut self, value: &LoxValue, depth: usize) -> Result<String, InterpreterError> {
+    Ok(match value {
+      LoxValue::Number(_) | LoxValue::Integer(_) | LoxValue::BigInt(_) => paint(&value.to_string(), YELLOW),
+      LoxValue::String(s) => paint(&format!("{:?}", s), GREEN),
+      LoxValue::Boolean(_) | LoxValue::Nil => paint(&value.to_string(), MAGENTA),
+      LoxValue::Callable(c) => paint(&format!("{:?}", c.borrow()), CYAN),
+      LoxValue::Class(c) => paint(&format!("<class {}>", c.name), CYAN),
+      LoxValue::Generator(g) => paint(&g.borrow().to_string(), CYAN),
+      LoxValue::Bytes(_) => paint(&value.to_string(), YELLOW),
+      LoxValue::List(list) => {
+        let id = std::rc::Rc::as_ptr(list) as *const ();
+        if self.path.contains(&id) {
+          return Ok("[...]".to_string());
+        }
+        self.path.push(id);
+        let elements = list.borrow().clone().iter().map(|e| self.format(e, depth + 1)).collect::<Result<Vec<_>, _>>()?;
+        self.path.pop();
+        PrettyPrinter::layout("[", "]", elements, depth)
+      }
+      LoxValue::Set(set) => {
+        let elements = set.borrow().values().iter().map(|e| self.format(e, depth + 1)).collect::<Result<Vec<_>, _>>()?;
+        PrettyPrinter::layout("#{", "}", elements, depth)
+      }
+      LoxValue::Map(map) => {
+        let id = std::rc::Rc::as_ptr(map) as *const ();
+        if self.path.contains(&id) {
+          return Ok("{...}".to_string());
+        }
+        self.path.push(id);
+        let entries: Vec<(LoxValue, LoxValue)> = map.borrow().entries().map(|(k, v)| (k.clone(), v.clone())).collect();
+        let entries = entries
+          .iter()
+          .map(|(key, value)| Ok(format!("{}: {}", self.format(key, depth + 1)?, self.format(value, depth + 1)?)))
+          .collect::<Result<Vec<_>, _>>()?;
+        self.path.pop();
+        PrettyPrinter::layout("{", "}", entries, depth)
+      }
+      LoxValue::Instance(instance) => {
+        if let Some(text) = self.interpreter.custom_string(instance)? {
+          return Ok(text);
+        }
+        let id = std::rc::Rc::as_ptr(instance) as *const ();
+        let name = instance.borrow().class.name.clone();
+        if self.path.contains(&id) {
+          return Ok(format!("{} {{...}}", name));
+        }
+        self.path.push(id);
+        let properties: Vec<(String, LoxValue)> =
+          instance.borrow().properties.iter().map(|(k, v)| (k.clone(), v.clone())).collect();
+        let fields = properties
+          .iter()
+          .map(|(key, value)| Ok(format!("{}: {}", key, self.format(value, depth + 1)?)))
+          .collect::<Result<Vec<_>, _>>()?;
+        self.path.pop();
+        if fields.is_empty() {
+          return Ok(format!("{} {{}}", name));
+        }
+        PrettyPrinter::layout(&format!("{} {{", name), "}", fields, depth)
+      }
+    })
+  }
+
+  // One line when it's short and flat, otherwise one item per line
+  fn layout(open: &str, close: &str, items: Vec<String>, depth: usize) -> String {
+    let inline = items.join(", ");
+    if visible_width(&inline) <= INLINE_WIDTH && !inline.contains('\n') {
+      // An instance's braces get a space inside them, brackets don't
+      return match open.ends_with(" {") {
+        true => format!("{} {} {}", open, inline, close),
+        false => format!("{}{}{}", open, inline, close),
+      };
+    }
+    let indent = "  ".repeat(depth + 1);
+    let mut out = format!("{}\n", open);
+    for item in items {
+      out.push_str(&format!("{}{},\n", indent, item));
+    }
+    out.push_str(&format!("{}{}", "  ".repeat(depth), close));
+    out
+  }
+}
+
+// Length without the ANSI color codes
+fn visible_width(text: &str) -> usize {
+  let mut width = 0;
+  let mut in_escape = false;
+  for c in text.chars() {
+    match c {
+      '\x1b' => in_escape = true,
+      'm' if in_escape => in_escape = false,
+      _ if !in_escape => width += 1,
+      _ => (),
+    }
+  }
+  width
+}
@@ -0,0 +1,180 @@
+/*
+Projects: a script spread over several files, described by a `lox.json`
+manifest at the project's root.
+
+    {
+      "name": "demo",
+      "entry": "src/main.lox",
+      "sources": ["src"],
+      "dialect": "extended",
+      "dependencies": {"github.com/user/loxlib": "v1.0"}
+    }
+
+`entry` is the script to run, and `sources` are directories whose `.lox`
+files make up the rest of the program. Paths are relative to the manifest.
+The files share one global scope: the sources run first, in path order, so
+the functions and classes they declare are there by the time the entry point
+runs. `dialect` is a spec as for --dialect, which takes precedence over it,
+and a file's own pragma still adjusts it for that file. `dependencies` are
+modules fetched by `lox get` (see packages.rs) into lox_modules/. Each runs
+before the project in a scope of its own, and what it declares is reached
+through a global named after it, as in `loxlib.double(2)`. Names starting
+with an underscore stay private to the module. Only `entry` is required.
+
+`lox init` writes a manifest and an entry point to start from, and `lox run`
+with no script finds the manifest in the current directory or the nearest
+one above it.
+*/
+
+use crate::astjson::{self, Json};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+pub const MANIFEST: &str = "lox.json";
+pub const MODULES: &str = "lox_modules";
+
+pub struct Manifest {
+  pub name: String,
+  // The directory the manifest is in
+  pub root: PathBuf,
+  pub entry: PathBuf,
+  pub sources: Vec<PathBuf>,
+  pub dialect: Option<String>,
+  // Module paths with the version asked for, in the order written
+  pub dependencies: Vec<(String, String)>,
+}
+
+// The manifest of the project the directory is in, if there is one
+pub fn find(directory: &Path) -> Option<PathBuf> {
+  directory.ancestors().map(|dir| dir.join(MANIFEST)).find(|path| path.is_file())
+}
+
+pub fn load(path: &Path) -> Result<Manifest, String> {
+  let content = fs::read_to_string(path).map_err(|err| format!("Error reading {}: {}", path.display(), err))?;
+  let document = astjson::parse_json(&content).map_err(|message| format!("{}: {}", path.display(), message))?;
+  let root = path.parent().unwrap_or(Path::new(".")).to_path_buf();
+  let text = |key: &str| match document.get(key) {
+    None | Some(Json::Null) => Ok(None),
+    Some(Json::String(value)) => Ok(Some(value.clone())),
+    Some(_) => Err(format!("{}: Expected '{}' to be a string.", path.display(), key)),
+  };
+  let entry = text("entry")?.ok_or_else(|| format!("{}: Expected an 'entry' field naming the script to run.", path.display()))?;
+  let sources = match document.get("sources") {
+    None | Some(Json::Null) => Vec::new(),
+    Some(Json::Array(items)) => items
+      .iter()
+      .map(|item| match item {
+        Json::String(dir) => Ok(root.join(dir)),
+        _ => Err(format!("{}: Expected 'sources' to be a list of directories.", path.display())),
+      })
+      .collect::<Result<_, _>>()?,
+    Some(_) => return Err(format!("{}: Expected 'sources' to be a list of directories.", path.display())),
+  };
+  let dependencies = match document.get("dependencies") {
+    None | Some(Json::Null) => Vec::new(),
+    Some(Json::Object(entries)) => entries
+      .iter()
+      .map(|(module, version)| match version {
+        Json::String(version) => Ok((module.clone(), version.clone())),
+        _ => Err(format!("{}: Expected the version of '{}' to be a string.", path.display(), module)),
+      })
+      .collect::<Result<_, _>>()?,
+    Some(_) => return Err(format!("{}: Expected 'dependencies' to map module paths to versions.", path.display())),
+  };
+  let name = text("name")?.unwrap_or_else(|| root.file_name().map(|name| name.to_string_lossy().into_owned()).unwrap_or_default());
+  Ok(Manifest { name, entry: root.join(entry), sources, dialect: text("dialect")?, dependencies, root })
+}
+
+impl Manifest {
+  // The project's own files in the order they run, the entry point last
+  pub fn files(&self) -> Result<Vec<PathBuf>, String> {
+    let mut files = Vec::new();
+    for dir in &self.sources {
+      collect(dir, &mut files).map_err(|err| format!("Error reading {}: {}", dir.display(), err))?;
+    }
+    files.sort();
+    files.dedup();
+    let entry = fs::canonicalize(&self.entry).map_err(|err| format!("Error reading {}: {}", self.entry.display(), err))?;
+    files.retain(|file| fs::canonicalize(file).map_or(true, |file| file != entry));
+    files.push(self.entry.clone());
+    Ok(files)
+  }
+
+  // Each dependency's namespace name and files, to run before the project
+  pub fn modules(&self) -> Result<Vec<(String, Vec<PathBuf>)>, String> {
+    let mut modules = Vec::new();
+    for (module, _) in &self.dependencies {
+      let files = module_files(&self.root.join(MODULES).join(module), module)?;
+      modules.push((namespace_name(module), files));
+    }
+    Ok(modules)
+  }
+}
+
+// A module is reached by the last part of its path, made into an identifier:
+// github.com/user/lox-utils is `lox_utils`
+pub fn namespace_name(module: &str) -> String {
+  let last = module.rsplit('/').next().unwrap_or(module);
+  let mut name: String = last.chars().map(|c| if c.is_ascii_alphanumeric() || c == '_' { c } else { '_' }).collect();
+  if name.is_empty() || name.starts_with(|c: char| c.is_ascii_digit()) {
+    name.insert(0, '_');
+  }
+  name
+}
+
+// A module's files are the ones its own manifest names, or without one every
+// script in it
+fn module_files(dir: &Path, module: &str) -> Result<Vec<PathBuf>, String> {
+  if !dir.is_dir() {
+    return Err(format!("Module '{}' hasn't been fetched. Run `lox get` to fetch it.", module));
+  }
+  let manifest = dir.join(MANIFEST);
+  if manifest.is_file() {
+    return load(&manifest)?.files();
+  }
+  let mut files = Vec::new();
+  collect(dir, &mut files).map_err(|err| format!("Error reading {}: {}", dir.display(), err))?;
+  files.sort();
+  Ok(files)
+}
+
+fn collect(dir: &Path, files: &mut Vec<PathBuf>) -> std::io::Result<()> {
+  for entry in fs::read_dir(dir)? {
+    let path = entry?.path();
+    if path.is_dir() {
+      collect(&path, files)?;
+    } else if path.extension().is_some_and(|extension| extension == "lox") {
+      files.push(path);
+    }
+  }
+  Ok(())
+}
+
+// Writes a manifest and an entry point into the directory, named after it,
+// and returns the files written. An existing entry point is kept.
+pub fn init(directory: &Path) -> Result<Vec<PathBuf>, String> {
+  let manifest = directory.join(MANIFEST);
+  if manifest.exists() {
+    return Err(format!("{} already exists.", manifest.display()));
+  }
+  let name = fs::canonicalize(directory)
+    .ok()
+    .and_then(|dir| dir.file_name().map(|name| name.to_string_lossy().into_owned()))
+    .unwrap_or_else(|| "lox-project".to_string());
+  let document = Json::Object(vec![
+    ("name".to_string(), Json::String(name.clone())),
+    ("entry".to_string(), Json::String("src/main.lox".to_string())),
+    ("sources".to_string(), Json::Array(vec![Json::String("src".to_string())])),
+    ("dialect".to_string(), Json::String("extended".to_string())),
+  ]);
+  let entry = directory.join("src").join("main.lox");
+  let mut written = Vec::new();
+  if !entry.exists() {
+    fs::create_dir_all(directory.join("src")).map_err(|err| format!("Error creating {}: {}", directory.join("src").display(), err))?;
+    fs::write(&entry, format!("print \"Hello from {}!\";\n", name)).map_err(|err| format!("Error writing {}: {}", entry.display(), err))?;
+    written.push(entry);
+  }
+  fs::write(&manifest, astjson::write_document(&document)).map_err(|err| format!("Error writing {}: {}", manifest.display(), err))?;
+  written.insert(0, manifest);
+  Ok(written)
+}
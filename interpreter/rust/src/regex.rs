@@ -0,0 +1,695 @@
+/*
+Regular expressions for regex(), in the syntax of Go's regexp package, which
+is what `lox build` hands them to. Like Go's, matching never backtracks: the
+compiled program runs as a Pike VM, which steps every possible thread through
+the input together, so a match takes time linear in the input whatever the
+pattern. Of the matches that start leftmost, the one the pattern prefers
+wins, as in Perl: `a|ab` finds "a" in "ab", and greedy repeats take as much
+as they can.
+
+Supported: literals and escapes (\n, \t, \x41, \x{263a}, \. and other
+punctuation), `.`, classes like [a-z] and [^0-9] and the Perl classes \d \w
+\s and their negations, anchors ^ $ \A \z \b \B, groups (...), (?:...) and
+(?P<name>...), alternation, and the repeats * + ? {n} {n,} {n,m}, with a
+trailing ? making them lazy. Flags i (ignore case), m (^ and $ match at line
+breaks) and s (. matches \n) are set with (?ims) for the rest of the group
+or (?ims:...) for part of it. There are no backreferences or lookarounds,
+since those can't be matched in linear time, and no Unicode or POSIX
+classes. Like Go, \d, \w, \s and \b are ASCII only.
+
+Positions are char indices, the same as the interpreter's strings use.
+*/
+
+// The most a counted repeat can ask for, as in Go
+const MAX_REPEAT: u32 = 1000;
+
+pub struct Regex {
+  pub pattern: String,
+  program: Vec<Inst>,
+  // Group names by group number, "" for unnamed ones and the whole match
+  names: Vec<String>,
+}
+
+// Start and end of the whole match and each group, None for a group that
+// didn't take part
+pub type Captures = Vec<Option<(usize, usize)>>;
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Look {
+  TextStart,
+  TextEnd,
+  LineStart,
+  LineEnd,
+  WordBoundary,
+  NotWordBoundary,
+}
+
+#[derive(Clone, Debug)]
+struct Class {
+  // Inclusive ranges of code points
+  ranges: Vec<(u32, u32)>,
+  negated: bool,
+  fold: bool,
+}
+
+#[derive(Clone, Debug)]
+enum Node {
+  Empty,
+  Char(char, bool),
+  // Whether it matches \n too
+  Any(bool),
+  Class(Class),
+  Look(Look),
+  Group(Box<Node>, Option<usize>),
+  Concat(Vec<Node>),
+  Alternate(Vec<Node>),
+  Repeat { node: Box<Node>, min: u32, max: Option<u32>, greedy: bool },
+}
+
+#[derive(Clone, Debug)]
+enum Inst {
+  Char(char, bool),
+  Any(bool),
+  Class(Class),
+  Look(Look),
+  // Both are tried, the first with higher priority
+  Split(usize, usize),
+  Jump(usize),
+  Save(usize),
+  Match,
+}
+
+#[derive(Clone, Copy, Default)]
+struct Flags {
+  fold: bool,
+  multiline: bool,
+  dot_all: bool,
+}
+
+impl Class {
+  fn matches(&self, c: char) -> bool {
+    let contains = |c: char| self.ranges.iter().any(|(low, high)| (*low..=*high).contains(&(c as u32)));
+    let found = contains(c) || (self.fold && (contains(lower(c)) || contains(upper(c))));
+    found != self.negated
+  }
+}
+
+fn lower(c: char) -> char {
+  let mut lowered = c.to_lowercase();
+  match (lowered.next(), lowered.next()) {
+    (Some(l), None) => l,
+    _ => c,
+  }
+}
+
+fn upper(c: char) -> char {
+  let mut raised = c.to_uppercase();
+  match (raised.next(), raised.next()) {
+    (Some(u), None) => u,
+    _ => c,
+  }
+}
+
+fn is_word(c: char) -> bool {
+  c.is_ascii_alphanumeric() || c == '_'
+}
+
+///////////// Parsing ///////////////
+
+struct Parser<'a> {
+  pattern: &'a str,
+  chars: Vec<char>,
+  current: usize,
+  flags: Flags,
+  names: Vec<String>,
+}
+
+impl Regex {
+  pub fn new(pattern: &str) -> Result<Regex, String> {
+    let mut parser = Parser { pattern, chars: pattern.chars().collect(), current: 0, flags: Flags::default(), names: vec![String::new()] };
+    let node = parser.alternation()?;
+    if parser.current < parser.chars.len() {
+      return Err(parser.error("unexpected )"));
+    }
+    let mut program = vec![Inst::Save(0)];
+    compile(&node, &mut program);
+    program.push(Inst::Save(1));
+    program.push(Inst::Match);
+    Ok(Regex { pattern: pattern.to_string(), program, names: parser.names })
+  }
+}
+
+impl Parser<'_> {
+  fn error(&self, message: &str) -> String {
+    format!("Invalid regex `{}`: {}.", self.pattern, message)
+  }
+
+  fn peek(&self) -> Option<char> {
+    self.chars.get(self.current).copied()
+  }
+
+  fn eat(&mut self, c: char) -> bool {
+    if self.peek() == Some(c) {
+      self.current += 1;
+      return true;
+    }
+    false
+  }
+
+  fn next(&mut self, missing: &str) -> Result<char, String> {
+    let c = self.peek().ok_or_else(|| self.error(missing))?;
+    self.current += 1;
+    Ok(c)
+  }
+
+  fn alternation(&mut self) -> Result<Node, String> {
+    let mut branches = vec![self.concatenation()?];
+    while self.eat('|') {
+      branches.push(self.concatenation()?);
+    }
+    Ok(if branches.len() == 1 { branches.pop().unwrap() } else { Node::Alternate(branches) })
+  }
+
+  fn concatenation(&mut self) -> Result<Node, String> {
+    let mut nodes = Vec::new();
+    while let Some(c) = self.peek() {
+      if c == '|' || c == ')' {
+        break;
+      }
+      if let Some(atom) = self.atom()? {
+        let atom = self.repeat(atom)?;
+        nodes.push(atom);
+      }
+    }
+    Ok(match nodes.len() {
+      0 => Node::Empty,
+      1 => nodes.pop().unwrap(),
+      _ => Node::Concat(nodes),
+    })
+  }
+
+  // Returns None for a flag group like (?i), which only changes the flags
+  fn atom(&mut self) -> Result<Option<Node>, String> {
+    let c = self.next("missing argument")?;
+    let node = match c {
+      '(' => return self.group(),
+      '[' => Node::Class(self.class()?),
+      '.' => Node::Any(self.flags.dot_all),
+      '^' => Node::Look(if self.flags.multiline { Look::LineStart } else { Look::TextStart }),
+      '$' => Node::Look(if self.flags.multiline { Look::LineEnd } else { Look::TextEnd }),
+      '*' | '+' | '?' => return Err(self.error(&format!("missing argument to repetition operator `{}`", c))),
+      '\\' => match self.next("trailing backslash at end of expression")? {
+        'A' => Node::Look(Look::TextStart),
+        'z' => Node::Look(Look::TextEnd),
+        'b' => Node::Look(Look::WordBoundary),
+        'B' => Node::Look(Look::NotWordBoundary),
+        _ => {
+          self.current -= 1;
+          match self.escape()? {
+            Escaped::Char(c) => Node::Char(c, self.flags.fold),
+            Escaped::Class(class) => Node::Class(class),
+          }
+        }
+      },
+      c => Node::Char(c, self.flags.fold),
+    };
+    Ok(Some(node))
+  }
+
+  // After the '('
+  fn group(&mut self) -> Result<Option<Node>, String> {
+    let saved = self.flags;
+    let mut index = None;
+    if self.eat('?') {
+      if self.eat('P') || self.peek() == Some('<') {
+        if !self.eat('<') {
+          return Err(self.error("invalid named capture"));
+        }
+        let mut name = String::new();
+        loop {
+          match self.next("invalid named capture")? {
+            '>' => break,
+            c if is_word(c) => name.push(c),
+            _ => return Err(self.error("invalid named capture")),
+          }
+        }
+        if name.is_empty() || self.names.contains(&name) {
+          return Err(self.error(&format!("invalid named capture `{}`", name)));
+        }
+        index = Some(self.names.len());
+        self.names.push(name);
+      } else {
+        let mut on = true;
+        loop {
+          match self.next("missing closing )")? {
+            'i' => self.flags.fold = on,
+            'm' => self.flags.multiline = on,
+            's' => self.flags.dot_all = on,
+            '-' if on => on = false,
+            // Flags for the rest of the enclosing group
+            ')' => return Ok(None),
+            ':' => break,
+            _ => return Err(self.error("invalid or unsupported Perl syntax")),
+          }
+        }
+      }
+    } else {
+      index = Some(self.names.len());
+      self.names.push(String::new());
+    }
+    let inner = self.alternation()?;
+    if !self.eat(')') {
+      return Err(self.error("missing closing )"));
+    }
+    self.flags = saved;
+    Ok(Some(Node::Group(Box::new(inner), index)))
+  }
+
+  fn repeat(&mut self, mut node: Node) -> Result<Node, String> {
+    loop {
+      let start = self.current;
+      let (min, max) = match self.peek() {
+        Some('*') => (0, None),
+        Some('+') => (1, None),
+        Some('?') => (0, Some(1)),
+        Some('{') => match self.counts() {
+          Some(counts) => counts,
+          // Not a repeat after all, so a literal brace
+          None => {
+            self.current = start;
+            return Ok(node);
+          }
+        },
+        _ => return Ok(node),
+      };
+      if self.chars[start] != '{' {
+        self.current += 1;
+      }
+      if max.is_some_and(|max| max < min) || min > MAX_REPEAT || max.is_some_and(|max| max > MAX_REPEAT) {
+        return Err(self.error("invalid repeat count"));
+      }
+      if let Node::Repeat { .. } = node {
+        let operator: String = self.chars[start..self.current].iter().collect();
+        return Err(self.error(&format!("invalid nested repetition operator `{}`", operator)));
+      }
+      let greedy = !self.eat('?');
+      node = Node::Repeat { node: Box::new(node), min, max, greedy };
+    }
+  }
+
+  // {n}, {n,} or {n,m}, or None if what's at the brace isn't one of those
+  fn counts(&mut self) -> Option<(u32, Option<u32>)> {
+    self.current += 1;
+    let min = self.number()?;
+    let max = if self.eat(',') {
+      if self.peek() == Some('}') { None } else { Some(self.number()?) }
+    } else {
+      Some(min)
+    };
+    self.eat('}').then_some((min, max))
+  }
+
+  fn number(&mut self) -> Option<u32> {
+    let start = self.current;
+    while self.peek().is_some_and(|c| c.is_ascii_digit()) {
+      self.current += 1;
+    }
+    let digits: String = self.chars[start..self.current].iter().collect();
+    // Too big to be valid either way, which the caller reports
+    if digits.len() > 8 { Some(u32::MAX) } else { digits.parse().ok() }
+  }
+
+  // After the '['
+  fn class(&mut self) -> Result<Class, String> {
+    let negated = self.eat('^');
+    let mut ranges = Vec::new();
+    let mut first = true;
+    loop {
+      let c = self.next("missing closing ]")?;
+      if c == ']' && !first {
+        break;
+      }
+      first = false;
+      let low = match c {
+        '\\' => match self.escape()? {
+          Escaped::Char(c) => c,
+          Escaped::Class(class) => {
+            ranges.extend(class_ranges(&class));
+            continue;
+          }
+        },
+        c => c,
+      };
+      let high = if self.peek() == Some('-') && self.chars.get(self.current + 1).is_some_and(|c| *c != ']') {
+        self.current += 1;
+        match self.next("missing closing ]")? {
+          '\\' => match self.escape()? {
+            Escaped::Char(c) => c,
+            Escaped::Class(_) => return Err(self.error("invalid character class range")),
+          },
+          c => c,
+        }
+      } else {
+        low
+      };
+      if high < low {
+        return Err(self.error(&format!("invalid character class range `{}-{}`", low, high)));
+      }
+      ranges.push((low as u32, high as u32));
+    }
+    Ok(Class { ranges, negated, fold: self.flags.fold })
+  }
+
+  // After a backslash: an escaped character or a Perl class
+  fn escape(&mut self) -> Result<Escaped, String> {
+    let c = self.next("trailing backslash at end of expression")?;
+    let class = |ranges: &[(char, char)], negated: bool| {
+      Escaped::Class(Class { ranges: ranges.iter().map(|(l, h)| (*l as u32, *h as u32)).collect(), negated, fold: false })
+    };
+    const DIGIT: &[(char, char)] = &[('0', '9')];
+    const SPACE: &[(char, char)] = &[('\t', '\n'), ('\x0c', '\r'), (' ', ' ')];
+    const WORD: &[(char, char)] = &[('0', '9'), ('A', 'Z'), ('_', '_'), ('a', 'z')];
+    Ok(match c {
+      'd' => class(DIGIT, false),
+      'D' => class(DIGIT, true),
+      's' => class(SPACE, false),
+      'S' => class(SPACE, true),
+      'w' => class(WORD, false),
+      'W' => class(WORD, true),
+      'a' => Escaped::Char('\x07'),
+      'f' => Escaped::Char('\x0c'),
+      't' => Escaped::Char('\t'),
+      'n' => Escaped::Char('\n'),
+      'r' => Escaped::Char('\r'),
+      'v' => Escaped::Char('\x0b'),
+      'x' => {
+        let digits: String = if self.eat('{') {
+          let mut digits = String::new();
+          loop {
+            match self.next("invalid escape sequence `\\x`")? {
+              '}' => break,
+              c => digits.push(c),
+            }
+          }
+          digits
+        } else {
+          let high = self.next("invalid escape sequence `\\x`")?;
+          let low = self.next("invalid escape sequence `\\x`")?;
+          format!("{}{}", high, low)
+        };
+        let code = u32::from_str_radix(&digits, 16).ok().and_then(char::from_u32);
+        Escaped::Char(code.ok_or_else(|| self.error(&format!("invalid escape sequence `\\x{}`", digits)))?)
+      }
+      c if c.is_ascii_punctuation() => Escaped::Char(c),
+      c => return Err(self.error(&format!("invalid escape sequence `\\{}`", c))),
+    })
+  }
+}
+
+enum Escaped {
+  Char(char),
+  Class(Class),
+}
+
+// The ranges a class matches, so a negated Perl class can go inside brackets
+fn class_ranges(class: &Class) -> Vec<(u32, u32)> {
+  if !class.negated {
+    return class.ranges.clone();
+  }
+  let mut ranges = Vec::new();
+  let mut next = 0;
+  for (low, high) in &class.ranges {
+    if *low > next {
+      ranges.push((next, low - 1));
+    }
+    next = high + 1;
+  }
+  ranges.push((next, char::MAX as u32));
+  ranges
+}
+
+///////////// Compiling ///////////////
+
+fn compile(node: &Node, program: &mut Vec<Inst>) {
+  match node {
+    Node::Empty => (),
+    Node::Char(c, fold) => program.push(Inst::Char(*c, *fold)),
+    Node::Any(dot_all) => program.push(Inst::Any(*dot_all)),
+    Node::Class(class) => program.push(Inst::Class(class.clone())),
+    Node::Look(look) => program.push(Inst::Look(*look)),
+    Node::Group(inner, index) => match index {
+      Some(index) => {
+        program.push(Inst::Save(index * 2));
+        compile(inner, program);
+        program.push(Inst::Save(index * 2 + 1));
+      }
+      None => compile(inner, program),
+    },
+    Node::Concat(nodes) => {
+      for node in nodes {
+        compile(node, program);
+      }
+    }
+    // Each branch but the last is a split to it or the rest, and jumps past
+    // the others once it's matched
+    Node::Alternate(branches) => {
+      let mut jumps = Vec::new();
+      for (i, branch) in branches.iter().enumerate() {
+        if i + 1 < branches.len() {
+          let split = program.len();
+          program.push(Inst::Split(split + 1, 0));
+          compile(branch, program);
+          jumps.push(program.len());
+          program.push(Inst::Jump(0));
+          let next = program.len();
+          program[split] = Inst::Split(split + 1, next);
+        } else {
+          compile(branch, program);
+        }
+      }
+      let end = program.len();
+      for jump in jumps {
+        program[jump] = Inst::Jump(end);
+      }
+    }
+    Node::Repeat { node, min, max, greedy } => {
+      for _ in 0..*min {
+        compile(node, program);
+      }
+      let split = |body: usize, skip: usize| if *greedy { Inst::Split(body, skip) } else { Inst::Split(skip, body) };
+      match max {
+        None => {
+          let start = program.len();
+          program.push(Inst::Split(0, 0));
+          compile(node, program);
+          program.push(Inst::Jump(start));
+          let end = program.len();
+          program[start] = split(start + 1, end);
+        }
+        // x{2,4} is xx(x(x)?)?, each optional copy skipping to the very end
+        Some(max) => {
+          let mut splits = Vec::new();
+          for _ in *min..*max {
+            splits.push(program.len());
+            program.push(Inst::Split(0, 0));
+            compile(node, program);
+          }
+          let end = program.len();
+          for at in splits {
+            program[at] = split(at + 1, end);
+          }
+        }
+      }
+    }
+  }
+}
+
+///////////// Matching ///////////////
+
+struct Thread {
+  pc: usize,
+  slots: Vec<Option<usize>>,
+}
+
+impl Regex {
+  // The leftmost match starting at or after `start`
+  pub fn find_at(&self, input: &[char], start: usize) -> Option<Captures> {
+    let slot_count = self.names.len() * 2;
+    let mut current: Vec<Thread> = Vec::new();
+    let mut matched: Option<Vec<Option<usize>>> = None;
+    let mut position = start;
+    loop {
+      // A new thread starts here while nothing has matched yet, behind the
+      // ones that started earlier, which are preferred
+      if matched.is_none() {
+        let mut seen = vec![false; self.program.len()];
+        self.add_thread(&mut current, &mut seen, 0, vec![None; slot_count], input, position);
+      }
+      if current.is_empty() && matched.is_some() {
+        break;
+      }
+      let mut next = Vec::new();
+      let mut seen = vec![false; self.program.len()];
+      for thread in current.drain(..) {
+        let step = match &self.program[thread.pc] {
+          Inst::Match => {
+            matched = Some(thread.slots);
+            // Threads after this one are ones the pattern prefers less
+            break;
+          }
+          Inst::Char(c, fold) => input.get(position).is_some_and(|x| x == c || (*fold && lower(*x) == lower(*c))),
+          Inst::Any(dot_all) => input.get(position).is_some_and(|x| *dot_all || *x != '\n'),
+          Inst::Class(class) => input.get(position).is_some_and(|x| class.matches(*x)),
+          _ => false,
+        };
+        if step {
+          self.add_thread(&mut next, &mut seen, thread.pc + 1, thread.slots, input, position + 1);
+        }
+      }
+      if position >= input.len() {
+        break;
+      }
+      current = next;
+      position += 1;
+    }
+    let slots = matched?;
+    Some(slots.chunks(2).map(|pair| pair[0].zip(pair[1])).collect())
+  }
+
+  // Follows jumps, splits, saves and assertions to the instructions that
+  // consume a char, in priority order
+  fn add_thread(&self, threads: &mut Vec<Thread>, seen: &mut [bool], pc: usize, mut slots: Vec<Option<usize>>, input: &[char], position: usize) {
+    if seen[pc] {
+      return;
+    }
+    seen[pc] = true;
+    match &self.program[pc] {
+      Inst::Jump(to) => self.add_thread(threads, seen, *to, slots, input, position),
+      Inst::Split(first, second) => {
+        self.add_thread(threads, seen, *first, slots.clone(), input, position);
+        self.add_thread(threads, seen, *second, slots, input, position);
+      }
+      Inst::Save(slot) => {
+        slots[*slot] = Some(position);
+        self.add_thread(threads, seen, pc + 1, slots, input, position);
+      }
+      Inst::Look(look) => {
+        if holds(*look, input, position) {
+          self.add_thread(threads, seen, pc + 1, slots, input, position);
+        }
+      }
+      _ => threads.push(Thread { pc, slots }),
+    }
+  }
+
+  // Every match, not overlapping, the way Go's FindAll finds them: an empty
+  // match right where the last one ended doesn't count
+  pub fn find_all(&self, input: &[char]) -> Vec<Captures> {
+    let mut matches = Vec::new();
+    let mut position = 0;
+    let mut last_end = None;
+    while position <= input.len() {
+      let Some(captures) = self.find_at(input, position) else {
+        break;
+      };
+      let (start, end) = captures[0].unwrap();
+      let accept = !(end == position && last_end == Some(start));
+      position = if end == position { position + 1 } else { end };
+      last_end = Some(end);
+      if accept {
+        matches.push(captures);
+      }
+    }
+    matches
+  }
+
+  // Replaces every match with the template, where $1 or ${1} stands for a
+  // group's text, $name or ${name} for a named group's, and $$ for a '$'
+  pub fn replace_all(&self, input: &[char], template: &str) -> String {
+    let mut out = String::new();
+    let mut last_end = 0;
+    let mut position = 0;
+    while position <= input.len() {
+      let Some(captures) = self.find_at(input, position) else {
+        break;
+      };
+      let (start, end) = captures[0].unwrap();
+      out.extend(&input[last_end..start]);
+      // An empty match right after the last one isn't replaced
+      if end > last_end || start == 0 {
+        self.expand(&mut out, template, input, &captures);
+      }
+      last_end = end;
+      position = if end == position { position + 1 } else { end };
+    }
+    out.extend(&input[last_end.min(input.len())..]);
+    out
+  }
+
+  fn expand(&self, out: &mut String, template: &str, input: &[char], captures: &Captures) {
+    let mut rest = template;
+    while let Some(dollar) = rest.find('$') {
+      out.push_str(&rest[..dollar]);
+      rest = &rest[dollar + 1..];
+      if let Some(after) = rest.strip_prefix('$') {
+        out.push('$');
+        rest = after;
+        continue;
+      }
+      let (braced, body) = match rest.strip_prefix('{') {
+        Some(body) => (true, body),
+        None => (false, rest),
+      };
+      let length = body.find(|c: char| !is_word(c)).unwrap_or(body.len());
+      let name = &body[..length];
+      if name.is_empty() || (braced && !body[length..].starts_with('}')) {
+        // Not a reference after all, so the '$' is just text
+        out.push('$');
+        continue;
+      }
+      rest = &body[length + braced as usize..];
+      let group = match name.parse::<usize>() {
+        Ok(n) if name.chars().all(|c| c.is_ascii_digit()) => Some(n),
+        _ => self.names.iter().position(|other| other == name),
+      };
+      if let Some((start, end)) = group.and_then(|group| captures.get(group).copied().flatten()) {
+        out.extend(&input[start..end]);
+      }
+    }
+    out.push_str(rest);
+  }
+
+  // The text between matches, as Go's Split(s, -1) gives it
+  pub fn split(&self, input: &[char]) -> Vec<String> {
+    if input.is_empty() {
+      return vec![String::new()];
+    }
+    let mut pieces = Vec::new();
+    let (mut begin, mut end) = (0, 0);
+    for captures in self.find_all(input) {
+      let (start, stop) = captures[0].unwrap();
+      end = start;
+      if stop != 0 {
+        pieces.push(input[begin..end].iter().collect());
+      }
+      begin = stop;
+    }
+    if end != input.len() {
+      pieces.push(input[begin..].iter().collect());
+    }
+    pieces
+  }
+}
+
+fn holds(look: Look, input: &[char], position: usize) -> bool {
+  let before = position.checked_sub(1).and_then(|i| input.get(i)).copied();
+  let after = input.get(position).copied();
+  match look {
+    Look::TextStart => position == 0,
+    Look::TextEnd => position == input.len(),
+    Look::LineStart => before.is_none_or(|c| c == '\n'),
+    Look::LineEnd => after.is_none_or(|c| c == '\n'),
+    Look::WordBoundary => before.is_some_and(is_word) != after.is_some_and(is_word),
+    Look::NotWordBoundary => before.is_some_and(is_word) == after.is_some_and(is_word),
+  }
+}
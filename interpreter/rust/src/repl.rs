@@ -0,0 +1,517 @@
+use crate::ast::*;
+use crate::interpreter::*;
+use crate::interrupt;
+use crate::lexer::*;
+use crate::logging::*;
+use crate::oop::LoxClass;
+use crate::parser::*;
+use crate::pretty::pretty;
+use crate::resolver::*;
+use crate::snapshot;
+use std::cell::RefCell;
+use std::collections::HashSet;
+use std::fs;
+use std::io::{self, IsTerminal, Write};
+use std::panic::{self, AssertUnwindSafe};
+use std::process;
+use std::rc::Rc;
+use std::time::Instant;
+
+const PROMPT: &str = ">> ";
+
+const HELP: &str = "Commands:
+  :help          Show this message
+  :load <file>   Run a file in this session
+  :reload [file] Reload the functions and classes of a file, or of the last
+                 loaded one, keeping the session's data
+  :vars          List the globals defined in this session
+  :save <file>   Save the session's functions, classes and globals, to be
+                 picked up again with `lox run --restore <file>`
+  :ast <expr>    Print the syntax tree of an expression
+  :type <expr>   Evaluate an expression and print its type
+  :time <expr>   Evaluate an expression and print how long it took
+  :quit          Leave the prompt
+
+An expression without a semicolon at the end prints its value.";
+
+// An interactive session. Unlike `run`, every line shares one interpreter and
+// resolver, so definitions carry over from one input to the next.
+pub struct Repl {
+  interpreter: Rc<RefCell<Interpreter>>,
+  resolver: Resolver,
+  // Natives present before the session started, hidden from :vars
+  builtins: HashSet<String>,
+  last_loaded: Option<String>,
+  // The latest declaration of each function, class and trait, for :save
+  declarations: Vec<Stmt>,
+  // Where the next input starts. The resolver keys locals by token offset, so
+  // each input continues from the last one instead of starting again at 0.
+  offset: usize,
+}
+
+impl Repl {
+  pub fn new() -> Self {
+    let interpreter = Rc::new(RefCell::new(Interpreter::new()));
+    let builtins = interpreter.borrow().globals.borrow().values.keys().map(|name| name.to_string()).collect();
+    let resolver = Resolver::new(Box::new(interpreter.clone()));
+    Self { interpreter, resolver, builtins, last_loaded: None, declarations: Vec::new(), offset: 0 }
+  }
+
+  pub fn run(&mut self) {
+    // Escape codes only make sense on a terminal, not in a pipe or file
+    set_color(io::stdout().is_terminal() && io::stderr().is_terminal());
+    catch_panics();
+    // Ctrl-C cancels the input being run; at the prompt it still exits
+    interrupt::install();
+    println!("Starting Lox Prompt! :)");
+    let stdin = io::stdin();
+    let mut input = String::new();
+
+    loop {
+      print!("{}", paint(PROMPT, BLUE));
+      io::stdout().flush().unwrap(); // Ensure the prompt is displayed
+
+      input.clear(); // Clear the input buffer
+      match stdin.read_line(&mut input) {
+        Ok(0) => break,
+        Ok(_) => (),
+        // Errors at the prompt don't end the session, but losing the input does
+        Err(err) => {
+          eprintln!("Error reading input: {}", err);
+          process::exit(74);
+        }
+      }
+
+      let trimmed = input.trim().to_string();
+      if trimmed.is_empty() {
+        continue;
+      }
+      if !self.handle(trimmed) {
+        break;
+      }
+    }
+  }
+
+  // Feeds the lines of a script to the session as if they were typed, and
+  // writes out the prompt and each line before what it prints, so the output
+  // reads like a transcript of someone using the prompt. Blank lines are kept
+  // to separate one part of the transcript from the next.
+  pub fn run_script(&mut self, content: &str) {
+    set_color(false);
+    catch_panics();
+    for line in content.lines() {
+      let trimmed = line.trim().to_string();
+      if trimmed.is_empty() {
+        println!();
+        continue;
+      }
+      println!("{}{}", PROMPT, trimmed);
+      if !self.handle(trimmed) {
+        break;
+      }
+    }
+  }
+
+  // Runs a command or Lox input. Returns false once the session should end.
+  fn handle(&mut self, input: String) -> bool {
+    let result = panic::catch_unwind(AssertUnwindSafe(|| match input.strip_prefix(':') {
+      Some(command) => self.command(command),
+      None => {
+        self.run_input(input.clone());
+        true
+      }
+    }));
+    match result {
+      Ok(running) => running,
+      // Unwinding skipped whatever would have restored the scope
+      Err(_) => {
+        self.interpreter.borrow_mut().reset();
+        self.resolver.scopes.clear();
+        true
+      }
+    }
+  }
+
+  // Returns false once the session should end
+  fn command(&mut self, command: &str) -> bool {
+    let (name, argument) = match command.split_once(char::is_whitespace) {
+      Some((name, argument)) => (name, argument.trim()),
+      None => (command, ""),
+    };
+    match name {
+      "help" => println!("{}", HELP),
+      "quit" | "q" => return false,
+      "load" if argument.is_empty() => eprintln!("Usage: :load <file>"),
+      "load" => self.load(argument.to_string()),
+      "reload" if !argument.is_empty() => self.reload(argument.to_string()),
+      "reload" => match self.last_loaded.clone() {
+        Some(path) => self.reload(path),
+        None => eprintln!("No file has been loaded yet."),
+      },
+      "vars" => self.vars(),
+      "save" if argument.is_empty() => eprintln!("Usage: :save <file>"),
+      "save" => self.save(argument),
+      "ast" | "type" | "time" if argument.is_empty() => eprintln!("Usage: :{} <expr>", name),
+      "ast" => {
+        if let Some(expr) = self.parse_expression(argument) {
+          println!("{:#?}", expr);
+        }
+      }
+      "type" => {
+        if let Some(value) = self.evaluate(argument) {
+          println!("{}", value.type_name());
+        }
+      }
+      "time" => {
+        let start = Instant::now();
+        if let Some(text) = self.evaluate(argument).and_then(|value| self.show(&value)) {
+          println!("{}", text);
+          println!("Took {:.3} ms", start.elapsed().as_secs_f64() * 1000.0);
+        }
+      }
+      _ => eprintln!("Unknown command ':{}'. Type :help for a list.", name),
+    }
+    true
+  }
+
+  pub fn load(&mut self, path: String) {
+    match fs::read_to_string(&path) {
+      Ok(content) => {
+        self.last_loaded = Some(path);
+        self.run_source(content);
+      }
+      Err(err) => {
+        eprintln!("Error reading file: {}", err);
+        eprintln!("Provided path: {}", path);
+      }
+    }
+  }
+
+  // Runs only the file's declarations. Functions, classes and traits replace
+  // the session's versions, and instances of a replaced class pick up its new
+  // methods, while globals that already exist keep their values and other
+  // statements aren't run again.
+  fn reload(&mut self, path: String) {
+    let content = match fs::read_to_string(&path) {
+      Ok(content) => content,
+      Err(err) => {
+        eprintln!("Error reading file: {}", err);
+        eprintln!("Provided path: {}", path);
+        return;
+      }
+    };
+    self.last_loaded = Some(path.clone());
+    let tokens = self.tokens(content);
+    let mut parser = Parser::new(tokens);
+    let stmts = match parser.parse() {
+      Ok(stmts) => stmts,
+      Err(_) => return,
+    };
+    self.resolver.had_error = false;
+    self.resolver.resolve(&stmts);
+    if self.resolver.had_error {
+      return;
+    }
+
+    let mut updated = Vec::new();
+    let mut kept = 0;
+    interrupt::arm();
+    for stmt in &stmts {
+      let exists = |name: &Token| self.interpreter.borrow().globals.borrow().values.contains_key(&name.symbol);
+      let name = match stmt {
+        Stmt::Fun(stmt) => &stmt.name,
+        Stmt::Class(stmt) => &stmt.name,
+        Stmt::Trait(stmt) => &stmt.name,
+        Stmt::Var(var) if exists(&var.name) => {
+          kept += 1;
+          continue;
+        }
+        Stmt::Destructure(stmt) if stmt.pattern.names().iter().all(|target| exists(&target.name)) => {
+          kept += 1;
+          continue;
+        }
+        Stmt::Var(_) | Stmt::Destructure(_) => {
+          self.execute(stmt);
+          continue;
+        }
+        _ => continue,
+      };
+      if !self.execute(stmt) {
+        continue;
+      }
+      self.remember(stmt);
+      if let Stmt::Class(_) = stmt {
+        let globals = self.interpreter.borrow().globals.clone();
+        if let Ok(LoxValue::Class(class)) = globals.borrow().get(name.symbol) {
+          let mut seen = HashSet::new();
+          for value in globals.borrow().values.values() {
+            swap_class(value, &class, &mut seen);
+          }
+        }
+      }
+      updated.push(name.token.clone());
+    }
+    interrupt::disarm();
+    let updated = if updated.is_empty() { "nothing".to_string() } else { updated.join(", ") };
+    let globals = if kept == 1 { "global" } else { "globals" };
+    println!("Reloaded {}: updated {}; kept {} existing {}.", path, updated, kept, globals);
+  }
+
+  // Returns whether the statement ran without an error
+  fn execute(&mut self, stmt: &Stmt) -> bool {
+    let result = self.interpreter.borrow_mut().execute(stmt);
+    match result {
+      Ok(()) => true,
+      Err(err) => {
+        err.print();
+        false
+      }
+    }
+  }
+
+  fn remember(&mut self, stmt: &Stmt) {
+    let declares = |other: &Stmt, name: &str| match other {
+      Stmt::Fun(other) => other.name.token == name,
+      Stmt::Class(other) => other.name.token == name,
+      Stmt::Trait(other) => other.name.token == name,
+      _ => false,
+    };
+    // A global can be declared again at the prompt, and a variable that takes
+    // over a function's name leaves it to :save as a global
+    let rebound = match stmt {
+      Stmt::Var(stmt) => vec![stmt.name.token.clone()],
+      Stmt::Destructure(stmt) => stmt.pattern.names().iter().map(|target| target.name.token.clone()).collect(),
+      _ => Vec::new(),
+    };
+    self.declarations.retain(|other| !rebound.iter().any(|name| declares(other, name)));
+    let name = match stmt {
+      Stmt::Fun(stmt) => &stmt.name.token,
+      Stmt::Class(stmt) => &stmt.name.token,
+      Stmt::Trait(stmt) => &stmt.name.token,
+      _ => return,
+    };
+    let declared = |other: &Stmt| declares(other, name);
+    // Redefinitions keep their place, so superclasses stay ahead of subclasses
+    match self.declarations.iter().position(declared) {
+      Some(index) => self.declarations[index] = stmt.clone(),
+      None => self.declarations.push(stmt.clone()),
+    }
+  }
+
+  fn save(&self, path: &str) {
+    let mut skip = self.builtins.clone();
+    for stmt in &self.declarations {
+      if let Some(name) = stmt.first_token() {
+        skip.insert(name.token.clone());
+      }
+    }
+    let globals = self.interpreter.borrow().globals.clone();
+    let (snapshot, left_out) = snapshot::save(&self.declarations, &globals.borrow(), &skip, self.offset);
+    if let Err(err) = fs::write(path, snapshot) {
+      eprintln!("Error writing file: {}", err);
+      return;
+    }
+    println!("Saved the session to {}.", path);
+    for global in left_out {
+      eprintln!("Not saved: {}", global);
+    }
+  }
+
+  // Picks up a session written by :save
+  pub fn restore(&mut self, content: &str) -> Result<(), String> {
+    let snapshot = snapshot::load(content)?;
+    self.resolver.had_error = false;
+    self.resolver.resolve(&snapshot.declarations);
+    if self.resolver.had_error {
+      return Err("The snapshot's declarations don't resolve.".to_string());
+    }
+    for stmt in &snapshot.declarations {
+      if !self.execute(stmt) {
+        return Err("The snapshot's declarations failed to run.".to_string());
+      }
+      self.remember(stmt);
+    }
+    let globals = self.interpreter.borrow().globals.clone();
+    snapshot.restore_globals(&globals)?;
+    self.offset = self.offset.max(snapshot.offset);
+    Ok(())
+  }
+
+  fn vars(&mut self) {
+    let globals = self.interpreter.borrow().globals.clone();
+    let mut names: Vec<(String, LoxValue)> = globals.borrow().values.iter()
+      .map(|(name, value)| (name.to_string(), value.clone()))
+      .filter(|(name, _)| !self.builtins.contains(name))
+      .collect();
+    names.sort_by(|a, b| a.0.cmp(&b.0));
+    for (name, value) in names {
+      if let Some(text) = self.show(&value) {
+        println!("{} = {}", name, text);
+      }
+    }
+  }
+
+  fn tokens(&mut self, source: String) -> Vec<Token> {
+    let length = source.len();
+    let mut lexer = Lexer::new(source);
+    let mut tokens = lexer.scan_tokens().clone();
+    for token in tokens.iter_mut() {
+      token.offset += self.offset;
+    }
+    // Leave room for the Eof token, which sits one past the end
+    self.offset += length + 1;
+    tokens
+  }
+
+  fn run_source(&mut self, source: String) {
+    let tokens = self.tokens(source);
+    self.run_tokens(tokens, false);
+  }
+
+  // A line typed at the prompt. One that ends in an expression without a
+  // semicolon prints the expression's value, while a semicolon keeps it
+  // quiet, as it would in a script. The semicolon it would need is added, so
+  // this works in dialects where semicolons aren't optional.
+  fn run_input(&mut self, source: String) {
+    let mut tokens = self.tokens(source);
+    let eof = tokens.len() - 1;
+    let echo = eof > 0 && !matches!(tokens[eof - 1].token_type, TokenType::Semicolon | TokenType::RightBrace);
+    if echo {
+      let semicolon = Token::new(TokenType::Semicolon, ";".to_string(), LoxValue::Nil, tokens[eof].line, tokens[eof].offset);
+      tokens.insert(eof, semicolon);
+    }
+    self.run_tokens(tokens, echo);
+  }
+
+  fn run_tokens(&mut self, tokens: Vec<Token>, echo: bool) {
+    let mut parser = Parser::new(tokens);
+    let stmts = match parser.parse() {
+      Ok(stmts) => stmts,
+      Err(_) => return,
+    };
+    self.resolver.had_error = false;
+    self.resolver.resolve(&stmts);
+    if self.resolver.had_error {
+      return;
+    }
+    let echoed = match stmts.last() {
+      Some(Stmt::Expression(stmt)) if echo => Some(stmt.expression.clone()),
+      _ => None,
+    };
+    let run = stmts.len() - usize::from(echoed.is_some());
+    self.interpreter.borrow_mut().interpret(&stmts[..run]);
+    for stmt in &stmts {
+      self.remember(stmt);
+    }
+    if let Some(text) = echoed.and_then(|expr| self.run_expression(&expr)).and_then(|value| self.show(&value)) {
+      println!("{}", text);
+    }
+  }
+
+  fn parse_expression(&mut self, source: &str) -> Option<Expr> {
+    let tokens = self.tokens(source.to_string());
+    let mut parser = Parser::new(tokens);
+    parser.parse_expression().ok()
+  }
+
+  fn evaluate(&mut self, source: &str) -> Option<LoxValue> {
+    let expr = self.parse_expression(source)?;
+    self.resolver.had_error = false;
+    self.resolver.resolve_expression(&expr);
+    if self.resolver.had_error {
+      return None;
+    }
+    self.run_expression(&expr)
+  }
+
+  // Evaluates an expression that's been resolved, reporting its error if it
+  // has one
+  fn run_expression(&mut self, expr: &Expr) -> Option<LoxValue> {
+    interrupt::arm();
+    let result = self.interpreter.borrow_mut().evaluate(expr);
+    interrupt::disarm();
+    match result {
+      Ok(value) => Some(value),
+      Err(err) => {
+        err.print();
+        None
+      }
+    }
+  }
+
+  // A value as the prompt shows it. Showing can run an instance's toString(),
+  // which may fail like any other call.
+  fn show(&mut self, value: &LoxValue) -> Option<String> {
+    interrupt::arm();
+    let result = pretty(value, &mut self.interpreter.borrow_mut());
+    interrupt::disarm();
+    match result {
+      Ok(text) => Some(text),
+      Err(err) => {
+        err.print();
+        None
+      }
+    }
+  }
+}
+
+// A bug in the interpreter shouldn't cost the session, so panics are reported
+// like any other error and the prompt carries on
+fn catch_panics() {
+  panic::set_hook(Box::new(|info| {
+    let message = match info.payload().downcast_ref::<&str>() {
+      Some(message) => message.to_string(),
+      None => info.payload().downcast_ref::<String>().cloned().unwrap_or_default(),
+    };
+    eprintln!("{}", paint(&format!("Internal error: {}", message), RED));
+  }));
+}
+
+// Points instances of the class, and classes inheriting from it, reachable
+// from the value at the class's new definition. Lists and instances are
+// visited once each, since they can contain themselves.
+fn swap_class(value: &LoxValue, class: &LoxClass, seen: &mut HashSet<usize>) {
+  match value {
+    LoxValue::Class(existing) => swap_superclass(existing, class),
+    LoxValue::Instance(instance) => {
+      if !seen.insert(Rc::as_ptr(instance) as *const () as usize) {
+        return;
+      }
+      let properties: Vec<LoxValue> = {
+        let mut instance = instance.borrow_mut();
+        if instance.class.name == class.name {
+          instance.class = class.clone();
+        } else {
+          swap_superclass(&instance.class, class);
+        }
+        instance.properties.values().cloned().collect()
+      };
+      for property in &properties {
+        swap_class(property, class, seen);
+      }
+    }
+    LoxValue::List(list) => {
+      if !seen.insert(Rc::as_ptr(list) as *const () as usize) {
+        return;
+      }
+      let elements = list.borrow().clone();
+      for element in &elements {
+        swap_class(element, class, seen);
+      }
+    }
+    _ => (),
+  }
+}
+
+// Subclasses share their superclass with their instances, so replacing it
+// once updates them all
+fn swap_superclass(existing: &LoxClass, class: &LoxClass) {
+  let mut superclass = existing.superclass.clone();
+  while let Some(current) = superclass {
+    if current.borrow().name == class.name {
+      *current.borrow_mut() = class.clone();
+      return;
+    }
+    superclass = current.borrow().superclass.clone();
+  }
+}
@@ -0,0 +1,233 @@
+/*
+`lox run --record <trace> <script>` and `lox run --replay <trace>`: runs
+that can be reproduced exactly.
+
+Everything a script sees from outside comes through here while a run is
+being recorded or replayed: its source, the time clock() and DateTime.now()
+return, the random bytes behind uuid(), and what it reads from files, which
+includes stdin through open("/dev/stdin"). Sockets aren't recorded, so
+listen() and connect() fail in a recorded or replayed run rather than letting
+the replay quietly take another path.
+Recording notes each value as it is handed out, and replaying hands back the
+recorded ones in the same order instead of asking the system, so the second
+run takes the same path as the first. A replay that asks for something the
+recording doesn't have next has diverged, and says so.
+
+The trace is binary: the bytes "LOXT", a version byte, then one event after
+another, each a tag byte and its payload. Source is tag 'S' with a
+little-endian u64 length and that many UTF-8 bytes, a clock reading is
+tag 'C' with a little-endian f64, and random bytes are tag 'R' with a length
+and the bytes like a source. What a file read returned is tag 'I' with a
+length and the bytes, or tag 'E' with a length and the error message if it
+failed.
+*/
+
+use std::cell::RefCell;
+use std::collections::VecDeque;
+
+const MAGIC: &[u8] = b"LOXT";
+const VERSION: u8 = 2;
+
+#[derive(Debug, PartialEq)]
+enum Event {
+  Source(String),
+  Clock(f64),
+  Random(Vec<u8>),
+  Input(Result<Vec<u8>, String>),
+}
+
+impl Event {
+  fn describe(&self) -> &'static str {
+    match self {
+      Event::Source(_) => "the script's source",
+      Event::Clock(_) => "a clock() reading",
+      Event::Random(_) => "random bytes",
+      Event::Input(_) => "a file read",
+    }
+  }
+}
+
+enum Mode {
+  Live,
+  Recording(Vec<Event>),
+  Replaying(VecDeque<Event>),
+}
+
+thread_local! {
+  static MODE: RefCell<Mode> = RefCell::new(Mode::Live);
+}
+
+pub fn start_recording(source: &str) {
+  MODE.with(|mode| *mode.borrow_mut() = Mode::Recording(vec![Event::Source(source.to_string())]));
+}
+
+// Ends the recording and returns the trace to write out
+pub fn finish_recording() -> Vec<u8> {
+  let events = MODE.with(|mode| match std::mem::replace(&mut *mode.borrow_mut(), Mode::Live) {
+    Mode::Recording(events) => events,
+    _ => Vec::new(),
+  });
+  let mut trace = MAGIC.to_vec();
+  trace.push(VERSION);
+  for event in events {
+    match event {
+      Event::Source(source) => {
+        trace.push(b'S');
+        trace.extend_from_slice(&(source.len() as u64).to_le_bytes());
+        trace.extend_from_slice(source.as_bytes());
+      }
+      Event::Clock(time) => {
+        trace.push(b'C');
+        trace.extend_from_slice(&time.to_le_bytes());
+      }
+      Event::Random(bytes) => {
+        trace.push(b'R');
+        trace.extend_from_slice(&(bytes.len() as u64).to_le_bytes());
+        trace.extend_from_slice(&bytes);
+      }
+      Event::Input(result) => {
+        let (tag, bytes) = match &result {
+          Ok(bytes) => (b'I', bytes.as_slice()),
+          Err(message) => (b'E', message.as_bytes()),
+        };
+        trace.push(tag);
+        trace.extend_from_slice(&(bytes.len() as u64).to_le_bytes());
+        trace.extend_from_slice(bytes);
+      }
+    }
+  }
+  trace
+}
+
+// Starts replaying a trace and returns the source of the script to run
+pub fn start_replay(trace: &[u8]) -> Result<String, String> {
+  let mut events = decode(trace)?;
+  let source = match events.pop_front() {
+    Some(Event::Source(source)) => source,
+    _ => return Err("The trace doesn't start with a script.".to_string()),
+  };
+  MODE.with(|mode| *mode.borrow_mut() = Mode::Replaying(events));
+  Ok(source)
+}
+
+fn decode(trace: &[u8]) -> Result<VecDeque<Event>, String> {
+  let invalid = || "Not a trace written by `lox run --record`.".to_string();
+  let rest = trace.strip_prefix(MAGIC).ok_or_else(invalid)?;
+  let (version, mut rest) = rest.split_first().ok_or_else(invalid)?;
+  if *version != VERSION {
+    return Err(format!("Unsupported trace version {}.", version));
+  }
+  let truncated = || "The trace is cut short.".to_string();
+  let mut events = VecDeque::new();
+  while let Some((tag, payload)) = rest.split_first() {
+    let (bytes, after) = payload.split_at_checked(8).ok_or_else(truncated)?;
+    let bytes: [u8; 8] = bytes.try_into().unwrap();
+    rest = match tag {
+      b'S' => {
+        let length = u64::from_le_bytes(bytes) as usize;
+        let (source, after) = after.split_at_checked(length).ok_or_else(truncated)?;
+        let source = String::from_utf8(source.to_vec()).map_err(|_| "The trace's source isn't UTF-8.".to_string())?;
+        events.push_back(Event::Source(source));
+        after
+      }
+      b'C' => {
+        events.push_back(Event::Clock(f64::from_le_bytes(bytes)));
+        after
+      }
+      b'R' => {
+        let length = u64::from_le_bytes(bytes) as usize;
+        let (random, after) = after.split_at_checked(length).ok_or_else(truncated)?;
+        events.push_back(Event::Random(random.to_vec()));
+        after
+      }
+      b'I' | b'E' => {
+        let length = u64::from_le_bytes(bytes) as usize;
+        let (input, after) = after.split_at_checked(length).ok_or_else(truncated)?;
+        let result = match tag {
+          b'I' => Ok(input.to_vec()),
+          _ => Err(String::from_utf8(input.to_vec()).map_err(|_| "The trace's error message isn't UTF-8.".to_string())?),
+        };
+        events.push_back(Event::Input(result));
+        after
+      }
+      _ => return Err(format!("Unknown event tag {} in the trace.", tag)),
+    };
+  }
+  Ok(events)
+}
+
+// The time for clock(): read live, and noted down while recording, or taken
+// from the trace while replaying
+pub fn clock(now: impl FnOnce() -> f64) -> Result<f64, String> {
+  MODE.with(|mode| match &mut *mode.borrow_mut() {
+    Mode::Live => Ok(now()),
+    Mode::Recording(events) => {
+      let time = now();
+      events.push(Event::Clock(time));
+      Ok(time)
+    }
+    Mode::Replaying(events) => match events.pop_front() {
+      Some(Event::Clock(time)) => Ok(time),
+      Some(other) => Err(format!("Replay diverged: the script read the clock where the recording has {}.", other.describe())),
+      None => Err("Replay diverged: the script read the clock more often than when it was recorded.".to_string()),
+    },
+  })
+}
+
+// `count` random bytes, read by `read` unless they're being replayed
+pub fn random(count: usize, read: impl FnOnce() -> Result<Vec<u8>, String>) -> Result<Vec<u8>, String> {
+  MODE.with(|mode| match &mut *mode.borrow_mut() {
+    Mode::Live => read(),
+    Mode::Recording(events) => {
+      let bytes = read()?;
+      events.push(Event::Random(bytes.clone()));
+      Ok(bytes)
+    }
+    Mode::Replaying(events) => match events.pop_front() {
+      Some(Event::Random(bytes)) if bytes.len() == count => Ok(bytes),
+      Some(Event::Random(bytes)) => Err(format!("Replay diverged: the script asked for {} random bytes where the recording has {}.", count, bytes.len())),
+      Some(other) => Err(format!("Replay diverged: the script asked for random bytes where the recording has {}.", other.describe())),
+      None => Err("Replay diverged: the script asked for random bytes more often than when it was recorded.".to_string()),
+    },
+  })
+}
+
+// What reading a file gave, from `read` unless it's being replayed, in which
+// case the file isn't touched at all. `what` says what the script did, for
+// when the replay has diverged.
+pub fn input(what: &str, read: impl FnOnce() -> Result<Vec<u8>, String>) -> Result<Vec<u8>, String> {
+  MODE.with(|mode| match &mut *mode.borrow_mut() {
+    Mode::Live => read(),
+    Mode::Recording(events) => {
+      let result = read();
+      events.push(Event::Input(result.clone()));
+      result
+    }
+    Mode::Replaying(events) => match events.pop_front() {
+      Some(Event::Input(result)) => result,
+      Some(other) => Err(format!("Replay diverged: the script {} where the recording has {}.", what, other.describe())),
+      None => Err(format!("Replay diverged: the script {} more often than when it was recorded.", what)),
+    },
+  })
+}
+
+// For what can't be recorded: fine in an ordinary run, an error in one
+// that's being recorded or replayed
+pub fn unrecorded(what: &str) -> Result<(), String> {
+  MODE.with(|mode| match &*mode.borrow() {
+    Mode::Live => Ok(()),
+    _ => Err(format!("{} aren't recorded, so they can't be used in a recorded or replayed run.", what)),
+  })
+}
+
+// Events the replayed run never asked for mean it took a different path
+pub fn finish_replay() -> Result<(), String> {
+  let left = MODE.with(|mode| match std::mem::replace(&mut *mode.borrow_mut(), Mode::Live) {
+    Mode::Replaying(events) => events.len(),
+    _ => 0,
+  });
+  match left {
+    0 => Ok(()),
+    left => Err(format!("Replay diverged: the script finished before using the whole recording ({} events left).", left)),
+  }
+}
@@ -1,9 +1,13 @@
 use crate::interpreter::*;
 use crate::ast::*;
 use crate::lexer::*;
+use crate::symbol::{self, Symbol};
+use crate::logging::*;
+use crate::format;
+use crate::dialect::{self, Feature};
 use std::rc::Rc;
 use std::cell::RefCell;
-use std::collections::HashMap;
+use std::collections::{HashMap, HashSet};
 
 #[derive(Debug, Clone, PartialEq, Eq)]
 enum FunctionType {
@@ -22,9 +26,90 @@ enum ClassType {
 
 pub struct Resolver {
   pub interpreter: Box<Rc<RefCell<Interpreter>>>,
-  pub scopes: Vec<HashMap<String, bool>>,
+  pub scopes: Vec<HashMap<Symbol, bool>>,
+  // Names declared with const, per local scope and at the top level
+  constants: Vec<HashSet<String>>,
+  global_constants: HashSet<String>,
+  // Everything the script declares at the top level, which hides a module of
+  // the same name
+  global_names: HashSet<String>,
+  // Local variables and functions declared per scope that nothing has read
+  // yet, warned about when the scope ends
+  unread: Vec<HashMap<String, Token>>,
   current_function: FunctionType,
   current_class: ClassType,
+  // How many loops enclose the current statement within its function
+  loop_depth: usize,
+  // The innermost try or using statement the current one is in, since a
+  // generator can't suspend inside either
+  cleanup_block: Option<&'static str>,
+  // Traits and the methods (name -> arity) each class ends up with, including
+  // inherited ones, so `implements` clauses can be checked statically.
+  traits: HashMap<String, TraitStmt>,
+  class_methods: HashMap<String, HashMap<String, usize>>,
+  // The natives and other builtins there were before the script, which a
+  // declaration hides with a warning
+  builtins: HashMap<String, &'static str>,
+  // Everything declared at the top of any statements given to resolve(), so
+  // a function reading a global declared below it isn't taken for a typo
+  declared: HashSet<String>,
+  pub had_error: bool,
+}
+
+// Which of a script's top-level statements are hoisted: run before the rest,
+// so the functions and classes they declare can be used from anywhere in the
+// script, including above them. A function is hoisted unless its name is
+// declared more than once at the top level, since which declaration a use
+// sees would then depend on where it is. A class is hoisted on the same terms
+// when it has no superclass, or its superclass is a hoisted class declared
+// above it or something the script doesn't declare, like Error. Nothing in
+// a block or function is hoisted: a local function can only be called from
+// below its declaration, so two that call each other have to be declared in
+// an enclosing scope or at the top level.
+pub fn hoisted(statements: &[Stmt]) -> Vec<bool> {
+  let mut declarations: HashMap<&str, usize> = HashMap::new();
+  for statement in statements {
+    for name in declared_names(statement) {
+      *declarations.entry(name.token.as_str()).or_insert(0) += 1;
+    }
+  }
+  let once = |name: &Token| declarations.get(name.token.as_str()) == Some(&1);
+  let mut classes = HashSet::new();
+  statements.iter().map(|statement| match statement {
+    Stmt::Fun(stmt) => once(&stmt.name),
+    Stmt::Class(stmt) if once(&stmt.name) => {
+      let hoistable = match stmt.superclass.as_deref() {
+        Some(Expr::Variable(superclass)) => {
+          classes.contains(&superclass.name.token) || !declarations.contains_key(superclass.name.token.as_str())
+        }
+        _ => true,
+      };
+      if hoistable {
+        classes.insert(stmt.name.token.clone());
+      }
+      hoistable
+    }
+    _ => false,
+  }).collect()
+}
+
+// The names a statement declares in the scope it's in
+fn declared_names(statement: &Stmt) -> Vec<&Token> {
+  match statement {
+    Stmt::Var(stmt) => vec![&stmt.name],
+    Stmt::Destructure(stmt) => stmt.pattern.targets.iter().chain(stmt.pattern.rest.iter()).map(|target| &target.name).collect(),
+    Stmt::Fun(stmt) => vec![&stmt.name],
+    Stmt::Class(stmt) => vec![&stmt.name],
+    Stmt::Trait(stmt) => vec![&stmt.name],
+    _ => Vec::new(),
+  }
+}
+
+// `_` can be declared any number of times, even in one scope, and assigned,
+// but never read, so it's somewhere to put a parameter or destructured value
+// that isn't needed without a warning about it going unread
+fn is_discard(name: &Token) -> bool {
+  name.token == "_" && dialect::enabled(Feature::Discard)
 }
 
 impl Resolver {
@@ -32,15 +117,95 @@ impl Resolver {
     let scopes = Vec::new();
     let current_function = FunctionType::None;
     let current_class = ClassType::None;
-    Self { interpreter, scopes, current_function, current_class }
+    let builtins = interpreter.borrow().globals.borrow().values.iter().filter_map(|(name, value)| match value {
+      LoxValue::Callable(_) => Some((name.to_string(), "function")),
+      LoxValue::Class(_) => Some((name.to_string(), "class")),
+      _ => None,
+    }).collect();
+    Self {
+      interpreter,
+      scopes,
+      constants: Vec::new(),
+      global_constants: HashSet::new(),
+      global_names: HashSet::new(),
+      unread: Vec::new(),
+      current_function,
+      current_class,
+      loop_depth: 0,
+      cleanup_block: None,
+      traits: HashMap::new(),
+      class_methods: HashMap::new(),
+      builtins,
+      declared: HashSet::new(),
+      had_error: false,
+    }
+  }
+
+  fn error(&mut self, token: &Token, message: &str) {
+    error_at_token(token, message);
+    self.had_error = true;
+  }
+
+  fn warning(&mut self, token: &Token, message: &str) {
+    if diagnostic(Severity::Warning, token, message) {
+      self.had_error = true;
+    }
+  }
+
+  // A template written out as a literal is checked against the arguments
+  // format() is given here, rather than failing when the call runs
+  fn check_format(&mut self, expr: &CallExpr) {
+    let Expr::Variable(callee) = &*expr.callee else {
+      return;
+    };
+    let shadowed = self.global_names.contains("format") || self.scopes.iter().any(|scope| scope.contains_key(&symbol::intern("format")));
+    if callee.name.token != "format" || shadowed || expr.arguments.iter().any(|arg| matches!(arg, Expr::Spread(_))) {
+      return;
+    }
+    let Some(Expr::Literal(LiteralExpr { literal: LoxValue::String(template), .. })) = expr.arguments.first() else {
+      return;
+    };
+    // The arguments' values aren't known yet, so numbers stand in for them,
+    // which any placeholder takes
+    let arguments = vec![LoxValue::Integer(0); expr.arguments.len() - 1];
+    if let Err(message) = format::format(template, &arguments, &mut |_| Ok(String::new())) {
+      self.error(&expr.paren, &format!("format: {}", message));
+    }
   }
 
   pub fn resolve(&mut self, statements: &[Stmt]) {
+    for statement in statements {
+      for name in declared_names(statement) {
+        self.declared.insert(name.token.clone());
+      }
+    }
+    if self.scopes.is_empty() {
+      for (statement, hoisted) in statements.iter().zip(hoisted(statements)) {
+        if let (Stmt::Fun(FunStmt { name, .. }) | Stmt::Class(ClassStmt { name, .. }), true) = (statement, hoisted) {
+          self.global_names.insert(name.token.clone());
+        }
+      }
+    }
     for statement in statements {
       self.resolve_stmt(statement);
     }
   }
 
+  // A module's statements, in the scope Interpreter::define_module runs them
+  // in. What they declare is exported, so it isn't unread.
+  pub fn resolve_module(&mut self, statements: &[Stmt]) {
+    self.begin_scope();
+    self.resolve(statements);
+    if let Some(unread) = self.unread.last_mut() {
+      unread.clear();
+    }
+    self.end_scope();
+  }
+
+  pub fn resolve_expression(&mut self, expr: &Expr) {
+    self.resolve_expr(expr);
+  }
+
   fn resolve_stmt(&mut self, statement: &Stmt) {
     match statement {
       Stmt::Block(stmt) => self.visitBlockStmt(stmt),
@@ -48,11 +213,20 @@ impl Resolver {
       Stmt::Print(expr) => self.visitPrintStmt(expr),
       Stmt::Return(expr) => self.visitReturnStmt(expr),
       Stmt::Var(expr) => self.visitVarStmt(expr),
+      Stmt::Destructure(expr) => self.visitDestructureStmt(expr),
       Stmt::Fun(expr) => self.visitFunStmt(expr),
       Stmt::If(expr) => self.visitIfStmt(expr),
       Stmt::While(expr) => self.visitWhileStmt(expr),
       Stmt::For(expr) => self.visitForStmt(expr),
       Stmt::Class(expr) => self.visitClassStmt(expr),
+      Stmt::Trait(expr) => self.visitTraitStmt(expr),
+      Stmt::Yield(expr) => self.visitYieldStmt(expr),
+      Stmt::ForIn(expr) => self.visitForInStmt(expr),
+      Stmt::DoWhile(expr) => self.visitDoWhileStmt(expr),
+      Stmt::Break(expr) => self.visitBreakStmt(expr),
+      Stmt::Try(expr) => self.visitTryStmt(expr),
+      Stmt::Throw(expr) => self.visitThrowStmt(expr),
+      Stmt::Using(expr) => self.visitUsingStmt(expr),
     }
   }
 
@@ -62,6 +236,11 @@ impl Resolver {
       Expr::Binary(expr) => self.visitBinaryExpr(expr),
       Expr::Call(expr) => self.visitCallExpr(expr),
       Expr::Get(expr) => self.visitGetExpr(expr),
+      Expr::OptionalGet(expr) => self.visitOptionalGetExpr(expr),
+      Expr::OptionalIndex(expr) => self.visitOptionalIndexExpr(expr),
+      Expr::OptionalChain(expr) => self.visitOptionalChainExpr(expr),
+      Expr::Match(expr) => self.visitMatchExpr(expr),
+      Expr::Comparison(expr) => self.visitComparisonExpr(expr),
       Expr::Set(expr) => self.visitSetExpr(expr),
       Expr::Grouping(expr) => self.visitGroupingExpr(expr),
       Expr::Literal(expr) => self.visitLiteralExpr(expr),
@@ -70,38 +249,161 @@ impl Resolver {
       Expr::Logical(expr) => self.visitLogicalExpression(expr),
       Expr::Super(expr) => self.visitSuperExpression(expr),
       Expr::This(expr) => self.visitThisExpression(expr),
+      Expr::List(expr) => self.visitListExpr(expr),
+      Expr::SetLiteral(expr) => self.visitSetLiteralExpr(expr),
+      Expr::MapLiteral(expr) => self.visitMapLiteralExpr(expr),
+      Expr::Index(expr) => self.visitIndexExpr(expr),
+      Expr::IndexSet(expr) => self.visitIndexSetExpr(expr),
+      Expr::Spread(expr) => self.visitSpreadExpr(expr),
+      Expr::DestructureAssign(expr) => self.visitDestructureAssignExpr(expr),
+      Expr::Interpolation(expr) => self.visitInterpolationExpr(expr),
     }
   }
 
   fn begin_scope(&mut self) {
     self.scopes.push(HashMap::new());
+    self.constants.push(HashSet::new());
+    self.unread.push(HashMap::new());
   }
 
   fn end_scope(&mut self) {
     self.scopes.pop();
+    self.constants.pop();
+    let mut unread: Vec<Token> = self.unread.pop().unwrap_or_default().into_values().collect();
+    unread.sort_by_key(|name| name.offset);
+    for name in unread {
+      self.warning(&name, &format!("'{}' is declared but never read.", name.token));
+    }
   }
 
-  fn declare(&mut self, name: &Token) {
-    if let Some(scope) = self.scopes.last_mut() {
-      if (scope.contains_key(&name.token)) {
-        print!("Error: Variable {} already declared in this scope.", name.token);
-        panic!();
+  // Globals are left alone: later scripts and REPL input can still read them.
+  // Names starting with an underscore are unused on purpose.
+  fn track_unread(&mut self, name: &Token) {
+    if let Some(unread) = self.unread.last_mut() {
+      if !name.token.starts_with('_') {
+        unread.insert(name.token.clone(), name.clone());
       }
-      scope.insert(name.token.clone(), false);
+    }
+  }
+
+  fn mark_read(&mut self, name: &Token) {
+    for (i, scope) in self.scopes.iter().enumerate().rev() {
+      if scope.contains_key(&name.symbol) {
+        self.unread[i].remove(&name.token);
+        return;
+      }
+    }
+  }
+
+  fn mark_constant(&mut self, name: &Token, constant: bool) {
+    let set = match self.constants.last_mut() {
+      Some(set) => set,
+      None => &mut self.global_constants,
+    };
+    if constant {
+      set.insert(name.token.clone());
+    } else {
+      set.remove(&name.token);
+    }
+  }
+
+  fn is_constant(&self, name: &Token) -> bool {
+    for (i, scope) in self.scopes.iter().enumerate().rev() {
+      if scope.contains_key(&name.symbol) {
+        return self.constants[i].contains(&name.token);
+      }
+    }
+    self.global_constants.contains(&name.token)
+  }
+
+  // A global declaration that hides a builtin, like `var clock = 0;`, makes
+  // the builtin unreachable for the rest of the program. Locals and
+  // parameters only hide it in their own scope, and the natives take plenty
+  // of ordinary names (add, get, keys, next), so those aren't pointed out.
+  fn check_shadowing(&mut self, name: &Token) {
+    if !self.scopes.is_empty() {
       return;
     }
+    if let Some(kind) = self.builtins.get(&name.token) {
+      let message = format!("'{}' shadows the builtin {} of the same name.", name.token, kind);
+      self.warning(name, &message);
+    }
+  }
+
+  // A global that's declared nowhere, in this script or before it, is most
+  // likely a typo, and is pointed out when it's close to a name that is
+  fn check_undeclared(&mut self, name: &Token) {
+    let is_local = self.scopes.iter().any(|scope| scope.contains_key(&name.symbol));
+    let globals = self.interpreter.borrow().globals.clone();
+    if is_local || self.declared.contains(&name.token) || self.global_names.contains(&name.token) || globals.borrow().values.contains_key(&name.symbol) {
+      return;
+    }
+    let mut candidates: Vec<String> = self.scopes.iter().flat_map(|scope| scope.keys().map(|name| name.to_string())).collect();
+    candidates.extend(self.declared.iter().cloned());
+    candidates.extend(globals.borrow().values.keys().map(|name| name.to_string()));
+    candidates.extend(["true", "false", "nil", "this"].map(String::from));
+    if let Some(suggestion) = closest(&name.token, &candidates) {
+      self.warning(name, &format!("'{}' isn't declared anywhere. Did you mean '{}'?", name.token, suggestion));
+    }
+  }
+
+  // False if the name is already taken in this scope, which is reported
+  // here; the caller then leaves the name to its first declaration
+  fn declare(&mut self, name: &Token) -> bool {
+    self.check_shadowing(name);
+    if let Some(scope) = self.scopes.last_mut() {
+      if scope.contains_key(&name.symbol) && !is_discard(name) {
+        self.error(name, &format!("Variable {} already declared in this scope.", name.token));
+        return false;
+      }
+      scope.insert(name.symbol, false);
+      return true;
+    }
+    // Globals can be declared again, in a script as at the prompt, where
+    // redefining something is the usual way to fix it
+    self.global_names.insert(name.token.clone());
+    true
   }
 
   fn define(&mut self, name: &Token) {
     if let Some(scope) = self.scopes.last_mut() {
-      scope.insert(name.token.clone(), true);
+      scope.insert(name.symbol, true);
+      return;
+    }
+  }
+
+  // `module.symbol` has to name something the module exports, unless the
+  // script has its own variable by the module's name. A module's names that
+  // start with an underscore are its own.
+  fn check_member(&mut self, object: &Expr, member: &Token) {
+    let Expr::Variable(variable) = object else {
+      return;
+    };
+    let module = &variable.name.token;
+    if self.global_names.contains(module) || self.scopes.iter().any(|scope| scope.contains_key(&symbol::intern(module))) {
+      return;
+    }
+    let exports = match self.interpreter.borrow().namespaces.get(module) {
+      Some(exports) => exports.clone(),
+      None => return,
+    };
+    if exports.contains(&member.token) {
+      return;
+    }
+    if member.token.starts_with('_') {
+      self.error(member, &format!("'{}' is private to module '{}'.", member.token, module));
       return;
     }
+    let message = match closest(&member.token, &exports) {
+      Some(suggestion) => format!("Module '{}' has no '{}'. Did you mean '{}'?", module, member.token, suggestion),
+      None => format!("Module '{}' has no '{}'.", module, member.token),
+    };
+    self.error(member, &message);
   }
 
   fn resolve_local(&mut self, expr: Expr, name: &Token) {
     for (i, scope) in self.scopes.iter().enumerate().rev() {
-      if scope.contains_key(&name.token) {
+      if scope.contains_key(&name.symbol) {
         self.interpreter.borrow_mut().resolve(expr, self.scopes.len() - 1 - i);
         return;
       }
@@ -110,17 +412,69 @@ impl Resolver {
 
   fn resolve_function(&mut self, function: &FunStmt, function_type: FunctionType) {
     let enclosing_function = self.current_function.clone();
+    let enclosing_loop_depth = std::mem::replace(&mut self.loop_depth, 0);
+    let enclosing_cleanup_block = self.cleanup_block.take();
     self.current_function = function_type;
     self.begin_scope();
-    for param in &function.params {
+    for (param, default) in function.params.iter().zip(&function.defaults) {
+      // Defaults see the closure and the parameters before them
+      if let Some(default) = default {
+        self.resolve_expr(default);
+      }
       self.declare(&param);
       self.define(&param);
     }
+    if let Some(rest) = &function.rest {
+      self.declare(rest);
+      self.define(rest);
+    }
     self.resolve_stmt(&Stmt::Block(BlockStmt {
       statements: function.body.statements.iter().cloned().collect(),
     }));
     self.end_scope();
     self.current_function = enclosing_function;
+    self.loop_depth = enclosing_loop_depth;
+    self.cleanup_block = enclosing_cleanup_block;
+  }
+
+  fn resolve_loop_body(&mut self, body: &Stmt) {
+    self.loop_depth += 1;
+    self.resolve_stmt(body);
+    self.loop_depth -= 1;
+  }
+
+  fn check_traits(&mut self, stmt: &ClassStmt) {
+    let mut methods = HashMap::new();
+    if let Some(Expr::Variable(superclass)) = &stmt.superclass.as_deref() {
+      if let Some(inherited) = self.class_methods.get(&superclass.name.token) {
+        methods = inherited.clone();
+      }
+    }
+    for method in &stmt.methods {
+      methods.insert(method.name.token.clone(), method.params.len());
+    }
+
+    for trait_name in &stmt.traits {
+      let required = match self.traits.get(&trait_name.token) {
+        Some(trait_stmt) => trait_stmt.methods.clone(),
+        None => {
+          self.error(trait_name, &format!("Undefined trait '{}'.", trait_name.token));
+          continue;
+        }
+      };
+      for signature in &required {
+        match methods.get(&signature.name.token) {
+          None => self.error(&stmt.name, &format!(
+            "Class '{}' is missing method '{}' required by trait '{}'.",
+            stmt.name.token, signature.name.token, trait_name.token)),
+          Some(arity) if *arity != signature.params.len() => self.error(&stmt.name, &format!(
+            "Method '{}' of class '{}' takes {} parameters but trait '{}' requires {}.",
+            signature.name.token, stmt.name.token, arity, trait_name.token, signature.params.len())),
+          _ => (),
+        }
+      }
+    }
+    self.class_methods.insert(stmt.name.token.clone(), methods);
   }
 }
 
@@ -146,10 +500,59 @@ impl ExprVisitor<()> for Resolver {
     for arg in &expr.arguments {
       self.resolve_expr(arg);
     }
+    for (_, arg) in &expr.named_arguments {
+      self.resolve_expr(arg);
+    }
+    self.check_format(expr);
   }
 
   fn visitGetExpr(&mut self, expr: &GetExpr)  {
     self.resolve_expr(&expr.object);
+    self.check_member(&expr.object, &expr.name);
+  }
+
+  fn visitOptionalGetExpr(&mut self, expr: &OptionalGetExpr)  {
+    self.resolve_expr(&expr.object);
+    self.check_member(&expr.object, &expr.name);
+  }
+
+  fn visitOptionalIndexExpr(&mut self, expr: &OptionalIndexExpr) {
+    self.resolve_expr(&expr.object);
+    self.resolve_expr(&expr.index);
+  }
+
+  fn visitOptionalChainExpr(&mut self, expr: &OptionalChainExpr)  {
+    self.resolve_expr(&expr.expression);
+  }
+
+  fn visitComparisonExpr(&mut self, expr: &ComparisonExpr) {
+    self.resolve_expr(&expr.left);
+    for (_, right) in &expr.comparisons {
+      self.resolve_expr(right);
+    }
+  }
+
+  fn visitMatchExpr(&mut self, expr: &MatchExpr)  {
+    self.resolve_expr(&expr.subject);
+    for arm in &expr.arms {
+      for class in arm.pattern.classes() {
+        self.visitVariableExpression(class);
+      }
+      self.begin_scope();
+      for binding in arm.pattern.bindings() {
+        if self.scopes.last().unwrap().contains_key(&binding.name.symbol) {
+          self.error(&binding.name, &format!("Duplicate binding '{}' in match pattern.", binding.name.token));
+          continue;
+        }
+        self.declare(&binding.name);
+        self.define(&binding.name);
+      }
+      if let Some(guard) = &arm.guard {
+        self.resolve_expr(guard);
+      }
+      self.resolve_expr(&arm.body);
+      self.end_scope();
+    }
   }
 
   fn visitSetExpr(&mut self, expr: &SetExpr)  {
@@ -158,20 +561,30 @@ impl ExprVisitor<()> for Resolver {
   }
 
   fn visitVariableExpression(&mut self, expr: &VariableExpr)  {
+    if is_discard(&expr.name) {
+      self.error(&expr.name, "'_' can't be read: it's only somewhere to put a value that isn't needed.");
+      return;
+    }
     if let Some(scope) = self.scopes.last() {
-      if let Some(defined) = scope.get(&expr.name.token) {
+      if let Some(defined) = scope.get(&expr.name.symbol) {
         if !defined {
           // Error: variable used before declaration
-          eprintln!("Can't read local variable {} in its own initializer.", expr.name.token);
+          write_error(&format!("Can't read local variable {} in its own initializer.", expr.name.token));
         }
       }
     }
+    self.check_undeclared(&expr.name);
     let expr_as_expr = Expr::Variable(expr.clone());
     self.resolve_local(expr_as_expr, &expr.name);
+    self.mark_read(&expr.name);
   }
 
   fn visitAssignExpression(&mut self, expr: &AssignExpr)  {
+    if self.is_constant(&expr.name) {
+      self.error(&expr.name, &format!("Cannot assign to constant '{}'.", expr.name.token));
+    }
     self.resolve_expr(&expr.value);
+    self.check_undeclared(&expr.name);
     self.resolve_local(Expr::Assign(expr.clone()), &expr.name);
   }
 
@@ -182,10 +595,10 @@ impl ExprVisitor<()> for Resolver {
 
   fn visitSuperExpression(&mut self, expr: &SuperExpr) -> () {
       if self.current_class == ClassType::None {
-        eprint!("Error: Can't use 'super' outside of a class.");
+        write_error("Error: Can't use 'super' outside of a class.");
         panic!();
       } else if self.current_class != ClassType::SubClass {
-        eprint!("Error: 'super' can only be used in a subclass.");
+        write_error("Error: 'super' can only be used in a subclass.");
         panic!();
       }
       self.resolve_local(Expr::Super(expr.clone()), &expr.keyword);
@@ -193,11 +606,61 @@ impl ExprVisitor<()> for Resolver {
 
   fn visitThisExpression(&mut self, expr: &ThisExpr) -> () {
     if self.current_class == ClassType::None {
-      eprintln!("Error: Can't use 'this' outside of a class.");
+      write_error("Error: Can't use 'this' outside of a class.");
       panic!();
     }
     self.resolve_local(Expr::This(expr.clone()), &expr.keyword);
   }
+
+  fn visitListExpr(&mut self, expr: &ListExpr) {
+    for element in &expr.elements {
+      self.resolve_expr(element);
+    }
+  }
+
+  fn visitSetLiteralExpr(&mut self, expr: &SetLiteralExpr) {
+    for element in &expr.elements {
+      self.resolve_expr(element);
+    }
+  }
+
+  fn visitMapLiteralExpr(&mut self, expr: &MapLiteralExpr) {
+    for (key, value) in &expr.entries {
+      self.resolve_expr(key);
+      self.resolve_expr(value);
+    }
+  }
+
+  fn visitIndexExpr(&mut self, expr: &IndexExpr) {
+    self.resolve_expr(&expr.object);
+    self.resolve_expr(&expr.index);
+  }
+
+  fn visitIndexSetExpr(&mut self, expr: &IndexSetExpr) {
+    self.resolve_expr(&expr.value);
+    self.resolve_expr(&expr.object);
+    self.resolve_expr(&expr.index);
+  }
+
+  fn visitSpreadExpr(&mut self, expr: &SpreadExpr) {
+    self.resolve_expr(&expr.expression);
+  }
+
+  fn visitInterpolationExpr(&mut self, expr: &InterpolationExpr) {
+    for part in &expr.parts {
+      self.resolve_expr(part);
+    }
+  }
+
+  fn visitDestructureAssignExpr(&mut self, expr: &DestructureAssignExpr) {
+    self.resolve_expr(&expr.value);
+    for target in expr.pattern.names() {
+      if self.is_constant(&target.name) {
+        self.error(&target.name, &format!("Cannot assign to constant '{}'.", target.name.token));
+      }
+      self.resolve_local(Expr::Variable(target.clone()), &target.name);
+    }
+  }
 }
 
 impl StmtVisitor<()> for Resolver {
@@ -210,9 +673,82 @@ impl StmtVisitor<()> for Resolver {
   fn visitForStmt(&mut self, stmt: &ForStmt) {
   }
 
+  fn visitYieldStmt(&mut self, stmt: &YieldStmt) {
+    if self.current_function == FunctionType::None {
+      self.error(&stmt.keyword, "Can't yield outside a function.");
+    } else if self.current_function == FunctionType::Initializer {
+      self.error(&stmt.keyword, "Can't yield from an initializer.");
+    } else if let Some(block) = self.cleanup_block {
+      self.error(&stmt.keyword, &format!("Can't yield inside a {} block.", block));
+    }
+    if let Some(value) = &stmt.value {
+      self.resolve_expr(value);
+    }
+  }
+
+  fn visitForInStmt(&mut self, stmt: &ForInStmt) {
+    self.resolve_expr(&stmt.iterable);
+    self.begin_scope();
+    self.declare(&stmt.name);
+    self.define(&stmt.name);
+    self.resolve_loop_body(&stmt.body);
+    self.end_scope();
+    if let Some(else_branch) = &stmt.else_branch {
+      self.resolve_stmt(else_branch);
+    }
+  }
+
+  fn visitDoWhileStmt(&mut self, stmt: &WhileStmt) {
+    self.resolve_loop_body(&stmt.body);
+    self.resolve_expr(&stmt.condition);
+  }
+
+  fn visitTryStmt(&mut self, stmt: &TryStmt) {
+    let enclosing_cleanup_block = self.cleanup_block.replace("try");
+    self.visitBlockStmt(&stmt.body);
+    for clause in &stmt.catches {
+      if let Some(class) = &clause.class {
+        self.resolve_expr(class);
+      }
+      self.begin_scope();
+      self.declare(&clause.name);
+      self.define(&clause.name);
+      self.visitBlockStmt(&clause.body);
+      self.end_scope();
+    }
+    if let Some(finally) = &stmt.finally {
+      self.visitBlockStmt(finally);
+    }
+    self.cleanup_block = enclosing_cleanup_block;
+  }
+
+  fn visitThrowStmt(&mut self, stmt: &ThrowStmt) {
+    self.resolve_expr(&stmt.value);
+  }
+
+  fn visitUsingStmt(&mut self, stmt: &UsingStmt) {
+    self.resolve_expr(&stmt.initializer);
+    let enclosing_cleanup_block = self.cleanup_block.replace("using");
+    self.begin_scope();
+    self.declare(&stmt.name);
+    self.define(&stmt.name);
+    self.visitBlockStmt(&stmt.body);
+    self.end_scope();
+    self.cleanup_block = enclosing_cleanup_block;
+  }
+
+  fn visitBreakStmt(&mut self, stmt: &BreakStmt) {
+    if self.loop_depth == 0 {
+      self.error(&stmt.keyword, "Can't break outside a loop.");
+    }
+  }
+
   fn visitWhileStmt(&mut self, stmt: &WhileStmt) {
     self.resolve_expr(&stmt.condition);
-    self.resolve_stmt(&stmt.body);
+    self.resolve_loop_body(&stmt.body);
+    if let Some(else_branch) = &stmt.else_branch {
+      self.resolve_stmt(else_branch);
+    }
   }
 
   fn visitIfStmt(&mut self, stmt: &IfStmt) {
@@ -228,17 +764,19 @@ impl StmtVisitor<()> for Resolver {
   }
 
   fn visitPrintStmt(&mut self, stmt: &PrintStmt) {
-    self.resolve_expr(&stmt.expression);
+    for expression in &stmt.expressions {
+      self.resolve_expr(expression);
+    }
   }
 
   fn visitReturnStmt(&mut self, stmt: &RetStmt) {
     if self.current_function == FunctionType::None {
-      eprintln!("Error: Can't return from top-level code.");
+      write_error("Error: Can't return from top-level code.");
       panic!();
     }
     if let Some(value) = &stmt.value {
       if self.current_function == FunctionType::Initializer {
-        eprintln!("Error: Can't return a value from an initializer.");
+        write_error("Error: Can't return a value from an initializer.");
         panic!();
       }
       self.resolve_expr(value);
@@ -246,28 +784,52 @@ impl StmtVisitor<()> for Resolver {
   }
 
   fn visitVarStmt(&mut self, stmt: &VarStmt) {
-    self.declare(&stmt.name);
+    let declared = self.declare(&stmt.name);
     if let Some(initializer) = &stmt.initializer {
       self.resolve_expr(initializer);
     }
     self.define(&stmt.name);
+    self.mark_constant(&stmt.name, stmt.constant);
+    if declared {
+      self.track_unread(&stmt.name);
+    }
+  }
+
+  fn visitDestructureStmt(&mut self, stmt: &DestructureStmt) {
+    for target in stmt.pattern.names() {
+      self.declare(&target.name);
+    }
+    self.resolve_expr(&stmt.initializer);
+    for target in stmt.pattern.names() {
+      self.define(&target.name);
+      self.mark_constant(&target.name, stmt.constant);
+    }
   }
 
   fn visitFunStmt(&mut self, stmt: &FunStmt) {
-    self.declare(&stmt.name);
+    if self.declare(&stmt.name) {
+      self.track_unread(&stmt.name);
+    }
     self.define(&stmt.name);
+    self.mark_constant(&stmt.name, false);
     self.resolve_function(stmt, FunctionType::Function);
   }
 
+  fn visitTraitStmt(&mut self, stmt: &TraitStmt) {
+    self.traits.insert(stmt.name.token.clone(), stmt.clone());
+  }
+
   fn visitClassStmt(&mut self, stmt: &ClassStmt) -> () {
+    self.check_traits(stmt);
     let enclosing_class = self.current_class.clone();
     self.current_class = ClassType::Class;
     self.declare(&stmt.name);
     self.define(&stmt.name);
+    self.mark_constant(&stmt.name, false);
 
     if let Some(Expr::Variable(superclass)) = &stmt.superclass.as_deref() {
       if stmt.name.token == superclass.name.token {
-        eprintln!("Error: Class can't inherit from itself.");
+        write_error("Error: Class can't inherit from itself.");
         panic!();
       }
       self.current_class = ClassType::SubClass;
@@ -275,13 +837,13 @@ impl StmtVisitor<()> for Resolver {
     }
     if stmt.superclass.is_some() {
       self.begin_scope();
-      self.scopes.last_mut().unwrap().insert("super".to_string(), true);
+      self.scopes.last_mut().unwrap().insert(symbol::SUPER, true);
     }
     self.begin_scope();
-    self.scopes.last_mut().unwrap().insert("this".to_string(), true);
+    self.scopes.last_mut().unwrap().insert(symbol::THIS, true);
     for method in &stmt.methods {
       let mut function_type = FunctionType::Method;
-      if (method.name.token == "init") {
+      if method.name.token == "init" {
         function_type = FunctionType::Initializer;
       }
       self.resolve_function(method, function_type);
@@ -293,3 +855,27 @@ impl StmtVisitor<()> for Resolver {
     self.current_class = enclosing_class;
   }
 }
+
+// The candidate within two edits of the name, if there is one. Runtime errors
+// for undefined names and properties use it too.
+pub fn closest<'a>(name: &str, candidates: &'a [String]) -> Option<&'a String> {
+  let distance = |a: &str, b: &str| {
+    let b: Vec<char> = b.chars().collect();
+    let mut row: Vec<usize> = (0..=b.len()).collect();
+    for (i, ca) in a.chars().enumerate() {
+      let mut previous = row[0];
+      row[0] = i + 1;
+      for (j, cb) in b.iter().enumerate() {
+        let substitution = previous + usize::from(ca != *cb);
+        previous = row[j + 1];
+        row[j + 1] = substitution.min(row[j] + 1).min(previous + 1);
+      }
+    }
+    row[b.len()]
+  };
+  // A one-letter name is within an edit of every other, which isn't a near miss
+  let limit = 2.min(name.chars().count().saturating_sub(1));
+  // Ties go to the first alphabetically, so the same mistake gets the same
+  // suggestion whatever order the candidates come in
+  candidates.iter().map(|candidate| (distance(name, candidate), candidate)).filter(|(d, _)| *d <= limit).min().map(|(_, c)| c)
+}
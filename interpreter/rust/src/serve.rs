@@ -0,0 +1,194 @@
+/*
+`lox serve`: a small playground for demos and teaching.
+
+GET / returns an editor page, and POST /run runs the request body as a Lox
+script and answers with {"output": "...", "errors": [...]}. Every run gets a
+fresh interpreter on its own thread with time and output limits, so one
+visitor's infinite loop or panic can't take the server down.
+*/
+
+use crate::interpreter::*;
+use crate::lexer::*;
+use crate::logging::*;
+use crate::parser::*;
+use crate::resolver::*;
+use std::cell::RefCell;
+use std::io::{self, BufRead, BufReader, Read, Write};
+use std::net::{TcpListener, TcpStream};
+use std::panic::{self, AssertUnwindSafe};
+use std::rc::Rc;
+use std::thread;
+use std::time::{Duration, Instant};
+
+const TIME_LIMIT: Duration = Duration::from_secs(2);
+const OUTPUT_LIMIT: usize = 64 * 1024;
+const SOURCE_LIMIT: usize = 64 * 1024;
+
+const PAGE: &str = r#"<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Lox Playground</title>
+<style>
+  body { font-family: sans-serif; margin: 2em; }
+  textarea, pre { font-family: monospace; font-size: 14px; width: 100%; box-sizing: border-box; }
+  textarea { height: 20em; }
+  pre { background: #f4f4f4; padding: 1em; min-height: 4em; }
+  .errors { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Lox Playground</h1>
+<textarea id="source">print "Hello, world!";</textarea>
+<p><button id="run">Run</button> <small>Ctrl+Enter also runs</small></p>
+<pre id="output"></pre>
+<pre id="errors" class="errors"></pre>
+<script>
+  const source = document.getElementById("source");
+  async function run() {
+    const response = await fetch("/run", { method: "POST", body: source.value });
+    const result = await response.json();
+    document.getElementById("output").textContent = result.output;
+    document.getElementById("errors").textContent = result.warnings.concat(result.errors).join("\n");
+  }
+  document.getElementById("run").addEventListener("click", run);
+  source.addEventListener("keydown", (e) => {
+    if (e.key === "Enter" && e.ctrlKey) run();
+  });
+</script>
+</body>
+</html>
+"#;
+
+pub fn serve(port: u16) {
+  let listener = match TcpListener::bind(("127.0.0.1", port)) {
+    Ok(listener) => listener,
+    Err(err) => {
+      eprintln!("Could not listen on port {}: {}", port, err);
+      std::process::exit(74);
+    }
+  };
+  println!("Lox playground running at http://127.0.0.1:{}/", port);
+  // The panic hook would otherwise print a backtrace notice for every
+  // misbehaving script; the panic is reported back to the page instead
+  panic::set_hook(Box::new(|_| {}));
+  for stream in listener.incoming() {
+    let result = stream.and_then(handle);
+    if let Err(err) = result {
+      eprintln!("Request failed: {}", err);
+    }
+  }
+}
+
+fn handle(mut stream: TcpStream) -> io::Result<()> {
+  let mut reader = BufReader::new(stream.try_clone()?);
+  let mut request_line = String::new();
+  reader.read_line(&mut request_line)?;
+  let mut parts = request_line.split_whitespace();
+  let (method, path) = (parts.next().unwrap_or(""), parts.next().unwrap_or(""));
+
+  let mut content_length = 0;
+  loop {
+    let mut header = String::new();
+    if reader.read_line(&mut header)? == 0 || header.trim().is_empty() {
+      break;
+    }
+    if let Some((name, value)) = header.split_once(':') {
+      if name.trim().eq_ignore_ascii_case("content-length") {
+        content_length = value.trim().parse().unwrap_or(0);
+      }
+    }
+  }
+
+  match (method, path) {
+    ("GET", "/") => respond(&mut stream, "200 OK", "text/html; charset=utf-8", PAGE),
+    ("POST", "/run") if content_length > SOURCE_LIMIT => {
+      respond(&mut stream, "413 Payload Too Large", "text/plain", "Script is too large.")
+    }
+    ("POST", "/run") => {
+      let mut body = vec![0; content_length];
+      reader.read_exact(&mut body)?;
+      let captured = run_sandboxed(String::from_utf8_lossy(&body).into_owned());
+      respond(&mut stream, "200 OK", "application/json", &to_json(&captured))
+    }
+    _ => respond(&mut stream, "404 Not Found", "text/plain", "Not found."),
+  }
+}
+
+fn respond(stream: &mut TcpStream, status: &str, content_type: &str, body: &str) -> io::Result<()> {
+  write!(
+    stream,
+    "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+    status,
+    content_type,
+    body.len(),
+    body
+  )?;
+  stream.flush()
+}
+
+// Runs on a thread of its own so deep recursion gets a full stack and a panic
+// only ends this run
+pub fn run_sandboxed(source: String) -> Captured {
+  let worker = thread::Builder::new().stack_size(crate::STACK_SIZE).spawn(move || {
+    start_capture();
+    let result = panic::catch_unwind(AssertUnwindSafe(|| run_limited(source)));
+    let mut captured = finish_capture();
+    if let Err(payload) = result {
+      let message = match payload.downcast_ref::<&str>() {
+        Some(message) => message.to_string(),
+        None => payload.downcast_ref::<String>().cloned().unwrap_or_default(),
+      };
+      captured.errors.push(format!("Internal error: {}", message));
+    }
+    captured
+  });
+  match worker.map(|worker| worker.join()) {
+    Ok(Ok(captured)) => captured,
+    _ => Captured { output: String::new(), errors: vec!["Could not start the script.".to_string()], warnings: Vec::new() },
+  }
+}
+
+fn run_limited(source: String) {
+  let mut lexer = Lexer::new(source);
+  let tokens = lexer.scan_tokens();
+  let mut parser = Parser::new(tokens.clone());
+  let stmts = match parser.parse() {
+    Ok(stmts) => stmts,
+    Err(_) => return,
+  };
+  let interpreter = Rc::new(RefCell::new(Interpreter::new()));
+  let mut resolver = Resolver::new(Box::new(interpreter.clone()));
+  resolver.resolve(&stmts);
+  if resolver.had_error {
+    return;
+  }
+  interpreter.borrow_mut().limits = Some(Limits { deadline: Instant::now() + TIME_LIMIT, output_left: OUTPUT_LIMIT });
+  interpreter.borrow_mut().interpret(&stmts);
+}
+
+pub fn to_json(captured: &Captured) -> String {
+  let errors: Vec<String> = captured.errors.iter().map(|e| json_string(e)).collect();
+  let warnings: Vec<String> = captured.warnings.iter().map(|w| json_string(w)).collect();
+  format!(
+    "{{\"output\": {}, \"errors\": [{}], \"warnings\": [{}]}}",
+    json_string(&captured.output), errors.join(", "), warnings.join(", ")
+  )
+}
+
+fn json_string(text: &str) -> String {
+  let mut out = String::from("\"");
+  for c in text.chars() {
+    match c {
+      '"' => out.push_str("\\\""),
+      '\\' => out.push_str("\\\\"),
+      '\n' => out.push_str("\\n"),
+      '\r' => out.push_str("\\r"),
+      '\t' => out.push_str("\\t"),
+      c if (c as u32) < 0x20 => out.push_str(&format!("\\u{:04x}", c as u32)),
+      c => out.push(c),
+    }
+  }
+  out.push('"');
+  out
+}
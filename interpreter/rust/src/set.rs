@@ -0,0 +1,205 @@
+/*
+Sets, written #{1, 2, 3} or built with Set(list), and the hashing rules that
+decide what can go in one.
+
+A value is hashable when `==` on it can't change later. Numbers, strings,
+booleans and nil hash by value, with 1 and 1.0 hashing alike since they're
+equal. Instances, functions and classes hash by identity, the way `==`
+compares them. Lists, sets, maps and bytes compare by content, so only
+frozen ones are hashable, and only when everything in them is. Generators and NaN aren't
+equal even to themselves and can't be hashed at all.
+*/
+
+use crate::interpreter::*;
+use crate::lexer::*;
+use std::collections::hash_map::DefaultHasher;
+use std::collections::HashMap;
+use std::hash::{Hash, Hasher};
+use std::rc::Rc;
+
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct LoxSet {
+  // In the order they were added, which is the order iteration sees them in
+  elements: Vec<(u64, LoxValue)>,
+  // The positions in `elements` of the values with each hash
+  buckets: HashMap<u64, Vec<usize>>,
+  // Set by freeze(), after which nothing can be added or removed
+  pub frozen: bool,
+}
+
+impl LoxSet {
+  pub fn new() -> Self {
+    Self::default()
+  }
+
+  pub fn from_values(values: Vec<LoxValue>, interpreter: &Interpreter) -> Result<Self, String> {
+    let mut set = LoxSet::new();
+    for value in values {
+      set.add(value, interpreter)?;
+    }
+    Ok(set)
+  }
+
+  pub fn len(&self) -> usize {
+    self.elements.len()
+  }
+
+  pub fn values(&self) -> Vec<LoxValue> {
+    self.elements.iter().map(|(_, value)| value.clone()).collect()
+  }
+
+  // Returns whether the value wasn't there already
+  pub fn add(&mut self, value: LoxValue, interpreter: &Interpreter) -> Result<bool, String> {
+    let hash = hash(&value, interpreter)?;
+    if self.position(hash, &value).is_some() {
+      return Ok(false);
+    }
+    self.buckets.entry(hash).or_default().push(self.elements.len());
+    self.elements.push((hash, value));
+    Ok(true)
+  }
+
+  pub fn has(&self, value: &LoxValue, interpreter: &Interpreter) -> Result<bool, String> {
+    Ok(self.position(hash(value, interpreter)?, value).is_some())
+  }
+
+  // Returns whether the value was there. The elements after it move down a
+  // place, so the buckets are rebuilt.
+  pub fn remove(&mut self, value: &LoxValue, interpreter: &Interpreter) -> Result<bool, String> {
+    let Some(i) = self.position(hash(value, interpreter)?, value) else {
+      return Ok(false);
+    };
+    self.elements.remove(i);
+    self.buckets.clear();
+    for (i, (hash, _)) in self.elements.iter().enumerate() {
+      self.buckets.entry(*hash).or_default().push(i);
+    }
+    Ok(true)
+  }
+
+  // A copy that isn't frozen
+  pub fn thawed(&self) -> LoxSet {
+    LoxSet { frozen: false, ..self.clone() }
+  }
+
+  // This set's elements, then the other's that it doesn't have
+  pub fn union(&self, other: &LoxSet) -> LoxSet {
+    let mut set = self.thawed();
+    for (hash, value) in &other.elements {
+      if set.position(*hash, value).is_none() {
+        set.buckets.entry(*hash).or_default().push(set.elements.len());
+        set.elements.push((*hash, value.clone()));
+      }
+    }
+    set
+  }
+
+  // This set's elements that the other has too
+  pub fn intersect(&self, other: &LoxSet) -> LoxSet {
+    let mut set = LoxSet::new();
+    for (hash, value) in &self.elements {
+      if other.position(*hash, value).is_some() {
+        set.buckets.entry(*hash).or_default().push(set.elements.len());
+        set.elements.push((*hash, value.clone()));
+      }
+    }
+    set
+  }
+
+  // Sets are equal when they have the same elements, in any order
+  pub fn same_elements(&self, other: &LoxSet) -> bool {
+    self.len() == other.len() && self.elements.iter().all(|(hash, value)| other.position(*hash, value).is_some())
+  }
+
+  fn position(&self, hash: u64, value: &LoxValue) -> Option<usize> {
+    let bucket = self.buckets.get(&hash)?;
+    bucket.iter().copied().find(|i| Interpreter::is_equal(&self.elements[*i].1, value))
+  }
+}
+
+pub fn hash(value: &LoxValue, interpreter: &Interpreter) -> Result<u64, String> {
+  let mut hasher = DefaultHasher::new();
+  hash_into(value, interpreter, &mut hasher, &mut Vec::new())?;
+  Ok(hasher.finish())
+}
+
+// `path` holds the lists and maps being hashed, so one that contains itself
+// hashes as a marker where it comes round again instead of recursing forever
+fn hash_into(value: &LoxValue, interpreter: &Interpreter, hasher: &mut DefaultHasher, path: &mut Vec<*const ()>) -> Result<(), String> {
+  match value {
+    LoxValue::Nil => 0u8.hash(hasher),
+    LoxValue::Boolean(b) => (1u8, b).hash(hasher),
+    // Integers hash as the float they compare equal to
+    LoxValue::Integer(n) => (2u8, number_bits(*n as f64)).hash(hasher),
+    LoxValue::Number(n) if n.is_nan() => return Err(format!("{} is unhashable.", value)),
+    LoxValue::Number(n) => (2u8, number_bits(*n)).hash(hasher),
+    LoxValue::BigInt(n) => match n.to_i64() {
+      Some(n) => (2u8, number_bits(n as f64)).hash(hasher),
+      None => (3u8, n.to_string()).hash(hasher),
+    },
+    LoxValue::String(s) => (4u8, s).hash(hasher),
+    LoxValue::Instance(instance) => (5u8, Rc::as_ptr(instance) as *const () as usize).hash(hasher),
+    // A bound method hashes as its method and instance, which it's compared by
+    LoxValue::Callable(callable) => match callable.borrow().bound_method() {
+      Some((method, this)) => (6u8, Rc::as_ptr(&method) as usize, Rc::as_ptr(&this) as *const () as usize).hash(hasher),
+      None => (6u8, Rc::as_ptr(callable) as *const () as usize).hash(hasher),
+    },
+    LoxValue::Class(class) => (7u8, &class.name).hash(hasher),
+    LoxValue::List(list) => {
+      if !interpreter.is_frozen(list) {
+        return Err(format!("{} is unhashable: a list has to be frozen to be hashed.", value));
+      }
+      let address = Rc::as_ptr(list) as *const ();
+      if path.contains(&address) {
+        return Ok(9u8.hash(hasher));
+      }
+      path.push(address);
+      8u8.hash(hasher);
+      for element in list.borrow().iter() {
+        hash_into(element, interpreter, hasher, path)?;
+      }
+      path.pop();
+    }
+    LoxValue::Set(set) => {
+      if !set.borrow().frozen {
+        return Err(format!("{} is unhashable: a set has to be frozen to be hashed.", value));
+      }
+      // Summed so the order the elements were added in doesn't matter
+      let sum = set.borrow().elements.iter().fold(0u64, |sum, (hash, _)| sum.wrapping_add(*hash));
+      (10u8, sum).hash(hasher);
+    }
+    LoxValue::Map(map) => {
+      if !map.borrow().frozen {
+        return Err(format!("{} is unhashable: a map has to be frozen to be hashed.", value));
+      }
+      let address = Rc::as_ptr(map) as *const ();
+      if path.contains(&address) {
+        return Ok(13u8.hash(hasher));
+      }
+      path.push(address);
+      // Each entry hashes on its own and they're summed, as for a set
+      let mut sum = 0u64;
+      for (key_hash, _, entry) in map.borrow().hashed_entries() {
+        let mut entry_hasher = DefaultHasher::new();
+        key_hash.hash(&mut entry_hasher);
+        hash_into(entry, interpreter, &mut entry_hasher, path)?;
+        sum = sum.wrapping_add(entry_hasher.finish());
+      }
+      path.pop();
+      (12u8, sum).hash(hasher);
+    }
+    LoxValue::Bytes(bytes) => {
+      if !bytes.borrow().frozen {
+        return Err(format!("{} is unhashable: bytes have to be frozen to be hashed.", value));
+      }
+      (11u8, &bytes.borrow().data).hash(hasher);
+    }
+    LoxValue::Generator(_) => return Err(format!("{} is unhashable.", value)),
+  }
+  Ok(())
+}
+
+// 0.0 and -0.0 are equal, so they have to hash the same
+fn number_bits(n: f64) -> u64 {
+  if n == 0.0 { 0 } else { n.to_bits() }
+}
@@ -0,0 +1,298 @@
+/*
+REPL session snapshots, written by `:save <file>` and read back by
+`lox run --restore <file>`.
+
+A snapshot is a JSON document:
+`{"version": 1, "offset": N, "statements": [...], "globals": [...]}`. The
+statements are the session's latest function, class and trait declarations
+in the format of astjson.rs, and restoring runs them again, so functions and
+classes come back as they were written. The offset is where the session's
+next input would have started. The restored session carries on from there,
+since the resolver tells names apart by their offset.
+
+Each global is `{"name", "constant", "value"}`. Strings, booleans and nil
+are plain JSON values. Everything else is an object whose "type" says what it
+is: Integer, Number (as text, so inf and NaN survive), BigInt, List, Instance,
+Bytes (as hex, with whether they're frozen), or a Class or Function saved by
+the global name it was declared under. Lists, instances and bytes get an "id"
+when first written and are written as a Ref to it after that, so shared and
+cyclic data comes back shared.
+
+Closures, bound methods and generators hold state that can't be written out,
+and a set's hashes of the instances in it wouldn't survive the restore.
+Globals holding them are left out and reported instead.
+*/
+
+use crate::ast::*;
+use crate::astjson::{self, Json};
+use crate::bignum::BigInt;
+use crate::bytes::{self, LoxBytes};
+use crate::environment::Environment;
+use crate::lexer::*;
+use crate::oop::LoxInstance;
+use crate::symbol::Symbol;
+use std::cell::RefCell;
+use std::collections::{HashMap, HashSet};
+use std::rc::Rc;
+
+const VERSION: i64 = 1;
+
+///////////// Saving ///////////////
+
+// Returns the snapshot, and the globals that couldn't be saved with why.
+// Globals in `skip` are left out silently: the declarations recreate them.
+pub fn save(declarations: &[Stmt], globals: &Environment, skip: &HashSet<String>, offset: usize) -> (String, Vec<String>) {
+  let mut saver = Saver { ids: HashMap::new(), functions: HashMap::new() };
+  for (symbol, value) in &globals.values {
+    if let LoxValue::Callable(callable) = value {
+      let name = symbol.to_string();
+      if skip.contains(&name) {
+        saver.functions.insert(address(callable), name);
+      }
+    }
+  }
+
+  let mut names: Vec<(String, Symbol)> = globals.values.keys()
+    .map(|symbol| (symbol.to_string(), *symbol))
+    .filter(|(name, _)| !skip.contains(name))
+    .collect();
+  names.sort();
+  let mut saved = Vec::new();
+  let mut left_out = Vec::new();
+  for (name, symbol) in names {
+    match saver.value(&globals.values[&symbol]) {
+      Ok(value) => saved.push(Json::Object(vec![
+        ("name".to_string(), Json::String(name.clone())),
+        ("constant".to_string(), Json::Bool(globals.constants.contains(&symbol))),
+        ("value".to_string(), value),
+      ])),
+      Err(reason) => left_out.push(format!("{} ({})", name, reason)),
+    }
+  }
+
+  let document = Json::Object(vec![
+    ("version".to_string(), Json::Number(VERSION.to_string())),
+    ("offset".to_string(), Json::Number(offset.to_string())),
+    ("statements".to_string(), astjson::statements_json(declarations)),
+    ("globals".to_string(), Json::Array(saved)),
+  ]);
+  (astjson::write_document(&document), left_out)
+}
+
+fn address<T: ?Sized>(rc: &Rc<T>) -> usize {
+  Rc::as_ptr(rc) as *const () as usize
+}
+
+fn tagged(kind: &str, fields: Vec<(&str, Json)>) -> Json {
+  let mut entries = vec![("type".to_string(), Json::String(kind.to_string()))];
+  entries.extend(fields.into_iter().map(|(key, value)| (key.to_string(), value)));
+  Json::Object(entries)
+}
+
+struct Saver {
+  // The id given to each list and instance already written
+  ids: HashMap<usize, usize>,
+  // The global name of each declared function and native
+  functions: HashMap<usize, String>,
+}
+
+impl Saver {
+  // Gives the data a new id, or returns the Ref to the id it already has
+  fn id(&mut self, address: usize) -> Result<usize, Json> {
+    if let Some(id) = self.ids.get(&address) {
+      return Err(tagged("Ref", vec![("id", Json::Number(id.to_string()))]));
+    }
+    let id = self.ids.len();
+    self.ids.insert(address, id);
+    Ok(id)
+  }
+
+  fn value(&mut self, value: &LoxValue) -> Result<Json, String> {
+    let json = match value {
+      LoxValue::Nil => Json::Null,
+      LoxValue::Boolean(b) => Json::Bool(*b),
+      LoxValue::String(s) => Json::String(s.clone()),
+      LoxValue::Integer(n) => tagged("Integer", vec![("value", Json::Number(n.to_string()))]),
+      LoxValue::Number(n) => tagged("Number", vec![("value", Json::String(format!("{:?}", n)))]),
+      LoxValue::BigInt(n) => tagged("BigInt", vec![("value", Json::String(n.to_string()))]),
+      LoxValue::Class(class) => tagged("Class", vec![("name", Json::String(class.name.clone()))]),
+      LoxValue::Callable(callable) => match self.functions.get(&address(callable)) {
+        Some(name) => tagged("Function", vec![("name", Json::String(name.clone()))]),
+        None => return Err(format!("{:?} is not a top-level function", callable.borrow())),
+      },
+      LoxValue::Generator(_) => return Err("generators can't be saved".to_string()),
+      LoxValue::Set(_) => return Err("sets can't be saved".to_string()),
+      LoxValue::Map(_) => return Err("maps can't be saved".to_string()),
+      LoxValue::Bytes(bytes) => {
+        let id = match self.id(address(bytes)) {
+          Ok(id) => id,
+          Err(reference) => return Ok(reference),
+        };
+        let bytes = bytes.borrow();
+        tagged("Bytes", vec![
+          ("id", Json::Number(id.to_string())),
+          ("data", Json::String(bytes::to_hex(&bytes.data))),
+          ("frozen", Json::Bool(bytes.frozen)),
+        ])
+      }
+      LoxValue::List(list) => {
+        let id = match self.id(address(list)) {
+          Ok(id) => id,
+          Err(reference) => return Ok(reference),
+        };
+        let mut elements = Vec::new();
+        for element in list.borrow().iter() {
+          elements.push(self.value(element)?);
+        }
+        tagged("List", vec![("id", Json::Number(id.to_string())), ("elements", Json::Array(elements))])
+      }
+      LoxValue::Instance(instance) => {
+        let id = match self.id(address(instance)) {
+          Ok(id) => id,
+          Err(reference) => return Ok(reference),
+        };
+        let instance = instance.borrow();
+        let mut fields = Vec::new();
+        for (name, value) in instance.properties.iter() {
+          fields.push((name.clone(), self.value(value)?));
+        }
+        tagged("Instance", vec![
+          ("id", Json::Number(id.to_string())),
+          ("class", Json::String(instance.class.name.clone())),
+          ("fields", Json::Object(fields)),
+        ])
+      }
+    };
+    Ok(json)
+  }
+}
+
+///////////// Restoring ///////////////
+
+pub struct Snapshot {
+  pub declarations: Vec<Stmt>,
+  pub offset: usize,
+  globals: Vec<Json>,
+}
+
+pub fn load(source: &str) -> Result<Snapshot, String> {
+  let document = astjson::parse_json(source)?;
+  match document.get("version") {
+    Some(Json::Number(n)) if n == &VERSION.to_string() => (),
+    Some(Json::Number(n)) => return Err(format!("Unsupported snapshot version {}.", n)),
+    _ => return Err("Expected a 'version' field.".to_string()),
+  }
+  let offset = match document.get("offset") {
+    Some(Json::Number(n)) => n.parse().map_err(|_| "Invalid 'offset' field.".to_string())?,
+    _ => return Err("Expected an 'offset' field.".to_string()),
+  };
+  let declarations = astjson::load_statements(document.array("statements")?)?;
+  let globals = document.array("globals")?.to_vec();
+  Ok(Snapshot { declarations, offset, globals })
+}
+
+impl Snapshot {
+  // Defines the saved globals. Run the declarations first: classes and
+  // functions are found by name among the globals.
+  pub fn restore_globals(&self, globals: &Rc<RefCell<Environment>>) -> Result<(), String> {
+    let mut restorer = Restorer { data: HashMap::new(), globals: globals.clone() };
+    for global in &self.globals {
+      let name = global.string("name")?;
+      let value = restorer.value(global.get("value").unwrap_or(&Json::Null))?;
+      if global.get("constant") == Some(&Json::Bool(true)) {
+        globals.borrow_mut().define_constant(name.to_string(), value);
+      } else {
+        globals.borrow_mut().define(name.to_string(), value);
+      }
+    }
+    Ok(())
+  }
+}
+
+struct Restorer {
+  // The lists, instances and bytes made so far, by id
+  data: HashMap<String, LoxValue>,
+  globals: Rc<RefCell<Environment>>,
+}
+
+impl Restorer {
+  fn id(node: &Json) -> Result<String, String> {
+    match node.get("id") {
+      Some(Json::Number(id)) => Ok(id.clone()),
+      _ => Err("Expected an 'id' field.".to_string()),
+    }
+  }
+
+  fn global(&self, node: &Json) -> Result<LoxValue, String> {
+    let name = node.string("name")?;
+    self.globals.borrow().get(name).map_err(|_| format!("The snapshot refers to '{}', which it doesn't declare.", name))
+  }
+
+  fn value(&mut self, node: &Json) -> Result<LoxValue, String> {
+    let bad_value = |kind: &str| format!("Invalid value for a saved {}.", kind);
+    let value = match node {
+      Json::Null => LoxValue::Nil,
+      Json::Bool(b) => LoxValue::Boolean(*b),
+      Json::String(s) => LoxValue::String(s.clone()),
+      _ => match node.string("type")? {
+        "Integer" => match node.get("value") {
+          Some(Json::Number(n)) => LoxValue::Integer(n.parse().map_err(|_| bad_value("Integer"))?),
+          _ => return Err(bad_value("Integer")),
+        },
+        "Number" => LoxValue::Number(node.string("value")?.parse().map_err(|_| bad_value("Number"))?),
+        "BigInt" => {
+          let digits = node.string("value")?;
+          let (negative, digits) = match digits.strip_prefix('-') {
+            Some(digits) => (true, digits),
+            None => (false, digits),
+          };
+          let value = BigInt::parse(digits, 10).filter(|_| !digits.is_empty()).ok_or_else(|| bad_value("BigInt"))?;
+          LoxValue::BigInt(if negative { value.neg() } else { value })
+        }
+        "Class" => match self.global(node)? {
+          LoxValue::Class(class) => LoxValue::Class(class),
+          _ => return Err(format!("'{}' is no longer a class.", node.string("name")?)),
+        },
+        "Function" => self.global(node)?,
+        "Ref" => match self.data.get(&Restorer::id(node)?) {
+          Some(value) => value.clone(),
+          None => return Err("A Ref comes before the data it refers to.".to_string()),
+        },
+        // Registered before the contents are read, which may refer back to it
+        "List" => {
+          let list = Rc::new(RefCell::new(Vec::new()));
+          self.data.insert(Restorer::id(node)?, LoxValue::List(list.clone()));
+          for element in node.array("elements")? {
+            let element = self.value(element)?;
+            list.borrow_mut().push(element);
+          }
+          LoxValue::List(list)
+        }
+        "Bytes" => {
+          let data = bytes::from_hex(node.string("data")?).map_err(|_| bad_value("Bytes"))?;
+          let frozen = node.get("frozen") == Some(&Json::Bool(true));
+          let bytes = LoxValue::Bytes(Rc::new(RefCell::new(LoxBytes { data, frozen })));
+          self.data.insert(Restorer::id(node)?, bytes.clone());
+          bytes
+        }
+        "Instance" => {
+          let class = match self.globals.borrow().get(node.string("class")?) {
+            Ok(LoxValue::Class(class)) => class,
+            _ => return Err(format!("The snapshot has instances of '{}', which it doesn't declare.", node.string("class")?)),
+          };
+          let instance = Rc::new(RefCell::new(LoxInstance::new(class)));
+          self.data.insert(Restorer::id(node)?, LoxValue::Instance(instance.clone()));
+          if let Some(Json::Object(fields)) = node.get("fields") {
+            for (name, field) in fields {
+              let field = self.value(field)?;
+              instance.borrow_mut().set(name.clone(), field);
+            }
+          }
+          LoxValue::Instance(instance)
+        }
+        kind => return Err(format!("Unknown saved value type '{}'.", kind)),
+      },
+    };
+    Ok(value)
+  }
+}
@@ -0,0 +1,79 @@
+/*
+The part of the standard library written in Lox.
+
+Natives stay the primitives that need the host: lengths, appending to a
+list, reflection, sorting and the like (see stl.rs). Everything that can be
+built on them, the collection helpers and string utilities, is Lox source in
+src/stdlib/, compiled into the binary and run by every new interpreter
+before any script. The files make up the module `std`, so the helpers are
+reached as `std.join(words, ", ")`, and the ones that used to be natives are
+global too, so `map(list, f)` keeps working.
+
+The library is always read as the extended dialect whatever the script's is,
+and its tokens are placed far past any script's offsets, since the resolver
+tells names apart by where they are.
+*/
+
+use crate::dialect::{self, Dialect};
+use crate::interpreter::Interpreter;
+use crate::lexer::{Lexer, LoxValue};
+use crate::logging;
+use crate::parser::Parser;
+use crate::resolver::Resolver;
+use std::cell::RefCell;
+use std::rc::Rc;
+
+const SOURCES: &[(&str, &str)] = &[
+  ("collections.lox", include_str!("stdlib/collections.lox")),
+  ("strings.lox", include_str!("stdlib/strings.lox")),
+  ("csv.lox", include_str!("stdlib/csv.lox")),
+  ("errors.lox", include_str!("stdlib/errors.lox")),
+];
+
+const OFFSET: usize = usize::MAX / 4;
+
+// Helpers that were natives before the library moved into Lox, and Error,
+// which user error classes subclass
+const GLOBALS: &[&str] = &["range", "map", "filter", "reduce", "any", "all", "zip", "Error"];
+
+// Defines `std` and the old global helpers in the interpreter's globals
+pub fn load(interpreter: Interpreter) -> Interpreter {
+  let saved = dialect::current();
+  dialect::switch(Dialect::parse("extended").unwrap());
+  let mut stmts = Vec::new();
+  let mut offset = OFFSET;
+  for (name, source) in SOURCES {
+    logging::add_source(offset, &format!("std/{}", name));
+    let mut tokens = Lexer::new(source.to_string()).scan_tokens().clone();
+    for token in tokens.iter_mut() {
+      token.offset += offset;
+    }
+    offset += source.chars().count() + 1;
+    match Parser::new(tokens).parse() {
+      Ok(parsed) => stmts.extend(parsed),
+      Err(_) => panic!("The standard library's {} doesn't parse.", name),
+    }
+  }
+  dialect::switch(saved);
+
+  let shared = Rc::new(RefCell::new(interpreter));
+  let mut resolver = Resolver::new(Box::new(shared.clone()));
+  resolver.resolve_module(&stmts);
+  assert!(!resolver.had_error, "The standard library doesn't resolve.");
+  drop(resolver);
+  let mut interpreter = match Rc::try_unwrap(shared) {
+    Ok(interpreter) => interpreter.into_inner(),
+    Err(_) => panic!("The standard library kept hold of the interpreter."),
+  };
+  if interpreter.define_module("std", &stmts).is_err() {
+    panic!("The standard library failed to run.");
+  }
+  let std = interpreter.globals.borrow().get("std").unwrap();
+  if let LoxValue::Instance(std) = std {
+    for name in GLOBALS {
+      let helper = std.borrow().properties[*name].clone();
+      interpreter.globals.borrow_mut().define(name.to_string(), helper);
+    }
+  }
+  interpreter
+}
@@ -1,9 +1,28 @@
 use crate::callable::*;
 use crate::environment::Environment;
 use crate::lexer::*;
+use crate::symbol;
 use crate::interpreter::*;
 use crate::ast::*;
 use crate::oop::*;
+use crate::bignum::BigInt;
+use crate::generator::LoxGenerator;
+use crate::replay;
+use crate::set::{self, LoxSet};
+use crate::map::LoxMap;
+use crate::bytes::{self, LoxBytes};
+use crate::regex::{Captures, Regex};
+use crate::datetime::{self, DateTime, Zone};
+use crate::net::{self, Socket};
+use crate::file::{self, LoxFile};
+use crate::weak::{self, WeakValue};
+use crate::csv;
+use crate::doc;
+use crate::logging;
+use crate::format;
+use crate::crypto;
+use std::cmp::Ordering;
+use std::collections::HashMap;
 use std::rc::Rc;
 use std::cell::RefCell;
 use std::fmt;
@@ -19,12 +38,15 @@ impl ClockCallable {
   }
 }
 impl LoxCallable for ClockCallable {
-  fn call(&mut self, _interpreter: &mut Interpreter, _arguments: Vec<LoxValue>) -> Box<LoxValue> {
-    let time = std::time::SystemTime::now()
-      .duration_since(std::time::UNIX_EPOCH)
-      .expect("Time went backwards")
-      .as_secs_f64();
-    Box::new(LoxValue::Number(time))
+  fn call(&self, _interpreter: &mut Interpreter, _arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    let time = replay::clock(|| {
+      std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .expect("Time went backwards")
+        .as_secs_f64()
+    })
+    .map_err(|message| InterpreterError::call_error("clock", message))?;
+    Ok(Box::new(LoxValue::Number(time)))
   }
 
   fn arity(&self) -> usize {
@@ -36,70 +58,1617 @@ impl LoxCallable for ClockCallable {
   }
 }
 
+pub type NativeFn = fn(&mut Interpreter, Vec<LoxValue>) -> Result<LoxValue, String>;
+// Natives that call back into Lox code, so errors raised by that code have to
+// pass through untouched
+pub type CallbackFn = fn(&mut Interpreter, Vec<LoxValue>) -> Result<LoxValue, InterpreterError>;
+
+#[derive(Clone, Copy)]
+pub enum NativeBody {
+  Plain(NativeFn),
+  Callback(CallbackFn),
+}
+
+// Natives that only need their arguments share this wrapper instead of
+// each getting a callable struct like clock does.
+#[derive(Clone)]
+pub struct NativeFunction {
+  pub name: String,
+  pub arity: usize,
+  pub function: NativeBody,
+  // Whether it takes any number of arguments past arity()
+  pub variadic: bool,
+  // The list or map a method like `list.get` was taken off, which goes
+  // before the arguments it's called with
+  pub receiver: Option<LoxValue>,
+}
+
+impl fmt::Debug for NativeFunction {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    write!(f, "<native fn {}>", self.name)
+  }
+}
+
+impl NativeFunction {
+  pub fn new(name: &str, arity: usize, function: NativeBody) -> Self {
+    Self { name: name.to_string(), arity, function, variadic: false, receiver: None }
+  }
+}
+
+impl LoxCallable for NativeFunction {
+  fn call(&self, interpreter: &mut Interpreter, mut arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    if let Some(receiver) = &self.receiver {
+      arguments.insert(0, receiver.clone());
+    }
+    let result = match self.function {
+      NativeBody::Plain(function) => function(interpreter, arguments)
+        .map_err(|message| InterpreterError::call_error(&self.name, format!("{}: {}", self.name, message))),
+      NativeBody::Callback(function) => function(interpreter, arguments),
+    };
+    result.map(Box::new)
+  }
+
+  fn arity(&self) -> usize {
+    self.arity
+  }
+
+  fn is_variadic(&self) -> bool {
+    self.variadic
+  }
+
+  fn box_clone(&self) -> Box<dyn LoxCallable> {
+    Box::new(self.clone())
+  }
+}
+
+pub fn define_native(globals: &mut Environment, name: &str, arity: usize, function: NativeFn) {
+  globals.define(
+    name.to_string(),
+    LoxValue::Callable(Rc::new(RefCell::new(Box::new(NativeFunction::new(name, arity, NativeBody::Plain(function)))))),
+  );
+}
+
+// A native that takes `arity` arguments and then any number more
+pub fn define_variadic_native(globals: &mut Environment, name: &str, arity: usize, function: NativeFn) {
+  let mut native = NativeFunction::new(name, arity, NativeBody::Plain(function));
+  native.variadic = true;
+  globals.define(name.to_string(), LoxValue::Callable(Rc::new(RefCell::new(Box::new(native)))));
+}
+
+pub fn define_callback_native(globals: &mut Environment, name: &str, arity: usize, function: CallbackFn) {
+  globals.define(
+    name.to_string(),
+    LoxValue::Callable(Rc::new(RefCell::new(Box::new(NativeFunction::new(name, arity, NativeBody::Callback(function)))))),
+  );
+}
+
+pub fn define_natives(globals: &mut Environment) {
+  define_native(globals, "len", 1, len_native);
+  define_native(globals, "hasField", 2, has_field_native);
+  define_native(globals, "getField", 2, get_field_native);
+  define_native(globals, "setField", 3, set_field_native);
+  define_native(globals, "fields", 1, fields_native);
+  define_native(globals, "methods", 1, methods_native);
+  define_native(globals, "classOf", 1, class_of_native);
+  define_native(globals, "bigint", 1, bigint_native);
+  define_native(globals, "identical", 2, identical_native);
+  define_native(globals, "push", 2, push_native);
+  define_native(globals, "get", 3, get_native);
+  define_native(globals, "clone", 1, clone_native);
+  define_native(globals, "deepEquals", 2, deep_equals_native);
+  define_native(globals, "freeze", 1, freeze_native);
+  define_native(globals, "Set", 1, set_native);
+  define_native(globals, "add", 2, add_native);
+  define_native(globals, "has", 2, has_native);
+  define_native(globals, "remove", 2, remove_native);
+  define_native(globals, "union", 2, union_native);
+  define_native(globals, "intersect", 2, intersect_native);
+  define_native(globals, "keys", 1, keys_native);
+  define_native(globals, "values", 1, values_native);
+  define_native(globals, "hash", 1, hash_native);
+  define_native(globals, "regex", 1, regex_native);
+  globals.define("DateTime".to_string(), datetime_namespace());
+  define_native(globals, "Bytes", 1, bytes_native);
+  define_native(globals, "slice", 3, slice_native);
+  define_native(globals, "toHex", 1, to_hex_native);
+  define_native(globals, "fromHex", 1, from_hex_native);
+  define_native(globals, "toBase64", 1, to_base64_native);
+  define_native(globals, "fromBase64", 1, from_base64_native);
+  define_native(globals, "toText", 1, to_text_native);
+  define_native(globals, "readBytes", 1, read_bytes_native);
+  define_native(globals, "writeBytes", 2, write_bytes_native);
+  define_native(globals, "listen", 1, listen_native);
+  define_native(globals, "connect", 1, connect_native);
+  define_native(globals, "ready", 2, ready_native);
+  define_native(globals, "open", 1, open_native);
+  define_native(globals, "create", 1, create_native);
+  define_native(globals, "weakRef", 1, weak_ref_native);
+  define_variadic_native(globals, "format", 1, format_native);
+  define_native(globals, "toFixed", 2, to_fixed_native);
+  define_native(globals, "str", 1, str_native);
+  define_native(globals, "num", 1, num_native);
+  define_number_constants(globals);
+  define_native(globals, "isNaN", 1, is_nan_native);
+  define_native(globals, "isFinite", 1, is_finite_native);
+  define_native(globals, "csvParse", 1, csv_parse_native);
+  define_native(globals, "csvRead", 1, csv_read_native);
+  define_native(globals, "csvWrite", 2, csv_write_native);
+  define_native(globals, "sha256", 1, sha256_native);
+  define_native(globals, "md5", 1, md5_native);
+  define_native(globals, "hmac", 2, hmac_native);
+  define_native(globals, "base64Encode", 1, base64_encode_native);
+  define_native(globals, "base64Decode", 1, base64_decode_native);
+  define_native(globals, "uuid", 0, uuid_native);
+  define_native(globals, "memStats", 0, mem_stats_native);
+  define_native(globals, "sort", 1, sort_native);
+  define_callback_native(globals, "sortBy", 2, sort_by_native);
+  define_callback_native(globals, "next", 1, next_native);
+}
+
+fn new_list(elements: Vec<LoxValue>) -> LoxValue {
+  LoxValue::List(Rc::new(RefCell::new(elements)))
+}
+
+fn expect_string(value: &LoxValue, what: &str) -> Result<String, String> {
+  match value {
+    LoxValue::String(s) => Ok(s.clone()),
+    _ => Err(format!("{} must be a string.", what)),
+  }
+}
+
+fn expect_instance(value: &LoxValue) -> Result<Rc<RefCell<LoxInstance>>, String> {
+  match value {
+    LoxValue::Instance(instance) => Ok(instance.clone()),
+    _ => Err(format!("{} is not an instance.", value)),
+  }
+}
+
+fn len_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  match &arguments[0] {
+    LoxValue::List(list) => Ok(LoxValue::Integer(list.borrow().len() as i64)),
+    LoxValue::Set(set) => Ok(LoxValue::Integer(set.borrow().len() as i64)),
+    LoxValue::Map(map) => Ok(LoxValue::Integer(map.borrow().len() as i64)),
+    LoxValue::Bytes(bytes) => Ok(LoxValue::Integer(bytes.borrow().data.len() as i64)),
+    LoxValue::String(s) => Ok(LoxValue::Integer(s.chars().count() as i64)),
+    other => Err(format!("{} has no length.", other)),
+  }
+}
+
+// Converts an integer or a decimal string to an arbitrary-precision integer
+fn bigint_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  match &arguments[0] {
+    LoxValue::BigInt(n) => Ok(LoxValue::BigInt(n.clone())),
+    LoxValue::Integer(n) => Ok(LoxValue::BigInt(BigInt::from_i64(*n))),
+    LoxValue::String(s) => {
+      let (negative, digits) = match s.strip_prefix('-') {
+        Some(digits) => (true, digits),
+        None => (false, s.as_str()),
+      };
+      match BigInt::parse(digits, 10) {
+        Some(n) if !digits.is_empty() => Ok(LoxValue::BigInt(if negative { n.neg() } else { n })),
+        _ => Err(format!("Cannot convert '{}' to a bigint.", s)),
+      }
+    }
+    other => Err(format!("Cannot convert {} to a bigint.", other)),
+  }
+}
+
+// Strict equality: values must have the same type (1 and 1.0 differ) and
+// lists, sets, maps and bytes are only identical to themselves, unlike `==`.
+fn identical_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let identical = match (&arguments[0], &arguments[1]) {
+    (LoxValue::Number(l), LoxValue::Number(r)) => l == r,
+    (LoxValue::Integer(l), LoxValue::Integer(r)) => l == r,
+    (LoxValue::Integer(_), _) | (_, LoxValue::Integer(_)) => false,
+    (LoxValue::Number(_), _) | (_, LoxValue::Number(_)) => false,
+    (LoxValue::BigInt(l), LoxValue::BigInt(r)) => l == r,
+    (LoxValue::List(l), LoxValue::List(r)) => Rc::ptr_eq(l, r),
+    (LoxValue::Set(l), LoxValue::Set(r)) => Rc::ptr_eq(l, r),
+    (LoxValue::Map(l), LoxValue::Map(r)) => Rc::ptr_eq(l, r),
+    (LoxValue::Bytes(l), LoxValue::Bytes(r)) => Rc::ptr_eq(l, r),
+    (LoxValue::Callable(l), LoxValue::Callable(r)) => Rc::ptr_eq(l, r),
+    (left, right) => Interpreter::is_equal(left, right),
+  };
+  Ok(LoxValue::Boolean(identical))
+}
+
+///////////// Compound data ///////////////
+/// Lists and instances are shared by reference, so these copy, compare and
+/// lock them down as a whole instead.
+
+type ListRef = Rc<RefCell<Vec<LoxValue>>>;
+type InstanceRef = Rc<RefCell<LoxInstance>>;
+type MapRef = Rc<RefCell<LoxMap>>;
+
+// A deep copy of lists, maps and instances, thawed. Values reachable more
+// than once, cycles included, are copied once, so the copy has the same shape.
+// A set is copied but its elements aren't, and nor are a map's keys: they're
+// hashable, so either can't change or are kept by identity.
+fn clone_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(deep_clone(&arguments[0], &mut HashMap::new(), &mut HashMap::new(), &mut HashMap::new()))
+}
+
+fn deep_clone(
+  value: &LoxValue,
+  lists: &mut HashMap<*const RefCell<Vec<LoxValue>>, ListRef>,
+  instances: &mut HashMap<*const RefCell<LoxInstance>, InstanceRef>,
+  maps: &mut HashMap<*const RefCell<LoxMap>, MapRef>,
+) -> LoxValue {
+  match value {
+    LoxValue::List(list) => {
+      if let Some(copy) = lists.get(&Rc::as_ptr(list)) {
+        return LoxValue::List(copy.clone());
+      }
+      let copy = Rc::new(RefCell::new(Vec::new()));
+      lists.insert(Rc::as_ptr(list), copy.clone());
+      let elements = list.borrow().clone();
+      let elements = elements.iter().map(|element| deep_clone(element, lists, instances, maps)).collect();
+      *copy.borrow_mut() = elements;
+      LoxValue::List(copy)
+    }
+    LoxValue::Instance(instance) => {
+      if let Some(copy) = instances.get(&Rc::as_ptr(instance)) {
+        return LoxValue::Instance(copy.clone());
+      }
+      let copy = Rc::new(RefCell::new(LoxInstance::new(instance.borrow().class.clone())));
+      instances.insert(Rc::as_ptr(instance), copy.clone());
+      let properties = instance.borrow().properties.clone();
+      for (name, field) in properties {
+        let field = deep_clone(&field, lists, instances, maps);
+        copy.borrow_mut().set(name, field);
+      }
+      LoxValue::Instance(copy)
+    }
+    LoxValue::Set(set) => {
+      LoxValue::Set(Rc::new(RefCell::new(set.borrow().thawed())))
+    }
+    LoxValue::Map(map) => {
+      if let Some(copy) = maps.get(&Rc::as_ptr(map)) {
+        return LoxValue::Map(copy.clone());
+      }
+      let copy = Rc::new(RefCell::new(map.borrow().thawed()));
+      maps.insert(Rc::as_ptr(map), copy.clone());
+      let values: Vec<LoxValue> = map.borrow().values().iter().map(|value| deep_clone(value, lists, instances, maps)).collect();
+      for (slot, value) in copy.borrow_mut().values_mut().zip(values) {
+        *slot = value;
+      }
+      LoxValue::Map(copy)
+    }
+    LoxValue::Bytes(bytes) => new_bytes(bytes.borrow().data.clone()),
+    other => other.clone(),
+  }
+}
+
+// Like `==`, but instances are equal when they're of the same class and
+// their fields are, and lists and maps that contain themselves can be compared
+fn deep_equals_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::Boolean(deep_equals(&arguments[0], &arguments[1], &mut Vec::new())))
+}
+
+// `comparing` holds the pairs already being compared further up, which are
+// taken to be equal so a cycle ends the comparison instead of recursing
+fn deep_equals(left: &LoxValue, right: &LoxValue, comparing: &mut Vec<(*const (), *const ())>) -> bool {
+  match (left, right) {
+    (LoxValue::List(l), LoxValue::List(r)) => {
+      let pair = (Rc::as_ptr(l) as *const (), Rc::as_ptr(r) as *const ());
+      if Rc::ptr_eq(l, r) || comparing.contains(&pair) {
+        return true;
+      }
+      let (l, r) = (l.borrow().clone(), r.borrow().clone());
+      comparing.push(pair);
+      let equal = l.len() == r.len() && l.iter().zip(r.iter()).all(|(a, b)| deep_equals(a, b, comparing));
+      comparing.pop();
+      equal
+    }
+    (LoxValue::Instance(l), LoxValue::Instance(r)) => {
+      let pair = (Rc::as_ptr(l) as *const (), Rc::as_ptr(r) as *const ());
+      if Rc::ptr_eq(l, r) || comparing.contains(&pair) {
+        return true;
+      }
+      let (l, r) = (l.borrow().clone(), r.borrow().clone());
+      if l.class != r.class || l.properties.len() != r.properties.len() {
+        return false;
+      }
+      comparing.push(pair);
+      let equal = l.properties.iter().all(|(name, a)| r.properties.get(name).is_some_and(|b| deep_equals(a, b, comparing)));
+      comparing.pop();
+      equal
+    }
+    (LoxValue::Map(l), LoxValue::Map(r)) => {
+      let pair = (Rc::as_ptr(l) as *const (), Rc::as_ptr(r) as *const ());
+      if Rc::ptr_eq(l, r) || comparing.contains(&pair) {
+        return true;
+      }
+      let (l, r) = (l.borrow().clone(), r.borrow().clone());
+      comparing.push(pair);
+      let equal = l.len() == r.len()
+        && l.hashed_entries().all(|(hash, key, a)| r.lookup(*hash, key).is_some_and(|b| deep_equals(a, b, comparing)));
+      comparing.pop();
+      equal
+    }
+    (left, right) => Interpreter::is_equal(left, right),
+  }
+}
+
+// Stops a list's elements, a set's or a map's entries, an instance's fields,
+// or bytes, from being changed, and returns it. Only the value itself is
+// frozen, not the ones it holds; other values can't be changed anyway.
+fn freeze_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  match &arguments[0] {
+    LoxValue::List(list) => interpreter.freeze_list(list),
+    LoxValue::Instance(instance) => instance.borrow_mut().frozen = true,
+    LoxValue::Set(set) => set.borrow_mut().frozen = true,
+    LoxValue::Map(map) => map.borrow_mut().frozen = true,
+    LoxValue::Bytes(bytes) => bytes.borrow_mut().frozen = true,
+    _ => (),
+  }
+  Ok(arguments[0].clone())
+}
+
+///////////// Sets ///////////////
+/// See set.rs for what can be put in one.
+
+fn expect_set(value: &LoxValue) -> Result<Rc<RefCell<LoxSet>>, String> {
+  match value {
+    LoxValue::Set(set) => Ok(set.clone()),
+    _ => Err(format!("{} is not a set.", value)),
+  }
+}
+
+fn new_set(set: LoxSet) -> LoxValue {
+  LoxValue::Set(Rc::new(RefCell::new(set)))
+}
+
+// A set of the list's elements, or a copy of a set
+fn set_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let values = match &arguments[0] {
+    LoxValue::List(list) => list.borrow().clone(),
+    LoxValue::Set(set) => set.borrow().values(),
+    other => return Err(format!("Can only make a set from a list or set, not {}.", other)),
+  };
+  Ok(new_set(LoxSet::from_values(values, interpreter)?))
+}
+
+// Returns whether the value was new to the set
+fn add_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let set = expect_set(&arguments[0])?;
+  if set.borrow().frozen {
+    return Err("Can't change a frozen set.".to_string());
+  }
+  let added = set.borrow_mut().add(arguments[1].clone(), interpreter)?;
+  Ok(LoxValue::Boolean(added))
+}
+
+// Whether a set has the value, or a map has it as a key
+fn has_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if let LoxValue::Map(map) = &arguments[0] {
+    return Ok(LoxValue::Boolean(map.borrow().has(&arguments[1], interpreter)?));
+  }
+  let set = expect_set(&arguments[0])?;
+  let has = set.borrow().has(&arguments[1], interpreter)?;
+  Ok(LoxValue::Boolean(has))
+}
+
+// Returns whether the value was in the set, or the key in the map
+fn remove_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if let LoxValue::Map(map) = &arguments[0] {
+    if map.borrow().frozen {
+      return Err("Can't change a frozen map.".to_string());
+    }
+    let removed = map.borrow_mut().remove(&arguments[1], interpreter)?;
+    return Ok(LoxValue::Boolean(removed));
+  }
+  let set = expect_set(&arguments[0])?;
+  if set.borrow().frozen {
+    return Err("Can't change a frozen set.".to_string());
+  }
+  let removed = set.borrow_mut().remove(&arguments[1], interpreter)?;
+  Ok(LoxValue::Boolean(removed))
+}
+
+fn union_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let (left, right) = (expect_set(&arguments[0])?, expect_set(&arguments[1])?);
+  let union = left.borrow().union(&right.borrow());
+  Ok(new_set(union))
+}
+
+fn intersect_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let (left, right) = (expect_set(&arguments[0])?, expect_set(&arguments[1])?);
+  let intersection = left.borrow().intersect(&right.borrow());
+  Ok(new_set(intersection))
+}
+
+///////////// Maps ///////////////
+/// See map.rs. m[k] and m[k] = v read and write entries, and has() and
+/// remove() take a map as well as a set.
+
+fn expect_map(value: &LoxValue) -> Result<Rc<RefCell<LoxMap>>, String> {
+  match value {
+    LoxValue::Map(map) => Ok(map.clone()),
+    _ => Err(format!("{} is not a map.", value)),
+  }
+}
+
+// The map's keys as a list, in the order they were added
+fn keys_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(new_list(expect_map(&arguments[0])?.borrow().keys()))
+}
+
+fn values_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(new_list(expect_map(&arguments[0])?.borrow().values()))
+}
+
+// Equal values hash alike. The number itself can change between versions of
+// this interpreter, so it shouldn't be saved anywhere.
+fn hash_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::Integer(set::hash(&arguments[0], interpreter)? as i64))
+}
+
+///////////// Regular expressions ///////////////
+/// regex(pattern) compiles the pattern (see regex.rs for the syntax) into a
+/// frozen Regex instance with the pattern and these methods, bound to it:
+/// match(s), find(s), findAll(s), replace(s, template) and split(s).
+
+const REGEX_METHODS: &[&str] = &["match", "find", "findAll", "replace", "split"];
+
+#[derive(Clone)]
+struct RegexMethod {
+  name: &'static str,
+  regex: Rc<Regex>,
+}
+
+impl fmt::Debug for RegexMethod {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    write!(f, "<native fn {}>", self.name)
+  }
+}
+
+impl LoxCallable for RegexMethod {
+  fn call(&self, _interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    self
+      .run(arguments)
+      .map(Box::new)
+      .map_err(|message| InterpreterError::call_error(self.name, format!("{}: {}", self.name, message)))
+  }
+
+  fn arity(&self) -> usize {
+    if self.name == "replace" { 2 } else { 1 }
+  }
+
+  fn box_clone(&self) -> Box<dyn LoxCallable> {
+    Box::new(self.clone())
+  }
+}
+
+impl RegexMethod {
+  fn run(&self, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+    let text: Vec<char> = expect_string(&arguments[0], "Text to search")?.chars().collect();
+    let strings = |pieces: Vec<String>| new_list(pieces.into_iter().map(LoxValue::String).collect());
+    let matched = |captures: &Captures| {
+      let (start, end) = captures[0].unwrap();
+      text[start..end].iter().collect::<String>()
+    };
+    Ok(match self.name {
+      "match" => LoxValue::Boolean(self.regex.find_at(&text, 0).is_some()),
+      // The text of the leftmost match, or nil if there isn't one
+      "find" => self.regex.find_at(&text, 0).map_or(LoxValue::Nil, |captures| LoxValue::String(matched(&captures))),
+      "findAll" => strings(self.regex.find_all(&text).iter().map(matched).collect()),
+      "replace" => LoxValue::String(self.regex.replace_all(&text, &expect_string(&arguments[1], "Replacement")?)),
+      _ => strings(self.regex.split(&text)),
+    })
+  }
+}
+
+fn regex_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let pattern = expect_string(&arguments[0], "Pattern")?;
+  let regex = Rc::new(Regex::new(&pattern)?);
+  let mut instance = LoxInstance::new(LoxClass::new("Regex".to_string(), None, std::collections::HashMap::new()));
+  instance.set("pattern".to_string(), LoxValue::String(pattern));
+  for name in REGEX_METHODS {
+    let method = RegexMethod { name, regex: regex.clone() };
+    instance.set(name.to_string(), LoxValue::Callable(Rc::new(RefCell::new(Box::new(method)))));
+  }
+  instance.frozen = true;
+  Ok(LoxValue::Instance(Rc::new(RefCell::new(instance))))
+}
+
+///////////// Dates and times ///////////////
+/// DateTime holds now(), parse(layout, s), parseIn(layout, s, zone) and
+/// unix(seconds), which make times (see datetime.rs for layouts and zones),
+/// and the layouts RFC3339, DateOnly and TimeOnly. A time is a frozen
+/// DateTime instance with its clock reading in year, month, day, hour,
+/// minute, second, nanosecond, weekday, yearDay, zone and offset, the
+/// instant in unix, and these methods bound to it: format(layout),
+/// inZone(zone), addSeconds(n), addDays(n), addMonths(n), since(other) and
+/// toString().
+
+const DATETIME_FUNCTIONS: &[(&str, usize)] = &[("now", 0), ("parse", 2), ("parseIn", 3), ("unix", 1)];
+const DATETIME_METHODS: &[(&str, usize)] = &[
+  ("format", 1), ("inZone", 1), ("addSeconds", 1), ("addDays", 1), ("addMonths", 1), ("since", 1), ("toString", 0),
+];
+const LAYOUTS: &[(&str, &str)] = &[("RFC3339", "2006-01-02T15:04:05Z07:00"), ("DateOnly", "2006-01-02"), ("TimeOnly", "15:04:05")];
+
+// How a time prints, as Go writes one
+const TO_STRING_LAYOUT: &str = "2006-01-02 15:04:05.999999999 -0700 MST";
+
+// One of DateTime's functions, or with a time, one of its methods
+#[derive(Clone)]
+struct DateTimeNative {
+  name: &'static str,
+  arity: usize,
+  time: Option<Rc<DateTime>>,
+}
+
+impl fmt::Debug for DateTimeNative {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    write!(f, "<native fn {}>", self.name)
+  }
+}
+
+impl LoxCallable for DateTimeNative {
+  fn call(&self, _interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    self
+      .run(arguments)
+      .map(Box::new)
+      .map_err(|message| InterpreterError::call_error(self.name, format!("{}: {}", self.name, message)))
+  }
+
+  fn arity(&self) -> usize {
+    self.arity
+  }
+
+  fn box_clone(&self) -> Box<dyn LoxCallable> {
+    Box::new(self.clone())
+  }
+}
+
+impl DateTimeNative {
+  fn run(&self, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+    let zone = |value: &LoxValue| datetime::load_zone(&expect_string(value, "Zone")?);
+    let Some(time) = &self.time else {
+      let time = match self.name {
+        "now" => {
+          let now = replay::clock(|| {
+            std::time::SystemTime::now()
+              .duration_since(std::time::UNIX_EPOCH)
+              .expect("Time went backwards")
+              .as_secs_f64()
+          })?;
+          DateTime::from_unix(0, 0, datetime::local_zone()).add_seconds(now)?
+        }
+        "parse" | "parseIn" => {
+          let layout = expect_string(&arguments[0], "Layout")?;
+          let text = expect_string(&arguments[1], "Time")?;
+          let default = if self.name == "parse" { Rc::new(Zone::utc()) } else { zone(&arguments[2])? };
+          let local = if self.name == "parse" { datetime::local_zone() } else { default.clone() };
+          DateTime::parse(&layout, &text, default, local)?
+        }
+        _ => match &arguments[0] {
+          LoxValue::Integer(n) => DateTime::from_unix(*n, 0, datetime::local_zone()),
+          LoxValue::Number(n) => DateTime::from_unix(0, 0, datetime::local_zone()).add_seconds(*n)?,
+          _ => return Err("Seconds must be a number.".to_string()),
+        },
+      };
+      return Ok(datetime_value(time));
+    };
+    let count = |what: &str| match &arguments[0] {
+      LoxValue::Integer(n) => Ok(*n),
+      _ => Err(format!("{} must be an integer.", what)),
+    };
+    Ok(match self.name {
+      "format" => LoxValue::String(time.format(&expect_string(&arguments[0], "Layout")?)),
+      "toString" => LoxValue::String(time.format(TO_STRING_LAYOUT)),
+      "inZone" => datetime_value(time.in_zone(zone(&arguments[0])?)),
+      "addSeconds" => match &arguments[0] {
+        LoxValue::Integer(n) => datetime_value(time.add_seconds(*n as f64)?),
+        LoxValue::Number(n) => datetime_value(time.add_seconds(*n)?),
+        _ => return Err("Seconds must be a number.".to_string()),
+      },
+      "addDays" => datetime_value(time.add_date(0, count("Days")?)?),
+      "addMonths" => datetime_value(time.add_date(count("Months")?, 0)?),
+      _ => LoxValue::Number(time.since(&expect_datetime(&arguments[0])?)),
+    })
+  }
+}
+
+fn datetime_namespace() -> LoxValue {
+  let mut instance = LoxInstance::new(LoxClass::new("DateTime".to_string(), None, HashMap::new()));
+  for (name, arity) in DATETIME_FUNCTIONS {
+    let function = DateTimeNative { name, arity: *arity, time: None };
+    instance.set(name.to_string(), LoxValue::Callable(Rc::new(RefCell::new(Box::new(function)))));
+  }
+  for (name, layout) in LAYOUTS {
+    instance.set(name.to_string(), LoxValue::String(layout.to_string()));
+  }
+  instance.frozen = true;
+  LoxValue::Instance(Rc::new(RefCell::new(instance)))
+}
+
+fn datetime_value(time: DateTime) -> LoxValue {
+  let civil = time.civil();
+  let mut instance = LoxInstance::new(LoxClass::new("DateTime".to_string(), None, HashMap::new()));
+  let fields = [
+    ("year", civil.year),
+    ("month", civil.month),
+    ("day", civil.day),
+    ("hour", civil.hour),
+    ("minute", civil.minute),
+    ("second", civil.second),
+    ("nanosecond", time.nanosecond),
+    ("yearDay", civil.year_day),
+    ("offset", civil.offset),
+    ("unix", time.unix),
+  ];
+  for (name, value) in fields {
+    instance.set(name.to_string(), LoxValue::Integer(value));
+  }
+  let weekday = ["Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"][civil.weekday as usize];
+  instance.set("weekday".to_string(), LoxValue::String(weekday.to_string()));
+  instance.set("zone".to_string(), LoxValue::String(civil.abbreviation));
+  let time = Rc::new(time);
+  for (name, arity) in DATETIME_METHODS {
+    let method = DateTimeNative { name, arity: *arity, time: Some(time.clone()) };
+    instance.set(name.to_string(), LoxValue::Callable(Rc::new(RefCell::new(Box::new(method)))));
+  }
+  instance.frozen = true;
+  LoxValue::Instance(Rc::new(RefCell::new(instance)))
+}
+
+// The instant a DateTime instance stands for. Its fields can't have been
+// changed, since it's frozen.
+fn expect_datetime(value: &LoxValue) -> Result<DateTime, String> {
+  if let LoxValue::Instance(instance) = value {
+    let instance = instance.borrow();
+    let field = |name: &str| match instance.properties.get(name) {
+      Some(LoxValue::Integer(n)) => Some(*n),
+      _ => None,
+    };
+    if let (true, Some(unix), Some(nanosecond)) = (instance.class.name == "DateTime" && instance.frozen, field("unix"), field("nanosecond")) {
+      return Ok(DateTime::from_unix(unix, nanosecond, Rc::new(Zone::utc())));
+    }
+  }
+  Err(format!("{} is not a DateTime.", value))
+}
+
+///////////// Bytes ///////////////
+/// Bytes(value) makes a buffer (see bytes.rs) from a list of integers 0-255,
+/// a string's UTF-8, other bytes, or a length to fill with zeros. slice()
+/// works on lists and strings as well. readBytes(path) and
+/// writeBytes(path, bytes) aren't available to sandboxed runs.
+
+fn new_bytes(data: Vec<u8>) -> LoxValue {
+  LoxValue::Bytes(Rc::new(RefCell::new(LoxBytes::new(data))))
+}
+
+fn expect_bytes(value: &LoxValue) -> Result<Vec<u8>, String> {
+  match value {
+    LoxValue::Bytes(bytes) => Ok(bytes.borrow().data.clone()),
+    _ => Err(format!("{} is not bytes.", value)),
+  }
+}
+
+fn expect_byte(value: &LoxValue) -> Result<u8, String> {
+  match value {
+    LoxValue::Integer(n) if (0..=255).contains(n) => Ok(*n as u8),
+    _ => Err(format!("A byte must be an integer from 0 to 255, not {}.", value)),
+  }
+}
+
+fn bytes_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let data = match &arguments[0] {
+    LoxValue::List(list) => list.borrow().iter().map(expect_byte).collect::<Result<Vec<u8>, String>>()?,
+    LoxValue::String(s) => s.as_bytes().to_vec(),
+    LoxValue::Bytes(bytes) => bytes.borrow().data.clone(),
+    LoxValue::Integer(n) => {
+      // Reserved up front so a huge length is an error rather than an abort
+      let mut data = Vec::new();
+      if *n < 0 || data.try_reserve_exact(*n as usize).is_err() {
+        return Err(format!("Can't make {} bytes.", n));
+      }
+      data.resize(*n as usize, 0);
+      data
+    }
+    other => return Err(format!("Can only make bytes from a list, string, bytes or length, not {}.", other)),
+  };
+  Ok(new_bytes(data))
+}
+
+// A copy of the elements, chars or bytes from start up to but not including end
+fn slice_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let len = match &arguments[0] {
+    LoxValue::List(list) => list.borrow().len(),
+    LoxValue::String(s) => s.chars().count(),
+    LoxValue::Bytes(bytes) => bytes.borrow().data.len(),
+    other => return Err(format!("Can only slice a list, string or bytes, not {}.", other)),
+  };
+  let (start, end) = match (&arguments[1], &arguments[2]) {
+    (LoxValue::Integer(start), LoxValue::Integer(end)) => (*start, *end),
+    _ => return Err("Slice bounds must be integers.".to_string()),
+  };
+  if start < 0 || start > end || end as usize > len {
+    return Err(format!("Slice {}..{} out of range for length {}.", start, end, len));
+  }
+  let (start, end) = (start as usize, end as usize);
+  Ok(match &arguments[0] {
+    LoxValue::List(list) => new_list(list.borrow()[start..end].to_vec()),
+    LoxValue::String(s) => LoxValue::String(s.chars().skip(start).take(end - start).collect()),
+    LoxValue::Bytes(bytes) => new_bytes(bytes.borrow().data[start..end].to_vec()),
+    _ => unreachable!(),
+  })
+}
+
+fn to_hex_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::String(bytes::to_hex(&expect_bytes(&arguments[0])?)))
+}
+
+fn from_hex_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(new_bytes(bytes::from_hex(&expect_string(&arguments[0], "Hex")?)?))
+}
+
+fn to_base64_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::String(bytes::to_base64(&expect_bytes(&arguments[0])?)))
+}
+
+fn from_base64_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(new_bytes(bytes::from_base64(&expect_string(&arguments[0], "Base64")?)?))
+}
+
+// Decodes UTF-8, the inverse of Bytes(string)
+fn to_text_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  String::from_utf8(expect_bytes(&arguments[0])?)
+    .map(LoxValue::String)
+    .map_err(|err| format!("Invalid UTF-8 at byte {}.", err.utf8_error().valid_up_to()))
+}
+
+fn read_bytes_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if interpreter.limits.is_some() {
+    return Err("Files can't be read here.".to_string());
+  }
+  let path = expect_string(&arguments[0], "Path")?;
+  let data = replay::input("read a file", || std::fs::read(&path).map_err(|err| format!("Can't read '{}': {}.", path, err)))?;
+  Ok(new_bytes(data))
+}
+
+fn write_bytes_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if interpreter.limits.is_some() {
+    return Err("Files can't be written here.".to_string());
+  }
+  let path = expect_string(&arguments[0], "Path")?;
+  std::fs::write(&path, expect_bytes(&arguments[1])?).map_err(|err| format!("Can't write '{}': {}.", path, err))?;
+  Ok(LoxValue::Nil)
+}
+
+///////////// Sockets ///////////////
+/// listen(address) and connect(address) open TCP sockets (see net.rs),
+/// which sandboxed runs can't. A listener is a frozen Listener instance with
+/// its address and the methods accept() and close(). A connection is a
+/// frozen Connection instance with localAddress, remoteAddress and the
+/// methods read(), readLine(), write(data), writeLine(text) and close().
+/// ready(sockets, timeout) returns the ones that can go on without blocking.
+
+const LISTENER_METHODS: &[(&str, usize)] = &[("accept", 0), ("close", 0)];
+const CONNECTION_METHODS: &[(&str, usize)] = &[("read", 0), ("readLine", 0), ("write", 1), ("writeLine", 1), ("close", 0)];
+
+#[derive(Clone)]
+struct SocketMethod {
+  name: &'static str,
+  arity: usize,
+  socket: Rc<RefCell<Socket>>,
+  id: i64,
+}
+
+impl fmt::Debug for SocketMethod {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    write!(f, "<native fn {}>", self.name)
+  }
+}
+
+impl LoxCallable for SocketMethod {
+  fn call(&self, _interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    self
+      .run(arguments)
+      .map(Box::new)
+      .map_err(|message| InterpreterError::call_error(self.name, format!("{}: {}", self.name, message)))
+  }
+
+  fn arity(&self) -> usize {
+    self.arity
+  }
+
+  fn box_clone(&self) -> Box<dyn LoxCallable> {
+    Box::new(self.clone())
+  }
+
+  fn handle(&self) -> Option<i64> {
+    Some(self.id)
+  }
+}
+
+impl SocketMethod {
+  fn run(&self, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+    let mut socket = self.socket.borrow_mut();
+    Ok(match self.name {
+      "accept" => socket_value(socket.accept()?),
+      // Bytes, or nil once the other end has closed
+      "read" => socket.read()?.map_or(LoxValue::Nil, new_bytes),
+      "readLine" => match socket.read_line()? {
+        Some(line) => LoxValue::String(String::from_utf8(line).map_err(|_| "The line isn't valid UTF-8.".to_string())?),
+        None => LoxValue::Nil,
+      },
+      "write" => {
+        match &arguments[0] {
+          LoxValue::String(s) => socket.write(s.as_bytes())?,
+          LoxValue::Bytes(bytes) => socket.write(&bytes.borrow().data)?,
+          other => return Err(format!("Can only write a string or bytes, not {}.", other)),
+        }
+        LoxValue::Nil
+      }
+      // Lox strings have no escapes, so this is how a script ends a line
+      "writeLine" => {
+        socket.write(format!("{}\n", expect_string(&arguments[0], "Line")?).as_bytes())?;
+        LoxValue::Nil
+      }
+      _ => {
+        socket.close();
+        LoxValue::Nil
+      }
+    })
+  }
+}
+
+fn socket_value(socket: Socket) -> LoxValue {
+  let (class, methods) = match socket {
+    Socket::Listener { .. } => ("Listener", LISTENER_METHODS),
+    _ => ("Connection", CONNECTION_METHODS),
+  };
+  let mut instance = LoxInstance::new(LoxClass::new(class.to_string(), None, HashMap::new()));
+  let (local, remote) = socket.addresses();
+  if class == "Listener" {
+    instance.set("address".to_string(), LoxValue::String(local));
+  } else {
+    instance.set("localAddress".to_string(), LoxValue::String(local));
+    instance.set("remoteAddress".to_string(), LoxValue::String(remote));
+  }
+  let socket = Rc::new(RefCell::new(socket));
+  let id = net::register(&socket);
+  instance.set("id".to_string(), LoxValue::Integer(id));
+  for (name, arity) in methods {
+    let method = SocketMethod { name, arity: *arity, socket: socket.clone(), id };
+    instance.set(name.to_string(), LoxValue::Callable(Rc::new(RefCell::new(Box::new(method)))));
+  }
+  instance.frozen = true;
+  LoxValue::Instance(Rc::new(RefCell::new(instance)))
+}
+
+// The socket behind a Listener or Connection instance. Its id can't have
+// been changed, since it's frozen.
+fn expect_socket(value: &LoxValue) -> Result<Rc<RefCell<Socket>>, String> {
+  if let LoxValue::Instance(instance) = value {
+    let instance = instance.borrow();
+    let is_socket = instance.frozen && (instance.class.name == "Listener" || instance.class.name == "Connection");
+    if let (true, Some(LoxValue::Integer(id))) = (is_socket, instance.properties.get("id")) {
+      if let Some(socket) = net::lookup(*id) {
+        return Ok(socket);
+      }
+    }
+  }
+  Err(format!("{} is not a socket.", value))
+}
+
+fn listen_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if interpreter.limits.is_some() {
+    return Err("Sockets can't be opened here.".to_string());
+  }
+  replay::unrecorded("Sockets")?;
+  Ok(socket_value(net::listen(&expect_string(&arguments[0], "Address")?)?))
+}
+
+fn connect_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if interpreter.limits.is_some() {
+    return Err("Sockets can't be opened here.".to_string());
+  }
+  replay::unrecorded("Sockets")?;
+  Ok(socket_value(net::connect(&expect_string(&arguments[0], "Address")?)?))
+}
+
+// The sockets in the list that are ready, after waiting up to `timeout`
+// seconds for one to be, or for as long as it takes if the timeout is nil
+fn ready_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let candidates = match &arguments[0] {
+    LoxValue::List(list) => list.borrow().clone(),
+    other => return Err(format!("{} is not a list.", other)),
+  };
+  let sockets = candidates.iter().map(expect_socket).collect::<Result<Vec<_>, _>>()?;
+  let timeout = match &arguments[1] {
+    LoxValue::Nil => None,
+    other => match Interpreter::as_float(other) {
+      Some(seconds) if seconds >= 0.0 && seconds.is_finite() => Some(std::time::Duration::from_secs_f64(seconds)),
+      _ => return Err("Timeout must be a number of seconds or nil.".to_string()),
+    },
+  };
+  let ready = net::ready(&sockets, timeout)?;
+  Ok(new_list(ready.into_iter().map(|i| candidates[i].clone()).collect()))
+}
+
+///////////// Files ///////////////
+/// open(path) opens a file for reading and create(path) one for writing (see
+/// file.rs), which sandboxed runs can't. Either is a frozen File instance with
+/// its path and the methods close() and, for reading, read() and readLine(),
+/// or for writing, write(data) and writeLine(text).
+
+const READER_METHODS: &[(&str, usize)] = &[("read", 0), ("readLine", 0), ("close", 0)];
+const WRITER_METHODS: &[(&str, usize)] = &[("write", 1), ("writeLine", 1), ("close", 0)];
+
+#[derive(Clone)]
+struct FileMethod {
+  name: &'static str,
+  arity: usize,
+  file: Rc<RefCell<LoxFile>>,
+  id: i64,
+}
+
+impl fmt::Debug for FileMethod {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    write!(f, "<native fn {}>", self.name)
+  }
+}
+
+impl LoxCallable for FileMethod {
+  fn call(&self, _interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    self
+      .run(arguments)
+      .map(Box::new)
+      .map_err(|message| InterpreterError::call_error(self.name, format!("{}: {}", self.name, message)))
+  }
+
+  fn arity(&self) -> usize {
+    self.arity
+  }
+
+  fn box_clone(&self) -> Box<dyn LoxCallable> {
+    Box::new(self.clone())
+  }
+
+  fn handle(&self) -> Option<i64> {
+    Some(self.id)
+  }
+}
+
+impl FileMethod {
+  fn run(&self, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+    let mut file = self.file.borrow_mut();
+    Ok(match self.name {
+      "read" => LoxValue::String(file.read()?),
+      // The next line, or nil at the end of the file
+      "readLine" => file.read_line()?.map_or(LoxValue::Nil, LoxValue::String),
+      "write" => {
+        match &arguments[0] {
+          LoxValue::String(s) => file.write(s.as_bytes())?,
+          LoxValue::Bytes(bytes) => file.write(&bytes.borrow().data)?,
+          other => return Err(format!("Can only write a string or bytes, not {}.", other)),
+        }
+        LoxValue::Nil
+      }
+      "writeLine" => {
+        file.write(format!("{}\n", expect_string(&arguments[0], "Line")?).as_bytes())?;
+        LoxValue::Nil
+      }
+      _ => {
+        file.close();
+        LoxValue::Nil
+      }
+    })
+  }
+}
+
+fn file_value(path: String, file: LoxFile) -> LoxValue {
+  let methods = match file {
+    LoxFile::Reader(_) | LoxFile::Replayed => READER_METHODS,
+    _ => WRITER_METHODS,
+  };
+  let mut instance = LoxInstance::new(LoxClass::new("File".to_string(), None, HashMap::new()));
+  instance.set("path".to_string(), LoxValue::String(path));
+  let file = Rc::new(RefCell::new(file));
+  let id = weak::track(file.clone());
+  for (name, arity) in methods {
+    let method = FileMethod { name, arity: *arity, file: file.clone(), id };
+    instance.set(name.to_string(), LoxValue::Callable(Rc::new(RefCell::new(Box::new(method)))));
+  }
+  instance.frozen = true;
+  LoxValue::Instance(Rc::new(RefCell::new(instance)))
+}
+
+fn open_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if interpreter.limits.is_some() {
+    return Err("Files can't be read here.".to_string());
+  }
+  let path = expect_string(&arguments[0], "Path")?;
+  let file = file::open(&path)?;
+  Ok(file_value(path, file))
+}
+
+fn create_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if interpreter.limits.is_some() {
+    return Err("Files can't be written here.".to_string());
+  }
+  let path = expect_string(&arguments[0], "Path")?;
+  let file = file::create(&path)?;
+  Ok(file_value(path, file))
+}
+
+// format(template, ...) fills the template's placeholders with the
+// arguments after it (see format.rs)
+fn format_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let template = expect_string(&arguments[0], "Template")?;
+  let text = format::format(&template, &arguments[1..], &mut |value| interpreter.stringify(value).map_err(|err| err.message))?;
+  Ok(LoxValue::String(text))
+}
+
+///////////// Numbers ///////////////
+/// Numbers become text as number_string (lexer.rs) writes them, which num()
+/// reads back exactly: num(str(x)) == x for every number.
+///
+/// Floats follow IEEE 754. 0 / 0 is NaN, and a result too large for a float
+/// is inf or -inf; integer arithmetic that overflows carries on as floats.
+/// NaN isn't equal to anything, itself included, every comparison with it is
+/// false, and it can't go in a set. The globals nan and inf hold the two, and
+/// isNaN() and isFinite() tell them apart from ordinary numbers.
+
+fn define_number_constants(globals: &mut Environment) {
+  globals.define("nan".to_string(), LoxValue::Number(f64::NAN));
+  globals.define("inf".to_string(), LoxValue::Number(f64::INFINITY));
+}
+
+fn expect_number(value: &LoxValue) -> Result<f64, String> {
+  Interpreter::as_float(value).ok_or_else(|| format!("{} is not a number.", value))
+}
+
+fn is_nan_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::Boolean(expect_number(&arguments[0])?.is_nan()))
+}
+
+// False for NaN, inf and -inf
+fn is_finite_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::Boolean(expect_number(&arguments[0])?.is_finite()))
+}
+
+// str(value) is the text print shows for the value
+fn str_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let text = interpreter.stringify(&arguments[0]).map_err(|err| err.message)?;
+  Ok(LoxValue::String(text))
+}
+
+// num(text) reads a number written as str() would write it
+fn num_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  match &arguments[0] {
+    LoxValue::String(s) => parse_number(s).ok_or_else(|| format!("Cannot convert '{}' to a number.", s)),
+    LoxValue::Number(_) | LoxValue::Integer(_) => Ok(arguments[0].clone()),
+    other => Err(format!("Cannot convert {} to a number.", other)),
+  }
+}
+
+// toFixed(number, digits) writes the number with exactly that many digits
+// after the decimal point, rounding the last one, so toFixed(2.5, 2) is
+// "2.50" where print would show 2.5
+fn to_fixed_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let n = expect_number(&arguments[0])?;
+  let digits = match &arguments[1] {
+    LoxValue::Integer(digits) if (0..=100).contains(digits) => *digits as usize,
+    other => return Err(format!("Digits must be an integer from 0 to 100, not {}.", other)),
+  };
+  if !n.is_finite() {
+    return Ok(LoxValue::String(number_string(n)));
+  }
+  Ok(LoxValue::String(format!("{:.*}", digits, n)))
+}
+
+///////////// Weak references ///////////////
+/// weakRef(value) refers to a list, set, bytes, instance, function or
+/// generator without keeping it alive. It's a frozen WeakRef instance whose
+/// get() returns the value, or nil once nothing else refers to it.
+
+#[derive(Clone)]
+struct WeakRefGet {
+  target: WeakValue,
+}
+
+impl fmt::Debug for WeakRefGet {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    write!(f, "<native fn get>")
+  }
+}
+
+impl LoxCallable for WeakRefGet {
+  fn call(&self, _interpreter: &mut Interpreter, _arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    Ok(Box::new(self.target.upgrade().unwrap_or(LoxValue::Nil)))
+  }
+
+  fn arity(&self) -> usize {
+    0
+  }
+
+  fn box_clone(&self) -> Box<dyn LoxCallable> {
+    Box::new(self.clone())
+  }
+}
+
+fn weak_ref_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let get = WeakRefGet { target: WeakValue::new(&arguments[0])? };
+  let mut instance = LoxInstance::new(LoxClass::new("WeakRef".to_string(), None, HashMap::new()));
+  instance.set("get".to_string(), LoxValue::Callable(Rc::new(RefCell::new(Box::new(get)))));
+  instance.frozen = true;
+  Ok(LoxValue::Instance(Rc::new(RefCell::new(instance))))
+}
+
+///////////// CSV ///////////////
+/// csvParse(text) and csvRead(path) return a list of records, each a list of
+/// strings (see csv.rs for the format); std.records() turns ones with a header
+/// into instances. csvWrite(path, rows) writes lists of values, converting
+/// them as print does. Sandboxed runs can't read or write files.
+
+fn csv_rows(records: Vec<Vec<String>>) -> LoxValue {
+  new_list(records.into_iter().map(|record| new_list(record.into_iter().map(LoxValue::String).collect())).collect())
+}
+
+fn csv_parse_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(csv_rows(csv::parse(&expect_string(&arguments[0], "CSV")?)?))
+}
+
+fn csv_read_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if interpreter.limits.is_some() {
+    return Err("Files can't be read here.".to_string());
+  }
+  let path = expect_string(&arguments[0], "Path")?;
+  let text = replay::input("read a file", || {
+    std::fs::read_to_string(&path).map(String::into_bytes).map_err(|err| format!("Can't read '{}': {}.", path, err))
+  })?;
+  let text = String::from_utf8(text).map_err(|_| format!("'{}' isn't UTF-8.", path))?;
+  Ok(csv_rows(csv::parse(&text).map_err(|message| format!("{}: {}", path, message))?))
+}
+
+fn csv_write_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  if interpreter.limits.is_some() {
+    return Err("Files can't be written here.".to_string());
+  }
+  let path = expect_string(&arguments[0], "Path")?;
+  let rows = match &arguments[1] {
+    LoxValue::List(rows) => rows.borrow().clone(),
+    other => return Err(format!("{} is not a list of rows.", other)),
+  };
+  let mut records = Vec::new();
+  for row in rows {
+    let LoxValue::List(row) = row else {
+      return Err(format!("Row {} is not a list.", row));
+    };
+    let row = row.borrow().clone();
+    let record = row.iter().map(|value| interpreter.stringify(value).map_err(|err| err.message)).collect::<Result<_, _>>()?;
+    records.push(record);
+  }
+  std::fs::write(&path, csv::format(&records)).map_err(|err| format!("Can't write '{}': {}.", path, err))?;
+  Ok(LoxValue::Nil)
+}
+
+///////////// Hashing ///////////////
+/// sha256(data), md5(data) and hmac(key, data) return digests as lowercase
+/// hex (see crypto.rs), for data given as a string's UTF-8 or bytes.
+/// base64Encode(data) and base64Decode(text) convert text, where toBase64()
+/// and fromBase64() work with bytes. uuid() returns a random UUID.
+
+// A string's UTF-8 or the contents of bytes
+fn expect_data(value: &LoxValue, what: &str) -> Result<Vec<u8>, String> {
+  match value {
+    LoxValue::String(s) => Ok(s.as_bytes().to_vec()),
+    LoxValue::Bytes(bytes) => Ok(bytes.borrow().data.clone()),
+    _ => Err(format!("{} must be a string or bytes.", what)),
+  }
+}
+
+fn sha256_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::String(bytes::to_hex(&crypto::sha256(&expect_data(&arguments[0], "Data")?))))
+}
+
+fn md5_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::String(bytes::to_hex(&crypto::md5(&expect_data(&arguments[0], "Data")?))))
+}
+
+// HMAC-SHA256
+fn hmac_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let key = expect_data(&arguments[0], "Key")?;
+  Ok(LoxValue::String(bytes::to_hex(&crypto::hmac_sha256(&key, &expect_data(&arguments[1], "Data")?))))
+}
+
+fn base64_encode_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::String(bytes::to_base64(&expect_data(&arguments[0], "Data")?)))
+}
+
+fn base64_decode_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let data = bytes::from_base64(&expect_string(&arguments[0], "Base64")?)?;
+  String::from_utf8(data)
+    .map(LoxValue::String)
+    .map_err(|_| "The decoded data isn't UTF-8 text; fromBase64() decodes it to bytes.".to_string())
+}
+
+fn uuid_native(_interpreter: &mut Interpreter, _arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  Ok(LoxValue::String(crypto::uuid()?))
+}
+
+///////////// Memory ///////////////
+/// memStats() returns a frozen MemStats instance with the heap's live bytes,
+/// its peak and its live allocations, and counts of the objects the program
+/// can still reach: objects in all, then environments, functions, classes,
+/// instances, lists, sets, maps, bytes and generators (see memory.rs).
+
+fn mem_stats_native(interpreter: &mut Interpreter, _arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let mut instance = LoxInstance::new(LoxClass::new("MemStats".to_string(), None, std::collections::HashMap::new()));
+  for (name, value) in interpreter.mem_stats().fields() {
+    instance.set(name.to_string(), LoxValue::Integer(value as i64));
+  }
+  instance.frozen = true;
+  Ok(LoxValue::Instance(Rc::new(RefCell::new(instance))))
+}
+
+///////////// Collections ///////////////
+/// The callback natives take the list first and a Lox callable second.
+
+// Appends to the list, or a byte to bytes, in place, which is how the
+// library's Lox half builds new lists
+fn push_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  match &arguments[0] {
+    LoxValue::List(list) if interpreter.is_frozen(list) => Err("Can't change a frozen list.".to_string()),
+    LoxValue::List(list) => {
+      list.borrow_mut().push(arguments[1].clone());
+      Ok(LoxValue::Nil)
+    }
+    LoxValue::Bytes(bytes) if bytes.borrow().frozen => Err("Can't change frozen bytes.".to_string()),
+    LoxValue::Bytes(bytes) => {
+      bytes.borrow_mut().data.push(expect_byte(&arguments[1])?);
+      Ok(LoxValue::Nil)
+    }
+    other => Err(format!("{} is not a list.", other)),
+  }
+}
+
+// The methods lists, maps and bytes have, as natives that take the value
+// first: `list.get(i, default)` is get(list, i, default)
+const VALUE_METHODS: &[(&str, usize, NativeFn)] = &[("get", 2, get_native)];
+
+pub fn value_method(object: &LoxValue, name: &str) -> Option<LoxValue> {
+  if !matches!(object, LoxValue::List(_) | LoxValue::Map(_) | LoxValue::Bytes(_)) {
+    return None;
+  }
+  let (name, arity, function) = VALUE_METHODS.iter().find(|(method, _, _)| *method == name)?;
+  let mut method = NativeFunction::new(name, *arity, NativeBody::Plain(*function));
+  method.receiver = Some(object.clone());
+  Some(LoxValue::Callable(Rc::new(RefCell::new(Box::new(method)))))
+}
+
+// An element of a list or bytes, a map's value for a key, or a field of an
+// instance, with `default` in place of an index that's out of range or a key
+// or field that isn't there
+fn get_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let default = arguments[2].clone();
+  match &arguments[0] {
+    LoxValue::List(list) => {
+      let list = list.borrow();
+      let position = Interpreter::list_position("List", list.len(), &arguments[1])?;
+      Ok(position.map_or(default, |i| list[i].clone()))
+    }
+    LoxValue::Bytes(bytes) => {
+      let bytes = bytes.borrow();
+      let position = Interpreter::list_position("Bytes", bytes.data.len(), &arguments[1])?;
+      Ok(position.map_or(default, |i| LoxValue::Integer(bytes.data[i] as i64)))
+    }
+    LoxValue::Map(map) => Ok(map.borrow().get(&arguments[1], interpreter)?.unwrap_or(default)),
+    LoxValue::Instance(instance) => {
+      let name = expect_string(&arguments[1], "Field name")?;
+      Ok(instance.borrow().properties.get(&name).cloned().unwrap_or(default))
+    }
+    other => Err(format!("{} is not a list, a map or an instance.", other)),
+  }
+}
+
+fn expect_list(value: &LoxValue, native: &str) -> Result<Vec<LoxValue>, InterpreterError> {
+  match value {
+    LoxValue::List(list) => Ok(list.borrow().clone()),
+    other => Err(InterpreterError::call_error(native, format!("{}: {} is not a list.", native, other))),
+  }
+}
+
+// Calls a Lox value from native code with the same arity rules as a call
+// expression
+fn call_value(interpreter: &mut Interpreter, callee: &LoxValue, arguments: Vec<LoxValue>, native: &str) -> Result<LoxValue, InterpreterError> {
+  let callable = match callee.clone().as_callable() {
+    Some(callable) => callable,
+    None => return Err(InterpreterError::call_error(native, format!("{}: {} is not callable.", native, callee))),
+  };
+  let (min_arity, arity, variadic) = {
+    let callable = callable.borrow();
+    (callable.min_arity(), callable.arity(), callable.is_variadic())
+  };
+  if arguments.len() < min_arity || (arguments.len() > arity && !variadic) {
+    return Err(InterpreterError::call_error(
+      native,
+      format!("{}: callback must accept {} arguments.", native, arguments.len()),
+    ));
+  }
+  let result = callable.borrow().call(interpreter, arguments)?;
+  Ok(*result)
+}
+
+// sort(list) returns a new list of the numbers or strings in order, and
+// sortBy(list, comparator) one in the order the comparator gives. It returns a
+// negative number when its first argument should come first, as in JS. Both
+// are a hand-written merge sort: it is stable, and a comparator that fails or
+// isn't consistent can't break it.
+fn sort_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let elements = match &arguments[0] {
+    LoxValue::List(list) => list.borrow().clone(),
+    other => return Err(format!("{} is not a list.", other)),
+  };
+  let sorted = merge_sort(elements, &mut |left, right| natural_order(left, right).map(|order| order == Ordering::Greater))?;
+  Ok(new_list(sorted))
+}
+
+fn sort_by_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, InterpreterError> {
+  let elements = expect_list(&arguments[0], "sortBy")?;
+  let comparator = &arguments[1];
+  let sorted = merge_sort(elements, &mut |left, right| {
+    let order = call_value(interpreter, comparator, vec![left.clone(), right.clone()], "sortBy")?;
+    match Interpreter::as_float(&order) {
+      Some(order) => Ok(order > 0.0),
+      None => Err(InterpreterError::call_error("sortBy", format!("sortBy: comparator must return a number but got {}.", order))),
+    }
+  })?;
+  Ok(new_list(sorted))
+}
+
+// Numbers by value and strings by their characters. NaN isn't ordered
+// against anything, so it stays where it is.
+fn natural_order(left: &LoxValue, right: &LoxValue) -> Result<Ordering, String> {
+  let order = match (left, right) {
+    (LoxValue::String(l), LoxValue::String(r)) => Some(l.cmp(r)),
+    (LoxValue::Integer(l), LoxValue::Integer(r)) => Some(l.cmp(r)),
+    _ => match (Interpreter::as_bigints(left, right), Interpreter::as_float(left), Interpreter::as_float(right)) {
+      (Some((l, r)), _, _) => l.partial_cmp(&r),
+      (None, Some(l), Some(r)) => Some(l.partial_cmp(&r).unwrap_or(Ordering::Equal)),
+      _ => None,
+    },
+  };
+  order.ok_or_else(|| format!("Can't order {} and {}. Use sortBy() with a comparator for anything but numbers or strings.", left, right))
+}
+
+// `right_first(left, right)` says whether `right` belongs before `left`
+fn merge_sort<E>(mut elements: Vec<LoxValue>, right_first: &mut dyn FnMut(&LoxValue, &LoxValue) -> Result<bool, E>) -> Result<Vec<LoxValue>, E> {
+  if elements.len() <= 1 {
+    return Ok(elements);
+  }
+  let right = elements.split_off(elements.len() / 2);
+  let left = merge_sort(elements, right_first)?;
+  let right = merge_sort(right, right_first)?;
+  let mut merged = Vec::with_capacity(left.len() + right.len());
+  let (mut left, mut right) = (left.into_iter().peekable(), right.into_iter().peekable());
+  while let (Some(l), Some(r)) = (left.peek(), right.peek()) {
+    let take_right = right_first(l, r)?;
+    merged.push(if take_right { right.next().unwrap() } else { left.next().unwrap() });
+  }
+  merged.extend(left);
+  merged.extend(right);
+  Ok(merged)
+}
+
+// The generator's next value, or nil once it is exhausted
+fn next_native(interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, InterpreterError> {
+  match &arguments[0] {
+    LoxValue::Generator(generator) => Ok(LoxGenerator::next(generator, interpreter)?.unwrap_or(LoxValue::Nil)),
+    other => Err(InterpreterError::call_error("next", format!("next: {} is not a generator.", other))),
+  }
+}
+
+///////////// Reflection ///////////////
+/// Fields are the properties stored on an instance; methods live on its class.
+
+fn has_field_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let name = expect_string(&arguments[1], "Field name")?;
+  match &arguments[0] {
+    LoxValue::Instance(instance) => Ok(LoxValue::Boolean(instance.borrow().properties.contains_key(&name))),
+    _ => Ok(LoxValue::Boolean(false)),
+  }
+}
+
+fn get_field_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let instance = expect_instance(&arguments[0])?;
+  let name = expect_string(&arguments[1], "Field name")?;
+  match instance.borrow().properties.get(&name) {
+    Some(value) => Ok(value.clone()),
+    None => Err(format!("Undefined field '{}'.", name)),
+  }
+}
+
+fn set_field_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let instance = expect_instance(&arguments[0])?;
+  let name = expect_string(&arguments[1], "Field name")?;
+  if instance.borrow().frozen {
+    return Err(format!("Can't set '{}' on a frozen {}.", name, instance.borrow()));
+  }
+  instance.borrow_mut().set(name, arguments[2].clone());
+  Ok(arguments[2].clone())
+}
+
+fn fields_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let instance = expect_instance(&arguments[0])?;
+  let names: Vec<LoxValue> = instance.borrow().properties.keys().cloned().map(LoxValue::String).collect();
+  Ok(new_list(names))
+}
+
+fn methods_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  let mut klass = match &arguments[0] {
+    LoxValue::Class(klass) => Some(klass.clone()),
+    other => return Err(format!("{} is not a class.", other)),
+  };
+  let mut names: Vec<String> = Vec::new();
+  while let Some(current) = klass {
+    for name in current.methods.keys() {
+      if !names.contains(name) {
+        names.push(name.clone());
+      }
+    }
+    klass = current.superclass.map(|sc| sc.borrow().clone());
+  }
+  names.sort();
+  Ok(new_list(names.into_iter().map(LoxValue::String).collect()))
+}
+
+fn class_of_native(_interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<LoxValue, String> {
+  match &arguments[0] {
+    LoxValue::Instance(instance) => Ok(LoxValue::Class(instance.borrow().class.clone())),
+    _ => Ok(LoxValue::Nil),
+  }
+}
+
 #[derive(Clone)]
 pub struct LoxFunction {
   pub declaration: Rc<FunStmt>,
   pub closure: Rc<RefCell<Environment>>,
   pub is_initializer: bool,
+  // The instance bind() gave the method as `this`, which bound methods are
+  // compared by
+  pub receiver: Option<Rc<RefCell<LoxInstance>>>,
 }
 
 impl fmt::Debug for LoxFunction {
   fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
-    write!(f, "Loxfunction {{ name: {:?} }}", self.declaration.name)
+    write!(f, "<fn {}>", self.declaration.name.token)
   }
 }
 
 impl LoxFunction {
   pub fn new(declaration: Rc<FunStmt>, closure: Rc<RefCell<Environment>>, is_initializer: bool) -> Self {
-    Self { declaration, closure, is_initializer }
+    Self { declaration, closure, is_initializer, receiver: None }
   }
 
   pub fn bind(&self, instance: Rc<RefCell<LoxInstance>>) -> LoxFunction {
     let mut environment = Environment::new_enclosed(self.closure.clone());
-    environment.define("this".to_string(), LoxValue::Instance(instance));
-    LoxFunction::new(self.declaration.clone(), Rc::new(RefCell::new(environment)), self.is_initializer)
+    environment.define(symbol::THIS, LoxValue::Instance(instance.clone()));
+    let mut bound = LoxFunction::new(self.declaration.clone(), Rc::new(RefCell::new(environment)), self.is_initializer);
+    bound.receiver = Some(instance);
+    bound
   }
 }
 
-impl LoxCallable for LoxFunction {
-  fn call(&mut self, interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Box<LoxValue> {
-    let mut environment = Environment::new_enclosed(self.closure.clone());
+impl LoxFunction {
+  // Binds one slot per declared parameter (None falls back to the default)
+  // plus any extra positional arguments for a rest parameter, then runs the body.
+  fn invoke(&self, interpreter: &mut Interpreter, slots: Vec<Option<LoxValue>>, extra: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    let environment = Rc::new(RefCell::new(Environment::new_enclosed(self.closure.clone())));
     for (i, param) in self.declaration.params.iter().enumerate() {
-      environment.define(param.token.clone(), arguments[i].clone());
+      let value = match (&slots[i], &self.declaration.defaults[i]) {
+        (Some(argument), _) => argument.clone(),
+        (None, Some(default)) => interpreter.evaluate_in(default, environment.clone())?,
+        (None, None) => return Err(InterpreterError::call_error(
+          &self.declaration.name.token,
+          format!("Missing argument for parameter '{}'.", param.token),
+        )),
+      };
+      environment.borrow_mut().define(param.symbol, value);
+    }
+    if let Some(rest) = &self.declaration.rest {
+      environment.borrow_mut().define(rest.symbol, LoxValue::List(Rc::new(RefCell::new(extra))));
     }
-    let result = interpreter.execute_block(&self.declaration.body, Rc::new(RefCell::new(environment)));
+    if self.declaration.is_generator {
+      let generator = LoxGenerator::new(self.declaration.name.token.clone(), &self.declaration.body, environment);
+      return Ok(Box::new(LoxValue::Generator(Rc::new(RefCell::new(generator)))));
+    }
+    let result = interpreter.execute_block(&self.declaration.body, environment);
     if let Err(e) = result {
       match e.error_type {
         InterpreterErrorType::ReturnValue(value) => {
           if self.is_initializer {
-            let this = self.closure.borrow_mut().get_at(0, "this");
+            let this = self.closure.borrow_mut().get_at(0, symbol::THIS);
             match this {
-              Ok(value) => return Box::new(value),
+              Ok(value) => return Ok(Box::new(value)),
               Err(_) => panic!("Error: 'this' not found in closure."),
             }
           }
-          return value;
+          return Ok(value);
         }
-        _ => panic!("Error in function call: {:?}", e),
+        _ => return Err(e),
       }
     }
     if self.is_initializer {
-      let this = self.closure.borrow_mut().get_at(0, "this");
+      let this = self.closure.borrow_mut().get_at(0, symbol::THIS);
       match this {
         Ok(value) => {
-          return Box::new(value);
+          return Ok(Box::new(value));
         }
         Err(_) => panic!("Error: 'this' not found in closure."),
       }
     }
-    Box::new(LoxValue::Nil)
+    Ok(Box::new(LoxValue::Nil))
+  }
+}
+
+impl LoxCallable for LoxFunction {
+  fn call(&self, interpreter: &mut Interpreter, arguments: Vec<LoxValue>) -> Result<Box<LoxValue>, InterpreterError> {
+    let count = self.declaration.params.len();
+    let slots = (0..count).map(|i| arguments.get(i).cloned()).collect();
+    let extra = arguments.into_iter().skip(count).collect();
+    self.invoke(interpreter, slots, extra)
+  }
+
+  fn call_named(&self, interpreter: &mut Interpreter, arguments: Vec<LoxValue>, named: Vec<(String, LoxValue)>) -> Result<Box<LoxValue>, InterpreterError> {
+    let name = self.declaration.name.token.clone();
+    let params = &self.declaration.params;
+    if arguments.len() > params.len() && self.declaration.rest.is_none() {
+      return Err(InterpreterError::call_error(&name, format!(
+        "Expected at most {} arguments but got {}. {}.", params.len(), arguments.len(), self.declaration().unwrap())));
+    }
+    let mut slots: Vec<Option<LoxValue>> = (0..params.len()).map(|i| arguments.get(i).cloned()).collect();
+    for (arg_name, value) in named {
+      match params.iter().position(|p| p.token == arg_name) {
+        Some(i) if slots[i].is_some() => return Err(InterpreterError::call_error(&name, format!(
+          "Argument '{}' was passed more than once.", arg_name))),
+        Some(i) => slots[i] = Some(value),
+        None => return Err(InterpreterError::call_error(&name, format!(
+          "No parameter named '{}'.", arg_name))),
+      }
+    }
+    let extra = arguments.into_iter().skip(params.len()).collect();
+    self.invoke(interpreter, slots, extra)
   }
 
   fn arity(&self) -> usize {
     self.declaration.params.len()
   }
 
+  fn min_arity(&self) -> usize {
+    self.declaration.required_params()
+  }
+
+  fn is_variadic(&self) -> bool {
+    self.declaration.rest.is_some()
+  }
+
   fn box_clone(&self) -> Box<dyn LoxCallable> {
-    Box::new(LoxFunction::new(self.declaration.clone(), self.closure.clone(), self.is_initializer))
+    Box::new(self.clone())
+  }
+
+  fn closure(&self) -> Option<Rc<RefCell<Environment>>> {
+    Some(self.closure.clone())
+  }
+
+  fn bound_method(&self) -> Option<(Rc<FunStmt>, Rc<RefCell<LoxInstance>>)> {
+    self.receiver.clone().map(|receiver| (self.declaration.clone(), receiver))
+  }
+
+  // A method bound to an instance is named after the class that declares it,
+  // the way a class's arity error names its init
+  fn declaration(&self) -> Option<String> {
+    let name = &self.declaration.name;
+    let class = self.receiver.as_ref().and_then(|receiver| receiver.borrow().class.declaring_class(self));
+    let function = match class {
+      Some(class) => format!("{}.{}", class, name.token),
+      None => name.token.clone(),
+    };
+    Some(format!("{}({}) is declared at {}", function, doc::parameter_list(&self.declaration), logging::location(name)))
   }
 }
@@ -0,0 +1,96 @@
+/*
+Interned names. The lexer gives every identifier (and keyword) token the
+symbol for its text, so the resolver's scopes and the environments key on a
+small integer and compare names without comparing strings.
+
+The table is per thread. A symbol only means something next to the tokens
+and environments it came from, which hold Rcs and so never leave the thread
+that made them; Symbol isn't Send either, so a symbol can't be carried to a
+thread whose table numbers its names differently.
+*/
+
+use std::cell::RefCell;
+use std::collections::HashMap;
+use std::fmt;
+use std::marker::PhantomData;
+use std::rc::Rc;
+
+#[derive(Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord)]
+pub struct Symbol(u32, PhantomData<Rc<()>>);
+
+// Names the interpreter looks up itself, at fixed places in every table
+const RESERVED: [&str; 3] = ["", "this", "super"];
+pub const NONE: Symbol = Symbol(0, PhantomData);
+pub const THIS: Symbol = Symbol(1, PhantomData);
+pub const SUPER: Symbol = Symbol(2, PhantomData);
+
+struct Table {
+  ids: HashMap<Rc<str>, Symbol>,
+  names: Vec<Rc<str>>,
+}
+
+impl Table {
+  fn new() -> Self {
+    let mut table = Table { ids: HashMap::new(), names: Vec::new() };
+    for name in RESERVED {
+      table.intern(name);
+    }
+    table
+  }
+
+  fn intern(&mut self, name: &str) -> Symbol {
+    if let Some(symbol) = self.ids.get(name) {
+      return *symbol;
+    }
+    let symbol = Symbol(self.names.len() as u32, PhantomData);
+    let name: Rc<str> = Rc::from(name);
+    self.ids.insert(name.clone(), symbol);
+    self.names.push(name);
+    symbol
+  }
+}
+
+thread_local! {
+  static TABLE: RefCell<Table> = RefCell::new(Table::new());
+}
+
+// The symbol for a name, numbering it if it's new
+pub fn intern(name: &str) -> Symbol {
+  TABLE.with(|table| table.borrow_mut().intern(name))
+}
+
+impl Symbol {
+  pub fn name(self) -> Rc<str> {
+    TABLE.with(|table| table.borrow().names[self.0 as usize].clone())
+  }
+}
+
+impl From<&str> for Symbol {
+  fn from(name: &str) -> Self {
+    intern(name)
+  }
+}
+
+impl From<&String> for Symbol {
+  fn from(name: &String) -> Self {
+    intern(name)
+  }
+}
+
+impl From<String> for Symbol {
+  fn from(name: String) -> Self {
+    intern(&name)
+  }
+}
+
+impl fmt::Display for Symbol {
+  fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+    write!(f, "{}", self.name())
+  }
+}
+
+impl fmt::Debug for Symbol {
+  fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+    write!(f, "Symbol({:?})", self.name())
+  }
+}
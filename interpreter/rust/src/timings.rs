@@ -0,0 +1,61 @@
+/*
+Per-phase timings, for --timings: how long lexing, parsing, setting up the
+interpreter, resolving and running a script each took, or for `lox build`
+translating and compiling it, so it's clear which phase a slow script is
+spending its time in. They're printed to stderr once the script has run, or
+stopped at an error, and after a build that succeeds.
+*/
+
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+
+// Set by --timings
+static REPORT: AtomicBool = AtomicBool::new(false);
+
+pub fn set_report(enabled: bool) {
+  REPORT.store(enabled, Ordering::Relaxed);
+}
+
+pub fn report_enabled() -> bool {
+  REPORT.load(Ordering::Relaxed)
+}
+
+// The phases finished so far, each timed from the end of the one before
+pub struct Timings {
+  phases: Vec<(&'static str, Duration)>,
+  mark: Instant,
+}
+
+impl Timings {
+  pub fn start() -> Self {
+    Self { phases: Vec::new(), mark: Instant::now() }
+  }
+
+  pub fn finish(&mut self, phase: &'static str) {
+    let now = Instant::now();
+    self.phases.push((phase, now - self.mark));
+    self.mark = now;
+  }
+
+  pub fn summary(&self) -> String {
+    let mut out = String::from("Timings:\n");
+    let mut total = Duration::ZERO;
+    for (phase, elapsed) in &self.phases {
+      out.push_str(&format!("  {:<12}{:>10.3} ms\n", phase, millis(*elapsed)));
+      total += *elapsed;
+    }
+    out.push_str(&format!("  {:<12}{:>10.3} ms\n", "total", millis(total)));
+    out
+  }
+
+  // Prints the summary if --timings asked for it
+  pub fn report(&self) {
+    if report_enabled() {
+      eprint!("{}", self.summary());
+    }
+  }
+}
+
+fn millis(duration: Duration) -> f64 {
+  duration.as_secs_f64() * 1000.0
+}
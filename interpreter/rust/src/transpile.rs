@@ -0,0 +1,786 @@
+/*
+`lox build`: ahead-of-time translation of a script into a Go program.
+
+Every Lox value is a Go `any`, and runtime/lox_runtime.go supplies the
+operators, calls and natives with the same semantics as the interpreter. The
+generated code is appended to that file, so the result is one standalone
+main package.
+
+Names declared at the top level become package-level variables, so functions
+can refer to globals declared after them, and each top-level statement runs
+inside `statement`, which reports a runtime error and moves on just like
+Interpreter::interpret. Hoisted functions and classes (resolver::hoisted) are
+emitted ahead of the rest, in the order the interpreter runs them. Locals become Go locals with a numbered name (two Lox
+scopes can reuse a name where Go can't), and Lox closures become Go closures,
+which capture variables by reference the same way environments do.
+
+Generators, match expressions, named arguments and bigints aren't translated
+yet; a script using them is reported instead of being built.
+
+When it is given the script's path and source, each generated line is
+preceded by a `//line path:line:column` directive naming the Lox statement it
+came from, so Go panics, stack traces and debuggers like Delve point at the
+script rather than at the generated file. That includes the parts of a `for`
+loop, which end up on Go lines away from where they were written. Only the
+first directive spells out the path; Go carries it over to the rest.
+*/
+
+use crate::dialect::{self, Equality, Overflow, Truthiness};
+use crate::doc;
+use crate::ast::*;
+use crate::lexer::*;
+use crate::logging::*;
+use crate::resolver;
+use std::collections::{BTreeSet, HashMap};
+
+pub const RUNTIME: &str = include_str!("../runtime/lox_runtime.go");
+
+// Natives the runtime provides; it must be kept in step with stl.rs
+const NATIVES: &[&str] = &[
+  "clock", "len", "push", "get", "hasField", "getField", "setField", "fields", "methods", "classOf",
+  "identical", "zip", "range", "map", "filter", "reduce", "sort", "sortBy", "any", "all", "regex",
+  "DateTime", "sha256", "md5", "hmac", "base64Encode", "base64Decode", "uuid", "toFixed", "str", "num",
+  "nan", "inf", "isNaN", "isFinite",
+];
+const UNSUPPORTED_NATIVES: &[&str] = &[
+  "bigint", "next", "clone", "deepEquals", "freeze", "Set", "add", "has", "remove", "union", "intersect", "hash",
+  "Bytes", "slice", "toHex", "fromHex", "toBase64", "fromBase64", "toText", "readBytes", "writeBytes",
+  "listen", "connect", "ready", "open", "create", "weakRef", "format", "csvParse", "csvRead", "csvWrite", "memStats",
+  // The standard library written in Lox (stdlib.rs), which the runtime doesn't include
+  "std", "Error",
+];
+
+pub struct GoTranspiler {
+  out: String,
+  indent: usize,
+  // Lox name -> Go name for each enclosing local scope
+  scopes: Vec<HashMap<String, String>>,
+  // Every global read or written, declared as a package-level variable
+  globals: BTreeSet<String>,
+  next_id: usize,
+  // Whether each enclosing function is an initializer, innermost last
+  functions: Vec<bool>,
+  // The Go variable holding each enclosing class's superclass
+  superclasses: Vec<Option<String>>,
+  // The line of the last token seen, for errors on nodes without a token
+  line: usize,
+  source_map: Option<SourceMap>,
+  // The Lox line and column of the code being emitted
+  position: Option<(usize, usize)>,
+  // The script's name, which arity errors give declarations in
+  script: String,
+  pub had_error: bool,
+}
+
+struct SourceMap {
+  path: String,
+  // The offset each line of the script starts at
+  line_starts: Vec<usize>,
+  // Whether a directive has named the path yet
+  named: bool,
+}
+
+impl GoTranspiler {
+  pub fn new() -> Self {
+    Self {
+      out: String::new(),
+      indent: 0,
+      scopes: Vec::new(),
+      globals: BTreeSet::new(),
+      next_id: 0,
+      functions: Vec::new(),
+      superclasses: Vec::new(),
+      line: 0,
+      source_map: None,
+      position: None,
+      script: String::new(),
+      had_error: false,
+    }
+  }
+
+  // A transpiler whose output maps back to `source`, read from `path`
+  pub fn with_source_map(path: &str, source: &str) -> Self {
+    let mut line_starts = vec![0];
+    for (i, c) in source.chars().enumerate() {
+      if c == '\n' {
+        line_starts.push(i + 1);
+      }
+    }
+    Self { source_map: Some(SourceMap { path: path.to_string(), line_starts, named: false }), ..Self::new() }
+  }
+
+  // Returns the complete Go source for the script
+  pub fn transpile(&mut self, statements: &[Stmt], script: &str) -> String {
+    self.indent = 1;
+    self.script = script.to_string();
+    // Hoisted functions and classes first, as the interpreter runs them
+    let hoisted = resolver::hoisted(statements);
+    let first = statements.iter().zip(&hoisted).filter(|(_, hoisted)| **hoisted);
+    let rest = statements.iter().zip(&hoisted).filter(|(_, hoisted)| !**hoisted);
+    for (statement, _) in first.chain(rest) {
+      self.locate(statement.first_token());
+      self.emit("statement(func() {");
+      self.indent += 1;
+      self.statement(statement);
+      self.indent -= 1;
+      self.emit("})");
+    }
+
+    let mut program = format!("// Code generated by `lox build` from {}. DO NOT EDIT.\n\n", script);
+    program.push_str(RUNTIME);
+    program.push_str("\n///////////// Program ///////////////\n\n");
+    if !self.globals.is_empty() {
+      program.push_str("var (\n");
+      for name in &self.globals {
+        let initial = if NATIVES.contains(&name.as_str()) {
+          format!("natives[{}]", go_string(name))
+        } else {
+          "undefined".to_string()
+        };
+        program.push_str(&format!("\tg_{} Value = {}\n", name, initial));
+      }
+      program.push_str(")\n\n");
+    }
+    program.push_str("func main() {\n\tdefer finish()\n");
+    if dialect::overflow() != Overflow::Float {
+      program.push_str(&format!("\toverflowMode = {}\n", go_string(dialect::overflow().name())));
+    }
+    if dialect::truthiness() != Truthiness::Book {
+      program.push_str(&format!("\ttruthinessMode = {}\n", go_string(dialect::truthiness().name())));
+    }
+    if dialect::equality() != Equality::Deep {
+      program.push_str(&format!("\tequalityMode = {}\n", go_string(dialect::equality().name())));
+    }
+    program.push_str(&self.out);
+    program.push_str("}\n");
+    program
+  }
+
+  fn error(&mut self, token: &Token, message: &str) {
+    error_at_token(token, message);
+    self.had_error = true;
+  }
+
+  fn emit(&mut self, line: &str) {
+    // Go numbers the lines after a directive on from it, so every line needs
+    // its own
+    if let (Some(map), Some((line, column))) = (&mut self.source_map, self.position) {
+      let path = if map.named { "" } else { map.path.as_str() };
+      self.out.push_str(&format!("//line {}:{}:{}\n", path, line, column));
+      map.named = true;
+    }
+    for _ in 0..self.indent {
+      self.out.push('\t');
+    }
+    self.out.push_str(line);
+    self.out.push('\n');
+  }
+
+  // Attributes the lines emitted from here on to where the token is
+  fn locate(&mut self, token: Option<&Token>) {
+    if let (Some(map), Some(token)) = (&self.source_map, token) {
+      let start = map.line_starts.get(token.line.saturating_sub(1)).copied().unwrap_or(0);
+      self.position = Some((token.line, token.offset.saturating_sub(start) + 1));
+    }
+  }
+
+  fn temp(&mut self) -> String {
+    self.next_id += 1;
+    format!("t{}", self.next_id)
+  }
+
+  ///////////// Variables ///////////////
+
+  // Declares a name in the current scope and returns the Go variable for it.
+  // At the top level that is the name's package-level variable.
+  fn declare(&mut self, name: &Token) -> String {
+    self.line = name.line;
+    if self.scopes.is_empty() {
+      return self.global(name);
+    }
+    self.next_id += 1;
+    let go_name = format!("l{}_{}", self.next_id, name.token);
+    self.scopes.last_mut().unwrap().insert(name.token.clone(), go_name.clone());
+    go_name
+  }
+
+  // Declares a local and emits its Go declaration
+  fn define_local(&mut self, name: &Token, value: &str) -> String {
+    let go_name = self.declare(name);
+    if self.scopes.is_empty() {
+      self.emit(&format!("{} = {}", go_name, value));
+    } else {
+      self.emit(&format!("var {} Value = {}", go_name, value));
+      self.emit(&format!("_ = {}", go_name));
+    }
+    go_name
+  }
+
+  fn global(&mut self, name: &Token) -> String {
+    if UNSUPPORTED_NATIVES.contains(&name.token.as_str()) && !self.globals.contains(&name.token) {
+      self.error(name, &format!("'{}' is not supported by lox build yet.", name.token));
+    }
+    self.globals.insert(name.token.clone());
+    format!("g_{}", name.token)
+  }
+
+  fn local(&self, name: &str) -> Option<String> {
+    self.scopes.iter().rev().find_map(|scope| scope.get(name).cloned())
+  }
+
+  fn read_variable(&mut self, name: &Token) -> String {
+    self.line = name.line;
+    match self.local(&name.token) {
+      Some(go_name) => go_name,
+      None => {
+        let go_name = self.global(name);
+        format!("global({}, {}, {})", go_name, go_string(&name.token), name.line)
+      }
+    }
+  }
+
+  fn assign_variable(&mut self, name: &Token, value: &str) -> String {
+    match self.local(&name.token) {
+      Some(go_name) => format!("assign(&{}, {})", go_name, value),
+      None => {
+        let go_name = self.global(name);
+        format!("assignGlobal(&{}, {}, {}, {})", go_name, value, go_string(&name.token), name.line)
+      }
+    }
+  }
+
+  ///////////// Statements ///////////////
+
+  fn statement(&mut self, statement: &Stmt) {
+    self.locate(statement.first_token());
+    match statement {
+      Stmt::Block(block) => self.block(block),
+      Stmt::Expression(stmt) => match stmt.expression.as_ref() {
+        // Plain assignments to locals don't need to produce a value
+        Expr::Assign(assign) if self.local(&assign.name.token).is_some() => {
+          let value = self.expression(&assign.value);
+          let go_name = self.local(&assign.name.token).unwrap();
+          self.emit(&format!("{} = {}", go_name, value));
+        }
+        expression => {
+          let value = self.expression(expression);
+          self.emit(&format!("_ = {}", value));
+        }
+      },
+      Stmt::Print(stmt) => {
+        let values: Vec<String> = stmt.expressions.iter().map(|e| self.expression(e)).collect();
+        self.emit(&format!("printValue({})", values.join(", ")));
+      }
+      Stmt::Return(stmt) => {
+        self.line = stmt.keyword.line;
+        if self.functions.last() == Some(&true) {
+          self.emit("return this");
+        } else {
+          let value = match &stmt.value {
+            Some(value) => self.expression(value),
+            None => "nil".to_string(),
+          };
+          self.emit(&format!("return {}", value));
+        }
+      }
+      Stmt::Var(stmt) => {
+        let value = match &stmt.initializer {
+          Some(initializer) => self.expression(initializer),
+          None => "nil".to_string(),
+        };
+        self.define_local(&stmt.name, &value);
+      }
+      Stmt::Destructure(stmt) => {
+        if stmt.pattern.keys.is_some() {
+          self.error(&stmt.pattern.bracket, "Maps are not supported by lox build yet.");
+        }
+        let value = self.expression(&stmt.initializer);
+        let values = self.temp();
+        self.emit(&format!(
+          "{} := unpack({}, {}, {}, {})",
+          values, value, stmt.pattern.targets.len(), stmt.pattern.rest.is_some(), stmt.pattern.bracket.line
+        ));
+        for (i, target) in stmt.pattern.names().into_iter().enumerate() {
+          self.define_local(&target.name, &format!("{}[{}]", values, i));
+        }
+      }
+      Stmt::Fun(stmt) => {
+        let go_name = self.declare(&stmt.name);
+        if !self.scopes.is_empty() {
+          // Declared first so the body can call itself
+          self.emit(&format!("var {} Value", go_name));
+          self.emit(&format!("_ = {}", go_name));
+        }
+        self.function(&format!("{} = ", go_name), stmt, None, "");
+      }
+      Stmt::If(stmt) => {
+        let condition = self.expression(&stmt.condition);
+        self.emit(&format!("if truthy({}) {{", condition));
+        self.nested(&stmt.then_branch);
+        if let Some(else_branch) = &stmt.else_branch {
+          self.emit("} else {");
+          self.nested(else_branch);
+        }
+        self.emit("}");
+      }
+      Stmt::While(stmt) => self.while_loop(stmt),
+      Stmt::DoWhile(stmt) => {
+        self.emit("for {");
+        self.nested(&stmt.body);
+        self.indent += 1;
+        self.locate(stmt.condition.first_token());
+        let condition = self.expression(&stmt.condition);
+        self.emit(&format!("if !truthy({}) {{", condition));
+        self.emit("\tbreak");
+        self.emit("}");
+        self.indent -= 1;
+        self.emit("}");
+      }
+      Stmt::For(stmt) => {
+        self.emit("{");
+        self.indent += 1;
+        self.scopes.push(HashMap::new());
+        if let Some(initializer) = &stmt.initializer {
+          self.statement(initializer);
+        }
+        let condition = match &stmt.condition {
+          Some(condition) => {
+            self.locate(condition.first_token());
+            self.expression(condition)
+          }
+          None => "true".to_string(),
+        };
+        self.emit(&format!("for truthy({}) {{", condition));
+        self.nested(&stmt.body);
+        if let Some(increment) = &stmt.increment {
+          self.indent += 1;
+          self.locate(increment.first_token());
+          let increment = self.expression(increment);
+          self.emit(&format!("_ = {}", increment));
+          self.indent -= 1;
+        }
+        self.emit("}");
+        self.scopes.pop();
+        self.indent -= 1;
+        self.emit("}");
+      }
+      Stmt::ForIn(stmt) => self.for_in_loop(stmt),
+      Stmt::Break(_) => self.emit("break"),
+      Stmt::Class(stmt) => self.class(stmt),
+      // Traits are only checked by the resolver
+      Stmt::Trait(_) => (),
+      Stmt::Yield(stmt) => self.error(&stmt.keyword, "Generators are not supported by lox build yet."),
+      Stmt::Try(TryStmt { keyword, .. }) | Stmt::Throw(ThrowStmt { keyword, .. }) => {
+        self.error(keyword, "Exceptions are not supported by lox build yet.");
+      }
+      Stmt::Using(stmt) => self.error(&stmt.keyword, "Using blocks are not supported by lox build yet."),
+    }
+  }
+
+  fn block(&mut self, block: &BlockStmt) {
+    self.emit("{");
+    self.indent += 1;
+    self.scopes.push(HashMap::new());
+    for statement in &block.statements {
+      self.statement(statement);
+    }
+    self.scopes.pop();
+    self.indent -= 1;
+    self.emit("}");
+  }
+
+  // A branch or loop body, inside braces the caller has opened
+  fn nested(&mut self, statement: &Stmt) {
+    self.indent += 1;
+    match statement {
+      Stmt::Block(block) => {
+        self.scopes.push(HashMap::new());
+        for statement in &block.statements {
+          self.statement(statement);
+        }
+        self.scopes.pop();
+      }
+      statement => self.statement(statement),
+    }
+    self.indent -= 1;
+  }
+
+  // A loop with an `else` records whether it ran out rather than breaking, so
+  // the else branch can go after the loop where its own `break`s belong to
+  // the enclosing loop
+  fn while_loop(&mut self, stmt: &WhileStmt) {
+    let else_branch = match &stmt.else_branch {
+      Some(else_branch) => else_branch,
+      None => {
+        let condition = self.expression(&stmt.condition);
+        self.emit(&format!("for truthy({}) {{", condition));
+        self.nested(&stmt.body);
+        self.emit("}");
+        return;
+      }
+    };
+    let finished = self.temp();
+    self.emit(&format!("{} := false", finished));
+    self.emit("for {");
+    self.indent += 1;
+    self.locate(stmt.condition.first_token());
+    let condition = self.expression(&stmt.condition);
+    self.emit(&format!("if !truthy({}) {{", condition));
+    self.emit(&format!("\t{} = true", finished));
+    self.emit("\tbreak");
+    self.emit("}");
+    self.indent -= 1;
+    self.nested(&stmt.body);
+    self.emit("}");
+    self.emit(&format!("if {} {{", finished));
+    self.nested(else_branch);
+    self.emit("}");
+  }
+
+  fn for_in_loop(&mut self, stmt: &ForInStmt) {
+    let iterable = self.expression(&stmt.iterable);
+    let line = stmt.name.line;
+    let else_branch = match &stmt.else_branch {
+      Some(else_branch) => else_branch,
+      None => {
+        let item = self.temp();
+        self.emit(&format!("for _, {} := range iterate({}, {}) {{", item, iterable, line));
+        self.for_in_body(stmt, &item);
+        return;
+      }
+    };
+    let (items, index, finished) = (self.temp(), self.temp(), self.temp());
+    self.emit(&format!("{} := iterate({}, {})", items, iterable, line));
+    self.emit(&format!("{} := false", finished));
+    self.emit(&format!("for {} := 0; ; {}++ {{", index, index));
+    self.emit(&format!("\tif {} == len({}) {{", index, items));
+    self.emit(&format!("\t\t{} = true", finished));
+    self.emit("\t\tbreak");
+    self.emit("\t}");
+    self.for_in_body(stmt, &format!("{}[{}]", items, index));
+    self.emit(&format!("if {} {{", finished));
+    self.nested(else_branch);
+    self.emit("}");
+  }
+
+  // Each iteration gets its own variable, as each gets its own environment
+  fn for_in_body(&mut self, stmt: &ForInStmt, item: &str) {
+    self.indent += 1;
+    self.scopes.push(HashMap::new());
+    self.define_local(&stmt.name, item);
+    self.indent -= 1;
+    self.nested(&stmt.body);
+    self.scopes.pop();
+    self.emit("}");
+  }
+
+  // Emits `prefix&Function{...}suffix`, with the body on the lines between.
+  // A method is given the class it's declared in.
+  fn function(&mut self, prefix: &str, stmt: &FunStmt, class: Option<&str>, suffix: &str) {
+    let initializer = class.is_some() && stmt.name.token == "init";
+    let name = match class {
+      Some(class) => format!("{}.{}", class, stmt.name.token),
+      None => stmt.name.token.clone(),
+    };
+    self.locate(Some(&stmt.name));
+    if stmt.is_generator {
+      self.error(&stmt.name, "Generators are not supported by lox build yet.");
+    }
+    self.emit(&format!(
+      "{}&Function{{Name: {}, Params: {}, Required: {}, Variadic: {}, Declaration: {}, Body: func(args []Value) Value {{",
+      prefix, go_string(&stmt.name.token), stmt.params.len(), stmt.required_params(), stmt.rest.is_some(),
+      go_string(&format!("{}({}) is declared at {}:{}", name, doc::parameter_list(stmt), self.script, stmt.name.line))
+    ));
+    self.indent += 1;
+    self.scopes.push(HashMap::new());
+    self.functions.push(initializer);
+    for (i, (param, default)) in stmt.params.iter().zip(&stmt.defaults).enumerate() {
+      self.locate(Some(param));
+      match default {
+        None => {
+          self.define_local(param, &format!("args[{}]", i));
+        }
+        // Defaults see the parameters before them
+        Some(default) => {
+          let go_name = self.define_local(param, "nil");
+          self.emit(&format!("if len(args) > {} {{", i));
+          self.emit(&format!("\t{} = args[{}]", go_name, i));
+          self.emit("} else {");
+          self.indent += 1;
+          let value = self.expression(default);
+          self.emit(&format!("{} = {}", go_name, value));
+          self.indent -= 1;
+          self.emit("}");
+        }
+      }
+    }
+    if let Some(rest) = &stmt.rest {
+      self.define_local(rest, &format!("restArgs(args, {})", stmt.params.len()));
+    }
+    self.block(&stmt.body);
+    self.emit(if initializer { "return this" } else { "return nil" });
+    self.functions.pop();
+    self.scopes.pop();
+    self.indent -= 1;
+    self.emit(&format!("}}}}{}", suffix));
+  }
+
+  fn class(&mut self, stmt: &ClassStmt) {
+    let go_name = self.declare(&stmt.name);
+    if !self.scopes.is_empty() {
+      self.emit(&format!("var {} Value", go_name));
+      self.emit(&format!("_ = {}", go_name));
+    }
+    self.emit("{");
+    self.indent += 1;
+    let superclass = match stmt.superclass.as_deref() {
+      Some(Expr::Variable(variable)) => {
+        let value = self.read_variable(&variable.name);
+        let superclass = self.temp();
+        self.emit(&format!("{} := superclass({}, {})", superclass, value, variable.name.line));
+        Some(superclass)
+      }
+      _ => None,
+    };
+    let class = self.temp();
+    self.emit(&format!(
+      "{} := &Class{{Name: {}, Super: {}, Methods: map[string]func(*Instance) *Function{{}}}}",
+      class, go_string(&stmt.name.token), superclass.clone().unwrap_or("nil".to_string())
+    ));
+    self.superclasses.push(superclass);
+    for method in &stmt.methods {
+      self.emit(&format!("{}.Methods[{}] = func(this *Instance) *Function {{", class, go_string(&method.name.token)));
+      self.indent += 1;
+      self.function("return ", method, Some(&stmt.name.token), "");
+      self.indent -= 1;
+      self.emit("}");
+    }
+    self.superclasses.pop();
+    self.emit(&format!("{} = {}", go_name, class));
+    self.indent -= 1;
+    self.emit("}");
+  }
+
+  ///////////// Expressions ///////////////
+
+  fn expression(&mut self, expr: &Expr) -> String {
+    match expr {
+      Expr::Literal(literal) => self.literal(&literal.literal),
+      Expr::Grouping(grouping) => format!("({})", self.expression(&grouping.expression)),
+      Expr::Unary(unary) => {
+        self.line = unary.operator.line;
+        let right = self.expression(&unary.right);
+        match unary.operator.token_type {
+          TokenType::Minus => format!("negate({}, {})", right, unary.operator.line),
+          _ => format!("!truthy({})", right),
+        }
+      }
+      Expr::Binary(binary) => {
+        let left = self.expression(&binary.left);
+        let right = self.expression(&binary.right);
+        let line = binary.operator.line;
+        self.line = line;
+        match binary.operator.token_type {
+          TokenType::Plus => format!("add({}, {}, {})", left, right, line),
+          TokenType::Minus | TokenType::Star | TokenType::Slash => {
+            format!("numeric('{}', {}, {}, {})", binary.operator.token, left, right, line)
+          }
+          TokenType::Greater | TokenType::GreaterEqual | TokenType::Less | TokenType::LessEqual => {
+            format!("compare({}, {}, {}, {})", go_string(&binary.operator.token), left, right, line)
+          }
+          TokenType::EqualEqual => format!("isEqual({}, {})", left, right),
+          TokenType::BangEqual => format!("!isEqual({}, {})", left, right),
+          _ => format!("isInstance({}, {}, {})", left, right, line),
+        }
+      }
+      // Each operand is held in a temporary so it's evaluated once, and the
+      // ones after a false comparison aren't evaluated at all
+      Expr::Comparison(comparison) => {
+        let mut left = self.temp();
+        let mut body = format!("var {} Value = {}", left, self.expression(&comparison.left));
+        for (i, (operator, right)) in comparison.comparisons.iter().enumerate() {
+          let value = self.temp();
+          body.push_str(&format!("; var {} Value = {}", value, self.expression(right)));
+          let compare = format!("compare({}, {}, {}, {})", go_string(&operator.token), left, value, operator.line);
+          if i + 1 == comparison.comparisons.len() {
+            body.push_str(&format!("; return {}", compare));
+          } else {
+            body.push_str(&format!("; if !truthy({}) {{ return false }}", compare));
+          }
+          left = value;
+        }
+        format!("func() Value {{ {} }}()", body)
+      }
+      Expr::Logical(logical) => {
+        let left = self.expression(&logical.left);
+        let right = self.expression(&logical.right);
+        let value = self.temp();
+        let keep_left = match logical.operator.token_type {
+          TokenType::QuestionQuestion => format!("{} != nil", value),
+          TokenType::Or => format!("truthy({})", value),
+          _ => format!("!truthy({})", value),
+        };
+        format!("func() Value {{ var {} Value = {}; if {} {{ return {} }}; return {} }}()", value, left, keep_left, value, right)
+      }
+      Expr::Variable(variable) => self.read_variable(&variable.name),
+      Expr::Assign(assign) => {
+        let value = self.expression(&assign.value);
+        self.assign_variable(&assign.name, &value)
+      }
+      Expr::DestructureAssign(assign) => {
+        if assign.pattern.keys.is_some() {
+          self.error(&assign.pattern.bracket, "Maps are not supported by lox build yet.");
+        }
+        let value = self.expression(&assign.value);
+        let (whole, values) = (self.temp(), self.temp());
+        let pattern = &assign.pattern;
+        let mut body = format!(
+          "{} := {}; {} := unpack({}, {}, {}, {}); ",
+          whole, value, values, whole, pattern.targets.len(), pattern.rest.is_some(), pattern.bracket.line
+        );
+        for (i, target) in pattern.names().into_iter().enumerate() {
+          body.push_str(&self.assign_variable(&target.name, &format!("{}[{}]", values, i)));
+          body.push_str("; ");
+        }
+        format!("func() Value {{ {}return {} }}()", body, whole)
+      }
+      Expr::Call(call) => {
+        self.line = call.paren.line;
+        if let Some((name, _)) = call.named_arguments.first() {
+          self.error(name, "Named arguments are not supported by lox build yet.");
+        }
+        let callee = self.expression(&call.callee);
+        let arguments = self.spreadable(&call.arguments);
+        format!("call({}, {}, {})", callee, arguments, call.paren.line)
+      }
+      Expr::Get(get) => {
+        let object = self.expression(&get.object);
+        format!("getProperty({}, {}, {})", object, go_string(&get.name.token), get.name.line)
+      }
+      Expr::OptionalGet(get) => {
+        let object = self.expression(&get.object);
+        format!("optionalGet({}, {}, {})", object, go_string(&get.name.token), get.name.line)
+      }
+      Expr::OptionalIndex(index) => {
+        let object = self.expression(&index.object);
+        let position = self.expression(&index.index);
+        format!("optionalIndex({}, {}, {})", object, position, index.bracket.line)
+      }
+      Expr::OptionalChain(chain) => {
+        let chain = self.expression(&chain.expression);
+        format!("optionalChain(func() Value {{ return {} }})", chain)
+      }
+      Expr::Set(set) => {
+        let object = self.expression(&set.object);
+        let value = self.expression(&set.value);
+        format!("setProperty({}, {}, {}, {})", object, go_string(&set.name.token), value, set.name.line)
+      }
+      Expr::This(_) => "this".to_string(),
+      Expr::Super(expr) => match self.superclasses.last().cloned().flatten() {
+        Some(superclass) => format!(
+          "superMethod({}, {}, this, {})",
+          superclass, go_string(&expr.method.token), expr.method.line
+        ),
+        None => {
+          self.error(&expr.keyword, "Can't use 'super' in a class with no superclass.");
+          "nil".to_string()
+        }
+      },
+      Expr::List(list) => format!("newList({})", self.spreadable(&list.elements)),
+      Expr::SetLiteral(set) => {
+        self.error(&set.brace, "Sets are not supported by lox build yet.");
+        "nil".to_string()
+      }
+      Expr::MapLiteral(map) => {
+        self.error(&map.brace, "Maps are not supported by lox build yet.");
+        "nil".to_string()
+      }
+      Expr::Index(index) => {
+        let object = self.expression(&index.object);
+        let position = self.expression(&index.index);
+        format!("getIndex({}, {}, {})", object, position, index.bracket.line)
+      }
+      Expr::IndexSet(index) => {
+        let object = self.expression(&index.object);
+        let position = self.expression(&index.index);
+        let value = self.expression(&index.value);
+        format!("setIndex({}, {}, {}, {})", object, position, value, index.bracket.line)
+      }
+      Expr::Spread(spread) => {
+        self.error(&spread.ellipsis, "Spread is only allowed in argument lists and list literals.");
+        "nil".to_string()
+      }
+      Expr::Interpolation(interpolation) => {
+        let parts: Vec<String> = interpolation.parts.iter().map(|part| self.expression(part)).collect();
+        format!("interpolate({})", parts.join(", "))
+      }
+      Expr::Match(expr) => {
+        self.error(&expr.keyword, "Match expressions are not supported by lox build yet.");
+        "nil".to_string()
+      }
+    }
+  }
+
+  fn literal(&mut self, value: &LoxValue) -> String {
+    match value {
+      LoxValue::Nil => "nil".to_string(),
+      LoxValue::Boolean(b) => b.to_string(),
+      LoxValue::Integer(n) => format!("int64({})", n),
+      LoxValue::Number(n) if n.is_nan() => "math.NaN()".to_string(),
+      LoxValue::Number(n) if n.is_infinite() => format!("math.Inf({})", n.signum()),
+      LoxValue::Number(n) => format!("float64({:?})", n),
+      LoxValue::String(s) => go_string(s),
+      _ => {
+        error_at_line(self.line, "Bigint literals are not supported by lox build yet.");
+        self.had_error = true;
+        "nil".to_string()
+      }
+    }
+  }
+
+  // A []Value for argument or element expressions, joining `...list` spreads in
+  fn spreadable(&mut self, exprs: &[Expr]) -> String {
+    if exprs.is_empty() {
+      return "nil".to_string();
+    }
+    let mut parts: Vec<String> = Vec::new();
+    let mut run: Vec<String> = Vec::new();
+    for expr in exprs {
+      if let Expr::Spread(spread) = expr {
+        if !run.is_empty() {
+          parts.push(format!("[]Value{{{}}}", run.join(", ")));
+          run.clear();
+        }
+        let list = self.expression(&spread.expression);
+        parts.push(format!("spread({}, {})", list, spread.ellipsis.line));
+      } else {
+        run.push(self.expression(expr));
+      }
+    }
+    if parts.is_empty() {
+      return format!("[]Value{{{}}}", run.join(", "));
+    }
+    if !run.is_empty() {
+      parts.push(format!("[]Value{{{}}}", run.join(", ")));
+    }
+    format!("concat({})", parts.join(", "))
+  }
+}
+
+// A Go string literal with the same contents
+fn go_string(text: &str) -> String {
+  let mut out = String::from("\"");
+  for c in text.chars() {
+    match c {
+      '"' => out.push_str("\\\""),
+      '\\' => out.push_str("\\\\"),
+      '\n' => out.push_str("\\n"),
+      '\r' => out.push_str("\\r"),
+      '\t' => out.push_str("\\t"),
+      c if (c as u32) < 0x20 || c == '\u{7f}' => out.push_str(&format!("\\x{:02x}", c as u32)),
+      c => out.push(c),
+    }
+  }
+  out.push('"');
+  out
+}
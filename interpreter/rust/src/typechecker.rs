@@ -0,0 +1,774 @@
+/*
+Optional static typing, run by `lox check --types`.
+
+Annotations are only ever checked here; the interpreter ignores them. Anything
+without an annotation is treated as Any, which is compatible with every type,
+so unannotated code stays dynamic and never produces type errors.
+*/
+
+use crate::ast::*;
+use crate::callable::expected_arguments;
+use crate::lexer::*;
+use crate::logging::*;
+use std::collections::HashMap;
+use std::fmt;
+
+#[derive(Debug, Clone, PartialEq)]
+pub enum Type {
+  Any,
+  Number,
+  String,
+  Bool,
+  Nil,
+  List,
+  Set,
+  Map,
+  Function,
+  Class(String),
+  Instance(String),
+  // Only ever the type of a `...list` argument
+  Spread,
+}
+
+impl fmt::Display for Type {
+  fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+    match self {
+      Type::Any => write!(f, "Any"),
+      Type::Number => write!(f, "Number"),
+      Type::String => write!(f, "String"),
+      Type::Bool => write!(f, "Bool"),
+      Type::Nil => write!(f, "Nil"),
+      Type::List => write!(f, "List"),
+      Type::Set => write!(f, "Set"),
+      Type::Map => write!(f, "Map"),
+      Type::Function => write!(f, "Function"),
+      Type::Class(name) => write!(f, "class {}", name),
+      Type::Instance(name) => write!(f, "{}", name),
+      Type::Spread => write!(f, "..."),
+    }
+  }
+}
+
+#[derive(Debug, Clone)]
+struct Signature {
+  params: Vec<Type>,
+  required: usize,
+  variadic: bool,
+  ret: Type,
+}
+
+#[derive(Debug, Clone)]
+struct Binding {
+  var_type: Type,
+  signature: Option<Signature>,
+}
+
+pub struct TypeChecker {
+  scopes: Vec<HashMap<String, Binding>>,
+  superclasses: HashMap<String, Option<String>>,
+  methods: HashMap<String, HashMap<String, Signature>>,
+  current_return: Option<Type>,
+  current_class: Option<String>,
+  pub had_error: bool,
+}
+
+impl TypeChecker {
+  pub fn new() -> Self {
+    Self {
+      scopes: vec![HashMap::new()],
+      superclasses: HashMap::new(),
+      methods: HashMap::new(),
+      current_return: None,
+      current_class: None,
+      had_error: false,
+    }
+  }
+
+  pub fn check(&mut self, statements: &[Stmt]) {
+    // Classes can be used as annotations before their declaration, so collect
+    // every class name first and then their method signatures.
+    let mut classes = Vec::new();
+    TypeChecker::collect_classes(statements, &mut classes);
+    for class in &classes {
+      let superclass = match class.superclass.as_deref() {
+        Some(Expr::Variable(superclass)) => Some(superclass.name.token.clone()),
+        _ => None,
+      };
+      self.superclasses.insert(class.name.token.clone(), superclass);
+    }
+    for class in &classes {
+      let mut signatures = HashMap::new();
+      for method in &class.methods {
+        signatures.insert(method.name.token.clone(), self.signature(method));
+      }
+      self.methods.insert(class.name.token.clone(), signatures);
+    }
+
+    for statement in statements {
+      self.check_stmt(statement);
+    }
+  }
+
+  fn collect_classes(statements: &[Stmt], classes: &mut Vec<ClassStmt>) {
+    for statement in statements {
+      match statement {
+        Stmt::Class(class) => classes.push(class.clone()),
+        Stmt::Block(block) => TypeChecker::collect_classes(&block.statements, classes),
+        Stmt::Fun(function) => TypeChecker::collect_classes(&function.body.statements, classes),
+        _ => (),
+      }
+    }
+  }
+
+  fn error(&mut self, token: &Token, message: &str) {
+    error_at_token(token, message);
+    self.had_error = true;
+  }
+
+  fn warning(&mut self, token: &Token, message: &str) {
+    if diagnostic(Severity::Warning, token, message) {
+      self.had_error = true;
+    }
+  }
+
+  // == and != between types that are never equal, like Number and String.
+  // Instances of different classes are left alone, since one may inherit
+  // from the other.
+  fn check_equality(&mut self, operator: &Token, left: &Type, right: &Type) {
+    let kind = |t: &Type| match t {
+      Type::Any | Type::Nil | Type::Spread => None,
+      Type::Class(_) => Some("class"),
+      Type::Instance(_) => Some("instance"),
+      other => Some(match other {
+        Type::Number => "number",
+        Type::String => "string",
+        Type::Bool => "bool",
+        Type::List => "list",
+        Type::Set => "set",
+        Type::Map => "map",
+        _ => "function",
+      }),
+    };
+    if let (Some(l), Some(r)) = (kind(left), kind(right)) {
+      if l != r {
+        let always = if operator.token_type == TokenType::EqualEqual { "false" } else { "true" };
+        self.warning(operator, &format!("Comparing {} with {} using '{}' is always {}.", left, right, operator.token, always));
+      }
+    }
+  }
+
+  fn check_stmt(&mut self, statement: &Stmt) {
+    match statement {
+      Stmt::Block(stmt) => self.visitBlockStmt(stmt),
+      Stmt::Expression(stmt) => self.visitExpressionStmt(stmt),
+      Stmt::Print(stmt) => self.visitPrintStmt(stmt),
+      Stmt::Return(stmt) => self.visitReturnStmt(stmt),
+      Stmt::Var(stmt) => self.visitVarStmt(stmt),
+      Stmt::Destructure(stmt) => self.visitDestructureStmt(stmt),
+      Stmt::Fun(stmt) => self.visitFunStmt(stmt),
+      Stmt::If(stmt) => self.visitIfStmt(stmt),
+      Stmt::While(stmt) => self.visitWhileStmt(stmt),
+      Stmt::For(stmt) => self.visitForStmt(stmt),
+      Stmt::Class(stmt) => self.visitClassStmt(stmt),
+      Stmt::Trait(stmt) => self.visitTraitStmt(stmt),
+      Stmt::Yield(stmt) => self.visitYieldStmt(stmt),
+      Stmt::ForIn(stmt) => self.visitForInStmt(stmt),
+      Stmt::DoWhile(stmt) => self.visitDoWhileStmt(stmt),
+      Stmt::Break(stmt) => self.visitBreakStmt(stmt),
+      Stmt::Try(stmt) => self.visitTryStmt(stmt),
+      Stmt::Throw(stmt) => self.visitThrowStmt(stmt),
+      Stmt::Using(stmt) => self.visitUsingStmt(stmt),
+    }
+  }
+
+  fn check_expr(&mut self, expr: &Expr) -> Type {
+    match expr {
+      Expr::Assign(expr) => self.visitAssignExpression(expr),
+      Expr::Binary(expr) => self.visitBinaryExpr(expr),
+      Expr::Call(expr) => self.visitCallExpr(expr),
+      Expr::Get(expr) => self.visitGetExpr(expr),
+      Expr::OptionalGet(expr) => self.visitOptionalGetExpr(expr),
+      Expr::OptionalIndex(expr) => self.visitOptionalIndexExpr(expr),
+      Expr::OptionalChain(expr) => self.visitOptionalChainExpr(expr),
+      Expr::Match(expr) => self.visitMatchExpr(expr),
+      Expr::Comparison(expr) => self.visitComparisonExpr(expr),
+      Expr::Set(expr) => self.visitSetExpr(expr),
+      Expr::Grouping(expr) => self.visitGroupingExpr(expr),
+      Expr::Literal(expr) => self.visitLiteralExpr(expr),
+      Expr::Unary(expr) => self.visitUnaryExpr(expr),
+      Expr::Variable(expr) => self.visitVariableExpression(expr),
+      Expr::Logical(expr) => self.visitLogicalExpression(expr),
+      Expr::Super(expr) => self.visitSuperExpression(expr),
+      Expr::This(expr) => self.visitThisExpression(expr),
+      Expr::List(expr) => self.visitListExpr(expr),
+      Expr::SetLiteral(expr) => self.visitSetLiteralExpr(expr),
+      Expr::MapLiteral(expr) => self.visitMapLiteralExpr(expr),
+      Expr::Index(expr) => self.visitIndexExpr(expr),
+      Expr::IndexSet(expr) => self.visitIndexSetExpr(expr),
+      Expr::Spread(expr) => self.visitSpreadExpr(expr),
+      Expr::DestructureAssign(expr) => self.visitDestructureAssignExpr(expr),
+      Expr::Interpolation(expr) => self.visitInterpolationExpr(expr),
+    }
+  }
+
+  // Unknown names are reported while checking statements, so this stays quiet
+  fn annotation_type(&self, annotation: &Option<Token>) -> Type {
+    match annotation {
+      None => Type::Any,
+      Some(token) => match token.token.as_str() {
+        "Any" => Type::Any,
+        "Number" => Type::Number,
+        "String" => Type::String,
+        "Bool" => Type::Bool,
+        "Nil" => Type::Nil,
+        "List" => Type::List,
+        "Set" => Type::Set,
+        "Map" => Type::Map,
+        "Function" => Type::Function,
+        name if self.superclasses.contains_key(name) => Type::Instance(name.to_string()),
+        _ => Type::Any,
+      },
+    }
+  }
+
+  fn check_annotation(&mut self, annotation: &Option<Token>) -> Type {
+    if let Some(token) = annotation {
+      let known = ["Any", "Number", "String", "Bool", "Nil", "List", "Set", "Map", "Function"];
+      if !known.contains(&token.token.as_str()) && !self.superclasses.contains_key(&token.token) {
+        self.error(token, &format!("Unknown type '{}'.", token.token));
+      }
+    }
+    self.annotation_type(annotation)
+  }
+
+  fn signature(&self, function: &FunStmt) -> Signature {
+    Signature {
+      params: function.param_types.iter().map(|t| self.annotation_type(t)).collect(),
+      required: function.required_params(),
+      variadic: function.rest.is_some(),
+      ret: self.annotation_type(&function.return_type),
+    }
+  }
+
+  fn is_subclass(&self, class: &str, ancestor: &str) -> bool {
+    let mut current = Some(class.to_string());
+    while let Some(name) = current {
+      if name == ancestor {
+        return true;
+      }
+      current = self.superclasses.get(&name).cloned().flatten();
+    }
+    false
+  }
+
+  fn assignable(&self, expected: &Type, actual: &Type) -> bool {
+    match (expected, actual) {
+      (Type::Any, _) | (_, Type::Any) => true,
+      (Type::Function, Type::Class(_)) => true,
+      (Type::Function, Type::Instance(class)) => self.method_signature(class, "call").is_some(),
+      (Type::Instance(e), Type::Instance(a)) => self.is_subclass(a, e),
+      _ => expected == actual,
+    }
+  }
+
+  fn define(&mut self, name: &str, var_type: Type, signature: Option<Signature>) {
+    self.scopes.last_mut().unwrap().insert(name.to_string(), Binding { var_type, signature });
+  }
+
+  fn lookup(&self, name: &str) -> Option<Binding> {
+    for scope in self.scopes.iter().rev() {
+      if let Some(binding) = scope.get(name) {
+        return Some(binding.clone());
+      }
+    }
+    None
+  }
+
+  fn method_signature(&self, class: &str, name: &str) -> Option<Signature> {
+    let mut current = Some(class.to_string());
+    while let Some(class_name) = current {
+      if let Some(signature) = self.methods.get(&class_name).and_then(|m| m.get(name)) {
+        return Some(signature.clone());
+      }
+      current = self.superclasses.get(&class_name).cloned().flatten();
+    }
+    None
+  }
+
+  // What `object.name` is: a function when it names one of the class's
+  // methods, and otherwise anything, since fields aren't declared
+  fn property_type(&self, object: &Type, name: &Token) -> Type {
+    match object {
+      Type::Instance(class) if self.method_signature(class, &name.token).is_some() => Type::Function,
+      _ => Type::Any,
+    }
+  }
+
+  fn check_arguments(&mut self, paren: &Token, signature: &Signature, arg_types: &[Type]) {
+    // A spread argument could expand to any number of values
+    if arg_types.contains(&Type::Spread) {
+      return;
+    }
+    if arg_types.len() < signature.required || (arg_types.len() > signature.params.len() && !signature.variadic) {
+      let expected = expected_arguments(signature.required, signature.params.len(), signature.variadic);
+      self.error(paren, &format!("Expected {} arguments but got {}.", expected, arg_types.len()));
+      return;
+    }
+    for (i, (expected, actual)) in signature.params.iter().zip(arg_types).enumerate() {
+      if !self.assignable(expected, actual) {
+        self.error(paren, &format!("Argument {} must be {} but got {}.", i + 1, expected, actual));
+      }
+    }
+  }
+
+  fn check_destructure(&mut self, pattern: &DestructurePattern, value: &Type) {
+    let expected = if pattern.keys.is_some() { Type::Map } else { Type::List };
+    if !self.assignable(&expected, value) {
+      self.error(&pattern.bracket, &format!("Can only destructure a {}, not {}.", expected, value));
+    }
+  }
+
+  fn check_numeric(&mut self, operator: &Token, operand: &Type) {
+    if !self.assignable(&Type::Number, operand) {
+      self.error(operator, &format!("Operand of '{}' must be a Number but got {}.", operator.token, operand));
+    }
+  }
+
+  fn check_function(&mut self, function: &FunStmt, this_class: Option<String>) {
+    for annotation in &function.param_types {
+      self.check_annotation(annotation);
+    }
+    self.check_annotation(&function.return_type);
+    let signature = self.signature(function);
+
+    let enclosing_return = self.current_return.replace(signature.ret.clone());
+    let enclosing_class = self.current_class.clone();
+    if this_class.is_some() {
+      self.current_class = this_class;
+    }
+    self.scopes.push(HashMap::new());
+    for ((param, param_type), default) in function.params.iter().zip(signature.params).zip(&function.defaults) {
+      if let Some(default) = default {
+        let actual = self.check_expr(default);
+        if !self.assignable(&param_type, &actual) {
+          self.error(param, &format!("Default for '{}' must be {} but got {}.", param.token, param_type, actual));
+        }
+      }
+      self.define(&param.token, param_type, None);
+    }
+    if let Some(rest) = &function.rest {
+      self.define(&rest.token, Type::List, None);
+    }
+    for statement in &function.body.statements {
+      self.check_stmt(statement);
+    }
+    self.scopes.pop();
+    self.current_class = enclosing_class;
+    self.current_return = enclosing_return;
+  }
+}
+
+impl ExprVisitor<Type> for TypeChecker {
+  fn visitLiteralExpr(&mut self, expr: &LiteralExpr) -> Type {
+    match expr.literal {
+      LoxValue::Number(_) | LoxValue::Integer(_) | LoxValue::BigInt(_) => Type::Number,
+      LoxValue::String(_) => Type::String,
+      LoxValue::Boolean(_) => Type::Bool,
+      LoxValue::Nil => Type::Nil,
+      _ => Type::Any,
+    }
+  }
+
+  fn visitGroupingExpr(&mut self, expr: &GroupingExpr) -> Type {
+    self.check_expr(&expr.expression)
+  }
+
+  fn visitUnaryExpr(&mut self, expr: &UnaryExpr) -> Type {
+    let right = self.check_expr(&expr.right);
+    match expr.operator.token_type {
+      TokenType::Minus => {
+        self.check_numeric(&expr.operator, &right);
+        Type::Number
+      }
+      _ => Type::Bool,
+    }
+  }
+
+  fn visitBinaryExpr(&mut self, expr: &BinaryExpr) -> Type {
+    let left = self.check_expr(&expr.left);
+    let right = self.check_expr(&expr.right);
+    match expr.operator.token_type {
+      TokenType::Plus => match (&left, &right) {
+        (Type::Number, Type::Number) => Type::Number,
+        (Type::String, Type::String) | (Type::String, Type::Number) | (Type::Number, Type::String) => Type::String,
+        (Type::String, Type::Instance(_)) | (Type::Instance(_), Type::String) => Type::String,
+        (Type::Any, Type::Any) | (Type::Any, Type::Number) | (Type::Number, Type::Any) => Type::Any,
+        (Type::Any, Type::String) | (Type::String, Type::Any) => Type::String,
+        (Type::Any, Type::Instance(_)) | (Type::Instance(_), Type::Any) => Type::String,
+        _ => {
+          self.error(&expr.operator, &format!("Cannot add {} and {}.", left, right));
+          Type::Any
+        }
+      },
+      TokenType::Minus | TokenType::Star | TokenType::Slash => {
+        self.check_numeric(&expr.operator, &left);
+        self.check_numeric(&expr.operator, &right);
+        Type::Number
+      }
+      TokenType::Greater | TokenType::GreaterEqual | TokenType::Less | TokenType::LessEqual => {
+        self.check_numeric(&expr.operator, &left);
+        self.check_numeric(&expr.operator, &right);
+        Type::Bool
+      }
+      TokenType::EqualEqual | TokenType::BangEqual => {
+        self.check_equality(&expr.operator, &left, &right);
+        Type::Bool
+      }
+      _ => Type::Bool,
+    }
+  }
+
+  fn visitCallExpr(&mut self, expr: &CallExpr) -> Type {
+    // A method call's object is checked once, here, and its type kept for
+    // looking up the method's signature below
+    let (callee, receiver) = match &*expr.callee {
+      Expr::Get(get) => {
+        let object = self.check_expr(&get.object);
+        (self.property_type(&object, &get.name), Some(object))
+      }
+      callee => (self.check_expr(callee), None),
+    };
+    let arg_types: Vec<Type> = expr.arguments.iter().map(|arg| self.check_expr(arg)).collect();
+    for (_, arg) in &expr.named_arguments {
+      self.check_expr(arg);
+    }
+    // Named arguments are matched to parameters at runtime, so the positional
+    // checks below would be wrong
+    if !expr.named_arguments.is_empty() {
+      return match &callee {
+        Type::Class(name) => Type::Instance(name.clone()),
+        _ => Type::Any,
+      };
+    }
+
+    let signature = match (&*expr.callee, &callee) {
+      (_, Type::Class(name)) => {
+        if let Some(init) = self.method_signature(name, "init") {
+          self.check_arguments(&expr.paren, &init, &arg_types);
+        }
+        return Type::Instance(name.clone());
+      }
+      // Called through its class's call() method
+      (_, Type::Instance(class)) => self.method_signature(class, "call"),
+      (Expr::Variable(variable), _) => self.lookup(&variable.name.token).and_then(|b| b.signature),
+      (Expr::Get(get), _) => match &receiver {
+        Some(Type::Instance(class)) => self.method_signature(class, &get.name.token),
+        _ => None,
+      },
+      _ => None,
+    };
+    match signature {
+      Some(signature) => {
+        self.check_arguments(&expr.paren, &signature, &arg_types);
+        signature.ret
+      }
+      None => Type::Any,
+    }
+  }
+
+  fn visitGetExpr(&mut self, expr: &GetExpr) -> Type {
+    let object = self.check_expr(&expr.object);
+    self.property_type(&object, &expr.name)
+  }
+
+  fn visitOptionalGetExpr(&mut self, expr: &OptionalGetExpr) -> Type {
+    self.check_expr(&expr.object);
+    Type::Any
+  }
+
+  fn visitOptionalIndexExpr(&mut self, expr: &OptionalIndexExpr) -> Type {
+    self.check_expr(&expr.object);
+    self.check_expr(&expr.index);
+    Type::Any
+  }
+
+  fn visitOptionalChainExpr(&mut self, expr: &OptionalChainExpr) -> Type {
+    self.check_expr(&expr.expression);
+    Type::Any
+  }
+
+  fn visitComparisonExpr(&mut self, expr: &ComparisonExpr) -> Type {
+    let left = self.check_expr(&expr.left);
+    self.check_numeric(&expr.comparisons[0].0, &left);
+    for (operator, right) in &expr.comparisons {
+      let right = self.check_expr(right);
+      self.check_numeric(operator, &right);
+    }
+    Type::Bool
+  }
+
+  // Bindings are untyped; the result is the arms' common type, if any
+  fn visitMatchExpr(&mut self, expr: &MatchExpr) -> Type {
+    self.check_expr(&expr.subject);
+    let mut result: Option<Type> = None;
+    for arm in &expr.arms {
+      self.scopes.push(HashMap::new());
+      for binding in arm.pattern.bindings() {
+        self.define(&binding.name.token, Type::Any, None);
+      }
+      if let Some(guard) = &arm.guard {
+        self.check_expr(guard);
+      }
+      let body = self.check_expr(&arm.body);
+      self.scopes.pop();
+      result = match result {
+        Some(previous) if previous != body => Some(Type::Any),
+        _ => Some(body),
+      };
+    }
+    result.unwrap_or(Type::Any)
+  }
+
+  fn visitSetExpr(&mut self, expr: &SetExpr) -> Type {
+    self.check_expr(&expr.object);
+    self.check_expr(&expr.value)
+  }
+
+  fn visitVariableExpression(&mut self, expr: &VariableExpr) -> Type {
+    match self.lookup(&expr.name.token) {
+      Some(binding) => binding.var_type,
+      None => Type::Any,
+    }
+  }
+
+  fn visitAssignExpression(&mut self, expr: &AssignExpr) -> Type {
+    let value = self.check_expr(&expr.value);
+    if let Some(binding) = self.lookup(&expr.name.token) {
+      if !self.assignable(&binding.var_type, &value) {
+        self.error(&expr.name, &format!("Cannot assign {} to '{}' of type {}.", value, expr.name.token, binding.var_type));
+      }
+    }
+    value
+  }
+
+  fn visitLogicalExpression(&mut self, expr: &LogicalExpr) -> Type {
+    let left = self.check_expr(&expr.left);
+    let right = self.check_expr(&expr.right);
+    if left == right { left } else { Type::Any }
+  }
+
+  fn visitSuperExpression(&mut self, _expr: &SuperExpr) -> Type {
+    Type::Any
+  }
+
+  fn visitThisExpression(&mut self, _expr: &ThisExpr) -> Type {
+    match &self.current_class {
+      Some(class) => Type::Instance(class.clone()),
+      None => Type::Any,
+    }
+  }
+
+  fn visitListExpr(&mut self, expr: &ListExpr) -> Type {
+    for element in &expr.elements {
+      self.check_expr(element);
+    }
+    Type::List
+  }
+
+  fn visitSetLiteralExpr(&mut self, expr: &SetLiteralExpr) -> Type {
+    for element in &expr.elements {
+      self.check_expr(element);
+    }
+    Type::Set
+  }
+
+  fn visitMapLiteralExpr(&mut self, expr: &MapLiteralExpr) -> Type {
+    for (key, value) in &expr.entries {
+      self.check_expr(key);
+      self.check_expr(value);
+    }
+    Type::Map
+  }
+
+  fn visitIndexExpr(&mut self, expr: &IndexExpr) -> Type {
+    self.check_expr(&expr.object);
+    self.check_expr(&expr.index);
+    Type::Any
+  }
+
+  fn visitIndexSetExpr(&mut self, expr: &IndexSetExpr) -> Type {
+    self.check_expr(&expr.object);
+    self.check_expr(&expr.index);
+    self.check_expr(&expr.value)
+  }
+
+  fn visitInterpolationExpr(&mut self, expr: &InterpolationExpr) -> Type {
+    for part in &expr.parts {
+      self.check_expr(part);
+    }
+    Type::String
+  }
+
+  fn visitDestructureAssignExpr(&mut self, expr: &DestructureAssignExpr) -> Type {
+    let value = self.check_expr(&expr.value);
+    // Elements of a list are Any, so only the value itself can be checked
+    self.check_destructure(&expr.pattern, &value);
+    value
+  }
+
+  fn visitSpreadExpr(&mut self, expr: &SpreadExpr) -> Type {
+    let spread = self.check_expr(&expr.expression);
+    if !self.assignable(&Type::List, &spread) && !self.assignable(&Type::Set, &spread) {
+      self.error(&expr.ellipsis, &format!("Can only spread a List or Set, not {}.", spread));
+    }
+    Type::Spread
+  }
+}
+
+impl StmtVisitor<()> for TypeChecker {
+  fn visitBlockStmt(&mut self, stmt: &BlockStmt) {
+    self.scopes.push(HashMap::new());
+    for statement in &stmt.statements {
+      self.check_stmt(statement);
+    }
+    self.scopes.pop();
+  }
+
+  fn visitExpressionStmt(&mut self, stmt: &ExprStmt) {
+    self.check_expr(&stmt.expression);
+  }
+
+  fn visitPrintStmt(&mut self, stmt: &PrintStmt) {
+    for expression in &stmt.expressions {
+      self.check_expr(expression);
+    }
+  }
+
+  fn visitVarStmt(&mut self, stmt: &VarStmt) {
+    let declared = self.check_annotation(&stmt.type_annotation);
+    if let Some(initializer) = &stmt.initializer {
+      let actual = self.check_expr(initializer);
+      if !self.assignable(&declared, &actual) {
+        self.error(&stmt.name, &format!("Cannot assign {} to '{}' of type {}.", actual, stmt.name.token, declared));
+      }
+    }
+    self.define(&stmt.name.token, declared, None);
+  }
+
+  fn visitDestructureStmt(&mut self, stmt: &DestructureStmt) {
+    let value = self.check_expr(&stmt.initializer);
+    self.check_destructure(&stmt.pattern, &value);
+    for target in stmt.pattern.targets.iter() {
+      self.define(&target.name.token, Type::Any, None);
+    }
+    if let Some(rest) = &stmt.pattern.rest {
+      let rest_type = if stmt.pattern.keys.is_some() { Type::Map } else { Type::List };
+      self.define(&rest.name.token, rest_type, None);
+    }
+  }
+
+  fn visitReturnStmt(&mut self, stmt: &RetStmt) {
+    let actual = match &stmt.value {
+      Some(value) => self.check_expr(value),
+      None => Type::Nil,
+    };
+    if let Some(expected) = self.current_return.clone() {
+      if !self.assignable(&expected, &actual) {
+        self.error(&stmt.keyword, &format!("Expected return type {} but got {}.", expected, actual));
+      }
+    }
+  }
+
+  fn visitFunStmt(&mut self, stmt: &FunStmt) {
+    let signature = self.signature(stmt);
+    self.define(&stmt.name.token, Type::Function, Some(signature));
+    self.check_function(stmt, None);
+  }
+
+  fn visitIfStmt(&mut self, stmt: &IfStmt) {
+    self.check_expr(&stmt.condition);
+    self.check_stmt(&stmt.then_branch);
+    if let Some(else_branch) = &stmt.else_branch {
+      self.check_stmt(else_branch);
+    }
+  }
+
+  fn visitYieldStmt(&mut self, stmt: &YieldStmt) {
+    if let Some(value) = &stmt.value {
+      self.check_expr(value);
+    }
+  }
+
+  fn visitForInStmt(&mut self, stmt: &ForInStmt) {
+    self.check_expr(&stmt.iterable);
+    self.scopes.push(HashMap::new());
+    self.define(&stmt.name.token, Type::Any, None);
+    self.check_stmt(&stmt.body);
+    self.scopes.pop();
+    if let Some(else_branch) = &stmt.else_branch {
+      self.check_stmt(else_branch);
+    }
+  }
+
+  fn visitDoWhileStmt(&mut self, stmt: &WhileStmt) {
+    self.check_stmt(&stmt.body);
+    self.check_expr(&stmt.condition);
+  }
+
+  fn visitBreakStmt(&mut self, _stmt: &BreakStmt) {}
+
+  fn visitTryStmt(&mut self, stmt: &TryStmt) {
+    self.visitBlockStmt(&stmt.body);
+    for clause in &stmt.catches {
+      self.scopes.push(HashMap::new());
+      self.define(&clause.name.token, Type::Any, None);
+      self.visitBlockStmt(&clause.body);
+      self.scopes.pop();
+    }
+    if let Some(finally) = &stmt.finally {
+      self.visitBlockStmt(finally);
+    }
+  }
+
+  fn visitThrowStmt(&mut self, stmt: &ThrowStmt) {
+    self.check_expr(&stmt.value);
+  }
+
+  fn visitUsingStmt(&mut self, stmt: &UsingStmt) {
+    let value = self.check_expr(&stmt.initializer);
+    self.scopes.push(HashMap::new());
+    self.define(&stmt.name.token, value, None);
+    self.visitBlockStmt(&stmt.body);
+    self.scopes.pop();
+  }
+
+  fn visitWhileStmt(&mut self, stmt: &WhileStmt) {
+    self.check_expr(&stmt.condition);
+    self.check_stmt(&stmt.body);
+    if let Some(else_branch) = &stmt.else_branch {
+      self.check_stmt(else_branch);
+    }
+  }
+
+  fn visitForStmt(&mut self, stmt: &ForStmt) {
+    if let Some(initializer) = &stmt.initializer {
+      self.check_stmt(initializer);
+    }
+    if let Some(condition) = &stmt.condition {
+      self.check_expr(condition);
+    }
+    if let Some(increment) = &stmt.increment {
+      self.check_expr(increment);
+    }
+    self.check_stmt(&stmt.body);
+  }
+
+  fn visitClassStmt(&mut self, stmt: &ClassStmt) {
+    self.define(&stmt.name.token, Type::Class(stmt.name.token.clone()), None);
+    for method in &stmt.methods {
+      self.check_function(method, Some(stmt.name.token.clone()));
+    }
+  }
+
+  fn visitTraitStmt(&mut self, _stmt: &TraitStmt) {}
+}
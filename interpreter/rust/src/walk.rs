@@ -0,0 +1,450 @@
+//! Generic traversal of the syntax tree, for tools built on the parser such as
+//! linters, codemods and instrumentation.
+//!
+//! `walk` visits every statement, expression, pattern and function in source
+//! order. A Visitor only implements the hooks it cares about: each `enter_` hook
+//! returns whether to go on into the node's children, and the matching `leave_`
+//! hook runs once they are done.
+//!
+//! `rewrite` rebuilds the tree bottom-up, handing each expression and statement
+//! to the Rewriter after its children have been rewritten, so a rewriter sees
+//! and returns finished nodes. Two things are never handed over because the
+//! interpreter needs them to stay plain names: a class's superclass and the
+//! targets of a destructuring pattern.
+//!
+//! ```
+//! use lox::ast::Expr;
+//! use lox::lexer::Lexer;
+//! use lox::parser::Parser;
+//! use lox::walk::{walk, Visitor};
+//!
+//! struct CallCounter { calls: usize }
+//!
+//! impl Visitor for CallCounter {
+//!   fn enter_expr(&mut self, expr: &Expr) -> bool {
+//!     if let Expr::Call(_) = expr {
+//!       self.calls += 1;
+//!     }
+//!     true
+//!   }
+//! }
+//!
+//! let tokens = Lexer::new("print len(str(1));".to_string()).scan_tokens().clone();
+//! let Ok(statements) = Parser::new(tokens).parse() else { panic!("doesn't parse") };
+//! let mut counter = CallCounter { calls: 0 };
+//! walk(&statements, &mut counter);
+//! assert_eq!(counter.calls, 2);
+//! ```
+
+use crate::ast::*;
+use std::rc::Rc;
+
+pub trait Visitor {
+  fn enter_stmt(&mut self, _stmt: &Stmt) -> bool {
+    true
+  }
+
+  fn leave_stmt(&mut self, _stmt: &Stmt) {}
+
+  fn enter_expr(&mut self, _expr: &Expr) -> bool {
+    true
+  }
+
+  fn leave_expr(&mut self, _expr: &Expr) {}
+
+  fn enter_pattern(&mut self, _pattern: &Pattern) -> bool {
+    true
+  }
+
+  fn leave_pattern(&mut self, _pattern: &Pattern) {}
+
+  // Both `fun` declarations and class methods, after enter_stmt for the former
+  fn enter_function(&mut self, _function: &FunStmt) -> bool {
+    true
+  }
+
+  fn leave_function(&mut self, _function: &FunStmt) {}
+}
+
+pub trait Rewriter {
+  fn rewrite_expr(&mut self, expr: Expr) -> Expr {
+    expr
+  }
+
+  fn rewrite_stmt(&mut self, stmt: Stmt) -> Stmt {
+    stmt
+  }
+}
+
+///////////// Walking ///////////////
+
+pub fn walk<V: Visitor>(statements: &[Stmt], visitor: &mut V) {
+  for statement in statements {
+    walk_stmt(statement, visitor);
+  }
+}
+
+pub fn walk_stmt<V: Visitor>(stmt: &Stmt, visitor: &mut V) {
+  if !visitor.enter_stmt(stmt) {
+    return;
+  }
+  match stmt {
+    Stmt::Block(block) => walk(&block.statements, visitor),
+    Stmt::Expression(s) => walk_expr(&s.expression, visitor),
+    Stmt::Print(s) => {
+      for expression in &s.expressions {
+        walk_expr(expression, visitor);
+      }
+    }
+    Stmt::Return(s) => walk_optional_expr(s.value.as_deref(), visitor),
+    Stmt::Var(s) => walk_optional_expr(s.initializer.as_ref(), visitor),
+    Stmt::Destructure(s) => walk_expr(&s.initializer, visitor),
+    Stmt::Fun(function) => walk_function(function, visitor),
+    Stmt::If(s) => {
+      walk_expr(&s.condition, visitor);
+      walk_stmt(&s.then_branch, visitor);
+      walk_optional_stmt(s.else_branch.as_deref(), visitor);
+    }
+    Stmt::While(s) | Stmt::DoWhile(s) => {
+      walk_expr(&s.condition, visitor);
+      walk_stmt(&s.body, visitor);
+      walk_optional_stmt(s.else_branch.as_deref(), visitor);
+    }
+    Stmt::For(s) => {
+      walk_optional_stmt(s.initializer.as_deref(), visitor);
+      walk_optional_expr(s.condition.as_deref(), visitor);
+      walk_optional_expr(s.increment.as_deref(), visitor);
+      walk_stmt(&s.body, visitor);
+    }
+    Stmt::ForIn(s) => {
+      walk_expr(&s.iterable, visitor);
+      walk_stmt(&s.body, visitor);
+      walk_optional_stmt(s.else_branch.as_deref(), visitor);
+    }
+    Stmt::Class(s) => {
+      walk_optional_expr(s.superclass.as_deref(), visitor);
+      for method in &s.methods {
+        walk_function(method, visitor);
+      }
+    }
+    Stmt::Yield(s) => walk_optional_expr(s.value.as_ref(), visitor),
+    Stmt::Try(s) => {
+      walk(&s.body.statements, visitor);
+      for clause in &s.catches {
+        walk_optional_expr(clause.class.as_ref(), visitor);
+        walk(&clause.body.statements, visitor);
+      }
+      if let Some(finally) = &s.finally {
+        walk(&finally.statements, visitor);
+      }
+    }
+    Stmt::Throw(s) => walk_expr(&s.value, visitor),
+    Stmt::Using(s) => {
+      walk_expr(&s.initializer, visitor);
+      walk(&s.body.statements, visitor);
+    }
+    Stmt::Trait(_) | Stmt::Break(_) => (),
+  }
+  visitor.leave_stmt(stmt);
+}
+
+pub fn walk_function<V: Visitor>(function: &FunStmt, visitor: &mut V) {
+  if !visitor.enter_function(function) {
+    return;
+  }
+  for default in function.defaults.iter().flatten() {
+    walk_expr(default, visitor);
+  }
+  walk(&function.body.statements, visitor);
+  visitor.leave_function(function);
+}
+
+pub fn walk_expr<V: Visitor>(expr: &Expr, visitor: &mut V) {
+  if !visitor.enter_expr(expr) {
+    return;
+  }
+  match expr {
+    Expr::Assign(e) => walk_expr(&e.value, visitor),
+    Expr::Binary(e) => {
+      walk_expr(&e.left, visitor);
+      walk_expr(&e.right, visitor);
+    }
+    Expr::Logical(e) => {
+      walk_expr(&e.left, visitor);
+      walk_expr(&e.right, visitor);
+    }
+    Expr::Comparison(e) => {
+      walk_expr(&e.left, visitor);
+      for (_, right) in &e.comparisons {
+        walk_expr(right, visitor);
+      }
+    }
+    Expr::Unary(e) => walk_expr(&e.right, visitor),
+    Expr::Call(e) => {
+      walk_expr(&e.callee, visitor);
+      for argument in e.arguments.iter().chain(e.named_arguments.iter().map(|(_, value)| value)) {
+        walk_expr(argument, visitor);
+      }
+    }
+    Expr::Get(e) => walk_expr(&e.object, visitor),
+    Expr::OptionalGet(e) => walk_expr(&e.object, visitor),
+    Expr::OptionalIndex(e) => {
+      walk_expr(&e.object, visitor);
+      walk_expr(&e.index, visitor);
+    }
+    Expr::OptionalChain(e) => walk_expr(&e.expression, visitor),
+    Expr::Set(e) => {
+      walk_expr(&e.object, visitor);
+      walk_expr(&e.value, visitor);
+    }
+    Expr::Grouping(e) => walk_expr(&e.expression, visitor),
+    Expr::List(e) => {
+      for element in &e.elements {
+        walk_expr(element, visitor);
+      }
+    }
+    Expr::SetLiteral(e) => {
+      for element in &e.elements {
+        walk_expr(element, visitor);
+      }
+    }
+    Expr::MapLiteral(e) => {
+      for (key, value) in &e.entries {
+        walk_expr(key, visitor);
+        walk_expr(value, visitor);
+      }
+    }
+    Expr::Index(e) => {
+      walk_expr(&e.object, visitor);
+      walk_expr(&e.index, visitor);
+    }
+    Expr::IndexSet(e) => {
+      walk_expr(&e.object, visitor);
+      walk_expr(&e.index, visitor);
+      walk_expr(&e.value, visitor);
+    }
+    Expr::Spread(e) => walk_expr(&e.expression, visitor),
+    Expr::DestructureAssign(e) => walk_expr(&e.value, visitor),
+    Expr::Interpolation(e) => {
+      for part in &e.parts {
+        walk_expr(part, visitor);
+      }
+    }
+    Expr::Match(e) => {
+      walk_expr(&e.subject, visitor);
+      for arm in &e.arms {
+        walk_pattern(&arm.pattern, visitor);
+        walk_optional_expr(arm.guard.as_ref(), visitor);
+        walk_expr(&arm.body, visitor);
+      }
+    }
+    Expr::Literal(_) | Expr::Variable(_) | Expr::Super(_) | Expr::This(_) => (),
+  }
+  visitor.leave_expr(expr);
+}
+
+pub fn walk_pattern<V: Visitor>(pattern: &Pattern, visitor: &mut V) {
+  if !visitor.enter_pattern(pattern) {
+    return;
+  }
+  match pattern {
+    Pattern::List(list) => {
+      for element in &list.elements {
+        walk_pattern(element, visitor);
+      }
+    }
+    Pattern::Class(class) => {
+      for (_, field) in &class.fields {
+        walk_pattern(field, visitor);
+      }
+    }
+    Pattern::Map(map) => {
+      for (_, entry) in &map.entries {
+        walk_pattern(entry, visitor);
+      }
+    }
+    Pattern::Wildcard | Pattern::Literal(_) | Pattern::Binding(_) => (),
+  }
+  visitor.leave_pattern(pattern);
+}
+
+fn walk_optional_expr<V: Visitor>(expr: Option<&Expr>, visitor: &mut V) {
+  if let Some(expr) = expr {
+    walk_expr(expr, visitor);
+  }
+}
+
+fn walk_optional_stmt<V: Visitor>(stmt: Option<&Stmt>, visitor: &mut V) {
+  if let Some(stmt) = stmt {
+    walk_stmt(stmt, visitor);
+  }
+}
+
+///////////// Rewriting ///////////////
+
+pub fn rewrite<R: Rewriter>(statements: Vec<Stmt>, rewriter: &mut R) -> Vec<Stmt> {
+  statements.into_iter().map(|s| rewrite_stmt(s, rewriter)).collect()
+}
+
+pub fn rewrite_stmt<R: Rewriter>(stmt: Stmt, rewriter: &mut R) -> Stmt {
+  let stmt = match stmt {
+    Stmt::Block(block) => Stmt::Block(BlockStmt::new(rewrite(block.statements, rewriter))),
+    Stmt::Expression(s) => Stmt::Expression(ExprStmt { expression: rewrite_boxed(s.expression, rewriter) }),
+    Stmt::Print(s) => Stmt::Print(PrintStmt { expressions: s.expressions.into_iter().map(|e| rewrite_expr(e, rewriter)).collect() }),
+    Stmt::Return(s) => Stmt::Return(RetStmt::new(s.keyword, s.value.map(|v| rewrite_boxed(v, rewriter)))),
+    Stmt::Var(s) => {
+      let initializer = s.initializer.map(|i| rewrite_expr(i, rewriter));
+      Stmt::Var(VarStmt::new(s.name, s.type_annotation, initializer, s.constant))
+    }
+    Stmt::Destructure(s) => {
+      let initializer = rewrite_expr(s.initializer, rewriter);
+      Stmt::Destructure(DestructureStmt::new(s.pattern, initializer, s.constant))
+    }
+    Stmt::Fun(function) => Stmt::Fun(rewrite_function(function, rewriter)),
+    Stmt::If(s) => {
+      let condition = rewrite_boxed(s.condition, rewriter);
+      let then_branch = rewrite_boxed_stmt(s.then_branch, rewriter);
+      let else_branch = s.else_branch.map(|e| rewrite_boxed_stmt(e, rewriter));
+      Stmt::If(IfStmt::new(condition, then_branch, else_branch))
+    }
+    Stmt::While(s) => Stmt::While(rewrite_loop(s, rewriter)),
+    Stmt::DoWhile(s) => Stmt::DoWhile(rewrite_loop(s, rewriter)),
+    Stmt::For(s) => {
+      let initializer = s.initializer.map(|i| rewrite_boxed_stmt(i, rewriter));
+      let condition = s.condition.map(|c| rewrite_boxed(c, rewriter));
+      let increment = s.increment.map(|i| rewrite_boxed(i, rewriter));
+      let body = rewrite_boxed_stmt(s.body, rewriter);
+      Stmt::For(ForStmt::new(initializer, condition, increment, body))
+    }
+    Stmt::ForIn(s) => {
+      let iterable = rewrite_expr(s.iterable, rewriter);
+      let body = rewrite_boxed_stmt(s.body, rewriter);
+      let else_branch = s.else_branch.map(|e| rewrite_boxed_stmt(e, rewriter));
+      Stmt::ForIn(ForInStmt::new(s.name, iterable, body, else_branch))
+    }
+    Stmt::Class(s) => {
+      let methods = s.methods.into_iter().map(|m| rewrite_function(m, rewriter)).collect();
+      let mut class = ClassStmt::new(s.name, s.superclass, s.traits, methods);
+      class.doc = s.doc;
+      Stmt::Class(class)
+    }
+    Stmt::Yield(s) => Stmt::Yield(YieldStmt::new(s.keyword, s.value.map(|v| rewrite_expr(v, rewriter)))),
+    Stmt::Try(s) => {
+      let body = BlockStmt::new(rewrite(s.body.statements, rewriter));
+      let catches = s.catches.into_iter().map(|clause| {
+        let class = clause.class.map(|c| rewrite_expr(c, rewriter));
+        CatchClause::new(clause.name, class, BlockStmt::new(rewrite(clause.body.statements, rewriter)))
+      }).collect();
+      let finally = s.finally.map(|finally| BlockStmt::new(rewrite(finally.statements, rewriter)));
+      Stmt::Try(TryStmt::new(s.keyword, body, catches, finally))
+    }
+    Stmt::Throw(s) => Stmt::Throw(ThrowStmt::new(s.keyword, rewrite_expr(s.value, rewriter))),
+    Stmt::Using(s) => {
+      let initializer = rewrite_expr(s.initializer, rewriter);
+      Stmt::Using(UsingStmt::new(s.keyword, s.name, initializer, BlockStmt::new(rewrite(s.body.statements, rewriter))))
+    }
+    stmt @ (Stmt::Trait(_) | Stmt::Break(_)) => stmt,
+  };
+  rewriter.rewrite_stmt(stmt)
+}
+
+fn rewrite_loop<R: Rewriter>(stmt: WhileStmt, rewriter: &mut R) -> WhileStmt {
+  let condition = rewrite_boxed(stmt.condition, rewriter);
+  let body = rewrite_boxed_stmt(stmt.body, rewriter);
+  let else_branch = stmt.else_branch.map(|e| rewrite_boxed_stmt(e, rewriter));
+  WhileStmt::new(condition, body, else_branch)
+}
+
+// Whether the function is a generator is worked out again, since its body
+// may have gained or lost a yield
+pub fn rewrite_function<R: Rewriter>(function: FunStmt, rewriter: &mut R) -> FunStmt {
+  let params = ParameterList {
+    names: function.params,
+    types: function.param_types,
+    defaults: function.defaults.into_iter().map(|d| d.map(|d| rewrite_expr(d, rewriter))).collect(),
+    rest: function.rest,
+  };
+  let body = Rc::try_unwrap(function.body).unwrap_or_else(|body| (*body).clone());
+  let body = BlockStmt::new(rewrite(body.statements, rewriter));
+  let mut rewritten = FunStmt::new(function.name, params, function.return_type, Rc::new(body));
+  rewritten.doc = function.doc;
+  rewritten
+}
+
+pub fn rewrite_expr<R: Rewriter>(expr: Expr, rewriter: &mut R) -> Expr {
+  let expr = match expr {
+    Expr::Assign(e) => Expr::Assign(AssignExpr::new(e.name, rewrite_boxed(e.value, rewriter))),
+    Expr::Binary(e) => {
+      let left = rewrite_boxed(e.left, rewriter);
+      Expr::Binary(BinaryExpr::new(left, e.operator, rewrite_boxed(e.right, rewriter)))
+    }
+    Expr::Logical(e) => {
+      let left = rewrite_boxed(e.left, rewriter);
+      Expr::Logical(LogicalExpr::new(left, e.operator, rewrite_boxed(e.right, rewriter)))
+    }
+    Expr::Comparison(e) => {
+      let left = rewrite_boxed(e.left, rewriter);
+      let comparisons = e.comparisons.into_iter().map(|(operator, right)| (operator, rewrite_expr(right, rewriter))).collect();
+      Expr::Comparison(ComparisonExpr::new(left, comparisons))
+    }
+    Expr::Unary(e) => Expr::Unary(UnaryExpr::new(e.operator, rewrite_boxed(e.right, rewriter))),
+    Expr::Call(e) => {
+      let callee = rewrite_boxed(e.callee, rewriter);
+      let arguments = rewrite_all(e.arguments, rewriter);
+      let named_arguments = e.named_arguments.into_iter().map(|(name, value)| (name, rewrite_expr(value, rewriter))).collect();
+      Expr::Call(CallExpr::new(callee, e.paren, arguments, named_arguments))
+    }
+    Expr::Get(e) => Expr::Get(GetExpr::new(rewrite_boxed(e.object, rewriter), e.name)),
+    Expr::OptionalGet(e) => Expr::OptionalGet(OptionalGetExpr::new(rewrite_boxed(e.object, rewriter), e.name)),
+    Expr::OptionalIndex(e) => {
+      let object = rewrite_boxed(e.object, rewriter);
+      Expr::OptionalIndex(OptionalIndexExpr::new(object, e.bracket, rewrite_boxed(e.index, rewriter)))
+    }
+    Expr::OptionalChain(e) => Expr::OptionalChain(OptionalChainExpr::new(rewrite_boxed(e.expression, rewriter))),
+    Expr::Set(e) => {
+      let object = rewrite_boxed(e.object, rewriter);
+      Expr::Set(SetExpr::new(object, e.name, rewrite_boxed(e.value, rewriter)))
+    }
+    Expr::Grouping(e) => Expr::Grouping(GroupingExpr::new(rewrite_boxed(e.expression, rewriter))),
+    Expr::List(e) => Expr::List(ListExpr::new(e.bracket, rewrite_all(e.elements, rewriter))),
+    Expr::SetLiteral(e) => Expr::SetLiteral(SetLiteralExpr::new(e.brace, rewrite_all(e.elements, rewriter))),
+    Expr::MapLiteral(e) => {
+      let entries = e.entries.into_iter().map(|(key, value)| (rewrite_expr(key, rewriter), rewrite_expr(value, rewriter))).collect();
+      Expr::MapLiteral(MapLiteralExpr::new(e.brace, entries))
+    }
+    Expr::Index(e) => {
+      let object = rewrite_boxed(e.object, rewriter);
+      Expr::Index(IndexExpr::new(object, e.bracket, rewrite_boxed(e.index, rewriter)))
+    }
+    Expr::IndexSet(e) => {
+      let object = rewrite_boxed(e.object, rewriter);
+      let index = rewrite_boxed(e.index, rewriter);
+      Expr::IndexSet(IndexSetExpr::new(object, e.bracket, index, rewrite_boxed(e.value, rewriter)))
+    }
+    Expr::Spread(e) => Expr::Spread(SpreadExpr::new(e.ellipsis, rewrite_boxed(e.expression, rewriter))),
+    Expr::DestructureAssign(e) => Expr::DestructureAssign(DestructureAssignExpr::new(e.pattern, rewrite_boxed(e.value, rewriter))),
+    Expr::Interpolation(e) => Expr::Interpolation(InterpolationExpr::new(e.start, rewrite_all(e.parts, rewriter))),
+    Expr::Match(e) => {
+      let subject = rewrite_boxed(e.subject, rewriter);
+      let arms = e.arms.into_iter().map(|arm| {
+        let guard = arm.guard.map(|g| rewrite_expr(g, rewriter));
+        MatchArm::new(arm.pattern, guard, rewrite_expr(arm.body, rewriter))
+      }).collect();
+      Expr::Match(MatchExpr::new(e.keyword, subject, arms))
+    }
+    expr @ (Expr::Literal(_) | Expr::Variable(_) | Expr::Super(_) | Expr::This(_)) => expr,
+  };
+  rewriter.rewrite_expr(expr)
+}
+
+fn rewrite_all<R: Rewriter>(exprs: Vec<Expr>, rewriter: &mut R) -> Vec<Expr> {
+  exprs.into_iter().map(|e| rewrite_expr(e, rewriter)).collect()
+}
+
+fn rewrite_boxed<R: Rewriter>(expr: Box<Expr>, rewriter: &mut R) -> Box<Expr> {
+  Box::new(rewrite_expr(*expr, rewriter))
+}
+
+fn rewrite_boxed_stmt<R: Rewriter>(stmt: Box<Stmt>, rewriter: &mut R) -> Box<Stmt> {
+  Box::new(rewrite_stmt(*stmt, rewriter))
+}
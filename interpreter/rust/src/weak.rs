@@ -0,0 +1,109 @@
+/*
+Weak references for weakRef(), and the finalizer that closes native handles
+(files and sockets) once nothing in the script can reach them.
+
+A handle closes when it's dropped, and reference counting drops it as soon as
+the last Lox value holding it goes. What counting misses is a cycle: a
+connection kept in an instance that refers back to itself is never dropped.
+So every open handle is tracked here, and between top-level statements, when
+no Lox code is running and everything the script can still use is reachable
+from its scopes, the interpreter takes a census (memory.rs) of the handles it
+can reach and closes the rest. The cycle itself stays, but the file or socket
+it was holding doesn't.
+
+A weak reference sees a value go when counting drops it, so one held only by
+a cycle stays reachable through it.
+*/
+
+use crate::callable::LoxCallable;
+use crate::generator::LoxGenerator;
+use crate::lexer::LoxValue;
+use crate::oop::LoxInstance;
+use crate::set::LoxSet;
+use crate::map::LoxMap;
+use crate::bytes::LoxBytes;
+use std::cell::{Cell, RefCell};
+use std::collections::{HashMap, HashSet};
+use std::rc::{Rc, Weak};
+
+// A native resource the finalizer can close
+pub trait Handle {
+  fn close(&mut self);
+}
+
+thread_local! {
+  static HANDLES: RefCell<HashMap<i64, Weak<RefCell<dyn Handle>>>> = RefCell::new(HashMap::new());
+  static NEXT_ID: Cell<i64> = const { Cell::new(0) };
+}
+
+// Starts tracking the handle and returns the id it's known by
+pub fn track(handle: Rc<RefCell<dyn Handle>>) -> i64 {
+  let id = NEXT_ID.with(|next| {
+    next.set(next.get() + 1);
+    next.get()
+  });
+  HANDLES.with(|handles| {
+    let mut handles = handles.borrow_mut();
+    handles.retain(|_, handle| handle.strong_count() > 0);
+    handles.insert(id, Rc::downgrade(&handle));
+  });
+  id
+}
+
+// Whether any tracked handle hasn't been dropped yet, which is when a census
+// is worth taking
+pub fn any_open() -> bool {
+  HANDLES.with(|handles| handles.borrow().values().any(|handle| handle.strong_count() > 0))
+}
+
+// Closes every handle that's still open but wasn't among those reached
+pub fn close_unreachable(reached: &HashSet<i64>) {
+  let unreachable: Vec<Rc<RefCell<dyn Handle>>> = HANDLES.with(|handles| {
+    let mut handles = handles.borrow_mut();
+    handles.retain(|_, handle| handle.strong_count() > 0);
+    handles.iter().filter(|(id, _)| !reached.contains(id)).filter_map(|(_, handle)| handle.upgrade()).collect()
+  });
+  for handle in unreachable {
+    handle.borrow_mut().close();
+  }
+}
+
+// The values weakRef() can refer to: the ones that live on the heap
+#[derive(Clone)]
+pub enum WeakValue {
+  Callable(Weak<RefCell<Box<dyn LoxCallable>>>),
+  Instance(Weak<RefCell<LoxInstance>>),
+  List(Weak<RefCell<Vec<LoxValue>>>),
+  Set(Weak<RefCell<LoxSet>>),
+  Map(Weak<RefCell<LoxMap>>),
+  Bytes(Weak<RefCell<LoxBytes>>),
+  Generator(Weak<RefCell<LoxGenerator>>),
+}
+
+impl WeakValue {
+  pub fn new(value: &LoxValue) -> Result<WeakValue, String> {
+    Ok(match value {
+      LoxValue::Callable(callable) => WeakValue::Callable(Rc::downgrade(callable)),
+      LoxValue::Instance(instance) => WeakValue::Instance(Rc::downgrade(instance)),
+      LoxValue::List(list) => WeakValue::List(Rc::downgrade(list)),
+      LoxValue::Set(set) => WeakValue::Set(Rc::downgrade(set)),
+      LoxValue::Map(map) => WeakValue::Map(Rc::downgrade(map)),
+      LoxValue::Bytes(bytes) => WeakValue::Bytes(Rc::downgrade(bytes)),
+      LoxValue::Generator(generator) => WeakValue::Generator(Rc::downgrade(generator)),
+      other => return Err(format!("Can't hold a weak reference to {}.", other)),
+    })
+  }
+
+  // The value, or None once it's been freed
+  pub fn upgrade(&self) -> Option<LoxValue> {
+    match self {
+      WeakValue::Callable(callable) => callable.upgrade().map(LoxValue::Callable),
+      WeakValue::Instance(instance) => instance.upgrade().map(LoxValue::Instance),
+      WeakValue::List(list) => list.upgrade().map(LoxValue::List),
+      WeakValue::Set(set) => set.upgrade().map(LoxValue::Set),
+      WeakValue::Map(map) => map.upgrade().map(LoxValue::Map),
+      WeakValue::Bytes(bytes) => bytes.upgrade().map(LoxValue::Bytes),
+      WeakValue::Generator(generator) => generator.upgrade().map(LoxValue::Generator),
+    }
+  }
+}
@@ -0,0 +1,57 @@
+// What the integration tests share: running the built `lox` on a script and
+// a scratch directory to write the scripts to. Not every test uses all of it.
+#![allow(dead_code)]
+
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+// The exit codes main.rs ends with, from sysexits.h
+pub const EXIT_OK: i32 = 0;
+pub const EXIT_STATIC_ERROR: i32 = 65;
+pub const EXIT_NO_INPUT: i32 = 66;
+pub const EXIT_RUNTIME_ERROR: i32 = 70;
+
+pub struct Run {
+  pub stdout: String,
+  pub stderr: String,
+  pub code: i32,
+}
+
+// Runs `lox` with the arguments, or another program such as one `lox build`
+// made when `program` is given
+pub fn run(program: Option<&Path>, args: &[&Path]) -> Run {
+  let output = Command::new(program.unwrap_or(Path::new(env!("CARGO_BIN_EXE_lox"))))
+    .args(args)
+    .output()
+    .expect("couldn't start lox");
+  Run {
+    stdout: String::from_utf8_lossy(&output.stdout).into_owned(),
+    stderr: String::from_utf8_lossy(&output.stderr).into_owned(),
+    code: output.status.code().unwrap_or(-1),
+  }
+}
+
+pub fn lox(script: &Path) -> Run {
+  run(None, &[script])
+}
+
+// An empty directory of the test's own, named after it so tests running at
+// the same time don't share one
+pub fn scratch_dir(name: &str) -> PathBuf {
+  let dir = std::env::temp_dir().join(format!("lox-{}-{}", name, std::process::id()));
+  let _ = fs::remove_dir_all(&dir);
+  fs::create_dir_all(&dir).expect("couldn't make a scratch directory");
+  dir
+}
+
+pub fn write_script(dir: &Path, name: &str, source: &str) -> PathBuf {
+  let path = dir.join(name);
+  fs::write(&path, source).expect("couldn't write the script");
+  path
+}
+
+// Output split into lines, without the empty one after the last newline
+pub fn lines(output: &str) -> Vec<&str> {
+  output.lines().collect()
+}
@@ -0,0 +1,45 @@
+// The exit codes a run ends with, from the interpreter and from the programs
+// `lox build` makes from a script
+
+mod common;
+
+use common::*;
+use std::process::Command;
+
+#[test]
+fn exit_codes() {
+  let dir = scratch_dir("exit-codes");
+  let valid = write_script(&dir, "valid.lox", "print 1 + 2;\n");
+  let failing = write_script(&dir, "failing.lox", "print 1;\nprint nil + 1;\nprint 2;\n");
+  let invalid = write_script(&dir, "invalid.lox", "print (;\n");
+
+  let tests = [
+    ("valid script", valid, EXIT_OK),
+    ("runtime error", failing, EXIT_RUNTIME_ERROR),
+    ("syntax error", invalid, EXIT_STATIC_ERROR),
+    ("missing script", dir.join("missing.lox"), EXIT_NO_INPUT),
+  ];
+  for (name, path, want) in &tests {
+    let run = lox(path);
+    assert_eq!(run.code, *want, "{}: stderr {:?}", name, run.stderr);
+  }
+
+  // A built program carries on past a failed statement like the
+  // interpreter, and exits with the same code at the end
+  for (name, path, want) in &tests[..2] {
+    let program = dir.join(path.file_stem().unwrap());
+    let build = Command::new(env!("CARGO_BIN_EXE_lox"))
+      .arg("build")
+      .arg(path)
+      .arg("-o")
+      .arg(&program)
+      .output()
+      .expect("couldn't start lox build");
+    assert!(build.status.success(), "lox build {}: {}", name, String::from_utf8_lossy(&build.stderr));
+    let run = run(Some(&program), &[]);
+    assert_eq!(run.code, *want, "built {}: stderr {:?}", name, run.stderr);
+    if *want == EXIT_RUNTIME_ERROR {
+      assert_eq!(run.stdout, "1\n2\n", "built {}: the statements around the failing one should run", name);
+    }
+  }
+}
@@ -0,0 +1,82 @@
+// The scoping rules for names used before their declaration, one script
+// each. Top-level functions and classes are hoisted; variables, names
+// declared twice and anything in a block are not.
+
+mod common;
+
+use common::*;
+
+struct Case {
+  name: &'static str,
+  source: &'static str,
+  output: &'static str,
+  // A runtime error's message, which means EXIT_RUNTIME_ERROR
+  error: Option<&'static str>,
+}
+
+const CASES: [Case; 8] = [
+  Case {
+    name: "function called above its declaration",
+    source: "print twice(2);\nfun twice(n) { return n * 2; }\n",
+    output: "4\n",
+    error: None,
+  },
+  Case {
+    name: "mutually recursive functions",
+    source: "fun isEven(n) { if (n == 0) return true; return isOdd(n - 1); }\nfun isOdd(n) { if (n == 0) return false; return isEven(n - 1); }\nprint isOdd(7);\n",
+    output: "true\n",
+    error: None,
+  },
+  Case {
+    name: "class used above its declaration",
+    source: "print Point(1, 2).sum();\nclass Point { init(x, y) { this.x = x; this.y = y; } sum() { return this.x + this.y; } }\n",
+    output: "3\n",
+    error: None,
+  },
+  Case {
+    name: "subclass declared above its superclass",
+    source: "class Dog < Animal {}\nclass Animal { speak() { return \"...\"; } }\nprint Dog().speak();\n",
+    output: "...\n",
+    error: None,
+  },
+  Case {
+    name: "variable read by a hoisted function before it's set",
+    source: "print late();\nvar x = 1;\nfun late() { return x; }\n",
+    output: "",
+    error: Some("Undefined variable 'x'."),
+  },
+  Case {
+    name: "variable read by a hoisted function after it's set",
+    source: "var x = 1;\nprint late();\nfun late() { return x; }\n",
+    output: "1\n",
+    error: None,
+  },
+  Case {
+    name: "function declared twice",
+    source: "print f();\nfun f() { return 1; }\nfun f() { return 2; }\n",
+    output: "",
+    error: Some("Undefined variable 'f'."),
+  },
+  Case {
+    name: "local function called above its declaration",
+    source: "{\n  fun a() { return b(); }\n  fun b() { return 1; }\n  print a();\n}\n",
+    output: "",
+    error: Some("Undefined variable 'b'."),
+  },
+];
+
+#[test]
+fn hoisting() {
+  let dir = scratch_dir("hoisting");
+  for (i, case) in CASES.iter().enumerate() {
+    let run = lox(&write_script(&dir, &format!("script{}.lox", i), case.source));
+    match case.error {
+      None => assert_eq!(run.code, EXIT_OK, "{}: stderr {:?}", case.name, run.stderr),
+      Some(error) => {
+        assert_eq!(run.code, EXIT_RUNTIME_ERROR, "{}", case.name);
+        assert!(run.stderr.contains(error), "{}: stderr {:?}, want it to report {:?}", case.name, run.stderr, error);
+      }
+    }
+    assert_eq!(run.stdout, case.output, "{}", case.name);
+  }
+}
@@ -0,0 +1,78 @@
+mod common;
+
+use common::*;
+
+// A fixed stream of random bits (xorshift64*), so every run tries the same
+// values without pulling in a crate for it
+struct Random(u64);
+
+impl Random {
+  fn next(&mut self) -> u64 {
+    self.0 ^= self.0 >> 12;
+    self.0 ^= self.0 << 25;
+    self.0 ^= self.0 >> 27;
+    self.0.wrapping_mul(0x2545F4914F6CDD1D)
+  }
+}
+
+// str() has to write every float so that both its own num() and any other
+// correct parser, here Rust's, read back exactly the same bits. The values
+// are the edges of the float range plus a fixed set of random ones across
+// all exponents.
+#[test]
+fn str_round_trips_floats() {
+  let mut values = vec![
+    0.0, -0.0, 0.1, 1.0 / 3.0, 1e21, 1e-7, 123456789012345680000.0,
+    f64::MAX, -f64::MAX, f64::from_bits(1),
+    f64::MIN_POSITIVE, f64::from_bits(0x000f_ffff_ffff_ffff), 9007199254740993.0,
+  ];
+  let mut random = Random(1);
+  for _ in 0..50 {
+    let value = f64::from_bits(random.next());
+    if value.is_finite() {
+      values.push(value);
+    }
+  }
+
+  let mut script = String::new();
+  for value in &values {
+    // Lox has no negative literals, so -x is a negated literal. A float
+    // literal needs a '.' or an exponent to stay a float.
+    let sign = if value.is_sign_negative() { "-" } else { "" };
+    let literal = format!("{}{:e}", sign, value.abs());
+    script.push_str(&format!("print str({0});\nprint num(str({0})) == {0};\n", literal));
+  }
+  let dir = scratch_dir("numbers");
+  let run = lox(&write_script(&dir, "numbers.lox", &script));
+  assert_eq!(run.code, EXIT_OK, "stderr {:?}", run.stderr);
+  let output = lines(&run.stdout);
+  assert_eq!(output.len(), 2 * values.len(), "lines of output");
+
+  for (i, value) in values.iter().enumerate() {
+    let (written, round_trips) = (output[2 * i], output[2 * i + 1]);
+    let parsed = written.parse::<f64>();
+    assert!(
+      parsed.is_ok_and(|parsed| parsed.to_bits() == value.to_bits()),
+      "str({:e}) is {:?}, which doesn't read back as the same number", value, written
+    );
+    assert_eq!(round_trips, "true", "num(str({:e})) != {:e}", value, value);
+  }
+}
+
+// Malformed number literals are reported at the literal, once each
+#[test]
+fn malformed_literals_are_reported_once() {
+  let tests = [
+    ("1_000_", "[line 1] Error  at '1_000_': Trailing '_' in number literal."),
+    ("1__000", "[line 1] Error  at '1__': Only one '_' can separate digits in a number literal."),
+    ("1e", "[line 1] Error  at '1e': Exponent has no digits."),
+    ("2.5e-", "[line 1] Error  at '2.5e-': Exponent has no digits."),
+    ("0x", "[line 1] Error  at '0x': Expect digits after '0x'."),
+  ];
+  let dir = scratch_dir("literals");
+  for (i, (literal, want)) in tests.iter().enumerate() {
+    let run = lox(&write_script(&dir, &format!("literal{}.lox", i), &format!("print {};\n", literal)));
+    assert_eq!(run.code, EXIT_STATIC_ERROR, "exit code for {}", literal);
+    assert_eq!(lines(&run.stderr).join("\n"), *want, "stderr for {}", literal);
+  }
+}
@@ -0,0 +1,77 @@
+// The demo scripts in program_files say what they print in comments, e.g.
+// `print 1 + 2; // Prints "3".`, or `// Prints "a", then "b".` for a line
+// that prints several times. Running each one and comparing its whole output
+// with those comments keeps the demos honest. Scripts without any such
+// comment, which only show syntax, aren't run.
+
+mod common;
+
+use common::*;
+use std::fs;
+use std::path::Path;
+
+// Scripts with comments on only some of what they print, which can't be
+// checked until the rest are written
+const PARTLY_ANNOTATED: [&str; 1] = ["classes.lox"];
+
+// The quoted part of a `// Prints "...".` comment ending the line
+fn prints_comment(line: &str) -> Option<&str> {
+  let start = line.find("// Prints \"")? + "// Prints ".len();
+  let quoted = line.trim_end_matches('\r').strip_suffix('.')?;
+  if quoted.len() < start + 2 || !quoted.ends_with('"') {
+    return None;
+  }
+  Some(&quoted[start + 1..quoted.len() - 1])
+}
+
+// One comment can list several lines, separated by `", "`, `" and "`,
+// `" then "` or `", then "`
+fn split_prints(quoted: &str) -> Vec<String> {
+  let mut lines = vec![quoted.to_string()];
+  for separator in ["\", then \"", "\", and \"", "\" then \"", "\" and \"", "\", \""] {
+    lines = lines.iter().flat_map(|line| line.split(separator).map(String::from).collect::<Vec<_>>()).collect();
+  }
+  lines
+}
+
+// The lines the script's comments say it prints, in order
+fn expected_prints(source: &str) -> Vec<String> {
+  source.lines().filter_map(prints_comment).flat_map(split_prints).collect()
+}
+
+#[test]
+fn program_files_print_what_their_comments_say() {
+  let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("../../program_files");
+  let mut paths: Vec<_> = fs::read_dir(&dir)
+    .expect("no program_files directory")
+    .map(|entry| entry.unwrap().path())
+    .filter(|path| path.extension().is_some_and(|extension| extension == "lox"))
+    .collect();
+  paths.sort();
+  assert!(!paths.is_empty(), "no scripts in program_files");
+
+  let mut failures = Vec::new();
+  for path in paths {
+    let name = path.file_name().unwrap().to_string_lossy().into_owned();
+    let expected = expected_prints(&fs::read_to_string(&path).unwrap());
+    if expected.is_empty() || PARTLY_ANNOTATED.contains(&name.as_str()) {
+      continue;
+    }
+    let run = lox(&path);
+    if run.code != EXIT_OK {
+      failures.push(format!("{}: exit code {}, want {} (stderr {:?})", name, run.code, EXIT_OK, run.stderr));
+    }
+    let output = lines(&run.stdout);
+    match output.iter().zip(&expected).position(|(line, want)| line != want) {
+      Some(i) => failures.push(format!("{}: line {} is {:?}, want {:?}", name, i + 1, output[i], expected[i])),
+      None if output.len() > expected.len() => {
+        failures.push(format!("{}: printed {:?} after the last expected line", name, output[expected.len()]))
+      }
+      None if output.len() < expected.len() => {
+        failures.push(format!("{}: missing expected output {:?}", name, expected[output.len()]))
+      }
+      None => {}
+    }
+  }
+  assert!(failures.is_empty(), "\n{}", failures.join("\n"));
+}
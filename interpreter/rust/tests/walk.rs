@@ -0,0 +1,298 @@
+// walk.rs against real parses: a script with every kind of node in it, so a
+// walk that skips a child shows up as a kind never seen, and a constant
+// folder that has to leave the program doing what it did.
+
+mod common;
+
+use common::*;
+use lox::ast::*;
+use lox::lexer::*;
+use lox::minify::Minifier;
+use lox::parser::Parser;
+use lox::walk::{rewrite, walk, Rewriter, Visitor};
+use std::collections::BTreeSet;
+
+fn parse(source: &str) -> (Vec<Token>, Vec<Stmt>) {
+  let tokens = Lexer::new(source.to_string()).scan_tokens().clone();
+  let statements = Parser::new(tokens.clone()).parse().unwrap_or_else(|_| panic!("couldn't parse {:?}", source));
+  (tokens, statements)
+}
+
+// No wildcard arms, so a new kind of node doesn't compile until it's named
+// here, and then fails the test until the script has one
+fn stmt_kind(stmt: &Stmt) -> &'static str {
+  match stmt {
+    Stmt::Block(_) => "Block",
+    Stmt::Expression(_) => "Expression",
+    Stmt::Print(_) => "Print",
+    Stmt::Return(_) => "Return",
+    Stmt::Var(_) => "Var",
+    Stmt::Destructure(_) => "Destructure",
+    Stmt::Fun(_) => "Fun",
+    Stmt::If(_) => "If",
+    Stmt::While(_) => "While",
+    Stmt::For(_) => "For",
+    Stmt::Class(_) => "Class",
+    Stmt::Trait(_) => "Trait",
+    Stmt::Yield(_) => "Yield",
+    Stmt::ForIn(_) => "ForIn",
+    Stmt::DoWhile(_) => "DoWhile",
+    Stmt::Break(_) => "Break",
+    Stmt::Try(_) => "Try",
+    Stmt::Throw(_) => "Throw",
+    Stmt::Using(_) => "Using",
+  }
+}
+
+fn expr_kind(expr: &Expr) -> &'static str {
+  match expr {
+    Expr::Assign(_) => "Assign",
+    Expr::Binary(_) => "Binary",
+    Expr::Call(_) => "Call",
+    Expr::Get(_) => "Get",
+    Expr::Set(_) => "Set",
+    Expr::Grouping(_) => "Grouping",
+    Expr::Literal(_) => "Literal",
+    Expr::Unary(_) => "Unary",
+    Expr::Variable(_) => "Variable",
+    Expr::Logical(_) => "Logical",
+    Expr::Super(_) => "Super",
+    Expr::This(_) => "This",
+    Expr::List(_) => "List",
+    Expr::SetLiteral(_) => "SetLiteral",
+    Expr::MapLiteral(_) => "MapLiteral",
+    Expr::Index(_) => "Index",
+    Expr::IndexSet(_) => "IndexSet",
+    Expr::Spread(_) => "Spread",
+    Expr::DestructureAssign(_) => "DestructureAssign",
+    Expr::Interpolation(_) => "Interpolation",
+    Expr::OptionalGet(_) => "OptionalGet",
+    Expr::OptionalIndex(_) => "OptionalIndex",
+    Expr::OptionalChain(_) => "OptionalChain",
+    Expr::Match(_) => "Match",
+    Expr::Comparison(_) => "Comparison",
+  }
+}
+
+fn pattern_kind(pattern: &Pattern) -> &'static str {
+  match pattern {
+    Pattern::Wildcard => "Wildcard",
+    Pattern::Literal(_) => "Literal",
+    Pattern::Binding(_) => "Binding",
+    Pattern::List(_) => "List",
+    Pattern::Class(_) => "Class",
+    Pattern::Map(_) => "Map",
+  }
+}
+
+#[derive(Default)]
+struct Kinds {
+  stmts: BTreeSet<&'static str>,
+  exprs: BTreeSet<&'static str>,
+  patterns: BTreeSet<&'static str>,
+  functions: Vec<String>,
+  expr_count: usize,
+  // Every enter_ hook's node has to be left again
+  depth: i32,
+}
+
+impl Visitor for Kinds {
+  fn enter_stmt(&mut self, stmt: &Stmt) -> bool {
+    self.stmts.insert(stmt_kind(stmt));
+    self.depth += 1;
+    true
+  }
+
+  fn leave_stmt(&mut self, _stmt: &Stmt) {
+    self.depth -= 1;
+  }
+
+  fn enter_expr(&mut self, expr: &Expr) -> bool {
+    self.exprs.insert(expr_kind(expr));
+    self.expr_count += 1;
+    self.depth += 1;
+    true
+  }
+
+  fn leave_expr(&mut self, _expr: &Expr) {
+    self.depth -= 1;
+  }
+
+  fn enter_pattern(&mut self, pattern: &Pattern) -> bool {
+    self.patterns.insert(pattern_kind(pattern));
+    self.depth += 1;
+    true
+  }
+
+  fn leave_pattern(&mut self, _pattern: &Pattern) {
+    self.depth -= 1;
+  }
+
+  fn enter_function(&mut self, function: &FunStmt) -> bool {
+    self.functions.push(function.name.token.clone());
+    self.depth += 1;
+    true
+  }
+
+  fn leave_function(&mut self, _function: &FunStmt) {
+    self.depth -= 1;
+  }
+}
+
+const EVERY_KIND: &str = r#"
+trait Named { name(); }
+class Base { greet() { return "hi"; } }
+class Child < Base implements Named {
+  init(first) { this.first = first; }
+  name() { return super.greet() + this.first; }
+}
+fun count(limit = 2) { var i = 0; while (i < limit) { yield i; i = i + 1; } }
+var [a, b] = [1, 2];
+[a, b] = [b, a];
+var child = Child("x");
+var items = [1, #{2}, {"k": 3}, ...[4]];
+items[0] = -a;
+print child?.first, items?[0], "${a}", (a + b), 0 < a < 3, !(a and b or nil);
+print match (items) {
+  [1, _, {"k": k}, ...rest] if k == 3 => k,
+  Child { first: "x" } => 0,
+  x => x,
+};
+while (true) { if (a == 0) print a; else break; }
+for (n in count(limit: 2)) print n;
+do { a = a + 1; } while (a < 5);
+try { throw Child("y"); } catch (e: Child) { print e.name(); } finally { print "done"; }
+using (var r = child) { print r.first; }
+{ print items[1]; }
+"#;
+
+// The parser turns `for` into a while loop, so the script can't have a For
+// node; this builds `for (var k = 0; k < 1; k = k + 1) print k;` from parts
+fn for_stmt() -> Stmt {
+  let (_, mut parts) = parse("var k = 0; k < 1; k = k + 1; print k;");
+  let body = parts.pop().unwrap();
+  let mut expression = || match parts.pop() {
+    Some(Stmt::Expression(stmt)) => stmt.expression,
+    _ => unreachable!(),
+  };
+  let (increment, condition) = (expression(), expression());
+  let initializer = parts.pop().unwrap();
+  Stmt::For(ForStmt::new(Some(Box::new(initializer)), Some(condition), Some(increment), Box::new(body)))
+}
+
+#[test]
+fn walk_visits_every_kind_of_node() {
+  let (_, mut statements) = parse(EVERY_KIND);
+  statements.push(for_stmt());
+  let mut kinds = Kinds::default();
+  walk(&statements, &mut kinds);
+
+  let want_stmts = BTreeSet::from([
+    "Block", "Expression", "Print", "Return", "Var", "Destructure", "Fun", "If", "While", "For", "Class", "Trait",
+    "Yield", "ForIn", "DoWhile", "Break", "Try", "Throw", "Using",
+  ]);
+  let want_exprs = BTreeSet::from([
+    "Assign", "Binary", "Call", "Get", "Set", "Grouping", "Literal", "Unary", "Variable", "Logical", "Super", "This",
+    "List", "SetLiteral", "MapLiteral", "Index", "IndexSet", "Spread", "DestructureAssign", "Interpolation",
+    "OptionalGet", "OptionalIndex", "OptionalChain", "Match", "Comparison",
+  ]);
+  let want_patterns = BTreeSet::from(["Wildcard", "Literal", "Binding", "List", "Class", "Map"]);
+  assert_eq!(kinds.stmts, want_stmts);
+  assert_eq!(kinds.exprs, want_exprs);
+  assert_eq!(kinds.patterns, want_patterns);
+  assert_eq!(kinds.functions, ["greet", "init", "name", "count"]);
+  assert_eq!(kinds.depth, 0);
+}
+
+// A rewriter that changes nothing still rebuilds every node, and has to
+// give back the same program
+#[test]
+fn rewrite_rebuilds_every_kind_of_node() {
+  struct Identity(usize);
+
+  impl Rewriter for Identity {
+    fn rewrite_expr(&mut self, expr: Expr) -> Expr {
+      self.0 += 1;
+      expr
+    }
+  }
+
+  let (tokens, mut statements) = parse(EVERY_KIND);
+  statements.push(for_stmt());
+  let before = Minifier::new(&tokens).minify(&statements);
+  let mut kinds = Kinds::default();
+  walk(&statements, &mut kinds);
+  let mut identity = Identity(0);
+  let rewritten = rewrite(statements, &mut identity);
+  assert_eq!(Minifier::new(&tokens).minify(&rewritten), before);
+  // Every expression the walk saw but Child's superclass
+  assert_eq!(identity.0, kinds.expr_count - 1);
+}
+
+// Returning false from an enter_ hook skips the node's children
+#[test]
+fn walk_skips_children_when_told() {
+  struct TopLevel(usize);
+
+  impl Visitor for TopLevel {
+    fn enter_expr(&mut self, _expr: &Expr) -> bool {
+      self.0 += 1;
+      false
+    }
+  }
+
+  let (_, statements) = parse("print 1 + 2 * 3; print f(g(h()));");
+  let mut visitor = TopLevel(0);
+  walk(&statements, &mut visitor);
+  assert_eq!(visitor.0, 2);
+}
+
+// Folds arithmetic on two number literals into one, which works all the way
+// up a tree of them since the rewriter gets the children already folded
+struct ConstantFolder;
+
+impl Rewriter for ConstantFolder {
+  fn rewrite_expr(&mut self, expr: Expr) -> Expr {
+    let Expr::Binary(binary) = &expr else {
+      return expr;
+    };
+    let (Expr::Literal(left), Expr::Literal(right)) = (binary.left.as_ref(), binary.right.as_ref()) else {
+      return expr;
+    };
+    let (LoxValue::Integer(l), LoxValue::Integer(r)) = (&left.literal, &right.literal) else {
+      return expr;
+    };
+    let value = match binary.operator.token_type {
+      TokenType::Plus => l.checked_add(*r),
+      TokenType::Minus => l.checked_sub(*r),
+      TokenType::Star => l.checked_mul(*r),
+      _ => None,
+    };
+    match value {
+      Some(value) => Expr::Literal(LiteralExpr::new(TokenType::Number, LoxValue::Integer(value))),
+      None => expr,
+    }
+  }
+}
+
+#[test]
+fn rewrite_folds_constants_and_keeps_the_program_the_same() {
+  let source = "var x = 10;\nprint 1 + 2 * 3;\nprint x * (4 - 1);\nfun f() { return 2 * 3 + x; }\nprint f();\nprint \"a\" + \"b\";\n";
+  let (tokens, statements) = parse(source);
+  let folded = rewrite(statements, &mut ConstantFolder);
+  let folded_source = Minifier::new(&tokens).minify(&folded);
+  for literal in ["7", "6", "3"] {
+    assert!(folded_source.contains(literal), "{} isn't folded into {:?}", literal, folded_source);
+  }
+  assert!(!folded_source.contains("2*3"), "{:?} still multiplies constants", folded_source);
+
+  // The folded program parses back to itself and prints the same
+  let (tokens, reparsed) = parse(&folded_source);
+  assert_eq!(Minifier::new(&tokens).minify(&reparsed), folded_source);
+  let dir = scratch_dir("walk");
+  let before = lox(&write_script(&dir, "before.lox", source));
+  let after = lox(&write_script(&dir, "after.lox", &folded_source));
+  assert_eq!(before.code, EXIT_OK, "stderr {:?}", before.stderr);
+  assert_eq!(after.stdout, before.stdout);
+  assert_eq!(before.stdout, "7\n30\n16\nab\n");
+}